@@ -0,0 +1,197 @@
+// pi-track-agent reports which process holds each TCP and UDP port on this machine to
+// pi-track, so traffic the Pi captures for it, e.g. through a mirror port, is attributed
+// to processes here as it is for the Pi's own. It runs on Linux, macOS and Windows; run
+// it as root or Administrator to see other users' processes.
+//
+//	pi-track-agent -server http://raspberrypi.local:25565 -key ptk_...
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/user"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	psnet "github.com/shirou/gopsutil/v3/net"
+	"github.com/shirou/gopsutil/v3/process"
+)
+
+// socket and report match AgentSocket and AgentReport in pi-track
+type socket struct {
+	Protocol   string `json:"protocol"`
+	LocalIP    string `json:"localIp,omitempty"`
+	LocalPort  uint16 `json:"localPort"`
+	RemoteIP   string `json:"remoteIp,omitempty"`
+	RemotePort uint16 `json:"remotePort,omitempty"`
+	PID        int32  `json:"pid"`
+	Process    string `json:"process"`
+	Exe        string `json:"exe,omitempty"`
+	User       string `json:"user,omitempty"`
+}
+
+type report struct {
+	Hostname  string   `json:"hostname"`
+	OS        string   `json:"os"`
+	Addresses []string `json:"addresses"`
+	Sockets   []socket `json:"sockets"`
+}
+
+// processInfo is what's looked up once per PID
+type processInfo struct {
+	name, exe, user string
+}
+
+func main() {
+	server := flag.String("server", "", "pi-track's address, e.g. http://raspberrypi.local:25565")
+	key := flag.String("key", os.Getenv("PITRACK_AGENT_KEY"), "API key with the agent scope, or an API token (PITRACK_AGENT_KEY if empty)")
+	interval := flag.Duration("interval", 5*time.Second, "How often open sockets are reported")
+	hostname := flag.String("hostname", "", "Name processes are reported under, as in firefox@name (this machine's hostname if empty)")
+	flag.Parse()
+
+	if *server == "" {
+		log.Fatalf("-server is required")
+	}
+	if *interval < time.Second {
+		log.Fatalf("Invalid -interval %s (expected at least 1s)", *interval)
+	}
+	if *hostname == "" {
+		name, err := os.Hostname()
+		if err != nil {
+			log.Fatalf("Failed to get the hostname, set -hostname: %v", err)
+		}
+		*hostname = strings.Split(name, ".")[0]
+	}
+	url := strings.TrimSuffix(*server, "/") + "/api/agents/report"
+	client := &http.Client{Timeout: 10 * time.Second}
+
+	log.Printf("Reporting processes as %s to %s every %s", *hostname, *server, *interval)
+	processes := make(map[int32]processInfo)
+	failing := false
+	for {
+		r, err := collect(*hostname, processes)
+		if err == nil {
+			err = send(client, url, *key, r)
+		}
+		if err != nil && !failing {
+			log.Printf("Error reporting processes: %v", err)
+		} else if err == nil && failing {
+			log.Printf("Reporting processes works again")
+		}
+		failing = err != nil
+		time.Sleep(*interval)
+	}
+}
+
+// collect lists the open sockets and the processes holding them. Processes are looked up
+// once, and forgotten once they no longer hold a socket.
+func collect(hostname string, processes map[int32]processInfo) (report, error) {
+	r := report{Hostname: hostname, OS: runtime.GOOS, Addresses: []string{}, Sockets: []socket{}}
+	addrs, _ := net.InterfaceAddrs()
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && !ipnet.IP.IsLoopback() {
+			r.Addresses = append(r.Addresses, ipnet.IP.String())
+		}
+	}
+
+	conns, err := psnet.Connections("inet")
+	if err != nil {
+		return r, err
+	}
+	seen := make(map[int32]bool)
+	for _, c := range conns {
+		// Loopback sockets never reach the network
+		if ip := net.ParseIP(c.Laddr.IP); c.Pid <= 0 || c.Laddr.Port == 0 || (ip != nil && ip.IsLoopback()) {
+			continue
+		}
+		info, ok := processes[c.Pid]
+		if !ok {
+			info = lookupProcess(c.Pid)
+			processes[c.Pid] = info
+		}
+		seen[c.Pid] = true
+		if info.name == "" {
+			continue
+		}
+		// Listening and unconnected sockets have an unspecified remote address
+		remote := c.Raddr
+		if ip := net.ParseIP(remote.IP); ip == nil || ip.IsUnspecified() || remote.Port == 0 {
+			remote = psnet.Addr{}
+		}
+		protocol := "TCP"
+		if c.Type == syscall.SOCK_DGRAM {
+			protocol = "UDP"
+		}
+		r.Sockets = append(r.Sockets, socket{
+			Protocol:   protocol,
+			LocalIP:    c.Laddr.IP,
+			LocalPort:  uint16(c.Laddr.Port),
+			RemoteIP:   remote.IP,
+			RemotePort: uint16(remote.Port),
+			PID:        c.Pid,
+			Process:    info.name,
+			Exe:        info.exe,
+			User:       info.user,
+		})
+	}
+	for pid := range processes {
+		if !seen[pid] {
+			delete(processes, pid)
+		}
+	}
+	return r, nil
+}
+
+func lookupProcess(pid int32) processInfo {
+	proc, err := process.NewProcess(pid)
+	if err != nil {
+		return processInfo{}
+	}
+	var info processInfo
+	info.name, _ = proc.Name()
+	info.exe, _ = proc.Exe()
+	if name, err := proc.Username(); err == nil {
+		info.user = name
+	} else if uids, err := proc.Uids(); err == nil && len(uids) > 0 {
+		info.user = strconv.Itoa(int(uids[0]))
+		if u, err := user.LookupId(info.user); err == nil {
+			info.user = u.Username
+		}
+	}
+	return info
+}
+
+func send(client *http.Client, url, key string, r report) error {
+	body, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if key != "" {
+		req.Header.Set("Authorization", "Bearer "+key)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		var msg bytes.Buffer
+		msg.ReadFrom(resp.Body)
+		return fmt.Errorf("%s returned %s: %s", url, resp.Status, strings.TrimSpace(msg.String()))
+	}
+	return nil
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Remote agent settings
+const (
+	agentExpiry     = time.Minute // An agent not heard from for this long is ignored
+	agentForget     = time.Hour   // ... and for this long is forgotten
+	agentMax        = 256         // Agents reporting at once; new ones beyond this are refused
+	agentMaxSockets = 50000       // Sockets accepted in one report
+	agentMaxBody    = 8 << 20     // Bytes of one report
+)
+
+// agents holds the port-to-process mappings reported by other machines
+var agents = NewAgentRegistry()
+
+// AgentSocket is an open socket on an agent's machine and the process holding it
+type AgentSocket struct {
+	Protocol   string `json:"protocol"`          // TCP or UDP
+	LocalIP    string `json:"localIp,omitempty"` // Unspecified or "" for every address
+	LocalPort  uint16 `json:"localPort"`
+	RemoteIP   string `json:"remoteIp,omitempty"`
+	RemotePort uint16 `json:"remotePort,omitempty"`
+	PID        int32  `json:"pid"`
+	Process    string `json:"process"`
+	Exe        string `json:"exe,omitempty"`
+	User       string `json:"user,omitempty"`
+}
+
+// AgentReport is what pi-track-agent POSTs to /api/agents/report
+type AgentReport struct {
+	Hostname  string        `json:"hostname"`
+	OS        string        `json:"os"`
+	Addresses []string      `json:"addresses"` // The machine's own IPs
+	Sockets   []AgentSocket `json:"sockets"`
+}
+
+// Agent is a machine reporting its processes, for /api/agents
+type Agent struct {
+	Hostname     string    `json:"hostname"`
+	OS           string    `json:"os"`
+	Addresses    []string  `json:"addresses"`
+	ReportedFrom string    `json:"reportedFrom"`
+	LastReport   time.Time `json:"lastReport"`
+	Sockets      int       `json:"sockets"`
+	Active       bool      `json:"active"` // Reported within the last minute, so its mappings are used
+}
+
+// agentPort is a local port of one protocol on one of an agent's addresses
+type agentPort struct {
+	ip   string
+	udp  bool
+	port uint16
+}
+
+// agentState is the latest report from one machine
+type agentState struct {
+	info  Agent
+	ports map[agentPort]*AgentSocket
+}
+
+// AgentRegistry attributes traffic between other LAN machines and the network to the
+// processes on them, as reported every few seconds by pi-track-agent. It's the remote
+// counterpart of the ProcessTracker, for when the Pi sees other machines' traffic through
+// a mirror port or by being their router. Machines are told apart by hostname and the
+// address they report from, and each report replaces the machine's previous one; a
+// machine that stops reporting is ignored after a minute and forgotten after an hour,
+// and at most 256 are kept, so reports under ever new hostnames can't use up memory.
+type AgentRegistry struct {
+	mu     sync.RWMutex
+	agents map[agentID]*agentState
+	byIP   map[string]*agentState
+}
+
+// agentID identifies a reporting machine
+type agentID struct {
+	hostname string
+	from     string
+}
+
+// NewAgentRegistry creates a registry with no agents
+func NewAgentRegistry() *AgentRegistry {
+	return &AgentRegistry{agents: make(map[agentID]*agentState), byIP: make(map[string]*agentState)}
+}
+
+// agentNetworks returns the networks a machine reporting from an address may claim
+// addresses in: the Pi's own subnet it's on, or just its address if it's routed from
+// elsewhere. A machine reporting over loopback is the Pi itself, which may claim the Pi's
+// addresses.
+func agentNetworks(from net.IP) []*net.IPNet {
+	var networks []*net.IPNet
+	addrs, _ := net.InterfaceAddrs()
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok || ipnet.IP.IsLoopback() {
+			continue
+		}
+		if from.IsLoopback() {
+			networks = append(networks, &net.IPNet{IP: ipnet.IP, Mask: net.CIDRMask(len(ipnet.IP)*8, len(ipnet.IP)*8)})
+		} else if ipnet.Contains(from) {
+			networks = append(networks, ipnet)
+		}
+	}
+	if !from.IsLoopback() && len(networks) == 0 {
+		networks = append(networks, &net.IPNet{IP: from, Mask: net.CIDRMask(len(from)*8, len(from)*8)})
+	}
+	return networks
+}
+
+// Report stores a machine's sockets. from is the address the report came from, which
+// counts as one of the machine's addresses unless it's loopback. The other addresses it
+// reports are only taken on the Pi's subnet that from is on, and not while another
+// active agent holds them, so one machine can't have another's traffic attributed to it.
+func (ar *AgentRegistry) Report(report AgentReport, from string) error {
+	report.Hostname = strings.TrimSpace(report.Hostname)
+	if report.Hostname == "" {
+		return fmt.Errorf("hostname is required")
+	}
+	if len(report.Sockets) > agentMaxSockets {
+		return fmt.Errorf("too many sockets (%d, at most %d)", len(report.Sockets), agentMaxSockets)
+	}
+
+	fromIP := net.ParseIP(from)
+	if fromIP == nil {
+		return fmt.Errorf("invalid address %q", from)
+	}
+	networks := agentNetworks(fromIP)
+	addresses := []string{}
+	seen := make(map[string]bool)
+	for _, a := range append(report.Addresses, from) {
+		ip := net.ParseIP(a)
+		if ip == nil || ip.IsLoopback() || ip.IsUnspecified() || seen[ip.String()] {
+			continue
+		}
+		for _, network := range networks {
+			if network.Contains(ip) {
+				seen[ip.String()] = true
+				addresses = append(addresses, ip.String())
+				break
+			}
+		}
+	}
+
+	state := &agentState{
+		info: Agent{
+			Hostname:     report.Hostname,
+			OS:           report.OS,
+			Addresses:    addresses,
+			ReportedFrom: from,
+			LastReport:   time.Now(),
+			Sockets:      len(report.Sockets),
+		},
+		ports: make(map[agentPort]*AgentSocket),
+	}
+	for i := range report.Sockets {
+		s := &report.Sockets[i]
+		s.Protocol = strings.ToUpper(s.Protocol)
+		if (s.Protocol != "TCP" && s.Protocol != "UDP") || s.LocalPort == 0 || s.Process == "" {
+			continue
+		}
+		ips := addresses
+		if ip := net.ParseIP(s.LocalIP); ip != nil && !ip.IsUnspecified() {
+			ips = []string{ip.String()}
+		}
+		for _, ip := range ips {
+			key := agentPort{ip, s.Protocol == "UDP", s.LocalPort}
+			// A connected socket says more than the listening one sharing its port
+			if old, ok := state.ports[key]; !ok || old.RemoteIP == "" {
+				state.ports[key] = s
+			}
+		}
+	}
+
+	id := agentID{report.Hostname, from}
+	ar.mu.Lock()
+	defer ar.mu.Unlock()
+	for other, old := range ar.agents {
+		if other == id || time.Since(old.info.LastReport) > agentForget {
+			ar.removeLocked(other)
+		}
+	}
+	if len(ar.agents) >= agentMax {
+		return fmt.Errorf("too many agents (at most %d)", agentMax)
+	}
+	// Ports on addresses left to another agent are never looked up, so they can stay
+	held := addresses[:0]
+	for _, ip := range addresses {
+		if holder := ar.byIP[ip]; holder != nil && time.Since(holder.info.LastReport) <= agentExpiry {
+			continue
+		}
+		held = append(held, ip)
+		ar.byIP[ip] = state
+	}
+	state.info.Addresses = held
+	ar.agents[id] = state
+	return nil
+}
+
+// removeLocked forgets an agent and the addresses it holds. Must be called with ar.mu held.
+func (ar *AgentRegistry) removeLocked(id agentID) {
+	old := ar.agents[id]
+	if old == nil {
+		return
+	}
+	for _, ip := range old.info.Addresses {
+		if ar.byIP[ip] == old {
+			delete(ar.byIP, ip)
+		}
+	}
+	delete(ar.agents, id)
+}
+
+// Process returns the process an agent reported holding a local port on one of its
+// addresses, named "<process>@<hostname>", and the agent's hostname, or nil
+func (ar *AgentRegistry) Process(protocol, ip string, port uint16) (*ProcessInfo, string) {
+	if ar == nil || (protocol != "TCP" && protocol != "UDP") {
+		return nil, ""
+	}
+	ar.mu.RLock()
+	defer ar.mu.RUnlock()
+	state := ar.byIP[ip]
+	if state == nil || time.Since(state.info.LastReport) > agentExpiry {
+		return nil, ""
+	}
+	s := state.ports[agentPort{ip, protocol == "UDP", port}]
+	if s == nil {
+		return nil, ""
+	}
+	return &ProcessInfo{PID: s.PID, Name: s.Process + "@" + state.info.Hostname, User: s.User, Exe: s.Exe}, state.info.Hostname
+}
+
+// Agents returns the machines that have reported, most recent first
+func (ar *AgentRegistry) Agents() []Agent {
+	ar.mu.RLock()
+	list := make([]Agent, 0, len(ar.agents))
+	for _, state := range ar.agents {
+		a := state.info
+		a.Active = time.Since(a.LastReport) <= agentExpiry
+		list = append(list, a)
+	}
+	ar.mu.RUnlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].LastReport.After(list[j].LastReport) })
+	return list
+}
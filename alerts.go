@@ -0,0 +1,1112 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Metrics an alert rule can watch
+const (
+	alertMetricBps          = "bps"              // Bits per second
+	alertMetricPps          = "pps"              // Packets per second
+	alertMetricCountryBytes = "country_bytes"    // Bytes exchanged with a country during one evaluation
+	alertMetricLatency      = "latency_ms"       // Last probe round-trip time
+	alertMetricLoss         = "loss_percent"     // Probe loss over the recent window
+	alertMetricBytesDay     = "bytes_day"        // Bytes a device sent and received today
+	alertMetricBytesMonth   = "bytes_month"      // Bytes a device sent and received this calendar month
+	alertMetricAnonymizer   = "anonymizer_bytes" // Bytes exchanged with Tor exit nodes or VPN endpoints during one evaluation
+)
+
+var alertMetrics = map[string]bool{
+	alertMetricBps: true, alertMetricPps: true, alertMetricCountryBytes: true,
+	alertMetricLatency: true, alertMetricLoss: true,
+	alertMetricBytesDay: true, alertMetricBytesMonth: true, alertMetricAnonymizer: true,
+}
+
+// Alert severities, in increasing order
+const (
+	severityInfo     = "info"
+	severityWarning  = "warning"
+	severityCritical = "critical"
+)
+
+// Alert states
+const (
+	alertStateFiring   = "firing"
+	alertStateResolved = "resolved"
+)
+
+// alertEvalInterval is how often rules are evaluated; rates are averaged over it
+const alertEvalInterval = 5 * time.Second
+
+// alertMemoryHistory is how many alerts are kept when running without a database
+const alertMemoryHistory = 500
+
+// detectionQuietPeriod resolves a detection alert once it hasn't been raised again for this long
+const detectionQuietPeriod = 15 * time.Minute
+
+// AlertRule describes a condition to alert on
+type AlertRule struct {
+	ID        int64   `json:"id"`
+	Name      string  `json:"name"`
+	Metric    string  `json:"metric"`
+	Condition string  `json:"condition"` // One of >, >=, <, <=, ==, !=
+	Threshold float64 `json:"threshold"`
+	Duration  string  `json:"duration,omitempty"` // How long the condition must hold before firing, e.g. "5m"
+	// Scope narrows what is measured: empty for the whole network, "*" for each device
+	// (or country, or probe target) separately, or a specific IP, MAC, country code or probe target
+	Scope    string   `json:"scope,omitempty"`
+	Severity string   `json:"severity"`
+	Channels []string `json:"channels,omitempty"` // Notifiers to use, e.g. ["slack", "email"]; empty to route by severity
+	// How long after resolving before the rule can fire again for the same subject, e.g. "1h"
+	Cooldown string `json:"cooldown,omitempty"`
+	Enabled  bool   `json:"enabled"`
+
+	hold     time.Duration
+	cooldown time.Duration
+}
+
+// validate checks the rule and fills in defaults
+func (r *AlertRule) validate() error {
+	if !alertMetrics[r.Metric] {
+		return fmt.Errorf("unknown metric %q", r.Metric)
+	}
+	switch r.Condition {
+	case ">", ">=", "<", "<=", "==", "!=":
+	case "":
+		r.Condition = ">"
+	default:
+		return fmt.Errorf("unknown condition %q", r.Condition)
+	}
+	switch r.Severity {
+	case severityInfo, severityWarning, severityCritical:
+	case "":
+		r.Severity = severityWarning
+	default:
+		return fmt.Errorf("unknown severity %q", r.Severity)
+	}
+	if r.Metric == alertMetricCountryBytes && r.Scope == "" {
+		return fmt.Errorf("country_bytes rules need a country code or * as scope")
+	}
+	if (r.Metric == alertMetricBytesDay || r.Metric == alertMetricBytesMonth) && r.Scope == "" {
+		return fmt.Errorf("%s rules need a device MAC or IP, or * as scope", r.Metric)
+	}
+	r.hold = 0
+	if r.Duration != "" {
+		d, err := time.ParseDuration(r.Duration)
+		if err != nil || d < 0 {
+			return fmt.Errorf("invalid duration %q", r.Duration)
+		}
+		r.hold = d
+	}
+	r.cooldown = 0
+	if r.Cooldown != "" {
+		d, err := time.ParseDuration(r.Cooldown)
+		if err != nil || d < 0 {
+			return fmt.Errorf("invalid cooldown %q", r.Cooldown)
+		}
+		r.cooldown = d
+	}
+	if r.Name == "" {
+		r.Name = fmt.Sprintf("%s %s %g", r.Metric, r.Condition, r.Threshold)
+	}
+	channels := r.Channels[:0]
+	for _, c := range r.Channels {
+		if c = strings.ToLower(strings.TrimSpace(c)); c != "" {
+			channels = append(channels, c)
+		}
+	}
+	r.Channels = channels
+	return nil
+}
+
+// wantsChannel reports whether alerts from the rule go to the named notifier
+func (r *AlertRule) wantsChannel(name string) bool {
+	if len(r.Channels) == 0 {
+		return true
+	}
+	for _, c := range r.Channels {
+		if c == name {
+			return true
+		}
+	}
+	return false
+}
+
+// routedTo reports whether a severity route includes the named notifier
+func routedTo(channels []string, name string) bool {
+	for _, c := range channels {
+		if c == name {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseSeverityRoutes parses severity routing such as "critical=ntfy,email;info=mqtt"
+// into the notifiers each severity goes to
+func ParseSeverityRoutes(spec string) (map[string][]string, error) {
+	routes := make(map[string][]string)
+	for _, route := range strings.Split(spec, ";") {
+		if strings.TrimSpace(route) == "" {
+			continue
+		}
+		severity, channels, ok := strings.Cut(route, "=")
+		severity = strings.ToLower(strings.TrimSpace(severity))
+		if !ok {
+			return nil, fmt.Errorf("invalid route %q, expected severity=channel,...", route)
+		}
+		switch severity {
+		case severityInfo, severityWarning, severityCritical:
+		default:
+			return nil, fmt.Errorf("unknown severity %q", severity)
+		}
+		// An empty list is allowed, and keeps the severity off every notifier
+		routes[severity] = []string{}
+		for _, c := range strings.Split(channels, ",") {
+			if c = strings.ToLower(strings.TrimSpace(c)); c != "" {
+				routes[severity] = append(routes[severity], c)
+			}
+		}
+	}
+	return routes, nil
+}
+
+// matches reports whether value satisfies the rule's condition
+func (r *AlertRule) matches(value float64) bool {
+	switch r.Condition {
+	case ">":
+		return value > r.Threshold
+	case ">=":
+		return value >= r.Threshold
+	case "<":
+		return value < r.Threshold
+	case "<=":
+		return value <= r.Threshold
+	case "==":
+		return value == r.Threshold
+	case "!=":
+		return value != r.Threshold
+	}
+	return false
+}
+
+// Alert is one occurrence of a rule firing for a subject
+type Alert struct {
+	ID         int64      `json:"id"`
+	RuleID     int64      `json:"ruleId"` // 0 for alerts raised by detectors rather than rules
+	Rule       string     `json:"rule"`
+	Subject    string     `json:"subject"` // What the alert is about: "network", a device, a country...
+	Severity   string     `json:"severity"`
+	State      string     `json:"state"`
+	Value      float64    `json:"value"`
+	Message    string     `json:"message"`
+	StartedAt  time.Time  `json:"startedAt"`
+	ResolvedAt *time.Time `json:"resolvedAt,omitempty"`
+}
+
+// AlertNotifier delivers alert state changes to an external channel
+type AlertNotifier interface {
+	Name() string // Channel name rules select notifiers by, e.g. "email"
+	Notify(a Alert) error
+}
+
+// alertKey identifies an alert instance: one rule can fire for several subjects at once
+type alertKey struct {
+	ruleID  int64
+	subject string
+}
+
+// keyFor returns the key of an alert. Detection alerts have no rule ID, so their name is part of the key.
+func keyFor(a Alert) alertKey {
+	if a.RuleID == 0 {
+		return alertKey{0, a.Rule + "\x00" + a.Subject}
+	}
+	return alertKey{a.RuleID, a.Subject}
+}
+
+// alertWindow accumulates traffic between evaluations
+type alertWindow struct {
+	start     time.Time
+	packets   int64
+	bytes     int64
+	byIP      map[string]*rollupCounts
+	byDevice  map[string]*rollupCounts
+	byCountry map[string]*rollupCounts
+	// Traffic with Tor exit nodes or VPN endpoints, by device
+	anonymizer   rollupCounts
+	byAnonymizer map[string]*rollupCounts
+}
+
+func newAlertWindow() *alertWindow {
+	return &alertWindow{
+		start:        time.Now(),
+		byIP:         make(map[string]*rollupCounts),
+		byDevice:     make(map[string]*rollupCounts),
+		byCountry:    make(map[string]*rollupCounts),
+		byAnonymizer: make(map[string]*rollupCounts),
+	}
+}
+
+func addCounts(m map[string]*rollupCounts, key string, length int64) {
+	if key == "" {
+		return
+	}
+	c := m[key]
+	if c == nil {
+		c = &rollupCounts{}
+		m[key] = c
+	}
+	c.packets++
+	c.bytes += length
+}
+
+// AlertEngine evaluates alert rules against live traffic and probe results,
+// tracks which alerts are firing and hands state changes to notifiers
+type AlertEngine struct {
+	db     *Database
+	store  *PacketStore
+	prober *LatencyProber
+	usage  *UsageTracker
+
+	mu        sync.Mutex
+	persistMu sync.Mutex // Serializes database writes of alerts, which happen outside mu
+	rules     []AlertRule
+	window    *alertWindow
+	pending   map[alertKey]time.Time
+	firing    map[alertKey]*Alert
+	raised    map[alertKey]time.Time // When each firing detection alert was last raised
+	cooling   map[alertKey]time.Time // Until when resolved alerts of rules with a cooldown can't fire again
+	notifiers []AlertNotifier
+	routes    map[string][]string // Severity -> notifiers, for alerts whose rule doesn't list channels
+
+	// Used when running without a database
+	nextRuleID  int64
+	nextAlertID int64
+	history     []Alert
+}
+
+// NewAlertEngine creates an engine, loading rules and firing alerts from the database if there is one
+func NewAlertEngine(db *Database, store *PacketStore, prober *LatencyProber) (*AlertEngine, error) {
+	ae := &AlertEngine{
+		db:      db,
+		store:   store,
+		prober:  prober,
+		window:  newAlertWindow(),
+		pending: make(map[alertKey]time.Time),
+		firing:  make(map[alertKey]*Alert),
+		raised:  make(map[alertKey]time.Time),
+		cooling: make(map[alertKey]time.Time),
+	}
+
+	if db != nil {
+		rules, err := db.GetAlertRules()
+		if err != nil {
+			return nil, fmt.Errorf("loading alert rules: %v", err)
+		}
+		for i := range rules {
+			if err := rules[i].validate(); err != nil {
+				log.Printf("Warning: alert rule %q is invalid: %v", rules[i].Name, err)
+				rules[i].Enabled = false
+			}
+		}
+		ae.rules = rules
+
+		// Pick up alerts that were firing before a restart so they aren't raised twice
+		firing, err := db.GetAlerts(alertStateFiring, nil, nil, 0)
+		if err != nil {
+			return nil, fmt.Errorf("loading alerts: %v", err)
+		}
+		for i := range firing {
+			a := firing[i]
+			ae.firing[keyFor(a)] = &a
+			if a.RuleID == 0 {
+				ae.raised[keyFor(a)] = time.Now()
+			}
+		}
+	}
+
+	return ae, nil
+}
+
+// AddNotifier registers a channel that receives fired and resolved alerts
+func (ae *AlertEngine) AddNotifier(n AlertNotifier) {
+	ae.mu.Lock()
+	defer ae.mu.Unlock()
+	ae.notifiers = append(ae.notifiers, n)
+}
+
+// SetRoutes sets which notifiers each severity goes to. Severities without a route go
+// to every notifier, and rules that list channels use those instead.
+func (ae *AlertEngine) SetRoutes(routes map[string][]string) {
+	ae.mu.Lock()
+	defer ae.mu.Unlock()
+	ae.routes = routes
+}
+
+// SetUsageSource provides the per-device daily and monthly usage that data cap rules check
+func (ae *AlertEngine) SetUsageSource(u *UsageTracker) {
+	ae.mu.Lock()
+	defer ae.mu.Unlock()
+	ae.usage = u
+}
+
+// Start begins evaluating rules in the background
+func (ae *AlertEngine) Start() {
+	go func() {
+		ticker := time.NewTicker(alertEvalInterval)
+		for range ticker.C {
+			ae.evaluate()
+		}
+	}()
+}
+
+// Observe implements PacketObserver
+func (ae *AlertEngine) Observe(p Packet) {
+	length := int64(p.Length)
+
+	ae.mu.Lock()
+	defer ae.mu.Unlock()
+
+	w := ae.window
+	w.packets++
+	w.bytes += length
+	addCounts(w.byIP, p.SrcIP, length)
+	if p.DstIP != p.SrcIP {
+		addCounts(w.byIP, p.DstIP, length)
+	}
+	addCounts(w.byDevice, deviceKey(p.SrcMAC, p.SrcIP), length)
+	if classifyCast(p) == castUnicast {
+		addCounts(w.byDevice, deviceKey(p.DstMAC, p.DstIP), length)
+	}
+	if p.SrcCountry != "" && p.SrcCountry != "Local" {
+		addCounts(w.byCountry, p.SrcCountry, length)
+	}
+	if p.DstCountry != "" && p.DstCountry != "Local" && p.DstCountry != p.SrcCountry {
+		addCounts(w.byCountry, p.DstCountry, length)
+	}
+	if anonymizers.Kind(p.DstIP) != "" {
+		w.anonymizer.packets++
+		w.anonymizer.bytes += length
+		addCounts(w.byAnonymizer, deviceKey(p.SrcMAC, p.SrcIP), length)
+	} else if anonymizers.Kind(p.SrcIP) != "" {
+		w.anonymizer.packets++
+		w.anonymizer.bytes += length
+		addCounts(w.byAnonymizer, deviceKey(p.DstMAC, p.DstIP), length)
+	}
+}
+
+// alertValue is a metric measured for one subject
+type alertValue struct {
+	subject string
+	value   float64
+}
+
+// measure computes the rule's metric for each subject in scope
+func (ae *AlertEngine) measure(rule AlertRule, w *alertWindow, elapsed float64, probes []LatencySummary) []alertValue {
+	rate := func(c *rollupCounts) float64 {
+		if c == nil {
+			return 0
+		}
+		if rule.Metric == alertMetricBps {
+			return float64(c.bytes) * 8 / elapsed
+		}
+		return float64(c.packets) / elapsed
+	}
+
+	switch rule.Metric {
+	case alertMetricBps, alertMetricPps:
+		switch {
+		case rule.Scope == "":
+			return []alertValue{{"network", rate(&rollupCounts{packets: w.packets, bytes: w.bytes})}}
+		case rule.Scope == "*":
+			values := make([]alertValue, 0, len(w.byDevice))
+			for device, c := range w.byDevice {
+				values = append(values, alertValue{device, rate(c)})
+			}
+			return values
+		case net.ParseIP(rule.Scope) != nil:
+			return []alertValue{{rule.Scope, rate(w.byIP[rule.Scope])}}
+		default:
+			return []alertValue{{rule.Scope, rate(w.byDevice[strings.ToLower(rule.Scope)])}}
+		}
+
+	case alertMetricCountryBytes:
+		if rule.Scope == "*" {
+			values := make([]alertValue, 0, len(w.byCountry))
+			for country, c := range w.byCountry {
+				values = append(values, alertValue{country, float64(c.bytes)})
+			}
+			return values
+		}
+		country := strings.ToUpper(rule.Scope)
+		var bytes float64
+		if c := w.byCountry[country]; c != nil {
+			bytes = float64(c.bytes)
+		}
+		return []alertValue{{country, bytes}}
+
+	case alertMetricAnonymizer:
+		switch {
+		case rule.Scope == "":
+			return []alertValue{{"network", float64(w.anonymizer.bytes)}}
+		case rule.Scope == "*":
+			values := make([]alertValue, 0, len(w.byAnonymizer))
+			for device, c := range w.byAnonymizer {
+				values = append(values, alertValue{device, float64(c.bytes)})
+			}
+			return values
+		default:
+			device := strings.ToLower(rule.Scope)
+			var bytes float64
+			if c := w.byAnonymizer[device]; c != nil {
+				bytes = float64(c.bytes)
+			}
+			return []alertValue{{device, bytes}}
+		}
+
+	case alertMetricLatency, alertMetricLoss:
+		values := []alertValue{}
+		for _, s := range probes {
+			if rule.Scope != "" && rule.Scope != "*" && rule.Scope != s.Label && rule.Scope != s.IP {
+				continue
+			}
+			if len(s.Samples) == 0 {
+				continue
+			}
+			v := s.LossPercent
+			if rule.Metric == alertMetricLatency {
+				// A lost probe has no RTT; loss rules cover that case
+				if s.Samples[len(s.Samples)-1].Lost {
+					continue
+				}
+				v = s.LastRTTMs
+			}
+			values = append(values, alertValue{s.Label + " (" + s.IP + ")", v})
+		}
+		return values
+
+	case alertMetricBytesDay, alertMetricBytesMonth:
+		if ae.usage == nil {
+			return nil
+		}
+		period := usagePeriodDay
+		if rule.Metric == alertMetricBytesMonth {
+			period = usagePeriodMonth
+		}
+		if rule.Scope != "*" {
+			return []alertValue{{rule.Scope, float64(ae.usage.Bytes(period, rule.Scope))}}
+		}
+		usage, _ := ae.usage.Usage(period)
+		values := make([]alertValue, 0, len(usage))
+		for _, u := range usage {
+			values = append(values, alertValue{u.Device, float64(u.Bytes)})
+		}
+		return values
+	}
+	return nil
+}
+
+// evaluate checks every rule against the traffic seen since the last evaluation
+func (ae *AlertEngine) evaluate() {
+	var probes []LatencySummary
+	if ae.prober != nil {
+		probes = ae.prober.Summaries()
+	}
+
+	ae.mu.Lock()
+	w := ae.window
+	ae.window = newAlertWindow()
+	now := time.Now()
+	elapsed := now.Sub(w.start).Seconds()
+	if elapsed <= 0 {
+		elapsed = alertEvalInterval.Seconds()
+	}
+
+	var fired, resolved []*Alert
+	active := map[alertKey]bool{}
+
+	for _, rule := range ae.rules {
+		if !rule.Enabled {
+			continue
+		}
+		for _, v := range ae.measure(rule, w, elapsed, probes) {
+			key := alertKey{rule.ID, v.subject}
+			if !rule.matches(v.value) {
+				continue
+			}
+			active[key] = true
+
+			since, ok := ae.pending[key]
+			if !ok {
+				since = now
+				ae.pending[key] = since
+			}
+			if a := ae.firing[key]; a != nil {
+				a.Value = v.value
+				continue
+			}
+			if until, ok := ae.cooling[key]; ok {
+				if now.Before(until) {
+					continue
+				}
+				delete(ae.cooling, key)
+			}
+			if now.Sub(since) >= rule.hold {
+				a := &Alert{
+					RuleID:    rule.ID,
+					Rule:      rule.Name,
+					Subject:   v.subject,
+					Severity:  rule.Severity,
+					State:     alertStateFiring,
+					Value:     v.value,
+					Message:   fmt.Sprintf("%s: %s %s is %s (%s %s)", rule.Name, v.subject, rule.Metric, formatMetric(rule.Metric, v.value), rule.Condition, formatMetric(rule.Metric, rule.Threshold)),
+					StartedAt: since,
+				}
+				ae.firing[key] = a
+				fired = append(fired, a)
+			}
+		}
+	}
+
+	// A condition must hold at every evaluation to count toward its duration; subjects not
+	// measured at all, such as devices without traffic, start over too
+	for key := range ae.pending {
+		if !active[key] {
+			delete(ae.pending, key)
+		}
+	}
+
+	cooldowns := make(map[int64]time.Duration, len(ae.rules))
+	for _, rule := range ae.rules {
+		cooldowns[rule.ID] = rule.cooldown
+	}
+
+	// Anything firing whose condition no longer holds (or whose rule is gone) resolves,
+	// as do detection alerts that have gone quiet
+	for key, a := range ae.firing {
+		if a.RuleID == 0 {
+			if now.Sub(ae.raised[key]) < detectionQuietPeriod {
+				continue
+			}
+			delete(ae.raised, key)
+		} else if active[key] {
+			continue
+		}
+		delete(ae.firing, key)
+		delete(ae.pending, key)
+		if cooldown := cooldowns[a.RuleID]; cooldown > 0 {
+			ae.cooling[key] = now.Add(cooldown)
+		}
+		resolvedAt := now
+		a.State = alertStateResolved
+		a.ResolvedAt = &resolvedAt
+		resolved = append(resolved, a)
+	}
+
+	changed := append(fired, resolved...)
+	for _, a := range changed {
+		ae.record(a)
+	}
+	ae.mu.Unlock()
+
+	ae.persist(changed)
+	ae.dispatch(ae.snapshot(changed))
+}
+
+// Raise fires an alert from a detector (rogue DHCP, beaconing, ...) rather than a rule.
+// Raising the same name and subject again while it is firing only keeps it alive; it
+// resolves after detectionQuietPeriod without being raised.
+func (ae *AlertEngine) Raise(name, subject, severity, message string) {
+	ae.mu.Lock()
+	now := time.Now()
+	a := &Alert{
+		Rule:      name,
+		Subject:   subject,
+		Severity:  severity,
+		State:     alertStateFiring,
+		Message:   message,
+		StartedAt: now,
+	}
+	key := keyFor(*a)
+	ae.raised[key] = now
+	if ae.firing[key] != nil {
+		ae.mu.Unlock()
+		return
+	}
+	ae.firing[key] = a
+	ae.record(a)
+	ae.mu.Unlock()
+
+	ae.persist([]*Alert{a})
+	ae.dispatch(ae.snapshot([]*Alert{a}))
+}
+
+// Resolve ends a detection alert raised with Raise straight away, for detectors that
+// know when the condition is over (a device coming back online, ...)
+func (ae *AlertEngine) Resolve(name, subject string) {
+	ae.mu.Lock()
+	key := keyFor(Alert{Rule: name, Subject: subject})
+	a := ae.firing[key]
+	if a == nil {
+		ae.mu.Unlock()
+		return
+	}
+	delete(ae.firing, key)
+	delete(ae.raised, key)
+	resolvedAt := time.Now()
+	a.State = alertStateResolved
+	a.ResolvedAt = &resolvedAt
+	ae.record(a)
+	ae.mu.Unlock()
+
+	ae.persist([]*Alert{a})
+	ae.dispatch(ae.snapshot([]*Alert{a}))
+}
+
+// dispatch logs, broadcasts and notifies alert state changes
+func (ae *AlertEngine) dispatch(changes []Alert) {
+	ae.mu.Lock()
+	notifiers := ae.notifiers
+	routes := ae.routes
+	rules := make(map[int64]AlertRule, len(ae.rules))
+	for _, r := range ae.rules {
+		rules[r.ID] = r
+	}
+	ae.mu.Unlock()
+
+	for _, a := range changes {
+		if a.State == alertStateFiring {
+			log.Printf("Warning: alert firing: %s", a.Message)
+		} else {
+			log.Printf("Alert resolved: %s (%s)", a.Rule, a.Subject)
+		}
+		if ae.store != nil {
+			ae.store.Broadcast("alert", a)
+		}
+		for _, n := range notifiers {
+			// Rules that list channels override severity routing. Alerts of deleted
+			// rules resolve through the channels of their severity.
+			if rule, ok := rules[a.RuleID]; ok && len(rule.Channels) > 0 {
+				if !rule.wantsChannel(n.Name()) {
+					continue
+				}
+			} else if channels, ok := routes[a.Severity]; ok && !routedTo(channels, n.Name()) {
+				continue
+			}
+			go func(n AlertNotifier, a Alert) {
+				if err := n.Notify(a); err != nil {
+					log.Printf("Error sending alert via %s: %v", n.Name(), err)
+				}
+			}(n, a)
+		}
+	}
+}
+
+// snapshot copies alerts the engine may still change
+func (ae *AlertEngine) snapshot(alerts []*Alert) []Alert {
+	ae.mu.Lock()
+	defer ae.mu.Unlock()
+	copies := make([]Alert, len(alerts))
+	for i, a := range alerts {
+		copies[i] = *a
+	}
+	return copies
+}
+
+// persist writes new and resolved alerts to the database. It's called without ae.mu
+// held, so a slow or locked database holds up only the caller rather than Observe and
+// the capture loop; an alert gets its ID once it's inserted.
+func (ae *AlertEngine) persist(alerts []*Alert) {
+	if ae.db == nil {
+		return
+	}
+	ae.persistMu.Lock()
+	defer ae.persistMu.Unlock()
+	for _, p := range alerts {
+		ae.mu.Lock()
+		a := *p
+		ae.mu.Unlock()
+		if a.ID == 0 {
+			id, err := ae.db.InsertAlert(a)
+			if err != nil {
+				log.Printf("Database alert insert error: %v", err)
+				continue
+			}
+			ae.mu.Lock()
+			p.ID = id
+			ae.mu.Unlock()
+			// It may have resolved since, which only an update records
+			if a.State == alertStateFiring {
+				continue
+			}
+			a.ID = id
+		}
+		if err := ae.db.UpdateAlert(a); err != nil {
+			log.Printf("Database alert update error: %v", err)
+		}
+	}
+}
+
+// record keeps a new or resolved alert in memory when there's no database; persist
+// writes it otherwise. Must be called with ae.mu held.
+func (ae *AlertEngine) record(a *Alert) {
+	if ae.db != nil {
+		return
+	}
+
+	if a.ID == 0 {
+		ae.nextAlertID++
+		a.ID = ae.nextAlertID
+		ae.history = append(ae.history, *a)
+		if len(ae.history) > alertMemoryHistory {
+			ae.history = ae.history[len(ae.history)-alertMemoryHistory:]
+		}
+		return
+	}
+	for i := range ae.history {
+		if ae.history[i].ID == a.ID {
+			ae.history[i] = *a
+		}
+	}
+}
+
+// formatMetric renders a metric value with its unit
+func formatMetric(metric string, v float64) string {
+	switch metric {
+	case alertMetricBps:
+		switch {
+		case v >= 1e9:
+			return fmt.Sprintf("%.1f Gbps", v/1e9)
+		case v >= 1e6:
+			return fmt.Sprintf("%.1f Mbps", v/1e6)
+		case v >= 1e3:
+			return fmt.Sprintf("%.1f kbps", v/1e3)
+		}
+		return fmt.Sprintf("%.0f bps", v)
+	case alertMetricPps:
+		return fmt.Sprintf("%.0f pps", v)
+	case alertMetricCountryBytes, alertMetricBytesDay, alertMetricBytesMonth, alertMetricAnonymizer:
+		return formatBytes(int64(v))
+	case alertMetricLatency:
+		return fmt.Sprintf("%.1f ms", v)
+	case alertMetricLoss:
+		return fmt.Sprintf("%.0f%%", v)
+	}
+	return fmt.Sprintf("%g", v)
+}
+
+// Alerts returns alerts in the given state ("" for all) and time range, newest first
+func (ae *AlertEngine) Alerts(state string, startTime, endTime *time.Time, limit int) ([]Alert, error) {
+	if ae.db != nil {
+		return ae.db.GetAlerts(state, startTime, endTime, limit)
+	}
+
+	ae.mu.Lock()
+	defer ae.mu.Unlock()
+	alerts := []Alert{}
+	for i := len(ae.history) - 1; i >= 0; i-- {
+		a := ae.history[i]
+		if (state != "" && a.State != state) ||
+			(startTime != nil && a.StartedAt.Before(*startTime)) ||
+			(endTime != nil && a.StartedAt.After(*endTime)) {
+			continue
+		}
+		alerts = append(alerts, a)
+		if limit > 0 && len(alerts) >= limit {
+			break
+		}
+	}
+	return alerts, nil
+}
+
+// Rules returns the configured rules
+func (ae *AlertEngine) Rules() []AlertRule {
+	ae.mu.Lock()
+	defer ae.mu.Unlock()
+	return append([]AlertRule{}, ae.rules...)
+}
+
+// SaveRule adds a rule (ID 0) or replaces the rule with the same ID
+func (ae *AlertEngine) SaveRule(rule AlertRule) (AlertRule, error) {
+	if err := rule.validate(); err != nil {
+		return rule, err
+	}
+
+	ae.mu.Lock()
+	defer ae.mu.Unlock()
+
+	index := -1
+	for i, r := range ae.rules {
+		if rule.ID != 0 && r.ID == rule.ID {
+			index = i
+		}
+	}
+	if rule.ID != 0 && index < 0 {
+		return rule, fmt.Errorf("alert rule %d not found", rule.ID)
+	}
+
+	if ae.db != nil {
+		id, err := ae.db.SaveAlertRule(rule)
+		if err != nil {
+			return rule, err
+		}
+		rule.ID = id
+	} else if rule.ID == 0 {
+		ae.nextRuleID++
+		rule.ID = ae.nextRuleID
+	}
+
+	if index >= 0 {
+		ae.rules[index] = rule
+	} else {
+		ae.rules = append(ae.rules, rule)
+	}
+	return rule, nil
+}
+
+// DeleteRule removes a rule; alerts it has firing resolve on the next evaluation
+func (ae *AlertEngine) DeleteRule(id int64) error {
+	ae.mu.Lock()
+	defer ae.mu.Unlock()
+
+	for i, r := range ae.rules {
+		if r.ID != id {
+			continue
+		}
+		if ae.db != nil {
+			if err := ae.db.DeleteAlertRule(id); err != nil {
+				return err
+			}
+		}
+		ae.rules = append(ae.rules[:i], ae.rules[i+1:]...)
+		return nil
+	}
+	return fmt.Errorf("alert rule %d not found", id)
+}
+
+// ReplaceRules swaps the whole rule set, as used by configuration import
+func (ae *AlertEngine) ReplaceRules(rules []AlertRule) error {
+	for i := range rules {
+		if err := rules[i].validate(); err != nil {
+			return fmt.Errorf("rule %q: %v", rules[i].Name, err)
+		}
+	}
+	for _, r := range ae.Rules() {
+		if err := ae.DeleteRule(r.ID); err != nil {
+			return err
+		}
+	}
+	for _, r := range rules {
+		r.ID = 0
+		if _, err := ae.SaveRule(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LoadRulesFile adds or updates rules from a JSON file, matching existing rules by name
+func (ae *AlertEngine) LoadRulesFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var raw []json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return fmt.Errorf("parsing %s: %v", path, err)
+	}
+	// Rules are enabled unless the file says otherwise
+	rules := make([]AlertRule, len(raw))
+	for i := range raw {
+		rules[i].Enabled = true
+		if err := json.Unmarshal(raw[i], &rules[i]); err != nil {
+			return fmt.Errorf("parsing %s: %v", path, err)
+		}
+	}
+
+	existing := map[string]int64{}
+	for _, r := range ae.Rules() {
+		existing[r.Name] = r.ID
+	}
+	for _, r := range rules {
+		r.ID = existing[r.Name]
+		if _, err := ae.SaveRule(r); err != nil {
+			return fmt.Errorf("rule %q: %v", r.Name, err)
+		}
+	}
+	log.Printf("Loaded %d alert rules from %s", len(rules), path)
+	return nil
+}
+
+func createAlertTables(db *sql.DB) error {
+	schema := `
+	CREATE TABLE IF NOT EXISTS alert_rules (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL,
+		metric TEXT NOT NULL,
+		condition TEXT NOT NULL,
+		threshold REAL NOT NULL,
+		duration TEXT,
+		scope TEXT,
+		severity TEXT NOT NULL,
+		channels TEXT,
+		cooldown TEXT,
+		enabled INTEGER DEFAULT 1
+	);
+
+	CREATE TABLE IF NOT EXISTS alerts (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		rule_id INTEGER,
+		rule_name TEXT,
+		subject TEXT,
+		severity TEXT,
+		state TEXT NOT NULL,
+		value REAL,
+		message TEXT,
+		started_at INTEGER NOT NULL,
+		resolved_at INTEGER
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_alerts_started_at ON alerts(started_at);
+	CREATE INDEX IF NOT EXISTS idx_alerts_state ON alerts(state);
+	`
+
+	if _, err := db.Exec(schema); err != nil {
+		return fmt.Errorf("failed to create alert schema: %v", err)
+	}
+
+	// Migration: Add cooldown column if it doesn't exist
+	db.Exec("ALTER TABLE alert_rules ADD COLUMN cooldown TEXT")
+	return nil
+}
+
+// GetAlertRules returns every stored alert rule
+func (d *Database) GetAlertRules() ([]AlertRule, error) {
+	rows, err := d.db.Query("SELECT id, name, metric, condition, threshold, duration, scope, severity, channels, cooldown, enabled FROM alert_rules ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rules := []AlertRule{}
+	for rows.Next() {
+		var r AlertRule
+		var duration, scope, channels, cooldown sql.NullString
+		if err := rows.Scan(&r.ID, &r.Name, &r.Metric, &r.Condition, &r.Threshold, &duration, &scope, &r.Severity, &channels, &cooldown, &r.Enabled); err != nil {
+			return nil, err
+		}
+		r.Duration = duration.String
+		r.Scope = scope.String
+		r.Cooldown = cooldown.String
+		if channels.String != "" {
+			r.Channels = strings.Split(channels.String, ",")
+		}
+		rules = append(rules, r)
+	}
+	return rules, rows.Err()
+}
+
+// SaveAlertRule inserts a rule (ID 0) or updates an existing one, returning its ID
+func (d *Database) SaveAlertRule(r AlertRule) (int64, error) {
+	if r.ID == 0 {
+		res, err := d.db.Exec(`
+			INSERT INTO alert_rules (name, metric, condition, threshold, duration, scope, severity, channels, cooldown, enabled)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		`, r.Name, r.Metric, r.Condition, r.Threshold, r.Duration, r.Scope, r.Severity, strings.Join(r.Channels, ","), r.Cooldown, r.Enabled)
+		if err != nil {
+			return 0, err
+		}
+		return res.LastInsertId()
+	}
+
+	_, err := d.db.Exec(`
+		UPDATE alert_rules SET name = ?, metric = ?, condition = ?, threshold = ?, duration = ?, scope = ?, severity = ?, channels = ?, cooldown = ?, enabled = ?
+		WHERE id = ?
+	`, r.Name, r.Metric, r.Condition, r.Threshold, r.Duration, r.Scope, r.Severity, strings.Join(r.Channels, ","), r.Cooldown, r.Enabled, r.ID)
+	return r.ID, err
+}
+
+// DeleteAlertRule removes a rule
+func (d *Database) DeleteAlertRule(id int64) error {
+	_, err := d.db.Exec("DELETE FROM alert_rules WHERE id = ?", id)
+	return err
+}
+
+// InsertAlert stores a newly fired alert and returns its ID
+func (d *Database) InsertAlert(a Alert) (int64, error) {
+	res, err := d.db.Exec(`
+		INSERT INTO alerts (rule_id, rule_name, subject, severity, state, value, message, started_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	`, a.RuleID, a.Rule, a.Subject, a.Severity, a.State, a.Value, a.Message, a.StartedAt.Unix())
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+// UpdateAlert records an alert's state change
+func (d *Database) UpdateAlert(a Alert) error {
+	var resolvedAt interface{}
+	if a.ResolvedAt != nil {
+		resolvedAt = a.ResolvedAt.Unix()
+	}
+	_, err := d.db.Exec("UPDATE alerts SET state = ?, value = ?, resolved_at = ? WHERE id = ?",
+		a.State, a.Value, resolvedAt, a.ID)
+	return err
+}
+
+// GetAlerts returns alerts in the given state ("" for all) that started in the time range, newest first
+func (d *Database) GetAlerts(state string, startTime, endTime *time.Time, limit int) ([]Alert, error) {
+	query := "SELECT id, rule_id, rule_name, subject, severity, state, value, message, started_at, resolved_at FROM alerts WHERE 1=1"
+	args := []interface{}{}
+	if state != "" {
+		query += " AND state = ?"
+		args = append(args, state)
+	}
+	if startTime != nil {
+		query += " AND started_at >= ?"
+		args = append(args, startTime.Unix())
+	}
+	if endTime != nil {
+		query += " AND started_at <= ?"
+		args = append(args, endTime.Unix())
+	}
+	query += " ORDER BY started_at DESC, id DESC"
+	if limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, limit)
+	}
+
+	rows, err := d.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	alerts := []Alert{}
+	for rows.Next() {
+		var a Alert
+		var started int64
+		var resolved sql.NullInt64
+		var message sql.NullString
+		if err := rows.Scan(&a.ID, &a.RuleID, &a.Rule, &a.Subject, &a.Severity, &a.State, &a.Value, &message, &started, &resolved); err != nil {
+			return nil, err
+		}
+		a.Message = message.String
+		a.StartedAt = time.Unix(started, 0)
+		if resolved.Valid {
+			t := time.Unix(resolved.Int64, 0)
+			a.ResolvedAt = &t
+		}
+		alerts = append(alerts, a)
+	}
+	return alerts, rows.Err()
+}
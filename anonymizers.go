@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Anonymizer lists. No one publishes the egress ranges of commercial VPNs, so the VPN list
+// is a community-maintained one, replaceable with -vpn-ranges-url.
+const (
+	torExitListURL    = "https://check.torproject.org/torbulkexitlist"
+	vpnRangesURL      = "https://raw.githubusercontent.com/X4BNet/lists_vpn/main/output/vpn/ipv4.txt"
+	anonymizerRetry   = 15 * time.Minute // After a failed download
+	anonymizerKindTor = "tor"
+	anonymizerKindVPN = "vpn"
+)
+
+// anonymizers spots Tor and VPN traffic, nil without -anonymizers
+var anonymizers *Anonymizers
+
+// AnonymizerHit is traffic between one device and Tor exit nodes or VPN endpoints
+type AnonymizerHit struct {
+	Kind      string    `json:"kind"`     // "tor" or "vpn"
+	Device    string    `json:"device"`   // MAC address, or IP when there is no Ethernet header
+	DeviceIP  string    `json:"deviceIp"` // Last LAN address seen
+	RemoteIP  string    `json:"remoteIp"` // Last exit node or endpoint seen
+	Bytes     int64     `json:"bytes"`
+	Packets   int64     `json:"packets"`
+	FirstSeen time.Time `json:"firstSeen"`
+	LastSeen  time.Time `json:"lastSeen"`
+}
+
+// anonymizerList is one list and where it comes from
+type anonymizerList struct {
+	kind string
+	url  string
+}
+
+// anonymizerTable is the lists as of their last download, remembering what each address
+// turned out to be since packets keep asking about the same ones
+type anonymizerTable struct {
+	ranges *cloudTable
+	kinds  sync.Map
+}
+
+// Anonymizers downloads the Tor Project's list of exit nodes and a list of commercial VPN
+// egress ranges, again every refresh, and flags traffic to and from them: talkers are
+// tagged, each device's traffic with them is tallied, and anonymizer_bytes alert rules
+// can fire on it. A list whose download fails keeps the addresses it had.
+type Anonymizers struct {
+	lists   []anonymizerList
+	refresh time.Duration
+	client  *http.Client
+
+	table atomic.Pointer[anonymizerTable]
+
+	mu       sync.Mutex
+	prefixes map[string][]cloudPrefix // Last good download of each list
+	status   map[string]*RangeListStatus
+	hits     map[string]*AnonymizerHit // Keyed by device and kind
+}
+
+// NewAnonymizers creates the lists for a comma-separated list of kinds: tor and vpn
+func NewAnonymizers(kinds, vpnURL string, refresh time.Duration) (*Anonymizers, error) {
+	a := &Anonymizers{
+		refresh:  refresh,
+		client:   &http.Client{Timeout: 60 * time.Second},
+		prefixes: make(map[string][]cloudPrefix),
+		status:   make(map[string]*RangeListStatus),
+		hits:     make(map[string]*AnonymizerHit),
+	}
+	for _, kind := range strings.Split(kinds, ",") {
+		kind = strings.ToLower(strings.TrimSpace(kind))
+		if kind == "" || a.status[kind] != nil {
+			continue
+		}
+		switch kind {
+		case anonymizerKindTor:
+			a.lists = append(a.lists, anonymizerList{kind, torExitListURL})
+		case anonymizerKindVPN:
+			if vpnURL == "" {
+				return nil, fmt.Errorf("vpn needs -vpn-ranges-url")
+			}
+			a.lists = append(a.lists, anonymizerList{kind, vpnURL})
+		default:
+			return nil, fmt.Errorf("unknown list %q (expected tor or vpn)", kind)
+		}
+		a.status[kind] = &RangeListStatus{}
+	}
+	a.table.Store(&anonymizerTable{ranges: &cloudTable{}})
+	return a, nil
+}
+
+// Start downloads the lists in the background, then again every refresh
+func (a *Anonymizers) Start() {
+	go func() {
+		for {
+			wait := a.refresh
+			if !a.update() {
+				wait = anonymizerRetry
+			}
+			time.Sleep(wait)
+		}
+	}()
+}
+
+// update downloads every list and rebuilds the table, reporting whether all succeeded
+func (a *Anonymizers) update() bool {
+	ok := true
+	for _, l := range a.lists {
+		prefixes, err := downloadRangeList(a.client, l.url, parseAddressList)
+		a.mu.Lock()
+		s := a.status[l.kind]
+		if err != nil {
+			s.Error = err.Error()
+			ok = false
+		} else {
+			now := time.Now()
+			a.prefixes[l.kind] = prefixes
+			s.Prefixes, s.UpdatedAt, s.Error = len(prefixes), &now, ""
+		}
+		a.mu.Unlock()
+		if err != nil {
+			log.Printf("Warning: failed to download the %s list: %v", l.kind, err)
+		}
+	}
+
+	t := &anonymizerTable{ranges: &cloudTable{}}
+	a.mu.Lock()
+	for _, l := range a.lists {
+		for _, prefix := range a.prefixes[l.kind] {
+			t.ranges.add(l.kind, prefix)
+		}
+	}
+	a.mu.Unlock()
+	t.ranges.finish()
+	a.table.Store(t)
+	return ok
+}
+
+// parseAddressList reads a plain list of addresses or CIDRs, one a line, skipping comments
+func parseAddressList(body []byte) ([]cloudPrefix, error) {
+	prefixes := []cloudPrefix{}
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexAny(line, "#;"); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if !strings.Contains(line, "/") {
+			if strings.Contains(line, ":") {
+				line += "/128"
+			} else {
+				line += "/32"
+			}
+		}
+		prefixes = append(prefixes, cloudPrefix{cidr: line})
+	}
+	return prefixes, scanner.Err()
+}
+
+// Kind returns "tor" or "vpn" for an address on the lists, or "" if it isn't on them
+func (a *Anonymizers) Kind(ip string) string {
+	if a == nil || ip == "" {
+		return ""
+	}
+	t := a.table.Load()
+	if kind, ok := t.kinds.Load(ip); ok {
+		return kind.(string)
+	}
+	kind := ""
+	if parsed := net.ParseIP(ip); parsed != nil {
+		if tag := t.ranges.lookup(parsed); tag != nil {
+			kind = tag.Provider
+		}
+	}
+	t.kinds.Store(ip, kind)
+	return kind
+}
+
+// Observe implements PacketObserver
+func (a *Anonymizers) Observe(p Packet) {
+	// The exit node or endpoint is the remote side, the local side is the device
+	var kind, remoteIP, deviceMAC, deviceIP string
+	if kind = a.Kind(p.DstIP); kind != "" {
+		remoteIP, deviceMAC, deviceIP = p.DstIP, p.SrcMAC, p.SrcIP
+	} else if kind = a.Kind(p.SrcIP); kind != "" {
+		remoteIP, deviceMAC, deviceIP = p.SrcIP, p.DstMAC, p.DstIP
+	} else {
+		return
+	}
+
+	device := deviceKey(deviceMAC, deviceIP)
+	key := device + "|" + kind
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	h := a.hits[key]
+	if h == nil {
+		h = &AnonymizerHit{Kind: kind, Device: device, FirstSeen: p.Timestamp}
+		a.hits[key] = h
+	}
+	h.DeviceIP = deviceIP
+	h.RemoteIP = remoteIP
+	h.Bytes += int64(p.Length)
+	h.Packets++
+	h.LastSeen = p.Timestamp
+}
+
+// Hits returns the traffic with anonymizers since startup, most bytes first
+func (a *Anonymizers) Hits() []AnonymizerHit {
+	hits := []AnonymizerHit{}
+	if a == nil {
+		return hits
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, h := range a.hits {
+		hits = append(hits, *h)
+	}
+	sort.Slice(hits, func(i, j int) bool {
+		return hits[i].Bytes > hits[j].Bytes
+	})
+	return hits
+}
+
+// Status reports each list's last download
+func (a *Anonymizers) Status() map[string]RangeListStatus {
+	status := make(map[string]RangeListStatus)
+	if a == nil {
+		return status
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for kind, s := range a.status {
+		status[kind] = *s
+	}
+	return status
+}
@@ -0,0 +1,421 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// apiKeysSetting is where API keys are persisted, as hashes
+const apiKeysSetting = "api_keys"
+
+// apiKeyPrefix starts every generated key, so leaked keys are easy to search for
+const apiKeyPrefix = "ptk_"
+
+// API key scopes
+const (
+	scopeReadPackets = "read:packets" // Individual packets, connections and lookups, live and stored
+	scopeReadStats   = "read:stats"   // Statistics, rankings, devices and other aggregates
+	scopeAgent       = "agent"        // Reporting a machine's processes, for pi-track-agent
+	scopeAdmin       = "admin"        // Everything, including changes and configuration
+)
+
+var apiKeyScopes = map[string]bool{scopeReadPackets: true, scopeReadStats: true, scopeAgent: true, scopeAdmin: true}
+
+// errUnknownAPIKey is returned for key IDs that don't exist
+var errUnknownAPIKey = errors.New("unknown API key")
+
+// Paths by the scope they need for reading; anything changed needs admin. A path covers
+// everything below it.
+var (
+	adminScopePaths   = []string{"/api/config", "/api/keys", "/api/database/backup", "/api/logs", "/api/clients"}
+	statsScopePaths   = []string{"/api/history/stats", "/api/history/talkers", "/api/history/devices", "/api/dns/tunneling"}
+	packetScopePaths  = []string{"/api/packets", "/api/search", "/api/history", "/api/dns", "/api/connections", "/api/sessions", "/ws", "/events"}
+	grpcPacketMethods = map[string]bool{"SubscribePackets": true, "SubscribeFlows": true}
+)
+
+// APIKey is a key scripts and integrations authenticate with, limited to some scopes and
+// optionally to a number of requests per minute
+type APIKey struct {
+	ID        string     `json:"id"`
+	Name      string     `json:"name"`
+	Prefix    string     `json:"prefix"` // Start of the key, to tell keys apart
+	Scopes    []string   `json:"scopes"`
+	RateLimit int        `json:"rateLimit"` // Requests per minute; 0 for no limit
+	Created   time.Time  `json:"created"`
+	LastUsed  *time.Time `json:"lastUsed,omitempty"` // Since startup
+}
+
+// storedAPIKey is an API key as persisted and exported
+type storedAPIKey struct {
+	APIKey
+	Hash string `json:"hash"` // Hex SHA-256 of the key
+}
+
+// apiKeyEntry is a loaded key with its rate limiter state
+type apiKeyEntry struct {
+	APIKey
+	hash [32]byte
+
+	tokens   float64 // Requests that can be made right away
+	refilled time.Time
+}
+
+// APIKeyStore holds the API keys, creating, changing and checking them
+type APIKeyStore struct {
+	db *Database
+
+	mu     sync.Mutex
+	keys   map[string]*apiKeyEntry   // ID -> key
+	byHash map[[32]byte]*apiKeyEntry // SHA-256 of the key -> key
+}
+
+// NewAPIKeyStore creates a store, loading the saved keys
+func NewAPIKeyStore(db *Database) *APIKeyStore {
+	s := &APIKeyStore{
+		db:     db,
+		keys:   make(map[string]*apiKeyEntry),
+		byHash: make(map[[32]byte]*apiKeyEntry),
+	}
+	if db != nil {
+		if value, ok, err := db.GetSetting(apiKeysSetting); err == nil && ok {
+			var stored []storedAPIKey
+			if err := json.Unmarshal([]byte(value), &stored); err != nil {
+				log.Printf("Warning: ignoring saved API keys: %v", err)
+			} else if err := s.replaceLocked(stored); err != nil {
+				log.Printf("Warning: ignoring saved API keys: %v", err)
+			}
+		}
+	}
+	return s
+}
+
+// Len returns how many keys there are
+func (s *APIKeyStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.keys)
+}
+
+// List returns every key, oldest first, without the keys themselves
+func (s *APIKeyStore) List() []APIKey {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keys := make([]APIKey, 0, len(s.keys))
+	for _, k := range s.keys {
+		keys = append(keys, k.APIKey)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Created.Before(keys[j].Created) })
+	return keys
+}
+
+// validateAPIKey checks a key's name, scopes and rate limit, normalizing them
+func validateAPIKey(k *APIKey) error {
+	k.Name = strings.TrimSpace(k.Name)
+	if k.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	if len(k.Name) > 64 {
+		return fmt.Errorf("name is longer than 64 characters")
+	}
+	if len(k.Scopes) == 0 {
+		return fmt.Errorf("at least one scope is required (read:packets, read:stats, agent or admin)")
+	}
+	seen := make(map[string]bool)
+	scopes := make([]string, 0, len(k.Scopes))
+	for _, scope := range k.Scopes {
+		scope = strings.ToLower(strings.TrimSpace(scope))
+		if !apiKeyScopes[scope] {
+			return fmt.Errorf("unknown scope %q (expected read:packets, read:stats, agent or admin)", scope)
+		}
+		if !seen[scope] {
+			seen[scope] = true
+			scopes = append(scopes, scope)
+		}
+	}
+	sort.Strings(scopes)
+	k.Scopes = scopes
+	if k.RateLimit < 0 {
+		return fmt.Errorf("rateLimit can't be negative")
+	}
+	return nil
+}
+
+// Create adds a key, returning it with the key itself, which isn't kept and can't be
+// shown again
+func (s *APIKeyStore) Create(k APIKey) (APIKey, string, error) {
+	if s.db == nil {
+		return APIKey{}, "", fmt.Errorf("API keys need the database")
+	}
+	if err := validateAPIKey(&k); err != nil {
+		return APIKey{}, "", err
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return APIKey{}, "", err
+	}
+	secret := apiKeyPrefix + hex.EncodeToString(b)
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return APIKey{}, "", err
+	}
+	k.ID = hex.EncodeToString(id)
+	k.Prefix = secret[:len(apiKeyPrefix)+6]
+	k.Created = time.Now().UTC()
+	k.LastUsed = nil
+
+	entry := &apiKeyEntry{APIKey: k, hash: sha256.Sum256([]byte(secret))}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys[k.ID] = entry
+	s.byHash[entry.hash] = entry
+	if err := s.saveLocked(); err != nil {
+		delete(s.keys, k.ID)
+		delete(s.byHash, entry.hash)
+		return APIKey{}, "", err
+	}
+	return k, secret, nil
+}
+
+// Update changes a key's name, scopes and rate limit
+func (s *APIKeyStore) Update(id string, k APIKey) (APIKey, error) {
+	if err := validateAPIKey(&k); err != nil {
+		return APIKey{}, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry := s.keys[id]
+	if entry == nil {
+		return APIKey{}, errUnknownAPIKey
+	}
+	entry.Name, entry.Scopes = k.Name, k.Scopes
+	if entry.RateLimit != k.RateLimit {
+		entry.RateLimit = k.RateLimit
+		entry.refilled = time.Time{}
+	}
+	return entry.APIKey, s.saveLocked()
+}
+
+// Delete revokes a key
+func (s *APIKeyStore) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry := s.keys[id]
+	if entry == nil {
+		return errUnknownAPIKey
+	}
+	delete(s.keys, id)
+	delete(s.byHash, entry.hash)
+	return s.saveLocked()
+}
+
+// Stored returns the keys as persisted, for configuration bundles
+func (s *APIKeyStore) Stored() []storedAPIKey {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.storedLocked()
+}
+
+// storedLocked returns the keys as persisted, oldest first. Must be called with s.mu held.
+func (s *APIKeyStore) storedLocked() []storedAPIKey {
+	stored := make([]storedAPIKey, 0, len(s.keys))
+	for _, k := range s.keys {
+		key := k.APIKey
+		key.LastUsed = nil
+		stored = append(stored, storedAPIKey{APIKey: key, Hash: hex.EncodeToString(k.hash[:])})
+	}
+	sort.Slice(stored, func(i, j int) bool { return stored[i].Created.Before(stored[j].Created) })
+	return stored
+}
+
+// SetStored replaces every key, as when a configuration bundle is imported
+func (s *APIKeyStore) SetStored(stored []storedAPIKey) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.replaceLocked(stored); err != nil {
+		return err
+	}
+	return s.saveLocked()
+}
+
+// replaceLocked loads persisted keys in place of the current ones. Must be called with
+// s.mu held.
+func (s *APIKeyStore) replaceLocked(stored []storedAPIKey) error {
+	keys := make(map[string]*apiKeyEntry, len(stored))
+	byHash := make(map[[32]byte]*apiKeyEntry, len(stored))
+	for _, sk := range stored {
+		k := sk.APIKey
+		if err := validateAPIKey(&k); err != nil {
+			return fmt.Errorf("key %s: %v", k.ID, err)
+		}
+		hash, err := hex.DecodeString(sk.Hash)
+		if err != nil || len(hash) != sha256.Size || k.ID == "" {
+			return fmt.Errorf("key %q is incomplete", k.Name)
+		}
+		k.LastUsed = nil
+		entry := &apiKeyEntry{APIKey: k}
+		copy(entry.hash[:], hash)
+		keys[k.ID] = entry
+		byHash[entry.hash] = entry
+	}
+	s.keys, s.byHash = keys, byHash
+	return nil
+}
+
+// saveLocked persists the keys. Must be called with s.mu held.
+func (s *APIKeyStore) saveLocked() error {
+	if s.db == nil {
+		return nil
+	}
+	data, _ := json.Marshal(s.storedLocked())
+	return s.db.SetSetting(apiKeysSetting, string(data))
+}
+
+// hasAdmin reports whether any key has the admin scope
+func (s *APIKeyStore) hasAdmin() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, k := range s.keys {
+		if k.hasScope(scopeAdmin) {
+			return true
+		}
+	}
+	return false
+}
+
+// lookup returns the key a secret belongs to, or nil
+func (s *APIKeyStore) lookup(secret string) *apiKeyEntry {
+	if !strings.HasPrefix(secret, apiKeyPrefix) {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.byHash[sha256.Sum256([]byte(secret))]
+}
+
+// admit checks that a key has the scope a request needs and is within its rate limit,
+// returning the status to refuse the request with, or 0
+func (s *APIKeyStore) admit(k *apiKeyEntry, scope string) (int, time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if scope != "" && !k.hasScope(scope) {
+		return http.StatusForbidden, 0, fmt.Errorf("API key %q lacks the %s scope", k.Name, scope)
+	}
+
+	now := time.Now()
+	if k.RateLimit > 0 {
+		// A bucket of a minute's requests, refilled continuously
+		limit := float64(k.RateLimit)
+		if k.refilled.IsZero() {
+			k.tokens = limit
+		} else {
+			k.tokens += now.Sub(k.refilled).Minutes() * limit
+			if k.tokens > limit {
+				k.tokens = limit
+			}
+		}
+		k.refilled = now
+		if k.tokens < 1 {
+			wait := time.Duration((1 - k.tokens) / limit * float64(time.Minute))
+			return http.StatusTooManyRequests, wait, fmt.Errorf("API key %q is over its limit of %d requests per minute", k.Name, k.RateLimit)
+		}
+		k.tokens--
+	}
+	used := now.UTC()
+	k.LastUsed = &used
+	return 0, 0, nil
+}
+
+// scopes returns a copy of a key's scopes
+func (s *APIKeyStore) scopes(k *apiKeyEntry) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), k.Scopes...)
+}
+
+// requestScopesKey is the context key holding the scopes of the API key a request
+// authenticated with
+type requestScopesKey struct{}
+
+// requestHasScope reports whether a request may do what needs a scope, for checks beyond
+// its path such as log subscriptions: logins, API tokens and open servers may do anything
+func requestHasScope(r *http.Request, scope string) bool {
+	scopes, ok := r.Context().Value(requestScopesKey{}).([]string)
+	if !ok {
+		return true
+	}
+	for _, s := range scopes {
+		if s == scope || s == scopeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// hasScope reports whether the key grants a scope; admin grants every scope
+func (k *apiKeyEntry) hasScope(scope string) bool {
+	for _, s := range k.Scopes {
+		if s == scope || s == scopeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// requiredScope returns the scope an API key needs for a request, or "" for the web UI's
+// static files, which any key can load
+func requiredScope(r *http.Request) string {
+	// Grafana POSTs its queries, but they only read the rollups
+	if r.URL.Path == "/grafana" || strings.HasPrefix(r.URL.Path, "/grafana/") {
+		return scopeReadStats
+	}
+	if r.URL.Path == "/api/agents/report" {
+		return scopeAgent
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return scopeAdmin
+	}
+	path := r.URL.Path
+	under := func(paths []string) bool {
+		for _, p := range paths {
+			if path == p || strings.HasPrefix(path, p+"/") {
+				return true
+			}
+		}
+		return false
+	}
+	switch {
+	case under(adminScopePaths):
+		return scopeAdmin
+	case under(statsScopePaths):
+		return scopeReadStats
+	case under(packetScopePaths):
+		return scopeReadPackets
+	case strings.HasPrefix(path, "/api/"):
+		return scopeReadStats
+	}
+	return ""
+}
+
+// grpcScope returns the scope an API key needs for a gRPC method, e.g.
+// /pitrack.v1.PiTrack/SubscribePackets, or "" for server reflection, which any key can use
+func grpcScope(fullMethod string) string {
+	if !strings.HasPrefix(fullMethod, "/pitrack.") {
+		return ""
+	}
+	if grpcPacketMethods[fullMethod[strings.LastIndex(fullMethod, "/")+1:]] {
+		return scopeReadPackets
+	}
+	return scopeReadStats
+}
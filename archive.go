@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Archiver keeps packets that retention is about to prune, as one gzip'd JSONL file per
+// day (packets-2024-06-01.jsonl.gz) in a directory. Each run appends a new gzip member to
+// the day's file, which gzip readers treat as one continuous stream.
+type Archiver struct {
+	dir string
+}
+
+// NewArchiver creates an archiver writing to dir, creating it if needed
+func NewArchiver(dir string) (*Archiver, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &Archiver{dir: dir}, nil
+}
+
+// ArchiveBefore writes every packet older than cutoff to the archive: rows in the main
+// database and, with partitioning on, the daily files that retention will delete
+func (a *Archiver) ArchiveBefore(d *Database, cutoff time.Time) (int64, error) {
+	var total int64
+	if d.partitions != nil {
+		files, err := d.partitions.files()
+		if err != nil {
+			return 0, err
+		}
+		for _, f := range files {
+			if f.day.AddDate(0, 0, 1).After(cutoff) {
+				break
+			}
+			n, err := a.archivePartition(d, f)
+			total += n
+			if err != nil {
+				return total, fmt.Errorf("%s: %v", filepath.Base(f.path), err)
+			}
+		}
+	}
+
+	rows, err := d.db.Query("SELECT "+packetColumns+" FROM packets WHERE timestamp < ? ORDER BY timestamp", cutoff)
+	if err != nil {
+		return total, err
+	}
+	defer rows.Close()
+	n, err := a.write(rows)
+	return total + n, err
+}
+
+func (a *Archiver) archivePartition(d *Database, f partitionFile) (int64, error) {
+	conn, release, err := d.attach([]string{f.path}, "archive")
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+
+	rows, err := conn.QueryContext(context.Background(), "SELECT "+packetColumns+" FROM archive.packets ORDER BY timestamp")
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	return a.write(rows)
+}
+
+// write appends packets, ordered by timestamp, to their days' files
+func (a *Archiver) write(rows *sql.Rows) (int64, error) {
+	var n int64
+	var day string
+	var out *archiveFile
+	for rows.Next() {
+		p, err := scanPacket(rows)
+		if err != nil {
+			out.Close()
+			return n, err
+		}
+		if d := p.Timestamp.Local().Format(partitionDayFormat); d != day || out == nil {
+			if err := out.Close(); err != nil {
+				return n, err
+			}
+			day = d
+			if out, err = a.open(day); err != nil {
+				return n, err
+			}
+		}
+		if err := out.enc.Encode(p); err != nil {
+			out.Close()
+			return n, err
+		}
+		n++
+	}
+	if err := rows.Err(); err != nil {
+		out.Close()
+		return n, err
+	}
+	return n, out.Close()
+}
+
+// archiveFile is a gzip member being appended to one day's archive
+type archiveFile struct {
+	f   *os.File
+	gz  *gzip.Writer
+	buf *bufio.Writer
+	enc *json.Encoder
+}
+
+func (a *Archiver) open(day string) (*archiveFile, error) {
+	f, err := os.OpenFile(filepath.Join(a.dir, "packets-"+day+".jsonl.gz"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	gz := gzip.NewWriter(f)
+	buf := bufio.NewWriter(gz)
+	return &archiveFile{f: f, gz: gz, buf: buf, enc: json.NewEncoder(buf)}, nil
+}
+
+// Close finishes the gzip member and syncs the file, so the rows are safe on disk before
+// they are pruned. Safe to call on nil.
+func (af *archiveFile) Close() error {
+	if af == nil {
+		return nil
+	}
+	err := af.buf.Flush()
+	if gzErr := af.gz.Close(); err == nil {
+		err = gzErr
+	}
+	if syncErr := af.f.Sync(); err == nil {
+		err = syncErr
+	}
+	if closeErr := af.f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// runImport implements the "import" subcommand, loading archived packets back into a database
+func runImport(args []string) {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	dbFlags := addCLIDatabaseFlags(fs)
+	iface := fs.String("interface", "", "Interface to record packets from capture files under")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: pi-track import [-db pitrack.db] <capture.pcap|capture.pcapng|packets-2024-06-01.jsonl.gz>...\n\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	db := dbFlags.open()
+	defer db.Close()
+
+	// The lookups that name and locate addresses run in the background while serving;
+	// here they'd be cut off at exit, so captures are stored without them. A backfill
+	// through /api/enrichment/backfill fills them in later.
+	enrichers = EnricherChain{}
+
+	for _, path := range fs.Args() {
+		if isCaptureFile(path) {
+			imported, err := db.ImportCapture(path, *iface)
+			if err != nil {
+				log.Fatalf("Failed to import %s after %d packets: %v", path, imported, err)
+			}
+			log.Printf("Imported %d packets from %s", imported, path)
+			continue
+		}
+		imported, skipped, err := db.ImportArchive(path)
+		if err != nil {
+			log.Fatalf("Failed to import %s: %v", path, err)
+		}
+		log.Printf("Imported %d packets from %s (%d already present)", imported, path, skipped)
+	}
+}
+
+// ImportArchive loads packets from a gzip'd JSONL archive in one transaction, keeping their
+// IDs. Packets whose ID is already in the database are skipped, so importing twice is harmless.
+func (d *Database) ImportArchive(path string) (imported, skipped int64, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer gz.Close()
+
+	tx, err := d.db.Begin()
+	if err != nil {
+		return 0, 0, err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(`
+		INSERT OR IGNORE INTO packets (` + packetColumns + `)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer stmt.Close()
+
+	dec := json.NewDecoder(gz)
+	for line := 1; ; line++ {
+		var p Packet
+		if err := dec.Decode(&p); err == io.EOF {
+			break
+		} else if err != nil {
+			return 0, 0, fmt.Errorf("record %d: %v", line, err)
+		}
+		result, err := stmt.Exec(p.ID, p.Timestamp, p.SrcIP, p.DstIP, p.SrcPort, p.DstPort,
+			p.Protocol, p.Length, p.Info, p.SrcMAC, p.DstMAC,
+			p.Application, p.SrcHostname, p.DstHostname, p.SrcCountry, p.DstCountry,
+			p.ProcessName, p.Interface, p.SrcASN, p.DstASN, p.ProcessUser, p.ProcessUnit)
+		if err != nil {
+			return 0, 0, err
+		}
+		if n, _ := result.RowsAffected(); n > 0 {
+			imported++
+		} else {
+			skipped++
+		}
+	}
+	return imported, skipped, tx.Commit()
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// authCookie holds the session ID of a logged-in browser
+const authCookie = "pitrack_session"
+
+// authPublicPaths can be fetched without logging in, so the login page can load
+var authPublicPaths = map[string]bool{
+	"/login.html": true,
+	"/styles.css": true,
+	"/api/login":  true,
+	"/api/auth":   true,
+}
+
+// Auth protects every HTTP and WebSocket endpoint. Browsers log in with the username and
+// password and get a session cookie; scripts send an API token or scoped API key as a
+// Bearer token, or the username and password with HTTP Basic authentication. With none
+// configured, everything stays open.
+type Auth struct {
+	user       string
+	password   [32]byte   // SHA-256, so comparisons take the same time whatever the length
+	tokens     [][32]byte // SHA-256 of each API token, which have full access
+	keys       *APIKeyStore
+	sessionTTL time.Duration
+
+	mu       sync.Mutex
+	sessions map[string]time.Time // Session ID -> expiry
+}
+
+// NewAuth creates an authenticator. An empty user disables password logins, and with no
+// tokens or API keys either, authentication is off.
+func NewAuth(user, password string, tokens []string, keys *APIKeyStore, sessionTTL time.Duration) *Auth {
+	a := &Auth{
+		user:       user,
+		password:   sha256.Sum256([]byte(password)),
+		keys:       keys,
+		sessionTTL: sessionTTL,
+		sessions:   make(map[string]time.Time),
+	}
+	for _, t := range tokens {
+		if t = strings.TrimSpace(t); t != "" {
+			a.tokens = append(a.tokens, sha256.Sum256([]byte(t)))
+		}
+	}
+	return a
+}
+
+// Enabled reports whether requests need to authenticate
+func (a *Auth) Enabled() bool {
+	return a.user != "" || len(a.tokens) > 0 || a.keys.Len() > 0
+}
+
+// Wrap returns next behind authentication. Unauthenticated API, WebSocket and event stream
+// requests get 401; page loads are sent to the login page. API keys also need the scope
+// for the request and to be within their rate limit.
+func (a *Auth) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !a.Enabled() || authPublicPaths[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if key, ok := a.authenticate(r); ok {
+			if key != nil {
+				status, retryAfter, err := a.keys.admit(key, requiredScope(r))
+				if err != nil {
+					if retryAfter > 0 {
+						w.Header().Set("Retry-After", fmt.Sprint(int(retryAfter.Seconds())+1))
+					}
+					http.Error(w, err.Error(), status)
+					return
+				}
+				r = r.WithContext(context.WithValue(r.Context(), requestScopesKey{}, a.keys.scopes(key)))
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+		if r.Method == http.MethodGet && !strings.HasPrefix(r.URL.Path, "/api/") && !strings.HasPrefix(r.URL.Path, "/grafana/") && r.URL.Path != "/ws" && r.URL.Path != "/events" {
+			http.Redirect(w, r, "/login.html", http.StatusFound)
+			return
+		}
+		w.Header().Set("WWW-Authenticate", `Bearer realm="pi-track"`)
+		http.Error(w, "authentication required", http.StatusUnauthorized)
+	})
+}
+
+// authenticate checks a request's session cookie or Authorization header, returning the
+// API key it used, or nil for a login or API token, which have full access
+func (a *Auth) authenticate(r *http.Request) (*apiKeyEntry, bool) {
+	if c, err := r.Cookie(authCookie); err == nil && a.validSession(c.Value) {
+		return nil, true
+	}
+	return a.checkAuthorization(r.Header.Get("Authorization"))
+}
+
+// checkAuthorization checks an Authorization header value holding Basic credentials or a
+// Bearer token or API key, returning the API key as for authenticate
+func (a *Auth) checkAuthorization(header string) (*apiKeyEntry, bool) {
+	if token, ok := strings.CutPrefix(header, "Bearer "); ok {
+		if a.checkToken(token) {
+			return nil, true
+		}
+		key := a.keys.lookup(token)
+		return key, key != nil
+	}
+	r := http.Request{Header: http.Header{"Authorization": {header}}}
+	if user, password, ok := r.BasicAuth(); ok {
+		return nil, a.checkPassword(user, password)
+	}
+	return nil, false
+}
+
+// CanCreateKeys reports whether an API key can be created without locking everyone out,
+// since the first key turns authentication on: there must be a login or API token, or
+// already an admin key
+func (a *Auth) CanCreateKeys() bool {
+	return a.user != "" || len(a.tokens) > 0 || a.keys.hasAdmin()
+}
+
+func (a *Auth) checkPassword(user, password string) bool {
+	if a.user == "" {
+		return false
+	}
+	userOK := subtle.ConstantTimeCompare([]byte(user), []byte(a.user)) == 1
+	sum := sha256.Sum256([]byte(password))
+	passwordOK := subtle.ConstantTimeCompare(sum[:], a.password[:]) == 1
+	return userOK && passwordOK
+}
+
+func (a *Auth) checkToken(token string) bool {
+	sum := sha256.Sum256([]byte(token))
+	ok := false
+	for _, t := range a.tokens {
+		if subtle.ConstantTimeCompare(sum[:], t[:]) == 1 {
+			ok = true
+		}
+	}
+	return ok
+}
+
+func (a *Auth) validSession(id string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	expiry, ok := a.sessions[id]
+	if ok && time.Now().After(expiry) {
+		delete(a.sessions, id)
+		return false
+	}
+	return ok
+}
+
+// newSession starts a session, returning its ID. Expired sessions are swept out first.
+func (a *Auth) newSession() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	id := hex.EncodeToString(b)
+
+	now := time.Now()
+	a.mu.Lock()
+	for sid, expiry := range a.sessions {
+		if now.After(expiry) {
+			delete(a.sessions, sid)
+		}
+	}
+	a.sessions[id] = now.Add(a.sessionTTL)
+	a.mu.Unlock()
+	return id, nil
+}
+
+// HandleLogin checks a username and password posted as a form or JSON and starts a session.
+// Form posts (from the login page) are redirected; JSON posts get a JSON answer.
+func (a *Auth) HandleLogin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	isJSON := strings.HasPrefix(r.Header.Get("Content-Type"), "application/json")
+	var creds struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+	if isJSON {
+		if err := json.NewDecoder(r.Body).Decode(&creds); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	} else {
+		creds.Username, creds.Password = r.PostFormValue("username"), r.PostFormValue("password")
+	}
+
+	if !a.checkPassword(creds.Username, creds.Password) {
+		if isJSON {
+			http.Error(w, "invalid username or password", http.StatusUnauthorized)
+		} else {
+			http.Redirect(w, r, "/login.html?failed=1", http.StatusSeeOther)
+		}
+		return
+	}
+	id, err := a.newSession()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// Strict same-site cookies aren't sent with requests started by other sites, which
+	// covers both cross-site form posts and WebSocket connections
+	http.SetCookie(w, &http.Cookie{
+		Name:     authCookie,
+		Value:    id,
+		Path:     "/",
+		MaxAge:   int(a.sessionTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	})
+	if isJSON {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"user": a.user})
+		return
+	}
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// HandleLogout ends the browser's session
+func (a *Auth) HandleLogout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if c, err := r.Cookie(authCookie); err == nil {
+		a.mu.Lock()
+		delete(a.sessions, c.Value)
+		a.mu.Unlock()
+	}
+	http.SetCookie(w, &http.Cookie{Name: authCookie, Value: "", Path: "/", MaxAge: -1, HttpOnly: true})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleStatus reports whether authentication is on and whether the request is logged in
+func (a *Auth) HandleStatus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_, authenticated := a.authenticate(r)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"enabled":       a.Enabled(),
+		"authenticated": !a.Enabled() || authenticated,
+		"passwordLogin": a.user != "",
+	})
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Backfill settings
+const (
+	backfillLookback  = time.Hour // How far back scheduled runs look
+	backfillBatchSize = 200       // Addresses updated per transaction
+)
+
+// BackfillRun is one backfill pass, in progress or finished
+type BackfillRun struct {
+	Trigger    string     `json:"trigger"` // "schedule" or "api"
+	Start      *time.Time `json:"start,omitempty"`
+	End        *time.Time `json:"end,omitempty"`
+	Addresses  int        `json:"addresses"` // Addresses missing a hostname, country or ASN somewhere
+	Checked    int        `json:"checked"`
+	Filled     int        `json:"filled"`  // Addresses whose packets gained something
+	Updated    int64      `json:"updated"` // Packets updated
+	Progress   float64    `json:"progress"`
+	Error      string     `json:"error,omitempty"`
+	StartedAt  time.Time  `json:"startedAt"`
+	FinishedAt *time.Time `json:"finishedAt,omitempty"`
+}
+
+// BackfillStatus is what GET /api/enrichment/backfill reports
+type BackfillStatus struct {
+	Running  bool         `json:"running"`
+	Interval string       `json:"interval"` // Empty when only run on demand
+	NextRun  *time.Time   `json:"nextRun,omitempty"`
+	Current  *BackfillRun `json:"current,omitempty"`
+	LastRun  *BackfillRun `json:"lastRun,omitempty"`
+}
+
+// EnrichmentBackfill fills in the hostnames, countries and ASNs of stored packets. Lookups
+// finish after the first packets of a new address have been stored, so without it those
+// packets would stay unnamed for good. Runs on a schedule cover the last hour; runs on
+// demand cover any range. Only packets still in the main database are updated, not
+// finished daily partitions.
+type EnrichmentBackfill struct {
+	db       *Database
+	interval time.Duration
+
+	mu      sync.Mutex
+	current *BackfillRun
+	lastRun *BackfillRun
+	nextRun time.Time
+}
+
+// NewEnrichmentBackfill creates a backfill running each interval (0 for on demand only)
+func NewEnrichmentBackfill(db *Database, interval time.Duration) *EnrichmentBackfill {
+	return &EnrichmentBackfill{db: db, interval: interval}
+}
+
+// Start runs the backfill on the schedule in the background
+func (b *EnrichmentBackfill) Start() {
+	if b.interval <= 0 {
+		return
+	}
+	b.mu.Lock()
+	b.nextRun = time.Now().Add(b.interval)
+	b.mu.Unlock()
+
+	go func() {
+		ticker := time.NewTicker(b.interval)
+		for range ticker.C {
+			b.mu.Lock()
+			b.nextRun = time.Now().Add(b.interval)
+			b.mu.Unlock()
+			start := time.Now().Add(-backfillLookback)
+			if err := b.Run("schedule", &start, nil, false); err != nil {
+				log.Printf("Debug: scheduled enrichment backfill skipped: %v", err)
+			}
+		}
+	}()
+}
+
+// Run fills in the packets stored between start and end (either may be nil for no bound),
+// in the background if async is set. Only one run happens at a time.
+func (b *EnrichmentBackfill) Run(trigger string, start, end *time.Time, async bool) error {
+	b.mu.Lock()
+	if b.current != nil {
+		b.mu.Unlock()
+		return fmt.Errorf("backfill is already running")
+	}
+	run := &BackfillRun{Trigger: trigger, Start: start, End: end, StartedAt: time.Now()}
+	b.current = run
+	b.mu.Unlock()
+
+	if async {
+		go b.run(run)
+	} else {
+		b.run(run)
+	}
+	return nil
+}
+
+func (b *EnrichmentBackfill) run(run *BackfillRun) {
+	err := b.fill(run)
+
+	finished := time.Now()
+	b.mu.Lock()
+	run.Progress = 100
+	if err != nil {
+		run.Error = err.Error()
+	}
+	run.FinishedAt = &finished
+	b.current = nil
+	b.lastRun = run
+	b.mu.Unlock()
+
+	if err != nil {
+		log.Printf("Error backfilling packet enrichment: %v", err)
+	} else if run.Updated > 0 {
+		log.Printf("Backfilled hostnames, countries and ASNs of %d packets from %d addresses", run.Updated, run.Filled)
+	}
+}
+
+func (b *EnrichmentBackfill) fill(run *BackfillRun) error {
+	ips, err := b.db.UnenrichedIPs(run.Start, run.End)
+	if err != nil {
+		return err
+	}
+	b.mu.Lock()
+	run.Addresses = len(ips)
+	b.mu.Unlock()
+
+	for len(ips) > 0 {
+		n := len(ips)
+		if n > backfillBatchSize {
+			n = backfillBatchSize
+		}
+		infos := make(map[string]IPInfo, n)
+		for _, ip := range ips[:n] {
+			// Starts the lookups not made yet, e.g. for addresses last seen before a restart,
+			// whose results a later run fills in
+			resolveIPInfo(ip)
+			if info := getIPInfo(ip); info.Hostname != "" || info.Country != "" || info.ASN != "" {
+				infos[ip] = info
+			}
+		}
+		updated, filled, err := b.db.FillPacketEnrichment(infos, run.Start, run.End)
+		if err != nil {
+			return err
+		}
+		ips = ips[n:]
+
+		b.mu.Lock()
+		run.Checked += n
+		run.Filled += filled
+		run.Updated += updated
+		run.Progress = float64(run.Checked) * 100 / float64(run.Addresses)
+		b.mu.Unlock()
+	}
+	return nil
+}
+
+// Status returns the schedule, the run in progress and the last finished run
+func (b *EnrichmentBackfill) Status() BackfillStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	status := BackfillStatus{Running: b.current != nil}
+	if b.interval > 0 {
+		status.Interval = b.interval.String()
+		next := b.nextRun
+		status.NextRun = &next
+	}
+	if b.current != nil {
+		c := *b.current
+		status.Current = &c
+	}
+	status.LastRun = b.lastRun
+	return status
+}
+
+// packetRangeClause limits packet queries to timestamps between start and end
+func packetRangeClause(start, end *time.Time) (string, []interface{}) {
+	clause := ""
+	args := []interface{}{}
+	if start != nil {
+		clause += " AND timestamp >= ?"
+		args = append(args, *start)
+	}
+	if end != nil {
+		clause += " AND timestamp <= ?"
+		args = append(args, *end)
+	}
+	return clause, args
+}
+
+// UnenrichedIPs returns the addresses of packets stored between start and end that lack
+// a hostname, country or ASN for that end
+func (d *Database) UnenrichedIPs(start, end *time.Time) ([]string, error) {
+	where, args := packetRangeClause(start, end)
+	rows, err := d.db.Query(`
+		SELECT src_ip FROM packets
+		WHERE src_ip != '' AND (COALESCE(src_hostname, '') = '' OR COALESCE(src_country, '') = '' OR COALESCE(src_asn, '') = '')`+where+`
+		UNION
+		SELECT dst_ip FROM packets
+		WHERE dst_ip != '' AND (COALESCE(dst_hostname, '') = '' OR COALESCE(dst_country, '') = '' OR COALESCE(dst_asn, '') = '')`+where,
+		append(args, args...)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ips := []string{}
+	for rows.Next() {
+		var ip string
+		if err := rows.Scan(&ip); err != nil {
+			return nil, err
+		}
+		ips = append(ips, ip)
+	}
+	return ips, rows.Err()
+}
+
+// FillPacketEnrichment sets the hostname, country and ASN of packets stored between start
+// and end from what's known about their addresses, only where they're empty, in one
+// transaction. It returns how many packets changed and of how many addresses.
+func (d *Database) FillPacketEnrichment(infos map[string]IPInfo, start, end *time.Time) (int64, int, error) {
+	if len(infos) == 0 {
+		return 0, 0, nil
+	}
+	where, rangeArgs := packetRangeClause(start, end)
+
+	tx, err := d.db.Begin()
+	if err != nil {
+		return 0, 0, err
+	}
+	defer tx.Rollback()
+
+	var updated int64
+	filled := 0
+	for ip, info := range infos {
+		var n int64
+		for _, side := range []string{"src", "dst"} {
+			set := []string{}
+			missing := []string{}
+			args := []interface{}{}
+			for _, field := range []struct{ column, value string }{
+				{side + "_hostname", info.Hostname},
+				{side + "_country", info.Country},
+				{side + "_asn", info.ASN},
+			} {
+				if field.value == "" {
+					continue
+				}
+				set = append(set, fmt.Sprintf("%[1]s = CASE WHEN COALESCE(%[1]s, '') = '' THEN ? ELSE %[1]s END", field.column))
+				missing = append(missing, fmt.Sprintf("COALESCE(%s, '') = ''", field.column))
+				args = append(args, field.value)
+			}
+			if len(set) == 0 {
+				continue
+			}
+			args = append(append(args, ip), rangeArgs...)
+			result, err := tx.Exec("UPDATE packets SET "+strings.Join(set, ", ")+
+				" WHERE "+side+"_ip = ? AND ("+strings.Join(missing, " OR ")+")"+where, args...)
+			if err != nil {
+				return 0, 0, err
+			}
+			affected, _ := result.RowsAffected()
+			n += affected
+		}
+		if n > 0 {
+			updated += n
+			filled++
+		}
+	}
+	return updated, filled, tx.Commit()
+}
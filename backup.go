@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"modernc.org/sqlite"
+)
+
+// sqliteBackupConn is the part of the SQLite driver's connection exposing the online backup API
+type sqliteBackupConn interface {
+	NewBackup(dstUri string) (*sqlite.Backup, error)
+	NewRestore(srcUri string) (*sqlite.Backup, error)
+}
+
+// copyDatabase runs an online backup between db and the file at path, in a single step so
+// the copy is one consistent snapshot even while packets are being written. With restore
+// set, the file is copied into db instead.
+func copyDatabase(db *sql.DB, path string, restore bool) error {
+	conn, err := db.Conn(context.Background())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	supported := true
+	err = conn.Raw(func(driverConn interface{}) error {
+		c, ok := driverConn.(sqliteBackupConn)
+		if !ok {
+			supported = false
+			return nil
+		}
+		var b *sqlite.Backup
+		if restore {
+			b, err = c.NewRestore(path)
+		} else {
+			b, err = c.NewBackup(path)
+		}
+		if err != nil {
+			return err
+		}
+		if _, err := b.Step(-1); err != nil {
+			b.Finish()
+			return err
+		}
+		return b.Finish()
+	})
+	if err != nil || supported {
+		return err
+	}
+
+	// SQLCipher has no backup API of its own here, but VACUUM INTO also writes a
+	// consistent snapshot, encrypted with the same key
+	if restore {
+		return fmt.Errorf("encrypted databases are restored by copying the backup file into place while pi-track is stopped")
+	}
+	_, err = conn.ExecContext(context.Background(), "VACUUM INTO ?", path)
+	return err
+}
+
+// Backup writes a consistent snapshot of the database, including queued packets, to path
+func (d *Database) Backup(path string) error {
+	d.Flush()
+	return copyDatabase(d.db, path, false)
+}
+
+// runRestore implements the "restore" subcommand, replacing a database's contents with a backup
+func runRestore(args []string) {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	dbFlags := addCLIDatabaseFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: pi-track restore [-db pitrack.db] <backup.db>\n\nStop pi-track before restoring.\n\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	backupPath := fs.Arg(0)
+
+	// The database is replaced wholesale, so it's opened bare rather than with open()
+	key := dbFlags.loadKey()
+	if err := checkBackup(backupPath, key); err != nil {
+		log.Fatalf("Invalid backup %s: %v", backupPath, err)
+	}
+
+	db, err := openSQLite(*dbFlags.path, key, "busy_timeout(5000)")
+	if err != nil {
+		log.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	if err := copyDatabase(db, backupPath, true); err != nil {
+		log.Fatalf("Failed to restore %s: %v", backupPath, err)
+	}
+	log.Printf("Restored %s into %s", backupPath, *dbFlags.path)
+}
+
+// checkBackup makes sure a file is an intact pi-track database before it replaces anything
+func checkBackup(path, key string) error {
+	if _, err := os.Stat(path); err != nil {
+		return err
+	}
+	db, err := openSQLite("file:"+path+"?mode=ro", key)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var result string
+	if err := db.QueryRow("PRAGMA quick_check").Scan(&result); err != nil {
+		return err
+	}
+	if result != "ok" {
+		return fmt.Errorf("integrity check failed: %s", result)
+	}
+	var tables int
+	if err := db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'packets'").Scan(&tables); err != nil {
+		return err
+	}
+	if tables == 0 {
+		return fmt.Errorf("not a pi-track database")
+	}
+	return nil
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Beaconing heuristics
+const (
+	beaconMinConnections = 8                // Connections needed before timing is judged
+	beaconMaxJitter      = 0.1              // Max stddev/mean of the gaps between connections
+	beaconMinInterval    = 10 * time.Second // Faster than this is a busy client, not a beacon
+	beaconMaxAvgBytes    = 16 * 1024        // Beacons are small check-ins, not transfers
+	beaconHistory        = 64               // Connection starts kept per endpoint
+	beaconForget         = 24 * time.Hour   // Endpoints idle this long are dropped
+	beaconCheckInterval  = time.Minute
+)
+
+// Beacon is a host connecting to the same external endpoint at suspiciously regular intervals
+type Beacon struct {
+	SrcIP       string    `json:"srcIp"`
+	DstIP       string    `json:"dstIp"`
+	DstPort     uint16    `json:"dstPort"`
+	Protocol    string    `json:"protocol"`
+	DstHostname string    `json:"dstHostname"`
+	DstCountry  string    `json:"dstCountry"`
+	Connections int       `json:"connections"`
+	IntervalSec float64   `json:"intervalSec"` // Mean gap between connections
+	JitterSec   float64   `json:"jitterSec"`   // Standard deviation of the gaps
+	AvgBytes    int64     `json:"avgBytes"`    // Mean bytes per connection
+	Score       float64   `json:"score"`       // 1 for perfectly regular, 0 at the jitter limit
+	FirstSeen   time.Time `json:"firstSeen"`
+	LastSeen    time.Time `json:"lastSeen"`
+}
+
+// beaconEndpoint is the connection history from one host to one external endpoint
+type beaconEndpoint struct {
+	srcIP, dstIP string
+	dstPort      uint16
+	protocol     string
+	starts       []time.Time
+	bytes        []int64
+}
+
+// BeaconDetector finds periodic, low-volume connections from LAN hosts to the internet,
+// the signature of malware checking in with a command and control server. Packets are
+// aggregated into flows; each flow is one connection attempt, and the gaps between
+// attempts to the same endpoint are scored for regularity.
+type BeaconDetector struct {
+	flows  *FlowTable
+	alerts *AlertEngine
+
+	mu        sync.Mutex
+	endpoints map[string]*beaconEndpoint
+	beacons   []Beacon
+}
+
+// NewBeaconDetector creates a detector with its own flow table
+func NewBeaconDetector(alerts *AlertEngine) *BeaconDetector {
+	// A long active timeout keeps persistent connections as one flow, so only real
+	// reconnects count as connection attempts
+	flows, _ := NewFlowTable(FlowConfig{
+		ActiveTimeout:   24 * time.Hour,
+		InactiveTimeout: 15 * time.Second,
+		AggregationKey:  flowKey5Tuple,
+		BatchSize:       1,
+	})
+	bd := &BeaconDetector{
+		flows:     flows,
+		alerts:    alerts,
+		endpoints: make(map[string]*beaconEndpoint),
+		beacons:   []Beacon{},
+	}
+	flows.AddExporter(bd)
+	return bd
+}
+
+// Start runs flow expiry and periodic analysis in the background
+func (bd *BeaconDetector) Start() {
+	bd.flows.Start()
+	go func() {
+		ticker := time.NewTicker(beaconCheckInterval)
+		for range ticker.C {
+			bd.analyze(time.Now())
+		}
+	}()
+}
+
+// Observe implements PacketObserver
+func (bd *BeaconDetector) Observe(p Packet) {
+	if p.Protocol != "TCP" && p.Protocol != "UDP" {
+		return
+	}
+	// DNS and NTP poll on a schedule by design
+	if p.DstPort == 53 || p.DstPort == 123 {
+		return
+	}
+	src, dst := net.ParseIP(p.SrcIP), net.ParseIP(p.DstIP)
+	if src == nil || dst == nil || !isPrivateIP(src) || isPrivateIP(dst) || dst.IsMulticast() {
+		return
+	}
+	bd.flows.Observe(p)
+}
+
+// Export implements FlowExporter, recording each finished flow as a connection attempt
+func (bd *BeaconDetector) Export(flows []Flow) error {
+	bd.mu.Lock()
+	defer bd.mu.Unlock()
+
+	for _, f := range flows {
+		// A TCP flow without a SYN is an existing connection that went quiet, not a new one
+		if f.Protocol == "TCP" && f.TCPFlags&tcpFlagSYN == 0 {
+			continue
+		}
+		key := fmt.Sprintf("%s->%s:%d/%s", f.SrcIP, f.DstIP, f.DstPort, f.Protocol)
+		e := bd.endpoints[key]
+		if e == nil {
+			e = &beaconEndpoint{srcIP: f.SrcIP, dstIP: f.DstIP, dstPort: f.DstPort, protocol: f.Protocol}
+			bd.endpoints[key] = e
+		}
+		e.starts = append(e.starts, f.FirstSeen)
+		e.bytes = append(e.bytes, f.Bytes)
+		if len(e.starts) > beaconHistory {
+			e.starts = e.starts[1:]
+			e.bytes = e.bytes[1:]
+		}
+	}
+	return nil
+}
+
+// score judges one endpoint's connection timing, returning false when it doesn't look
+// like a beacon or the beaconing has stopped
+func (e *beaconEndpoint) score(now time.Time) (Beacon, bool) {
+	if len(e.starts) < beaconMinConnections {
+		return Beacon{}, false
+	}
+
+	// Flows finish out of order, so sort the starts before taking gaps
+	starts := append([]time.Time(nil), e.starts...)
+	sort.Slice(starts, func(i, j int) bool { return starts[i].Before(starts[j]) })
+
+	gaps := make([]float64, 0, len(starts)-1)
+	var sum float64
+	for i := 1; i < len(starts); i++ {
+		gap := starts[i].Sub(starts[i-1]).Seconds()
+		gaps = append(gaps, gap)
+		sum += gap
+	}
+	mean := sum / float64(len(gaps))
+	if mean < beaconMinInterval.Seconds() {
+		return Beacon{}, false
+	}
+	// Several missed check-ins in a row means it went away
+	if now.Sub(starts[len(starts)-1]).Seconds() > 3*mean {
+		return Beacon{}, false
+	}
+	var variance float64
+	for _, gap := range gaps {
+		variance += (gap - mean) * (gap - mean)
+	}
+	stddev := math.Sqrt(variance / float64(len(gaps)))
+	jitter := stddev / mean
+	if jitter > beaconMaxJitter {
+		return Beacon{}, false
+	}
+
+	var total int64
+	for _, b := range e.bytes {
+		total += b
+	}
+	avg := total / int64(len(e.bytes))
+	if avg > beaconMaxAvgBytes {
+		return Beacon{}, false
+	}
+
+	info := getIPInfo(e.dstIP)
+	return Beacon{
+		SrcIP:       e.srcIP,
+		DstIP:       e.dstIP,
+		DstPort:     e.dstPort,
+		Protocol:    e.protocol,
+		DstHostname: info.Hostname,
+		DstCountry:  info.Country,
+		Connections: len(starts),
+		IntervalSec: mean,
+		JitterSec:   stddev,
+		AvgBytes:    avg,
+		Score:       1 - jitter/beaconMaxJitter,
+		FirstSeen:   starts[0],
+		LastSeen:    starts[len(starts)-1],
+	}, true
+}
+
+// analyze rescores every endpoint and raises an alert for each beacon. Re-raising
+// keeps the alert firing for as long as the beaconing goes on.
+func (bd *BeaconDetector) analyze(now time.Time) {
+	bd.mu.Lock()
+	beacons := []Beacon{}
+	for key, e := range bd.endpoints {
+		if now.Sub(e.starts[len(e.starts)-1]) > beaconForget {
+			delete(bd.endpoints, key)
+			continue
+		}
+		if b, ok := e.score(now); ok {
+			beacons = append(beacons, b)
+		}
+	}
+	sort.Slice(beacons, func(i, j int) bool {
+		return beacons[i].Score > beacons[j].Score
+	})
+	bd.beacons = beacons
+	bd.mu.Unlock()
+
+	if bd.alerts == nil {
+		return
+	}
+	for _, b := range beacons {
+		dst := b.DstIP
+		if b.DstHostname != "" {
+			dst = fmt.Sprintf("%s (%s)", b.DstHostname, b.DstIP)
+		}
+		bd.alerts.Raise("Beaconing", fmt.Sprintf("%s → %s:%d", b.SrcIP, b.DstIP, b.DstPort), severityWarning,
+			fmt.Sprintf("%s connects to %s port %d/%s every %.0fs (±%.1fs, %d connections, %s each)",
+				b.SrcIP, dst, b.DstPort, b.Protocol, b.IntervalSec, b.JitterSec, b.Connections, formatBytes(b.AvgBytes)))
+	}
+}
+
+// Beacons returns the suspicious periodicity report: endpoints currently judged to be
+// beaconing, most regular first
+func (bd *BeaconDetector) Beacons() []Beacon {
+	bd.mu.Lock()
+	defer bd.mu.Unlock()
+	beacons := make([]Beacon, len(bd.beacons))
+	copy(beacons, bd.beacons)
+	return beacons
+}
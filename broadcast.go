@@ -0,0 +1,96 @@
+package main
+
+import "encoding/json"
+
+// maxBroadcastBatch caps the packets waiting for the next batched message; beyond it,
+// packets are left out of the live view as when a client's send channel is full
+const maxBroadcastBatch = 2000
+
+// QueueBroadcast holds a packet for the next batched packets message
+func (ps *PacketStore) QueueBroadcast(p Packet) {
+	ps.pendingMu.Lock()
+	defer ps.pendingMu.Unlock()
+	if len(ps.pending) < maxBroadcastBatch {
+		ps.pending = append(ps.pending, p)
+	}
+}
+
+// FlushBroadcast sends the queued packets as one packets message, whose data is an array
+// of packets, oldest first
+func (ps *PacketStore) FlushBroadcast() {
+	ps.pendingMu.Lock()
+	batch := ps.pending
+	ps.pending = nil
+	ps.pendingMu.Unlock()
+	if len(batch) > 0 {
+		ps.BroadcastPackets(batch)
+	}
+}
+
+// BroadcastPackets sends a batch of packets to the clients subscribed to packets. The
+// batch is marshaled once for every client without a display filter or rate limit; clients
+// with a filter or following a connection get the packets matching it, if any, resumed
+// clients those they weren't replayed, and rate-limited clients a sample of them. Paused
+// clients get none.
+func (ps *PacketStore) BroadcastPackets(batch []Packet) {
+	ps.clientsMu.RLock()
+	defer ps.clientsMu.RUnlock()
+
+	var all []byte
+	for client := range ps.clients {
+		// ?types=packet, from before batching, still selects them
+		if client.channels.Load()&channelPackets == 0 || (client.types != nil && !client.types["packets"] && !client.types["packet"]) || client.paused.Load() {
+			continue
+		}
+
+		var data []byte
+		f := client.filter.Load()
+		follow := client.follow.Load()
+		replayedTo := client.replayedTo.Load()
+		rate := client.sampler.Rate()
+		if f != nil || follow != nil || replayedTo >= batch[0].ID || rate > 0 {
+			matched := make([]Packet, 0, len(batch))
+			for i := range batch {
+				if batch[i].ID > replayedTo && (f == nil || f.Match(&batch[i])) && (follow == nil || follow.Match(&batch[i])) {
+					matched = append(matched, batch[i])
+				}
+			}
+			if rate > 0 {
+				matched = client.sampler.sample(matched)
+			}
+			if len(matched) == 0 {
+				continue
+			}
+			data = marshalPacketsMessage(matched, false)
+		} else {
+			if all == nil {
+				all = marshalPacketsMessage(batch, false)
+			}
+			data = all
+		}
+		if data == nil {
+			continue
+		}
+		client.deliver(data, true)
+	}
+}
+
+// marshalPacketsMessage encodes a packets message. seq is the ID of its last packet and
+// resume the token to reconnect with to carry on after it.
+func marshalPacketsMessage(packets []Packet, replay bool) []byte {
+	last := packets[len(packets)-1].ID
+	message := map[string]interface{}{
+		"type":   "packets",
+		"data":   packets,
+		"seq":    last,
+		"resume": resumeToken(last),
+	}
+	if replay {
+		message["replay"] = true
+	}
+	data, err := json.Marshal(message)
+	if err != nil {
+		return nil
+	}
+	return data
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+)
+
+// captureConfigSetting is where the capture configuration saved through the API is persisted
+const captureConfigSetting = "capture_config"
+
+// maxLivePackets caps the live buffer so a typo can't exhaust a Pi's memory
+const maxLivePackets = 1000000
+
+// CaptureConfig holds the capture settings that can be changed while running, through
+// /api/config
+type CaptureConfig struct {
+	Filter            string  `json:"filter"`                   // BPF expression applied to the capture; empty for everything
+	MaxPackets        int     `json:"maxPackets"`               // Packets kept in the live buffer
+	SampleRate        int     `json:"sampleRate"`               // Process 1 in N packets; 1 for all
+	BroadcastRate     int     `json:"broadcastRate"`            // Packets per second sent to clients; 0 for no limit
+	BroadcastInterval float64 `json:"broadcastIntervalSeconds"` // How often packets are sent to clients in one message; 0 for each as captured
+	StatsInterval     float64 `json:"statsIntervalSeconds"`     // How often stats are sent to clients
+	Retention         string  `json:"retention"`                // Maximum packet age, e.g. 30d; empty to keep forever
+	RetentionTables   string  `json:"retentionTables"`          // table=age policies, as for -retention-tables
+}
+
+// Validate checks every setting, compiling the filter and parsing the retention policies
+func (c CaptureConfig) Validate() error {
+	if c.Filter != "" {
+		if _, err := pcap.NewBPF(layers.LinkTypeEthernet, 65536, c.Filter); err != nil {
+			return fmt.Errorf("invalid filter %q: %v", c.Filter, err)
+		}
+	}
+	if c.MaxPackets < 1 || c.MaxPackets > maxLivePackets {
+		return fmt.Errorf("maxPackets must be between 1 and %d", maxLivePackets)
+	}
+	if c.SampleRate < 1 {
+		return fmt.Errorf("sampleRate must be at least 1")
+	}
+	if c.BroadcastRate < 0 {
+		return fmt.Errorf("broadcastRate can't be negative")
+	}
+	if c.BroadcastInterval < 0 || c.BroadcastInterval > 5 {
+		return fmt.Errorf("broadcastIntervalSeconds must be between 0 and 5")
+	}
+	if c.StatsInterval < 0.1 || c.StatsInterval > 3600 {
+		return fmt.Errorf("statsIntervalSeconds must be between 0.1 and 3600")
+	}
+	if _, err := ParseRetentionPolicies(c.Retention, c.RetentionTables); err != nil {
+		return fmt.Errorf("invalid retention: %v", err)
+	}
+	return nil
+}
+
+// captureConfigFlags maps the flag of each capture setting to its /api/config field
+var captureConfigFlags = map[string]string{
+	"capture-filter":     "filter",
+	"max-packets":        "maxPackets",
+	"sample-rate":        "sampleRate",
+	"broadcast-rate":     "broadcastRate",
+	"broadcast-interval": "broadcastIntervalSeconds",
+	"stats-interval":     "statsIntervalSeconds",
+	"retention":          "retention",
+	"retention-tables":   "retentionTables",
+}
+
+// overriddenCaptureFields returns the /api/config fields whose flags were given on the
+// command line, which LoadCaptureConfig puts back in place of saved changes on restart
+func overriddenCaptureFields(explicit map[string]bool) []string {
+	fields := []string{}
+	for name, field := range captureConfigFlags {
+		if explicit[name] {
+			fields = append(fields, field)
+		}
+	}
+	sort.Strings(fields)
+	return fields
+}
+
+// LoadCaptureConfig returns the configuration to start with: the configuration saved
+// through the API, with the value of each flag given explicitly in its place
+func LoadCaptureConfig(db *Database, flags CaptureConfig, explicit map[string]bool) (CaptureConfig, error) {
+	config := flags
+	if db != nil {
+		if value, ok, err := db.GetSetting(captureConfigSetting); err == nil && ok {
+			if err := json.Unmarshal([]byte(value), &config); err != nil {
+				log.Printf("Warning: ignoring saved capture configuration: %v", err)
+				config = flags
+			}
+		}
+	}
+
+	for name, apply := range map[string]func(){
+		"capture-filter":     func() { config.Filter = flags.Filter },
+		"max-packets":        func() { config.MaxPackets = flags.MaxPackets },
+		"sample-rate":        func() { config.SampleRate = flags.SampleRate },
+		"broadcast-rate":     func() { config.BroadcastRate = flags.BroadcastRate },
+		"broadcast-interval": func() { config.BroadcastInterval = flags.BroadcastInterval },
+		"stats-interval":     func() { config.StatsInterval = flags.StatsInterval },
+		"retention":          func() { config.Retention = flags.Retention },
+		"retention-tables":   func() { config.RetentionTables = flags.RetentionTables },
+	} {
+		if explicit[name] {
+			apply()
+		}
+	}
+	config.Filter = strings.TrimSpace(config.Filter)
+	return config, config.Validate()
+}
+
+// CaptureSettings applies the capture configuration to the running capture, live buffer,
+// client broadcasts and retention, and saves changes so they survive a restart
+type CaptureSettings struct {
+	db        *Database
+	store     *PacketStore
+	retention *RetentionManager // nil without a database
+
+	mu      sync.RWMutex
+	config  CaptureConfig
+	handles map[*pcap.Handle]bool // Open captures the filter is applied to
+
+	seen atomic.Int64 // Packets seen by the capture, for sampling
+
+	rateMu     sync.Mutex
+	rateSecond int64 // Unix second rateCount is for
+	rateCount  int
+}
+
+// NewCaptureSettings manages a configuration already applied to store and retention
+func NewCaptureSettings(config CaptureConfig, db *Database, store *PacketStore, retention *RetentionManager) *CaptureSettings {
+	return &CaptureSettings{
+		db:        db,
+		store:     store,
+		retention: retention,
+		config:    config,
+		handles:   make(map[*pcap.Handle]bool),
+	}
+}
+
+// Config returns the current configuration
+func (cs *CaptureSettings) Config() CaptureConfig {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	return cs.config
+}
+
+// Update validates and applies a new configuration, then saves it
+func (cs *CaptureSettings) Update(config CaptureConfig) error {
+	config.Filter = strings.TrimSpace(config.Filter)
+	if err := config.Validate(); err != nil {
+		return err
+	}
+	policies, _ := ParseRetentionPolicies(config.Retention, config.RetentionTables)
+
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	if cs.retention == nil && (config.Retention != cs.config.Retention || config.RetentionTables != cs.config.RetentionTables) {
+		return fmt.Errorf("retention needs the database")
+	}
+
+	if config.Filter != cs.config.Filter {
+		for handle := range cs.handles {
+			if err := handle.SetBPFFilter(config.Filter); err != nil {
+				return fmt.Errorf("error applying filter: %v", err)
+			}
+		}
+		if config.Filter != "" {
+			log.Printf("Capture filter set to %q", config.Filter)
+		} else {
+			log.Printf("Capture filter cleared")
+		}
+	}
+	cs.store.SetMaxPackets(config.MaxPackets)
+	if cs.retention != nil {
+		cs.retention.SetPolicies(policies)
+	}
+	cs.config = config
+
+	if cs.db != nil {
+		data, _ := json.Marshal(config)
+		if err := cs.db.SetSetting(captureConfigSetting, string(data)); err != nil {
+			return fmt.Errorf("applied but not saved: %v", err)
+		}
+	}
+	return nil
+}
+
+// attach applies the filter to a newly opened capture and keeps it applied through updates
+// until the returned function is called
+func (cs *CaptureSettings) attach(handle *pcap.Handle) (func(), error) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	if cs.config.Filter != "" {
+		if err := handle.SetBPFFilter(cs.config.Filter); err != nil {
+			return nil, fmt.Errorf("error applying filter %q: %v", cs.config.Filter, err)
+		}
+	}
+	cs.handles[handle] = true
+	return func() {
+		cs.mu.Lock()
+		delete(cs.handles, handle)
+		cs.mu.Unlock()
+	}, nil
+}
+
+// sample reports whether the capture should process its next packet
+func (cs *CaptureSettings) sample() bool {
+	cs.mu.RLock()
+	rate := cs.config.SampleRate
+	cs.mu.RUnlock()
+	return rate <= 1 || cs.seen.Add(1)%int64(rate) == 0
+}
+
+// allowBroadcast reports whether another packet can be sent to clients this second
+func (cs *CaptureSettings) allowBroadcast() bool {
+	cs.mu.RLock()
+	limit := cs.config.BroadcastRate
+	cs.mu.RUnlock()
+	if limit == 0 {
+		return true
+	}
+
+	cs.rateMu.Lock()
+	defer cs.rateMu.Unlock()
+	if now := time.Now().Unix(); now != cs.rateSecond {
+		cs.rateSecond = now
+		cs.rateCount = 0
+	}
+	if cs.rateCount >= limit {
+		return false
+	}
+	cs.rateCount++
+	return true
+}
+
+// StatsInterval returns how often stats are sent to clients
+func (cs *CaptureSettings) StatsInterval() time.Duration {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	return time.Duration(cs.config.StatsInterval * float64(time.Second))
+}
+
+// BroadcastInterval returns how often batched packets are sent to clients, 0 for each as
+// it is captured
+func (cs *CaptureSettings) BroadcastInterval() time.Duration {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	return time.Duration(cs.config.BroadcastInterval * float64(time.Second))
+}
+
+// SetMaxPackets resizes the live buffer, dropping the oldest packets if it shrinks
+func (ps *PacketStore) SetMaxPackets(n int) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	if over := len(ps.packets) - n; over > 0 {
+		ps.packets = append(make([]Packet, 0, n), ps.packets[over:]...)
+	}
+	ps.maxPackets = n
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Channels live clients subscribe to, so a stats widget isn't sent every packet
+const (
+	channelPackets uint32 = 1 << iota
+	channelStats
+	channelConnections
+	channelAlerts
+	channelDevices
+
+	channelsAll = channelPackets | channelStats | channelConnections | channelAlerts | channelDevices
+)
+
+// wsChannels names the channels for ?channels= and subscribe messages
+var wsChannels = map[string]uint32{
+	"packets":     channelPackets,
+	"stats":       channelStats,
+	"connections": channelConnections,
+	"alerts":      channelAlerts,
+	"devices":     channelDevices,
+}
+
+// messageChannels is the channel each broadcast message type belongs to. Types not
+// listed, like init and filter replies, go to every client.
+var messageChannels = map[string]uint32{
+	"packet":      channelPackets,
+	"packets":     channelPackets,
+	"stats":       channelStats,
+	"statsDelta":  channelStats,
+	"disk":        channelStats,
+	"maintenance": channelStats,
+	"connections": channelConnections,
+	"alert":       channelAlerts,
+	"presence":    channelDevices,
+}
+
+// parseChannels reads a comma-separated channel list such as "stats,alerts"
+func parseChannels(list string) (uint32, error) {
+	var channels uint32
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		c, ok := wsChannels[name]
+		if !ok {
+			return 0, fmt.Errorf("invalid channel %q (expected %s)", name, strings.Join(channelNames(channelsAll), ", "))
+		}
+		channels |= c
+	}
+	return channels, nil
+}
+
+// channelNames lists the names of the channels in a set, sorted
+func channelNames(channels uint32) []string {
+	names := []string{}
+	for name, c := range wsChannels {
+		if channels&c != 0 {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// wants reports whether the client is subscribed to the channel a message type belongs to
+func (c *wsClient) wants(messageType string) bool {
+	if c.types != nil && !c.types[messageType] {
+		return false
+	}
+	if (messageType == "stats" && c.statsDeltas) || (messageType == "statsDelta" && !c.statsDeltas) {
+		return false
+	}
+	channel, ok := messageChannels[messageType]
+	return !ok || c.channels.Load()&channel != 0
+}
+
+// subscribe adds channels to or removes them from the client's subscriptions, answering
+// with a channels message listing them. A client that connected without choosing any
+// gets everything until its first subscribe, which narrows it to that channel. Only the
+// client's reader calls this, so there is one writer.
+func (c *wsClient) subscribe(list string, on bool) {
+	reply := map[string]interface{}{}
+	if channels, err := parseChannels(list); err != nil {
+		reply["error"] = err.Error()
+	} else {
+		current := c.channels.Load()
+		if !c.channelsChosen.Swap(true) && on {
+			current = 0
+		}
+		if on {
+			current |= channels
+			if channels&channelPackets != 0 {
+				c.degraded.Store(false)
+			}
+		} else {
+			current &^= channels
+		}
+		c.channels.Store(current)
+	}
+	reply["channels"] = channelNames(c.channels.Load())
+	c.reply("channels", reply)
+}
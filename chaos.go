@@ -0,0 +1,134 @@
+//go:build chaos
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// chaosConfig controls the faults injected by a chaos build
+type chaosConfig struct {
+	CaptureErrorRate   float64 `json:"captureErrorRate"`   // Probability per packet that capture fails
+	SlowClientDelayMs  int     `json:"slowClientDelayMs"`  // Delay before every WebSocket write
+	EnrichmentDelayMs  int     `json:"enrichmentDelayMs"`  // Delay before every hostname/GeoIP lookup
+	EnrichmentFailRate float64 `json:"enrichmentFailRate"` // Probability that a lookup fails after the delay
+}
+
+var (
+	chaosMu  sync.RWMutex
+	chaosCfg chaosConfig
+)
+
+func init() {
+	log.Printf("WARNING: chaos build, fault injection available at /api/chaos")
+}
+
+func currentChaos() chaosConfig {
+	chaosMu.RLock()
+	defer chaosMu.RUnlock()
+	return chaosCfg
+}
+
+// chaosCaptureFault returns an error when a capture failure should be simulated
+func chaosCaptureFault() error {
+	if rate := currentChaos().CaptureErrorRate; rate > 0 && rand.Float64() < rate {
+		return errors.New("chaos: injected capture error")
+	}
+	return nil
+}
+
+// chaosSlowClient delays a WebSocket write
+func chaosSlowClient() {
+	if ms := currentChaos().SlowClientDelayMs; ms > 0 {
+		time.Sleep(time.Duration(ms) * time.Millisecond)
+	}
+}
+
+// chaosEnrichmentFault delays an enrichment lookup and optionally fails it
+func chaosEnrichmentFault() error {
+	cfg := currentChaos()
+	if cfg.EnrichmentDelayMs > 0 {
+		time.Sleep(time.Duration(cfg.EnrichmentDelayMs) * time.Millisecond)
+	}
+	if cfg.EnrichmentFailRate > 0 && rand.Float64() < cfg.EnrichmentFailRate {
+		return errors.New("chaos: injected enrichment timeout")
+	}
+	return nil
+}
+
+// chaosLockDatabase holds an exclusive lock on the database for the given duration,
+// forcing concurrent writers into busy-timeout waits
+func chaosLockDatabase(db *Database, d time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), d+10*time.Second)
+	defer cancel()
+
+	conn, err := db.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, "BEGIN EXCLUSIVE"); err != nil {
+		return err
+	}
+	time.Sleep(d)
+	_, err = conn.ExecContext(ctx, "ROLLBACK")
+	return err
+}
+
+// registerChaosHandlers exposes the fault injection controls
+func registerChaosHandlers(db *Database) {
+	// GET returns the current faults, POST replaces them
+	http.HandleFunc("/api/chaos", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		if r.Method == http.MethodPost {
+			var cfg chaosConfig
+			if err := json.NewDecoder(r.Body).Decode(&cfg); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			chaosMu.Lock()
+			chaosCfg = cfg
+			chaosMu.Unlock()
+			log.Printf("Chaos faults updated: %+v", cfg)
+		}
+
+		json.NewEncoder(w).Encode(currentChaos())
+	})
+
+	// One-shot database lock, e.g. POST /api/chaos/db-lock?ms=8000
+	http.HandleFunc("/api/chaos/db-lock", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if db == nil {
+			http.Error(w, "Database disabled", http.StatusBadRequest)
+			return
+		}
+
+		ms := 5000
+		if v := r.URL.Query().Get("ms"); v != "" {
+			fmt.Sscanf(v, "%d", &ms)
+		}
+
+		go func() {
+			log.Printf("Chaos: holding database lock for %dms", ms)
+			if err := chaosLockDatabase(db, time.Duration(ms)*time.Millisecond); err != nil {
+				log.Printf("Chaos: database lock failed: %v", err)
+			}
+		}()
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"status": "ok", "lockMs": ms})
+	})
+}
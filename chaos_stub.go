@@ -0,0 +1,13 @@
+//go:build !chaos
+
+package main
+
+// Fault injection hooks compile to no-ops unless built with -tags chaos
+
+func chaosCaptureFault() error { return nil }
+
+func chaosSlowClient() {}
+
+func chaosEnrichmentFault() error { return nil }
+
+func registerChaosHandlers(db *Database) {}
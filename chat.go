@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// chatMessage formats an alert as a one-line chat message
+func chatMessage(a Alert) string {
+	if a.State == alertStateResolved {
+		return fmt.Sprintf("✅ Resolved: %s (%s)", a.Rule, a.Subject)
+	}
+	icon := map[string]string{severityInfo: "ℹ️", severityWarning: "⚠️", severityCritical: "🚨"}[a.Severity]
+	return fmt.Sprintf("%s [%s] %s", icon, a.Severity, a.Message)
+}
+
+// chatClient is shared by the chat notifiers
+var chatClient = &http.Client{Timeout: 10 * time.Second}
+
+// checkWebhookURL validates an incoming-webhook URL
+func checkWebhookURL(kind, rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Scheme != "https" || u.Host == "" {
+		return fmt.Errorf("invalid %s webhook URL %q", kind, rawURL)
+	}
+	return nil
+}
+
+// SlackNotifier posts alerts to a Slack incoming webhook
+type SlackNotifier struct {
+	url string
+}
+
+// NewSlackNotifier creates a notifier for a https://hooks.slack.com/... URL
+func NewSlackNotifier(webhookURL string) (*SlackNotifier, error) {
+	if err := checkWebhookURL("Slack", webhookURL); err != nil {
+		return nil, err
+	}
+	return &SlackNotifier{url: webhookURL}, nil
+}
+
+// Name implements AlertNotifier
+func (sn *SlackNotifier) Name() string {
+	return "slack"
+}
+
+// Notify implements AlertNotifier
+func (sn *SlackNotifier) Notify(a Alert) error {
+	return postJSONWithRetry(chatClient, sn.url, map[string]string{"text": chatMessage(a)})
+}
+
+// DiscordNotifier posts alerts to a Discord channel webhook
+type DiscordNotifier struct {
+	url string
+}
+
+// NewDiscordNotifier creates a notifier for a https://discord.com/api/webhooks/... URL
+func NewDiscordNotifier(webhookURL string) (*DiscordNotifier, error) {
+	if err := checkWebhookURL("Discord", webhookURL); err != nil {
+		return nil, err
+	}
+	return &DiscordNotifier{url: webhookURL}, nil
+}
+
+// Name implements AlertNotifier
+func (dn *DiscordNotifier) Name() string {
+	return "discord"
+}
+
+// Notify implements AlertNotifier
+func (dn *DiscordNotifier) Notify(a Alert) error {
+	return postJSONWithRetry(chatClient, dn.url, map[string]string{"content": chatMessage(a)})
+}
+
+// TelegramNotifier sends alerts to a chat through the Telegram Bot API
+type TelegramNotifier struct {
+	token  string
+	chatID string
+}
+
+// NewTelegramNotifier creates a notifier for the given bot token and chat ID
+func NewTelegramNotifier(token, chatID string) (*TelegramNotifier, error) {
+	if token == "" || chatID == "" {
+		return nil, fmt.Errorf("telegram needs both a bot token and a chat ID")
+	}
+	return &TelegramNotifier{token: token, chatID: chatID}, nil
+}
+
+// Name implements AlertNotifier
+func (tn *TelegramNotifier) Name() string {
+	return "telegram"
+}
+
+// Notify implements AlertNotifier
+func (tn *TelegramNotifier) Notify(a Alert) error {
+	endpoint := "https://api.telegram.org/bot" + tn.token + "/sendMessage"
+	err := postJSONWithRetry(chatClient, endpoint, map[string]string{
+		"chat_id": tn.chatID,
+		"text":    chatMessage(a),
+	})
+	if err != nil {
+		// Errors from net/http include the URL, which contains the bot token
+		return fmt.Errorf("%s", strings.ReplaceAll(err.Error(), tn.token, "<token>"))
+	}
+	return nil
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// cliUsage lists the subcommands, for pi-track help and -h
+const cliUsage = `Usage: pi-track [serve] [flags]
+       pi-track <command> [flags] [args]
+
+Commands:
+  serve     Capture traffic and serve the web UI and API (the default)
+  import    Load pcap/pcapng captures or packet archives into the database
+  export    Write stored packets as CSV, NDJSON or Parquet
+  query     Print stored packets matching a display filter
+  prune     Delete stored packets older than an age or time
+  seed      Fill the database with synthetic history
+  restore   Replace the database with a backup
+
+Run pi-track <command> -h for a command's flags.
+`
+
+// cliDatabase is the database options every subcommand working on one takes
+type cliDatabase struct {
+	path, key, keyFile *string
+	partition          *bool
+}
+
+func addCLIDatabaseFlags(fs *flag.FlagSet) cliDatabase {
+	return cliDatabase{
+		path:    fs.String("db", "pitrack.db", "SQLite database path"),
+		key:     fs.String("db-key", os.Getenv("PITRACK_DB_KEY"), "Database encryption key (default $PITRACK_DB_KEY)"),
+		keyFile: fs.String("db-key-file", "", "File holding the database encryption key"),
+		partition: fs.Bool("db-partition", false, "Read and prune the daily files next to the database, as the server's -db-partition writes "+
+			"(on by itself when there are any)"),
+	}
+}
+
+// loadKey returns the encryption key from -db-key or -db-key-file, exiting if the file
+// can't be read
+func (c cliDatabase) loadKey() string {
+	key, err := loadDBKey(*c.key, *c.keyFile)
+	if err != nil {
+		log.Fatalf("Invalid -db-key-file: %v", err)
+	}
+	return key
+}
+
+// open opens the database, exiting if it can't. Its daily files are included unless
+// there are none and -db-partition wasn't given; they're only moved to while serving.
+func (c cliDatabase) open() *Database {
+	db, err := NewDatabase(*c.path, c.loadKey(), DefaultDatabaseOptions())
+	if err != nil {
+		log.Fatalf("Failed to open database: %v", err)
+	}
+	if *c.partition || partitionsExist(*c.path) {
+		db.EnablePartitions(*c.path)
+	}
+	return db
+}
+
+// parseCLITime reads a time given on the command line: RFC3339, a date, or an age such as
+// 30d or 12h before now. Empty is nil.
+func parseCLITime(s string, now time.Time) (*time.Time, error) {
+	if s == "" {
+		return nil, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return &t, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", s, time.Local); err == nil {
+		return &t, nil
+	}
+	age, err := parseRetentionAge(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid time %q (expected RFC3339, YYYY-MM-DD or an age such as 30d)", s)
+	}
+	t := now.Add(-age)
+	return &t, nil
+}
+
+// parseCLIRange reads the -from and -to times of export and query
+func parseCLIRange(from, to string) (startTime, endTime *time.Time) {
+	now := time.Now()
+	startTime, err := parseCLITime(from, now)
+	if err != nil {
+		log.Fatalf("Invalid -from: %v", err)
+	}
+	if endTime, err = parseCLITime(to, now); err != nil {
+		log.Fatalf("Invalid -to: %v", err)
+	}
+	return startTime, endTime
+}
+
+// parseCLIFilter compiles a display filter for stored packets, nil if there's none
+func parseCLIFilter(s string) (*DisplayFilter, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	f, err := ParseDisplayFilter(s)
+	if err == nil {
+		_, _, err = f.SQL()
+	}
+	return f, err
+}
+
+// runExport implements the "export" subcommand, writing stored packets to a file or stdout
+func runExport(args []string) {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	dbFlags := addCLIDatabaseFlags(fs)
+	from := fs.String("from", "", "Export packets from this time: RFC3339, YYYY-MM-DD or an age such as 7d (the oldest if empty)")
+	to := fs.String("to", "", "Export packets up to this time, as for -from (the newest if empty)")
+	format := fs.String("format", "csv", "Output format: csv, ndjson or parquet")
+	filter := fs.String("filter", "", "Display filter packets must match, e.g. \"ip == 1.2.3.4 && port == 443\"")
+	output := fs.String("o", "", "File to write to (stdout if empty)")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: pi-track export [-db pitrack.db] [-from 7d] [-to 2024-06-01] [-format csv] [-o packets.csv]\n\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	q := PacketExport{}
+	q.StartTime, q.EndTime = parseCLIRange(*from, *to)
+	var err error
+	if q.Query, err = parseCLIFilter(*filter); err != nil {
+		log.Fatalf("Invalid -filter: %v", err)
+	}
+	var write func(io.Writer, *Database, PacketExport) error
+	switch *format {
+	case "csv":
+		write = writePacketsCSV
+	case "ndjson":
+		write = func(w io.Writer, db *Database, q PacketExport) error {
+			return db.StreamPackets(q.Filter, q.Query, q.Country, q.Interface, q.ExcludeIPs, q.StartTime, q.EndTime, newPacketJSONStream(w, true).Write)
+		}
+	case "parquet":
+		write = writePacketsParquet
+	default:
+		log.Fatalf("Invalid -format %q (expected csv, ndjson or parquet)", *format)
+	}
+
+	db := dbFlags.open()
+	defer db.Close()
+
+	out := os.Stdout
+	if *output != "" {
+		if out, err = os.Create(*output); err != nil {
+			log.Fatalf("Failed to create %s: %v", *output, err)
+		}
+	}
+	w := bufio.NewWriterSize(out, 64*1024)
+	err = write(w, db, q)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil && out != os.Stdout {
+		err = out.Close()
+	}
+	if err != nil {
+		log.Fatalf("Failed to export packets: %v", err)
+	}
+}
+
+// runQuery implements the "query" subcommand, printing the newest stored packets that
+// match a display filter
+func runQuery(args []string) {
+	fs := flag.NewFlagSet("query", flag.ExitOnError)
+	dbFlags := addCLIDatabaseFlags(fs)
+	from := fs.String("from", "", "Only packets from this time: RFC3339, YYYY-MM-DD or an age such as 1h")
+	to := fs.String("to", "", "Only packets up to this time, as for -from")
+	limit := fs.Int("limit", 50, "Packets printed, newest first (0 for all)")
+	format := fs.String("format", "table", "Output format: table, csv or ndjson")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: pi-track query [-db pitrack.db] [-from 1h] [-limit 50] ['ip == 1.2.3.4']\n\nThe filter uses the web UI's display filter syntax; every packet matches without one.\n\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() > 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	startTime, endTime := parseCLIRange(*from, *to)
+	expr, err := parseCLIFilter(fs.Arg(0))
+	if err != nil {
+		log.Fatalf("Invalid filter: %v", err)
+	}
+	if *limit <= 0 {
+		*limit = -1 // SQLite's LIMIT for no limit
+	}
+
+	w := bufio.NewWriter(os.Stdout)
+	var emit func(Packet) error
+	var done func() error
+	switch *format {
+	case "table":
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "TIME\tPROTOCOL\tSOURCE\tDESTINATION\tLENGTH\tAPPLICATION\tPROCESS\tINFO")
+		emit = func(p Packet) error {
+			_, err := fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\t%s\t%s\t%s\n", p.Timestamp.Local().Format("2006-01-02 15:04:05.000"),
+				p.Protocol, cliEndpoint(p.SrcIP, p.SrcPort), cliEndpoint(p.DstIP, p.DstPort), p.Length, p.Application, p.ProcessName, p.Info)
+			return err
+		}
+		done = tw.Flush
+	case "csv":
+		out := csv.NewWriter(w)
+		out.Write(packetCSVHeader)
+		emit = func(p Packet) error { return out.Write(packetCSVRecord(p)) }
+		done = func() error {
+			out.Flush()
+			return out.Error()
+		}
+	case "ndjson":
+		emit = newPacketJSONStream(w, true).Write
+		done = func() error { return nil }
+	default:
+		log.Fatalf("Invalid -format %q (expected table, csv or ndjson)", *format)
+	}
+
+	db := dbFlags.open()
+	defer db.Close()
+
+	err = db.QueryPackets(*limit, 0, "", expr, "", "", nil, startTime, endTime, emit)
+	if err == nil {
+		err = done()
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		log.Fatalf("Failed to query packets: %v", err)
+	}
+}
+
+// cliEndpoint formats an address and port, leaving out a zero port
+func cliEndpoint(ip string, port uint16) string {
+	if port == 0 {
+		return ip
+	}
+	if strings.Contains(ip, ":") {
+		return fmt.Sprintf("[%s]:%d", ip, port)
+	}
+	return fmt.Sprintf("%s:%d", ip, port)
+}
+
+// runPrune implements the "prune" subcommand, applying retention once, as -retention and
+// -retention-tables do every hour while serving
+func runPrune(args []string) {
+	fs := flag.NewFlagSet("prune", flag.ExitOnError)
+	dbFlags := addCLIDatabaseFlags(fs)
+	before := fs.String("before", "", "Delete packets older than this: an age such as 30d, YYYY-MM-DD or RFC3339")
+	tables := fs.String("tables", "", "Comma-separated table=age policies for other tables, as for -retention-tables")
+	archiveDir := fs.String("archive-dir", "", "Append packets to gzip'd JSONL files in this directory before deleting them")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: pi-track prune [-db pitrack.db] -before 30d [-tables alerts=90d]\n\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 0 || (*before == "" && *tables == "") {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	policies, err := ParseRetentionPolicies("", *tables)
+	if err != nil {
+		log.Fatalf("Invalid -tables: %v", err)
+	}
+	if *before != "" {
+		cutoff, err := parseCLITime(*before, time.Now())
+		if err != nil {
+			log.Fatalf("Invalid -before: %v", err)
+		}
+		age := time.Since(*cutoff)
+		if age <= 0 {
+			log.Fatalf("Invalid -before: %s is in the future", *before)
+		}
+		policies["packets"] = age
+	}
+	var archive *Archiver
+	if *archiveDir != "" {
+		if archive, err = NewArchiver(*archiveDir); err != nil {
+			log.Fatalf("Invalid -archive-dir: %v", err)
+		}
+	}
+
+	db := dbFlags.open()
+	defer db.Close()
+
+	run := NewRetentionManager(db, policies, archive).Run()
+	if run.Error != "" {
+		log.Fatalf("Failed to prune: %s", run.Error)
+	}
+	tablesPruned := make([]string, 0, len(run.Deleted))
+	for table := range run.Deleted {
+		tablesPruned = append(tablesPruned, table)
+	}
+	sort.Strings(tablesPruned)
+	for _, table := range tablesPruned {
+		fmt.Printf("%s: deleted %d rows\n", table, run.Deleted[table])
+	}
+	if run.Archived > 0 {
+		fmt.Printf("Archived %d packets to %s\n", run.Archived, *archiveDir)
+	}
+	fmt.Printf("Reclaimed %s\n", formatBytes(run.ReclaimedBytes))
+}
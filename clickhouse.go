@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ClickHouse writer settings
+const (
+	clickHouseFlushInterval = 5 * time.Second
+	clickHouseBatchSize     = 5000   // Rows per INSERT
+	clickHouseMaxQueue      = 200000 // Rows held while ClickHouse is unreachable before dropping
+	clickHouseTimeFormat    = "2006-01-02 15:04:05.000000"
+)
+
+// ClickHouseConfig configures the ClickHouse writer
+type ClickHouseConfig struct {
+	URL      string // HTTP interface, e.g. http://localhost:8123
+	Database string
+	Username string
+	Password string
+	TTL      time.Duration // Drop rows older than this; 0 keeps them forever
+}
+
+// clickHousePacket is a packets table row
+type clickHousePacket struct {
+	Timestamp   string `json:"timestamp"`
+	SrcIP       string `json:"src_ip"`
+	DstIP       string `json:"dst_ip"`
+	SrcPort     uint16 `json:"src_port"`
+	DstPort     uint16 `json:"dst_port"`
+	Protocol    string `json:"protocol"`
+	Length      int    `json:"length"`
+	Info        string `json:"info"`
+	SrcMAC      string `json:"src_mac"`
+	DstMAC      string `json:"dst_mac"`
+	Application string `json:"application"`
+	SrcHostname string `json:"src_hostname"`
+	DstHostname string `json:"dst_hostname"`
+	SrcCountry  string `json:"src_country"`
+	DstCountry  string `json:"dst_country"`
+	ProcessName string `json:"process_name"`
+}
+
+// clickHouseFlow is a flows table row
+type clickHouseFlow struct {
+	FirstSeen string `json:"first_seen"`
+	LastSeen  string `json:"last_seen"`
+	SrcIP     string `json:"src_ip"`
+	DstIP     string `json:"dst_ip"`
+	SrcPort   uint16 `json:"src_port"`
+	DstPort   uint16 `json:"dst_port"`
+	Protocol  string `json:"protocol"`
+	Packets   int64  `json:"packets"`
+	Bytes     int64  `json:"bytes"`
+	TCPFlags  uint8  `json:"tcp_flags"`
+	EndReason string `json:"end_reason"`
+}
+
+// ClickHouseStats describes what the writer has done
+type ClickHouseStats struct {
+	URL            string     `json:"url"`
+	Database       string     `json:"database"`
+	PacketsWritten int64      `json:"packetsWritten"`
+	FlowsWritten   int64      `json:"flowsWritten"`
+	Queued         int        `json:"queued"`
+	Dropped        int64      `json:"dropped"` // Rows lost because the queue was full
+	LastError      string     `json:"lastError,omitempty"`
+	LastWrite      *time.Time `json:"lastWrite,omitempty"`
+}
+
+// ClickHouseWriter logs packets and flow records to ClickHouse through its HTTP interface.
+// Its compressed column storage holds months of per-packet data that would swamp SQLite.
+// Rows are batched, and held in memory (up to clickHouseMaxQueue) while the server is down.
+type ClickHouseWriter struct {
+	cfg    ClickHouseConfig
+	client *http.Client
+
+	mu      sync.Mutex
+	packets [][]byte // Rows queued as JSON
+	flows   [][]byte
+	stats   ClickHouseStats
+}
+
+// NewClickHouseWriter creates a writer and makes sure the database and tables exist
+func NewClickHouseWriter(cfg ClickHouseConfig) (*ClickHouseWriter, error) {
+	u, err := url.Parse(cfg.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid ClickHouse URL %q, expected e.g. http://localhost:8123", cfg.URL)
+	}
+	if cfg.Database == "" {
+		cfg.Database = "pitrack"
+	}
+	cw := &ClickHouseWriter{
+		cfg:    cfg,
+		client: &http.Client{Timeout: 30 * time.Second},
+		stats:  ClickHouseStats{URL: u.Scheme + "://" + u.Host, Database: cfg.Database},
+	}
+	if err := cw.createTables(); err != nil {
+		return nil, fmt.Errorf("setting up ClickHouse: %v", err)
+	}
+	return cw, nil
+}
+
+func (cw *ClickHouseWriter) createTables() error {
+	ttl := func(column string) string {
+		if cw.cfg.TTL <= 0 {
+			return ""
+		}
+		return fmt.Sprintf(" TTL toDateTime(%s) + toIntervalSecond(%d)", column, int64(cw.cfg.TTL.Seconds()))
+	}
+	statements := []string{
+		"CREATE DATABASE IF NOT EXISTS " + cw.cfg.Database,
+		`CREATE TABLE IF NOT EXISTS ` + cw.cfg.Database + `.packets (
+			timestamp DateTime64(6, 'UTC'),
+			src_ip String,
+			dst_ip String,
+			src_port UInt16,
+			dst_port UInt16,
+			protocol LowCardinality(String),
+			length UInt32,
+			info String CODEC(ZSTD),
+			src_mac LowCardinality(String),
+			dst_mac LowCardinality(String),
+			application LowCardinality(String),
+			src_hostname String CODEC(ZSTD),
+			dst_hostname String CODEC(ZSTD),
+			src_country LowCardinality(String),
+			dst_country LowCardinality(String),
+			process_name LowCardinality(String)
+		) ENGINE = MergeTree
+		PARTITION BY toYYYYMM(timestamp)
+		ORDER BY timestamp` + ttl("timestamp"),
+		`CREATE TABLE IF NOT EXISTS ` + cw.cfg.Database + `.flows (
+			first_seen DateTime64(6, 'UTC'),
+			last_seen DateTime64(6, 'UTC'),
+			src_ip String,
+			dst_ip String,
+			src_port UInt16,
+			dst_port UInt16,
+			protocol LowCardinality(String),
+			packets UInt64,
+			bytes UInt64,
+			tcp_flags UInt8,
+			end_reason LowCardinality(String)
+		) ENGINE = MergeTree
+		PARTITION BY toYYYYMM(first_seen)
+		ORDER BY first_seen` + ttl("first_seen"),
+	}
+	for _, stmt := range statements {
+		if err := cw.exec(stmt, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// exec runs a statement over the HTTP interface, with body as its data if not nil
+func (cw *ClickHouseWriter) exec(query string, body io.Reader) error {
+	target := cw.cfg.URL + "?query=" + url.QueryEscape(query)
+	req, err := http.NewRequest(http.MethodPost, target, body)
+	if err != nil {
+		return err
+	}
+	if cw.cfg.Username != "" {
+		req.Header.Set("X-ClickHouse-User", cw.cfg.Username)
+		req.Header.Set("X-ClickHouse-Key", cw.cfg.Password)
+	}
+	resp, err := cw.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("ClickHouse returned %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// Start flushes queued rows in the background
+func (cw *ClickHouseWriter) Start() {
+	go func() {
+		ticker := time.NewTicker(clickHouseFlushInterval)
+		for range ticker.C {
+			cw.Flush()
+		}
+	}()
+}
+
+// Observe implements PacketObserver
+func (cw *ClickHouseWriter) Observe(p Packet) {
+	row, err := json.Marshal(clickHousePacket{
+		Timestamp:   p.Timestamp.UTC().Format(clickHouseTimeFormat),
+		SrcIP:       p.SrcIP,
+		DstIP:       p.DstIP,
+		SrcPort:     p.SrcPort,
+		DstPort:     p.DstPort,
+		Protocol:    p.Protocol,
+		Length:      p.Length,
+		Info:        p.Info,
+		SrcMAC:      p.SrcMAC,
+		DstMAC:      p.DstMAC,
+		Application: p.Application,
+		SrcHostname: p.SrcHostname,
+		DstHostname: p.DstHostname,
+		SrcCountry:  p.SrcCountry,
+		DstCountry:  p.DstCountry,
+		ProcessName: p.ProcessName,
+	})
+	if err != nil {
+		return
+	}
+
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+	if len(cw.packets)+len(cw.flows) >= clickHouseMaxQueue {
+		cw.stats.Dropped++
+		return
+	}
+	cw.packets = append(cw.packets, row)
+}
+
+// Export implements FlowExporter
+func (cw *ClickHouseWriter) Export(flows []Flow) error {
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+	for _, f := range flows {
+		if len(cw.packets)+len(cw.flows) >= clickHouseMaxQueue {
+			cw.stats.Dropped++
+			continue
+		}
+		row, err := json.Marshal(clickHouseFlow{
+			FirstSeen: f.FirstSeen.UTC().Format(clickHouseTimeFormat),
+			LastSeen:  f.LastSeen.UTC().Format(clickHouseTimeFormat),
+			SrcIP:     f.SrcIP,
+			DstIP:     f.DstIP,
+			SrcPort:   f.SrcPort,
+			DstPort:   f.DstPort,
+			Protocol:  f.Protocol,
+			Packets:   f.Packets,
+			Bytes:     f.Bytes,
+			TCPFlags:  f.TCPFlags,
+			EndReason: f.EndReason,
+		})
+		if err != nil {
+			return err
+		}
+		cw.flows = append(cw.flows, row)
+	}
+	return nil
+}
+
+// Flush writes queued rows in batches. Rows that fail to insert stay queued for the next flush.
+func (cw *ClickHouseWriter) Flush() {
+	cw.mu.Lock()
+	packets, flows := cw.packets, cw.flows
+	cw.packets, cw.flows = nil, nil
+	cw.mu.Unlock()
+
+	packets, packetErr := cw.insert("packets", packets)
+	flows, flowErr := cw.insert("flows", flows)
+
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+	// Put back what wasn't written, ahead of anything queued meanwhile
+	cw.packets = append(packets, cw.packets...)
+	cw.flows = append(flows, cw.flows...)
+	err := packetErr
+	if err == nil {
+		err = flowErr
+	}
+	if err != nil {
+		if cw.stats.LastError != err.Error() {
+			log.Printf("Error writing to ClickHouse: %v", err)
+		}
+		cw.stats.LastError = err.Error()
+	} else {
+		cw.stats.LastError = ""
+	}
+}
+
+// insert writes JSON rows to a table in batches, returning the rows left unwritten
+func (cw *ClickHouseWriter) insert(table string, rows [][]byte) ([][]byte, error) {
+	for len(rows) > 0 {
+		n := len(rows)
+		if n > clickHouseBatchSize {
+			n = clickHouseBatchSize
+		}
+		body := bytes.Join(rows[:n], []byte("\n"))
+		if err := cw.exec("INSERT INTO "+cw.cfg.Database+"."+table+" FORMAT JSONEachRow", bytes.NewReader(body)); err != nil {
+			return rows, err
+		}
+
+		now := time.Now()
+		cw.mu.Lock()
+		if table == "packets" {
+			cw.stats.PacketsWritten += int64(n)
+		} else {
+			cw.stats.FlowsWritten += int64(n)
+		}
+		cw.stats.LastWrite = &now
+		cw.mu.Unlock()
+		rows = rows[n:]
+	}
+	return nil, nil
+}
+
+// Stats returns the writer's counters
+func (cw *ClickHouseWriter) Stats() ClickHouseStats {
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+	stats := cw.stats
+	stats.Queued = len(cw.packets) + len(cw.flows)
+	return stats
+}
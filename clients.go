@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// What happens to a live client that can't keep up, once its send buffer is full
+const (
+	slowClientDegrade    = "degrade"    // Stop sending it packets, then disconnect it if it still can't keep up
+	slowClientDisconnect = "disconnect" // Disconnect it straight away
+	slowClientDrop       = "drop"       // Leave out the messages that don't fit, as before
+)
+
+// parseSlowClientPolicy checks a -slow-client-policy value
+func parseSlowClientPolicy(s string) (string, error) {
+	switch s {
+	case slowClientDegrade, slowClientDisconnect, slowClientDrop:
+		return s, nil
+	}
+	return "", fmt.Errorf("invalid slow client policy %q (expected degrade, disconnect or drop)", s)
+}
+
+// clientStats are a live client's counters, kept for /api/clients
+type clientStats struct {
+	id        int64
+	kind      string // "websocket" or "events"
+	remote    string
+	connected time.Time
+
+	sent     atomic.Int64
+	dropped  atomic.Int64
+	degraded atomic.Bool
+
+	notices   chan []byte   // Messages about the client itself, sent ahead of its queue
+	evicted   chan struct{} // Closed when the client is to be disconnected
+	evictOnce sync.Once
+	reason    string // Why it was disconnected, set before evicted is closed
+}
+
+var nextClientID atomic.Int64
+
+func newClientStats(r *http.Request, kind string) clientStats {
+	return clientStats{
+		id:        nextClientID.Add(1),
+		kind:      kind,
+		remote:    r.RemoteAddr,
+		connected: time.Now(),
+		notices:   make(chan []byte, 1),
+		evicted:   make(chan struct{}),
+	}
+}
+
+// deliver queues a message for the client. When the queue is full the message is dropped
+// and the store's slow-client policy applies: with degrade, a client that can't keep up
+// with packets is unsubscribed from them and its backlog discarded, and one that can't
+// keep up even then is disconnected.
+func (c *wsClient) deliver(data []byte, packets bool) {
+	select {
+	case c.send <- data:
+		c.sent.Add(1)
+		return
+	default:
+	}
+	c.dropped.Add(1)
+
+	switch c.store.slowClients {
+	case slowClientDegrade:
+		if packets && !c.degraded.Swap(true) {
+			for {
+				old := c.channels.Load()
+				if c.channels.CompareAndSwap(old, old&^channelPackets) {
+					break
+				}
+			}
+			// The packets still queued are stale by now; discard them so the rest flows again
+			for drained := false; !drained; {
+				select {
+				case <-c.send:
+					c.sent.Add(-1)
+					c.dropped.Add(1)
+				default:
+					drained = true
+				}
+			}
+			c.notice("slow", map[string]interface{}{
+				"action":   "degraded",
+				"reason":   "too slow for the packet stream; packets are no longer sent",
+				"channels": channelNames(c.channels.Load()),
+			})
+		} else if !packets || c.degraded.Load() {
+			c.evict("too slow, even without packets")
+		}
+	case slowClientDisconnect:
+		c.evict("too slow to keep up with the live stream")
+	}
+}
+
+// notice sends the client a message about itself, ahead of whatever it has queued
+func (c *wsClient) notice(messageType string, data interface{}) {
+	msg, _ := json.Marshal(map[string]interface{}{"type": messageType, "data": data})
+	select {
+	case c.notices <- msg:
+	default:
+	}
+}
+
+// evict has the client's writer disconnect it, telling it why
+func (c *wsClient) evict(reason string) {
+	c.evictOnce.Do(func() {
+		c.reason = reason
+		close(c.evicted)
+	})
+}
+
+// ClientInfo describes a live client for /api/clients
+type ClientInfo struct {
+	ID        int64     `json:"id"`
+	Kind      string    `json:"kind"`
+	Remote    string    `json:"remote"`
+	Connected time.Time `json:"connected"`
+	Channels  []string  `json:"channels"`
+	Filter    string    `json:"filter,omitempty"`
+	Follow    string    `json:"follow,omitempty"`
+	Sent      int64     `json:"sent"`
+	Dropped   int64     `json:"dropped"`
+	Queued    int       `json:"queued"`
+	Degraded  bool      `json:"degraded"`
+	Paused    bool      `json:"paused"`
+	Rate      int       `json:"rate,omitempty"`
+	Skipped   int64     `json:"skipped"`
+}
+
+// Clients lists the connected WebSocket and event stream clients, oldest first
+func (ps *PacketStore) Clients() []ClientInfo {
+	ps.clientsMu.RLock()
+	defer ps.clientsMu.RUnlock()
+
+	list := make([]ClientInfo, 0, len(ps.clients))
+	for c := range ps.clients {
+		info := ClientInfo{
+			ID:        c.id,
+			Kind:      c.kind,
+			Remote:    c.remote,
+			Connected: c.connected,
+			Channels:  channelNames(c.channels.Load()),
+			Sent:      c.sent.Load(),
+			Dropped:   c.dropped.Load(),
+			Queued:    len(c.send),
+			Degraded:  c.degraded.Load(),
+			Paused:    c.paused.Load(),
+			Rate:      c.sampler.Rate(),
+			Skipped:   c.sampler.skipped.Load(),
+		}
+		if f := c.filter.Load(); f != nil {
+			info.Filter = f.String()
+		}
+		if f := c.follow.Load(); f != nil {
+			info.Follow = f.String()
+		}
+		list = append(list, info)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
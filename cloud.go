@@ -0,0 +1,376 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Published IP range lists. Microsoft renames its file every week, so Azure's is given
+// with -cloud-ranges-azure-url.
+const (
+	cloudRangesAWSURL        = "https://ip-ranges.amazonaws.com/ip-ranges.json"
+	cloudRangesGCPURL        = "https://www.gstatic.com/ipranges/cloud.json"
+	cloudRangesCloudflareURL = "https://api.cloudflare.com/client/v4/ips"
+	cloudRangesRetry         = 15 * time.Minute // After a failed download
+)
+
+// cloudRanges tags cloud addresses, nil without -cloud-ranges
+var cloudRanges *CloudRanges
+
+// CloudTag says which cloud an address belongs to
+type CloudTag struct {
+	Name     string `json:"name"` // e.g. "AWS eu-west-1"
+	Provider string `json:"provider"`
+	Service  string `json:"service,omitempty"`
+	Region   string `json:"region,omitempty"`
+}
+
+// cloudProvider is one provider's list and where it comes from
+type cloudProvider struct {
+	name  string // As given to -cloud-ranges
+	label string // As shown in tags
+	url   string
+	parse func(body []byte) ([]cloudPrefix, error)
+}
+
+type cloudPrefix struct {
+	cidr    string
+	service string
+	region  string
+}
+
+// CloudRanges downloads the IP ranges AWS, Google Cloud, Azure and Cloudflare publish and
+// tags addresses within them with the provider, service and region, so an anonymous EC2
+// address shows up as "AWS eu-west-1". The lists are downloaded again every refresh; a
+// provider whose download fails keeps the ranges it had. The most specific range wins.
+type CloudRanges struct {
+	providers []cloudProvider
+	refresh   time.Duration
+	client    *http.Client
+
+	table atomic.Pointer[cloudTable]
+
+	mu       sync.Mutex
+	prefixes map[string][]cloudPrefix // Last good download of each provider
+	status   map[string]*RangeListStatus
+}
+
+// RangeListStatus is how a downloaded list of addresses last went
+type RangeListStatus struct {
+	Prefixes  int        `json:"prefixes"`
+	UpdatedAt *time.Time `json:"updatedAt,omitempty"`
+	Error     string     `json:"error,omitempty"`
+}
+
+// NewCloudRanges creates the tagger for a comma-separated list of providers: aws, gcp,
+// azure (which needs azureURL) and cloudflare
+func NewCloudRanges(list, azureURL string, refresh time.Duration) (*CloudRanges, error) {
+	known := map[string]cloudProvider{
+		"aws":        {name: "aws", label: "AWS", url: cloudRangesAWSURL, parse: parseAWSRanges},
+		"gcp":        {name: "gcp", label: "Google Cloud", url: cloudRangesGCPURL, parse: parseGCPRanges},
+		"azure":      {name: "azure", label: "Azure", url: azureURL, parse: parseAzureRanges},
+		"cloudflare": {name: "cloudflare", label: "Cloudflare", url: cloudRangesCloudflareURL, parse: parseCloudflareRanges},
+	}
+	c := &CloudRanges{
+		refresh:  refresh,
+		client:   &http.Client{Timeout: 60 * time.Second},
+		prefixes: make(map[string][]cloudPrefix),
+		status:   make(map[string]*RangeListStatus),
+	}
+	for _, name := range strings.Split(list, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" || c.status[name] != nil {
+			continue
+		}
+		p, ok := known[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown provider %q (expected aws, gcp, azure or cloudflare)", name)
+		}
+		if p.url == "" {
+			return nil, fmt.Errorf("azure needs -cloud-ranges-azure-url, the ServiceTags_Public JSON file linked from Microsoft's download page")
+		}
+		c.providers = append(c.providers, p)
+		c.status[name] = &RangeListStatus{}
+	}
+	c.table.Store(&cloudTable{})
+	return c, nil
+}
+
+// Start downloads the lists in the background, then again every refresh
+func (c *CloudRanges) Start() {
+	go func() {
+		for {
+			wait := c.refresh
+			if !c.update() {
+				wait = cloudRangesRetry
+			}
+			time.Sleep(wait)
+		}
+	}()
+}
+
+// update downloads every list and rebuilds the table, reporting whether all succeeded
+func (c *CloudRanges) update() bool {
+	ok := true
+	for _, p := range c.providers {
+		prefixes, err := c.download(p)
+		c.mu.Lock()
+		s := c.status[p.name]
+		if err != nil {
+			s.Error = err.Error()
+			ok = false
+		} else {
+			now := time.Now()
+			c.prefixes[p.name] = prefixes
+			s.Prefixes, s.UpdatedAt, s.Error = len(prefixes), &now, ""
+		}
+		c.mu.Unlock()
+		if err != nil {
+			log.Printf("Warning: failed to download %s IP ranges: %v", p.label, err)
+		}
+	}
+
+	t := &cloudTable{}
+	c.mu.Lock()
+	for _, p := range c.providers {
+		for _, prefix := range c.prefixes[p.name] {
+			t.add(p.label, prefix)
+		}
+	}
+	c.mu.Unlock()
+	t.finish()
+	c.table.Store(t)
+	return ok
+}
+
+func (c *CloudRanges) download(p cloudProvider) ([]cloudPrefix, error) {
+	return downloadRangeList(c.client, p.url, p.parse)
+}
+
+// downloadRangeList fetches a list of addresses and parses it, failing if it's empty
+func downloadRangeList(client *http.Client, url string, parse func(body []byte) ([]cloudPrefix, error)) ([]cloudPrefix, error) {
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	prefixes, err := parse(body)
+	if err == nil && len(prefixes) == 0 {
+		err = fmt.Errorf("%s listed no ranges", url)
+	}
+	return prefixes, err
+}
+
+// Lookup returns the cloud an address belongs to, or nil if none
+func (c *CloudRanges) Lookup(ip string) *CloudTag {
+	if c == nil {
+		return nil
+	}
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return nil
+	}
+	return c.table.Load().lookup(parsed)
+}
+
+// Status reports each provider's last download
+func (c *CloudRanges) Status() map[string]RangeListStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	status := make(map[string]RangeListStatus, len(c.status))
+	for name, s := range c.status {
+		status[name] = *s
+	}
+	return status
+}
+
+// cloudTable finds the longest range containing an address: ranges are keyed by prefix
+// length and network, and lengths are tried longest first
+type cloudTable struct {
+	networks map[int]map[string]*CloudTag // By prefix length as IPv6 (IPv4 ones plus 96), then masked address
+	lengths  []int                        // Longest first
+}
+
+func (t *cloudTable) add(provider string, p cloudPrefix) {
+	_, network, err := net.ParseCIDR(p.cidr)
+	if err != nil {
+		return
+	}
+	ones, bits := network.Mask.Size()
+	if bits == 32 {
+		ones += 96
+	}
+	if t.networks == nil {
+		t.networks = make(map[int]map[string]*CloudTag)
+	}
+	if t.networks[ones] == nil {
+		t.networks[ones] = make(map[string]*CloudTag)
+	}
+	key := string(network.IP.To16())
+	// Listed more than once, e.g. under AWS's catch-all AMAZON and a service: keep the service
+	if tag := t.networks[ones][key]; tag != nil {
+		if tag.Service != "" || p.service == "" {
+			return
+		}
+		if p.region == "" {
+			p.region = tag.Region
+		}
+	}
+	tag := &CloudTag{Provider: provider, Service: p.service, Region: p.region}
+	tag.Name = strings.TrimSpace(provider + " " + p.region)
+	if p.region == "" && p.service != "" {
+		tag.Name = provider + " " + p.service
+	}
+	t.networks[ones][key] = tag
+}
+
+func (t *cloudTable) finish() {
+	for ones := range t.networks {
+		t.lengths = append(t.lengths, ones)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(t.lengths)))
+}
+
+func (t *cloudTable) lookup(ip net.IP) *CloudTag {
+	ip16 := ip.To16()
+	for _, ones := range t.lengths {
+		key := string(ip16.Mask(net.CIDRMask(ones, 128)))
+		if tag := t.networks[ones][key]; tag != nil {
+			return tag
+		}
+	}
+	return nil
+}
+
+// parseAWSRanges reads ip-ranges.json, where AMAZON lists every range and EC2, S3 and
+// the other services their share of them
+func parseAWSRanges(body []byte) ([]cloudPrefix, error) {
+	var doc struct {
+		Prefixes []struct {
+			IPPrefix string `json:"ip_prefix"`
+			Region   string `json:"region"`
+			Service  string `json:"service"`
+		} `json:"prefixes"`
+		IPv6Prefixes []struct {
+			IPv6Prefix string `json:"ipv6_prefix"`
+			Region     string `json:"region"`
+			Service    string `json:"service"`
+		} `json:"ipv6_prefixes"`
+	}
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return nil, err
+	}
+	service := func(s string) string {
+		if s == "AMAZON" {
+			return ""
+		}
+		return s
+	}
+	region := func(r string) string {
+		if r == "GLOBAL" {
+			return ""
+		}
+		return r
+	}
+	prefixes := []cloudPrefix{}
+	for _, p := range doc.Prefixes {
+		prefixes = append(prefixes, cloudPrefix{p.IPPrefix, service(p.Service), region(p.Region)})
+	}
+	for _, p := range doc.IPv6Prefixes {
+		prefixes = append(prefixes, cloudPrefix{p.IPv6Prefix, service(p.Service), region(p.Region)})
+	}
+	return prefixes, nil
+}
+
+// parseGCPRanges reads cloud.json, whose scope is the region
+func parseGCPRanges(body []byte) ([]cloudPrefix, error) {
+	var doc struct {
+		Prefixes []struct {
+			IPv4Prefix string `json:"ipv4Prefix"`
+			IPv6Prefix string `json:"ipv6Prefix"`
+			Scope      string `json:"scope"`
+		} `json:"prefixes"`
+	}
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return nil, err
+	}
+	prefixes := []cloudPrefix{}
+	for _, p := range doc.Prefixes {
+		region := p.Scope
+		if region == "global" {
+			region = ""
+		}
+		for _, cidr := range []string{p.IPv4Prefix, p.IPv6Prefix} {
+			if cidr != "" {
+				prefixes = append(prefixes, cloudPrefix{cidr: cidr, region: region})
+			}
+		}
+	}
+	return prefixes, nil
+}
+
+// parseAzureRanges reads a ServiceTags_Public file, where AzureCloud.<region> tags cover
+// each region and the other tags a service's share of them
+func parseAzureRanges(body []byte) ([]cloudPrefix, error) {
+	var doc struct {
+		Values []struct {
+			Name       string `json:"name"`
+			Properties struct {
+				Region          string   `json:"region"`
+				SystemService   string   `json:"systemService"`
+				AddressPrefixes []string `json:"addressPrefixes"`
+			} `json:"properties"`
+		} `json:"values"`
+	}
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return nil, err
+	}
+	prefixes := []cloudPrefix{}
+	for _, v := range doc.Values {
+		if v.Name == "AzureCloud" {
+			continue // Every region at once
+		}
+		service := ""
+		if !strings.HasPrefix(v.Name, "AzureCloud.") {
+			service, _, _ = strings.Cut(v.Name, ".")
+		}
+		for _, cidr := range v.Properties.AddressPrefixes {
+			prefixes = append(prefixes, cloudPrefix{cidr, service, v.Properties.Region})
+		}
+	}
+	return prefixes, nil
+}
+
+// parseCloudflareRanges reads the ips API, which lists ranges without regions
+func parseCloudflareRanges(body []byte) ([]cloudPrefix, error) {
+	var doc struct {
+		Result struct {
+			IPv4CIDRs []string `json:"ipv4_cidrs"`
+			IPv6CIDRs []string `json:"ipv6_cidrs"`
+		} `json:"result"`
+	}
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return nil, err
+	}
+	prefixes := []cloudPrefix{}
+	for _, cidr := range append(doc.Result.IPv4CIDRs, doc.Result.IPv6CIDRs...) {
+		prefixes = append(prefixes, cloudPrefix{cidr: cidr})
+	}
+	return prefixes, nil
+}
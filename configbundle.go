@@ -0,0 +1,145 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// configBundleVersion is bumped when the bundle format changes incompatibly
+const configBundleVersion = 1
+
+// ConfigBundle is a portable, signed snapshot of application configuration
+type ConfigBundle struct {
+	Version    int                        `json:"version"`
+	ExportedAt time.Time                  `json:"exportedAt"`
+	Hostname   string                     `json:"hostname"`
+	Sections   map[string]json.RawMessage `json:"sections"`
+	Signature  string                     `json:"signature,omitempty"`
+}
+
+// configSection is one exportable part of the configuration
+type configSection struct {
+	name    string
+	export  func() (interface{}, error)
+	restore func(data json.RawMessage) error
+}
+
+// ConfigRegistry collects configuration sections from subsystems so they can be
+// exported and imported as a single bundle
+type ConfigRegistry struct {
+	mu       sync.RWMutex
+	sections []configSection
+	secret   []byte
+}
+
+// NewConfigRegistry creates a registry signing bundles with the given secret (may be empty)
+func NewConfigRegistry(secret string) *ConfigRegistry {
+	return &ConfigRegistry{secret: []byte(secret)}
+}
+
+// Register adds a section; sections are imported in registration order
+func (cr *ConfigRegistry) Register(name string, export func() (interface{}, error), restore func(data json.RawMessage) error) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	cr.sections = append(cr.sections, configSection{name: name, export: export, restore: restore})
+}
+
+// sign computes the HMAC of the bundle with its signature cleared
+func (cr *ConfigRegistry) sign(b ConfigBundle) (string, error) {
+	b.Signature = ""
+	payload, err := json.Marshal(b)
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, cr.secret)
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// Export builds a bundle from every registered section
+func (cr *ConfigRegistry) Export() (*ConfigBundle, error) {
+	cr.mu.RLock()
+	defer cr.mu.RUnlock()
+
+	hostname, _ := os.Hostname()
+	b := ConfigBundle{
+		Version:    configBundleVersion,
+		ExportedAt: time.Now().UTC(),
+		Hostname:   hostname,
+		Sections:   make(map[string]json.RawMessage, len(cr.sections)),
+	}
+
+	for _, s := range cr.sections {
+		v, err := s.export()
+		if err != nil {
+			return nil, fmt.Errorf("exporting %s: %v", s.name, err)
+		}
+		data, err := json.Marshal(v)
+		if err != nil {
+			return nil, fmt.Errorf("encoding %s: %v", s.name, err)
+		}
+		b.Sections[s.name] = data
+	}
+
+	if len(cr.secret) > 0 {
+		sig, err := cr.sign(b)
+		if err != nil {
+			return nil, err
+		}
+		b.Signature = sig
+	}
+
+	return &b, nil
+}
+
+// Import verifies a bundle and restores its sections, returning the names of the
+// sections applied and those in the bundle that this instance doesn't know about
+func (cr *ConfigRegistry) Import(b ConfigBundle) (imported, skipped []string, err error) {
+	if b.Version != configBundleVersion {
+		return nil, nil, fmt.Errorf("unsupported bundle version %d", b.Version)
+	}
+
+	// With a secret configured the signature is mandatory; without one we can't verify anything
+	if len(cr.secret) > 0 {
+		expected, err := cr.sign(b)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !hmac.Equal([]byte(expected), []byte(b.Signature)) {
+			return nil, nil, fmt.Errorf("bundle signature does not match (check -config-secret)")
+		}
+	} else {
+		log.Printf("Warning: importing configuration bundle from %s without signature verification", b.Hostname)
+	}
+
+	cr.mu.RLock()
+	defer cr.mu.RUnlock()
+
+	known := map[string]bool{}
+	for _, s := range cr.sections {
+		known[s.name] = true
+		data, ok := b.Sections[s.name]
+		if !ok {
+			continue
+		}
+		if err := s.restore(data); err != nil {
+			return imported, nil, fmt.Errorf("importing %s: %v", s.name, err)
+		}
+		imported = append(imported, s.name)
+	}
+
+	for name := range b.Sections {
+		if !known[name] {
+			skipped = append(skipped, name)
+		}
+	}
+
+	return imported, skipped, nil
+}
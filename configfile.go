@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// configValue is an option read from a config file, and the line it's on
+type configValue struct {
+	value string
+	line  int
+}
+
+// configLevel is a key whose options are indented below it
+type configLevel struct {
+	indent  int
+	key     string
+	list    bool // Its entries are "- item" lines
+	section bool // Its entries are options
+}
+
+// loadConfigFile reads the options in a YAML config file, by the name of their flag. It
+// isn't a full YAML parser, just enough for flag values: "key: value" lines, where the
+// key is a flag name without the dash; keys nested under a section, which are prefixed
+// with it, so smtp's host is -smtp-host; and lists, as "- item" lines or [a, b], which
+// are joined with commas for the comma-separated flags.
+func loadConfigFile(path string) (map[string]configValue, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	values := make(map[string]configValue)
+	var levels []configLevel
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1<<20)
+	for n := 1; scanner.Scan(); n++ {
+		line := stripConfigComment(scanner.Text())
+		text := strings.TrimLeft(line, " ")
+		if strings.TrimSpace(text) == "" || text == "---" {
+			continue
+		}
+		if strings.HasPrefix(text, "\t") {
+			return nil, fmt.Errorf("%s:%d: indent with spaces, not tabs", path, n)
+		}
+		text = strings.TrimSpace(text)
+		indent := len(line) - len(strings.TrimLeft(line, " "))
+		item := text == "-" || strings.HasPrefix(text, "- ")
+		for len(levels) > 0 && levels[len(levels)-1].indent >= indent {
+			// List items may be indented as far as their key
+			if item && levels[len(levels)-1].indent == indent {
+				break
+			}
+			levels = levels[:len(levels)-1]
+		}
+
+		// A list item belongs to the key above it
+		if item {
+			if len(levels) == 0 {
+				return nil, fmt.Errorf("%s:%d: list item without a key", path, n)
+			}
+			parent := &levels[len(levels)-1]
+			key := configKey(levels)
+			if parent.section {
+				return nil, fmt.Errorf("%s:%d: %s has both options and list items", path, n, key)
+			}
+			parent.list = true
+			value := configScalar(strings.TrimSpace(strings.TrimPrefix(text, "-")))
+			v := values[key]
+			if v.value != "" {
+				value = v.value + "," + value
+			}
+			values[key] = configValue{value, v.line}
+			continue
+		}
+
+		key, value, ok := strings.Cut(text, ":")
+		if !ok || (value != "" && value[0] != ' ') {
+			return nil, fmt.Errorf("%s:%d: expected key: value", path, n)
+		}
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		if key == "" {
+			return nil, fmt.Errorf("%s:%d: expected key: value", path, n)
+		}
+		if len(levels) > 0 {
+			parent := &levels[len(levels)-1]
+			if parent.list {
+				return nil, fmt.Errorf("%s:%d: %s has both options and list items", path, n, configKey(levels))
+			}
+			// Sections are only prefixes, not options of their own
+			if !parent.section {
+				parent.section = true
+				delete(values, configKey(levels))
+			}
+		}
+		levels = append(levels, configLevel{indent: indent, key: key})
+		name := configKey(levels)
+		if _, dup := values[name]; dup {
+			return nil, fmt.Errorf("%s:%d: %s is set twice", path, n, name)
+		}
+		if value == "" {
+			// A section, or a list to come; an empty value otherwise
+			values[name] = configValue{"", n}
+			continue
+		}
+		levels = levels[:len(levels)-1]
+		if strings.HasPrefix(value, "[") && strings.HasSuffix(value, "]") {
+			items := []string{}
+			for _, item := range strings.Split(strings.TrimSuffix(strings.TrimPrefix(value, "["), "]"), ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					items = append(items, configScalar(item))
+				}
+			}
+			value = strings.Join(items, ",")
+		} else {
+			value = configScalar(value)
+		}
+		values[name] = configValue{value, n}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+// configKey joins nested keys into a flag name
+func configKey(levels []configLevel) string {
+	keys := make([]string, len(levels))
+	for i, l := range levels {
+		keys[i] = l.key
+	}
+	return strings.Join(keys, "-")
+}
+
+// stripConfigComment removes a "# comment" that's outside quotes
+func stripConfigComment(line string) string {
+	var quote rune
+	for i, c := range line {
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// configScalar unquotes a value in single or double quotes
+func configScalar(s string) string {
+	if len(s) >= 2 && s[0] == '"' && s[len(s)-1] == '"' {
+		if unquoted, err := strconv.Unquote(s); err == nil {
+			return unquoted
+		}
+	}
+	if len(s) >= 2 && s[0] == '\'' && s[len(s)-1] == '\'' {
+		return strings.ReplaceAll(s[1:len(s)-1], "''", "'")
+	}
+	return s
+}
+
+// applyConfigFile sets the flags in a config file that weren't given on the command line,
+// which takes precedence, failing on an unknown option or invalid value. It returns the
+// flags it set, which flag.Visit can't tell from those given on the command line.
+func applyConfigFile(fs *flag.FlagSet, path string) (map[string]bool, error) {
+	values, err := loadConfigFile(path)
+	if err != nil {
+		return nil, err
+	}
+	given := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { given[f.Name] = true })
+
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool { return values[names[i]].line < values[names[j]].line })
+	set := make(map[string]bool)
+	for _, name := range names {
+		v := values[name]
+		f := fs.Lookup(name)
+		if f == nil || name == "config" {
+			return nil, fmt.Errorf("%s:%d: unknown option %q", path, v.line, name)
+		}
+		if given[name] {
+			continue
+		}
+		value := v.value
+		// YAML's other ways of saying true and false
+		if b, ok := f.Value.(interface{ IsBoolFlag() bool }); ok && b.IsBoolFlag() {
+			switch strings.ToLower(value) {
+			case "yes", "on":
+				value = "true"
+			case "no", "off":
+				value = "false"
+			}
+		}
+		if err := fs.Set(name, value); err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid %s %q: %v", path, v.line, name, value, err)
+		}
+		set[name] = true
+	}
+	return set, nil
+}
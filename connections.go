@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Connection states
+const (
+	connStateActive = "active"
+	connStateIdle   = "idle"   // No packets for connIdleAfter
+	connStateClosed = "closed" // TCP FIN or RST seen
+)
+
+// connIdleAfter is how long a connection goes without packets before it counts as idle
+const connIdleAfter = time.Minute
+
+// ConnectionQuery selects, sorts and pages live connections for /api/connections
+type ConnectionQuery struct {
+	Network   *net.IPNet      // Either end in this address or range
+	Port      uint16          // Either port; 0 for any
+	Protocols map[string]bool // Upper case; empty for any
+	States    map[string]bool // Empty for any
+	Sort      string          // "bytes", "packets", "firstSeen" or "lastSeen"
+	Ascending bool
+	Limit     int
+	Offset    int
+}
+
+// parseConnectionQuery reads the /api/connections parameters, defaulting to the top 100
+// by bytes
+func parseConnectionQuery(r *http.Request) (ConnectionQuery, error) {
+	v := r.URL.Query()
+	q := ConnectionQuery{
+		Protocols: upperSet(v.Get("protocol")),
+		States:    make(map[string]bool),
+		Sort:      "bytes",
+		Limit:     100,
+	}
+
+	if s := v.Get("ip"); s != "" {
+		network, err := parseIPNet(s)
+		if err != nil {
+			return q, err
+		}
+		q.Network = network
+	}
+	if s := v.Get("port"); s != "" {
+		port, err := strconv.ParseUint(s, 10, 16)
+		if err != nil {
+			return q, fmt.Errorf("invalid port %q", s)
+		}
+		q.Port = uint16(port)
+	}
+	for _, state := range strings.Split(v.Get("state"), ",") {
+		switch state = strings.TrimSpace(state); state {
+		case "":
+		case connStateActive, connStateIdle, connStateClosed:
+			q.States[state] = true
+		default:
+			return q, fmt.Errorf("invalid state %q (expected active, idle or closed)", state)
+		}
+	}
+
+	if s := v.Get("sort"); s != "" {
+		if s != "bytes" && s != "packets" && s != "firstSeen" && s != "lastSeen" {
+			return q, fmt.Errorf("invalid sort %q (expected bytes, packets, firstSeen or lastSeen)", s)
+		}
+		q.Sort = s
+	}
+	if s := v.Get("order"); s != "" {
+		if s != "asc" && s != "desc" {
+			return q, fmt.Errorf("invalid order %q (expected asc or desc)", s)
+		}
+		q.Ascending = s == "asc"
+	}
+
+	if s := v.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			return q, fmt.Errorf("invalid limit %q", s)
+		}
+		if n > 1000 {
+			n = 1000
+		}
+		q.Limit = n
+	}
+	if s := v.Get("offset"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			return q, fmt.Errorf("invalid offset %q", s)
+		}
+		q.Offset = n
+	}
+	return q, nil
+}
+
+func (q ConnectionQuery) matches(c *Connection) bool {
+	if len(q.Protocols) > 0 && !q.Protocols[strings.ToUpper(c.Protocol)] {
+		return false
+	}
+	if len(q.States) > 0 && !q.States[c.State] {
+		return false
+	}
+	if q.Port != 0 && c.SrcPort != q.Port && c.DstPort != q.Port {
+		return false
+	}
+	if q.Network != nil && !q.Network.Contains(net.ParseIP(c.SrcIP)) && !q.Network.Contains(net.ParseIP(c.DstIP)) {
+		return false
+	}
+	return true
+}
+
+// less orders connections by the query's sort key, breaking ties by first seen so pages
+// stay stable
+func (q ConnectionQuery) less(a, b *Connection) bool {
+	var x, y int64
+	switch q.Sort {
+	case "packets":
+		x, y = a.Packets, b.Packets
+	case "firstSeen":
+		x, y = a.FirstSeen.UnixNano(), b.FirstSeen.UnixNano()
+	case "lastSeen":
+		x, y = a.LastSeen.UnixNano(), b.LastSeen.UnixNano()
+	default:
+		x, y = a.Bytes, b.Bytes
+	}
+	if x == y {
+		x, y = a.FirstSeen.UnixNano(), b.FirstSeen.UnixNano()
+	}
+	if q.Ascending {
+		return x < y
+	}
+	return x > y
+}
+
+// FindConnections returns a page of matching connections and how many match in total
+func (ps *PacketStore) FindConnections(q ConnectionQuery) ([]Connection, int) {
+	now := time.Now()
+	ps.mu.RLock()
+	connections := make([]Connection, 0, len(ps.connections))
+	for _, conn := range ps.connections {
+		c := *conn
+		if c.State == connStateActive && now.Sub(c.LastSeen) >= connIdleAfter {
+			c.State = connStateIdle
+		}
+		if q.matches(&c) {
+			connections = append(connections, c)
+		}
+	}
+	ps.mu.RUnlock()
+
+	sort.Slice(connections, func(i, j int) bool {
+		return q.less(&connections[i], &connections[j])
+	})
+
+	total := len(connections)
+	if q.Offset >= total {
+		return []Connection{}, total
+	}
+	connections = connections[q.Offset:]
+	if len(connections) > q.Limit {
+		connections = connections[:q.Limit]
+	}
+	for i := range connections {
+		c := &connections[i]
+		src, dst := getIPInfo(c.SrcIP), getIPInfo(c.DstIP)
+		c.SrcHostname, c.SrcCountry = src.Hostname, src.Country
+		c.DstHostname, c.DstCountry = dst.Hostname, dst.Country
+	}
+	return connections, total
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Methods and request headers cross-origin callers may use, and response headers they may read
+const (
+	corsAllowMethods  = "GET, POST, PUT, PATCH, DELETE, OPTIONS"
+	corsAllowHeaders  = "Authorization, Content-Type"
+	corsExposeHeaders = "X-Total-Count, Content-Disposition"
+	corsMaxAge        = "600" // Seconds browsers may cache a preflight answer
+)
+
+// CORSPolicy decides which other web origins may call the API from a browser. Pages
+// served by pi-track itself are always allowed; with no origins listed, nothing else is.
+type CORSPolicy struct {
+	any     bool            // "*": every origin, without credentials
+	origins map[string]bool // scheme://host[:port], lower case
+}
+
+// NewCORSPolicy parses a comma-separated list of origins, e.g.
+// https://grafana.example.com,http://localhost:3000, or "*" for any origin
+func NewCORSPolicy(list string) (*CORSPolicy, error) {
+	c := &CORSPolicy{origins: make(map[string]bool)}
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(s)
+		switch {
+		case s == "":
+			continue
+		case s == "*":
+			c.any = true
+			continue
+		}
+		u, err := url.Parse(strings.TrimSuffix(s, "/"))
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.Path != "" {
+			return nil, fmt.Errorf("invalid origin %q (expected scheme://host[:port], e.g. https://grafana.example.com)", s)
+		}
+		c.origins[strings.ToLower(u.Scheme+"://"+u.Host)] = true
+	}
+	return c, nil
+}
+
+// allowed reports whether a request may come from its origin: it sent none, as scripts
+// and same-origin navigation don't, the origin is this server, or the origin is listed
+func (c *CORSPolicy) allowed(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" || c.sameOrigin(r, origin) {
+		return true
+	}
+	return c.any || c.origins[strings.ToLower(origin)]
+}
+
+// sameOrigin reports whether the origin is the host the request was sent to
+func (c *CORSPolicy) sameOrigin(r *http.Request, origin string) bool {
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
+
+// CheckOrigin is for the WebSocket upgrader, which browsers don't apply CORS to: a page
+// from an origin that isn't allowed can't open the live feed
+func (c *CORSPolicy) CheckOrigin(r *http.Request) bool {
+	return c.allowed(r)
+}
+
+// Wrap adds the CORS headers for allowed origins and answers preflight requests. Requests
+// from other origins get no CORS headers, so browsers won't let the page read the
+// response, and those that could change something are refused outright.
+func (c *CORSPolicy) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" || c.sameOrigin(r, origin) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Add("Vary", "Origin")
+		preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+		if !c.allowed(r) {
+			if preflight || (r.Method != http.MethodGet && r.Method != http.MethodHead) {
+				http.Error(w, "origin not allowed", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if c.origins[strings.ToLower(origin)] {
+			// Listed origins may send the session cookie; a wildcard never can
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+		} else {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+		}
+		if preflight {
+			w.Header().Set("Access-Control-Allow-Methods", corsAllowMethods)
+			w.Header().Set("Access-Control-Allow-Headers", corsAllowHeaders)
+			w.Header().Set("Access-Control-Max-Age", corsMaxAge)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.Header().Set("Access-Control-Expose-Headers", corsExposeHeaders)
+		next.ServeHTTP(w, r)
+	})
+}
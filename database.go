@@ -4,8 +4,11 @@ import (
 	"database/sql"
 	"fmt"
 	"log"
+	"net/url"
+	"os"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	_ "modernc.org/sqlite"
@@ -21,31 +24,72 @@ type Database struct {
 	flushTicker *time.Ticker
 	flushChan   chan struct{} // Signal channel for flush requests
 	stopChan    chan struct{}
+	paused      atomic.Bool // Set when packets should not be written (e.g. disk nearly full)
+	encrypted   bool        // Opened through SQLCipher with a key
+	partitions  *Partitions // Set when finished days are moved to daily files
+	options     DatabaseOptions
+
+	// Write queue metrics, guarded by insertMu
+	peakQueue     int
+	lastFlush     time.Time
+	lastBatch     int
+	lastFlushTime time.Duration
+}
+
+// DatabaseOptions tunes how captured packets are written. Larger batches and longer
+// intervals cost fewer writes to the SD card, but more packets are lost if the process
+// dies; the synchronous mode decides whether a power cut can lose committed batches too.
+type DatabaseOptions struct {
+	BatchSize     int           // Queued packets that trigger a write
+	FlushInterval time.Duration // Longest a packet waits in the queue
+	Synchronous   string        // SQLite synchronous mode: OFF, NORMAL, FULL or EXTRA
+}
+
+// DefaultDatabaseOptions returns the options used unless flags say otherwise
+func DefaultDatabaseOptions() DatabaseOptions {
+	return DatabaseOptions{BatchSize: 100, FlushInterval: 5 * time.Second, Synchronous: "NORMAL"}
+}
+
+// Validate checks the options, normalizing the synchronous mode to upper case
+func (o *DatabaseOptions) Validate() error {
+	if o.BatchSize < 1 {
+		return fmt.Errorf("batch size must be at least 1")
+	}
+	if o.FlushInterval <= 0 {
+		return fmt.Errorf("flush interval must be positive")
+	}
+	o.Synchronous = strings.ToUpper(strings.TrimSpace(o.Synchronous))
+	switch o.Synchronous {
+	case "OFF", "NORMAL", "FULL", "EXTRA":
+		return nil
+	}
+	return fmt.Errorf("unknown synchronous mode %q (want OFF, NORMAL, FULL or EXTRA)", o.Synchronous)
 }
 
 // NewDatabase creates a new database connection
-func NewDatabase(dbPath string) (*Database, error) {
-	db, err := sql.Open("sqlite", dbPath)
-	if err != nil {
-		return nil, fmt.Errorf("failed to open database: %v", err)
+func NewDatabase(dbPath, key string, opts DatabaseOptions) (*Database, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
 	}
 
-	// Enable WAL mode for better concurrent performance
-	_, err = db.Exec("PRAGMA journal_mode=WAL")
+	// Per-connection settings are applied to every connection in the pool: wait up to
+	// 5 seconds instead of failing immediately when locked, and the chosen durability
+	db, err := openSQLite(dbPath, key, "busy_timeout(5000)", "synchronous("+opts.Synchronous+")")
 	if err != nil {
-		return nil, fmt.Errorf("failed to set WAL mode: %v", err)
+		return nil, fmt.Errorf("failed to open database: %v", err)
 	}
 
-	// Set busy timeout to 5 seconds (waits instead of failing immediately when locked)
-	_, err = db.Exec("PRAGMA busy_timeout=5000")
+	// Let the retention job hand freed pages back to the filesystem. This only takes
+	// effect on a new database; existing ones are converted by the retention job.
+	_, err = db.Exec("PRAGMA auto_vacuum=INCREMENTAL")
 	if err != nil {
-		return nil, fmt.Errorf("failed to set busy timeout: %v", err)
+		return nil, fmt.Errorf("failed to set auto vacuum: %v", err)
 	}
 
-	// Use NORMAL synchronous mode for better performance with WAL
-	_, err = db.Exec("PRAGMA synchronous=NORMAL")
+	// Enable WAL mode for better concurrent performance
+	_, err = db.Exec("PRAGMA journal_mode=WAL")
 	if err != nil {
-		return nil, fmt.Errorf("failed to set synchronous mode: %v", err)
+		return nil, fmt.Errorf("failed to set WAL mode: %v", err)
 	}
 
 	// Create tables
@@ -60,8 +104,8 @@ func NewDatabase(dbPath string) (*Database, error) {
 			timestamp, src_ip, dst_ip, src_port, dst_port, 
 			protocol, length, info, src_mac, dst_mac, 
 			application, src_hostname, dst_hostname, src_country, dst_country,
-			process_name
-		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+			process_name, interface, src_asn, dst_asn, process_user, process_unit
+		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
 	`)
 	if err != nil {
 		return nil, fmt.Errorf("failed to prepare insert statement: %v", err)
@@ -69,10 +113,12 @@ func NewDatabase(dbPath string) (*Database, error) {
 
 	d := &Database{
 		db:          db,
+		encrypted:   key != "",
 		insertStmt:  insertStmt,
-		batchQueue:  make([]Packet, 0, 100),
-		batchSize:   100, // Batch insert every 100 packets
-		flushTicker: time.NewTicker(5 * time.Second),
+		batchQueue:  make([]Packet, 0, opts.BatchSize),
+		batchSize:   opts.BatchSize,
+		flushTicker: time.NewTicker(opts.FlushInterval),
+		options:     opts,
 		flushChan:   make(chan struct{}, 1), // Buffered channel of size 1 for checks
 		stopChan:    make(chan struct{}),
 	}
@@ -83,6 +129,39 @@ func NewDatabase(dbPath string) (*Database, error) {
 	return d, nil
 }
 
+// openSQLite opens a database file, through SQLCipher if a key is given. Each pragma,
+// written as name(value), is run on every new connection.
+func openSQLite(path, key string, pragmas ...string) (*sql.DB, error) {
+	if key != "" {
+		return openEncrypted(path, key, pragmas)
+	}
+	sep := "?"
+	if strings.Contains(path, "?") {
+		sep = "&"
+	}
+	for _, p := range pragmas {
+		path += sep + "_pragma=" + url.QueryEscape(p)
+		sep = "&"
+	}
+	return sql.Open("sqlite", path)
+}
+
+// loadDBKey returns the database encryption key: the contents of keyFile if set, otherwise key
+func loadDBKey(key, keyFile string) (string, error) {
+	if keyFile == "" {
+		return key, nil
+	}
+	data, err := os.ReadFile(keyFile)
+	if err != nil {
+		return "", err
+	}
+	key = strings.TrimSpace(string(data))
+	if key == "" {
+		return "", fmt.Errorf("key file %s is empty", keyFile)
+	}
+	return key, nil
+}
+
 func createTables(db *sql.DB) error {
 	schema := `
 	CREATE TABLE IF NOT EXISTS packets (
@@ -128,6 +207,12 @@ func createTables(db *sql.DB) error {
 		first_seen DATETIME,
 		last_seen DATETIME
 	);
+
+	CREATE TABLE IF NOT EXISTS settings (
+		key TEXT PRIMARY KEY,
+		value TEXT NOT NULL,
+		updated_at DATETIME
+	);
 	`
 
 	_, err := db.Exec(schema)
@@ -138,13 +223,59 @@ func createTables(db *sql.DB) error {
 	// Migration: Add process_name column if it doesn't exist
 	db.Exec("ALTER TABLE packets ADD COLUMN process_name TEXT")
 
+	// Migration: Record which interface each packet was captured on
+	db.Exec("ALTER TABLE packets ADD COLUMN interface TEXT")
+
+	// Migration: Store the ASN of each end alongside its hostname and country
+	db.Exec("ALTER TABLE packets ADD COLUMN src_asn TEXT")
+	db.Exec("ALTER TABLE packets ADD COLUMN dst_asn TEXT")
+
+	// Migration: Store the user running each packet's process
+	db.Exec("ALTER TABLE packets ADD COLUMN process_user TEXT")
+
+	// Migration: Store the systemd unit each packet's process runs in
+	db.Exec("ALTER TABLE packets ADD COLUMN process_unit TEXT")
+
+	// Migration: Track the sent share of each IP's totals
+	db.Exec("ALTER TABLE ip_stats ADD COLUMN packets_sent INTEGER DEFAULT 0")
+	db.Exec("ALTER TABLE ip_stats ADD COLUMN bytes_sent INTEGER DEFAULT 0")
+
+	// Subsystem tables
+	for _, create := range []func(*sql.DB) error{
+		createRollupTables,
+		createLatencyTables,
+		createSpeedTestTables,
+		createReportTables,
+		createAlertTables,
+		createUsageTables,
+		createPresenceTables,
+		createFlowTables,
+		createSessionTables,
+		createPayloadTables,
+		createDNSLogTables,
+		createProcessConnectionTables,
+		createKnownProcessTables,
+		createIPInfoTables,
+	} {
+		if err := create(db); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
 // QueuePacket adds a packet to the batch queue for insertion
 func (d *Database) QueuePacket(p Packet) {
+	if d.paused.Load() {
+		return
+	}
+
 	d.insertMu.Lock()
 	d.batchQueue = append(d.batchQueue, p)
+	if len(d.batchQueue) > d.peakQueue {
+		d.peakQueue = len(d.batchQueue)
+	}
 	shouldFlush := len(d.batchQueue) >= d.batchSize
 	d.insertMu.Unlock()
 
@@ -171,30 +302,91 @@ func (d *Database) Flush() {
 	d.batchQueue = d.batchQueue[:0]
 	d.insertMu.Unlock()
 
+	start := time.Now()
+	if err := d.writeBatch(packets); err != nil {
+		log.Printf("Database error: %v", err)
+	}
+
+	d.insertMu.Lock()
+	d.lastFlush = start
+	d.lastBatch = len(packets)
+	d.lastFlushTime = time.Since(start)
+	d.insertMu.Unlock()
+}
+
+// WriteQueueStatus describes the queue of packets waiting to be written
+type WriteQueueStatus struct {
+	Depth         int        `json:"depth"`     // Packets waiting now
+	Peak          int        `json:"peak"`      // Most packets ever waiting at once
+	BatchSize     int        `json:"batchSize"` // Depth that triggers a write
+	FlushInterval float64    `json:"flushIntervalSeconds"`
+	Synchronous   string     `json:"synchronous"`
+	LastFlush     *time.Time `json:"lastFlush,omitempty"`
+	LastBatch     int        `json:"lastBatch"`           // Packets written by the last flush
+	LastFlushTime float64    `json:"lastFlushDurationMs"` // How long the last flush took
+}
+
+// QueueStatus returns the write queue's current depth and recent flush activity
+func (d *Database) QueueStatus() WriteQueueStatus {
+	d.insertMu.Lock()
+	defer d.insertMu.Unlock()
+	status := WriteQueueStatus{
+		Depth:         len(d.batchQueue),
+		Peak:          d.peakQueue,
+		BatchSize:     d.batchSize,
+		FlushInterval: d.options.FlushInterval.Seconds(),
+		Synchronous:   d.options.Synchronous,
+		LastBatch:     d.lastBatch,
+		LastFlushTime: float64(d.lastFlushTime.Microseconds()) / 1000,
+	}
+	if !d.lastFlush.IsZero() {
+		lastFlush := d.lastFlush
+		status.LastFlush = &lastFlush
+	}
+	return status
+}
+
+// writeBatch inserts packets and updates rollups in a single transaction
+func (d *Database) writeBatch(packets []Packet) error {
 	// Begin transaction for batch insert
 	tx, err := d.db.Begin()
 	if err != nil {
-		log.Printf("Database error starting transaction: %v", err)
-		return
+		return fmt.Errorf("starting transaction: %v", err)
 	}
 
 	stmt := tx.Stmt(d.insertStmt)
 	for _, p := range packets {
-		_, err := stmt.Exec(
+		result, err := stmt.Exec(
 			p.Timestamp, p.SrcIP, p.DstIP, p.SrcPort, p.DstPort,
 			p.Protocol, p.Length, p.Info, p.SrcMAC, p.DstMAC,
 			p.Application, p.SrcHostname, p.DstHostname, p.SrcCountry, p.DstCountry,
-			p.ProcessName,
+			p.ProcessName, p.Interface, p.SrcASN, p.DstASN, p.ProcessUser, p.ProcessUnit,
 		)
 		if err != nil {
 			log.Printf("Database insert error: %v", err)
+			continue
+		}
+		if p.stored != nil {
+			id, _ := result.LastInsertId()
+			if err := insertPayload(tx, id, p.stored.length, p.stored.data); err != nil {
+				log.Printf("Database payload insert error: %v", err)
+			}
 		}
 	}
 
+	// Keep hourly rollups in step with the raw rows
+	if err := updateRollups(tx, packets); err != nil {
+		log.Printf("Database rollup error: %v", err)
+	}
+	if err := updateIPStats(tx, packets); err != nil {
+		log.Printf("Database ip_stats error: %v", err)
+	}
+
 	if err := tx.Commit(); err != nil {
-		log.Printf("Database commit error: %v", err)
 		tx.Rollback()
+		return fmt.Errorf("commit: %v", err)
 	}
+	return nil
 }
 
 func (d *Database) backgroundFlush() {
@@ -212,96 +404,214 @@ func (d *Database) backgroundFlush() {
 	}
 }
 
-// QueryPackets retrieves packets from the database with optional filters
-func (d *Database) QueryPackets(limit int, offset int, filter string, country string, excludeIPs []string, startTime, endTime *time.Time) ([]Packet, int, error) {
-	// Build query
-	query := "SELECT id, timestamp, src_ip, dst_ip, src_port, dst_port, protocol, length, info, src_mac, dst_mac, application, src_hostname, dst_hostname, src_country, dst_country, process_name FROM packets WHERE 1=1"
-	countQuery := "SELECT COUNT(*) FROM packets WHERE 1=1"
+// packetFilter builds the WHERE clause shared by packet history queries and exports
+func packetFilter(filter string, expr *DisplayFilter, country string, iface string, excludeIPs []string, startTime, endTime *time.Time) (string, []interface{}, error) {
+	where := " WHERE 1=1"
 	args := []interface{}{}
 
 	if startTime != nil {
-		query += " AND timestamp >= ?"
-		countQuery += " AND timestamp >= ?"
+		where += " AND timestamp >= ?"
 		args = append(args, startTime)
 	}
 
 	if endTime != nil {
-		query += " AND timestamp <= ?"
-		countQuery += " AND timestamp <= ?"
+		where += " AND timestamp <= ?"
 		args = append(args, endTime)
 	}
 
 	if filter != "" {
-		filterClause := " AND (src_ip LIKE ? OR dst_ip LIKE ? OR protocol LIKE ? OR application LIKE ? OR src_hostname LIKE ? OR dst_hostname LIKE ? OR info LIKE ?)"
-		query += filterClause
-		countQuery += filterClause
+		where += " AND (src_ip LIKE ? OR dst_ip LIKE ? OR protocol LIKE ? OR application LIKE ? OR src_hostname LIKE ? OR dst_hostname LIKE ? OR info LIKE ?)"
 		filterArg := "%" + filter + "%"
 		args = append(args, filterArg, filterArg, filterArg, filterArg, filterArg, filterArg, filterArg)
 	}
 
+	if expr != nil {
+		cond, exprArgs, err := expr.SQL()
+		if err != nil {
+			return "", nil, err
+		}
+		where += " AND " + cond
+		args = append(args, exprArgs...)
+	}
+
 	if country != "" {
-		countryClause := " AND (src_country = ? OR dst_country = ?)"
-		query += countryClause
-		countQuery += countryClause
+		where += " AND (src_country = ? OR dst_country = ?)"
 		args = append(args, country, country)
 	}
 
+	if iface != "" {
+		where += " AND interface = ?"
+		args = append(args, iface)
+	}
+
 	// Exclude specified IPs
 	for _, ip := range excludeIPs {
 		ip = strings.TrimSpace(ip)
 		if ip != "" {
-			excludeClause := " AND src_ip != ? AND dst_ip != ?"
-			query += excludeClause
-			countQuery += excludeClause
+			where += " AND src_ip != ? AND dst_ip != ?"
 			args = append(args, ip, ip)
 		}
 	}
 
-	// Get total count
+	return where, args, nil
+}
+
+// packetColumns are the columns scanPacket reads, in order
+const packetColumns = "id, timestamp, src_ip, dst_ip, src_port, dst_port, protocol, length, info, src_mac, dst_mac, application, src_hostname, dst_hostname, src_country, dst_country, process_name, interface, src_asn, dst_asn, process_user, process_unit"
+
+// scanPacket reads a row selected with packetColumns
+func scanPacket(rows *sql.Rows) (Packet, error) {
+	var p Packet
+	var srcHostname, dstHostname, srcCountry, dstCountry, processName, iface, srcASN, dstASN, processUser, processUnit sql.NullString
+	err := rows.Scan(
+		&p.ID, &p.Timestamp, &p.SrcIP, &p.DstIP, &p.SrcPort, &p.DstPort,
+		&p.Protocol, &p.Length, &p.Info, &p.SrcMAC, &p.DstMAC,
+		&p.Application, &srcHostname, &dstHostname, &srcCountry, &dstCountry,
+		&processName, &iface, &srcASN, &dstASN, &processUser, &processUnit,
+	)
+	p.SrcHostname = srcHostname.String
+	p.DstHostname = dstHostname.String
+	p.SrcCountry = srcCountry.String
+	p.DstCountry = dstCountry.String
+	p.ProcessName = processName.String
+	p.Interface = iface.String
+	p.SrcASN = srcASN.String
+	p.DstASN = dstASN.String
+	p.ProcessUser = processUser.String
+	p.ProcessUnit = processUnit.String
+	return p, err
+}
+
+// CountPackets returns how many packets match the filters QueryPackets takes
+func (d *Database) CountPackets(filter string, expr *DisplayFilter, country string, iface string, excludeIPs []string, startTime, endTime *time.Time) (int, error) {
+	where, args, err := packetFilter(filter, expr, country, iface, excludeIPs, startTime, endTime)
+	if err != nil {
+		return 0, err
+	}
+	db, release, err := d.packetsBetween(startTime, endTime)
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+
 	var total int
-	err := d.db.QueryRow(countQuery, args...).Scan(&total)
+	err = db.QueryRow("SELECT COUNT(*) FROM packets"+where, args...).Scan(&total)
+	return total, err
+}
+
+// QueryPackets calls fn for one page of packets matching the filters, newest first, as
+// each row is read. It stops at the first error fn returns.
+func (d *Database) QueryPackets(limit int, offset int, filter string, expr *DisplayFilter, country string, iface string, excludeIPs []string, startTime, endTime *time.Time, fn func(Packet) error) error {
+	where, args, err := packetFilter(filter, expr, country, iface, excludeIPs, startTime, endTime)
 	if err != nil {
-		return nil, 0, err
+		return err
 	}
+	db, release, err := d.packetsBetween(startTime, endTime)
+	if err != nil {
+		return err
+	}
+	defer release()
 
 	// Add ordering and pagination
-	query += " ORDER BY timestamp DESC LIMIT ? OFFSET ?"
+	query := "SELECT " + packetColumns + " FROM packets" + where + " ORDER BY timestamp DESC LIMIT ? OFFSET ?"
 	args = append(args, limit, offset)
 
-	rows, err := d.db.Query(query, args...)
+	rows, err := db.Query(query, args...)
 	if err != nil {
-		return nil, 0, err
+		return err
 	}
 	defer rows.Close()
 
-	packets := []Packet{}
 	for rows.Next() {
-		var p Packet
-		var srcHostname, dstHostname, srcCountry, dstCountry, processName sql.NullString
-		err := rows.Scan(
-			&p.ID, &p.Timestamp, &p.SrcIP, &p.DstIP, &p.SrcPort, &p.DstPort,
-			&p.Protocol, &p.Length, &p.Info, &p.SrcMAC, &p.DstMAC,
-			&p.Application, &srcHostname, &dstHostname, &srcCountry, &dstCountry,
-			&processName,
-		)
+		p, err := scanPacket(rows)
 		if err != nil {
 			log.Printf("Error scanning row: %v", err)
 			continue
 		}
-		p.SrcHostname = srcHostname.String
-		p.DstHostname = dstHostname.String
-		p.SrcCountry = srcCountry.String
-		p.DstCountry = dstCountry.String
-		p.ProcessName = processName.String
-		packets = append(packets, p)
+		if err := fn(p); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// DeletePackets deletes the stored packets matching the same filters as QueryPackets, with
+// their payloads, from the main database and the daily files the range covers. Packets
+// still queued are written first so they are included. The hourly rollups keep counting
+// them, as they do for packets removed by retention. It returns how many were deleted.
+func (d *Database) DeletePackets(filter string, expr *DisplayFilter, country string, iface string, excludeIPs []string, startTime, endTime *time.Time) (int64, error) {
+	where, args, err := packetFilter(filter, expr, country, iface, excludeIPs, startTime, endTime)
+	if err != nil {
+		return 0, err
+	}
+	d.Flush()
+
+	tx, err := d.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("DELETE FROM packet_payloads WHERE packet_id IN (SELECT id FROM packets"+where+")", args...); err != nil {
+		return 0, err
+	}
+	res, err := tx.Exec("DELETE FROM packets"+where, args...)
+	if err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
 	}
+	deleted, _ := res.RowsAffected()
 
-	return packets, total, nil
+	if d.partitions != nil {
+		n, err := d.partitions.deletePackets(where, args, startTime, endTime)
+		deleted += n
+		if err != nil {
+			return deleted, fmt.Errorf("deleting from daily files: %v", err)
+		}
+	}
+	return deleted, nil
+}
+
+// StreamPackets calls fn for every packet matching the same filters as QueryPackets, oldest
+// first, without holding the results in memory. It stops at the first error fn returns.
+func (d *Database) StreamPackets(filter string, expr *DisplayFilter, country string, iface string, excludeIPs []string, startTime, endTime *time.Time, fn func(Packet) error) error {
+	where, args, err := packetFilter(filter, expr, country, iface, excludeIPs, startTime, endTime)
+	if err != nil {
+		return err
+	}
+	db, release, err := d.packetsBetween(startTime, endTime)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	rows, err := db.Query("SELECT "+packetColumns+" FROM packets"+where+" ORDER BY timestamp", args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		p, err := scanPacket(rows)
+		if err != nil {
+			return err
+		}
+		if err := fn(p); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
 }
 
 // GetStats returns aggregated statistics from the database
 func (d *Database) GetStats(startTime, endTime *time.Time) (map[string]interface{}, error) {
 	stats := map[string]interface{}{}
+	db, release, err := d.packetsBetween(startTime, endTime)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
 
 	// Total packets and bytes
 	query := "SELECT COUNT(*), COALESCE(SUM(length), 0) FROM packets WHERE 1=1"
@@ -317,7 +627,7 @@ func (d *Database) GetStats(startTime, endTime *time.Time) (map[string]interface
 	}
 
 	var totalPackets, totalBytes int64
-	err := d.db.QueryRow(query, args...).Scan(&totalPackets, &totalBytes)
+	err = db.QueryRow(query, args...).Scan(&totalPackets, &totalBytes)
 	if err != nil {
 		return nil, err
 	}
@@ -334,7 +644,7 @@ func (d *Database) GetStats(startTime, endTime *time.Time) (map[string]interface
 	}
 	protocolQuery += " GROUP BY protocol ORDER BY cnt DESC LIMIT 10"
 
-	rows, err := d.db.Query(protocolQuery, args...)
+	rows, err := db.Query(protocolQuery, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -360,7 +670,7 @@ func (d *Database) GetStats(startTime, endTime *time.Time) (map[string]interface
 	}
 	talkerQuery += " GROUP BY src_ip ORDER BY bytes DESC LIMIT 10"
 
-	rows2, err := d.db.Query(talkerQuery, args...)
+	rows2, err := db.Query(talkerQuery, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -396,7 +706,13 @@ func (d *Database) GetDistinctCountries() ([]string, error) {
 		) ORDER BY country
 	`
 
-	rows, err := d.db.Query(query)
+	db, release, err := d.packetsBetween(nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	rows, err := db.Query(query)
 	if err != nil {
 		return nil, err
 	}
@@ -427,7 +743,7 @@ func (d *Database) Truncate() error {
 	}
 
 	// Delete contents from tables
-	tables := []string{"packets", "sessions", "ip_stats"}
+	tables := []string{"packets", "sessions", "ip_stats", "traffic_hourly", "latency_samples", "speedtests", "reports", "alerts", "device_usage", "device_presence", "device_hourly", "flows", "packet_payloads", "dns_log", "process_connections"}
 	for _, table := range tables {
 		_, err := tx.Exec("DELETE FROM " + table)
 		if err != nil {
@@ -446,6 +762,10 @@ func (d *Database) Truncate() error {
 		return err
 	}
 
+	if _, err := d.DropPartitions(time.Now().AddDate(0, 0, 1)); err != nil {
+		return fmt.Errorf("failed to delete daily files: %v", err)
+	}
+
 	// Optimize database to reclaim space
 	_, err = d.db.Exec("VACUUM")
 	if err != nil {
@@ -484,9 +804,69 @@ func (d *Database) GetDatabaseInfo() (map[string]interface{}, error) {
 	d.db.QueryRow("PRAGMA page_size").Scan(&pageSize)
 	info["databaseSize"] = pageCount * pageSize
 
+	if d.partitions != nil {
+		info["partitions"] = d.partitions.Status()
+	}
+
 	return info, nil
 }
 
+// GetSetting returns a stored setting value, or ok=false if it is not set
+func (d *Database) GetSetting(key string) (value string, ok bool, err error) {
+	err = d.db.QueryRow("SELECT value FROM settings WHERE key = ?", key).Scan(&value)
+	if err == sql.ErrNoRows {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return value, true, nil
+}
+
+// SetSetting stores a setting value
+func (d *Database) SetSetting(key, value string) error {
+	_, err := d.db.Exec(`
+		INSERT INTO settings (key, value, updated_at) VALUES (?, ?, ?)
+		ON CONFLICT (key) DO UPDATE SET value = excluded.value, updated_at = excluded.updated_at
+	`, key, value, time.Now())
+	return err
+}
+
+// SetWritesPaused stops or resumes writing captured packets
+func (d *Database) SetWritesPaused(paused bool) {
+	d.paused.Store(paused)
+}
+
+// WritesPaused reports whether packet writes are currently paused
+func (d *Database) WritesPaused() bool {
+	return d.paused.Load()
+}
+
+// Encrypted reports whether the database file is encrypted
+func (d *Database) Encrypted() bool {
+	return d.encrypted
+}
+
+// DeleteOldestPackets removes up to n of the oldest packets and truncates the WAL. With
+// partitioning on, they come from the oldest daily file while there is one.
+func (d *Database) DeleteOldestPackets(n int) (int64, error) {
+	if deleted, ok, err := d.deleteOldestPartitionPackets(n); ok || err != nil {
+		return deleted, err
+	}
+
+	result, err := d.db.Exec("DELETE FROM packets WHERE id IN (SELECT id FROM packets ORDER BY id LIMIT ?)", n)
+	if err != nil {
+		return 0, err
+	}
+	deleted, _ := result.RowsAffected()
+
+	if _, err := d.db.Exec("PRAGMA wal_checkpoint(TRUNCATE)"); err != nil {
+		log.Printf("Warning: WAL checkpoint failed: %v", err)
+	}
+
+	return deleted, nil
+}
+
 // Close closes the database connection
 func (d *Database) Close() error {
 	close(d.stopChan)
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Destination classes for link-layer traffic
+const (
+	castUnicast   = "unicast"
+	castBroadcast = "broadcast"
+	castMulticast = "multicast"
+)
+
+// maxDeviceIPs caps how many LAN addresses are remembered per device
+const maxDeviceIPs = 8
+
+// Device tracker limits
+const (
+	deviceForget     = 24 * time.Hour // A device not seen for this long is forgotten
+	deviceMax        = 4096           // Devices tracked at once; new ones beyond this are ignored
+	devicePruneEvery = time.Minute    // Forgotten devices are swept at most this often
+)
+
+// classifyCast reports whether a packet was sent to one host, every host or a group.
+// The destination MAC decides it; the IP address is used when there is no Ethernet header.
+func classifyCast(p Packet) string {
+	if p.DstMAC != "" {
+		if mac, err := net.ParseMAC(p.DstMAC); err == nil && len(mac) > 0 {
+			if p.DstMAC == "ff:ff:ff:ff:ff:ff" {
+				return castBroadcast
+			}
+			// The I/G bit of the first octet marks group addresses
+			if mac[0]&0x01 != 0 {
+				return castMulticast
+			}
+			return castUnicast
+		}
+	}
+
+	if ip := net.ParseIP(p.DstIP); ip != nil {
+		if ip.Equal(net.IPv4bcast) {
+			return castBroadcast
+		}
+		if ip.IsMulticast() {
+			return castMulticast
+		}
+	}
+	return castUnicast
+}
+
+// CastCount is traffic volume of one destination class
+type CastCount struct {
+	Packets int64 `json:"packets"`
+	Bytes   int64 `json:"bytes"`
+}
+
+// Device is a host seen on the local network, identified by MAC address
+type Device struct {
+	MAC         string    `json:"mac"`
+	IPs         []string  `json:"ips"`
+	FirstSeen   time.Time `json:"firstSeen"`
+	LastSeen    time.Time `json:"lastSeen"`
+	SentPackets int64     `json:"sentPackets"`
+	SentBytes   int64     `json:"sentBytes"`
+	RecvPackets int64     `json:"recvPackets"`
+	RecvBytes   int64     `json:"recvBytes"`
+
+	// Breakdown of sent traffic by destination class
+	Unicast          CastCount `json:"unicast"`
+	Broadcast        CastCount `json:"broadcast"`
+	Multicast        CastCount `json:"multicast"`
+	BroadcastPercent float64   `json:"broadcastPercent"` // Broadcast and multicast share of sent packets
+}
+
+// DeviceTracker keeps per-device traffic accounting for hosts on the LAN. Devices not
+// seen for a day are forgotten and at most 4096 are kept, so a flood of spoofed MAC
+// addresses can't use up memory.
+type DeviceTracker struct {
+	mu      sync.RWMutex
+	devices map[string]*Device
+	pruned  time.Time
+}
+
+// NewDeviceTracker creates an empty device tracker
+func NewDeviceTracker() *DeviceTracker {
+	return &DeviceTracker{devices: make(map[string]*Device)}
+}
+
+// deviceKey identifies the sending or receiving device, falling back to the IP
+// address on captures without an Ethernet header (tun and WireGuard interfaces). Only
+// LAN addresses count there, or every internet host would become a device; "" is
+// returned for the rest.
+func deviceKey(mac, ip string) string {
+	if mac != "" {
+		return mac
+	}
+	if !isLANIP(net.ParseIP(ip)) {
+		return ""
+	}
+	return ip
+}
+
+// isLANIP reports whether an address is private or link-local
+func isLANIP(ip net.IP) bool {
+	return ip != nil && (ip.IsPrivate() || ip.IsLinkLocalUnicast())
+}
+
+// device returns the device with a key, adding it if there's room, or nil. Must be called
+// with dt.mu held.
+func (dt *DeviceTracker) device(key string, now time.Time) *Device {
+	d, ok := dt.devices[key]
+	if !ok {
+		if now.Sub(dt.pruned) >= devicePruneEvery {
+			dt.pruneLocked(now)
+		}
+		if len(dt.devices) >= deviceMax {
+			return nil
+		}
+		d = &Device{MAC: key, IPs: []string{}, FirstSeen: now}
+		dt.devices[key] = d
+	}
+	d.LastSeen = now
+	return d
+}
+
+// pruneLocked forgets devices not seen for deviceForget. Must be called with dt.mu held.
+func (dt *DeviceTracker) pruneLocked(now time.Time) {
+	dt.pruned = now
+	for key, d := range dt.devices {
+		if now.Sub(d.LastSeen) > deviceForget {
+			delete(dt.devices, key)
+		}
+	}
+}
+
+// addIP records a LAN address for the device. Remote addresses are ignored, otherwise
+// the router would collect every internet host it forwards traffic for.
+func (d *Device) addIP(s string) {
+	ip := net.ParseIP(s)
+	if !isLANIP(ip) || len(d.IPs) >= maxDeviceIPs {
+		return
+	}
+	for _, existing := range d.IPs {
+		if existing == s {
+			return
+		}
+	}
+	d.IPs = append(d.IPs, s)
+}
+
+// Observe implements PacketObserver
+func (dt *DeviceTracker) Observe(p Packet) {
+	src := deviceKey(p.SrcMAC, p.SrcIP)
+	if src == "" {
+		return
+	}
+	cast := classifyCast(p)
+	length := int64(p.Length)
+
+	dt.mu.Lock()
+	defer dt.mu.Unlock()
+
+	if d := dt.device(src, p.Timestamp); d != nil {
+		d.addIP(p.SrcIP)
+		d.SentPackets++
+		d.SentBytes += length
+
+		var count *CastCount
+		switch cast {
+		case castBroadcast:
+			count = &d.Broadcast
+		case castMulticast:
+			count = &d.Multicast
+		default:
+			count = &d.Unicast
+		}
+		count.Packets++
+		count.Bytes += length
+	}
+
+	// Group traffic is received by everyone, so only unicast is credited to the receiver
+	if cast == castUnicast {
+		if dst := deviceKey(p.DstMAC, p.DstIP); dst != "" {
+			if r := dt.device(dst, p.Timestamp); r != nil {
+				r.addIP(p.DstIP)
+				r.RecvPackets++
+				r.RecvBytes += length
+			}
+		}
+	}
+}
+
+// Devices returns a snapshot of every tracked device, sorted by the given key:
+// "broadcast" (broadcast and multicast packets sent), "packets" or "bytes" (the default)
+func (dt *DeviceTracker) Devices(sortBy string) []Device {
+	dt.mu.RLock()
+	devices := make([]Device, 0, len(dt.devices))
+	for _, d := range dt.devices {
+		c := *d
+		c.IPs = append([]string{}, d.IPs...)
+		if c.SentPackets > 0 {
+			c.BroadcastPercent = float64(c.Broadcast.Packets+c.Multicast.Packets) * 100 / float64(c.SentPackets)
+		}
+		devices = append(devices, c)
+	}
+	dt.mu.RUnlock()
+
+	value := deviceSortValue(sortBy)
+	sort.Slice(devices, func(i, j int) bool {
+		if vi, vj := value(devices[i]), value(devices[j]); vi != vj {
+			return vi > vj
+		}
+		return devices[i].MAC < devices[j].MAC
+	})
+	return devices
+}
+
+// deviceSortValue returns the value devices are ordered by, highest first, for a sort key
+func deviceSortValue(sortBy string) func(d Device) int64 {
+	switch strings.ToLower(sortBy) {
+	case "broadcast":
+		return func(d Device) int64 { return d.Broadcast.Packets + d.Multicast.Packets }
+	case "packets":
+		return func(d Device) int64 { return d.SentPackets + d.RecvPackets }
+	default:
+		return func(d Device) int64 { return d.SentBytes + d.RecvBytes }
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+// dhcpServersSetting is where learned and API-trusted DHCP servers are persisted
+const dhcpServersSetting = "dhcp_servers"
+
+// DHCPServer is a DHCP server seen answering clients on the LAN
+type DHCPServer struct {
+	IP        string    `json:"ip"`
+	MAC       string    `json:"mac"`
+	Offers    int64     `json:"offers"`
+	Acks      int64     `json:"acks"`
+	LastLease string    `json:"lastLease"` // Last address handed out
+	FirstSeen time.Time `json:"firstSeen"`
+	LastSeen  time.Time `json:"lastSeen"`
+	Trusted   bool      `json:"trusted"`
+}
+
+// DHCPGuard watches DHCP offers and acks and raises an alert when a server other than
+// the legitimate ones answers. Legitimate servers are either configured, or learned:
+// with none configured, the first server seen is trusted and remembered.
+type DHCPGuard struct {
+	alerts *AlertEngine
+	db     *Database
+
+	mu      sync.Mutex
+	trusted map[string]bool // Server IPs and MACs
+	learn   bool            // Trust the first server seen, when none are configured
+	servers map[string]*DHCPServer
+}
+
+// NewDHCPGuard creates a guard trusting the given server IPs or MACs, plus any
+// learned or trusted through the API before
+func NewDHCPGuard(trusted []string, alerts *AlertEngine, db *Database) *DHCPGuard {
+	dg := &DHCPGuard{
+		alerts:  alerts,
+		db:      db,
+		trusted: make(map[string]bool),
+		servers: make(map[string]*DHCPServer),
+	}
+	for _, t := range trusted {
+		if t = strings.ToLower(strings.TrimSpace(t)); t != "" {
+			dg.trusted[t] = true
+		}
+	}
+
+	dg.learn = len(dg.trusted) == 0
+
+	if db != nil {
+		if value, ok, err := db.GetSetting(dhcpServersSetting); err == nil && ok {
+			var saved []string
+			if err := json.Unmarshal([]byte(value), &saved); err == nil {
+				for _, t := range saved {
+					dg.trusted[t] = true
+				}
+				log.Printf("Trusting previously saved DHCP servers: %s", strings.Join(saved, ", "))
+			}
+		}
+	}
+	return dg
+}
+
+// dhcpMessageType returns the DHCP message type option, if present
+func dhcpMessageType(d *layers.DHCPv4) layers.DHCPMsgType {
+	for _, opt := range d.Options {
+		if opt.Type == layers.DHCPOptMessageType && len(opt.Data) == 1 {
+			return layers.DHCPMsgType(opt.Data[0])
+		}
+	}
+	return layers.DHCPMsgTypeUnspecified
+}
+
+// dhcpServerID returns the server identifier option, falling back to the sender's address
+func dhcpServerID(d *layers.DHCPv4, srcIP string) string {
+	for _, opt := range d.Options {
+		if opt.Type == layers.DHCPOptServerID && len(opt.Data) == 4 {
+			return net.IP(opt.Data).String()
+		}
+	}
+	return srcIP
+}
+
+// Observe implements PacketObserver
+func (dg *DHCPGuard) Observe(p Packet) {
+	if p.dhcp == nil || p.dhcp.Operation != layers.DHCPOpReply {
+		return
+	}
+	msgType := dhcpMessageType(p.dhcp)
+	if msgType != layers.DHCPMsgTypeOffer && msgType != layers.DHCPMsgTypeAck {
+		return
+	}
+
+	serverIP := dhcpServerID(p.dhcp, p.SrcIP)
+	serverMAC := strings.ToLower(p.SrcMAC)
+	client := p.dhcp.ClientHWAddr.String()
+	lease := p.dhcp.YourClientIP.String()
+
+	dg.mu.Lock()
+	s := dg.servers[serverIP]
+	if s == nil {
+		s = &DHCPServer{IP: serverIP, MAC: serverMAC, FirstSeen: p.Timestamp}
+		dg.servers[serverIP] = s
+	}
+	s.LastSeen = p.Timestamp
+	s.LastLease = lease
+	if msgType == layers.DHCPMsgTypeOffer {
+		s.Offers++
+	} else {
+		s.Acks++
+	}
+
+	// With nothing configured or learned yet, the first server to answer is the legitimate one
+	if dg.learn && len(dg.trusted) == 0 {
+		dg.trustLocked(serverIP)
+		log.Printf("Learned DHCP server %s (%s)", serverIP, serverMAC)
+	}
+
+	trusted := dg.trusted[serverIP] || (serverMAC != "" && dg.trusted[serverMAC])
+	s.Trusted = trusted
+	dg.mu.Unlock()
+
+	if !trusted && dg.alerts != nil {
+		dg.alerts.Raise("Rogue DHCP server", fmt.Sprintf("%s (%s)", serverIP, serverMAC), severityCritical,
+			fmt.Sprintf("Unknown DHCP server %s (%s) sent a %s to %s offering %s", serverIP, serverMAC, msgType, client, lease))
+	}
+}
+
+// trustLocked marks a server as legitimate and persists the trusted set. Must be called with dg.mu held.
+func (dg *DHCPGuard) trustLocked(server string) {
+	dg.trusted[strings.ToLower(server)] = true
+	if s := dg.servers[server]; s != nil {
+		s.Trusted = true
+	}
+	if dg.db == nil {
+		return
+	}
+	learned := make([]string, 0, len(dg.trusted))
+	for t := range dg.trusted {
+		learned = append(learned, t)
+	}
+	sort.Strings(learned)
+	data, _ := json.Marshal(learned)
+	if err := dg.db.SetSetting(dhcpServersSetting, string(data)); err != nil {
+		log.Printf("Error saving trusted DHCP servers: %v", err)
+	}
+}
+
+// Trust marks a server (IP or MAC) as legitimate, e.g. after replacing the router
+func (dg *DHCPGuard) Trust(server string) {
+	dg.mu.Lock()
+	defer dg.mu.Unlock()
+	dg.trustLocked(server)
+}
+
+// Servers returns every DHCP server seen since startup
+func (dg *DHCPGuard) Servers() []DHCPServer {
+	dg.mu.Lock()
+	defer dg.mu.Unlock()
+
+	servers := make([]DHCPServer, 0, len(dg.servers))
+	for _, s := range dg.servers {
+		servers = append(servers, *s)
+	}
+	sort.Slice(servers, func(i, j int) bool {
+		return servers[i].FirstSeen.Before(servers[j].FirstSeen)
+	})
+	return servers
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shirou/gopsutil/v3/disk"
+)
+
+// Disk states, in increasing severity
+const (
+	diskStateOK       = "ok"
+	diskStateLow      = "low"      // Below the warning threshold: prune oldest packets
+	diskStateCritical = "critical" // Below the critical threshold: stop writing packets
+)
+
+// diskPruneChunk is how many of the oldest packets are deleted per check while space is low
+const diskPruneChunk = 20000
+
+// parseByteSize parses sizes like "500MB", "2GB" or "1048576" into bytes
+func parseByteSize(s string) (uint64, error) {
+	s = strings.TrimSpace(strings.ToUpper(s))
+	multipliers := []struct {
+		suffix string
+		factor uint64
+	}{
+		{"TB", 1 << 40}, {"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"B", 1},
+	}
+
+	factor := uint64(1)
+	for _, m := range multipliers {
+		if strings.HasSuffix(s, m.suffix) {
+			factor = m.factor
+			s = strings.TrimSpace(strings.TrimSuffix(s, m.suffix))
+			break
+		}
+	}
+
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return uint64(n * float64(factor)), nil
+}
+
+// DiskStatus describes free space on a monitored volume
+type DiskStatus struct {
+	Path        string    `json:"path"`
+	Total       uint64    `json:"total"`
+	Free        uint64    `json:"free"`
+	UsedPercent float64   `json:"usedPercent"`
+	State       string    `json:"state"`
+	StatsOnly   bool      `json:"statsOnly"`
+	DBSize      int64     `json:"dbSize"`              // Bytes of the database in use, excluding free pages
+	DBMaxSize   uint64    `json:"dbMaxSize,omitempty"` // Cap on DBSize, 0 for none
+	CheckedAt   time.Time `json:"checkedAt"`
+}
+
+// DiskMonitor watches free space on the volume holding the database and degrades
+// gracefully as it runs out: first pruning the oldest packets, then switching to
+// stats-only mode where packets are no longer written to the database. It also keeps
+// the database under an optional size cap by evicting the oldest packets.
+type DiskMonitor struct {
+	path         string
+	warnFree     uint64
+	criticalFree uint64
+	maxSize      uint64
+	db           *Database
+	store        *PacketStore
+
+	mu     sync.RWMutex
+	status DiskStatus
+
+	// Only used by check
+	pruned      bool // Packets were pruned for space at the last check
+	pruneHalted bool // Pruning didn't bring space back, so it's stopped until it recovers
+}
+
+// NewDiskMonitor creates a monitor for the volume holding dbPath. maxSize caps the database size (0 for no cap).
+func NewDiskMonitor(dbPath string, warnFree, criticalFree, maxSize uint64, db *Database, store *PacketStore) *DiskMonitor {
+	dir, err := filepath.Abs(filepath.Dir(dbPath))
+	if err != nil {
+		dir = filepath.Dir(dbPath)
+	}
+	return &DiskMonitor{
+		path:         dir,
+		warnFree:     warnFree,
+		criticalFree: criticalFree,
+		maxSize:      maxSize,
+		db:           db,
+		store:        store,
+		status:       DiskStatus{Path: dir, State: diskStateOK},
+	}
+}
+
+// Start begins checking free space in the background
+func (dm *DiskMonitor) Start(interval time.Duration) {
+	go func() {
+		dm.check()
+		ticker := time.NewTicker(interval)
+		for range ticker.C {
+			dm.check()
+		}
+	}()
+}
+
+// Status returns the latest disk status
+func (dm *DiskMonitor) Status() DiskStatus {
+	dm.mu.RLock()
+	defer dm.mu.RUnlock()
+	return dm.status
+}
+
+func (dm *DiskMonitor) check() {
+	dm.enforceMaxSize()
+
+	usage, err := disk.Usage(dm.path)
+	if err != nil {
+		log.Printf("Error checking disk space for %s: %v", dm.path, err)
+		return
+	}
+	var dbSize int64
+	if dm.db != nil {
+		dbSize = dm.db.UsedSize()
+	}
+
+	dm.mu.Lock()
+	prev := dm.status.State
+	statsOnly := dm.status.StatsOnly
+
+	state := diskStateOK
+	switch {
+	case usage.Free < dm.criticalFree:
+		state = diskStateCritical
+	case usage.Free < dm.warnFree:
+		state = diskStateLow
+	}
+
+	// Stop writing at critical, but only resume once back above the warning threshold
+	// so writes don't flap on and off around the critical mark
+	if state == diskStateCritical {
+		statsOnly = true
+	} else if state == diskStateOK {
+		statsOnly = false
+	}
+
+	dm.status = DiskStatus{
+		Path:        dm.path,
+		Total:       usage.Total,
+		Free:        usage.Free,
+		UsedPercent: usage.UsedPercent,
+		State:       state,
+		StatsOnly:   statsOnly,
+		DBSize:      dbSize,
+		DBMaxSize:   dm.maxSize,
+		CheckedAt:   time.Now(),
+	}
+	status := dm.status
+	dm.mu.Unlock()
+
+	if dm.db != nil {
+		dm.db.SetWritesPaused(statsOnly)
+	}
+
+	if state != prev {
+		if state == diskStateOK {
+			log.Printf("Disk space recovered on %s (%d MB free)", dm.path, usage.Free>>20)
+		} else {
+			log.Printf("Warning: disk space %s on %s (%d MB free, stats-only: %v)", state, dm.path, usage.Free>>20, statsOnly)
+		}
+		if dm.store != nil {
+			dm.store.Broadcast("disk", status)
+		}
+	}
+
+	// While space is short, delete the oldest packets. SQLite keeps the freed pages and
+	// reuses them for new rows, so this stops the file growing; the WAL is truncated outright.
+	// If space is still short after that, something else is using it, and the rest of the
+	// history is kept rather than deleted to no avail.
+	if state == diskStateOK {
+		dm.pruned, dm.pruneHalted = false, false
+	}
+	if state != diskStateOK && dm.pruned && !dm.pruneHalted {
+		dm.pruneHalted = true
+		log.Printf("Warning: pruning packets didn't bring free space on %s back above %d MB; no more will be pruned until it recovers", dm.path, dm.warnFree>>20)
+	}
+	if state != diskStateOK && !dm.pruneHalted && dm.db != nil {
+		dm.pruned = true
+		deleted, err := dm.db.DeleteOldestPackets(diskPruneChunk)
+		if err != nil {
+			log.Printf("Error pruning packets for disk space: %v", err)
+			return
+		}
+		if deleted > 0 {
+			log.Printf("Pruned %d oldest packets to free disk space", deleted)
+		}
+	}
+}
+
+// enforceMaxSize deletes the oldest packets in chunks until the database is back under the
+// size cap, then hands the freed pages back to the filesystem
+func (dm *DiskMonitor) enforceMaxSize() {
+	if dm.maxSize == 0 || dm.db == nil {
+		return
+	}
+	var total int64
+	for uint64(dm.db.UsedSize()) > dm.maxSize {
+		deleted, err := dm.db.DeleteOldestPackets(diskPruneChunk)
+		if err != nil {
+			log.Printf("Error evicting packets for the database size cap: %v", err)
+			break
+		}
+		if deleted == 0 {
+			// Only packets are evicted; whatever else is stored stays
+			break
+		}
+		total += deleted
+	}
+	if total == 0 {
+		return
+	}
+	if err := dm.db.IncrementalVacuum(); err != nil {
+		log.Printf("Warning: incremental vacuum failed: %v", err)
+	}
+	log.Printf("Evicted %d oldest packets to keep the database under %d MB", total, dm.maxSize>>20)
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+// DNS log settings
+const (
+	dnsLogFlushInterval = 5 * time.Second
+	dnsLogMaxPending    = 10000 // Lookups held while the database is unavailable before new ones are dropped
+)
+
+// DNSLogEntry is one name lookup answered on the network
+type DNSLogEntry struct {
+	ID           int64     `json:"id"`
+	Timestamp    time.Time `json:"timestamp"`
+	Client       string    `json:"client"` // IP address that asked
+	ClientMAC    string    `json:"clientMac,omitempty"`
+	Server       string    `json:"server"`
+	Domain       string    `json:"domain"`
+	Type         string    `json:"type"`         // Record type asked for, e.g. A or AAAA
+	ResponseCode string    `json:"responseCode"` // e.g. No Error or Non-Existent Domain
+	Answers      []string  `json:"answers"`      // Addresses and names returned
+}
+
+// DNSLogQuery selects logged lookups for /api/dns
+type DNSLogQuery struct {
+	Client    string // IP or MAC address
+	Domain    string // The name or any name under it
+	StartTime *time.Time
+	EndTime   *time.Time
+	Limit     int
+	Offset    int
+}
+
+// parseDNSLogQuery reads the /api/dns parameters
+func parseDNSLogQuery(r *http.Request) (DNSLogQuery, error) {
+	v := r.URL.Query()
+	q := DNSLogQuery{
+		Client: strings.ToLower(strings.TrimSpace(v.Get("client"))),
+		Domain: strings.TrimSuffix(strings.ToLower(strings.TrimSpace(v.Get("domain"))), "."),
+		Limit:  100,
+	}
+	var err error
+	if q.StartTime, q.EndTime, err = parseFromTo(v); err != nil {
+		return q, err
+	}
+	if s := v.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			return q, fmt.Errorf("invalid limit %q", s)
+		}
+		if n > 1000 {
+			n = 1000
+		}
+		q.Limit = n
+	}
+	if s := v.Get("offset"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			return q, fmt.Errorf("invalid offset %q", s)
+		}
+		q.Offset = n
+	}
+	return q, nil
+}
+
+// parseFromTo reads the from and to parameters, RFC 3339 times that may each be missing
+func parseFromTo(v url.Values) (from, to *time.Time, err error) {
+	for name, dst := range map[string]**time.Time{"from": &from, "to": &to} {
+		if s := v.Get(name); s != "" {
+			t, err := time.Parse(time.RFC3339, s)
+			if err != nil {
+				return nil, nil, fmt.Errorf("invalid %s %q (expected RFC 3339, e.g. 2024-06-01T22:00:00Z)", name, s)
+			}
+			*dst = &t
+		}
+	}
+	return from, to, nil
+}
+
+// DNSLogger records every DNS answer sent to a client in the dns_log table, so past
+// lookups can be searched by device, name and time. Only port 53 responses are logged,
+// leaving out mDNS and LLMNR chatter.
+type DNSLogger struct {
+	db *Database
+
+	mu      sync.Mutex
+	pending []DNSLogEntry
+}
+
+// NewDNSLogger creates a logger writing to db
+func NewDNSLogger(db *Database) *DNSLogger {
+	return &DNSLogger{db: db}
+}
+
+// Start writes logged lookups to the database in the background
+func (dl *DNSLogger) Start() {
+	go func() {
+		ticker := time.NewTicker(dnsLogFlushInterval)
+		for range ticker.C {
+			dl.Flush()
+		}
+	}()
+}
+
+// Flush writes pending lookups to the database
+func (dl *DNSLogger) Flush() {
+	dl.mu.Lock()
+	pending := dl.pending
+	dl.pending = nil
+	dl.mu.Unlock()
+
+	if len(pending) == 0 {
+		return
+	}
+	if err := dl.db.InsertDNSLog(pending); err != nil {
+		log.Printf("Error saving DNS log: %v", err)
+		// Put them back so they are retried on the next flush
+		dl.mu.Lock()
+		if len(pending)+len(dl.pending) <= dnsLogMaxPending {
+			dl.pending = append(pending, dl.pending...)
+		}
+		dl.mu.Unlock()
+	}
+}
+
+// Observe implements PacketObserver
+func (dl *DNSLogger) Observe(p Packet) {
+	if p.dns == nil || !p.dns.QR || len(p.dns.Questions) == 0 || p.SrcPort != 53 {
+		return
+	}
+	q := p.dns.Questions[0]
+	entry := DNSLogEntry{
+		Timestamp:    p.Timestamp,
+		Client:       p.DstIP,
+		ClientMAC:    p.DstMAC,
+		Server:       p.SrcIP,
+		Domain:       strings.TrimSuffix(strings.ToLower(string(q.Name)), "."),
+		Type:         q.Type.String(),
+		ResponseCode: p.dns.ResponseCode.String(),
+		Answers:      []string{},
+	}
+	for _, a := range p.dns.Answers {
+		switch a.Type {
+		case layers.DNSTypeA, layers.DNSTypeAAAA:
+			entry.Answers = append(entry.Answers, a.IP.String())
+		case layers.DNSTypeCNAME:
+			entry.Answers = append(entry.Answers, string(a.CNAME))
+		case layers.DNSTypePTR:
+			entry.Answers = append(entry.Answers, string(a.PTR))
+		}
+	}
+
+	dl.mu.Lock()
+	if len(dl.pending) < dnsLogMaxPending {
+		dl.pending = append(dl.pending, entry)
+	}
+	dl.mu.Unlock()
+}
+
+func createDNSLogTables(db *sql.DB) error {
+	schema := `
+	CREATE TABLE IF NOT EXISTS dns_log (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		timestamp DATETIME NOT NULL,
+		client_ip TEXT NOT NULL,
+		client_mac TEXT,
+		server_ip TEXT,
+		domain TEXT NOT NULL,
+		type TEXT,
+		response_code TEXT,
+		answers TEXT
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_dns_log_timestamp ON dns_log(timestamp);
+	CREATE INDEX IF NOT EXISTS idx_dns_log_client_ip ON dns_log(client_ip, timestamp);
+	CREATE INDEX IF NOT EXISTS idx_dns_log_domain ON dns_log(domain);
+	`
+
+	if _, err := db.Exec(schema); err != nil {
+		return fmt.Errorf("failed to create DNS log schema: %v", err)
+	}
+	return nil
+}
+
+// InsertDNSLog stores logged lookups in one transaction
+func (d *Database) InsertDNSLog(entries []DNSLogEntry) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(`
+		INSERT INTO dns_log (timestamp, client_ip, client_mac, server_ip, domain, type, response_code, answers)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, e := range entries {
+		_, err := stmt.Exec(e.Timestamp, e.Client, e.ClientMAC, e.Server, e.Domain, e.Type, e.ResponseCode, strings.Join(e.Answers, ","))
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// QueryDNSLog returns logged lookups matching q, most recent first, and how many match in total
+func (d *Database) QueryDNSLog(q DNSLogQuery) ([]DNSLogEntry, int, error) {
+	where := " WHERE 1=1"
+	args := []interface{}{}
+	if q.Client != "" {
+		where += " AND (client_ip = ? OR client_mac = ?)"
+		args = append(args, q.Client, q.Client)
+	}
+	if q.Domain != "" {
+		where += " AND (domain = ? OR domain LIKE ? ESCAPE '\\')"
+		escaped := strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(q.Domain)
+		args = append(args, q.Domain, "%."+escaped)
+	}
+	if q.StartTime != nil {
+		where += " AND timestamp >= ?"
+		args = append(args, q.StartTime)
+	}
+	if q.EndTime != nil {
+		where += " AND timestamp <= ?"
+		args = append(args, q.EndTime)
+	}
+
+	var total int
+	if err := d.db.QueryRow("SELECT COUNT(*) FROM dns_log"+where, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	query := `
+		SELECT id, timestamp, client_ip, client_mac, server_ip, domain, type, response_code, answers
+		FROM dns_log` + where + " ORDER BY timestamp DESC, id DESC LIMIT ? OFFSET ?"
+	args = append(args, q.Limit, q.Offset)
+
+	rows, err := d.db.Query(query, args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	entries := []DNSLogEntry{}
+	for rows.Next() {
+		var e DNSLogEntry
+		var clientMAC, server, typ, responseCode, answers sql.NullString
+		if err := rows.Scan(&e.ID, &e.Timestamp, &e.Client, &clientMAC, &server, &e.Domain, &typ, &responseCode, &answers); err != nil {
+			return nil, 0, err
+		}
+		e.ClientMAC = clientMAC.String
+		e.Server = server.String
+		e.Type = typ.String
+		e.ResponseCode = responseCode.String
+		e.Answers = []string{}
+		if answers.String != "" {
+			e.Answers = strings.Split(answers.String, ",")
+		}
+		entries = append(entries, e)
+	}
+	return entries, total, rows.Err()
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+// DNS name settings
+const (
+	dnsNameMinTTL     = time.Hour // Clients keep using addresses well past short record TTLs
+	dnsNameMaxEntries = 100000    // Answers beyond this are dropped until old ones expire
+)
+
+// dnsNames names remote addresses after the lookups that led to them, nil with
+// -dns-names=false
+var dnsNames *DNSNames
+
+// dnsName is the name a client looked an address up by
+type dnsName struct {
+	name    string
+	expires time.Time
+}
+
+// DNSNames remembers, for each client, the names it resolved and the addresses they
+// resolved to, from the DNS answers on the network. Packets between the client and one of
+// those addresses are then named after what the client asked for, like api.example.com,
+// rather than the address's reverse DNS, which for cloud and CDN addresses is a generic
+// name like ec2-3-21-0-1.us-east-2.compute.amazonaws.com. An answer is kept for its TTL,
+// but at least an hour; the latest lookup of an address wins.
+type DNSNames struct {
+	mu        sync.Mutex
+	names     map[string]dnsName // Keyed by client and answer address
+	lastSweep time.Time
+	dropped   int64
+}
+
+// NewDNSNames creates an empty set of names
+func NewDNSNames() *DNSNames {
+	return &DNSNames{names: make(map[string]dnsName)}
+}
+
+// Observe implements PacketObserver
+func (d *DNSNames) Observe(p Packet) {
+	if p.dns == nil || !p.dns.QR || len(p.dns.Questions) == 0 || p.SrcPort != 53 {
+		return
+	}
+	name := strings.TrimSuffix(strings.ToLower(string(p.dns.Questions[0].Name)), ".")
+	if name == "" {
+		return
+	}
+
+	now := time.Now()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if since := now.Sub(d.lastSweep); since > dnsNameMinTTL || len(d.names) >= dnsNameMaxEntries && since > time.Minute {
+		d.sweep(now)
+	}
+	for _, a := range p.dns.Answers {
+		if a.Type != layers.DNSTypeA && a.Type != layers.DNSTypeAAAA {
+			continue
+		}
+		ttl := time.Duration(a.TTL) * time.Second
+		if ttl < dnsNameMinTTL {
+			ttl = dnsNameMinTTL
+		}
+		key := p.DstIP + "|" + a.IP.String()
+		if _, ok := d.names[key]; !ok && len(d.names) >= dnsNameMaxEntries {
+			d.dropped++
+			continue
+		}
+		d.names[key] = dnsName{name, now.Add(ttl)}
+	}
+}
+
+// sweep removes expired names. Callers hold mu.
+func (d *DNSNames) sweep(now time.Time) {
+	for key, n := range d.names {
+		if now.After(n.expires) {
+			delete(d.names, key)
+		}
+	}
+	d.lastSweep = now
+}
+
+// Name returns the name client looked remote up by, or "" if it didn't
+func (d *DNSNames) Name(client, remote string) string {
+	if d == nil || client == "" || remote == "" {
+		return ""
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	n, ok := d.names[client+"|"+remote]
+	if !ok || time.Now().After(n.expires) {
+		return ""
+	}
+	return n.name
+}
+
+// Status reports how many names are known, for /api/enrichment
+func (d *DNSNames) Status() map[string]int64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return map[string]int64{"names": int64(len(d.names)), "dropped": d.dropped}
+}
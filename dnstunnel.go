@@ -0,0 +1,231 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+// DNS tunneling heuristics
+const (
+	dnsTunnelWindow       = 10 * time.Minute // Clients are scored over this much traffic
+	dnsTunnelMinQueries   = 20               // Too few queries to judge below this
+	dnsTunnelLongLabel    = 40               // Labels this long rarely occur in real hostnames
+	dnsTunnelLongName     = 100              // Nor do names this long
+	dnsTunnelMinSubdomain = 12               // Subdomains shorter than this aren't judged on entropy
+	dnsTunnelHighEntropy  = 3.8              // Bits per character of encoded data in subdomains
+	dnsTunnelExtremeQPM   = 300              // Queries per minute considered extreme
+	dnsTunnelAlertScore   = 50               // Score at which a client is flagged
+)
+
+// DNSTunnelScore is one client's DNS behaviour over the current window, scored 0-100
+// for how much it looks like data being tunneled through DNS
+type DNSTunnelScore struct {
+	Client        string    `json:"client"`
+	Score         float64   `json:"score"`
+	Queries       int       `json:"queries"`
+	QueriesPerMin float64   `json:"queriesPerMin"`
+	LongNames     int       `json:"longNames"`     // Queries with an overlong label or name
+	HighEntropy   int       `json:"highEntropy"`   // Queries whose subdomain looks like encoded data
+	TXTNull       int       `json:"txtNull"`       // TXT and NULL queries
+	UniqueNames   int       `json:"uniqueNames"`   // Distinct names queried
+	TopDomain     string    `json:"topDomain"`     // Most queried base domain
+	TopDomainHits int       `json:"topDomainHits"` // Queries for it
+	WindowStart   time.Time `json:"windowStart"`
+}
+
+// dnsClientStats accumulates one client's queries in the current window
+type dnsClientStats struct {
+	queries     int
+	longNames   int
+	highEntropy int
+	txtNull     int
+	names       map[string]bool
+	domains     map[string]int
+}
+
+// DNSTunnelDetector scores DNS clients on the tell-tale signs of DNS tunneling and
+// exfiltration: long labels, random-looking subdomains, TXT/NULL queries and sheer volume
+type DNSTunnelDetector struct {
+	alerts *AlertEngine
+
+	mu          sync.Mutex
+	windowStart time.Time
+	clients     map[string]*dnsClientStats
+	scores      map[string]DNSTunnelScore
+}
+
+// NewDNSTunnelDetector creates a detector raising alerts through the given engine
+func NewDNSTunnelDetector(alerts *AlertEngine) *DNSTunnelDetector {
+	return &DNSTunnelDetector{
+		alerts:      alerts,
+		windowStart: time.Now(),
+		clients:     make(map[string]*dnsClientStats),
+		scores:      make(map[string]DNSTunnelScore),
+	}
+}
+
+// Start scores clients every minute in the background
+func (dt *DNSTunnelDetector) Start() {
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		for range ticker.C {
+			dt.analyze(time.Now())
+		}
+	}()
+}
+
+// shannonEntropy returns the entropy of s in bits per character
+func shannonEntropy(s string) float64 {
+	if s == "" {
+		return 0
+	}
+	counts := make(map[rune]int)
+	for _, c := range s {
+		counts[c]++
+	}
+	var entropy float64
+	n := float64(len(s))
+	for _, c := range counts {
+		p := float64(c) / n
+		entropy -= p * math.Log2(p)
+	}
+	return entropy
+}
+
+// splitDNSName splits a query name into its subdomain and base domain (the last two labels)
+func splitDNSName(name string) (sub, base string) {
+	labels := strings.Split(strings.TrimSuffix(strings.ToLower(name), "."), ".")
+	if len(labels) <= 2 {
+		return "", strings.Join(labels, ".")
+	}
+	return strings.Join(labels[:len(labels)-2], "."), strings.Join(labels[len(labels)-2:], ".")
+}
+
+// Observe implements PacketObserver
+func (dt *DNSTunnelDetector) Observe(p Packet) {
+	if p.dns == nil || p.dns.QR || len(p.dns.Questions) == 0 {
+		return
+	}
+	q := p.dns.Questions[0]
+	name := string(q.Name)
+	sub, base := splitDNSName(name)
+
+	long := len(name) >= dnsTunnelLongName
+	for _, label := range strings.Split(name, ".") {
+		if len(label) >= dnsTunnelLongLabel {
+			long = true
+		}
+	}
+	encoded := len(sub) >= dnsTunnelMinSubdomain && shannonEntropy(strings.ReplaceAll(sub, ".", "")) >= dnsTunnelHighEntropy
+
+	dt.mu.Lock()
+	defer dt.mu.Unlock()
+
+	c := dt.clients[p.SrcIP]
+	if c == nil {
+		c = &dnsClientStats{names: make(map[string]bool), domains: make(map[string]int)}
+		dt.clients[p.SrcIP] = c
+	}
+	c.queries++
+	if long {
+		c.longNames++
+	}
+	if encoded {
+		c.highEntropy++
+	}
+	if q.Type == layers.DNSTypeTXT || q.Type == layers.DNSTypeNULL {
+		c.txtNull++
+	}
+	c.names[name] = true
+	c.domains[base]++
+}
+
+// score combines the heuristics into 0-100. Each share of suspicious queries contributes
+// up to its weight; volume is scaled against the extreme query rate.
+func (c *dnsClientStats) score(client string, minutes float64, windowStart time.Time) DNSTunnelScore {
+	s := DNSTunnelScore{
+		Client:        client,
+		Queries:       c.queries,
+		QueriesPerMin: float64(c.queries) / minutes,
+		LongNames:     c.longNames,
+		HighEntropy:   c.highEntropy,
+		TXTNull:       c.txtNull,
+		UniqueNames:   len(c.names),
+		WindowStart:   windowStart,
+	}
+	for domain, hits := range c.domains {
+		if hits > s.TopDomainHits {
+			s.TopDomain, s.TopDomainHits = domain, hits
+		}
+	}
+	if c.queries < dnsTunnelMinQueries {
+		return s
+	}
+
+	n := float64(c.queries)
+	s.Score = 30*float64(c.longNames)/n +
+		30*float64(c.highEntropy)/n +
+		20*float64(c.txtNull)/n +
+		20*math.Min(s.QueriesPerMin/dnsTunnelExtremeQPM, 1)
+	s.Score = math.Round(s.Score*10) / 10
+	return s
+}
+
+// analyze scores every client, raises alerts for suspicious ones and starts a new
+// window once the current one is complete
+func (dt *DNSTunnelDetector) analyze(now time.Time) {
+	dt.mu.Lock()
+	minutes := math.Max(now.Sub(dt.windowStart).Minutes(), 1)
+	var flagged []DNSTunnelScore
+	for client, c := range dt.clients {
+		s := c.score(client, minutes, dt.windowStart)
+		dt.scores[client] = s
+		if s.Score >= dnsTunnelAlertScore {
+			flagged = append(flagged, s)
+		}
+	}
+	if now.Sub(dt.windowStart) >= dnsTunnelWindow {
+		// Clients that went quiet for a whole window are forgotten
+		for client := range dt.scores {
+			if dt.clients[client] == nil {
+				delete(dt.scores, client)
+			}
+		}
+		dt.windowStart = now
+		dt.clients = make(map[string]*dnsClientStats)
+	}
+	dt.mu.Unlock()
+
+	if dt.alerts == nil {
+		return
+	}
+	for _, s := range flagged {
+		dt.alerts.Raise("DNS tunneling", s.Client, severityWarning,
+			fmt.Sprintf("%s looks like it is tunneling data over DNS (score %.0f): %d queries, %d long, %d high-entropy, %d TXT/NULL, top domain %s",
+				s.Client, s.Score, s.Queries, s.LongNames, s.HighEntropy, s.TXTNull, s.TopDomain))
+	}
+}
+
+// Scores returns the latest score of every DNS client, most suspicious first
+func (dt *DNSTunnelDetector) Scores() []DNSTunnelScore {
+	dt.mu.Lock()
+	defer dt.mu.Unlock()
+
+	scores := make([]DNSTunnelScore, 0, len(dt.scores))
+	for _, s := range dt.scores {
+		scores = append(scores, s)
+	}
+	sort.Slice(scores, func(i, j int) bool {
+		if scores[i].Score != scores[j].Score {
+			return scores[i].Score > scores[j].Score
+		}
+		return scores[i].Queries > scores[j].Queries
+	})
+	return scores
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Docker settings
+const (
+	dockerDefaultSocket = "/var/run/docker.sock"
+	dockerRefresh       = 30 * time.Second
+	dockerNamePrefix    = "container: " // How containers appear in process names and hostnames
+)
+
+// docker names the containers running on the Pi, nil when Docker isn't
+var docker *DockerContainers
+
+// dockerIDPattern finds a container ID in a /proc/<pid>/cgroup path, e.g.
+// "0::/system.slice/docker-<id>.scope" or "0::/docker/<id>"
+var dockerIDPattern = regexp.MustCompile(`[0-9a-f]{64}`)
+
+// DockerContainers attributes traffic to the Docker containers on the Pi, asking the
+// Docker API for them every 30 seconds. Containers on a bridge network are known by their
+// addresses; traffic to a published port is the container's rather than docker-proxy's;
+// and a process found behind a connection, by polling or eBPF, is matched to its
+// container through its cgroup, which covers containers on the host network and NATed
+// connections out of bridge networks.
+type DockerContainers struct {
+	socket string
+	client *http.Client
+
+	mu      sync.RWMutex
+	byIP    map[string]string // Container address -> name
+	byPort  map[string]string // Published port as "tcp/8096" -> name
+	byID    map[string]string // Container ID -> name
+	byPID   map[int32]string  // Processes already matched, "" for none; cleared each refresh
+	lastErr string
+}
+
+// NewDockerContainers creates the lookup for the Docker API at socket
+func NewDockerContainers(socket string) *DockerContainers {
+	return &DockerContainers{
+		socket: socket,
+		client: &http.Client{
+			Timeout: 10 * time.Second,
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, "unix", socket)
+				},
+			},
+		},
+		byIP:   make(map[string]string),
+		byPort: make(map[string]string),
+		byID:   make(map[string]string),
+		byPID:  make(map[int32]string),
+	}
+}
+
+// Start lists the containers in the background, then again every 30 seconds
+func (d *DockerContainers) Start() {
+	go func() {
+		for {
+			err := d.refresh()
+			d.mu.Lock()
+			if err != nil && err.Error() != d.lastErr {
+				log.Printf("Warning: failed to list Docker containers: %v", err)
+			}
+			d.lastErr = ""
+			if err != nil {
+				d.lastErr = err.Error()
+			}
+			d.mu.Unlock()
+			time.Sleep(dockerRefresh)
+		}
+	}()
+}
+
+// refresh replaces the containers with the ones running now
+func (d *DockerContainers) refresh() error {
+	resp, err := d.client.Get("http://docker/containers/json")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", d.socket, resp.Status)
+	}
+	var containers []struct {
+		ID     string   `json:"Id"`
+		Names  []string `json:"Names"`
+		Labels map[string]string
+		Ports  []struct {
+			PublicPort uint16
+			Type       string
+		}
+		NetworkSettings struct {
+			Networks map[string]struct {
+				IPAddress         string
+				GlobalIPv6Address string
+			}
+		}
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&containers); err != nil {
+		return err
+	}
+
+	byIP := make(map[string]string)
+	byPort := make(map[string]string)
+	byID := make(map[string]string)
+	for _, c := range containers {
+		// Compose names containers "<project>-<service>-1"; the service is what people call it
+		name := c.Labels["com.docker.compose.service"]
+		if name == "" && len(c.Names) > 0 {
+			name = strings.TrimPrefix(c.Names[0], "/")
+		}
+		if name == "" {
+			name = c.ID[:min(12, len(c.ID))]
+		}
+		byID[c.ID] = name
+		for _, n := range c.NetworkSettings.Networks {
+			for _, ip := range []string{n.IPAddress, n.GlobalIPv6Address} {
+				if ip != "" {
+					byIP[ip] = name
+				}
+			}
+		}
+		for _, p := range c.Ports {
+			if p.PublicPort != 0 {
+				byPort[strings.ToLower(p.Type)+"/"+strconv.Itoa(int(p.PublicPort))] = name
+			}
+		}
+	}
+
+	d.mu.Lock()
+	d.byIP, d.byPort, d.byID = byIP, byPort, byID
+	d.byPID = make(map[int32]string)
+	d.mu.Unlock()
+	return nil
+}
+
+// ForIP returns the name of the container with an address, or ""
+func (d *DockerContainers) ForIP(ip string) string {
+	if d == nil {
+		return ""
+	}
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.byIP[ip]
+}
+
+// ForPort returns the name of the container a TCP or UDP port on the Pi is published
+// for, or ""
+func (d *DockerContainers) ForPort(protocol string, port uint16) string {
+	if d == nil {
+		return ""
+	}
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.byPort[strings.ToLower(protocol)+"/"+strconv.Itoa(int(port))]
+}
+
+// ForPID returns the name of the container a process runs in, or ""
+func (d *DockerContainers) ForPID(pid int32) string {
+	if d == nil || pid <= 0 {
+		return ""
+	}
+	d.mu.RLock()
+	name, ok := d.byPID[pid]
+	d.mu.RUnlock()
+	if ok {
+		return name
+	}
+
+	cgroup, _ := os.ReadFile(fmt.Sprintf("/proc/%d/cgroup", pid))
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, id := range dockerIDPattern.FindAllString(string(cgroup), -1) {
+		if n, ok := d.byID[id]; ok {
+			name = n
+			break
+		}
+	}
+	d.byPID[pid] = name
+	return name
+}
+
+// Status reports the containers known and the last error listing them, for /api/enrichment
+func (d *DockerContainers) Status() map[string]interface{} {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	status := map[string]interface{}{"socket": d.socket, "containers": len(d.byID)}
+	if d.lastErr != "" {
+		status["error"] = d.lastErr
+	}
+	return status
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"mime"
+	"net"
+	"net/smtp"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+const defaultEmailSubject = `[pi-track] {{.Severity}}: {{.Rule}} {{.State}}`
+
+const defaultEmailBody = `{{.Message}}
+
+Rule:     {{.Rule}}
+Subject:  {{.Subject}}
+Severity: {{.Severity}}
+State:    {{.State}}
+Started:  {{.StartedAt.Format "2006-01-02 15:04:05"}}
+{{- with .ResolvedAt}}
+Resolved: {{.Format "2006-01-02 15:04:05"}}{{end}}
+{{- if .Suppressed}}
+
+{{.Suppressed}} earlier notification(s) were suppressed by rate limiting.{{end}}
+
+--
+pi-track on {{.Host}}
+`
+
+// SMTPConfig configures the email notifier
+type SMTPConfig struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	From     string
+	To       []string
+
+	SubjectTemplate string // text/template over emailData; defaults to defaultEmailSubject
+	BodyTemplate    string // text/template over emailData; defaults to defaultEmailBody
+
+	MaxPerHour int           // Cap on alert emails per hour, 0 for no cap
+	Cooldown   time.Duration // Minimum gap between emails about the same rule and subject
+}
+
+// emailData is what subject and body templates are executed against
+type emailData struct {
+	Alert
+	Host       string
+	Suppressed int
+}
+
+// EmailNotifier sends alerts and weekly reports by email. Alert emails are rate
+// limited so a flapping rule can't flood the inbox; suppressed notifications are
+// counted and mentioned in the next email that goes out.
+type EmailNotifier struct {
+	cfg     SMTPConfig
+	subject *template.Template
+	body    *template.Template
+
+	mu         sync.Mutex
+	sent       []time.Time
+	lastSent   map[alertKey]time.Time
+	suppressed int
+}
+
+// NewEmailNotifier validates the configuration and parses the templates
+func NewEmailNotifier(cfg SMTPConfig) (*EmailNotifier, error) {
+	if cfg.Host == "" || cfg.From == "" || len(cfg.To) == 0 {
+		return nil, fmt.Errorf("email needs an SMTP host, a from address and at least one recipient")
+	}
+	if cfg.SubjectTemplate == "" {
+		cfg.SubjectTemplate = defaultEmailSubject
+	}
+	if cfg.BodyTemplate == "" {
+		cfg.BodyTemplate = defaultEmailBody
+	}
+
+	subject, err := template.New("subject").Parse(cfg.SubjectTemplate)
+	if err != nil {
+		return nil, fmt.Errorf("parsing email subject template: %v", err)
+	}
+	body, err := template.New("body").Parse(cfg.BodyTemplate)
+	if err != nil {
+		return nil, fmt.Errorf("parsing email body template: %v", err)
+	}
+
+	return &EmailNotifier{
+		cfg:      cfg,
+		subject:  subject,
+		body:     body,
+		lastSent: make(map[alertKey]time.Time),
+	}, nil
+}
+
+// Name implements AlertNotifier
+func (en *EmailNotifier) Name() string {
+	return "email"
+}
+
+// allow applies the rate limits, returning how many notifications were suppressed
+// since the last email when this one may be sent
+func (en *EmailNotifier) allow(a Alert) (bool, int) {
+	en.mu.Lock()
+	defer en.mu.Unlock()
+
+	now := time.Now()
+	key := keyFor(a)
+
+	// Resolutions are always let through for alerts whose firing email went out,
+	// otherwise the inbox would show a problem that never ends
+	cooling := en.cfg.Cooldown > 0 && now.Sub(en.lastSent[key]) < en.cfg.Cooldown
+	if a.State == alertStateFiring && cooling {
+		en.suppressed++
+		return false, 0
+	}
+
+	cutoff := now.Add(-time.Hour)
+	for len(en.sent) > 0 && en.sent[0].Before(cutoff) {
+		en.sent = en.sent[1:]
+	}
+	if en.cfg.MaxPerHour > 0 && len(en.sent) >= en.cfg.MaxPerHour {
+		en.suppressed++
+		return false, 0
+	}
+
+	en.sent = append(en.sent, now)
+	if a.State == alertStateFiring {
+		en.lastSent[key] = now
+	}
+	suppressed := en.suppressed
+	en.suppressed = 0
+	return true, suppressed
+}
+
+// Notify implements AlertNotifier
+func (en *EmailNotifier) Notify(a Alert) error {
+	ok, suppressed := en.allow(a)
+	if !ok {
+		return nil
+	}
+
+	hostname, _ := os.Hostname()
+	data := emailData{Alert: a, Host: hostname, Suppressed: suppressed}
+
+	var subject, body bytes.Buffer
+	if err := en.subject.Execute(&subject, data); err != nil {
+		return fmt.Errorf("rendering subject: %v", err)
+	}
+	if err := en.body.Execute(&body, data); err != nil {
+		return fmt.Errorf("rendering body: %v", err)
+	}
+
+	return en.send(subject.String(), "text/plain", body.Bytes())
+}
+
+// SendReport emails a weekly report as HTML. Reports are not rate limited.
+func (en *EmailNotifier) SendReport(r *Report) error {
+	page, err := r.RenderHTML()
+	if err != nil {
+		return err
+	}
+	subject := fmt.Sprintf("[pi-track] Weekly report %s: %s", r.ID, formatBytes(r.TotalBytes))
+	return en.send(subject, "text/html", page)
+}
+
+// send delivers one message to every recipient
+func (en *EmailNotifier) send(subject, contentType string, body []byte) error {
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", en.cfg.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(en.cfg.To, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", strings.TrimSpace(subject)))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&msg, "Content-Type: %s; charset=utf-8\r\n", contentType)
+	fmt.Fprintf(&msg, "Content-Transfer-Encoding: 8bit\r\n\r\n")
+	msg.Write(bytes.ReplaceAll(bytes.ReplaceAll(body, []byte("\r\n"), []byte("\n")), []byte("\n"), []byte("\r\n")))
+
+	addr := net.JoinHostPort(en.cfg.Host, strconv.Itoa(en.cfg.Port))
+	var auth smtp.Auth
+	if en.cfg.Username != "" {
+		auth = smtp.PlainAuth("", en.cfg.Username, en.cfg.Password, en.cfg.Host)
+	}
+
+	// Port 465 speaks TLS from the start; anything else upgrades with STARTTLS when offered
+	if en.cfg.Port != 465 {
+		return smtp.SendMail(addr, auth, en.cfg.From, en.cfg.To, msg.Bytes())
+	}
+
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: 30 * time.Second}, "tcp", addr, &tls.Config{ServerName: en.cfg.Host})
+	if err != nil {
+		return err
+	}
+	client, err := smtp.NewClient(conn, en.cfg.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	if auth != nil {
+		if err := client.Auth(auth); err != nil {
+			return err
+		}
+	}
+	if err := client.Mail(en.cfg.From); err != nil {
+		return err
+	}
+	for _, to := range en.cfg.To {
+		if err := client.Rcpt(to); err != nil {
+			return err
+		}
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg.Bytes()); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+// loadEmailTemplate returns the contents of a template file, or "" when no path is given
+func loadEmailTemplate(path string) string {
+	if path == "" {
+		return ""
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		log.Printf("Warning: failed to read email template %s, using the default: %v", path, err)
+		return ""
+	}
+	return string(data)
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+)
+
+// Enricher is a source of what's known about addresses: hostnames, locations, ASNs or
+// labels. Providers are chained with -enrichers and asked in order about each address the
+// first time it's seen. Each fills in only what the providers before it left empty, so
+// earlier ones take precedence. A provider that needs time, like a DNS or web lookup,
+// queues the address in Enrich and merges its answer into the cache with updateIPInfo
+// once it arrives.
+type Enricher interface {
+	Enrich(ip net.IP, info *IPInfo)
+}
+
+// enrichRetrier is a provider asked again each time an address without a hostname is
+// seen. It decides itself whether enough time has passed to really look again.
+type enrichRetrier interface {
+	Retry(ip string)
+}
+
+// enricherProviders builds each provider by name. A provider kept in its own file adds
+// itself from an init function with RegisterEnricher.
+var enricherProviders = map[string]func() (Enricher, error){
+	"labels": func() (Enricher, error) { return labelEnricher{}, nil },
+	"mmdb": func() (Enricher, error) {
+		if geoCityDB == nil {
+			return nil, fmt.Errorf("mmdb needs -geoip-city-db")
+		}
+		return mmdbEnricher{geoCityDB}, nil
+	},
+	"rdns":  func() (Enricher, error) { return rdnsEnricher{}, nil },
+	"ipapi": func() (Enricher, error) { return ipAPIEnricher{}, nil },
+}
+
+// RegisterEnricher adds a provider that -enrichers can name. build runs once flags are
+// parsed and may fail if the provider isn't configured.
+func RegisterEnricher(name string, build func() (Enricher, error)) {
+	enricherProviders[name] = build
+}
+
+// enrichers is the chain addresses are resolved with, set up by main from -enrichers
+var enrichers = EnricherChain{
+	{"labels", labelEnricher{}},
+	{"rdns", rdnsEnricher{}},
+	{"ipapi", ipAPIEnricher{}},
+}
+
+// EnricherChain is the providers in the order they're asked
+type EnricherChain []namedEnricher
+
+type namedEnricher struct {
+	name string
+	Enricher
+}
+
+// defaultEnrichers is the chain used without -enrichers: a city database replaces
+// ip-api.com, so addresses aren't sent anywhere
+func defaultEnrichers(cityDB bool) string {
+	if cityDB {
+		return "labels,mmdb,rdns"
+	}
+	return "labels,rdns,ipapi"
+}
+
+// NewEnricherChain builds the chain from a comma-separated list of provider names
+func NewEnricherChain(list string) (EnricherChain, error) {
+	chain := EnricherChain{}
+	seen := make(map[string]bool)
+	for _, name := range strings.Split(list, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" || seen[name] {
+			continue
+		}
+		build, ok := enricherProviders[name]
+		if !ok {
+			names := make([]string, 0, len(enricherProviders))
+			for n := range enricherProviders {
+				names = append(names, n)
+			}
+			sort.Strings(names)
+			return nil, fmt.Errorf("unknown provider %q (expected %s)", name, strings.Join(names, ", "))
+		}
+		e, err := build()
+		if err != nil {
+			return nil, err
+		}
+		seen[name] = true
+		chain = append(chain, namedEnricher{name, e})
+	}
+	return chain, nil
+}
+
+// Names returns the providers in order, for /api/enrichment
+func (c EnricherChain) Names() []string {
+	names := make([]string, len(c))
+	for i, e := range c {
+		names[i] = e.name
+	}
+	return names
+}
+
+// Enrich asks every provider about an address
+func (c EnricherChain) Enrich(ip net.IP, info *IPInfo) {
+	for _, e := range c {
+		e.Enrich(ip, info)
+	}
+}
+
+// Retry asks the providers that look again about an address without a hostname
+func (c EnricherChain) Retry(ip string) {
+	for _, e := range c {
+		if r, ok := e.Enricher.(enrichRetrier); ok {
+			r.Retry(ip)
+		}
+	}
+}
+
+// mergeIPInfo fills in what info is missing from found
+func mergeIPInfo(info *IPInfo, found IPInfo) {
+	if info.Hostname == "" {
+		info.Hostname = found.Hostname
+	}
+	if info.Country == "" {
+		info.Country = found.Country
+	}
+	if info.City == "" {
+		info.City = found.City
+	}
+	if info.Lat == 0 && info.Lon == 0 {
+		info.Lat, info.Lon = found.Lat, found.Lon
+	}
+	if info.ASN == "" {
+		info.ASN = found.ASN
+	}
+}
+
+// labelEnricher names labelled addresses, so they aren't looked up in DNS
+type labelEnricher struct{}
+
+func (labelEnricher) Enrich(ip net.IP, info *IPInfo) {
+	if info.Hostname == "" {
+		info.Hostname = ipLabels.Label(ip.String())
+	}
+}
+
+// mmdbEnricher locates addresses in a city or country database
+type mmdbEnricher struct {
+	db *GeoCityDB
+}
+
+func (e mmdbEnricher) Enrich(ip net.IP, info *IPInfo) {
+	if info.Country != "" {
+		return
+	}
+	if located, ok := e.db.Locate(ip); ok {
+		mergeIPInfo(info, located)
+	}
+}
+
+// rdnsEnricher queues addresses for reverse DNS
+type rdnsEnricher struct{}
+
+func (rdnsEnricher) Enrich(ip net.IP, info *IPInfo) {
+	if info.Hostname == "" {
+		rdnsLookups.Enqueue(ip.String())
+	}
+}
+
+// Retry asks again once an earlier lookup that found no name has expired
+func (rdnsEnricher) Retry(ip string) {
+	rdnsLookups.Enqueue(ip)
+}
+
+// ipAPIEnricher queues addresses not located yet for ip-api.com
+type ipAPIEnricher struct{}
+
+func (ipAPIEnricher) Enrich(ip net.IP, info *IPInfo) {
+	if info.Country == "" {
+		geoLookups.Enqueue(ip.String())
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Executable hashing settings
+const (
+	exeHashQueue      = 64      // Binaries waiting to be hashed; more are asked for again later
+	exeHashMaxEntries = 10000   // Hashes remembered; the cache is cleared when full
+	exeHashMaxSize    = 1 << 30 // Larger files aren't hashed
+)
+
+// exeHashKey identifies one version of a binary: replacing the file, as an upgrade does,
+// changes its size or modification time
+type exeHashKey struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+// ExeHasher works out the SHA-256 of process executables in the background, since
+// reading a large binary on a Pi takes too long to hold up a packet. The file is read
+// through /proc/<pid>/exe, so it's the binary actually running, even if it has since
+// been replaced or deleted. A hash is "" until it's ready.
+type ExeHasher struct {
+	queue chan exeHashJob
+
+	mu      sync.Mutex
+	hashes  map[exeHashKey]string
+	pending map[exeHashKey]bool
+	failed  bool // A hash failed, so further failures aren't logged
+}
+
+type exeHashJob struct {
+	key  exeHashKey
+	file string // /proc/<pid>/exe
+}
+
+// NewExeHasher creates a hasher and starts its worker
+func NewExeHasher() *ExeHasher {
+	h := &ExeHasher{
+		queue:   make(chan exeHashJob, exeHashQueue),
+		hashes:  make(map[exeHashKey]string),
+		pending: make(map[exeHashKey]bool),
+	}
+	go h.run()
+	return h
+}
+
+// Hash returns the hex SHA-256 of a process's executable, or "" if it isn't known yet, in
+// which case it's queued
+func (h *ExeHasher) Hash(pid int32, exe string) string {
+	if h == nil || pid <= 0 || exe == "" {
+		return ""
+	}
+	file := fmt.Sprintf("/proc/%d/exe", pid)
+	info, err := os.Stat(file)
+	if err != nil || !info.Mode().IsRegular() || info.Size() > exeHashMaxSize {
+		return ""
+	}
+	key := exeHashKey{exe, info.Size(), info.ModTime()}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if sum, ok := h.hashes[key]; ok {
+		return sum
+	}
+	if !h.pending[key] {
+		select {
+		case h.queue <- exeHashJob{key, file}:
+			h.pending[key] = true
+		default:
+		}
+	}
+	return ""
+}
+
+func (h *ExeHasher) run() {
+	for job := range h.queue {
+		sum, err := hashFile(job.file)
+
+		h.mu.Lock()
+		delete(h.pending, job.key)
+		if err != nil {
+			// The process may have exited; another of its packets asks again
+			if !h.failed {
+				log.Printf("Warning: failed to hash %s: %v", job.key.path, err)
+				h.failed = true
+			}
+		} else {
+			if len(h.hashes) >= exeHashMaxEntries {
+				h.hashes = make(map[exeHashKey]string)
+			}
+			h.hashes[job.key] = sum
+		}
+		h.mu.Unlock()
+	}
+}
+
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	sum := sha256.New()
+	if _, err := io.Copy(sum, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(sum.Sum(nil)), nil
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+)
+
+// exportFlushRows is how many rows are written between flushes to the client
+const exportFlushRows = 1000
+
+// parquetRowGroupRows is how many rows make up a Parquet row group. The writer holds
+// a row group in memory until it is complete.
+const parquetRowGroupRows = 100000
+
+// packetCSVHeader names the columns of a packet CSV export
+var packetCSVHeader = []string{
+	"id", "timestamp", "src_ip", "dst_ip", "src_port", "dst_port", "protocol", "length", "info",
+	"src_mac", "dst_mac", "application", "src_hostname", "dst_hostname", "src_country", "dst_country", "process_name",
+	"interface",
+}
+
+// packetCSVRecord renders a packet as a CSV row matching packetCSVHeader
+func packetCSVRecord(p Packet) []string {
+	return []string{
+		strconv.FormatInt(p.ID, 10),
+		p.Timestamp.Format(time.RFC3339Nano),
+		p.SrcIP,
+		p.DstIP,
+		strconv.Itoa(int(p.SrcPort)),
+		strconv.Itoa(int(p.DstPort)),
+		p.Protocol,
+		strconv.Itoa(p.Length),
+		p.Info,
+		p.SrcMAC,
+		p.DstMAC,
+		p.Application,
+		p.SrcHostname,
+		p.DstHostname,
+		p.SrcCountry,
+		p.DstCountry,
+		p.ProcessName,
+		p.Interface,
+	}
+}
+
+// packetParquetRow is a packet as stored in a Parquet export. Repetitive columns are
+// dictionary encoded, and everything is zstd compressed.
+type packetParquetRow struct {
+	ID          int64     `parquet:"id"`
+	Timestamp   time.Time `parquet:"timestamp,timestamp(microsecond)"`
+	SrcIP       string    `parquet:"src_ip,dict"`
+	DstIP       string    `parquet:"dst_ip,dict"`
+	SrcPort     int32     `parquet:"src_port"`
+	DstPort     int32     `parquet:"dst_port"`
+	Protocol    string    `parquet:"protocol,dict"`
+	Length      int32     `parquet:"length"`
+	Info        string    `parquet:"info"`
+	SrcMAC      string    `parquet:"src_mac,dict"`
+	DstMAC      string    `parquet:"dst_mac,dict"`
+	Application string    `parquet:"application,dict"`
+	SrcHostname string    `parquet:"src_hostname,dict"`
+	DstHostname string    `parquet:"dst_hostname,dict"`
+	SrcCountry  string    `parquet:"src_country,dict"`
+	DstCountry  string    `parquet:"dst_country,dict"`
+	ProcessName string    `parquet:"process_name,dict"`
+	Interface   string    `parquet:"interface,dict"`
+}
+
+// PacketExport describes which stored packets to export
+type PacketExport struct {
+	Filter     string
+	Query      *DisplayFilter
+	Country    string
+	Interface  string
+	ExcludeIPs []string
+	StartTime  *time.Time
+	EndTime    *time.Time
+}
+
+// exportPacketsCSV streams matching packets to w as CSV, oldest first. Rows are flushed as
+// they go, so exports of any size use constant memory. Once the first row is out the status
+// can't change, so a failure part way through just ends the download early.
+func exportPacketsCSV(w http.ResponseWriter, db *Database, q PacketExport) error {
+	filename := fmt.Sprintf("pitrack-packets-%s.csv", time.Now().Format("20060102-150405"))
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	return writePacketsCSV(w, db, q)
+}
+
+// writePacketsCSV writes matching packets to w as CSV, oldest first, flushing w every
+// exportFlushRows if it's an http.Flusher
+func writePacketsCSV(w io.Writer, db *Database, q PacketExport) error {
+	flusher, _ := w.(http.Flusher)
+	out := csv.NewWriter(w)
+	if err := out.Write(packetCSVHeader); err != nil {
+		return err
+	}
+
+	rows := 0
+	err := db.StreamPackets(q.Filter, q.Query, q.Country, q.Interface, q.ExcludeIPs, q.StartTime, q.EndTime, func(p Packet) error {
+		if err := out.Write(packetCSVRecord(p)); err != nil {
+			return err
+		}
+		rows++
+		if rows%exportFlushRows == 0 {
+			out.Flush()
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		return out.Error()
+	})
+	out.Flush()
+	if err != nil {
+		return err
+	}
+	return out.Error()
+}
+
+// packetJSONStream writes packets to a response as they are read, as the elements of a
+// JSON array or as NDJSON (one object per line), flushing every exportFlushRows
+type packetJSONStream struct {
+	w       io.Writer
+	flusher http.Flusher
+	ndjson  bool
+	rows    int
+}
+
+func newPacketJSONStream(w io.Writer, ndjson bool) *packetJSONStream {
+	flusher, _ := w.(http.Flusher)
+	return &packetJSONStream{w: w, flusher: flusher, ndjson: ndjson}
+}
+
+// Write implements the callback of Database.QueryPackets and Database.StreamPackets
+func (s *packetJSONStream) Write(p Packet) error {
+	data, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	if s.ndjson {
+		data = append(data, '\n')
+	} else if s.rows > 0 {
+		data = append([]byte{','}, data...)
+	}
+	if _, err := s.w.Write(data); err != nil {
+		return err
+	}
+	s.rows++
+	if s.rows%exportFlushRows == 0 && s.flusher != nil {
+		s.flusher.Flush()
+	}
+	return nil
+}
+
+// exportPacketsNDJSON streams matching packets to w as NDJSON, oldest first, in the same
+// form as /api/history. Like CSV exports, it uses constant memory whatever the size.
+func exportPacketsNDJSON(w http.ResponseWriter, db *Database, q PacketExport) error {
+	filename := fmt.Sprintf("pitrack-packets-%s.ndjson", time.Now().Format("20060102-150405"))
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+
+	return db.StreamPackets(q.Filter, q.Query, q.Country, q.Interface, q.ExcludeIPs, q.StartTime, q.EndTime, newPacketJSONStream(w, true).Write)
+}
+
+// exportPacketsParquet streams matching packets to w as a Parquet file, for loading into
+// DuckDB, Pandas and the like. Memory use is bounded by the row group size.
+func exportPacketsParquet(w http.ResponseWriter, db *Database, q PacketExport) error {
+	filename := fmt.Sprintf("pitrack-packets-%s.parquet", time.Now().Format("20060102-150405"))
+	w.Header().Set("Content-Type", "application/vnd.apache.parquet")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	return writePacketsParquet(w, db, q)
+}
+
+// writePacketsParquet writes matching packets to w as a Parquet file, flushing w after
+// each row group if it's an http.Flusher
+func writePacketsParquet(w io.Writer, db *Database, q PacketExport) error {
+	flusher, _ := w.(http.Flusher)
+	out := parquet.NewGenericWriter[packetParquetRow](w, parquet.Compression(&parquet.Zstd))
+	batch := make([]packetParquetRow, 0, exportFlushRows)
+	rows := 0
+	write := func() error {
+		if _, err := out.Write(batch); err != nil {
+			return err
+		}
+		batch = batch[:0]
+		return nil
+	}
+
+	err := db.StreamPackets(q.Filter, q.Query, q.Country, q.Interface, q.ExcludeIPs, q.StartTime, q.EndTime, func(p Packet) error {
+		batch = append(batch, packetParquetRow{
+			ID:          p.ID,
+			Timestamp:   p.Timestamp,
+			SrcIP:       p.SrcIP,
+			DstIP:       p.DstIP,
+			SrcPort:     int32(p.SrcPort),
+			DstPort:     int32(p.DstPort),
+			Protocol:    p.Protocol,
+			Length:      int32(p.Length),
+			Info:        p.Info,
+			SrcMAC:      p.SrcMAC,
+			DstMAC:      p.DstMAC,
+			Application: p.Application,
+			SrcHostname: p.SrcHostname,
+			DstHostname: p.DstHostname,
+			SrcCountry:  p.SrcCountry,
+			DstCountry:  p.DstCountry,
+			ProcessName: p.ProcessName,
+			Interface:   p.Interface,
+		})
+		rows++
+		if len(batch) == cap(batch) {
+			if err := write(); err != nil {
+				return err
+			}
+		}
+		if rows%parquetRowGroupRows == 0 {
+			if err := out.Flush(); err != nil {
+				return err
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := write(); err != nil {
+		return err
+	}
+	return out.Close()
+}
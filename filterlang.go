@@ -0,0 +1,670 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxFilterLength caps display filters, which clients can also send over the WebSocket
+const maxFilterLength = 2048
+
+// DisplayFilter is a compiled Wireshark-style display filter, e.g.
+// ip == 192.168.1.5 && app == "HTTPS" && bytes > 1000. It is matched against packets in
+// memory and translated to SQL for stored packets, with the same results either way.
+type DisplayFilter struct {
+	text string
+	root filterNode
+}
+
+// Kinds of filter fields, which decide the operators and values a field takes
+type filterKind int
+
+const (
+	filterText filterKind = iota
+	filterIP
+	filterMAC
+	filterNumber
+	filterTime
+)
+
+// filterField is a packet property a filter can test. Fields covering both ends of a
+// packet, like ip, match when either end does.
+type filterField struct {
+	kind    filterKind
+	columns []string                  // One column per end
+	text    func(p *Packet) []string  // Text, IP and MAC fields, one value per end
+	number  func(p *Packet) []int64   // Number fields
+	time    func(p *Packet) time.Time // The time field
+}
+
+var (
+	filterIPField        = &filterField{kind: filterIP, columns: []string{"src_ip", "dst_ip"}, text: func(p *Packet) []string { return []string{p.SrcIP, p.DstIP} }}
+	filterSrcIPField     = &filterField{kind: filterIP, columns: []string{"src_ip"}, text: func(p *Packet) []string { return []string{p.SrcIP} }}
+	filterDstIPField     = &filterField{kind: filterIP, columns: []string{"dst_ip"}, text: func(p *Packet) []string { return []string{p.DstIP} }}
+	filterPortField      = &filterField{kind: filterNumber, columns: []string{"src_port", "dst_port"}, number: func(p *Packet) []int64 { return []int64{int64(p.SrcPort), int64(p.DstPort)} }}
+	filterSrcPortField   = &filterField{kind: filterNumber, columns: []string{"src_port"}, number: func(p *Packet) []int64 { return []int64{int64(p.SrcPort)} }}
+	filterDstPortField   = &filterField{kind: filterNumber, columns: []string{"dst_port"}, number: func(p *Packet) []int64 { return []int64{int64(p.DstPort)} }}
+	filterMACField       = &filterField{kind: filterMAC, columns: []string{"src_mac", "dst_mac"}, text: func(p *Packet) []string { return []string{p.SrcMAC, p.DstMAC} }}
+	filterSrcMACField    = &filterField{kind: filterMAC, columns: []string{"src_mac"}, text: func(p *Packet) []string { return []string{p.SrcMAC} }}
+	filterDstMACField    = &filterField{kind: filterMAC, columns: []string{"dst_mac"}, text: func(p *Packet) []string { return []string{p.DstMAC} }}
+	filterHostField      = &filterField{kind: filterText, columns: []string{"src_hostname", "dst_hostname"}, text: func(p *Packet) []string { return []string{p.SrcHostname, p.DstHostname} }}
+	filterSrcHostField   = &filterField{kind: filterText, columns: []string{"src_hostname"}, text: func(p *Packet) []string { return []string{p.SrcHostname} }}
+	filterDstHostField   = &filterField{kind: filterText, columns: []string{"dst_hostname"}, text: func(p *Packet) []string { return []string{p.DstHostname} }}
+	filterCountryField   = &filterField{kind: filterText, columns: []string{"src_country", "dst_country"}, text: func(p *Packet) []string { return []string{p.SrcCountry, p.DstCountry} }}
+	filterSrcCountry     = &filterField{kind: filterText, columns: []string{"src_country"}, text: func(p *Packet) []string { return []string{p.SrcCountry} }}
+	filterDstCountry     = &filterField{kind: filterText, columns: []string{"dst_country"}, text: func(p *Packet) []string { return []string{p.DstCountry} }}
+	filterProtocolField  = &filterField{kind: filterText, columns: []string{"protocol"}, text: func(p *Packet) []string { return []string{p.Protocol} }}
+	filterAppField       = &filterField{kind: filterText, columns: []string{"application"}, text: func(p *Packet) []string { return []string{p.Application} }}
+	filterLengthField    = &filterField{kind: filterNumber, columns: []string{"length"}, number: func(p *Packet) []int64 { return []int64{int64(p.Length)} }}
+	filterInfoField      = &filterField{kind: filterText, columns: []string{"info"}, text: func(p *Packet) []string { return []string{p.Info} }}
+	filterProcessField   = &filterField{kind: filterText, columns: []string{"process_name"}, text: func(p *Packet) []string { return []string{p.ProcessName} }}
+	filterUserField      = &filterField{kind: filterText, columns: []string{"process_user"}, text: func(p *Packet) []string { return []string{p.ProcessUser} }}
+	filterUnitField      = &filterField{kind: filterText, columns: []string{"process_unit"}, text: func(p *Packet) []string { return []string{p.ProcessUnit} }}
+	filterInterfaceField = &filterField{kind: filterText, columns: []string{"interface"}, text: func(p *Packet) []string { return []string{p.Interface} }}
+	filterTimeField      = &filterField{kind: filterTime, columns: []string{"timestamp"}, time: func(p *Packet) time.Time { return p.Timestamp }}
+)
+
+// filterFields are the field names a filter can use, with their Wireshark-like aliases
+var filterFields = map[string]*filterField{
+	"ip": filterIPField, "ip.addr": filterIPField,
+	"ip.src": filterSrcIPField, "src": filterSrcIPField,
+	"ip.dst": filterDstIPField, "dst": filterDstIPField,
+	"port":     filterPortField,
+	"port.src": filterSrcPortField, "srcport": filterSrcPortField,
+	"port.dst": filterDstPortField, "dstport": filterDstPortField,
+	"mac": filterMACField, "eth.addr": filterMACField,
+	"mac.src": filterSrcMACField, "eth.src": filterSrcMACField,
+	"mac.dst": filterDstMACField, "eth.dst": filterDstMACField,
+	"host": filterHostField, "hostname": filterHostField,
+	"host.src": filterSrcHostField, "host.dst": filterDstHostField,
+	"country": filterCountryField, "country.src": filterSrcCountry, "country.dst": filterDstCountry,
+	"proto": filterProtocolField, "protocol": filterProtocolField,
+	"app": filterAppField, "application": filterAppField,
+	"bytes": filterLengthField, "len": filterLengthField, "length": filterLengthField,
+	"info":    filterInfoField,
+	"process": filterProcessField,
+	"user":    filterUserField,
+	"unit":    filterUnitField,
+	"iface":   filterInterfaceField, "interface": filterInterfaceField,
+	"time": filterTimeField,
+}
+
+// filterProtocols can be written on their own, as in Wireshark: tcp is protocol == "TCP"
+var filterProtocols = map[string]string{"tcp": "TCP", "udp": "UDP", "icmp": "ICMP", "arp": "ARP"}
+
+// filterOperators maps every spelling of a comparison to its canonical form
+var filterOperators = map[string]string{
+	"==": "==", "=": "==", "eq": "==",
+	"!=": "!=", "ne": "!=",
+	">": ">", "gt": ">",
+	"<": "<", "lt": "<",
+	">=": ">=", "ge": ">=",
+	"<=": "<=", "le": "<=",
+	"contains": "contains",
+	"in":       "in",
+}
+
+// ParseDisplayFilter compiles a filter expression. Comparisons (==, !=, >, <, >=, <=,
+// contains and in {...}) are combined with && (and), || (or), ! (not) and parentheses.
+func ParseDisplayFilter(s string) (*DisplayFilter, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil, fmt.Errorf("empty filter")
+	}
+	if len(s) > maxFilterLength {
+		return nil, fmt.Errorf("filter is longer than %d characters", maxFilterLength)
+	}
+	tokens, err := lexFilter(s)
+	if err != nil {
+		return nil, err
+	}
+	p := &filterParser{tokens: tokens}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokenEOF {
+		return nil, fmt.Errorf("unexpected %s at column %d", t, t.pos+1)
+	}
+	return &DisplayFilter{text: s, root: root}, nil
+}
+
+// parseDisplayFilterParam reads the q parameter, returning nil when there is none. Filters
+// for stored packets must also translate to SQL.
+func parseDisplayFilterParam(v url.Values, stored bool) (*DisplayFilter, error) {
+	s := v.Get("q")
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	f, err := ParseDisplayFilter(s)
+	if err == nil && stored {
+		_, _, err = f.SQL()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid q: %v", err)
+	}
+	return f, nil
+}
+
+// String returns the filter as written
+func (f *DisplayFilter) String() string {
+	return f.text
+}
+
+// Match reports whether a packet passes the filter
+func (f *DisplayFilter) Match(p *Packet) bool {
+	return f.root.match(p)
+}
+
+// SQL returns the filter as a condition on the packets table with its arguments. IPv6
+// ranges can't be expressed on the stored text addresses and return an error.
+func (f *DisplayFilter) SQL() (string, []interface{}, error) {
+	return f.root.sql()
+}
+
+// filterNode is one node of a parsed filter
+type filterNode interface {
+	match(p *Packet) bool
+	sql() (string, []interface{}, error)
+}
+
+type filterAnd struct{ left, right filterNode }
+type filterOr struct{ left, right filterNode }
+type filterNot struct{ node filterNode }
+
+func (n filterAnd) match(p *Packet) bool { return n.left.match(p) && n.right.match(p) }
+func (n filterOr) match(p *Packet) bool  { return n.left.match(p) || n.right.match(p) }
+func (n filterNot) match(p *Packet) bool { return !n.node.match(p) }
+
+func (n filterAnd) sql() (string, []interface{}, error) { return joinFilterSQL(n.left, n.right, "AND") }
+func (n filterOr) sql() (string, []interface{}, error)  { return joinFilterSQL(n.left, n.right, "OR") }
+
+func (n filterNot) sql() (string, []interface{}, error) {
+	cond, args, err := n.node.sql()
+	// A comparison with a NULL column is NULL, which NOT leaves NULL; count it as false
+	// first so the negation matches what Match does
+	return "NOT COALESCE(" + cond + ", 0)", args, err
+}
+
+func joinFilterSQL(left, right filterNode, op string) (string, []interface{}, error) {
+	l, largs, err := left.sql()
+	if err != nil {
+		return "", nil, err
+	}
+	r, rargs, err := right.sql()
+	if err != nil {
+		return "", nil, err
+	}
+	return "(" + l + " " + op + " " + r + ")", append(largs, rargs...), nil
+}
+
+// filterValue is a comparison value, parsed for the field's kind
+type filterValue struct {
+	text    string     // Text fields, lower case; MAC addresses, normalized
+	number  int64      // Number fields
+	network *net.IPNet // IP fields: an address or range
+	time    time.Time  // The time field
+}
+
+// filterCompare tests a field against one value, or several for in
+type filterCompare struct {
+	field  *filterField
+	op     string
+	values []filterValue
+}
+
+func (c filterCompare) match(p *Packet) bool {
+	if c.op == "!=" {
+		// True when no end is equal, so ip != x is the same as !(ip == x)
+		return !filterCompare{field: c.field, op: "==", values: c.values}.match(p)
+	}
+
+	f := c.field
+	switch f.kind {
+	case filterNumber:
+		for _, n := range f.number(p) {
+			for _, v := range c.values {
+				if compareInts(c.op, n, v.number) {
+					return true
+				}
+			}
+		}
+	case filterTime:
+		t := f.time(p)
+		return compareInts(c.op, t.UnixNano(), c.values[0].time.UnixNano())
+	default:
+		for _, s := range f.text(p) {
+			for _, v := range c.values {
+				switch {
+				case f.kind == filterIP:
+					if ip := net.ParseIP(s); ip != nil && v.network.Contains(ip) {
+						return true
+					}
+				case c.op == "contains":
+					if strings.Contains(strings.ToLower(s), v.text) {
+						return true
+					}
+				case strings.ToLower(s) == v.text:
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// compareInts applies an equality or ordering operator
+func compareInts(op string, a, b int64) bool {
+	switch op {
+	case "==", "in":
+		return a == b
+	case ">":
+		return a > b
+	case "<":
+		return a < b
+	case ">=":
+		return a >= b
+	case "<=":
+		return a <= b
+	}
+	return false
+}
+
+func (c filterCompare) sql() (string, []interface{}, error) {
+	if c.op == "!=" {
+		return filterNot{node: filterCompare{field: c.field, op: "==", values: c.values}}.sql()
+	}
+
+	var conds []string
+	var args []interface{}
+	for _, column := range c.field.columns {
+		for _, v := range c.values {
+			switch c.field.kind {
+			case filterNumber:
+				op := c.op
+				if op == "==" || op == "in" {
+					op = "="
+				}
+				conds = append(conds, "COALESCE("+column+", 0) "+op+" ?")
+				args = append(args, v.number)
+			case filterTime:
+				op := c.op
+				if op == "==" {
+					op = "="
+				}
+				conds = append(conds, column+" "+op+" ?")
+				args = append(args, v.time)
+			case filterIP:
+				cond, ipArgs, err := ipRangeSQL(column, v.network)
+				if err != nil {
+					return "", nil, err
+				}
+				conds = append(conds, cond)
+				args = append(args, ipArgs...)
+			case filterMAC:
+				conds = append(conds, column+" = ?")
+				args = append(args, v.text)
+			default:
+				if c.op == "contains" {
+					escaped := strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(v.text)
+					conds = append(conds, "COALESCE("+column+", '') LIKE ? ESCAPE '\\'")
+					args = append(args, "%"+escaped+"%")
+				} else {
+					conds = append(conds, "COALESCE("+column+", '') = ? COLLATE NOCASE")
+					args = append(args, v.text)
+				}
+			}
+		}
+	}
+	return "(" + strings.Join(conds, " OR ") + ")", args, nil
+}
+
+// ipRangeSQL matches a text address column against an address or range. IPv4 ranges
+// become LIKE prefixes of whole octets, or the addresses themselves when the range ends
+// inside the last octet, so at most 128 patterns are needed.
+func ipRangeSQL(column string, network *net.IPNet) (string, []interface{}, error) {
+	ones, bits := network.Mask.Size()
+	if ones == bits {
+		return column + " = ?", []interface{}{network.IP.String()}, nil
+	}
+	ip4 := network.IP.To4()
+	if ip4 == nil {
+		return "", nil, fmt.Errorf("IPv6 ranges like %s can't be searched in stored packets; use a full address", network)
+	}
+	if ones == 0 {
+		return column + " LIKE '%.%'", nil, nil
+	}
+
+	octets := (ones + 7) / 8
+	step := uint32(1) << (32 - 8*octets)
+	count := 1 << (8*octets - ones)
+	start := binary.BigEndian.Uint32(ip4)
+
+	var conds []string
+	var args []interface{}
+	for i := 0; i < count; i++ {
+		b := make([]byte, 4)
+		binary.BigEndian.PutUint32(b, start+uint32(i)*step)
+		if octets == 4 {
+			conds = append(conds, column+" = ?")
+			args = append(args, net.IP(b).String())
+			continue
+		}
+		parts := make([]string, octets)
+		for j := range parts {
+			parts[j] = strconv.Itoa(int(b[j]))
+		}
+		conds = append(conds, column+" LIKE ?")
+		args = append(args, strings.Join(parts, ".")+".%")
+	}
+	return "(" + strings.Join(conds, " OR ") + ")", args, nil
+}
+
+// filterExists is a field on its own, true when any end has a value, e.g. process
+type filterExists struct{ field *filterField }
+
+func (e filterExists) match(p *Packet) bool {
+	switch e.field.kind {
+	case filterNumber:
+		for _, n := range e.field.number(p) {
+			if n != 0 {
+				return true
+			}
+		}
+		return false
+	case filterTime:
+		return !e.field.time(p).IsZero()
+	}
+	for _, s := range e.field.text(p) {
+		if s != "" {
+			return true
+		}
+	}
+	return false
+}
+
+func (e filterExists) sql() (string, []interface{}, error) {
+	var conds []string
+	for _, column := range e.field.columns {
+		switch e.field.kind {
+		case filterNumber:
+			conds = append(conds, "COALESCE("+column+", 0) != 0")
+		case filterTime:
+			conds = append(conds, column+" IS NOT NULL")
+		default:
+			conds = append(conds, "COALESCE("+column+", '') != ''")
+		}
+	}
+	return "(" + strings.Join(conds, " OR ") + ")", nil, nil
+}
+
+// Filter tokens
+type filterTokenKind int
+
+const (
+	tokenEOF filterTokenKind = iota
+	tokenWord
+	tokenString
+	tokenSymbol
+)
+
+type filterToken struct {
+	kind filterTokenKind
+	text string
+	pos  int // Byte offset in the filter
+}
+
+func (t filterToken) String() string {
+	switch t.kind {
+	case tokenEOF:
+		return "end of filter"
+	case tokenString:
+		return strconv.Quote(t.text)
+	}
+	return fmt.Sprintf("%q", t.text)
+}
+
+// lexFilter splits a filter into words (field names, operators spelled out and unquoted
+// values), quoted strings and symbols
+func lexFilter(s string) ([]filterToken, error) {
+	var tokens []filterToken
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '"':
+			var sb strings.Builder
+			j := i + 1
+			for ; j < len(s) && s[j] != '"'; j++ {
+				if s[j] == '\\' && j+1 < len(s) {
+					j++
+				}
+				sb.WriteByte(s[j])
+			}
+			if j == len(s) {
+				return nil, fmt.Errorf("unterminated string at column %d", i+1)
+			}
+			tokens = append(tokens, filterToken{kind: tokenString, text: sb.String(), pos: i})
+			i = j + 1
+		case strings.HasPrefix(s[i:], "&&") || strings.HasPrefix(s[i:], "||") ||
+			strings.HasPrefix(s[i:], "==") || strings.HasPrefix(s[i:], "!=") ||
+			strings.HasPrefix(s[i:], ">=") || strings.HasPrefix(s[i:], "<="):
+			tokens = append(tokens, filterToken{kind: tokenSymbol, text: s[i : i+2], pos: i})
+			i += 2
+		case strings.IndexByte("()!{},<>=", c) >= 0:
+			tokens = append(tokens, filterToken{kind: tokenSymbol, text: s[i : i+1], pos: i})
+			i++
+		case c == '&' || c == '|':
+			return nil, fmt.Errorf("unexpected %q at column %d (use %c%c)", c, i+1, c, c)
+		default:
+			j := i
+			for j < len(s) && !strings.ContainsRune(" \t\n\r\"()!{},<>=&|", rune(s[j])) {
+				j++
+			}
+			tokens = append(tokens, filterToken{kind: tokenWord, text: s[i:j], pos: i})
+			i = j
+		}
+	}
+	return append(tokens, filterToken{kind: tokenEOF, pos: len(s)}), nil
+}
+
+// filterParser is a recursive descent parser over the tokens of a filter
+type filterParser struct {
+	tokens []filterToken
+	next   int
+}
+
+func (p *filterParser) peek() filterToken {
+	return p.tokens[p.next]
+}
+
+func (p *filterParser) take() filterToken {
+	t := p.tokens[p.next]
+	if t.kind != tokenEOF {
+		p.next++
+	}
+	return t
+}
+
+// is reports whether the next token is the symbol or, case-insensitively, the word
+func (p *filterParser) is(symbol, word string) bool {
+	t := p.peek()
+	return (t.kind == tokenSymbol && t.text == symbol) || (t.kind == tokenWord && strings.EqualFold(t.text, word))
+}
+
+func (p *filterParser) parseOr() (filterNode, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.is("||", "or") {
+		p.take()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = filterOr{left, right}
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseAnd() (filterNode, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.is("&&", "and") {
+		p.take()
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = filterAnd{left, right}
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseNot() (filterNode, error) {
+	if p.is("!", "not") {
+		p.take()
+		node, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return filterNot{node}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *filterParser) parsePrimary() (filterNode, error) {
+	t := p.take()
+	if t.kind == tokenSymbol && t.text == "(" {
+		node, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if end := p.take(); end.kind != tokenSymbol || end.text != ")" {
+			return nil, fmt.Errorf("expected \")\" at column %d, found %s", end.pos+1, end)
+		}
+		return node, nil
+	}
+	if t.kind != tokenWord {
+		return nil, fmt.Errorf("expected a field at column %d, found %s", t.pos+1, t)
+	}
+
+	name := strings.ToLower(t.text)
+	field := filterFields[name]
+	if field == nil {
+		if protocol, ok := filterProtocols[name]; ok {
+			return filterCompare{field: filterProtocolField, op: "==", values: []filterValue{{text: strings.ToLower(protocol)}}}, nil
+		}
+		return nil, fmt.Errorf("unknown field %q at column %d", t.text, t.pos+1)
+	}
+
+	opToken := p.peek()
+	op, ok := filterOperators[strings.ToLower(opToken.text)]
+	if !ok || opToken.kind == tokenString || opToken.kind == tokenEOF {
+		return filterExists{field}, nil
+	}
+	p.take()
+	if err := checkFilterOperator(name, field.kind, op); err != nil {
+		return nil, fmt.Errorf("%v at column %d", err, opToken.pos+1)
+	}
+
+	c := filterCompare{field: field, op: op}
+	if op != "in" {
+		v, err := p.parseValue(name, field.kind)
+		if err != nil {
+			return nil, err
+		}
+		c.values = []filterValue{v}
+		return c, nil
+	}
+
+	if open := p.take(); open.kind != tokenSymbol || open.text != "{" {
+		return nil, fmt.Errorf("expected \"{\" after in at column %d, found %s", open.pos+1, open)
+	}
+	for {
+		if p.is("}", "") {
+			p.take()
+			break
+		}
+		if p.is(",", "") && len(c.values) > 0 {
+			p.take()
+			continue
+		}
+		v, err := p.parseValue(name, field.kind)
+		if err != nil {
+			return nil, err
+		}
+		c.values = append(c.values, v)
+	}
+	if len(c.values) == 0 {
+		return nil, fmt.Errorf("empty set after %s in", name)
+	}
+	return c, nil
+}
+
+// checkFilterOperator rejects comparisons that make no sense for a kind of field
+func checkFilterOperator(name string, kind filterKind, op string) error {
+	switch op {
+	case ">", "<", ">=", "<=":
+		if kind != filterNumber && kind != filterTime {
+			return fmt.Errorf("%s can't be compared with %s", name, op)
+		}
+	case "contains":
+		if kind != filterText {
+			return fmt.Errorf("%s doesn't support contains", name)
+		}
+	case "in":
+		if kind == filterTime {
+			return fmt.Errorf("%s doesn't support in", name)
+		}
+	}
+	return nil
+}
+
+// parseValue reads a word or quoted string as a value for the kind of field
+func (p *filterParser) parseValue(name string, kind filterKind) (filterValue, error) {
+	t := p.take()
+	if t.kind != tokenWord && t.kind != tokenString {
+		return filterValue{}, fmt.Errorf("expected a value for %s at column %d, found %s", name, t.pos+1, t)
+	}
+
+	var v filterValue
+	switch kind {
+	case filterNumber:
+		n, err := strconv.ParseInt(t.text, 10, 64)
+		if err != nil {
+			return v, fmt.Errorf("invalid number %q for %s at column %d", t.text, name, t.pos+1)
+		}
+		v.number = n
+	case filterTime:
+		ts, err := time.Parse(time.RFC3339, t.text)
+		if err != nil {
+			return v, fmt.Errorf("invalid time %q for %s at column %d (expected RFC 3339)", t.text, name, t.pos+1)
+		}
+		v.time = ts
+	case filterIP:
+		network, err := parseIPNet(t.text)
+		if err != nil {
+			return v, fmt.Errorf("invalid address %q for %s at column %d", t.text, name, t.pos+1)
+		}
+		v.network = network
+	case filterMAC:
+		mac, err := net.ParseMAC(t.text)
+		if err != nil {
+			return v, fmt.Errorf("invalid MAC address %q for %s at column %d", t.text, name, t.pos+1)
+		}
+		v.text = mac.String()
+	default:
+		v.text = strings.ToLower(t.text)
+	}
+	return v, nil
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+// Kinds of flood
+const (
+	floodSYN  = "SYN flood"
+	floodICMP = "ICMP flood"
+	floodAmp  = "UDP amplification"
+)
+
+// floodTopSources is how many apparent sources an alert names
+const floodTopSources = 5
+
+// amplificationPorts are UDP services abused for reflection attacks: small spoofed
+// requests make them send large responses to the victim
+var amplificationPorts = map[uint16]string{
+	17:    "QOTD",
+	19:    "Chargen",
+	53:    "DNS",
+	123:   "NTP",
+	161:   "SNMP",
+	389:   "CLDAP",
+	1900:  "SSDP",
+	3702:  "WS-Discovery",
+	11211: "Memcached",
+}
+
+// FloodConfig holds the detection thresholds. A flood needs both the rate and the
+// unanswered ratio to be exceeded, so a busy but healthy server isn't flagged.
+type FloodConfig struct {
+	SYNRate    float64 // SYNs per second to one host
+	ICMPRate   float64 // Echo requests per second to one host
+	AmpRate    float64 // Responses per second from amplification ports to one host
+	Unanswered float64 // Share of SYNs/pings left unanswered, or of responses never asked for (0-1)
+}
+
+// floodCounter tracks one kind of flood against one victim
+type floodCounter struct {
+	hits    int64 // SYNs, echo requests or amplified responses
+	bytes   int64
+	answers int64 // SYN-ACKs, echo replies or requests sent by the victim
+	sources map[string]int64
+}
+
+func (fc *floodCounter) add(src string, length int) {
+	if fc.sources == nil {
+		fc.sources = make(map[string]int64)
+	}
+	fc.hits++
+	fc.bytes += int64(length)
+	fc.sources[src]++
+}
+
+// topSources returns the sources sending the most packets, with counts
+func (fc *floodCounter) topSources() []string {
+	type source struct {
+		ip    string
+		count int64
+	}
+	sources := make([]source, 0, len(fc.sources))
+	for ip, count := range fc.sources {
+		sources = append(sources, source{ip, count})
+	}
+	sort.Slice(sources, func(i, j int) bool {
+		return sources[i].count > sources[j].count
+	})
+	top := []string{}
+	for i := 0; i < len(sources) && i < floodTopSources; i++ {
+		top = append(top, fmt.Sprintf("%s (%d)", sources[i].ip, sources[i].count))
+	}
+	if len(sources) > floodTopSources {
+		top = append(top, fmt.Sprintf("%d more", len(sources)-floodTopSources))
+	}
+	return top
+}
+
+// FloodDetector spots SYN floods, ICMP floods and UDP amplification aimed at a host,
+// by packet rate and the share of traffic the victim never answered (or never asked for)
+type FloodDetector struct {
+	cfg    FloodConfig
+	alerts *AlertEngine
+
+	mu          sync.Mutex
+	windowStart time.Time
+	counters    map[string]map[string]*floodCounter // kind -> victim -> counter
+}
+
+// NewFloodDetector creates a detector with the given thresholds
+func NewFloodDetector(cfg FloodConfig, alerts *AlertEngine) *FloodDetector {
+	fd := &FloodDetector{cfg: cfg, alerts: alerts}
+	fd.reset(time.Now())
+	return fd
+}
+
+func (fd *FloodDetector) reset(now time.Time) {
+	fd.windowStart = now
+	fd.counters = map[string]map[string]*floodCounter{
+		floodSYN:  {},
+		floodICMP: {},
+		floodAmp:  {},
+	}
+}
+
+func (fd *FloodDetector) counter(kind, victim string) *floodCounter {
+	c := fd.counters[kind][victim]
+	if c == nil {
+		c = &floodCounter{}
+		fd.counters[kind][victim] = c
+	}
+	return c
+}
+
+// Start checks the counters on the alert evaluation interval in the background
+func (fd *FloodDetector) Start() {
+	go func() {
+		ticker := time.NewTicker(alertEvalInterval)
+		for range ticker.C {
+			fd.check(time.Now())
+		}
+	}()
+}
+
+// Observe implements PacketObserver
+func (fd *FloodDetector) Observe(p Packet) {
+	if p.SrcIP == "" || p.DstIP == "" {
+		return
+	}
+
+	fd.mu.Lock()
+	defer fd.mu.Unlock()
+
+	switch p.Protocol {
+	case "TCP":
+		syn := p.tcpFlags&tcpFlagSYN != 0
+		ack := p.tcpFlags&tcpFlagACK != 0
+		if syn && !ack {
+			fd.counter(floodSYN, p.DstIP).add(p.SrcIP, p.Length)
+		} else if syn && ack {
+			fd.counter(floodSYN, p.SrcIP).answers++
+		}
+	case "ICMP":
+		switch p.icmpType {
+		case layers.ICMPv4TypeEchoRequest:
+			fd.counter(floodICMP, p.DstIP).add(p.SrcIP, p.Length)
+		case layers.ICMPv4TypeEchoReply:
+			fd.counter(floodICMP, p.SrcIP).answers++
+		}
+	case "UDP":
+		if _, ok := amplificationPorts[p.SrcPort]; ok {
+			fd.counter(floodAmp, p.DstIP).add(p.SrcIP, p.Length)
+		} else if _, ok := amplificationPorts[p.DstPort]; ok {
+			fd.counter(floodAmp, p.SrcIP).answers++
+		}
+	}
+}
+
+// check raises an alert for every victim over both thresholds and starts a new window
+func (fd *FloodDetector) check(now time.Time) {
+	fd.mu.Lock()
+	elapsed := now.Sub(fd.windowStart).Seconds()
+	counters := fd.counters
+	fd.reset(now)
+	fd.mu.Unlock()
+
+	if elapsed <= 0 || fd.alerts == nil {
+		return
+	}
+
+	thresholds := map[string]float64{
+		floodSYN:  fd.cfg.SYNRate,
+		floodICMP: fd.cfg.ICMPRate,
+		floodAmp:  fd.cfg.AmpRate,
+	}
+	for kind, victims := range counters {
+		threshold := thresholds[kind]
+		if threshold <= 0 {
+			continue
+		}
+		for victim, c := range victims {
+			rate := float64(c.hits) / elapsed
+			if rate < threshold {
+				continue
+			}
+			unanswered := 1 - float64(c.answers)/float64(c.hits)
+			if unanswered < 0 {
+				unanswered = 0
+			}
+			if unanswered < fd.cfg.Unanswered {
+				continue
+			}
+
+			what := "unanswered"
+			if kind == floodAmp {
+				what = "unsolicited"
+			}
+			fd.alerts.Raise(kind, victim, severityCritical,
+				fmt.Sprintf("%s against %s: %.0f packets/s (%s/s), %.0f%% %s, from %d sources: %s",
+					kind, victim, rate, formatBytes(int64(float64(c.bytes)/elapsed)), unanswered*100, what,
+					len(c.sources), strings.Join(c.topSources(), ", ")))
+		}
+	}
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// Flow aggregation keys
+const (
+	flowKey5Tuple = "5tuple" // src/dst IP + ports + protocol
+	flowKeyIPPair = "ippair" // src/dst IP + protocol, ports ignored
+	flowKeySrcIP  = "srcip"  // source IP + protocol only
+)
+
+// TCP flag bits as used in NetFlow tcp_flags
+const (
+	tcpFlagFIN uint8 = 0x01
+	tcpFlagSYN uint8 = 0x02
+	tcpFlagRST uint8 = 0x04
+	tcpFlagPSH uint8 = 0x08
+	tcpFlagACK uint8 = 0x10
+)
+
+// FlowConfig controls how packets are aggregated into flows and exported
+type FlowConfig struct {
+	ActiveTimeout   time.Duration // Export long-lived flows at least this often
+	InactiveTimeout time.Duration // Expire flows idle for this long
+	AggregationKey  string        // One of flowKey5Tuple, flowKeyIPPair, flowKeySrcIP
+	BatchSize       int           // Number of expired flows to accumulate before exporting, or to wait up to InactiveTimeout for
+}
+
+// Flow is an aggregated flow record
+type Flow struct {
+	SrcIP     string    `json:"srcIp"`
+	DstIP     string    `json:"dstIp"`
+	SrcPort   uint16    `json:"srcPort"`
+	DstPort   uint16    `json:"dstPort"`
+	Protocol  string    `json:"protocol"`
+	Packets   int64     `json:"packets"`
+	Bytes     int64     `json:"bytes"`
+	FirstSeen time.Time `json:"firstSeen"`
+	LastSeen  time.Time `json:"lastSeen"`
+	TCPFlags  uint8     `json:"tcpFlags"`
+	EndReason string    `json:"endReason"`
+	Interface string    `json:"interface"` // Capture interface of the first packet
+}
+
+// FlowExporter receives batches of expired flows
+type FlowExporter interface {
+	Export(flows []Flow) error
+}
+
+// FlowTable aggregates packets into flows and hands expired flows to exporters
+type FlowTable struct {
+	mu        sync.Mutex
+	cfg       FlowConfig
+	flows     map[string]*Flow
+	pending   []Flow
+	since     time.Time // When the expiry loop first saw flows pending, zero while none are
+	exporters []FlowExporter
+}
+
+// NewFlowTable creates a flow table with the given configuration
+func NewFlowTable(cfg FlowConfig) (*FlowTable, error) {
+	switch cfg.AggregationKey {
+	case "":
+		cfg.AggregationKey = flowKey5Tuple
+	case flowKey5Tuple, flowKeyIPPair, flowKeySrcIP:
+	default:
+		return nil, fmt.Errorf("unknown flow aggregation key %q", cfg.AggregationKey)
+	}
+	if cfg.ActiveTimeout <= 0 {
+		cfg.ActiveTimeout = 2 * time.Minute
+	}
+	if cfg.InactiveTimeout <= 0 {
+		cfg.InactiveTimeout = 15 * time.Second
+	}
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = 30
+	}
+
+	return &FlowTable{
+		cfg:   cfg,
+		flows: make(map[string]*Flow),
+	}, nil
+}
+
+// AddExporter registers an exporter for expired flows
+func (ft *FlowTable) AddExporter(e FlowExporter) {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	ft.exporters = append(ft.exporters, e)
+}
+
+// Start begins the background expiry loop
+func (ft *FlowTable) Start() {
+	go func() {
+		ticker := time.NewTicker(1 * time.Second)
+		for range ticker.C {
+			ft.expire(time.Now(), false)
+		}
+	}()
+}
+
+// flowKey builds the aggregation key for a packet and zeroes fields not part of it
+func (ft *FlowTable) flowKey(f *Flow) string {
+	switch ft.cfg.AggregationKey {
+	case flowKeyIPPair:
+		f.SrcPort, f.DstPort = 0, 0
+	case flowKeySrcIP:
+		f.DstIP = ""
+		f.SrcPort, f.DstPort = 0, 0
+	}
+	return fmt.Sprintf("%s:%d->%s:%d/%s", f.SrcIP, f.SrcPort, f.DstIP, f.DstPort, f.Protocol)
+}
+
+// Observe accounts a packet to its flow
+func (ft *FlowTable) Observe(p Packet) {
+	if p.SrcIP == "" || p.DstIP == "" {
+		return
+	}
+
+	f := Flow{
+		SrcIP:     p.SrcIP,
+		DstIP:     p.DstIP,
+		SrcPort:   p.SrcPort,
+		DstPort:   p.DstPort,
+		Protocol:  p.Protocol,
+		Interface: p.Interface,
+	}
+	key := ft.flowKey(&f)
+
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+
+	flow, exists := ft.flows[key]
+	if !exists {
+		f.FirstSeen = p.Timestamp
+		flow = &f
+		ft.flows[key] = flow
+	}
+	flow.Packets++
+	flow.Bytes += int64(p.Length)
+	flow.LastSeen = p.Timestamp
+	flow.TCPFlags |= p.tcpFlags
+
+	// A FIN or RST ends a 5-tuple TCP flow immediately rather than waiting for the inactive timeout
+	if ft.cfg.AggregationKey == flowKey5Tuple && p.tcpFlags&(tcpFlagFIN|tcpFlagRST) != 0 {
+		flow.EndReason = "end"
+		ft.pending = append(ft.pending, *flow)
+		delete(ft.flows, key)
+	}
+}
+
+// expire moves timed-out flows to the pending batch and exports when the batch is full,
+// or has waited for the inactive timeout, so a quiet network's last flows still go out.
+// With force set, every flow is expired and the batch is exported regardless of size.
+func (ft *FlowTable) expire(now time.Time, force bool) {
+	ft.mu.Lock()
+	for key, flow := range ft.flows {
+		switch {
+		case force:
+			flow.EndReason = "forced"
+		case now.Sub(flow.LastSeen) >= ft.cfg.InactiveTimeout:
+			flow.EndReason = "idle"
+		case now.Sub(flow.FirstSeen) >= ft.cfg.ActiveTimeout:
+			flow.EndReason = "active"
+		default:
+			continue
+		}
+		ft.pending = append(ft.pending, *flow)
+		delete(ft.flows, key)
+	}
+
+	if len(ft.pending) > 0 && ft.since.IsZero() {
+		ft.since = now
+	}
+	var batch []Flow
+	if len(ft.pending) >= ft.cfg.BatchSize || (len(ft.pending) > 0 && (force || now.Sub(ft.since) >= ft.cfg.InactiveTimeout)) {
+		batch = ft.pending
+		ft.pending = nil
+		ft.since = time.Time{}
+	}
+	exporters := ft.exporters
+	ft.mu.Unlock()
+
+	if batch == nil {
+		return
+	}
+	for _, e := range exporters {
+		if err := e.Export(batch); err != nil {
+			log.Printf("Flow export error: %v", err)
+		}
+	}
+}
+
+// Flush expires all flows and exports everything pending
+func (ft *FlowTable) Flush() {
+	ft.expire(time.Now(), true)
+}
+
+// protocolNumber maps a protocol name to its IANA number
+func protocolNumber(name string) uint8 {
+	switch name {
+	case "ICMP", "ICMPv4":
+		return 1
+	case "IGMP":
+		return 2
+	case "TCP":
+		return 6
+	case "UDP":
+		return 17
+	case "GRE":
+		return 47
+	case "ESP":
+		return 50
+	case "AH":
+		return 51
+	case "ICMPv6":
+		return 58
+	case "SCTP":
+		return 132
+	}
+	return 0
+}
+
+// NetFlowV5Exporter sends flows to a collector as NetFlow v5 datagrams.
+// NetFlow v5 only carries IPv4 addresses, so IPv6 flows are skipped.
+type NetFlowV5Exporter struct {
+	conn      net.Conn
+	bootTime  time.Time
+	sequence  uint32
+	maxPerMsg int
+}
+
+// NewNetFlowV5Exporter creates an exporter sending to the given collector address
+func NewNetFlowV5Exporter(collector string) (*NetFlowV5Exporter, error) {
+	conn, err := net.Dial("udp", collector)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to flow collector %s: %v", collector, err)
+	}
+	return &NetFlowV5Exporter{
+		conn:      conn,
+		bootTime:  time.Now(),
+		maxPerMsg: 30, // Protocol limit for v5
+	}, nil
+}
+
+// Export encodes and sends flows, splitting into datagrams of at most 30 records
+func (e *NetFlowV5Exporter) Export(flows []Flow) error {
+	records := make([]Flow, 0, len(flows))
+	for _, f := range flows {
+		if net.ParseIP(f.SrcIP).To4() == nil || (f.DstIP != "" && net.ParseIP(f.DstIP).To4() == nil) {
+			continue
+		}
+		records = append(records, f)
+	}
+
+	for len(records) > 0 {
+		n := len(records)
+		if n > e.maxPerMsg {
+			n = e.maxPerMsg
+		}
+		if _, err := e.conn.Write(e.encode(records[:n], time.Now())); err != nil {
+			return err
+		}
+		records = records[n:]
+	}
+	return nil
+}
+
+// uptime returns milliseconds since the exporter started, as NetFlow expects
+func (e *NetFlowV5Exporter) uptime(t time.Time) uint32 {
+	if t.Before(e.bootTime) {
+		return 0
+	}
+	return uint32(t.Sub(e.bootTime).Milliseconds())
+}
+
+func (e *NetFlowV5Exporter) encode(flows []Flow, now time.Time) []byte {
+	buf := make([]byte, 24+48*len(flows))
+
+	// Header
+	binary.BigEndian.PutUint16(buf[0:], 5)
+	binary.BigEndian.PutUint16(buf[2:], uint16(len(flows)))
+	binary.BigEndian.PutUint32(buf[4:], e.uptime(now))
+	binary.BigEndian.PutUint32(buf[8:], uint32(now.Unix()))
+	binary.BigEndian.PutUint32(buf[12:], uint32(now.Nanosecond()))
+	binary.BigEndian.PutUint32(buf[16:], e.sequence)
+	e.sequence += uint32(len(flows))
+
+	// Records
+	for i, f := range flows {
+		r := buf[24+48*i:]
+		copy(r[0:4], net.ParseIP(f.SrcIP).To4())
+		if f.DstIP != "" {
+			copy(r[4:8], net.ParseIP(f.DstIP).To4())
+		}
+		binary.BigEndian.PutUint32(r[16:], uint32(f.Packets))
+		binary.BigEndian.PutUint32(r[20:], uint32(f.Bytes))
+		binary.BigEndian.PutUint32(r[24:], e.uptime(f.FirstSeen))
+		binary.BigEndian.PutUint32(r[28:], e.uptime(f.LastSeen))
+		binary.BigEndian.PutUint16(r[32:], f.SrcPort)
+		binary.BigEndian.PutUint16(r[34:], f.DstPort)
+		r[37] = f.TCPFlags
+		r[38] = protocolNumber(f.Protocol)
+	}
+
+	return buf
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// FlowRecord is a finished flow as stored in the flows table
+type FlowRecord struct {
+	ID int64 `json:"id"`
+	Flow
+	Application string `json:"application"`
+	SrcHostname string `json:"srcHostname"`
+	DstHostname string `json:"dstHostname"`
+	SrcCountry  string `json:"srcCountry"`
+	DstCountry  string `json:"dstCountry"`
+}
+
+// FlowQuery selects stored flows
+type FlowQuery struct {
+	IP        string // Either end of the flow
+	Port      uint16 // Either port; 0 for any
+	Protocol  string
+	Interface string
+	StartTime *time.Time // Flows still active at or after this
+	EndTime   *time.Time // Flows that started at or before this
+	Limit     int
+	Offset    int
+}
+
+// SQLiteFlowExporter keeps a history of connections by writing every closed or expired
+// flow to the flows table, with the hostnames and countries known at the time
+type SQLiteFlowExporter struct {
+	db *Database
+}
+
+// NewSQLiteFlowExporter creates an exporter writing to db
+func NewSQLiteFlowExporter(db *Database) *SQLiteFlowExporter {
+	return &SQLiteFlowExporter{db: db}
+}
+
+// Export implements FlowExporter
+func (e *SQLiteFlowExporter) Export(flows []Flow) error {
+	records := make([]FlowRecord, len(flows))
+	for i, f := range flows {
+		src, dst := getIPInfo(f.SrcIP), getIPInfo(f.DstIP)
+		records[i] = FlowRecord{
+			Flow:        f,
+			Application: detectApplication(f.SrcPort, f.DstPort),
+			SrcHostname: src.Hostname,
+			DstHostname: dst.Hostname,
+			SrcCountry:  src.Country,
+			DstCountry:  dst.Country,
+		}
+	}
+	return e.db.InsertFlows(records)
+}
+
+func createFlowTables(db *sql.DB) error {
+	schema := `
+	CREATE TABLE IF NOT EXISTS flows (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		first_seen DATETIME NOT NULL,
+		last_seen DATETIME NOT NULL,
+		src_ip TEXT NOT NULL,
+		dst_ip TEXT NOT NULL,
+		src_port INTEGER,
+		dst_port INTEGER,
+		protocol TEXT,
+		packets INTEGER DEFAULT 0,
+		bytes INTEGER DEFAULT 0,
+		tcp_flags INTEGER DEFAULT 0,
+		end_reason TEXT,
+		application TEXT,
+		src_hostname TEXT,
+		dst_hostname TEXT,
+		src_country TEXT,
+		dst_country TEXT
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_flows_first_seen ON flows(first_seen);
+	CREATE INDEX IF NOT EXISTS idx_flows_src_ip ON flows(src_ip);
+	CREATE INDEX IF NOT EXISTS idx_flows_dst_ip ON flows(dst_ip);
+	`
+
+	if _, err := db.Exec(schema); err != nil {
+		return fmt.Errorf("failed to create flow schema: %v", err)
+	}
+
+	// Migration: Record which interface each flow was captured on
+	db.Exec("ALTER TABLE flows ADD COLUMN interface TEXT")
+	return nil
+}
+
+// InsertFlows stores finished flows in one transaction
+func (d *Database) InsertFlows(flows []FlowRecord) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(`
+		INSERT INTO flows (first_seen, last_seen, src_ip, dst_ip, src_port, dst_port, protocol, packets, bytes,
+			tcp_flags, end_reason, application, src_hostname, dst_hostname, src_country, dst_country, interface)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, f := range flows {
+		_, err := stmt.Exec(f.FirstSeen, f.LastSeen, f.SrcIP, f.DstIP, f.SrcPort, f.DstPort, f.Protocol, f.Packets, f.Bytes,
+			f.TCPFlags, f.EndReason, f.Application, f.SrcHostname, f.DstHostname, f.SrcCountry, f.DstCountry, f.Interface)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// QueryFlows returns stored flows matching q, most recent first, and how many match in total
+func (d *Database) QueryFlows(q FlowQuery) ([]FlowRecord, int, error) {
+	where := " WHERE 1=1"
+	args := []interface{}{}
+	if q.IP != "" {
+		where += " AND (src_ip = ? OR dst_ip = ?)"
+		args = append(args, q.IP, q.IP)
+	}
+	if q.Port != 0 {
+		where += " AND (src_port = ? OR dst_port = ?)"
+		args = append(args, q.Port, q.Port)
+	}
+	if q.Protocol != "" {
+		where += " AND protocol = ?"
+		args = append(args, q.Protocol)
+	}
+	if q.Interface != "" {
+		where += " AND interface = ?"
+		args = append(args, q.Interface)
+	}
+	if q.StartTime != nil {
+		where += " AND last_seen >= ?"
+		args = append(args, q.StartTime)
+	}
+	if q.EndTime != nil {
+		where += " AND first_seen <= ?"
+		args = append(args, q.EndTime)
+	}
+
+	var total int
+	if err := d.db.QueryRow("SELECT COUNT(*) FROM flows"+where, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	query := `
+		SELECT id, first_seen, last_seen, src_ip, dst_ip, src_port, dst_port, protocol, packets, bytes,
+			tcp_flags, end_reason, application, src_hostname, dst_hostname, src_country, dst_country, interface
+		FROM flows` + where + " ORDER BY first_seen DESC LIMIT ? OFFSET ?"
+	args = append(args, q.Limit, q.Offset)
+
+	rows, err := d.db.Query(query, args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	flows := []FlowRecord{}
+	for rows.Next() {
+		var f FlowRecord
+		var protocol, endReason, application, srcHostname, dstHostname, srcCountry, dstCountry, iface sql.NullString
+		err := rows.Scan(&f.ID, &f.FirstSeen, &f.LastSeen, &f.SrcIP, &f.DstIP, &f.SrcPort, &f.DstPort, &protocol, &f.Packets, &f.Bytes,
+			&f.TCPFlags, &endReason, &application, &srcHostname, &dstHostname, &srcCountry, &dstCountry, &iface)
+		if err != nil {
+			return nil, 0, err
+		}
+		f.Protocol = protocol.String
+		f.EndReason = endReason.String
+		f.Application = application.String
+		f.SrcHostname = srcHostname.String
+		f.DstHostname = dstHostname.String
+		f.SrcCountry = srcCountry.String
+		f.DstCountry = dstCountry.String
+		f.Interface = iface.String
+		flows = append(flows, f)
+	}
+	return flows, total, rows.Err()
+}
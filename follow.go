@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// connFollow is the connection a client follows, named by either end's address
+type connFollow struct {
+	srcIP, dstIP     string
+	srcPort, dstPort uint16
+	protocol         string
+}
+
+// parseFollow reads a connection such as "192.168.1.5:51234-142.250.1.1:443/TCP", with
+// IPv6 addresses in brackets
+func parseFollow(s string) (*connFollow, error) {
+	invalid := fmt.Errorf("invalid connection %q (expected <ip>:<port>-<ip>:<port>/<protocol>)", s)
+	ends, protocol, ok := strings.Cut(strings.TrimSpace(s), "/")
+	if !ok || protocol == "" {
+		return nil, invalid
+	}
+	src, dst, ok := strings.Cut(ends, "-")
+	if !ok {
+		return nil, invalid
+	}
+	f := &connFollow{protocol: strings.ToUpper(protocol)}
+	for _, end := range []struct {
+		addr string
+		ip   *string
+		port *uint16
+	}{{src, &f.srcIP, &f.srcPort}, {dst, &f.dstIP, &f.dstPort}} {
+		host, port, err := net.SplitHostPort(end.addr)
+		if err != nil {
+			return nil, invalid
+		}
+		ip := net.ParseIP(host)
+		n, err := strconv.ParseUint(port, 10, 16)
+		if ip == nil || err != nil {
+			return nil, invalid
+		}
+		*end.ip, *end.port = ip.String(), uint16(n)
+	}
+	return f, nil
+}
+
+// String formats the connection as parseFollow reads it
+func (f *connFollow) String() string {
+	return net.JoinHostPort(f.srcIP, strconv.Itoa(int(f.srcPort))) + "-" +
+		net.JoinHostPort(f.dstIP, strconv.Itoa(int(f.dstPort))) + "/" + f.protocol
+}
+
+// Match reports whether a packet belongs to the connection, in either direction
+func (f *connFollow) Match(p *Packet) bool {
+	return p.Protocol == f.protocol && ((p.SrcIP == f.srcIP && p.SrcPort == f.srcPort && p.DstIP == f.dstIP && p.DstPort == f.dstPort) ||
+		(p.SrcIP == f.dstIP && p.SrcPort == f.dstPort && p.DstIP == f.srcIP && p.DstPort == f.srcPort))
+}
+
+// setFollow narrows the client's packets to one connection, or lifts that when conn is
+// empty, answering with a follow message naming the connection followed or why it was
+// rejected
+func (c *wsClient) setFollow(conn string) {
+	reply := map[string]string{"connection": ""}
+	if strings.TrimSpace(conn) == "" {
+		c.follow.Store(nil)
+	} else if f, err := parseFollow(conn); err != nil {
+		reply["error"] = err.Error()
+		if current := c.follow.Load(); current != nil {
+			reply["connection"] = current.String()
+		}
+	} else {
+		c.follow.Store(f)
+		reply["connection"] = f.String()
+	}
+	c.reply("follow", reply)
+}
+
+// BroadcastFollowed sends each client following a connection its counters, as a
+// followStats message with the connection and the tracked flows of each direction:
+// forward, from the end it was named by first, and reverse. A direction not yet seen
+// (or not since the stats were cleared) is null.
+func (ps *PacketStore) BroadcastFollowed() {
+	ps.clientsMu.RLock()
+	defer ps.clientsMu.RUnlock()
+
+	for client := range ps.clients {
+		f := client.follow.Load()
+		if f == nil {
+			continue
+		}
+		ps.mu.RLock()
+		forward := ps.followedFlow(f.srcIP, f.srcPort, f.dstIP, f.dstPort, f.protocol)
+		reverse := ps.followedFlow(f.dstIP, f.dstPort, f.srcIP, f.srcPort, f.protocol)
+		ps.mu.RUnlock()
+		client.reply("followStats", map[string]interface{}{
+			"connection": f.String(),
+			"forward":    forward,
+			"reverse":    reverse,
+		})
+	}
+}
+
+// followedFlow copies one direction of a connection from the tracked connections, or
+// returns nil if it isn't tracked. ps.mu must be held.
+func (ps *PacketStore) followedFlow(srcIP string, srcPort uint16, dstIP string, dstPort uint16, protocol string) *Connection {
+	if conn, ok := ps.connections[fmt.Sprintf("%s:%d->%s:%d/%s", srcIP, srcPort, dstIP, dstPort, protocol)]; ok {
+		copied := *conn
+		return &copied
+	}
+	return nil
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ip-api.com limits: 100 addresses per batch request and 15 batch requests a minute from
+// one address on the free tier
+const (
+	geoAPIURL        = "http://ip-api.com/batch?fields=status,countryCode,city,lat,lon,as,query"
+	geoAPIBatchSize  = 100
+	geoAPIBatchWait  = 2 * time.Second // How long a batch waits to fill before it is sent
+	geoAPIInterval   = 4 * time.Second // Between requests, staying within 15 a minute
+	geoAPIQueueSize  = 10000           // Addresses waiting beyond this are dropped
+	geoAPIMaxRetries = 3
+)
+
+// geoLookups is the queue of addresses waiting to be located on ip-api.com
+var geoLookups = &GeoAPIQueue{
+	url:    geoAPIURL,
+	client: &http.Client{Timeout: 10 * time.Second},
+	queue:  make(chan string, geoAPIQueueSize),
+}
+
+// GeoAPIQueue locates addresses on ip-api.com with one worker that sends them in batches,
+// keeping to the rate limit the service reports, instead of a request per address. It
+// starts with the first address queued.
+type GeoAPIQueue struct {
+	url    string
+	client *http.Client
+
+	start  sync.Once
+	queue  chan string
+	queued sync.Map // Addresses in the queue or a batch, so each is asked about once
+
+	// Counters, for /api/enrichment
+	mu                        sync.Mutex
+	requests, located, failed int64
+	dropped                   int64
+	limitedUntil              time.Time
+}
+
+// Enqueue queues an address to be located, unless it already is
+func (q *GeoAPIQueue) Enqueue(ip string) {
+	q.start.Do(func() { go q.run() })
+	if _, dup := q.queued.LoadOrStore(ip, true); dup {
+		return
+	}
+	select {
+	case q.queue <- ip:
+	default:
+		q.queued.Delete(ip)
+		q.mu.Lock()
+		q.dropped++
+		q.mu.Unlock()
+	}
+}
+
+// run sends queued addresses a batch at a time
+func (q *GeoAPIQueue) run() {
+	for {
+		batch := []string{<-q.queue}
+		timeout := time.After(geoAPIBatchWait)
+	fill:
+		for len(batch) < geoAPIBatchSize {
+			select {
+			case ip := <-q.queue:
+				batch = append(batch, ip)
+			case <-timeout:
+				break fill
+			}
+		}
+
+		q.send(batch)
+		for _, ip := range batch {
+			q.queued.Delete(ip)
+		}
+		time.Sleep(geoAPIInterval)
+	}
+}
+
+// send looks a batch up, retrying after the wait the service asks for when it is rate
+// limited and with a growing delay after other failures
+func (q *GeoAPIQueue) send(batch []string) {
+	for attempt := 1; ; attempt++ {
+		wait, err := q.lookup(batch)
+		if err == nil {
+			return
+		}
+		if attempt > geoAPIMaxRetries {
+			log.Printf("Debug: giving up locating %d IPs: %v", len(batch), err)
+			q.mu.Lock()
+			q.failed += int64(len(batch))
+			q.mu.Unlock()
+			return
+		}
+		if wait == 0 {
+			wait = time.Duration(attempt) * 5 * time.Second
+		}
+		time.Sleep(wait)
+	}
+}
+
+// lookup makes one batch request and caches the answers. When rate limited it returns
+// how long the service said to wait.
+func (q *GeoAPIQueue) lookup(batch []string) (time.Duration, error) {
+	if err := chaosEnrichmentFault(); err != nil {
+		return 0, err
+	}
+	body, _ := json.Marshal(batch)
+	q.mu.Lock()
+	q.requests++
+	q.mu.Unlock()
+	resp, err := q.client.Post(q.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	// X-Rl is the requests left in this window and X-Ttl the seconds until it resets
+	ttl, _ := strconv.Atoi(resp.Header.Get("X-Ttl"))
+	reset := time.Duration(ttl+1) * time.Second
+	if resp.StatusCode == http.StatusTooManyRequests {
+		q.mu.Lock()
+		q.limitedUntil = time.Now().Add(reset)
+		q.mu.Unlock()
+		return reset, fmt.Errorf("rate limited by ip-api.com")
+	}
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("ip-api.com returned %s", resp.Status)
+	}
+
+	var results []struct {
+		Status      string  `json:"status"`
+		CountryCode string  `json:"countryCode"`
+		City        string  `json:"city"`
+		Lat         float64 `json:"lat"`
+		Lon         float64 `json:"lon"`
+		AS          string  `json:"as"`
+		Query       string  `json:"query"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&results); err != nil {
+		return 0, err
+	}
+	located := int64(0)
+	for _, result := range results {
+		if result.Status != "success" {
+			continue
+		}
+		updateIPInfo(result.Query, func(info *IPInfo) {
+			info.Country, info.City = result.CountryCode, result.City
+			info.Lat, info.Lon = result.Lat, result.Lon
+			info.ASN = result.AS
+		})
+		located++
+	}
+
+	q.mu.Lock()
+	q.located += located
+	q.failed += int64(len(batch)) - located
+	q.mu.Unlock()
+
+	// Out of requests for this window: hold the next batch until it resets
+	if rl := resp.Header.Get("X-Rl"); rl == "0" {
+		q.mu.Lock()
+		q.limitedUntil = time.Now().Add(reset)
+		q.mu.Unlock()
+		time.Sleep(reset)
+	}
+	return 0, nil
+}
+
+// Status reports the queue and how lookups have gone, for /api/enrichment
+func (q *GeoAPIQueue) Status() map[string]interface{} {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	status := map[string]interface{}{
+		"queued":   len(q.queue),
+		"requests": q.requests,
+		"located":  q.located,
+		"failed":   q.failed,
+		"dropped":  q.dropped,
+	}
+	if time.Now().Before(q.limitedUntil) {
+		status["rateLimitedUntil"] = q.limitedUntil
+	}
+	return status
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Grafana targets are "<measure>[ by <dimension>][ where <dimension>=<value>,...]" over
+// the hourly traffic rollups, e.g. "bytes by application where ip=192.168.1.20"
+var (
+	grafanaMeasures   = []string{"bytes", "packets", "bitrate"}
+	grafanaDimensions = map[string]string{"protocol": "protocol", "application": "application", "ip": "ip"}
+)
+
+const (
+	grafanaMaxSeries  = 10 // Series a "by" target returns before the rest are summed as "other"
+	grafanaMaxBuckets = 10000
+)
+
+// grafanaQueryRequest is the body Grafana's JSON datasources (SimpleJSON, Infinity) POST
+// to /grafana/query
+type grafanaQueryRequest struct {
+	Range struct {
+		From time.Time `json:"from"`
+		To   time.Time `json:"to"`
+	} `json:"range"`
+	IntervalMs int64           `json:"intervalMs"`
+	Targets    []grafanaTarget `json:"targets"`
+}
+
+type grafanaTarget struct {
+	Target string `json:"target"`
+	RefID  string `json:"refId"`
+	Type   string `json:"type"` // "timeserie" (the default) or "table"
+	Hide   bool   `json:"hide"`
+}
+
+// grafanaMetric is a parsed target
+type grafanaMetric struct {
+	measure string
+	by      string            // Dimension column to split series by, or ""
+	where   map[string]string // Dimension column to value
+}
+
+// grafanaSeries is one line of a time series response
+type grafanaSeries struct {
+	Target     string       `json:"target"`
+	RefID      string       `json:"refId,omitempty"`
+	Datapoints [][2]float64 `json:"datapoints"` // [value, Unix milliseconds]
+}
+
+// grafanaTable is a table response
+type grafanaTable struct {
+	Type    string          `json:"type"`
+	RefID   string          `json:"refId,omitempty"`
+	Columns []grafanaColumn `json:"columns"`
+	Rows    [][]interface{} `json:"rows"`
+}
+
+type grafanaColumn struct {
+	Text string `json:"text"`
+	Type string `json:"type"`
+}
+
+// parseGrafanaQuery reads a /grafana/query body and checks its targets, defaulting to the
+// last 24 hours
+func parseGrafanaQuery(r *http.Request) (grafanaQueryRequest, error) {
+	var q grafanaQueryRequest
+	if err := json.NewDecoder(r.Body).Decode(&q); err != nil {
+		return q, fmt.Errorf("invalid query: %v", err)
+	}
+	if q.Range.To.IsZero() {
+		q.Range.To = time.Now()
+	}
+	if q.Range.From.IsZero() {
+		q.Range.From = q.Range.To.Add(-24 * time.Hour)
+	}
+	if !q.Range.From.Before(q.Range.To) {
+		return q, fmt.Errorf("invalid range: from must be before to")
+	}
+	for _, t := range q.Targets {
+		if _, err := parseGrafanaMetric(t.Target); err != nil && !t.Hide && strings.TrimSpace(t.Target) != "" {
+			return q, err
+		}
+	}
+	return q, nil
+}
+
+// parseGrafanaMetric parses a target such as "packets by protocol where ip=10.0.0.5"
+func parseGrafanaMetric(target string) (grafanaMetric, error) {
+	m := grafanaMetric{where: make(map[string]string)}
+	s := strings.TrimSpace(target)
+	if i := strings.Index(s, " where "); i >= 0 {
+		for _, cond := range strings.Split(s[i+len(" where "):], ",") {
+			key, value, ok := strings.Cut(cond, "=")
+			col := grafanaDimensions[strings.TrimSpace(key)]
+			if !ok || col == "" {
+				return m, fmt.Errorf("invalid condition %q in %q (expected protocol, application or ip=value)", strings.TrimSpace(cond), target)
+			}
+			m.where[col] = strings.TrimSpace(value)
+		}
+		s = s[:i]
+	}
+	if measure, dim, ok := strings.Cut(s, " by "); ok {
+		m.by = grafanaDimensions[strings.TrimSpace(dim)]
+		if m.by == "" {
+			return m, fmt.Errorf("invalid dimension %q in %q (expected protocol, application or ip)", strings.TrimSpace(dim), target)
+		}
+		s = measure
+	}
+	m.measure = strings.TrimSpace(s)
+	for _, name := range grafanaMeasures {
+		if m.measure == name {
+			return m, nil
+		}
+	}
+	return m, fmt.Errorf("invalid measure %q in %q (expected bytes, packets or bitrate)", m.measure, target)
+}
+
+// grafanaMetricNames lists the targets /grafana/search offers, those containing filter
+func grafanaMetricNames(filter string) []string {
+	names := []string{}
+	for _, measure := range grafanaMeasures {
+		for _, dim := range []string{"", "protocol", "application", "ip"} {
+			name := measure
+			if dim != "" {
+				name += " by " + dim
+			}
+			if strings.Contains(name, filter) {
+				names = append(names, name)
+			}
+		}
+	}
+	return names
+}
+
+// GrafanaDimensionValues lists the values a dimension took over the last 30 days, for
+// Grafana template variables
+func (d *Database) GrafanaDimensionValues(dim string) ([]string, error) {
+	col := grafanaDimensions[dim]
+	if col == "" {
+		return nil, fmt.Errorf("unknown dimension %q", dim)
+	}
+	rows, err := d.db.Query(`
+		SELECT DISTINCT `+col+` FROM traffic_hourly
+		WHERE hour >= ? AND `+col+` != '' ORDER BY `+col+` LIMIT 1000
+	`, time.Now().AddDate(0, 0, -30).Truncate(time.Hour).Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	values := []string{}
+	for rows.Next() {
+		var v string
+		if err := rows.Scan(&v); err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+	}
+	return values, rows.Err()
+}
+
+// GrafanaQuery answers one target, as time series or a table. Points are summed into
+// buckets of Grafana's interval, rounded up to whole hours since that's what the rollups
+// hold; bitrate is the average over each bucket.
+func (d *Database) GrafanaQuery(q grafanaQueryRequest, t grafanaTarget) ([]interface{}, error) {
+	m, err := parseGrafanaMetric(t.Target)
+	if err != nil {
+		return nil, err
+	}
+
+	bucket := int64(3600)
+	if q.IntervalMs > 0 {
+		bucket = (q.IntervalMs/1000 + 3599) / 3600 * 3600
+	}
+	from := q.Range.From.Truncate(time.Hour).Unix()
+	to := q.Range.To.Unix()
+	for (to-from)/bucket > grafanaMaxBuckets {
+		bucket *= 2
+	}
+	from -= from % bucket
+
+	dim := "''"
+	if m.by != "" {
+		dim = m.by
+	}
+	query := `SELECT hour, ` + dim + `, SUM(bytes), SUM(packets) FROM traffic_hourly WHERE hour >= ? AND hour <= ?`
+	args := []interface{}{from, to}
+	for col, v := range m.where {
+		query += " AND " + col + " = ?"
+		args = append(args, v)
+	}
+	query += " GROUP BY hour, " + dim
+
+	rows, err := d.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	// Value per series and bucket, and each series' total for picking the top ones
+	values := make(map[string]map[int64]float64)
+	totals := make(map[string]float64)
+	for rows.Next() {
+		var hour, bytes, packets int64
+		var key string
+		if err := rows.Scan(&hour, &key, &bytes, &packets); err != nil {
+			return nil, err
+		}
+		v := float64(bytes)
+		switch m.measure {
+		case "packets":
+			v = float64(packets)
+		case "bitrate":
+			v = float64(bytes*8) / float64(bucket)
+		}
+		if key == "" && m.by != "" {
+			key = "unknown"
+		}
+		if values[key] == nil {
+			values[key] = make(map[int64]float64)
+		}
+		values[key][hour-hour%bucket] += v
+		totals[key] += v
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// One series for a plain measure, the top ones and "other" when split by a dimension
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if totals[keys[i]] != totals[keys[j]] {
+			return totals[keys[i]] > totals[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+	if m.by == "" {
+		keys = []string{""}
+	} else if len(keys) > grafanaMaxSeries {
+		other := make(map[int64]float64)
+		for _, k := range keys[grafanaMaxSeries:] {
+			for b, v := range values[k] {
+				other[b] += v
+			}
+		}
+		keys = append(keys[:grafanaMaxSeries], "other")
+		values["other"] = other
+	}
+
+	if t.Type == "table" {
+		table := grafanaTable{Type: "table", RefID: t.RefID, Rows: [][]interface{}{}}
+		table.Columns = append(table.Columns, grafanaColumn{"Time", "time"})
+		if m.by != "" {
+			table.Columns = append(table.Columns, grafanaColumn{m.by, "string"})
+		}
+		table.Columns = append(table.Columns, grafanaColumn{m.measure, "number"})
+		for _, k := range keys {
+			buckets := make([]int64, 0, len(values[k]))
+			for b := range values[k] {
+				buckets = append(buckets, b)
+			}
+			sort.Slice(buckets, func(i, j int) bool { return buckets[i] < buckets[j] })
+			for _, b := range buckets {
+				row := []interface{}{b * 1000}
+				if m.by != "" {
+					row = append(row, k)
+				}
+				table.Rows = append(table.Rows, append(row, values[k][b]))
+			}
+		}
+		return []interface{}{table}, nil
+	}
+
+	// Time series have a point for every bucket, so quiet hours show as zero, not a gap
+	result := []interface{}{}
+	for _, k := range keys {
+		s := grafanaSeries{Target: t.Target, RefID: t.RefID, Datapoints: [][2]float64{}}
+		if m.by != "" {
+			s.Target = k
+		}
+		for b := from; b <= to; b += bucket {
+			s.Datapoints = append(s.Datapoints, [2]float64{values[k][b], float64(b * 1000)})
+		}
+		result = append(result, s)
+	}
+	return result, nil
+}
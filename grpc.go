@@ -0,0 +1,312 @@
+package main
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative pitrackpb/pitrack.proto
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"pi-track/pitrackpb"
+)
+
+// grpcSubscriberBuffer is how many messages a slow subscriber can fall behind before
+// messages are dropped for it, as for WebSocket clients
+const grpcSubscriberBuffer = 256
+
+// GRPCServer serves the live feed defined in pitrackpb/pitrack.proto. It sees packets and
+// flows like any other observer and exporter, and hands them to each subscriber's stream.
+type GRPCServer struct {
+	pitrackpb.UnimplementedPiTrackServer
+	store *PacketStore
+
+	mu          sync.RWMutex
+	subscribers map[*grpcSubscriber]bool
+}
+
+// grpcSubscriber is one SubscribePackets or SubscribeFlows stream; only the channel for
+// its kind is set
+type grpcSubscriber struct {
+	filter  *pitrackpb.SubscribeRequest
+	packets chan *pitrackpb.Packet
+	flows   chan *pitrackpb.Flow
+}
+
+// NewGRPCServer creates a server streaming from store
+func NewGRPCServer(store *PacketStore) *GRPCServer {
+	return &GRPCServer{
+		store:       store,
+		subscribers: make(map[*grpcSubscriber]bool),
+	}
+}
+
+// Serve listens on port, requiring auth's credentials when it's enabled and serving TLS
+// when tlsConfig is set. It blocks until the listener fails.
+func (g *GRPCServer) Serve(port int, auth *Auth, tlsConfig *tls.Config) error {
+	lis, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return err
+	}
+	opts := []grpc.ServerOption{
+		grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			if err := grpcAuthorize(ctx, auth, info.FullMethod); err != nil {
+				return nil, err
+			}
+			return handler(ctx, req)
+		}),
+		grpc.StreamInterceptor(func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			if err := grpcAuthorize(ss.Context(), auth, info.FullMethod); err != nil {
+				return err
+			}
+			return handler(srv, ss)
+		}),
+	}
+	if tlsConfig != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+	s := grpc.NewServer(opts...)
+	pitrackpb.RegisterPiTrackServer(s, g)
+	// Lets grpcurl and similar tools list the service without the .proto file
+	reflection.Register(s)
+	return s.Serve(lis)
+}
+
+// grpcAuthorize checks the request's "authorization" metadata, which takes the same
+// Bearer tokens, API keys and Basic credentials as the HTTP API
+func grpcAuthorize(ctx context.Context, auth *Auth, method string) error {
+	if !auth.Enabled() {
+		return nil
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, v := range md.Get("authorization") {
+		key, ok := auth.checkAuthorization(v)
+		if !ok {
+			continue
+		}
+		if key != nil {
+			code, _, err := auth.keys.admit(key, grpcScope(method))
+			if code == http.StatusTooManyRequests {
+				return status.Error(codes.ResourceExhausted, err.Error())
+			}
+			if err != nil {
+				return status.Error(codes.PermissionDenied, err.Error())
+			}
+		}
+		return nil
+	}
+	return status.Error(codes.Unauthenticated, "authentication required")
+}
+
+// Observe implements PacketObserver
+func (g *GRPCServer) Observe(p Packet) {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	var msg *pitrackpb.Packet
+	for sub := range g.subscribers {
+		if sub.packets == nil || !sub.matches(p.SrcIP, p.DstIP, p.SrcPort, p.DstPort, p.Protocol, p.Interface) {
+			continue
+		}
+		if msg == nil {
+			msg = packetProto(p)
+		}
+		select {
+		case sub.packets <- msg:
+		default:
+			// Subscriber is behind, skip this packet for it
+		}
+	}
+}
+
+// Export implements FlowExporter
+func (g *GRPCServer) Export(flows []Flow) error {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	for sub := range g.subscribers {
+		if sub.flows == nil {
+			continue
+		}
+		for _, f := range flows {
+			if !sub.matches(f.SrcIP, f.DstIP, f.SrcPort, f.DstPort, f.Protocol, f.Interface) {
+				continue
+			}
+			select {
+			case sub.flows <- flowProto(f):
+			default:
+			}
+		}
+	}
+	return nil
+}
+
+func (g *GRPCServer) subscribe(sub *grpcSubscriber) func() {
+	g.mu.Lock()
+	g.subscribers[sub] = true
+	g.mu.Unlock()
+	return func() {
+		g.mu.Lock()
+		delete(g.subscribers, sub)
+		g.mu.Unlock()
+	}
+}
+
+// SubscribePackets implements pitrackpb.PiTrackServer
+func (g *GRPCServer) SubscribePackets(req *pitrackpb.SubscribeRequest, stream pitrackpb.PiTrack_SubscribePacketsServer) error {
+	sub := &grpcSubscriber{filter: req, packets: make(chan *pitrackpb.Packet, grpcSubscriberBuffer)}
+	defer g.subscribe(sub)()
+
+	for {
+		select {
+		case p := <-sub.packets:
+			if err := stream.Send(p); err != nil {
+				return err
+			}
+		case <-stream.Context().Done():
+			return nil
+		}
+	}
+}
+
+// SubscribeFlows implements pitrackpb.PiTrackServer
+func (g *GRPCServer) SubscribeFlows(req *pitrackpb.SubscribeRequest, stream pitrackpb.PiTrack_SubscribeFlowsServer) error {
+	sub := &grpcSubscriber{filter: req, flows: make(chan *pitrackpb.Flow, grpcSubscriberBuffer)}
+	defer g.subscribe(sub)()
+
+	for {
+		select {
+		case f := <-sub.flows:
+			if err := stream.Send(f); err != nil {
+				return err
+			}
+		case <-stream.Context().Done():
+			return nil
+		}
+	}
+}
+
+// SubscribeStats implements pitrackpb.PiTrackServer
+func (g *GRPCServer) SubscribeStats(req *pitrackpb.StatsRequest, stream pitrackpb.PiTrack_SubscribeStatsServer) error {
+	interval := time.Duration(req.GetIntervalSeconds()) * time.Second
+	if interval <= 0 {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := stream.Send(statsProto(g.store.GetStats())); err != nil {
+			return err
+		}
+		select {
+		case <-ticker.C:
+		case <-stream.Context().Done():
+			return nil
+		}
+	}
+}
+
+// GetStats implements pitrackpb.PiTrackServer
+func (g *GRPCServer) GetStats(context.Context, *pitrackpb.StatsRequest) (*pitrackpb.Stats, error) {
+	return statsProto(g.store.GetStats()), nil
+}
+
+// matches reports whether a packet or flow passes the subscription's filter
+func (s *grpcSubscriber) matches(srcIP, dstIP string, srcPort, dstPort uint16, protocol, iface string) bool {
+	f := s.filter
+	if f.GetIp() != "" && f.GetIp() != srcIP && f.GetIp() != dstIP {
+		return false
+	}
+	if port := f.GetPort(); port != 0 && port != uint32(srcPort) && port != uint32(dstPort) {
+		return false
+	}
+	if f.GetInterface() != "" && f.GetInterface() != iface {
+		return false
+	}
+	if len(f.GetProtocols()) == 0 {
+		return true
+	}
+	for _, proto := range f.GetProtocols() {
+		if strings.EqualFold(proto, protocol) {
+			return true
+		}
+	}
+	return false
+}
+
+func packetProto(p Packet) *pitrackpb.Packet {
+	return &pitrackpb.Packet{
+		Id:          p.ID,
+		Timestamp:   timestamppb.New(p.Timestamp),
+		SrcIp:       p.SrcIP,
+		DstIp:       p.DstIP,
+		SrcPort:     uint32(p.SrcPort),
+		DstPort:     uint32(p.DstPort),
+		Protocol:    p.Protocol,
+		Length:      uint32(p.Length),
+		Info:        p.Info,
+		SrcMac:      p.SrcMAC,
+		DstMac:      p.DstMAC,
+		Application: p.Application,
+		SrcHostname: p.SrcHostname,
+		DstHostname: p.DstHostname,
+		SrcCountry:  p.SrcCountry,
+		DstCountry:  p.DstCountry,
+		ProcessName: p.ProcessName,
+		Interface:   p.Interface,
+	}
+}
+
+func flowProto(f Flow) *pitrackpb.Flow {
+	return &pitrackpb.Flow{
+		SrcIp:     f.SrcIP,
+		DstIp:     f.DstIP,
+		SrcPort:   uint32(f.SrcPort),
+		DstPort:   uint32(f.DstPort),
+		Protocol:  f.Protocol,
+		Packets:   f.Packets,
+		Bytes:     f.Bytes,
+		FirstSeen: timestamppb.New(f.FirstSeen),
+		LastSeen:  timestamppb.New(f.LastSeen),
+		TcpFlags:  uint32(f.TCPFlags),
+		EndReason: f.EndReason,
+		Interface: f.Interface,
+	}
+}
+
+func statsProto(s Stats) *pitrackpb.Stats {
+	msg := &pitrackpb.Stats{
+		TotalPackets:     s.TotalPackets,
+		TotalBytes:       s.TotalBytes,
+		PacketsPerSec:    s.PacketsPerSec,
+		BytesPerSec:      s.BytesPerSec,
+		ProtocolStats:    s.ProtocolStats,
+		CountryStats:     s.CountryStats,
+		ApplicationStats: s.ApplicationStats,
+		ProcessStats:     s.ProcessStats,
+		StartTime:        timestamppb.New(s.StartTime),
+	}
+	for _, t := range s.TopTalkers {
+		msg.TopTalkers = append(msg.TopTalkers, &pitrackpb.Talker{
+			Ip:       t.IP,
+			Packets:  t.Packets,
+			Bytes:    t.Bytes,
+			Hostname: t.Hostname,
+			Country:  t.Country,
+		})
+	}
+	return msg
+}
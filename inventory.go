@@ -0,0 +1,292 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// deviceNamesSetting is where the friendly names assigned to devices are persisted
+const deviceNamesSetting = "device_names"
+
+// maxDeviceNameLength caps friendly names
+const maxDeviceNameLength = 64
+
+// errUnknownDevice is returned for devices that have never been seen
+var errUnknownDevice = errors.New("unknown device")
+
+// Hostname sources, in the order they are preferred
+const (
+	hostnameSourceDHCP = "dhcp" // Option 12 of the device's DHCP requests
+	hostnameSourceMDNS = "mdns" // Addresses the device announces over multicast DNS
+	hostnameSourceRDNS = "rdns" // Reverse DNS of its LAN addresses
+)
+
+// InventoryDevice is everything known about one device: its traffic since startup, when it
+// was first and last seen across restarts, who made it, what it calls itself and how much
+// it has used
+type InventoryDevice struct {
+	Device
+	Name       string            `json:"name,omitempty"`     // Friendly name assigned through the API
+	Hostname   string            `json:"hostname,omitempty"` // Best of the hostnames
+	Hostnames  map[string]string `json:"hostnames"`          // Source -> hostname
+	Vendor     string            `json:"vendor,omitempty"`
+	Randomized bool              `json:"randomized"` // Locally administered (private) MAC address
+	Online     bool              `json:"online"`
+	UsageToday int64             `json:"usageToday"` // Bytes sent and received today
+	UsageMonth int64             `json:"usageMonth"` // Bytes sent and received this month
+}
+
+// DeviceInventory combines the device, presence and usage trackers into one list of every
+// known device, learning hostnames from DHCP and mDNS and keeping friendly names
+type DeviceInventory struct {
+	db       *Database
+	devices  *DeviceTracker
+	presence *PresenceMonitor
+	usage    *UsageTracker
+	vendors  *VendorDB
+
+	mu        sync.RWMutex
+	names     map[string]string            // Device -> friendly name
+	hostnames map[string]map[string]string // Device -> source -> hostname
+}
+
+// NewDeviceInventory creates an inventory, loading the saved friendly names
+func NewDeviceInventory(db *Database, devices *DeviceTracker, presence *PresenceMonitor, usage *UsageTracker, vendors *VendorDB) *DeviceInventory {
+	inv := &DeviceInventory{
+		db:        db,
+		devices:   devices,
+		presence:  presence,
+		usage:     usage,
+		vendors:   vendors,
+		names:     make(map[string]string),
+		hostnames: make(map[string]map[string]string),
+	}
+	if db != nil {
+		if value, ok, err := db.GetSetting(deviceNamesSetting); err == nil && ok {
+			if err := json.Unmarshal([]byte(value), &inv.names); err != nil {
+				log.Printf("Warning: ignoring saved device names: %v", err)
+			}
+		}
+	}
+	return inv
+}
+
+// normalizeDeviceKey accepts a device as any MAC address notation or an IP address
+func normalizeDeviceKey(s string) string {
+	s = strings.TrimSpace(s)
+	if mac, err := net.ParseMAC(s); err == nil {
+		return mac.String()
+	}
+	return strings.ToLower(s)
+}
+
+// Observe implements PacketObserver, picking up the names devices give themselves
+func (inv *DeviceInventory) Observe(p Packet) {
+	switch {
+	case p.dhcp != nil && p.dhcp.Operation == layers.DHCPOpRequest:
+		for _, opt := range p.dhcp.Options {
+			if opt.Type == layers.DHCPOptHostname && len(opt.Data) > 0 {
+				inv.learnHostname(p.dhcp.ClientHWAddr.String(), hostnameSourceDHCP, string(opt.Data))
+			}
+		}
+	case p.Protocol == "UDP" && p.SrcPort == 5353 && len(p.payload) > 0:
+		var mdns layers.DNS
+		if err := mdns.DecodeFromBytes(p.payload, gopacket.NilDecodeFeedback); err != nil || !mdns.QR {
+			return
+		}
+		// Only the device's own address record names it; answers can be for others
+		src := net.ParseIP(p.SrcIP)
+		for _, a := range mdns.Answers {
+			if (a.Type == layers.DNSTypeA || a.Type == layers.DNSTypeAAAA) && a.IP.Equal(src) {
+				inv.learnHostname(deviceKey(p.SrcMAC, p.SrcIP), hostnameSourceMDNS, string(a.Name))
+				return
+			}
+		}
+	}
+}
+
+func (inv *DeviceInventory) learnHostname(device, source, name string) {
+	name = strings.TrimSuffix(strings.TrimSpace(name), ".")
+	if device == "" || name == "" {
+		return
+	}
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+	if inv.hostnames[device] == nil {
+		inv.hostnames[device] = make(map[string]string)
+	}
+	inv.hostnames[device][source] = name
+}
+
+// Devices returns every known device, sorted as for DeviceTracker.Devices. Devices only
+// remembered from before the last restart come last.
+func (inv *DeviceInventory) Devices(sortBy string) []InventoryDevice {
+	byKey := make(map[string]*InventoryDevice)
+	var order []string
+	for _, d := range inv.devices.Devices(sortBy) {
+		byKey[d.MAC] = &InventoryDevice{Device: d}
+		order = append(order, d.MAC)
+	}
+	if inv.presence != nil {
+		for _, p := range inv.presence.Devices() {
+			d := byKey[p.Device]
+			if d == nil {
+				d = &InventoryDevice{Device: Device{MAC: p.Device, IPs: []string{}, FirstSeen: p.FirstSeen, LastSeen: p.LastSeen}}
+				d.addIP(p.IP)
+				byKey[p.Device] = d
+				order = append(order, p.Device)
+			}
+			// Presence is kept across restarts, so it knows when the device really first appeared
+			if p.FirstSeen.Before(d.FirstSeen) {
+				d.FirstSeen = p.FirstSeen
+			}
+			d.Online = p.Online
+		}
+	}
+
+	devices := make([]InventoryDevice, 0, len(order))
+	for _, key := range order {
+		d := byKey[key]
+		inv.describe(d)
+		devices = append(devices, *d)
+	}
+	// Keep the traffic order, putting devices without traffic since startup in last-seen order
+	value := deviceSortValue(sortBy)
+	sort.SliceStable(devices, func(i, j int) bool {
+		vi, vj := value(devices[i].Device), value(devices[j].Device)
+		if vi == 0 && vj == 0 {
+			return devices[i].LastSeen.After(devices[j].LastSeen)
+		}
+		return vi > vj
+	})
+	return devices
+}
+
+// Device returns one known device
+func (inv *DeviceInventory) Device(key string) (InventoryDevice, bool) {
+	key = normalizeDeviceKey(key)
+	for _, d := range inv.Devices("") {
+		if d.MAC == key {
+			return d, true
+		}
+	}
+	return InventoryDevice{}, false
+}
+
+// Label returns a device's friendly name, or failing that the name it gives itself
+func (inv *DeviceInventory) Label(device string) string {
+	inv.mu.RLock()
+	defer inv.mu.RUnlock()
+	if name := inv.names[device]; name != "" {
+		return name
+	}
+	for _, source := range []string{hostnameSourceDHCP, hostnameSourceMDNS} {
+		if name := inv.hostnames[device][source]; name != "" {
+			return name
+		}
+	}
+	return ""
+}
+
+// describe fills in the name, hostnames, vendor and usage of a device
+func (inv *DeviceInventory) describe(d *InventoryDevice) {
+	d.Hostnames = make(map[string]string)
+	inv.mu.RLock()
+	d.Name = inv.names[d.MAC]
+	for source, name := range inv.hostnames[d.MAC] {
+		d.Hostnames[source] = name
+	}
+	inv.mu.RUnlock()
+
+	for _, ip := range d.IPs {
+		if name := strings.TrimSuffix(resolveHostname(ip), "."); name != "" {
+			d.Hostnames[hostnameSourceRDNS] = name
+			break
+		}
+	}
+	for _, source := range []string{hostnameSourceDHCP, hostnameSourceMDNS, hostnameSourceRDNS} {
+		if name := d.Hostnames[source]; name != "" {
+			d.Hostname = name
+			break
+		}
+	}
+
+	d.Randomized = randomizedMAC(d.MAC)
+	if inv.vendors != nil && !d.Randomized {
+		d.Vendor = inv.vendors.Lookup(d.MAC)
+	}
+	if inv.usage != nil {
+		d.UsageToday = inv.usage.Bytes(usagePeriodDay, d.MAC)
+		d.UsageMonth = inv.usage.Bytes(usagePeriodMonth, d.MAC)
+	}
+}
+
+// SetName assigns a friendly name to a known device, or removes it when name is empty
+func (inv *DeviceInventory) SetName(key, name string) (InventoryDevice, error) {
+	name = strings.TrimSpace(name)
+	if len(name) > maxDeviceNameLength {
+		return InventoryDevice{}, fmt.Errorf("name is longer than %d characters", maxDeviceNameLength)
+	}
+	d, ok := inv.Device(key)
+	if !ok {
+		return InventoryDevice{}, errUnknownDevice
+	}
+
+	inv.mu.Lock()
+	if name == "" {
+		delete(inv.names, d.MAC)
+	} else {
+		inv.names[d.MAC] = name
+	}
+	err := inv.saveLocked()
+	inv.mu.Unlock()
+
+	d.Name = name
+	return d, err
+}
+
+// Names returns the friendly names by device
+func (inv *DeviceInventory) Names() map[string]string {
+	inv.mu.RLock()
+	defer inv.mu.RUnlock()
+	names := make(map[string]string, len(inv.names))
+	for device, name := range inv.names {
+		names[device] = name
+	}
+	return names
+}
+
+// SetNames replaces every friendly name, as when a configuration bundle is imported
+func (inv *DeviceInventory) SetNames(names map[string]string) error {
+	normalized := make(map[string]string, len(names))
+	for device, name := range names {
+		if name = strings.TrimSpace(name); name != "" {
+			if len(name) > maxDeviceNameLength {
+				return fmt.Errorf("name for %s is longer than %d characters", device, maxDeviceNameLength)
+			}
+			normalized[normalizeDeviceKey(device)] = name
+		}
+	}
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+	inv.names = normalized
+	return inv.saveLocked()
+}
+
+// saveLocked persists the friendly names. Must be called with inv.mu held.
+func (inv *DeviceInventory) saveLocked() error {
+	if inv.db == nil {
+		return nil
+	}
+	data, _ := json.Marshal(inv.names)
+	return inv.db.SetSetting(deviceNamesSetting, string(data))
+}
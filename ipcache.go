@@ -0,0 +1,250 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// IP info cache settings
+const (
+	ipInfoFlushInterval = 30 * time.Second
+	ipInfoLoadLimit     = 100000 // Most recently resolved IPs loaded at startup
+)
+
+// ipInfoStore saves lookups to the database, nil without one or with -ip-info-ttl 0
+var ipInfoStore *IPInfoStore
+
+// IPInfoStore keeps resolved hostnames, locations and ASNs in the ip_info table, so a
+// restart picks up where the last run left off instead of looking every address up again.
+// Each row expires ttl after it was resolved; expired entries are dropped from the cache
+// and looked up afresh the next time the address is seen.
+type IPInfoStore struct {
+	db  *Database
+	ttl time.Duration
+
+	mu      sync.Mutex
+	dirty   map[string]bool      // Resolved since the last flush
+	expires map[string]time.Time // When each saved or loaded entry expires
+}
+
+// NewIPInfoStore creates a store keeping lookups for ttl
+func NewIPInfoStore(db *Database, ttl time.Duration) *IPInfoStore {
+	return &IPInfoStore{
+		db:      db,
+		ttl:     ttl,
+		dirty:   make(map[string]bool),
+		expires: make(map[string]time.Time),
+	}
+}
+
+// Load fills the in-memory cache with the lookups that haven't expired, returning how many
+func (s *IPInfoStore) Load() (int, error) {
+	n := 0
+	err := s.db.LoadIPInfo(time.Now(), ipInfoLoadLimit, func(ip string, info IPInfo, expires time.Time) {
+		ipInfoCache.Store(ip, info)
+		s.mu.Lock()
+		s.expires[ip] = expires
+		s.mu.Unlock()
+		n++
+	})
+	return n, err
+}
+
+// Start saves lookups and expires old ones in the background
+func (s *IPInfoStore) Start() {
+	go func() {
+		ticker := time.NewTicker(ipInfoFlushInterval)
+		for range ticker.C {
+			s.Flush()
+			s.expire()
+		}
+	}()
+}
+
+// mark queues an address whose lookup finished to be saved
+func (s *IPInfoStore) mark(ip string) {
+	s.mu.Lock()
+	s.dirty[ip] = true
+	s.mu.Unlock()
+}
+
+// Flush saves the lookups that finished since the last flush
+func (s *IPInfoStore) Flush() {
+	s.mu.Lock()
+	dirty := s.dirty
+	s.dirty = make(map[string]bool)
+	s.mu.Unlock()
+	if len(dirty) == 0 {
+		return
+	}
+
+	now := time.Now()
+	expires := now.Add(s.ttl)
+	infos := make(map[string]IPInfo, len(dirty))
+	for ip := range dirty {
+		// What was looked up, without any label, so one removed while stopped doesn't linger
+		if cached, ok := ipInfoCache.Load(ip); ok {
+			info := cached.(IPInfo)
+			if info.Hostname != "" && info.Hostname == ipLabels.Label(ip) {
+				info.Hostname = ""
+			}
+			infos[ip] = info
+		}
+	}
+	if err := s.db.SaveIPInfo(infos, now, expires); err != nil {
+		log.Printf("Error saving IP info: %v", err)
+		// Retry on the next flush
+		s.mu.Lock()
+		for ip := range dirty {
+			s.dirty[ip] = true
+		}
+		s.mu.Unlock()
+		return
+	}
+
+	s.mu.Lock()
+	for ip := range dirty {
+		s.expires[ip] = expires
+	}
+	s.mu.Unlock()
+}
+
+// expire drops expired entries from the cache and the table
+func (s *IPInfoStore) expire() {
+	now := time.Now()
+	s.mu.Lock()
+	for ip, t := range s.expires {
+		if now.After(t) {
+			ipInfoCache.Delete(ip)
+			delete(s.expires, ip)
+		}
+	}
+	s.mu.Unlock()
+
+	if err := s.db.DeleteExpiredIPInfo(now); err != nil {
+		log.Printf("Error expiring IP info: %v", err)
+	}
+}
+
+// storeIPInfo caches what a finished lookup found about an address, saving it if a
+// store is configured
+func storeIPInfo(ip string, info IPInfo) {
+	ipInfoCache.Store(ip, info)
+	if ipInfoStore != nil {
+		ipInfoStore.mark(ip)
+	}
+}
+
+// ipInfoUpdateMu keeps lookups finishing together for one address from losing each
+// other's results
+var ipInfoUpdateMu sync.Mutex
+
+// updateIPInfo merges what a finished lookup found into what's cached for an address
+func updateIPInfo(ip string, update func(*IPInfo)) {
+	ipInfoUpdateMu.Lock()
+	defer ipInfoUpdateMu.Unlock()
+	info := IPInfo{}
+	if cached, ok := ipInfoCache.Load(ip); ok {
+		info = cached.(IPInfo)
+	}
+	update(&info)
+	storeIPInfo(ip, info)
+}
+
+func createIPInfoTables(db *sql.DB) error {
+	schema := `
+	CREATE TABLE IF NOT EXISTS ip_info (
+		ip TEXT PRIMARY KEY,
+		hostname TEXT,
+		country TEXT,
+		city TEXT,
+		lat REAL,
+		lon REAL,
+		asn TEXT,
+		resolved_at DATETIME NOT NULL,
+		expires_at DATETIME NOT NULL
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_ip_info_expires_at ON ip_info(expires_at);
+	`
+
+	if _, err := db.Exec(schema); err != nil {
+		return fmt.Errorf("failed to create IP info schema: %v", err)
+	}
+	return nil
+}
+
+// LoadIPInfo calls fn with each saved lookup that hasn't expired by now, up to limit of
+// them, most recently resolved first
+func (d *Database) LoadIPInfo(now time.Time, limit int, fn func(ip string, info IPInfo, expires time.Time)) error {
+	rows, err := d.db.Query(`
+		SELECT ip, hostname, country, city, lat, lon, asn, expires_at FROM ip_info
+		WHERE expires_at > ? ORDER BY resolved_at DESC LIMIT ?`, now, limit)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var ip string
+		var hostname, country, city, asn sql.NullString
+		var lat, lon sql.NullFloat64
+		var expires time.Time
+		if err := rows.Scan(&ip, &hostname, &country, &city, &lat, &lon, &asn, &expires); err != nil {
+			return err
+		}
+		fn(ip, IPInfo{
+			Hostname: hostname.String,
+			Country:  country.String,
+			City:     city.String,
+			Lat:      lat.Float64,
+			Lon:      lon.Float64,
+			ASN:      asn.String,
+		}, expires)
+	}
+	return rows.Err()
+}
+
+// SaveIPInfo stores lookups in one transaction, replacing earlier ones for the same IPs
+func (d *Database) SaveIPInfo(infos map[string]IPInfo, resolvedAt, expiresAt time.Time) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(`
+		INSERT INTO ip_info (ip, hostname, country, city, lat, lon, asn, resolved_at, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (ip) DO UPDATE SET
+			hostname = excluded.hostname,
+			country = excluded.country,
+			city = excluded.city,
+			lat = excluded.lat,
+			lon = excluded.lon,
+			asn = excluded.asn,
+			resolved_at = excluded.resolved_at,
+			expires_at = excluded.expires_at
+	`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for ip, info := range infos {
+		_, err := stmt.Exec(ip, info.Hostname, info.Country, info.City, info.Lat, info.Lon, info.ASN, resolvedAt, expiresAt)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// DeleteExpiredIPInfo removes the lookups that expired by now
+func (d *Database) DeleteExpiredIPInfo(now time.Time) error {
+	_, err := d.db.Exec("DELETE FROM ip_info WHERE expires_at <= ?", now)
+	return err
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Known process settings
+const (
+	knownProcessLearn   = time.Hour        // A host's processes are learned this long before new ones are reported
+	knownProcessCheck   = 10 * time.Second // How often new processes are reported and changes persisted
+	knownProcessMax     = 10000            // Processes remembered; beyond this, new ones aren't tracked
+	newProcessAlertName = "New process"
+)
+
+// KnownProcess is a process, on the Pi or an agent host, that has connected out
+type KnownProcess struct {
+	Host      string    `json:"host,omitempty"` // Agent hostname, "" for the Pi
+	Process   string    `json:"process"`
+	Exe       string    `json:"exe,omitempty"`
+	User      string    `json:"user,omitempty"`
+	FirstSeen time.Time `json:"firstSeen"`
+	LastSeen  time.Time `json:"lastSeen"`
+	Remote    string    `json:"remote,omitempty"` // Where it first connected to, as "host (ip:port/protocol)"
+}
+
+// knownProcessKey tells processes apart by name and executable, so a different binary
+// under a familiar name counts as new
+type knownProcessKey struct {
+	host, process, exe string
+}
+
+// newProcess is a process seen connecting out for the first time, waiting to be reported
+// with the bytes it has exchanged since
+type newProcess struct {
+	KnownProcess
+	bytes int64
+}
+
+// KnownProcesses remembers every process that has connected out from the Pi or an agent
+// host, and raises an alert the first time one it hasn't seen does, as a light egress
+// control: a process is only expected to reach the internet if it has before. A
+// connection is outbound when the process sends a SYN, or sends from a higher port than
+// the one it sends to, to a public address. Each host's processes are learned for its
+// first hour instead of reported, since everything is new then.
+type KnownProcesses struct {
+	db     *Database
+	alerts *AlertEngine
+
+	mu        sync.Mutex
+	processes map[knownProcessKey]*KnownProcess
+	learning  map[string]time.Time // Hosts whose processes are learned until then
+	pending   map[knownProcessKey]*newProcess
+	dirty     map[knownProcessKey]bool
+}
+
+// NewKnownProcesses creates the detector, loading the processes seen before from the database
+func NewKnownProcesses(db *Database, alerts *AlertEngine) *KnownProcesses {
+	kp := &KnownProcesses{
+		db:        db,
+		alerts:    alerts,
+		processes: make(map[knownProcessKey]*KnownProcess),
+		learning:  make(map[string]time.Time),
+		pending:   make(map[knownProcessKey]*newProcess),
+		dirty:     make(map[knownProcessKey]bool),
+	}
+	if db != nil {
+		processes, err := db.GetKnownProcesses()
+		if err != nil {
+			log.Printf("Error loading known processes: %v", err)
+		}
+		for i := range processes {
+			p := processes[i]
+			kp.processes[knownProcessKey{p.Host, p.Process, p.Exe}] = &p
+		}
+	}
+	// With nothing remembered for the Pi, every process would look new
+	if !kp.hasHostLocked("") {
+		kp.learning[""] = time.Now().Add(knownProcessLearn)
+	}
+	return kp
+}
+
+// hasHostLocked reports whether any process of a host is known. Must be called with kp.mu
+// held, or before the detector is shared.
+func (kp *KnownProcesses) hasHostLocked(host string) bool {
+	for key := range kp.processes {
+		if key.host == host {
+			return true
+		}
+	}
+	return false
+}
+
+// Start reports new processes and persists the known ones in the background
+func (kp *KnownProcesses) Start() {
+	go func() {
+		ticker := time.NewTicker(knownProcessCheck)
+		for range ticker.C {
+			kp.check()
+		}
+	}()
+}
+
+// outbound reports whether a packet is its process connecting out to the internet
+func outbound(p Packet) bool {
+	if !p.processSent || (p.Protocol != "TCP" && p.Protocol != "UDP") {
+		return false
+	}
+	ip := net.ParseIP(p.DstIP)
+	if ip == nil || isPrivateIP(ip) || ip.IsMulticast() || ip.IsUnspecified() || ip.Equal(net.IPv4bcast) {
+		return false
+	}
+	if p.tcpFlags&tcpFlagSYN != 0 {
+		return p.tcpFlags&tcpFlagACK == 0
+	}
+	return p.DstPort < p.SrcPort
+}
+
+// Observe implements PacketObserver
+func (kp *KnownProcesses) Observe(p Packet) {
+	if p.ProcessName == "" {
+		return
+	}
+	key := knownProcessKey{p.processHost, p.ProcessName, p.processExe}
+
+	kp.mu.Lock()
+	defer kp.mu.Unlock()
+	if known := kp.processes[key]; known != nil {
+		if p.Timestamp.After(known.LastSeen) {
+			known.LastSeen = p.Timestamp
+			kp.dirty[key] = true
+		}
+		if n := kp.pending[key]; n != nil {
+			n.bytes += int64(p.Length)
+		}
+		return
+	}
+	if !outbound(p) || len(kp.processes) >= knownProcessMax {
+		return
+	}
+
+	// An agent host's first process starts its learning period
+	until, learning := kp.learning[p.processHost]
+	if !learning && p.processHost != "" && !kp.hasHostLocked(p.processHost) {
+		until, learning = p.Timestamp.Add(knownProcessLearn), true
+		kp.learning[p.processHost] = until
+	}
+
+	remote := fmt.Sprintf("%s:%d/%s", p.DstIP, p.DstPort, p.Protocol)
+	if p.sni != "" {
+		remote = fmt.Sprintf("%s (%s)", p.sni, remote)
+	} else if p.DstHostname != "" {
+		remote = fmt.Sprintf("%s (%s)", p.DstHostname, remote)
+	}
+	known := &KnownProcess{
+		Host:      p.processHost,
+		Process:   p.ProcessName,
+		Exe:       p.processExe,
+		User:      p.ProcessUser,
+		FirstSeen: p.Timestamp,
+		LastSeen:  p.Timestamp,
+		Remote:    remote,
+	}
+	kp.processes[key] = known
+	kp.dirty[key] = true
+	if !learning || p.Timestamp.After(until) {
+		kp.pending[key] = &newProcess{KnownProcess: *known, bytes: int64(p.Length)}
+	}
+}
+
+// check raises an alert for each new process, with the bytes it exchanged up to now, and
+// persists what changed
+func (kp *KnownProcesses) check() {
+	kp.mu.Lock()
+	pending := make([]newProcess, 0, len(kp.pending))
+	for _, n := range kp.pending {
+		pending = append(pending, *n)
+	}
+	kp.pending = make(map[knownProcessKey]*newProcess)
+	dirty := make([]KnownProcess, 0, len(kp.dirty))
+	for key := range kp.dirty {
+		dirty = append(dirty, *kp.processes[key])
+	}
+	kp.dirty = make(map[knownProcessKey]bool)
+	for host, until := range kp.learning {
+		if time.Now().After(until) {
+			delete(kp.learning, host)
+		}
+	}
+	kp.mu.Unlock()
+
+	if kp.db != nil && len(dirty) > 0 {
+		if err := kp.db.SaveKnownProcesses(dirty); err != nil {
+			log.Printf("Error saving known processes: %v", err)
+		}
+	}
+	if kp.alerts == nil {
+		return
+	}
+	for _, n := range pending {
+		details := []string{}
+		if n.Exe != "" {
+			details = append(details, n.Exe)
+		}
+		if n.User != "" {
+			details = append(details, "user "+n.User)
+		}
+		name, subject := n.Process, n.Process
+		if len(details) > 0 {
+			name = fmt.Sprintf("%s (%s)", n.Process, strings.Join(details, ", "))
+		}
+		if n.Exe != "" {
+			subject = fmt.Sprintf("%s (%s)", n.Process, n.Exe)
+		}
+		where := "the Pi"
+		if n.Host != "" {
+			where = n.Host
+		}
+		kp.alerts.Raise(newProcessAlertName, subject, severityWarning,
+			fmt.Sprintf("New process %s on %s connected out for the first time, to %s, exchanging %s so far",
+				name, where, n.Remote, formatBytes(n.bytes)))
+	}
+}
+
+// Processes returns the processes seen connecting out, most recently first seen first
+func (kp *KnownProcesses) Processes() []KnownProcess {
+	kp.mu.Lock()
+	processes := make([]KnownProcess, 0, len(kp.processes))
+	for _, p := range kp.processes {
+		processes = append(processes, *p)
+	}
+	kp.mu.Unlock()
+
+	sort.Slice(processes, func(i, j int) bool {
+		return processes[i].FirstSeen.After(processes[j].FirstSeen)
+	})
+	return processes
+}
+
+func createKnownProcessTables(db *sql.DB) error {
+	schema := `
+	CREATE TABLE IF NOT EXISTS known_processes (
+		host TEXT NOT NULL DEFAULT '',
+		process TEXT NOT NULL,
+		exe TEXT NOT NULL DEFAULT '',
+		user TEXT,
+		remote TEXT,
+		first_seen INTEGER NOT NULL,
+		last_seen INTEGER NOT NULL,
+		PRIMARY KEY (host, process, exe)
+	);
+	`
+
+	if _, err := db.Exec(schema); err != nil {
+		return fmt.Errorf("failed to create known process schema: %v", err)
+	}
+	return nil
+}
+
+// SaveKnownProcesses stores when processes were first and last seen connecting out
+func (d *Database) SaveKnownProcesses(processes []KnownProcess) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(`
+		INSERT INTO known_processes (host, process, exe, user, remote, first_seen, last_seen) VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (host, process, exe) DO UPDATE SET last_seen = excluded.last_seen
+	`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, p := range processes {
+		if _, err := stmt.Exec(p.Host, p.Process, p.Exe, p.User, p.Remote, p.FirstSeen.Unix(), p.LastSeen.Unix()); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// GetKnownProcesses returns every process seen connecting out before
+func (d *Database) GetKnownProcesses() ([]KnownProcess, error) {
+	rows, err := d.db.Query("SELECT host, process, exe, user, remote, first_seen, last_seen FROM known_processes")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	processes := []KnownProcess{}
+	for rows.Next() {
+		var p KnownProcess
+		var user, remote sql.NullString
+		var firstSeen, lastSeen int64
+		if err := rows.Scan(&p.Host, &p.Process, &p.Exe, &user, &remote, &firstSeen, &lastSeen); err != nil {
+			return nil, err
+		}
+		p.User = user.String
+		p.Remote = remote.String
+		p.FirstSeen = time.Unix(firstSeen, 0)
+		p.LastSeen = time.Unix(lastSeen, 0)
+		processes = append(processes, p)
+	}
+	return processes, rows.Err()
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Kubernetes settings
+const (
+	kubeDefaultConfig  = "/etc/rancher/k3s/k3s.yaml" // Written by k3s on its servers
+	kubeServiceAccount = "/var/run/secrets/kubernetes.io/serviceaccount"
+	kubeRefresh        = 30 * time.Second
+	kubeNamePrefix     = "pod: " // How pods appear in process names and hostnames
+)
+
+// kube names the Kubernetes pods in the cluster, nil when there's none
+var kube *KubernetesPods
+
+// kubePodUIDPattern finds a pod's UID in a /proc/<pid>/cgroup path, e.g.
+// "0::/kubepods/besteffort/pod<uid>/<container>" or, with the systemd driver,
+// "0::/kubepods.slice/kubepods-besteffort.slice/kubepods-besteffort-pod<uid_with_underscores>.slice/..."
+var kubePodUIDPattern = regexp.MustCompile(`pod([0-9a-f]{8}[-_][0-9a-f]{4}[-_][0-9a-f]{4}[-_][0-9a-f]{4}[-_][0-9a-f]{12})`)
+
+// kubeConfig is what's needed to reach the API server
+type kubeConfig struct {
+	server                string
+	token                 string
+	caData, certData      []byte
+	keyData               []byte
+	insecureSkipTLSVerify bool
+	source                string // The kubeconfig file, or the service account directory
+}
+
+// KubernetesPods attributes traffic to the pods of a Kubernetes cluster, such as k3s on a
+// Pi cluster, asking the API server for them every 30 seconds. Pods are named after their
+// namespace and workload, as "pod: media/jellyfin", the workload being the Deployment,
+// StatefulSet, DaemonSet or Job that owns the pod, or the pod itself. Pods with their own
+// address are known by it, traffic to a hostPort counts as its pod's, and a process
+// found behind a connection on the Pi is matched to its pod through its cgroup, which
+// covers pods on the host network.
+type KubernetesPods struct {
+	config kubeConfig
+	client *http.Client
+
+	mu      sync.RWMutex
+	byIP    map[string]string // Pod address -> name
+	byPort  map[string]string // hostPort as "tcp/8096" -> name
+	byUID   map[string]string // Pod UID -> name
+	byPID   map[int32]string  // Processes already matched, "" for none; cleared each refresh
+	pods    int
+	lastErr string
+}
+
+// NewKubernetesPods creates the lookup for the API server in a kubeconfig file, or, with
+// path "", the one pi-track runs in, through its service account
+func NewKubernetesPods(path string) (*KubernetesPods, error) {
+	var config kubeConfig
+	var err error
+	if path == "" {
+		config, err = inClusterKubeConfig()
+	} else {
+		config, err = loadKubeConfig(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: config.insecureSkipTLSVerify}
+	if len(config.caData) > 0 {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(config.caData) {
+			return nil, fmt.Errorf("%s: invalid certificate authority", config.source)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if len(config.certData) > 0 {
+		cert, err := tls.X509KeyPair(config.certData, config.keyData)
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid client certificate: %v", config.source, err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return &KubernetesPods{
+		config: config,
+		client: &http.Client{
+			Timeout:   10 * time.Second,
+			Transport: &http.Transport{TLSClientConfig: tlsConfig},
+		},
+		byIP:   make(map[string]string),
+		byPort: make(map[string]string),
+		byUID:  make(map[string]string),
+		byPID:  make(map[int32]string),
+	}, nil
+}
+
+// inClusterKubeConfig reads the service account Kubernetes gives pods, for pi-track
+// running in the cluster itself, e.g. as a DaemonSet
+func inClusterKubeConfig() (kubeConfig, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return kubeConfig{}, fmt.Errorf("not running in a Kubernetes pod")
+	}
+	token, err := os.ReadFile(kubeServiceAccount + "/token")
+	if err != nil {
+		return kubeConfig{}, err
+	}
+	ca, _ := os.ReadFile(kubeServiceAccount + "/ca.crt")
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	return kubeConfig{
+		server: "https://" + host + ":" + port,
+		token:  strings.TrimSpace(string(token)),
+		caData: ca,
+		source: kubeServiceAccount,
+	}, nil
+}
+
+// loadKubeConfig reads the API server's address and credentials from a kubeconfig file.
+// It isn't a full YAML parser: the first cluster and user in the file are used, which
+// is all k3s's own file has.
+func loadKubeConfig(path string) (kubeConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return kubeConfig{}, err
+	}
+	values := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), 1<<20)
+	for scanner.Scan() {
+		line := strings.TrimPrefix(strings.TrimSpace(scanner.Text()), "- ")
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		key = strings.TrimSpace(key)
+		if _, seen := values[key]; !seen {
+			values[key] = strings.Trim(strings.TrimSpace(value), `"'`)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return kubeConfig{}, err
+	}
+
+	config := kubeConfig{
+		server:                strings.TrimSuffix(values["server"], "/"),
+		token:                 values["token"],
+		insecureSkipTLSVerify: values["insecure-skip-tls-verify"] == "true",
+		source:                path,
+	}
+	if config.server == "" {
+		return config, fmt.Errorf("%s: no server", path)
+	}
+	for _, f := range []struct {
+		key, fileKey string
+		dest         *[]byte
+	}{
+		{"certificate-authority-data", "certificate-authority", &config.caData},
+		{"client-certificate-data", "client-certificate", &config.certData},
+		{"client-key-data", "client-key", &config.keyData},
+	} {
+		if v := values[f.key]; v != "" {
+			if *f.dest, err = base64.StdEncoding.DecodeString(v); err != nil {
+				return config, fmt.Errorf("%s: invalid %s: %v", path, f.key, err)
+			}
+		} else if file := values[f.fileKey]; file != "" {
+			if *f.dest, err = os.ReadFile(file); err != nil {
+				return config, fmt.Errorf("%s: %v", path, err)
+			}
+		}
+	}
+	return config, nil
+}
+
+// Start lists the pods in the background, then again every 30 seconds
+func (k *KubernetesPods) Start() {
+	go func() {
+		for {
+			err := k.refresh()
+			k.mu.Lock()
+			if err != nil && err.Error() != k.lastErr {
+				log.Printf("Warning: failed to list Kubernetes pods: %v", err)
+			}
+			k.lastErr = ""
+			if err != nil {
+				k.lastErr = err.Error()
+			}
+			k.mu.Unlock()
+			time.Sleep(kubeRefresh)
+		}
+	}()
+}
+
+// refresh replaces the pods with the ones running now
+func (k *KubernetesPods) refresh() error {
+	req, err := http.NewRequest(http.MethodGet, k.config.server+"/api/v1/pods", nil)
+	if err != nil {
+		return err
+	}
+	if k.config.token != "" {
+		req.Header.Set("Authorization", "Bearer "+k.config.token)
+	}
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", k.config.server, resp.Status)
+	}
+	var list struct {
+		Items []struct {
+			Metadata struct {
+				Name            string            `json:"name"`
+				Namespace       string            `json:"namespace"`
+				UID             string            `json:"uid"`
+				Labels          map[string]string `json:"labels"`
+				OwnerReferences []struct {
+					Kind string `json:"kind"`
+					Name string `json:"name"`
+				} `json:"ownerReferences"`
+			} `json:"metadata"`
+			Spec struct {
+				HostNetwork bool `json:"hostNetwork"`
+				Containers  []struct {
+					Ports []struct {
+						HostPort int    `json:"hostPort"`
+						Protocol string `json:"protocol"`
+					} `json:"ports"`
+				} `json:"containers"`
+			} `json:"spec"`
+			Status struct {
+				Phase  string `json:"phase"`
+				PodIPs []struct {
+					IP string `json:"ip"`
+				} `json:"podIPs"`
+			} `json:"status"`
+		} `json:"items"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return err
+	}
+
+	byIP := make(map[string]string)
+	byPort := make(map[string]string)
+	byUID := make(map[string]string)
+	pods := 0
+	for _, pod := range list.Items {
+		// A finished pod's address is soon someone else's
+		if pod.Status.Phase == "Succeeded" || pod.Status.Phase == "Failed" {
+			continue
+		}
+		pods++
+		workload := pod.Metadata.Name
+		if len(pod.Metadata.OwnerReferences) > 0 {
+			owner := pod.Metadata.OwnerReferences[0]
+			workload = owner.Name
+			// A Deployment's pods belong to a ReplicaSet named "<deployment>-<pod-template-hash>"
+			if hash := pod.Metadata.Labels["pod-template-hash"]; owner.Kind == "ReplicaSet" && hash != "" {
+				workload = strings.TrimSuffix(owner.Name, "-"+hash)
+			}
+		}
+		name := pod.Metadata.Namespace + "/" + workload
+		byUID[pod.Metadata.UID] = name
+		// Pods on the host network share the node's addresses
+		if !pod.Spec.HostNetwork {
+			for _, ip := range pod.Status.PodIPs {
+				byIP[ip.IP] = name
+			}
+		}
+		for _, c := range pod.Spec.Containers {
+			for _, p := range c.Ports {
+				if p.HostPort != 0 {
+					protocol := p.Protocol
+					if protocol == "" {
+						protocol = "TCP"
+					}
+					byPort[strings.ToLower(protocol)+"/"+strconv.Itoa(p.HostPort)] = name
+				}
+			}
+		}
+	}
+
+	k.mu.Lock()
+	k.byIP, k.byPort, k.byUID, k.pods = byIP, byPort, byUID, pods
+	k.byPID = make(map[int32]string)
+	k.mu.Unlock()
+	return nil
+}
+
+// ForIP returns the name of the pod with an address, or ""
+func (k *KubernetesPods) ForIP(ip string) string {
+	if k == nil {
+		return ""
+	}
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.byIP[ip]
+}
+
+// ForPort returns the name of the pod a TCP or UDP hostPort on the Pi belongs to, or ""
+func (k *KubernetesPods) ForPort(protocol string, port uint16) string {
+	if k == nil {
+		return ""
+	}
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.byPort[strings.ToLower(protocol)+"/"+strconv.Itoa(int(port))]
+}
+
+// ForPID returns the name of the pod a process on the Pi runs in, or ""
+func (k *KubernetesPods) ForPID(pid int32) string {
+	if k == nil || pid <= 0 {
+		return ""
+	}
+	k.mu.RLock()
+	name, ok := k.byPID[pid]
+	k.mu.RUnlock()
+	if ok {
+		return name
+	}
+
+	cgroup, _ := os.ReadFile(fmt.Sprintf("/proc/%d/cgroup", pid))
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	for _, m := range kubePodUIDPattern.FindAllStringSubmatch(string(cgroup), -1) {
+		if n, ok := k.byUID[strings.ReplaceAll(m[1], "_", "-")]; ok {
+			name = n
+			break
+		}
+	}
+	k.byPID[pid] = name
+	return name
+}
+
+// Status reports the pods known and the last error listing them, for /api/enrichment
+func (k *KubernetesPods) Status() map[string]interface{} {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	status := map[string]interface{}{"server": k.config.server, "config": k.config.source, "pods": k.pods}
+	if k.lastErr != "" {
+		status["error"] = k.lastErr
+	}
+	return status
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ipLabelsSetting is where the labels set through the API are persisted
+const ipLabelsSetting = "ip_labels"
+
+// ipLabels are the names given to addresses and subnets, nil until main sets them up
+var ipLabels *IPLabels
+
+// IPLabels names addresses and subnets, e.g. 192.168.1.10 as "NAS" or 10.0.8.0/24 as
+// "Work VPN". A label stands in for the hostname wherever one is shown, and is what's
+// stored as the hostname of packets captured while it applies. The most specific match
+// wins, so a host can be named inside a labelled subnet.
+type IPLabels struct {
+	db *Database
+
+	mu      sync.RWMutex
+	labels  map[string]string // As given, keyed by address or CIDR
+	hosts   map[string]string // Single addresses, keyed by their canonical form
+	subnets []ipLabelSubnet   // Longest prefix first
+}
+
+type ipLabelSubnet struct {
+	network *net.IPNet
+	ones    int
+	label   string
+}
+
+// NewIPLabels creates the labels. Entries like "192.168.1.10=NAS" passed in replace the
+// saved labels; when none are, the labels saved through the API are used.
+func NewIPLabels(entries []string, db *Database) (*IPLabels, error) {
+	l := &IPLabels{db: db}
+	labels := make(map[string]string)
+	for _, e := range entries {
+		if strings.TrimSpace(e) == "" {
+			continue
+		}
+		target, label, ok := strings.Cut(e, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid label %q (expected <ip or cidr>=<label>)", e)
+		}
+		labels[strings.TrimSpace(target)] = strings.TrimSpace(label)
+	}
+	if len(labels) == 0 && db != nil {
+		if value, ok, err := db.GetSetting(ipLabelsSetting); err == nil && ok {
+			json.Unmarshal([]byte(value), &labels)
+		}
+	}
+	if err := l.set(labels); err != nil {
+		return nil, err
+	}
+	if len(labels) > 0 {
+		log.Printf("Labelling %d addresses and subnets", len(labels))
+	}
+	return l, nil
+}
+
+// set replaces the labels after checking every entry
+func (l *IPLabels) set(labels map[string]string) error {
+	hosts := make(map[string]string)
+	subnets := []ipLabelSubnet{}
+	for target, label := range labels {
+		if label == "" {
+			return fmt.Errorf("empty label for %s", target)
+		}
+		if ip := net.ParseIP(target); ip != nil {
+			hosts[ip.String()] = label
+			continue
+		}
+		_, network, err := net.ParseCIDR(target)
+		if err != nil {
+			return fmt.Errorf("invalid address or subnet %q", target)
+		}
+		ones, _ := network.Mask.Size()
+		subnets = append(subnets, ipLabelSubnet{network: network, ones: ones, label: label})
+	}
+	sort.Slice(subnets, func(i, j int) bool { return subnets[i].ones > subnets[j].ones })
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.labels, l.hosts, l.subnets = labels, hosts, subnets
+	return nil
+}
+
+// Label returns the label for an address, or "" if it has none
+func (l *IPLabels) Label(ip string) string {
+	if l == nil {
+		return ""
+	}
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if label, ok := l.hosts[ip]; ok {
+		return label
+	}
+	if len(l.subnets) == 0 {
+		return ""
+	}
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return ""
+	}
+	for _, s := range l.subnets {
+		if s.network.Contains(parsed) {
+			return s.label
+		}
+	}
+	return ""
+}
+
+// Labels returns the labels, keyed by address or CIDR
+func (l *IPLabels) Labels() map[string]string {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	labels := make(map[string]string, len(l.labels))
+	for target, label := range l.labels {
+		labels[target] = label
+	}
+	return labels
+}
+
+// SetLabels replaces the labels and saves them. Packets already stored keep the names
+// they were stored with.
+func (l *IPLabels) SetLabels(labels map[string]string) error {
+	if labels == nil {
+		labels = map[string]string{}
+	}
+	old := &IPLabels{}
+	l.mu.RLock()
+	old.hosts, old.subnets = l.hosts, l.subnets
+	l.mu.RUnlock()
+	if err := l.set(labels); err != nil {
+		return err
+	}
+
+	// Addresses named by a label that no longer applies get a hostname looked up the next
+	// time they're seen
+	ipInfoCache.Range(func(key, value interface{}) bool {
+		ip := key.(string)
+		if name := old.Label(ip); name != "" && value.(IPInfo).Hostname == name && l.Label(ip) != name {
+			updateIPInfo(ip, func(info *IPInfo) {
+				if info.Hostname == name {
+					info.Hostname = ""
+				}
+			})
+		}
+		return true
+	})
+	if l.db != nil {
+		data, _ := json.Marshal(labels)
+		return l.db.SetSetting(ipLabelsSetting, string(data))
+	}
+	return nil
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+)
+
+// LatencyTarget is a host probed by the latency monitor
+type LatencyTarget struct {
+	Label string `json:"label"`
+	IP    string `json:"ip"`
+}
+
+// LatencySample is the result of one probe
+type LatencySample struct {
+	Time       time.Time `json:"time"`
+	Target     string    `json:"target"`
+	RTTMs      float64   `json:"rttMs"`
+	Lost       bool      `json:"lost"`
+	TrafficBps float64   `json:"trafficBps"` // Capture throughput when the probe was sent
+}
+
+// LatencySummary describes recent probe results for one target
+type LatencySummary struct {
+	LatencyTarget
+	LastRTTMs   float64         `json:"lastRttMs"`
+	AvgRTTMs    float64         `json:"avgRttMs"`
+	MaxRTTMs    float64         `json:"maxRttMs"`
+	LossPercent float64         `json:"lossPercent"`
+	Samples     []LatencySample `json:"samples"`
+}
+
+// latencyWindow is how much probe history is kept in memory per target
+const latencyWindow = 5 * time.Minute
+
+// LatencyProber pings the default gateway and a few internet hosts, recording
+// round-trip time and loss alongside the traffic load at the time
+type LatencyProber struct {
+	targets  []LatencyTarget
+	interval time.Duration
+	timeout  time.Duration
+	store    *PacketStore
+	db       *Database
+
+	mu     sync.RWMutex
+	recent map[string][]LatencySample
+	seq    uint16
+}
+
+// NewLatencyProber creates a prober for the given targets; the default gateway is added when it can be found
+func NewLatencyProber(targets []string, interval time.Duration, store *PacketStore, db *Database) *LatencyProber {
+	lp := &LatencyProber{
+		interval: interval,
+		timeout:  time.Second,
+		store:    store,
+		db:       db,
+		recent:   make(map[string][]LatencySample),
+	}
+
+	if gw := defaultGateway(); gw != nil {
+		lp.targets = append(lp.targets, LatencyTarget{Label: "gateway", IP: gw.String()})
+	}
+
+	for _, t := range targets {
+		t = strings.TrimSpace(t)
+		if t == "" {
+			continue
+		}
+		ips, err := net.LookupIP(t)
+		if err != nil {
+			log.Printf("Warning: latency probe target %s not resolvable: %v", t, err)
+			continue
+		}
+		for _, ip := range ips {
+			if ip.To4() != nil {
+				lp.targets = append(lp.targets, LatencyTarget{Label: t, IP: ip.String()})
+				break
+			}
+		}
+	}
+
+	return lp
+}
+
+// Start begins probing in the background
+func (lp *LatencyProber) Start() error {
+	// Raw ICMP needs root; fall back to unprivileged ICMP sockets where the kernel allows them
+	privileged := true
+	conn, err := icmp.ListenPacket("ip4:icmp", "0.0.0.0")
+	if err != nil {
+		privileged = false
+		conn, err = icmp.ListenPacket("udp4", "0.0.0.0")
+		if err != nil {
+			return fmt.Errorf("failed to open ICMP socket: %v", err)
+		}
+	}
+
+	log.Printf("Latency probing %d targets every %s", len(lp.targets), lp.interval)
+
+	go func() {
+		ticker := time.NewTicker(lp.interval)
+		for range ticker.C {
+			lp.probeAll(conn, privileged)
+		}
+	}()
+	return nil
+}
+
+func (lp *LatencyProber) probeAll(conn *icmp.PacketConn, privileged bool) {
+	var bps float64
+	if lp.store != nil {
+		bps = lp.store.GetStats().BytesPerSec
+	}
+
+	samples := make([]LatencySample, 0, len(lp.targets))
+	for _, t := range lp.targets {
+		sample := LatencySample{Time: time.Now(), Target: t.IP, TrafficBps: bps}
+		rtt, err := lp.ping(conn, privileged, net.ParseIP(t.IP))
+		if err != nil {
+			sample.Lost = true
+		} else {
+			sample.RTTMs = float64(rtt.Microseconds()) / 1000
+		}
+		samples = append(samples, sample)
+	}
+
+	lp.mu.Lock()
+	cutoff := time.Now().Add(-latencyWindow)
+	for _, s := range samples {
+		recent := append(lp.recent[s.Target], s)
+		for len(recent) > 0 && recent[0].Time.Before(cutoff) {
+			recent = recent[1:]
+		}
+		lp.recent[s.Target] = recent
+	}
+	lp.mu.Unlock()
+
+	if lp.db != nil {
+		if err := lp.db.InsertLatencySamples(samples); err != nil {
+			log.Printf("Database latency insert error: %v", err)
+		}
+	}
+}
+
+// ping sends one ICMP echo and waits for the matching reply
+func (lp *LatencyProber) ping(conn *icmp.PacketConn, privileged bool, ip net.IP) (time.Duration, error) {
+	lp.seq++
+	seq := int(lp.seq)
+	id := os.Getpid() & 0xffff
+
+	msg := icmp.Message{
+		Type: ipv4.ICMPTypeEcho,
+		Body: &icmp.Echo{ID: id, Seq: seq, Data: []byte("pi-track")},
+	}
+	b, err := msg.Marshal(nil)
+	if err != nil {
+		return 0, err
+	}
+
+	var dst net.Addr = &net.IPAddr{IP: ip}
+	if !privileged {
+		dst = &net.UDPAddr{IP: ip}
+	}
+
+	start := time.Now()
+	if _, err := conn.WriteTo(b, dst); err != nil {
+		return 0, err
+	}
+	conn.SetReadDeadline(start.Add(lp.timeout))
+
+	buf := make([]byte, 1500)
+	for {
+		n, peer, err := conn.ReadFrom(buf)
+		if err != nil {
+			return 0, err
+		}
+		reply, err := icmp.ParseMessage(1, buf[:n])
+		if err != nil || reply.Type != ipv4.ICMPTypeEchoReply {
+			continue
+		}
+		echo, ok := reply.Body.(*icmp.Echo)
+		// Unprivileged sockets get their ID rewritten by the kernel, so only raw sockets check it
+		if !ok || echo.Seq != seq || (privileged && echo.ID != id) {
+			continue
+		}
+		var peerIP net.IP
+		switch addr := peer.(type) {
+		case *net.IPAddr:
+			peerIP = addr.IP
+		case *net.UDPAddr:
+			peerIP = addr.IP
+		}
+		if !peerIP.Equal(ip) {
+			continue
+		}
+		return time.Since(start), nil
+	}
+}
+
+// Summaries returns recent results per target
+func (lp *LatencyProber) Summaries() []LatencySummary {
+	lp.mu.RLock()
+	defer lp.mu.RUnlock()
+
+	summaries := make([]LatencySummary, 0, len(lp.targets))
+	for _, t := range lp.targets {
+		s := LatencySummary{LatencyTarget: t, Samples: append([]LatencySample{}, lp.recent[t.IP]...)}
+
+		var total float64
+		var received, lost int
+		for _, sample := range s.Samples {
+			if sample.Lost {
+				lost++
+				continue
+			}
+			received++
+			total += sample.RTTMs
+			s.LastRTTMs = sample.RTTMs
+			if sample.RTTMs > s.MaxRTTMs {
+				s.MaxRTTMs = sample.RTTMs
+			}
+		}
+		if received > 0 {
+			s.AvgRTTMs = total / float64(received)
+		}
+		if len(s.Samples) > 0 {
+			s.LossPercent = float64(lost) * 100 / float64(len(s.Samples))
+		}
+		summaries = append(summaries, s)
+	}
+	return summaries
+}
+
+// defaultGateway returns the IPv4 default gateway from the Linux routing table
+func defaultGateway() net.IP {
+	f, err := os.Open("/proc/net/route")
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Scan() // Header
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 || fields[1] != "00000000" || fields[2] == "00000000" {
+			continue
+		}
+		raw, err := hex.DecodeString(fields[2])
+		if err != nil || len(raw) != 4 {
+			continue
+		}
+		// The kernel prints the address in host (little-endian) byte order
+		ip := make(net.IP, 4)
+		binary.BigEndian.PutUint32(ip, binary.LittleEndian.Uint32(raw))
+		return ip
+	}
+	return nil
+}
+
+func createLatencyTables(db *sql.DB) error {
+	schema := `
+	CREATE TABLE IF NOT EXISTS latency_samples (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		timestamp INTEGER NOT NULL,
+		target TEXT NOT NULL,
+		rtt_ms REAL,
+		lost INTEGER DEFAULT 0,
+		traffic_bps REAL
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_latency_samples_timestamp ON latency_samples(timestamp);
+	`
+
+	if _, err := db.Exec(schema); err != nil {
+		return fmt.Errorf("failed to create latency schema: %v", err)
+	}
+	return nil
+}
+
+// InsertLatencySamples stores probe results
+func (d *Database) InsertLatencySamples(samples []LatencySample) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	for _, s := range samples {
+		var rtt interface{}
+		if !s.Lost {
+			rtt = s.RTTMs
+		}
+		_, err := tx.Exec("INSERT INTO latency_samples (timestamp, target, rtt_ms, lost, traffic_bps) VALUES (?, ?, ?, ?, ?)",
+			s.Time.Unix(), s.Target, rtt, s.Lost, s.TrafficBps)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// LatencyBucket aggregates probe results for one target over one time bucket
+type LatencyBucket struct {
+	Time        time.Time `json:"time"`
+	Target      string    `json:"target"`
+	AvgRTTMs    float64   `json:"avgRttMs"`
+	MaxRTTMs    float64   `json:"maxRttMs"`
+	LossPercent float64   `json:"lossPercent"`
+	TrafficBps  float64   `json:"trafficBps"`
+}
+
+// GetLatencyHistory returns probe results grouped into buckets of the given size
+func (d *Database) GetLatencyHistory(startTime, endTime *time.Time, bucket time.Duration) ([]LatencyBucket, error) {
+	size := int64(bucket.Seconds())
+	if size < 1 {
+		size = 60
+	}
+
+	query := `
+		SELECT (timestamp / ?) * ? AS b, target,
+			COALESCE(AVG(rtt_ms), 0), COALESCE(MAX(rtt_ms), 0),
+			SUM(lost) * 100.0 / COUNT(*), COALESCE(AVG(traffic_bps), 0)
+		FROM latency_samples WHERE 1=1`
+	args := []interface{}{size, size}
+	if startTime != nil {
+		query += " AND timestamp >= ?"
+		args = append(args, startTime.Unix())
+	}
+	if endTime != nil {
+		query += " AND timestamp <= ?"
+		args = append(args, endTime.Unix())
+	}
+	query += " GROUP BY b, target ORDER BY b"
+
+	rows, err := d.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	buckets := []LatencyBucket{}
+	for rows.Next() {
+		var b LatencyBucket
+		var ts int64
+		if err := rows.Scan(&ts, &b.Target, &b.AvgRTTMs, &b.MaxRTTMs, &b.LossPercent, &b.TrafficBps); err != nil {
+			return nil, err
+		}
+		b.Time = time.Unix(ts, 0)
+		buckets = append(buckets, b)
+	}
+	return buckets, rows.Err()
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LivePacketQuery selects packets from the in-memory buffer for /api/packets. Packet IDs
+// increase by one per packet, so they double as cursors: Before pages back through older
+// packets and After polls for new ones.
+type LivePacketQuery struct {
+	Filter       string          // Substring of an IP, protocol, application, hostname or info, as for history
+	Query        *DisplayFilter  // Display filter expression; nil for none
+	Protocols    map[string]bool // Upper case; empty for any
+	Applications map[string]bool // Upper case; empty for any
+	Network      *net.IPNet      // Either end in this address or range
+	Port         uint16          // Either port; 0 for any
+	Country      string
+	Interface    string
+	ExcludeIPs   []string
+	Before       int64 // Only packets with a lower ID; 0 for none
+	After        int64 // Only packets with a higher ID; 0 for none
+	Limit        int
+}
+
+// parseLivePacketQuery reads the /api/packets filters from the request
+func parseLivePacketQuery(r *http.Request) (LivePacketQuery, error) {
+	v := r.URL.Query()
+	q := LivePacketQuery{
+		Filter:       strings.ToLower(v.Get("filter")),
+		Protocols:    upperSet(v.Get("protocol")),
+		Applications: upperSet(v.Get("application")),
+		Country:      v.Get("country"),
+		Interface:    v.Get("interface"),
+		Limit:        500,
+	}
+	if exclude := v.Get("exclude"); exclude != "" {
+		q.ExcludeIPs = strings.Split(exclude, ",")
+	}
+
+	var err error
+	if q.Query, err = parseDisplayFilterParam(v, false); err != nil {
+		return q, err
+	}
+	if s := v.Get("ip"); s != "" {
+		network, err := parseIPNet(s)
+		if err != nil {
+			return q, err
+		}
+		q.Network = network
+	}
+	if s := v.Get("port"); s != "" {
+		port, err := strconv.ParseUint(s, 10, 16)
+		if err != nil {
+			return q, fmt.Errorf("invalid port %q", s)
+		}
+		q.Port = uint16(port)
+	}
+	if s := v.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			return q, fmt.Errorf("invalid limit %q", s)
+		}
+		q.Limit = n
+	}
+	for name, dst := range map[string]*int64{"before": &q.Before, "after": &q.After} {
+		if s := v.Get(name); s != "" {
+			id, err := strconv.ParseInt(s, 10, 64)
+			if err != nil || id < 0 {
+				return q, fmt.Errorf("invalid %s %q (expected a packet ID)", name, s)
+			}
+			*dst = id
+		}
+	}
+	if q.Before != 0 && q.After != 0 {
+		return q, fmt.Errorf("before and after can't be combined")
+	}
+	return q, nil
+}
+
+// parseIPNet parses an ip= parameter, an address or a CIDR range
+func parseIPNet(s string) (*net.IPNet, error) {
+	cidr := s
+	if !strings.Contains(cidr, "/") {
+		if strings.Contains(cidr, ":") {
+			cidr += "/128"
+		} else {
+			cidr += "/32"
+		}
+	}
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ip %q (expected an address or CIDR range)", s)
+	}
+	return network, nil
+}
+
+// upperSet splits a comma-separated list into a set of upper-case names
+func upperSet(list string) map[string]bool {
+	set := make(map[string]bool)
+	for _, s := range strings.Split(list, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			set[strings.ToUpper(s)] = true
+		}
+	}
+	return set
+}
+
+// matches reports whether a packet passes the query's filters, ignoring the cursor
+func (q LivePacketQuery) matches(p *Packet) bool {
+	if len(q.Protocols) > 0 && !q.Protocols[strings.ToUpper(p.Protocol)] {
+		return false
+	}
+	if len(q.Applications) > 0 && !q.Applications[strings.ToUpper(p.Application)] {
+		return false
+	}
+	if q.Port != 0 && p.SrcPort != q.Port && p.DstPort != q.Port {
+		return false
+	}
+	if q.Interface != "" && p.Interface != q.Interface {
+		return false
+	}
+	if q.Country != "" && p.SrcCountry != q.Country && p.DstCountry != q.Country {
+		return false
+	}
+	for _, ip := range q.ExcludeIPs {
+		if ip = strings.TrimSpace(ip); ip != "" && (p.SrcIP == ip || p.DstIP == ip) {
+			return false
+		}
+	}
+	if q.Network != nil && !q.Network.Contains(net.ParseIP(p.SrcIP)) && !q.Network.Contains(net.ParseIP(p.DstIP)) {
+		return false
+	}
+	if q.Query != nil && !q.Query.Match(p) {
+		return false
+	}
+	if q.Filter == "" {
+		return true
+	}
+	for _, field := range []string{p.SrcIP, p.DstIP, p.Protocol, p.Application, p.SrcHostname, p.DstHostname, p.Info} {
+		if strings.Contains(strings.ToLower(field), q.Filter) {
+			return true
+		}
+	}
+	return false
+}
+
+// FindPackets returns up to q.Limit matching packets, oldest first, and how many packets
+// in the buffer match regardless of the cursor. Without a cursor or with Before, the page
+// is the newest matches; with After, it is the oldest matches after that ID.
+func (ps *PacketStore) FindPackets(q LivePacketQuery) ([]Packet, int) {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+
+	page := make([]Packet, 0)
+	total := 0
+	if q.After != 0 {
+		for i := range ps.packets {
+			p := &ps.packets[i]
+			if !q.matches(p) {
+				continue
+			}
+			total++
+			if p.ID > q.After && len(page) < q.Limit {
+				page = append(page, *p)
+			}
+		}
+		return page, total
+	}
+
+	for i := len(ps.packets) - 1; i >= 0; i-- {
+		p := &ps.packets[i]
+		if !q.matches(p) {
+			continue
+		}
+		total++
+		if (q.Before == 0 || p.ID < q.Before) && len(page) < q.Limit {
+			page = append(page, *p)
+		}
+	}
+	// Collected newest first
+	for i, j := 0, len(page)-1; i < j; i, j = i+1, j-1 {
+		page[i], page[j] = page[j], page[i]
+	}
+	return page, total
+}
+
+// RemovePackets drops the buffered packets matching q, ignoring its cursor and limit, that
+// were captured in the range, returning how many were removed. Statistics are unchanged.
+func (ps *PacketStore) RemovePackets(q LivePacketQuery, startTime, endTime *time.Time) int {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	kept := ps.packets[:0]
+	for i := range ps.packets {
+		p := &ps.packets[i]
+		inRange := (startTime == nil || !p.Timestamp.Before(*startTime)) && (endTime == nil || !p.Timestamp.After(*endTime))
+		if !inRange || !q.matches(p) {
+			kept = append(kept, *p)
+		}
+	}
+	removed := len(ps.packets) - len(kept)
+	for i := len(kept); i < len(ps.packets); i++ {
+		ps.packets[i] = Packet{}
+	}
+	ps.packets = kept
+	return removed
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Log levels, in increasing severity. Zero means "not subscribed" for WebSocket clients.
+const (
+	logLevelDebug int32 = iota + 1
+	logLevelInfo
+	logLevelWarn
+	logLevelError
+)
+
+var logLevelNames = map[int32]string{
+	logLevelDebug: "debug",
+	logLevelInfo:  "info",
+	logLevelWarn:  "warn",
+	logLevelError: "error",
+}
+
+// parseLogLevel converts a level name to its value, defaulting to info
+func parseLogLevel(name string) int32 {
+	if level, ok := lookupLogLevel(name); ok {
+		return level
+	}
+	return logLevelInfo
+}
+
+// lookupLogLevel converts a level name to its value, reporting whether it's known
+func lookupLogLevel(name string) (int32, bool) {
+	for level, n := range logLevelNames {
+		if strings.EqualFold(name, n) {
+			return level, true
+		}
+	}
+	if strings.EqualFold(name, "warning") {
+		return logLevelWarn, true
+	}
+	return 0, false
+}
+
+// LogFilter drops log lines below a level, set with -log-level, before they reach stderr
+// and the LogBuffer
+type LogFilter struct {
+	min atomic.Int32
+	w   io.Writer
+}
+
+// NewLogFilter creates a filter passing lines at info and above to w
+func NewLogFilter(w io.Writer) *LogFilter {
+	f := &LogFilter{w: w}
+	f.min.Store(logLevelInfo)
+	return f
+}
+
+// SetLevel changes the lowest level passed on
+func (f *LogFilter) SetLevel(level int32) {
+	f.min.Store(level)
+}
+
+// Write implements io.Writer for the log package
+func (f *LogFilter) Write(p []byte) (int, error) {
+	if classifyLogLevel(logMessage(p)) < f.min.Load() {
+		return len(p), nil
+	}
+	return f.w.Write(p)
+}
+
+// logMessage returns a line written by the log package without its trailing newline and
+// the standard "2006/01/02 15:04:05 " prefix
+func logMessage(p []byte) string {
+	msg := strings.TrimRight(string(p), "\n")
+	if len(msg) > 20 && msg[4] == '/' && msg[7] == '/' && msg[13] == ':' {
+		msg = msg[20:]
+	}
+	return msg
+}
+
+// LogEntry is one captured log line
+type LogEntry struct {
+	Seq     int64     `json:"seq"`
+	Time    time.Time `json:"time"`
+	Level   string    `json:"level"`
+	Message string    `json:"message"`
+
+	level int32
+}
+
+// LogBuffer keeps the most recent log lines in memory. It is installed as the
+// log package's output (alongside stderr) so existing log.Printf calls are captured.
+type LogBuffer struct {
+	mu      sync.Mutex
+	entries []LogEntry
+	next    int
+	full    bool
+	seq     int64
+	onEntry func(LogEntry)
+}
+
+// NewLogBuffer creates a ring buffer holding up to size entries
+func NewLogBuffer(size int) *LogBuffer {
+	return &LogBuffer{entries: make([]LogEntry, size)}
+}
+
+// OnEntry registers a callback invoked for every new entry
+func (lb *LogBuffer) OnEntry(fn func(LogEntry)) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	lb.onEntry = fn
+}
+
+// Write implements io.Writer for the log package
+func (lb *LogBuffer) Write(p []byte) (int, error) {
+	// The entry carries its own time
+	msg := logMessage(p)
+	level := classifyLogLevel(msg)
+	entry := LogEntry{
+		Time:    time.Now(),
+		Level:   logLevelNames[level],
+		Message: msg,
+		level:   level,
+	}
+
+	lb.mu.Lock()
+	lb.seq++
+	entry.Seq = lb.seq
+	lb.entries[lb.next] = entry
+	lb.next = (lb.next + 1) % len(lb.entries)
+	if lb.next == 0 {
+		lb.full = true
+	}
+	onEntry := lb.onEntry
+	lb.mu.Unlock()
+
+	if onEntry != nil {
+		onEntry(entry)
+	}
+
+	return len(p), nil
+}
+
+// classifyLogLevel infers a level from the message text, since the codebase logs
+// through plain log.Printf with conventional "Warning:"/"error" wording
+func classifyLogLevel(msg string) int32 {
+	lower := strings.ToLower(msg)
+	switch {
+	case strings.HasPrefix(lower, "debug"):
+		// Even when it mentions an error
+		return logLevelDebug
+	case strings.Contains(lower, "error"), strings.Contains(lower, "fatal"), strings.Contains(lower, "failed"):
+		return logLevelError
+	case strings.Contains(lower, "warning"), strings.Contains(lower, "warn:"):
+		return logLevelWarn
+	}
+	return logLevelInfo
+}
+
+// Entries returns buffered entries at or above minLevel with a sequence number
+// greater than since, oldest first, limited to the newest limit entries
+func (lb *LogBuffer) Entries(minLevel int32, since int64, limit int) []LogEntry {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	ordered := lb.entries[:lb.next]
+	if lb.full {
+		ordered = append(append([]LogEntry{}, lb.entries[lb.next:]...), lb.entries[:lb.next]...)
+	}
+
+	result := []LogEntry{}
+	for _, e := range ordered {
+		if e.Seq > since && e.level >= minLevel {
+			result = append(result, e)
+		}
+	}
+
+	if limit > 0 && len(result) > limit {
+		result = result[len(result)-limit:]
+	}
+	return result
+}
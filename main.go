@@ -1,17 +1,25 @@
 package main
 
 import (
+	"database/sql"
 	"embed"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"io/fs"
 	"log"
 	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
 	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/google/gopacket"
@@ -42,6 +50,30 @@ type Packet struct {
 	SrcCountry  string    `json:"srcCountry"`
 	DstCountry  string    `json:"dstCountry"`
 	ProcessName string    `json:"processName"`
+	Interface   string    `json:"interface"` // Capture interface
+	SrcASN      string    `json:"srcAsn,omitempty"`
+	DstASN      string    `json:"dstAsn,omitempty"`
+	ProcessUser string    `json:"processUser,omitempty"` // User running ProcessName's process
+	ProcessUnit string    `json:"processUnit,omitempty"` // systemd unit ProcessName's process runs in, e.g. nginx.service
+	// How sure the Pi's own process attribution is: polled, traced or uncertain
+	ProcessConfidence string `json:"processConfidence,omitempty"`
+
+	tcpFlags    uint8          // NetFlow-style TCP flag bits, used for flow aggregation
+	rtp         *rtpHeader     // Set when the UDP payload looks like RTP
+	dhcp        *layers.DHCPv4 // Set for DHCP messages
+	sni         string         // TLS server name, set on ClientHello packets
+	dns         *layers.DNS    // Set for DNS messages
+	processSent bool           // ProcessName's process sent it rather than received it
+	processPID  int32          // ProcessName's process, 0 if unknown
+	processExe  string         // Its executable path, "" if unknown
+	processHash string         // Its executable's SHA-256, with -process-hash
+	processHost string         // The agent host ProcessName's process runs on, "" for the Pi
+	icmpType    uint8          // ICMPv4 type and code, when Protocol is ICMP
+	icmpCode    uint8
+	payload     []byte         // Transport payload, for signature matching; not kept in the packet buffer
+	stored      *storedPayload // Start of the payload to keep in the database, when selected
+	raw         []byte         // Start of the frame, for /api/packets/{id}
+	linkType    layers.LinkType
 }
 
 // Stats holds network statistics
@@ -55,16 +87,25 @@ type Stats struct {
 	TopTalkers       []Talker         `json:"topTalkers"`
 	ApplicationStats map[string]int64 `json:"applicationStats"`
 	ProcessStats     map[string]int64 `json:"processStats"`
+	UserStats        map[string]int64 `json:"userStats"` // Bytes by the user running the process
+	UnitStats        map[string]int64 `json:"unitStats"` // Bytes by the systemd unit the process runs in
 	StartTime        time.Time        `json:"startTime"`
 }
 
 // Talker represents a host and their traffic stats
 type Talker struct {
-	IP       string `json:"ip"`
-	Packets  int64  `json:"packets"`
-	Bytes    int64  `json:"bytes"`
-	Hostname string `json:"hostname"`
-	Country  string `json:"country"`
+	IP       string    `json:"ip"`
+	Packets  int64     `json:"packets"`
+	Bytes    int64     `json:"bytes"`
+	Hostname string    `json:"hostname"`
+	Country  string    `json:"country"`
+	City     string    `json:"city,omitempty"`
+	Lat      float64   `json:"lat,omitempty"`
+	Lon      float64   `json:"lon,omitempty"`
+	ASN      string    `json:"asn,omitempty"`
+	Cloud    *CloudTag `json:"cloud,omitempty"` // With -cloud-ranges
+	// "tor" for a Tor exit node, "vpn" for a VPN endpoint, with -anonymizers
+	Anonymizer string `json:"anonymizer,omitempty"`
 }
 
 // Connection represents a network connection
@@ -85,10 +126,160 @@ type Connection struct {
 	DstCountry  string    `json:"dstCountry"`
 }
 
-// wsClient wraps a WebSocket connection with a send channel for thread-safe writes
+// PacketObserver consumes parsed packets from the capture loop
+type PacketObserver interface {
+	Observe(p Packet)
+}
+
+// wsClient wraps a WebSocket connection with a send channel for thread-safe writes.
+// Server-Sent Events clients use it too, without a connection.
 type wsClient struct {
-	conn *websocket.Conn
-	send chan []byte
+	conn     *websocket.Conn
+	send     chan []byte
+	logLevel atomic.Int32                  // Minimum level of log lines to stream, 0 when not subscribed
+	logsOK   bool                          // Whether it may subscribe to log lines, which need the admin scope
+	types    map[string]bool               // Message types to send, nil for all; fixed once registered
+	filter   atomic.Pointer[DisplayFilter] // Display filter packet messages must pass, nil for all
+	follow   atomic.Pointer[connFollow]    // The one connection to send packets of, nil for all
+
+	channels       atomic.Uint32 // Channels subscribed to, see wsChannels
+	channelsChosen atomic.Bool   // Whether the client picked its channels rather than getting all
+	replayedTo     atomic.Int64  // Last packet ID covered by a resume replay, not to be sent again
+	statsDeltas    bool          // Send statsDelta messages rather than full stats; fixed once registered
+	paused         atomic.Bool   // Packets are held back until the client unpauses
+	sampler        packetSampler // Limits the packets sent to the client each second
+
+	store *PacketStore
+	clientStats
+}
+
+// checkClientQuery validates the ?channels=, ?stats=, ?rate= and ?follow= parameters of a
+// live client
+func checkClientQuery(r *http.Request) error {
+	if _, err := parseChannels(r.URL.Query().Get("channels")); err != nil {
+		return err
+	}
+	if _, err := parseClientRate(r.URL.Query().Get("rate")); err != nil {
+		return err
+	}
+	if conn := r.URL.Query().Get("follow"); conn != "" {
+		if _, err := parseFollow(conn); err != nil {
+			return err
+		}
+	}
+	if s := r.URL.Query().Get("stats"); s != "" && s != "full" && s != "delta" {
+		return fmt.Errorf("invalid stats %q (expected full or delta)", s)
+	}
+	return nil
+}
+
+// newWSClient creates a client for a request, subscribed to the channels in its
+// ?channels= list, or to all of them if the list is empty, sent stats deltas with
+// ?stats=delta and at most ?rate= packets a second, of the ?follow= connection only if set
+func newWSClient(store *PacketStore, conn *websocket.Conn, r *http.Request) (*wsClient, error) {
+	if err := checkClientQuery(r); err != nil {
+		return nil, err
+	}
+	kind := "websocket"
+	if conn == nil {
+		kind = "events"
+	}
+	c := &wsClient{conn: conn, send: make(chan []byte, 256), store: store, clientStats: newClientStats(r, kind)}
+	c.statsDeltas = r.URL.Query().Get("stats") == "delta"
+	c.logsOK = requestHasScope(r, scopeAdmin)
+	rate, _ := parseClientRate(r.URL.Query().Get("rate"))
+	c.sampler.setRate(rate)
+	if conn := r.URL.Query().Get("follow"); conn != "" {
+		f, _ := parseFollow(conn)
+		c.follow.Store(f)
+	}
+	channels := r.URL.Query().Get("channels")
+	set, _ := parseChannels(channels)
+	if strings.TrimSpace(channels) == "" {
+		set = channelsAll
+	} else {
+		c.channelsChosen.Store(true)
+	}
+	c.channels.Store(set)
+	return c, nil
+}
+
+// errLogsScope refuses log subscriptions from API keys without the admin scope, which
+// /api/logs needs too
+var errLogsScope = errors.New("streaming logs needs the admin scope")
+
+// handleMessage processes a control message sent by the client, e.g.
+// {"type":"subscribe","channel":"stats,alerts"}, {"type":"unsubscribe","channel":"packets"},
+// {"type":"subscribe","channel":"logs","level":"warn"} or
+// {"type":"filter","query":"ip == 192.168.1.5 && app == \"HTTPS\""},
+// {"type":"resume","token":"<resume token from the last packets message>"},
+// {"type":"pause"}, {"type":"unpause"}, {"type":"rate","rate":20},
+// {"type":"follow","connection":"192.168.1.5:51234-142.250.1.1:443/TCP"} or {"type":"unfollow"}
+func (c *wsClient) handleMessage(data []byte) {
+	var msg struct {
+		Type    string      `json:"type"`
+		Channel string      `json:"channel"`
+		Level   string      `json:"level"`
+		Query   string      `json:"query"`
+		Token   string      `json:"token"`
+		Rate    json.Number `json:"rate"`
+		Conn    string      `json:"connection"`
+	}
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return
+	}
+
+	switch {
+	case msg.Type == "subscribe" && msg.Channel == "logs":
+		if !c.logsOK {
+			c.reply("logs", map[string]string{"error": errLogsScope.Error()})
+			return
+		}
+		c.logLevel.Store(parseLogLevel(msg.Level))
+	case msg.Type == "unsubscribe" && msg.Channel == "logs":
+		c.logLevel.Store(0)
+	case msg.Type == "subscribe" || msg.Type == "unsubscribe":
+		c.subscribe(msg.Channel, msg.Type == "subscribe")
+	case msg.Type == "filter":
+		c.setFilter(msg.Query)
+	case msg.Type == "resume":
+		c.store.Resume(c, msg.Token)
+	case msg.Type == "pause" || msg.Type == "unpause":
+		c.setPaused(msg.Type == "pause")
+	case msg.Type == "rate":
+		c.setRate(msg.Rate.String())
+	case msg.Type == "follow":
+		c.setFollow(msg.Conn)
+	case msg.Type == "unfollow":
+		c.setFollow("")
+	}
+}
+
+// setFilter replaces the client's packet filter, or removes it when query is empty, and
+// answers with a filter message carrying the filter in effect or why it was rejected
+func (c *wsClient) setFilter(query string) {
+	reply := map[string]string{"query": ""}
+	if strings.TrimSpace(query) == "" {
+		c.filter.Store(nil)
+	} else if f, err := ParseDisplayFilter(query); err != nil {
+		reply["error"] = err.Error()
+		if current := c.filter.Load(); current != nil {
+			reply["query"] = current.String()
+		}
+	} else {
+		c.filter.Store(f)
+		reply["query"] = f.String()
+	}
+	c.reply("filter", reply)
+}
+
+// reply sends the client the answer to one of its control messages
+func (c *wsClient) reply(messageType string, data interface{}) {
+	msg, _ := json.Marshal(map[string]interface{}{"type": messageType, "data": data})
+	select {
+	case c.send <- msg:
+	default:
+	}
 }
 
 // PacketStore holds captured packets and statistics
@@ -102,21 +293,32 @@ type PacketStore struct {
 	connections     map[string]*Connection
 	clients         map[*wsClient]bool
 	clientsMu       sync.RWMutex
+	pending         []Packet // Packets waiting for the next batched broadcast
+	pendingMu       sync.Mutex
+	slowClients     string // What to do with clients that can't keep up, see slowClientDegrade
 	lastStatsUpdate time.Time
 	packetsWindow   []time.Time
 	bytesWindow     []int
 }
 
 type ipTraffic struct {
-	packets int64
-	bytes   int64
+	packets   int64 // Sent by this IP
+	bytes     int64
+	inPackets int64 // Received by this IP
+	inBytes   int64
 }
 
-var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool {
-		return true
-	},
-}
+// WebSocket keepalive: clients are pinged every wsPingPeriod and dropped if no pong or
+// other message arrives within wsPongWait, or a write takes longer than wsWriteWait
+const (
+	wsWriteWait  = 10 * time.Second
+	wsPongWait   = 60 * time.Second
+	wsPingPeriod = wsPongWait * 9 / 10
+)
+
+// upgrader accepts WebSocket connections from the origins the CORS policy allows; main sets
+// CheckOrigin once the policy is known
+var upgrader = websocket.Upgrader{}
 
 // NewPacketStore creates a new packet store
 func NewPacketStore(maxPackets int) *PacketStore {
@@ -128,11 +330,14 @@ func NewPacketStore(maxPackets int) *PacketStore {
 			CountryStats:     make(map[string]int64),
 			ApplicationStats: make(map[string]int64),
 			ProcessStats:     make(map[string]int64),
+			UserStats:        make(map[string]int64),
+			UnitStats:        make(map[string]int64),
 			StartTime:        time.Now(),
 		},
 		ipStats:         make(map[string]*ipTraffic),
 		connections:     make(map[string]*Connection),
 		clients:         make(map[*wsClient]bool),
+		slowClients:     slowClientDegrade,
 		lastStatsUpdate: time.Now(),
 		packetsWindow:   make([]time.Time, 0),
 		bytesWindow:     make([]int, 0),
@@ -146,6 +351,7 @@ func (ps *PacketStore) AddPacket(p Packet) {
 
 	ps.packetID++
 	p.ID = ps.packetID
+	p.payload = nil
 
 	// Add to packet list (circular buffer)
 	if len(ps.packets) >= ps.maxPackets {
@@ -178,11 +384,24 @@ func (ps *PacketStore) AddPacket(p Packet) {
 		ps.ipStats[p.SrcIP].packets++
 		ps.ipStats[p.SrcIP].bytes += int64(p.Length)
 	}
+	if p.DstIP != "" {
+		if ps.ipStats[p.DstIP] == nil {
+			ps.ipStats[p.DstIP] = &ipTraffic{}
+		}
+		ps.ipStats[p.DstIP].inPackets++
+		ps.ipStats[p.DstIP].inBytes += int64(p.Length)
+	}
 
 	// Track Process Stats
 	if p.ProcessName != "" {
 		ps.stats.ProcessStats[p.ProcessName] += int64(p.Length)
 	}
+	if p.ProcessUser != "" {
+		ps.stats.UserStats[p.ProcessUser] += int64(p.Length)
+	}
+	if p.ProcessUnit != "" {
+		ps.stats.UnitStats[p.ProcessUnit] += int64(p.Length)
+	}
 
 	// Track connections
 	if p.SrcPort > 0 || p.DstPort > 0 {
@@ -191,6 +410,13 @@ func (ps *PacketStore) AddPacket(p Packet) {
 			conn.Packets++
 			conn.Bytes += int64(p.Length)
 			conn.LastSeen = p.Timestamp
+			switch {
+			case p.tcpFlags&(tcpFlagFIN|tcpFlagRST) != 0:
+				conn.State = connStateClosed
+			case p.tcpFlags&tcpFlagSYN != 0 && p.tcpFlags&tcpFlagACK == 0:
+				// The ports were reused for a new connection
+				conn.State = connStateActive
+			}
 		} else {
 			ps.connections[connKey] = &Connection{
 				SrcIP:     p.SrcIP,
@@ -202,7 +428,7 @@ func (ps *PacketStore) AddPacket(p Packet) {
 				Bytes:     int64(p.Length),
 				FirstSeen: p.Timestamp,
 				LastSeen:  p.Timestamp,
-				State:     "active",
+				State:     connStateActive,
 			}
 		}
 	}
@@ -235,14 +461,63 @@ func (ps *PacketStore) AddPacket(p Packet) {
 
 // GetStats returns current statistics
 func (ps *PacketStore) GetStats() Stats {
+	return ps.statsSnapshot(true)
+}
+
+// statsSnapshot copies the statistics, leaving out the top talkers and country stats
+// unless talkers is set, since working those out means going through every IP seen
+func (ps *PacketStore) statsSnapshot(talkers bool) Stats {
 	ps.mu.RLock()
 	defer ps.mu.RUnlock()
 
+	stats := ps.stats
+	if talkers {
+		stats.TopTalkers, stats.CountryStats = ps.topTalkers()
+	} else {
+		stats.TopTalkers, stats.CountryStats = nil, nil
+	}
+
+	// Deep copy maps to avoid race conditions during JSON marshaling
+	stats.ProtocolStats = make(map[string]int64, len(ps.stats.ProtocolStats))
+	for k, v := range ps.stats.ProtocolStats {
+		stats.ProtocolStats[k] = v
+	}
+
+	stats.ApplicationStats = make(map[string]int64, len(ps.stats.ApplicationStats))
+	for k, v := range ps.stats.ApplicationStats {
+		stats.ApplicationStats[k] = v
+	}
+
+	stats.ProcessStats = make(map[string]int64, len(ps.stats.ProcessStats))
+	for k, v := range ps.stats.ProcessStats {
+		stats.ProcessStats[k] = v
+	}
+
+	stats.UserStats = make(map[string]int64, len(ps.stats.UserStats))
+	for k, v := range ps.stats.UserStats {
+		stats.UserStats[k] = v
+	}
+
+	stats.UnitStats = make(map[string]int64, len(ps.stats.UnitStats))
+	for k, v := range ps.stats.UnitStats {
+		stats.UnitStats[k] = v
+	}
+
+	return stats
+}
+
+// topTalkers works out the top 10 senders and bytes per country; ps.mu must be held
+func (ps *PacketStore) topTalkers() ([]Talker, map[string]int64) {
 	// Calculate top talkers and country stats dynamically
 	talkers := make([]Talker, 0, len(ps.ipStats))
 	countryStats := make(map[string]int64)
 
 	for ip, stats := range ps.ipStats {
+		// Top talkers here are by bytes sent; receive-only IPs are listed by /api/talkers
+		if stats.packets == 0 {
+			continue
+		}
+
 		info := getIPInfo(ip)
 		if info.Hostname == "" && info.Country == "" {
 			// Trigger resolution for this IP if not already trying
@@ -254,13 +529,9 @@ func (ps *PacketStore) GetStats() Stats {
 			countryStats[info.Country] += stats.bytes
 		}
 
-		talkers = append(talkers, Talker{
-			IP:       ip,
-			Packets:  stats.packets,
-			Bytes:    stats.bytes,
-			Hostname: info.Hostname,
-			Country:  info.Country,
-		})
+		t := Talker{IP: ip, Packets: stats.packets, Bytes: stats.bytes}
+		t.setIPInfo(info)
+		talkers = append(talkers, t)
 	}
 
 	// Sort by bytes descending
@@ -272,28 +543,7 @@ func (ps *PacketStore) GetStats() Stats {
 	if len(talkers) > 10 {
 		talkers = talkers[:10]
 	}
-
-	stats := ps.stats
-	stats.TopTalkers = talkers
-	stats.CountryStats = countryStats // Assign the dynamically calculated map
-
-	// Deep copy maps to avoid race conditions during JSON marshaling
-	stats.ProtocolStats = make(map[string]int64, len(ps.stats.ProtocolStats))
-	for k, v := range ps.stats.ProtocolStats {
-		stats.ProtocolStats[k] = v
-	}
-
-	stats.ApplicationStats = make(map[string]int64, len(ps.stats.ApplicationStats))
-	for k, v := range ps.stats.ApplicationStats {
-		stats.ApplicationStats[k] = v
-	}
-
-	stats.ProcessStats = make(map[string]int64, len(ps.stats.ProcessStats))
-	for k, v := range ps.stats.ProcessStats {
-		stats.ProcessStats[k] = v
-	}
-
-	return stats
+	return talkers, countryStats
 }
 
 // GetPackets returns recent packets
@@ -315,26 +565,9 @@ func (ps *PacketStore) GetPackets(limit int) []Packet {
 	return result
 }
 
-// GetConnections returns active connections
+// GetConnections returns the top 100 connections by bytes
 func (ps *PacketStore) GetConnections() []Connection {
-	ps.mu.RLock()
-	defer ps.mu.RUnlock()
-
-	connections := make([]Connection, 0, len(ps.connections))
-	for _, conn := range ps.connections {
-		connections = append(connections, *conn)
-	}
-
-	// Sort by bytes descending
-	sort.Slice(connections, func(i, j int) bool {
-		return connections[i].Bytes > connections[j].Bytes
-	})
-
-	// Keep top 100
-	if len(connections) > 100 {
-		connections = connections[:100]
-	}
-
+	connections, _ := ps.FindConnections(ConnectionQuery{Sort: "bytes", Limit: 100})
 	return connections
 }
 
@@ -349,6 +582,8 @@ func (ps *PacketStore) Clear() {
 		CountryStats:     make(map[string]int64),
 		ApplicationStats: make(map[string]int64),
 		ProcessStats:     make(map[string]int64),
+		UserStats:        make(map[string]int64),
+		UnitStats:        make(map[string]int64),
 		StartTime:        time.Now(),
 	}
 	ps.ipStats = make(map[string]*ipTraffic)
@@ -357,27 +592,88 @@ func (ps *PacketStore) Clear() {
 	ps.bytesWindow = make([]int, 0)
 }
 
-// Broadcast sends data to all connected WebSocket clients
+// Broadcast sends data to the connected WebSocket clients subscribed to its channel. It
+// isn't marshaled at all when none are.
 func (ps *PacketStore) Broadcast(messageType string, data interface{}) {
+	packet, isPacket := data.(Packet)
+
+	ps.clientsMu.RLock()
+	defer ps.clientsMu.RUnlock()
+
+	var recipients []*wsClient
+	for client := range ps.clients {
+		if !client.wants(messageType) {
+			continue
+		}
+		if isPacket && messageType == "packet" {
+			if client.paused.Load() {
+				continue
+			}
+			if f := client.filter.Load(); (f != nil && !f.Match(&packet)) || packet.ID <= client.replayedTo.Load() {
+				continue
+			}
+			if f := client.follow.Load(); f != nil && !f.Match(&packet) {
+				continue
+			}
+			if client.sampler.take(1) == 0 {
+				continue
+			}
+		}
+		recipients = append(recipients, client)
+	}
+	if len(recipients) == 0 {
+		return
+	}
+
 	message := map[string]interface{}{
 		"type": messageType,
 		"data": data,
 	}
-
+	if isPacket {
+		message["seq"] = packet.ID
+		message["resume"] = resumeToken(packet.ID)
+	}
 	jsonData, err := json.Marshal(message)
 	if err != nil {
 		return
 	}
+	for _, client := range recipients {
+		client.deliver(jsonData, isPacket)
+	}
+}
+
+// Subscribed reports whether any client is subscribed to a channel, so data only it needs
+// isn't gathered for nobody
+func (ps *PacketStore) Subscribed(channel uint32) bool {
+	ps.clientsMu.RLock()
+	defer ps.clientsMu.RUnlock()
+	for client := range ps.clients {
+		if client.channels.Load()&channel != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// BroadcastLog streams a log entry to clients subscribed to its level
+func (ps *PacketStore) BroadcastLog(entry LogEntry) {
+	jsonData, err := json.Marshal(map[string]interface{}{
+		"type": "log",
+		"data": entry,
+	})
+	if err != nil {
+		return
+	}
 
 	ps.clientsMu.RLock()
 	defer ps.clientsMu.RUnlock()
 
 	for client := range ps.clients {
-		select {
-		case client.send <- jsonData:
-		default:
-			// Channel full, skip this message for this client
+		level := client.logLevel.Load()
+		if level == 0 || entry.level < level {
+			continue
 		}
+		client.deliver(jsonData, false)
 	}
 }
 
@@ -387,73 +683,45 @@ var ipInfoCache sync.Map
 type IPInfo struct {
 	Hostname string
 	Country  string
+	City     string  // With a city database or from ip-api
+	Lat, Lon float64 // Where the city is, or the country when the city isn't known
+	ASN      string  // Autonomous system, e.g. "AS15169 Google LLC", from ip-api
 }
 
-// resolveIPInfo returns hostname and country for an IP address
+// resolveIPInfo returns hostname and country for an IP address, asking the enrichers
+// about an address seen for the first time. It doesn't wait for their lookups to finish.
 func resolveIPInfo(ip string) IPInfo {
 	if cached, ok := ipInfoCache.Load(ip); ok {
-		return cached.(IPInfo)
+		info := cached.(IPInfo)
+		if info.Hostname == "" {
+			enrichers.Retry(ip)
+		}
+		return info
 	}
 
 	info := IPInfo{}
-
-	// Skip private/local IPs for GeoIP
 	parsedIP := net.ParseIP(ip)
 	if parsedIP == nil {
 		ipInfoCache.Store(ip, info)
 		return info
 	}
 
-	// Resolve hostname (reverse DNS)
-	go func(ipAddr string) {
-		names, err := net.LookupAddr(ipAddr)
-		if err == nil && len(names) > 0 {
-			if cached, ok := ipInfoCache.Load(ipAddr); ok {
-				existing := cached.(IPInfo)
-				existing.Hostname = names[0]
-				ipInfoCache.Store(ipAddr, existing)
-			}
-		}
-	}(ip)
-
-	// Check if it's a private IP (skip GeoIP lookup for local addresses)
+	// Local addresses aren't located. What's known now is cached before any provider
+	// starts, so answers arriving later are merged into it.
 	if isPrivateIP(parsedIP) {
 		info.Country = "Local"
-		ipInfoCache.Store(ip, info)
+	}
+	if cached, loaded := ipInfoCache.LoadOrStore(ip, info); loaded {
+		return cached.(IPInfo)
+	}
+	found := info
+	enrichers.Enrich(parsedIP, &found)
+	if found == info {
 		return info
 	}
-
-	// GeoIP lookup using ip-api.com (free, no API key needed)
-	go func(ipAddr string) {
-		client := &http.Client{Timeout: 2 * time.Second}
-		resp, err := client.Get(fmt.Sprintf("http://ip-api.com/json/%s?fields=status,country,countryCode", ipAddr))
-		if err != nil {
-			return
-		}
-		defer resp.Body.Close()
-
-		var result struct {
-			Status      string `json:"status"`
-			Country     string `json:"country"`
-			CountryCode string `json:"countryCode"`
-		}
-		if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-			return
-		}
-
-		if result.Status == "success" {
-			if cached, ok := ipInfoCache.Load(ipAddr); ok {
-				existing := cached.(IPInfo)
-				existing.Country = result.CountryCode
-				ipInfoCache.Store(ipAddr, existing)
-			} else {
-				ipInfoCache.Store(ipAddr, IPInfo{Country: result.CountryCode})
-			}
-		}
-	}(ip)
-
-	ipInfoCache.Store(ip, info)
-	return info
+	updateIPInfo(ip, func(cached *IPInfo) { mergeIPInfo(cached, found) })
+	cached, _ := ipInfoCache.Load(ip)
+	return cached.(IPInfo)
 }
 
 // isPrivateIP checks if an IP is a private/local address
@@ -480,9 +748,24 @@ func isPrivateIP(ip net.IP) bool {
 	return false
 }
 
-// getIPInfo retrieves cached IP info (may be partially filled if lookups are pending)
+// getIPInfo retrieves cached IP info (may be partially filled if lookups are pending),
+// with the address's label in place of its hostname
 func getIPInfo(ip string) IPInfo {
-	if cached, ok := ipInfoCache.Load(ip); ok {
+	cached, ok := ipInfoCache.Load(ip)
+	if label := ipLabels.Label(ip); label != "" {
+		if !ok {
+			// Callers only look up addresses they know nothing about, and this has a name
+			resolveIPInfo(ip)
+			cached, ok = ipInfoCache.Load(ip)
+		}
+		info := IPInfo{}
+		if ok {
+			info = cached.(IPInfo)
+		}
+		info.Hostname = label
+		return info
+	}
+	if ok {
 		return cached.(IPInfo)
 	}
 	return IPInfo{}
@@ -540,7 +823,7 @@ func detectApplication(srcPort, dstPort uint16) string {
 	return ""
 }
 
-func startCapture(iface string, store *PacketStore, db *Database, tracker *ProcessTracker) error {
+func startCapture(iface string, store *PacketStore, db *Database, tracker *ProcessTracker, payloads *PayloadCapture, settings *CaptureSettings, observers []PacketObserver) error {
 	// Open the device
 	handle, err := pcap.OpenLive(iface, 65536, true, pcap.BlockForever)
 	if err != nil {
@@ -548,6 +831,17 @@ func startCapture(iface string, store *PacketStore, db *Database, tracker *Proce
 	}
 	defer handle.Close()
 
+	detach, err := settings.attach(handle)
+	if err != nil {
+		return err
+	}
+	defer detach()
+
+	payloadBPF, err := payloads.compile(handle)
+	if err != nil {
+		return fmt.Errorf("error compiling payload filter: %v", err)
+	}
+
 	// Get local IPs for this interface to identify direction
 	localIPs := make(map[string]bool)
 	devices, _ := pcap.FindAllDevs()
@@ -566,16 +860,45 @@ func startCapture(iface string, store *PacketStore, db *Database, tracker *Proce
 	packetSource := gopacket.NewPacketSource(handle, handle.LinkType())
 
 	for packet := range packetSource.Packets() {
+		if err := chaosCaptureFault(); err != nil {
+			return err
+		}
+		if !settings.sample() {
+			continue
+		}
+
 		p := parsePacket(packet, tracker, localIPs)
+		p.Interface = iface
+		var stored *storedPayload
+		if db != nil {
+			stored = payloads.Select(p, payloadBPF, packet)
+		}
+		p.raw = rawFrame(packet.Data(), p.payload, stored)
+		p.linkType = handle.LinkType()
 		store.AddPacket(p)
 
-		// Store in database if enabled
+		// Store in database if enabled, with the start of the payload if selected
 		if db != nil {
-			db.QueuePacket(p)
+			queued := p
+			queued.payload = nil
+			queued.raw = nil
+			queued.stored = stored
+			db.QueuePacket(queued)
+		}
+
+		// Feed flow aggregation, media quality tracking, etc.
+		for _, o := range observers {
+			o.Observe(p)
 		}
 
 		// Broadcast to WebSocket clients
-		store.Broadcast("packet", p)
+		if settings.allowBroadcast() {
+			if settings.BroadcastInterval() > 0 {
+				store.QueueBroadcast(p)
+			} else {
+				store.Broadcast("packet", p)
+			}
+		}
 	}
 
 	return nil
@@ -619,21 +942,28 @@ func parsePacket(packet gopacket.Packet, tracker *ProcessTracker, localIPs map[s
 		flags := ""
 		if tcp.SYN {
 			flags += "SYN "
+			p.tcpFlags |= tcpFlagSYN
 		}
 		if tcp.ACK {
 			flags += "ACK "
+			p.tcpFlags |= tcpFlagACK
 		}
 		if tcp.FIN {
 			flags += "FIN "
+			p.tcpFlags |= tcpFlagFIN
 		}
 		if tcp.RST {
 			flags += "RST "
+			p.tcpFlags |= tcpFlagRST
 		}
 		if tcp.PSH {
 			flags += "PSH "
+			p.tcpFlags |= tcpFlagPSH
 		}
 		p.Info = fmt.Sprintf("%d → %d [%s] Seq=%d Ack=%d Win=%d",
 			tcp.SrcPort, tcp.DstPort, flags, tcp.Seq, tcp.Ack, tcp.Window)
+		p.sni = parseSNI(tcp.Payload)
+		p.payload = tcp.Payload
 	}
 
 	// UDP layer
@@ -643,6 +973,11 @@ func parsePacket(packet gopacket.Packet, tracker *ProcessTracker, localIPs map[s
 		p.DstPort = uint16(udp.DstPort)
 		p.Protocol = "UDP"
 		p.Info = fmt.Sprintf("%d → %d Len=%d", udp.SrcPort, udp.DstPort, udp.Length)
+		p.rtp = parseRTP(p.SrcPort, p.DstPort, udp.Payload)
+		p.payload = udp.Payload
+		if dhcpLayer := packet.Layer(layers.LayerTypeDHCPv4); dhcpLayer != nil {
+			p.dhcp = dhcpLayer.(*layers.DHCPv4)
+		}
 	}
 
 	// ICMP layer
@@ -650,6 +985,9 @@ func parsePacket(packet gopacket.Packet, tracker *ProcessTracker, localIPs map[s
 		icmp := icmpLayer.(*layers.ICMPv4)
 		p.Protocol = "ICMP"
 		p.Info = fmt.Sprintf("Type=%d Code=%d", icmp.TypeCode.Type(), icmp.TypeCode.Code())
+		p.icmpType = icmp.TypeCode.Type()
+		p.icmpCode = icmp.TypeCode.Code()
+		p.payload = icmp.Payload
 	}
 
 	// ARP layer
@@ -669,6 +1007,7 @@ func parsePacket(packet gopacket.Packet, tracker *ProcessTracker, localIPs map[s
 	if dnsLayer := packet.Layer(layers.LayerTypeDNS); dnsLayer != nil {
 		dns := dnsLayer.(*layers.DNS)
 		p.Application = "DNS"
+		p.dns = dns
 		if dns.QR {
 			p.Info = fmt.Sprintf("DNS Response: %d answers", len(dns.Answers))
 		} else if len(dns.Questions) > 0 {
@@ -684,41 +1023,287 @@ func parsePacket(packet gopacket.Packet, tracker *ProcessTracker, localIPs map[s
 	// Detect process name (local only)
 	if tracker != nil {
 		if localIPs[p.SrcIP] {
-			p.ProcessName = tracker.GetProcessName(p.SrcPort)
+			info := tracker.GetProcess(p.Protocol, p.SrcPort, p.DstIP, p.DstPort, p.Timestamp)
+			p.ProcessName, p.ProcessUser, p.processPID, p.processExe, p.processHash = info.Name, info.User, info.PID, info.Exe, info.SHA256
+			p.ProcessUnit, p.ProcessConfidence = info.Unit, info.Confidence
+			p.processSent = true
 		} else if localIPs[p.DstIP] {
-			p.ProcessName = tracker.GetProcessName(p.DstPort)
+			info := tracker.GetProcess(p.Protocol, p.DstPort, p.SrcIP, p.SrcPort, p.Timestamp)
+			p.ProcessName, p.ProcessUser, p.processPID, p.processExe, p.processHash = info.Name, info.User, info.PID, info.Exe, info.SHA256
+			p.ProcessUnit, p.ProcessConfidence = info.Unit, info.Confidence
+		}
+	}
+	// Seen on a Docker bridge, before NAT, a container's packets have its own address
+	if p.ProcessName == "" {
+		if container := docker.ForIP(p.SrcIP); container != "" {
+			p.ProcessName = dockerNamePrefix + container
+			p.processSent = true
+		} else if container := docker.ForIP(p.DstIP); container != "" {
+			p.ProcessName = dockerNamePrefix + container
+		}
+	}
+	// Likewise a pod's, on the node's CNI bridge or between nodes
+	if p.ProcessName == "" {
+		if pod := kube.ForIP(p.SrcIP); pod != "" {
+			p.ProcessName = kubeNamePrefix + pod
+			p.processSent = true
+		} else if pod := kube.ForIP(p.DstIP); pod != "" {
+			p.ProcessName = kubeNamePrefix + pod
+		}
+	}
+	// Other machines' traffic, attributed by the agents running on them
+	if p.ProcessName == "" {
+		if info, host := agents.Process(p.Protocol, p.SrcIP, p.SrcPort); info != nil {
+			p.ProcessName, p.ProcessUser, p.processPID, p.processExe, p.processHost = info.Name, info.User, info.PID, info.Exe, host
+			p.processSent = true
+		} else if info, host := agents.Process(p.Protocol, p.DstIP, p.DstPort); info != nil {
+			p.ProcessName, p.ProcessUser, p.processPID, p.processExe, p.processHost = info.Name, info.User, info.PID, info.Exe, host
 		}
 	}
 
-	// Resolve hostname and country for source/destination IPs (async)
+	// Resolve hostname and country for source/destination IPs (async). Without a
+	// hostname yet, the lookups are started, or the reverse DNS one retried once an
+	// earlier failure has expired. An address the other side looked up by name is
+	// called that, and a Docker container's or Kubernetes pod's address after the
+	// container or pod, unless it has a label.
 	if p.SrcIP != "" {
 		srcInfo := getIPInfo(p.SrcIP)
-		if srcInfo.Hostname == "" && srcInfo.Country == "" {
-			go resolveIPInfo(p.SrcIP)
-		} else {
-			p.SrcHostname = srcInfo.Hostname
-			p.SrcCountry = srcInfo.Country
+		if srcInfo.Hostname == "" {
+			srcInfo = resolveIPInfo(p.SrcIP)
+		}
+		p.SrcHostname = srcInfo.Hostname
+		if name := dnsNames.Name(p.DstIP, p.SrcIP); name != "" && ipLabels.Label(p.SrcIP) == "" {
+			p.SrcHostname = name
+		}
+		if container := docker.ForIP(p.SrcIP); container != "" && ipLabels.Label(p.SrcIP) == "" {
+			p.SrcHostname = dockerNamePrefix + container
+		}
+		if pod := kube.ForIP(p.SrcIP); pod != "" && ipLabels.Label(p.SrcIP) == "" {
+			p.SrcHostname = kubeNamePrefix + pod
 		}
+		p.SrcCountry = srcInfo.Country
+		p.SrcASN = srcInfo.ASN
 	}
 	if p.DstIP != "" {
 		dstInfo := getIPInfo(p.DstIP)
-		if dstInfo.Hostname == "" && dstInfo.Country == "" {
-			go resolveIPInfo(p.DstIP)
-		} else {
-			p.DstHostname = dstInfo.Hostname
-			p.DstCountry = dstInfo.Country
+		if dstInfo.Hostname == "" {
+			dstInfo = resolveIPInfo(p.DstIP)
+		}
+		p.DstHostname = dstInfo.Hostname
+		if name := dnsNames.Name(p.SrcIP, p.DstIP); name != "" && ipLabels.Label(p.DstIP) == "" {
+			p.DstHostname = name
+		}
+		if container := docker.ForIP(p.DstIP); container != "" && ipLabels.Label(p.DstIP) == "" {
+			p.DstHostname = dockerNamePrefix + container
+		}
+		if pod := kube.ForIP(p.DstIP); pod != "" && ipLabels.Label(p.DstIP) == "" {
+			p.DstHostname = kubeNamePrefix + pod
 		}
+		p.DstCountry = dstInfo.Country
+		p.DstASN = dstInfo.ASN
 	}
 
 	return p
 }
 
+// parseTimeRange reads the optional RFC3339 start and end query parameters
+func parseTimeRange(r *http.Request) (startTime, endTime *time.Time) {
+	if s := r.URL.Query().Get("start"); s != "" {
+		if t, err := time.Parse(time.RFC3339, s); err == nil {
+			startTime = &t
+		}
+	}
+	if e := r.URL.Query().Get("end"); e != "" {
+		if t, err := time.Parse(time.RFC3339, e); err == nil {
+			endTime = &t
+		}
+	}
+	return startTime, endTime
+}
+
 func main() {
+	// Subcommands
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "serve":
+			// The default, so its flags work with or without it
+			os.Args = append(os.Args[:1], os.Args[2:]...)
+		case "help":
+			fmt.Print(cliUsage)
+			return
+		case "seed":
+			runSeed(os.Args[2:])
+			return
+		case "restore":
+			runRestore(os.Args[2:])
+			return
+		case "import":
+			runImport(os.Args[2:])
+			return
+		case "export":
+			runExport(os.Args[2:])
+			return
+		case "query":
+			runQuery(os.Args[2:])
+			return
+		case "prune":
+			runPrune(os.Args[2:])
+			return
+		default:
+			if !strings.HasPrefix(os.Args[1], "-") {
+				fmt.Fprintf(os.Stderr, "Unknown command %q\n\n%s", os.Args[1], cliUsage)
+				os.Exit(2)
+			}
+		}
+	}
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "%s\nFlags for serve:\n", cliUsage)
+		flag.PrintDefaults()
+	}
+
+	// Keep recent log lines in memory for /api/logs and the WebSocket log stream
+	logBuffer := NewLogBuffer(1000)
+	logFilter := NewLogFilter(io.MultiWriter(os.Stderr, logBuffer))
+	log.SetOutput(logFilter)
+
+	configFile := flag.String("config", "", "YAML file of options, named as the flags without the dash, e.g. /etc/pitrack.yaml (flags given on the command line override it)")
 	port := flag.Int("port", 25565, "Web server port")
+	logLevel := flag.String("log-level", "info", "Lowest level of log lines written and kept for /api/logs: debug, info, warn or error")
 	iface := flag.String("interface", "", "Network interface to capture (leave empty to auto-detect)")
 	maxPackets := flag.Int("max-packets", 10000, "Maximum packets to store in memory")
+	captureFilter := flag.String("capture-filter", "", "BPF expression selecting the packets to capture, e.g. \"not port 22\" (everything if empty)")
+	sampleRate := flag.Int("sample-rate", 1, "Process only 1 in N captured packets, to keep up on busy links")
+	processEBPF := flag.Bool("process-ebpf", true, "Trace connections to processes with eBPF as they're made (Linux, as root), so short-lived ones like DNS lookups are attributed too")
+	processPollInterval := flag.Duration("process-poll-interval", 0, "How often open sockets are polled to attribute packets to processes (0 for 2s, or 10s with eBPF tracing)")
+	processHash := flag.Bool("process-hash", false, "Record the SHA-256 of each process's executable along with its path, hashing each binary once in the background")
+	dockerSocket := flag.String("docker-socket", dockerDefaultSocket, "Docker API socket, to attribute traffic to containers by name (skipped if missing; empty to disable)")
+	kubeconfig := flag.String("kubeconfig", kubeDefaultConfig, "Kubernetes kubeconfig, to attribute traffic to pods by namespace and workload (skipped if missing, using the service account when running in a pod; empty to disable)")
+	broadcastRate := flag.Int("broadcast-rate", 0, "Maximum packets per second sent to each live view (0 for no limit)")
+	broadcastInterval := flag.Duration("broadcast-interval", 200*time.Millisecond, "Send packets to live views in one message this often, rather than one message each (0 for one each)")
+	statsInterval := flag.Duration("stats-interval", time.Second, "How often stats are sent to live views")
+	wsCompression := flag.Bool("ws-compression", true, "Compress WebSocket messages for browsers that support it (permessage-deflate)")
+	slowClientPolicy := flag.String("slow-client-policy", slowClientDegrade, "What to do with a live view that can't keep up: degrade (stop sending it packets, then disconnect it), disconnect, or drop (leave out messages)")
+	wsCompressionLevel := flag.Int("ws-compression-level", 1, "WebSocket compression level, from 1 (fastest) to 9 (smallest)")
 	dbPath := flag.String("db", "pitrack.db", "SQLite database path (use empty string to disable)")
+	dbKey := flag.String("db-key", os.Getenv("PITRACK_DB_KEY"), "Encrypt the database with SQLCipher using this key (default $PITRACK_DB_KEY; needs a SQLCipher build)")
+	dbKeyFile := flag.String("db-key-file", "", "File holding the database encryption key (overrides -db-key)")
+	dbBatchSize := flag.Int("db-batch-size", 100, "Write queued packets to the database once this many are waiting")
+	dbFlushInterval := flag.Duration("db-flush-interval", 5*time.Second, "Write queued packets at least this often (the most data a crash can lose)")
+	dbSynchronous := flag.String("db-synchronous", "NORMAL", "SQLite synchronous mode: OFF, NORMAL (may lose the last writes on power loss) or FULL/EXTRA (durable, more SD card writes)")
+	dbPartition := flag.Bool("db-partition", false, "Move each finished day of packets to its own file next to the database, e.g. pitrack-2024-06-01.db")
+	flowCollector := flag.String("flow-collector", "", "NetFlow v5 collector address host:port (leave empty to disable flow export)")
+	flowActive := flag.Duration("flow-active-timeout", 2*time.Minute, "Export long-lived flows at least this often")
+	flowInactive := flag.Duration("flow-inactive-timeout", 15*time.Second, "Expire flows idle for this long")
+	flowKey := flag.String("flow-key", flowKey5Tuple, "Flow aggregation key: 5tuple, ippair or srcip")
+	flowBatch := flag.Int("flow-batch", 30, "Number of expired flows to batch per export")
+	clickHouseURL := flag.String("clickhouse-url", "", "ClickHouse HTTP interface to log packets and flows to, e.g. http://localhost:8123 (disabled if empty)")
+	clickHouseDB := flag.String("clickhouse-db", "pitrack", "ClickHouse database to create the packets and flows tables in")
+	clickHouseUser := flag.String("clickhouse-user", "", "ClickHouse username")
+	clickHousePassword := flag.String("clickhouse-password", os.Getenv("PITRACK_CLICKHOUSE_PASSWORD"), "ClickHouse password (default $PITRACK_CLICKHOUSE_PASSWORD)")
+	clickHouseTTL := flag.String("clickhouse-ttl", "", "Drop ClickHouse rows older than this, e.g. 180d (kept forever if empty; set when the tables are created)")
+	probe := flag.Bool("probe", false, "Actively ping the default gateway and probe targets to monitor latency")
+	probeTargets := flag.String("probe-targets", "1.1.1.1,8.8.8.8", "Comma-separated hosts to ping in addition to the gateway")
+	probeInterval := flag.Duration("probe-interval", 5*time.Second, "Interval between latency probes")
+	diskWarnFree := flag.String("disk-warn-free", "1GB", "Prune the oldest packets when free disk space drops below this")
+	speedtestInterval := flag.Duration("speedtest-interval", 0, "Run a speed test this often, e.g. 6h (0 to disable)")
+	speedtestTool := flag.String("speedtest-tool", speedtestOokla, "Speed test client: ookla (speedtest CLI) or librespeed (librespeed-cli)")
+	alertWebhooks := flag.String("alert-webhook", "", "Comma-separated URLs to POST alerts to as JSON")
+	smtpHost := flag.String("smtp-host", "", "SMTP server for alert and report emails (email disabled if empty)")
+	smtpPort := flag.Int("smtp-port", 587, "SMTP server port (465 for implicit TLS, otherwise STARTTLS when offered)")
+	smtpUser := flag.String("smtp-user", "", "SMTP username")
+	smtpPassword := flag.String("smtp-password", os.Getenv("PITRACK_SMTP_PASSWORD"), "SMTP password (default $PITRACK_SMTP_PASSWORD)")
+	smtpFrom := flag.String("smtp-from", "", "Sender address for emails")
+	smtpTo := flag.String("smtp-to", "", "Comma-separated recipient addresses")
+	smtpSubject := flag.String("smtp-subject", defaultEmailSubject, "Alert email subject template (Go text/template)")
+	smtpBody := flag.String("smtp-body-template", "", "File containing the alert email body template (built-in default if empty)")
+	smtpMaxPerHour := flag.Int("smtp-max-per-hour", 20, "Maximum alert emails per hour (0 for no limit)")
+	smtpCooldown := flag.Duration("smtp-cooldown", 15*time.Minute, "Minimum time between emails about the same alert")
+	alertSlack := flag.String("alert-slack", "", "Slack incoming webhook URL for alerts")
+	alertDiscord := flag.String("alert-discord", "", "Discord webhook URL for alerts")
+	telegramToken := flag.String("telegram-token", os.Getenv("PITRACK_TELEGRAM_TOKEN"), "Telegram bot token for alerts (default $PITRACK_TELEGRAM_TOKEN)")
+	telegramChat := flag.String("telegram-chat", "", "Telegram chat ID to send alerts to")
+	ntfyURL := flag.String("ntfy-url", "", "ntfy topic URL to push alerts to, e.g. https://ntfy.sh/my-topic")
+	ntfyToken := flag.String("ntfy-token", os.Getenv("PITRACK_NTFY_TOKEN"), "ntfy access token for protected topics (default $PITRACK_NTFY_TOKEN)")
+	pushoverToken := flag.String("pushover-token", os.Getenv("PITRACK_PUSHOVER_TOKEN"), "Pushover application token (default $PITRACK_PUSHOVER_TOKEN)")
+	pushoverUser := flag.String("pushover-user", "", "Pushover user or group key to send alerts to")
+	mqttBroker := flag.String("mqtt-broker", "", "MQTT broker to publish stats, device usage and alerts to, e.g. tcp://localhost:1883")
+	mqttUser := flag.String("mqtt-user", "", "MQTT username")
+	mqttPassword := flag.String("mqtt-password", os.Getenv("PITRACK_MQTT_PASSWORD"), "MQTT password (default $PITRACK_MQTT_PASSWORD)")
+	mqttTopic := flag.String("mqtt-topic", "pitrack", "MQTT topic prefix")
+	mqttInterval := flag.Duration("mqtt-interval", 10*time.Second, "How often stats and device usage are published to MQTT")
+	dhcpServers := flag.String("dhcp-servers", "", "Comma-separated IPs or MACs of legitimate DHCP servers (the first server seen is trusted if empty)")
+	ipLabelList := flag.String("ip-labels", "", "Comma-separated names for addresses and subnets shown instead of their hostnames, e.g. \"192.168.1.10=NAS,10.0.8.0/24=Work VPN\" (replaces the labels saved through the API)")
+	watchCountries := flag.String("watch-countries", "", "Comma-separated country codes that should never appear in traffic, e.g. KP,IR (replaces the list saved through the API)")
+	floodSYNRate := flag.Float64("flood-syn-rate", 200, "SYNs per second to one host that count as a SYN flood (0 disables)")
+	floodICMPRate := flag.Float64("flood-icmp-rate", 200, "Echo requests per second to one host that count as an ICMP flood (0 disables)")
+	floodAmpRate := flag.Float64("flood-amp-rate", 100, "Responses per second from UDP amplification ports (DNS, NTP, SSDP, ...) to one host that count as an attack (0 disables)")
+	floodUnanswered := flag.Float64("flood-unanswered", 0.8, "Share of SYNs/pings unanswered, or of UDP responses never requested, needed to call it a flood (0-1)")
+	wanInterfaces := flag.String("wan-interfaces", "", "Comma-separated capture interfaces facing the internet, whose packets from internal addresses are reported as spoofed")
+	gatewayMACs := flag.String("gateway-macs", "", "Comma-separated MACs of the router's WAN-facing side, whose packets from internal addresses are reported as spoofed (learned from the default gateway if empty)")
+	fullBogons := flag.Bool("full-bogons", false, "Download Team Cymru's full bogon list daily, to also report sources in unallocated ranges")
+	offlineAfter := flag.Duration("offline-after", 10*time.Minute, "Report a known device as offline when it hasn't been seen for this long")
+	enricherList := flag.String("enrichers", "", "Comma-separated providers addresses are looked up with, in order: labels, mmdb, rdns, ipapi (labels,rdns,ipapi, or labels,mmdb,rdns with -geoip-city-db, if empty)")
+	useDNSNames := flag.Bool("dns-names", true, "Name remote addresses after the names clients looked them up by in DNS, in preference to reverse DNS")
+	dnsServer := flag.String("dns-server", "", "DNS server to resolve hostnames of IPs with, e.g. 192.168.1.1:53 (the system resolver if empty)")
+	rdnsWorkers := flag.Int("rdns-workers", rdnsDefaultWorkers, "Hostname lookups run at once")
+	rdnsTimeout := flag.Duration("rdns-timeout", rdnsDefaultTimeout, "How long a hostname lookup may take")
+	rdnsNegativeTTL := flag.Duration("rdns-negative-ttl", rdnsDefaultNegativeTTL, "How long an IP without a hostname is left before it's looked up again")
+	ipInfoTTL := flag.Duration("ip-info-ttl", 7*24*time.Hour, "How long resolved hostnames, locations and ASNs are kept in the database and reused after a restart (0 keeps them in memory only)")
+	cloudRangeList := flag.String("cloud-ranges", "", "Comma-separated clouds whose published IP ranges tag talkers with provider, service and region: aws, gcp, azure, cloudflare (none if empty)")
+	cloudRangesAzureURL := flag.String("cloud-ranges-azure-url", "", "URL of Azure's ServiceTags_Public JSON file, which Microsoft renames weekly (needed for azure in -cloud-ranges)")
+	cloudRangesRefresh := flag.Duration("cloud-ranges-refresh", 24*time.Hour, "How often the -cloud-ranges lists are downloaded again")
+	anonymizerList := flag.String("anonymizers", "", "Comma-separated lists of addresses whose traffic is flagged: tor (exit nodes), vpn (commercial VPN endpoints) (none if empty)")
+	vpnRangesList := flag.String("vpn-ranges-url", vpnRangesURL, "URL of the list of VPN endpoint addresses and CIDRs, one a line, for vpn in -anonymizers")
+	anonymizerRefresh := flag.Duration("anonymizer-refresh", time.Hour, "How often the -anonymizers lists are downloaded again")
+	geoipCityDB := flag.String("geoip-city-db", "", "MaxMind DB city database (GeoLite2 City or DB-IP City Lite .mmdb) to locate remote IPs with, instead of ip-api.com")
+	ouiFile := flag.String("oui-file", "", "IEEE oui.txt/oui.csv, arp-scan ieee-oui.txt or Wireshark manuf file to look up device vendors in (the usual system locations if empty)")
+	presenceWatch := flag.String("presence-watch", "", "Comma-separated MACs or IPs to report offline/online events for (all known devices if empty)")
+	signatureFiles := flag.String("signatures", "", "Comma-separated Suricata/Snort rule files or directories of *.rules files to match packets against")
+	homeNet := flag.String("home-net", "", "HOME_NET for signature rules, e.g. [192.168.1.0/24] (private ranges if empty)")
+	alertRoutes := flag.String("alert-routes", "", "Notifiers per alert severity, e.g. critical=ntfy,email;info=mqtt (every notifier if empty)")
+	alertRulesFile := flag.String("alert-rules", "", "JSON file of alert rules to load at startup (merged by name)")
+	configSecret := flag.String("config-secret", os.Getenv("PITRACK_CONFIG_SECRET"), "Secret used to sign and verify configuration bundles (default $PITRACK_CONFIG_SECRET)")
+	retention := flag.String("retention", "", "Delete packets older than this, e.g. 30d (kept forever if empty)")
+	archiveDir := flag.String("archive-dir", "", "Before -retention prunes packets, append them to gzip'd JSONL files in this directory (pruned without a copy if empty)")
+	retentionTables := flag.String("retention-tables", "", "Comma-separated table=age retention policies for other tables, e.g. traffic_hourly=365d,alerts=90d")
+	backfillInterval := flag.Duration("backfill-interval", 10*time.Minute, "Fill in the hostnames, countries and ASNs of packets stored in the last hour this often, once their lookups finish (0 for on demand only)")
+	maintenanceInterval := flag.Duration("maintenance-interval", 24*time.Hour, "Run database maintenance (ANALYZE, PRAGMA optimize, incremental vacuum) this often (0 for on demand only)")
+	dbMaxSize := flag.String("db-max-size", "", "Evict the oldest packets when the database grows beyond this, e.g. 2GB (no cap if empty)")
+	payloadBytes := flag.Int("payload-bytes", 0, "Store the first N bytes of each selected packet's payload in the database (0 disables)")
+	payloadProtocols := flag.String("payload-protocols", "", "Comma-separated protocols or applications whose payloads are stored, e.g. DNS,HTTP")
+	payloadFilter := flag.String("payload-filter", "", "BPF expression selecting packets whose payloads are stored, e.g. \"port 5060\"")
+	diskCriticalFree := flag.String("disk-critical-free", "200MB", "Stop writing packets (stats-only mode) when free disk space drops below this")
+	authUser := flag.String("auth-user", "", "Username for logging in to the web UI and API (no login required unless this or -api-tokens is set)")
+	authPassword := flag.String("auth-password", os.Getenv("PITRACK_AUTH_PASSWORD"), "Password for -auth-user (default $PITRACK_AUTH_PASSWORD)")
+	apiTokens := flag.String("api-tokens", os.Getenv("PITRACK_API_TOKENS"), "Comma-separated API tokens accepted as \"Authorization: Bearer <token>\" (default $PITRACK_API_TOKENS)")
+	authSessionTTL := flag.Duration("auth-session-ttl", 7*24*time.Hour, "How long a web UI login lasts")
+	tlsCert := flag.String("tls-cert", "", "PEM certificate file to serve HTTPS with, reloaded when it changes (requires -tls-key)")
+	tlsKey := flag.String("tls-key", "", "PEM private key file for -tls-cert")
+	tlsSelfSigned := flag.Bool("tls-self-signed", false, "Serve HTTPS with a self-signed certificate, generated on first run (at -tls-cert/-tls-key, default "+selfSignedCertFile+"/"+selfSignedKeyFile+")")
+	acmeDomains := flag.String("acme-domains", "", "Comma-separated domain names to get Let's Encrypt certificates for over ACME; they must resolve to this host and reach it on port 443")
+	acmeEmail := flag.String("acme-email", "", "Contact email for the ACME account (optional)")
+	acmeCache := flag.String("acme-cache", "pitrack-acme", "Directory keeping the ACME account key and certificates")
+	grpcPort := flag.Int("grpc-port", 0, "Serve the gRPC streaming API (pitrackpb/pitrack.proto) on this port (0 disables)")
+	corsOrigins := flag.String("cors-origins", "", "Comma-separated origins other web pages may call the API from, e.g. https://grafana.example.com (\"*\" for any; same-origin only if empty)")
+	apiRateLimit := flag.Float64("api-rate-limit", 20, "Requests per second each client address may make to the web server (0 disables)")
+	apiRateBurst := flag.Int("api-rate-burst", 60, "Requests a client may make at once before -api-rate-limit applies")
+	dbMaxQueries := flag.Int("db-max-queries", 2, "Database-backed API requests served at once; others wait up to 10s, then get 503 (0 for no limit)")
+	httpReadTimeout := flag.Duration("http-read-timeout", 30*time.Second, "Longest the web server waits for a request, headers and body")
+	httpWriteTimeout := flag.Duration("http-write-timeout", 60*time.Second, "Longest the web server takes to write a response, except exports, backups and live streams")
+	httpRedirectPort := flag.Int("http-redirect-port", 0, "With HTTPS, also listen for plain HTTP on this port (e.g. 80), redirecting to HTTPS and answering ACME HTTP-01 challenges (0 disables)")
 	flag.Parse()
+	var configFileFlags map[string]bool
+	if *configFile != "" {
+		var err error
+		if configFileFlags, err = applyConfigFile(flag.CommandLine, *configFile); err != nil {
+			log.Fatalf("Invalid -config: %v", err)
+		}
+	}
+	if level, ok := lookupLogLevel(*logLevel); ok {
+		logFilter.SetLevel(level)
+	} else {
+		log.Fatalf("Invalid -log-level %q (expected debug, info, warn or error)", *logLevel)
+	}
 
 	// Auto-detect interface if not specified
 	if *iface == "" {
@@ -754,64 +1339,1128 @@ func main() {
 	// Initialize database if path is provided
 	var db *Database
 	if *dbPath != "" {
-		var err error
-		db, err = NewDatabase(*dbPath)
+		key, err := loadDBKey(*dbKey, *dbKeyFile)
+		if err != nil {
+			log.Fatalf("Invalid -db-key-file: %v", err)
+		}
+		opts := DatabaseOptions{BatchSize: *dbBatchSize, FlushInterval: *dbFlushInterval, Synchronous: *dbSynchronous}
+		if err := opts.Validate(); err != nil {
+			log.Fatalf("Invalid database options: %v", err)
+		}
+		db, err = NewDatabase(*dbPath, key, opts)
 		if err != nil {
 			log.Printf("Warning: Failed to initialize database: %v (continuing without database)", err)
 			db = nil
 		} else {
 			log.Printf("Database initialized: %s", *dbPath)
+			if db.Encrypted() {
+				log.Printf("Database is encrypted with SQLCipher")
+			}
 			defer db.Close()
 		}
 	}
 
-	store := NewPacketStore(*maxPackets)
-	tracker := NewProcessTracker()
-	tracker.Start()
-
-	// Start packet capture in background
-	go func() {
-		if err := startCapture(*iface, store, db, tracker); err != nil {
-			log.Printf("Capture error: %v", err)
-		}
-	}()
-
-	// Start stats broadcaster
-	go func() {
-		ticker := time.NewTicker(1 * time.Second)
-		for range ticker.C {
-			store.Broadcast("stats", store.GetStats())
+	// Settings changed through /api/config are saved and used unless the flag is given on
+	// the command line. The config file only sets defaults, or every restart would undo
+	// changes made through the API.
+	explicitFlags := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		if !configFileFlags[f.Name] {
+			explicitFlags[f.Name] = true
 		}
-	}()
-
-	// Serve static files from embedded filesystem
-	webFS, err := fs.Sub(webContent, "web")
+	})
+	captureConfig, err := LoadCaptureConfig(db, CaptureConfig{
+		Filter:            *captureFilter,
+		MaxPackets:        *maxPackets,
+		SampleRate:        *sampleRate,
+		BroadcastRate:     *broadcastRate,
+		BroadcastInterval: broadcastInterval.Seconds(),
+		StatsInterval:     statsInterval.Seconds(),
+		Retention:         *retention,
+		RetentionTables:   *retentionTables,
+	}, explicitFlags)
 	if err != nil {
-		log.Fatal(err)
+		log.Fatalf("Invalid capture configuration: %v", err)
 	}
 
-	// API endpoints
-	http.HandleFunc("/api/packets", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		json.NewEncoder(w).Encode(store.GetPackets(500))
-	})
+	store := NewPacketStore(captureConfig.MaxPackets)
+	logBuffer.OnEntry(store.BroadcastLog)
+	if store.slowClients, err = parseSlowClientPolicy(*slowClientPolicy); err != nil {
+		log.Fatalf("Invalid -slow-client-policy: %v", err)
+	}
 
-	http.HandleFunc("/api/stats", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		json.NewEncoder(w).Encode(store.GetStats())
-	})
+	// Watch free space on the database volume
+	var diskMonitor *DiskMonitor
+	var retentionManager *RetentionManager
+	var maintenance *DBMaintenance
+	var backfill *EnrichmentBackfill
+	var session *SessionRecorder
+	var payloads *PayloadCapture
+	if db != nil {
+		if *dbPartition {
+			db.EnablePartitions(*dbPath).Start()
+			log.Printf("Archiving finished days of packets to daily files")
+		}
 
-	http.HandleFunc("/api/connections", func(w http.ResponseWriter, r *http.Request) {
+		warnFree, err := parseByteSize(*diskWarnFree)
+		if err != nil {
+			log.Fatalf("Invalid -disk-warn-free: %v", err)
+		}
+		criticalFree, err := parseByteSize(*diskCriticalFree)
+		if err != nil {
+			log.Fatalf("Invalid -disk-critical-free: %v", err)
+		}
+		var maxSize uint64
+		if *dbMaxSize != "" {
+			if maxSize, err = parseByteSize(*dbMaxSize); err != nil {
+				log.Fatalf("Invalid -db-max-size: %v", err)
+			}
+		}
+		diskMonitor = NewDiskMonitor(*dbPath, warnFree, criticalFree, maxSize, db, store)
+		diskMonitor.Start(30 * time.Second)
+
+		policies, _ := ParseRetentionPolicies(captureConfig.Retention, captureConfig.RetentionTables)
+		var archive *Archiver
+		if *archiveDir != "" {
+			if archive, err = NewArchiver(*archiveDir); err != nil {
+				log.Fatalf("Invalid -archive-dir: %v", err)
+			}
+		}
+		retentionManager = NewRetentionManager(db, policies, archive)
+		retentionManager.Start()
+
+		maintenance = NewDBMaintenance(db, store, *maintenanceInterval)
+		maintenance.Start()
+
+		backfill = NewEnrichmentBackfill(db, *backfillInterval)
+		backfill.Start()
+
+		session, err = NewSessionRecorder(db, *iface)
+		if err != nil {
+			log.Printf("Warning: could not record capture session: %v", err)
+			session = nil
+		} else {
+			session.Start()
+		}
+
+		if *payloadBytes > 0 {
+			payloads, err = NewPayloadCapture(*payloadBytes, *payloadProtocols, *payloadFilter)
+			if err != nil {
+				log.Fatalf("Invalid -payload-filter: %v", err)
+			}
+			log.Printf("Storing up to %d payload bytes per selected packet", *payloadBytes)
+		}
+	}
+	if *dockerSocket != "" {
+		if _, err := os.Stat(*dockerSocket); err == nil {
+			docker = NewDockerContainers(*dockerSocket)
+			docker.Start()
+			log.Printf("Attributing traffic to Docker containers via %s", *dockerSocket)
+		} else if *dockerSocket != dockerDefaultSocket {
+			log.Printf("Warning: Docker socket %s unavailable, traffic won't be attributed to containers: %v", *dockerSocket, err)
+		}
+	}
+	if *kubeconfig != "" {
+		path := *kubeconfig
+		_, err := os.Stat(path)
+		// Running in a pod, there's the service account instead of k3s's file
+		if err != nil && path == kubeDefaultConfig && os.Getenv("KUBERNETES_SERVICE_HOST") != "" {
+			path, err = "", nil
+		}
+		switch {
+		case err == nil:
+			if kube, err = NewKubernetesPods(path); err != nil {
+				log.Printf("Warning: traffic won't be attributed to Kubernetes pods: %v", err)
+			} else {
+				kube.Start()
+				log.Printf("Attributing traffic to Kubernetes pods via %s", kube.config.server)
+			}
+		case path != kubeDefaultConfig:
+			log.Printf("Warning: kubeconfig %s unavailable, traffic won't be attributed to pods: %v", path, err)
+		}
+	}
+	tracker := NewProcessTracker()
+	if *processPollInterval < 0 || (*processPollInterval > 0 && *processPollInterval < 100*time.Millisecond) {
+		log.Fatalf("Invalid -process-poll-interval %s (expected at least 100ms, or 0 for the default)", *processPollInterval)
+	}
+	tracker.Start(*processEBPF, *processHash, *processPollInterval)
+
+	// Start active latency probing if enabled
+	var prober *LatencyProber
+	if *probe {
+		prober = NewLatencyProber(strings.Split(*probeTargets, ","), *probeInterval, store, db)
+		if err := prober.Start(); err != nil {
+			log.Printf("Warning: latency probing disabled: %v", err)
+			prober = nil
+		}
+	}
+
+	// Scheduled speed tests, also available on demand via the API
+	var speedTester *SpeedTester
+	if *speedtestInterval > 0 {
+		var err error
+		speedTester, err = NewSpeedTester(*speedtestTool, db)
+		if err != nil {
+			log.Printf("Warning: speed tests disabled: %v", err)
+		} else {
+			speedTester.Start(*speedtestInterval)
+		}
+	}
+
+	// Weekly summary reports are built from the packet history
+	var reports *ReportGenerator
+	if db != nil {
+		reports = NewReportGenerator(db)
+	}
+
+	// Rules-based alerting
+	alertEngine, err := NewAlertEngine(db, store, prober)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *alertRulesFile != "" {
+		if err := alertEngine.LoadRulesFile(*alertRulesFile); err != nil {
+			log.Printf("Warning: failed to load alert rules: %v", err)
+		}
+	}
+	routes, err := ParseSeverityRoutes(*alertRoutes)
+	if err != nil {
+		log.Fatalf("Invalid -alert-routes: %v", err)
+	}
+	alertEngine.SetRoutes(routes)
+	for _, u := range strings.Split(*alertWebhooks, ",") {
+		if u = strings.TrimSpace(u); u == "" {
+			continue
+		}
+		webhook, err := NewWebhookNotifier(u)
+		if err != nil {
+			log.Fatal(err)
+		}
+		alertEngine.AddNotifier(webhook)
+	}
+	if *alertSlack != "" {
+		slack, err := NewSlackNotifier(*alertSlack)
+		if err != nil {
+			log.Fatal(err)
+		}
+		alertEngine.AddNotifier(slack)
+	}
+	if *alertDiscord != "" {
+		discord, err := NewDiscordNotifier(*alertDiscord)
+		if err != nil {
+			log.Fatal(err)
+		}
+		alertEngine.AddNotifier(discord)
+	}
+	if *telegramChat != "" {
+		telegram, err := NewTelegramNotifier(*telegramToken, *telegramChat)
+		if err != nil {
+			log.Fatal(err)
+		}
+		alertEngine.AddNotifier(telegram)
+	}
+	if *ntfyURL != "" {
+		ntfy, err := NewNtfyNotifier(*ntfyURL, *ntfyToken)
+		if err != nil {
+			log.Fatal(err)
+		}
+		alertEngine.AddNotifier(ntfy)
+	}
+	if *pushoverUser != "" {
+		pushover, err := NewPushoverNotifier(*pushoverToken, *pushoverUser)
+		if err != nil {
+			log.Fatal(err)
+		}
+		alertEngine.AddNotifier(pushover)
+	}
+	if *smtpHost != "" {
+		var recipients []string
+		for _, to := range strings.Split(*smtpTo, ",") {
+			if to = strings.TrimSpace(to); to != "" {
+				recipients = append(recipients, to)
+			}
+		}
+		mailer, err := NewEmailNotifier(SMTPConfig{
+			Host:            *smtpHost,
+			Port:            *smtpPort,
+			Username:        *smtpUser,
+			Password:        *smtpPassword,
+			From:            *smtpFrom,
+			To:              recipients,
+			SubjectTemplate: *smtpSubject,
+			BodyTemplate:    loadEmailTemplate(*smtpBody),
+			MaxPerHour:      *smtpMaxPerHour,
+			Cooldown:        *smtpCooldown,
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+		alertEngine.AddNotifier(mailer)
+		if reports != nil {
+			reports.OnReport(func(r *Report) {
+				if err := mailer.SendReport(r); err != nil {
+					log.Printf("Error emailing weekly report: %v", err)
+				}
+			})
+		}
+		log.Printf("Emailing alerts and reports to %s via %s", strings.Join(recipients, ", "), *smtpHost)
+	}
+	alertEngine.Start()
+
+	// Reports start once notifiers and the alert source are set, so a catch-up report
+	// gets sent too, with its alerts
+	if reports != nil {
+		reports.SetAlertSource(func(start, end time.Time) []ReportAlert {
+			alerts, err := alertEngine.Alerts("", &start, &end, 0)
+			if err != nil {
+				log.Printf("Error loading alerts for report: %v", err)
+			}
+			result := make([]ReportAlert, 0, len(alerts))
+			for _, a := range alerts {
+				result = append(result, ReportAlert{Time: a.StartedAt, Severity: a.Severity, Title: a.Message})
+			}
+			return result
+		})
+		reports.Start()
+	}
+
+	media := NewMediaTracker()
+	devices := NewDeviceTracker()
+	usage := NewUsageTracker(db)
+	usage.Start()
+	alertEngine.SetUsageSource(usage)
+	dhcpGuard := NewDHCPGuard(strings.Split(*dhcpServers, ","), alertEngine, db)
+	watchlist := NewCountryWatchlist(strings.Split(*watchCountries, ","), alertEngine, db)
+	if ipLabels, err = NewIPLabels(strings.Split(*ipLabelList, ","), db); err != nil {
+		log.Fatalf("Invalid -ip-labels: %v", err)
+	}
+	watchlist.Start()
+	beacons := NewBeaconDetector(alertEngine)
+	beacons.Start()
+	dnsTunnels := NewDNSTunnelDetector(alertEngine)
+	dnsTunnels.Start()
+	floods := NewFloodDetector(FloodConfig{
+		SYNRate:    *floodSYNRate,
+		ICMPRate:   *floodICMPRate,
+		AmpRate:    *floodAmpRate,
+		Unanswered: *floodUnanswered,
+	}, alertEngine)
+	floods.Start()
+	spoofing := NewSpoofDetector(*wanInterfaces, *gatewayMACs, *fullBogons)
+	spoofing.Start()
+	whois := NewWhoisClient()
+	presence := NewPresenceMonitor(*offlineAfter, strings.Split(*presenceWatch, ","), db, alertEngine, store)
+	presence.Start()
+	knownProcesses := NewKnownProcesses(db, alertEngine)
+	knownProcesses.Start()
+	if *geoipCityDB != "" {
+		geoCityDB, err = LoadGeoCityDB(*geoipCityDB)
+		if err != nil {
+			log.Fatalf("Invalid -geoip-city-db: %v", err)
+		}
+		log.Printf("Locating remote IPs with %s (%s)", *geoipCityDB, geoCityDB.mmdb.dbType)
+	}
+	if *cloudRangeList != "" {
+		if cloudRanges, err = NewCloudRanges(*cloudRangeList, *cloudRangesAzureURL, *cloudRangesRefresh); err != nil {
+			log.Fatalf("Invalid -cloud-ranges: %v", err)
+		}
+		cloudRanges.Start()
+	}
+	if *anonymizerList != "" {
+		if anonymizers, err = NewAnonymizers(*anonymizerList, *vpnRangesList, *anonymizerRefresh); err != nil {
+			log.Fatalf("Invalid -anonymizers: %v", err)
+		}
+		anonymizers.Start()
+	}
+	if *rdnsWorkers < 1 {
+		log.Fatalf("Invalid -rdns-workers %d (expected at least 1)", *rdnsWorkers)
+	}
+	if *dnsServer != "" {
+		if _, _, err := net.SplitHostPort(*dnsServer); err != nil {
+			*dnsServer = net.JoinHostPort(*dnsServer, "53")
+		}
+	}
+	if *useDNSNames {
+		dnsNames = NewDNSNames()
+	}
+	rdnsLookups = NewRDNSPool(*dnsServer, *rdnsWorkers, *rdnsTimeout, *rdnsNegativeTTL)
+	if *enricherList == "" {
+		*enricherList = defaultEnrichers(geoCityDB != nil)
+	}
+	if enrichers, err = NewEnricherChain(*enricherList); err != nil {
+		log.Fatalf("Invalid -enrichers: %v", err)
+	}
+	if db != nil && *ipInfoTTL > 0 {
+		ipInfoStore = NewIPInfoStore(db, *ipInfoTTL)
+		if n, err := ipInfoStore.Load(); err != nil {
+			log.Printf("Warning: Failed to load saved IP lookups: %v", err)
+		} else if n > 0 {
+			log.Printf("Loaded %d saved IP lookups", n)
+		}
+		ipInfoStore.Start()
+	}
+	vendors, err := LoadVendorDB(*ouiFile)
+	if err != nil {
+		log.Fatalf("Invalid -oui-file: %v", err)
+	}
+	inventory := NewDeviceInventory(db, devices, presence, usage, vendors)
+	processUsage := NewProcessUsage()
+	observers := []PacketObserver{media, devices, usage, presence, inventory, alertEngine, dhcpGuard, watchlist, beacons, dnsTunnels, floods, spoofing, processUsage, knownProcesses}
+	if session != nil {
+		observers = append(observers, session)
+	}
+	if anonymizers != nil {
+		observers = append(observers, anonymizers)
+	}
+	if dnsNames != nil {
+		observers = append(observers, dnsNames)
+	}
+	if db != nil {
+		dnsLog := NewDNSLogger(db)
+		dnsLog.Start()
+		observers = append(observers, dnsLog)
+		processLog := NewProcessConnectionLog(db)
+		processLog.Start()
+		observers = append(observers, processLog)
+	}
+
+	// Match packets against IDS signatures if rule files are given
+	signatures := NewSignatureEngine(alertEngine)
+	if *signatureFiles != "" {
+		if err := signatures.Load(strings.Split(*signatureFiles, ","), *homeNet); err != nil {
+			log.Fatalf("Failed to load signatures: %v", err)
+		}
+		observers = append(observers, signatures)
+	}
+
+	// Publish to MQTT for home automation
+	if *mqttBroker != "" {
+		publisher, err := NewMQTTPublisher(MQTTConfig{
+			Broker:   *mqttBroker,
+			Username: *mqttUser,
+			Password: *mqttPassword,
+			Topic:    *mqttTopic,
+			Interval: *mqttInterval,
+		}, store, devices)
+		if err != nil {
+			log.Fatal(err)
+		}
+		publisher.Start()
+		alertEngine.AddNotifier(publisher)
+	}
+
+	// Log packets and flows to ClickHouse
+	var clickHouse *ClickHouseWriter
+	if *clickHouseURL != "" {
+		var ttl time.Duration
+		if *clickHouseTTL != "" {
+			if ttl, err = parseRetentionAge(*clickHouseTTL); err != nil {
+				log.Fatalf("Invalid -clickhouse-ttl: %v", err)
+			}
+		}
+		clickHouse, err = NewClickHouseWriter(ClickHouseConfig{
+			URL:      *clickHouseURL,
+			Database: *clickHouseDB,
+			Username: *clickHouseUser,
+			Password: *clickHousePassword,
+			TTL:      ttl,
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+		clickHouse.Start()
+		observers = append(observers, clickHouse)
+		log.Printf("Logging packets and flows to ClickHouse at %s", *clickHouseURL)
+	}
+
+	// Live packets, flows and stats for gRPC clients
+	var grpcServer *GRPCServer
+	if *grpcPort > 0 {
+		grpcServer = NewGRPCServer(store)
+		observers = append(observers, grpcServer)
+	}
+
+	// Aggregate flows for the collector, ClickHouse, the connection history and gRPC
+	var flows *FlowTable
+	if *flowCollector != "" || clickHouse != nil || db != nil || grpcServer != nil {
+		var err error
+		flows, err = NewFlowTable(FlowConfig{
+			ActiveTimeout:   *flowActive,
+			InactiveTimeout: *flowInactive,
+			AggregationKey:  *flowKey,
+			BatchSize:       *flowBatch,
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+		if *flowCollector != "" {
+			exporter, err := NewNetFlowV5Exporter(*flowCollector)
+			if err != nil {
+				log.Fatal(err)
+			}
+			flows.AddExporter(exporter)
+			log.Printf("Exporting flows to %s (key: %s)", *flowCollector, *flowKey)
+		}
+		if clickHouse != nil {
+			flows.AddExporter(clickHouse)
+		}
+		if db != nil {
+			flows.AddExporter(NewSQLiteFlowExporter(db))
+		}
+		if grpcServer != nil {
+			flows.AddExporter(grpcServer)
+		}
+		flows.Start()
+		observers = append(observers, flows)
+	}
+
+	captureSettings := NewCaptureSettings(captureConfig, db, store, retentionManager)
+
+	// Start packet capture in background, reopening the interface if capture stops
+	go func() {
+		for {
+			if err := startCapture(*iface, store, db, tracker, payloads, captureSettings, observers); err != nil {
+				log.Printf("Capture error: %v", err)
+			}
+			log.Printf("Capture stopped, restarting in 5s")
+			time.Sleep(5 * time.Second)
+		}
+	}()
+
+	// Send batched packets; a short wait when batching is off picks up any left queued
+	go func() {
+		for {
+			interval := captureSettings.BroadcastInterval()
+			if interval <= 0 {
+				interval = 250 * time.Millisecond
+			}
+			time.Sleep(interval)
+			store.FlushBroadcast()
+		}
+	}()
+
+	// Start stats broadcaster
+	go func() {
+		stats := &statsBroadcaster{store: store}
+		for {
+			time.Sleep(captureSettings.StatsInterval())
+			stats.tick()
+			store.BroadcastFollowed()
+			if store.Subscribed(channelConnections) {
+				store.Broadcast("connections", store.GetConnections())
+			}
+		}
+	}()
+
+	// Serve static files from embedded filesystem
+	webFS, err := fs.Sub(webContent, "web")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Keep dashboards polling the API from starving capture and database writes
+	limiter := NewAPILimiter(*apiRateLimit, *apiRateBurst, *dbMaxQueries)
+
+	// API endpoints
+	http.HandleFunc("/api/packets", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		q, err := parseLivePacketQuery(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		packets, total := store.FindPackets(q)
+		w.Header().Set("X-Total-Count", fmt.Sprint(total))
+		json.NewEncoder(w).Encode(packets)
+	})
+
+	// Display filter search over the live buffer or, with source=history, the database
+	http.HandleFunc("/api/search", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		q, err := parseSearchQuery(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var packets []Packet
+		var total int
+		if q.Source == searchSourceHistory {
+			if db == nil {
+				http.Error(w, "history search needs the database", http.StatusBadRequest)
+				return
+			}
+			release, ok := limiter.acquire(w, r)
+			if !ok {
+				return
+			}
+			defer release()
+			startTime, endTime, err := parseHistoryRange(r, db)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if total, err = db.CountPackets("", q.Filter, "", "", nil, startTime, endTime); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			packets = make([]Packet, 0)
+			err = db.QueryPackets(q.Limit, q.Offset, "", q.Filter, "", "", nil, startTime, endTime, func(p Packet) error {
+				packets = append(packets, p)
+				return nil
+			})
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		} else {
+			packets, total = store.SearchPackets(q.Filter, q.Limit, q.Offset)
+		}
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"query":   q.Filter.String(),
+			"source":  q.Source,
+			"packets": packets,
+			"total":   total,
+			"limit":   q.Limit,
+			"offset":  q.Offset,
+		})
+	})
+
+	// One live packet decoded layer by layer, /api/packets/{id}
+	http.HandleFunc("/api/packets/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		var id int64
+		if _, err := fmt.Sscanf(strings.TrimPrefix(r.URL.Path, "/api/packets/"), "%d", &id); err != nil {
+			http.Error(w, "invalid packet ID", http.StatusBadRequest)
+			return
+		}
+		p, ok := store.GetPacket(id)
+		if !ok {
+			http.Error(w, "packet is no longer in the live buffer", http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(decodePacketDetail(p))
+	})
+
+	http.HandleFunc("/api/stats", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(store.GetStats())
+	})
+
+	http.HandleFunc("/api/connections", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		q, err := parseConnectionQuery(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		connections, total := store.FindConnections(q)
+		w.Header().Set("X-Total-Count", fmt.Sprint(total))
+		json.NewEncoder(w).Encode(connections)
+	})
+
+	http.HandleFunc("/api/talkers", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		q, err := parseTalkerQuery(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// Historical queries go to the database, everything else to the live store
+		if r.URL.Query().Get("source") == "history" {
+			if db == nil {
+				http.Error(w, "Database disabled", http.StatusBadRequest)
+				return
+			}
+			release, ok := limiter.acquire(w, r)
+			if !ok {
+				return
+			}
+			defer release()
+			startTime, endTime, err := parseHistoryRange(r, db)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			talkers, err := db.GetTalkers(q, startTime, endTime)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			json.NewEncoder(w).Encode(talkers)
+			return
+		}
+
+		json.NewEncoder(w).Encode(store.GetTalkers(q))
+	})
+
+	// Machines reporting their processes with pi-track-agent
+	http.HandleFunc("/api/agents", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(agents.Agents())
+	})
+
+	http.HandleFunc("/api/agents/report", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var report AgentReport
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, agentMaxBody)).Decode(&report); err != nil {
+			http.Error(w, "invalid report: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		from, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			from = r.RemoteAddr
+		}
+		if err := agents.Report(report, from); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	// Traffic of each process on the Pi itself and the remote hosts it talks to, live
+	// since startup or, with ?source=history, stored in a range
+	http.HandleFunc("/api/processes", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		q, err := parseProcessQuery(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if r.URL.Query().Get("source") == "history" {
+			if db == nil {
+				http.Error(w, "Database disabled", http.StatusBadRequest)
+				return
+			}
+			release, ok := limiter.acquire(w, r)
+			if !ok {
+				return
+			}
+			defer release()
+			startTime, endTime, err := parseHistoryRange(r, db)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			processes, err := db.GetProcesses(q, startTime, endTime)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			json.NewEncoder(w).Encode(processes)
+			return
+		}
+
+		json.NewEncoder(w).Encode(processUsage.Processes(q))
+	})
+
+	// Where each process sends its data, by domain, ASN and country, live or stored
+	http.HandleFunc("/api/processes/destinations", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		q, err := parseProcessQuery(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		q.Remotes = processMaxRemotes
+		if r.URL.Query().Get("source") == "history" {
+			if db == nil {
+				http.Error(w, "Database disabled", http.StatusBadRequest)
+				return
+			}
+			release, ok := limiter.acquire(w, r)
+			if !ok {
+				return
+			}
+			defer release()
+			startTime, endTime, err := parseHistoryRange(r, db)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			processes, err := db.GetProcesses(q, startTime, endTime)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			json.NewEncoder(w).Encode(processDestinations(processes, q))
+			return
+		}
+
+		json.NewEncoder(w).Encode(processDestinations(processUsage.Processes(q), q))
+	})
+
+	// How fresh the port-to-process map is, and how sure attributions have been
+	http.HandleFunc("/api/processes/tracker", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(tracker.Status())
+	})
+
+	// Processes seen connecting out, which a new one raises an alert for
+	http.HandleFunc("/api/processes/known", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(knownProcesses.Processes())
+	})
+
+	http.HandleFunc("/api/media", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(media.Streams())
+	})
+
+	http.HandleFunc("/api/alerts", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		limit := 100
+		if l := r.URL.Query().Get("limit"); l != "" {
+			fmt.Sscanf(l, "%d", &limit)
+		}
+		startTime, endTime := parseTimeRange(r)
+		alerts, err := alertEngine.Alerts(r.URL.Query().Get("state"), startTime, endTime, limit)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(alerts)
+	})
+
+	// Alert rules: GET lists, POST creates, PUT/DELETE ?id= update or remove
+	http.HandleFunc("/api/alerts/rules", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		var id int64
+		if v := r.URL.Query().Get("id"); v != "" {
+			fmt.Sscanf(v, "%d", &id)
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			json.NewEncoder(w).Encode(alertEngine.Rules())
+		case http.MethodPost, http.MethodPut:
+			rule := AlertRule{Enabled: true}
+			if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			rule.ID = 0
+			if r.Method == http.MethodPut {
+				if id == 0 {
+					http.Error(w, "id is required", http.StatusBadRequest)
+					return
+				}
+				rule.ID = id
+			}
+			saved, err := alertEngine.SaveRule(rule)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			json.NewEncoder(w).Encode(saved)
+		case http.MethodDelete:
+			if err := alertEngine.DeleteRule(id); err != nil {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+
+	http.HandleFunc("/api/devices", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(inventory.Devices(r.URL.Query().Get("sort")))
+	})
+
+	// One device by MAC (or IP without Ethernet headers), /api/devices/{mac}; PATCH names it
+	http.HandleFunc("/api/devices/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		key := strings.TrimPrefix(r.URL.Path, "/api/devices/")
+		switch r.Method {
+		case http.MethodGet:
+			device, ok := inventory.Device(key)
+			if !ok {
+				http.Error(w, errUnknownDevice.Error(), http.StatusNotFound)
+				return
+			}
+			json.NewEncoder(w).Encode(device)
+		case http.MethodPatch:
+			var patch struct {
+				Name *string `json:"name"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if patch.Name == nil {
+				http.Error(w, "nothing to change (expected name)", http.StatusBadRequest)
+				return
+			}
+			device, err := inventory.SetName(key, *patch.Name)
+			if err == errUnknownDevice {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			} else if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			json.NewEncoder(w).Encode(device)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+
+	http.HandleFunc("/api/devices/usage", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		result, err := usage.Usage(r.URL.Query().Get("period"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(result)
+	})
+
+	http.HandleFunc("/api/devices/presence", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(presence.Devices())
+	})
+
+	http.HandleFunc("/api/watchlist", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		switch r.Method {
+		case http.MethodGet:
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"countries": watchlist.Countries(),
+				"hits":      watchlist.Hits(),
+			})
+		case http.MethodPut:
+			var countries []string
+			if err := json.NewDecoder(r.Body).Decode(&countries); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err := watchlist.SetCountries(countries); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			json.NewEncoder(w).Encode(watchlist.Countries())
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+
+	http.HandleFunc("/api/labels", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		switch r.Method {
+		case http.MethodGet:
+			json.NewEncoder(w).Encode(ipLabels.Labels())
+		case http.MethodPut:
+			var labels map[string]string
+			if err := json.NewDecoder(r.Body).Decode(&labels); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err := ipLabels.SetLabels(labels); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			json.NewEncoder(w).Encode(ipLabels.Labels())
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+
+	http.HandleFunc("/api/beacons", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(beacons.Beacons())
+	})
+
+	http.HandleFunc("/api/dns/tunneling", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(dnsTunnels.Scores())
+	})
+
+	http.HandleFunc("/api/signatures", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		loaded, skipped, hits := signatures.Stats()
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"loaded":  loaded,
+			"skipped": skipped,
+			"hits":    hits,
+		})
+	})
+
+	http.HandleFunc("/api/clickhouse", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		if clickHouse == nil {
+			json.NewEncoder(w).Encode(map[string]interface{}{"enabled": false})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"enabled": true, "stats": clickHouse.Stats()})
+	})
+
+	http.HandleFunc("/api/dhcp", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		switch r.Method {
+		case http.MethodGet:
+			json.NewEncoder(w).Encode(dhcpGuard.Servers())
+		case http.MethodPost:
+			server := r.URL.Query().Get("trust")
+			if server == "" {
+				http.Error(w, "trust parameter required", http.StatusBadRequest)
+				return
+			}
+			dhcpGuard.Trust(server)
+			json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+
+	http.HandleFunc("/api/latency", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		if prober == nil {
+			json.NewEncoder(w).Encode(map[string]interface{}{"enabled": false})
+			return
+		}
+
+		// A time range returns bucketed history from the database, otherwise recent live results
+		startTime, endTime := parseTimeRange(r)
+		if startTime != nil || endTime != nil {
+			if db == nil {
+				http.Error(w, "Database disabled", http.StatusBadRequest)
+				return
+			}
+			bucket := 60
+			if b := r.URL.Query().Get("bucket"); b != "" {
+				fmt.Sscanf(b, "%d", &bucket)
+			}
+			history, err := db.GetLatencyHistory(startTime, endTime, time.Duration(bucket)*time.Second)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"enabled": true, "history": history})
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]interface{}{"enabled": true, "targets": prober.Summaries()})
+	})
+
+	http.HandleFunc("/api/speedtest", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		if speedTester == nil {
+			json.NewEncoder(w).Encode(map[string]interface{}{"enabled": false})
+			return
+		}
+
+		// POST runs a test now (takes up to a minute or so)
+		if r.Method == http.MethodPost {
+			result, err := speedTester.Run()
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			}
+			json.NewEncoder(w).Encode(result)
+			return
+		}
+
+		response := map[string]interface{}{"enabled": true, "last": speedTester.Last()}
+		if db != nil {
+			startTime, endTime := parseTimeRange(r)
+			history, err := db.GetSpeedTests(startTime, endTime)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			response["history"] = history
+		}
+		json.NewEncoder(w).Encode(response)
+	})
+
+	http.HandleFunc("/api/logs", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		limit := 200
+		var since int64
+		if l := r.URL.Query().Get("limit"); l != "" {
+			fmt.Sscanf(l, "%d", &limit)
+		}
+		if s := r.URL.Query().Get("since"); s != "" {
+			fmt.Sscanf(s, "%d", &since)
+		}
+		level := parseLogLevel(r.URL.Query().Get("level"))
+		if r.URL.Query().Get("level") == "" {
+			level = logLevelDebug
+		}
+
+		json.NewEncoder(w).Encode(logBuffer.Entries(level, since, limit))
+	})
+
+	// Traffic with Tor exit nodes and VPN endpoints by device, and how the lists last downloaded
+	http.HandleFunc("/api/anonymizers", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"lists": anonymizers.Status(),
+			"hits":  anonymizers.Hits(),
+		})
+	})
+
+	// Packets from bogon sources, and from internal addresses arriving from the internet side
+	http.HandleFunc("/api/spoofing", func(w http.ResponseWriter, r *http.Request) {
+		reason := r.URL.Query().Get("reason")
+		if reason != "" && reason != spoofReasonBogon && reason != spoofReasonInternal {
+			http.Error(w, "invalid reason (expected bogon or internal-from-wan)", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(spoofing.Report(reason))
+	})
+
+	// Owner and abuse contact of the netblock an address is in, from its registry over RDAP
+	http.HandleFunc("/api/whois/", func(w http.ResponseWriter, r *http.Request) {
+		ip := net.ParseIP(strings.TrimPrefix(r.URL.Path, "/api/whois/"))
+		if ip == nil {
+			http.Error(w, "invalid IP address", http.StatusBadRequest)
+			return
+		}
+		result, err := whois.Lookup(ip)
+		if err == errNoRDAPRecord {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		} else if err == errNotPublicAddr {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
 		w.Header().Set("Content-Type", "application/json")
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		json.NewEncoder(w).Encode(store.GetConnections())
+		json.NewEncoder(w).Encode(result)
 	})
 
 	http.HandleFunc("/api/interfaces", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
-		w.Header().Set("Access-Control-Allow-Origin", "*")
 
 		interfaces, _ := pcap.FindAllDevs()
 		result := []map[string]interface{}{}
@@ -832,12 +2481,85 @@ func main() {
 		json.NewEncoder(w).Encode(result)
 	})
 
+	// How IP lookups are going: the city database, or the batched ip-api.com queue, and
+	// the reverse DNS workers
+	http.HandleFunc("/api/enrichment", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		status := map[string]interface{}{"providers": enrichers.Names(), "ipApi": geoLookups.Status(), "reverseDns": rdnsLookups.Status()}
+		if geoCityDB != nil {
+			status["cityDatabase"] = map[string]string{"path": *geoipCityDB, "type": geoCityDB.mmdb.dbType}
+		}
+		if dnsNames != nil {
+			status["dnsNames"] = dnsNames.Status()
+		}
+		if docker != nil {
+			status["docker"] = docker.Status()
+		}
+		if kube != nil {
+			status["kubernetes"] = kube.Status()
+		}
+		if cloudRanges != nil {
+			status["cloudRanges"] = cloudRanges.Status()
+		}
+		if backfill != nil {
+			status["backfill"] = backfill.Status()
+		}
+		json.NewEncoder(w).Encode(status)
+	})
+
 	// Database API endpoints (only if database is enabled)
 	if db != nil {
 		// Query historical packets
-		http.HandleFunc("/api/history", func(w http.ResponseWriter, r *http.Request) {
+		http.HandleFunc("/api/history", limiter.Query(func(w http.ResponseWriter, r *http.Request) {
 			w.Header().Set("Content-Type", "application/json")
-			w.Header().Set("Access-Control-Allow-Origin", "*")
+
+			// DELETE removes the packets matching the filters, from storage and the live buffer
+			if r.Method == http.MethodDelete {
+				v := r.URL.Query()
+				q := LivePacketQuery{
+					Filter:    strings.ToLower(v.Get("filter")),
+					Country:   v.Get("country"),
+					Interface: v.Get("interface"),
+				}
+				if exclude := v.Get("exclude"); exclude != "" {
+					q.ExcludeIPs = strings.Split(exclude, ",")
+				}
+				var err error
+				if q.Query, err = parseDisplayFilterParam(v, true); err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				startTime, endTime, err := parseHistoryRange(r, db)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				if s := v.Get("before"); s != "" {
+					before, err := time.Parse(time.RFC3339, s)
+					if err != nil {
+						http.Error(w, fmt.Sprintf("invalid before %q (expected RFC 3339)", s), http.StatusBadRequest)
+						return
+					}
+					if endTime == nil || before.Before(*endTime) {
+						endTime = &before
+					}
+				}
+				if q.Filter == "" && q.Query == nil && q.Country == "" && q.Interface == "" && startTime == nil && endTime == nil {
+					http.Error(w, "no filter given; use /api/database/truncate to delete everything", http.StatusBadRequest)
+					return
+				}
+
+				deleted, err := db.DeletePackets(v.Get("filter"), q.Query, q.Country, q.Interface, q.ExcludeIPs, startTime, endTime)
+				if err != nil {
+					log.Printf("Error deleting packets: %v", err)
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+				live := store.RemovePackets(q, startTime, endTime)
+				log.Printf("Deleted %d stored and %d live packets matching %s", deleted, live, r.URL.RawQuery)
+				json.NewEncoder(w).Encode(map[string]interface{}{"deleted": deleted, "live": live})
+				return
+			}
 
 			// Parse query parameters
 			limit := 100
@@ -854,72 +2576,454 @@ func main() {
 				fmt.Sscanf(o, "%d", &offset)
 			}
 
-			// Parse time range
-			var startTime, endTime *time.Time
-			if s := r.URL.Query().Get("start"); s != "" {
-				if t, err := time.Parse(time.RFC3339, s); err == nil {
-					startTime = &t
+			// Parse time range
+			startTime, endTime, err := parseHistoryRange(r, db)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			// Parse exclude IPs
+			var excludeIPs []string
+			if exclude := r.URL.Query().Get("exclude"); exclude != "" {
+				excludeIPs = strings.Split(exclude, ",")
+			}
+
+			// Parse country and interface filters
+			country := r.URL.Query().Get("country")
+			iface := r.URL.Query().Get("interface")
+
+			query, err := parseDisplayFilterParam(r.URL.Query(), true)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			total, err := db.CountPackets(filter, query, country, iface, excludeIPs, startTime, endTime)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+
+			// Packets are written as they are read rather than collected first, so a
+			// failure part way through can only cut the response short
+			ndjson := r.URL.Query().Get("format") == "ndjson"
+			if ndjson {
+				noWriteTimeout(w)
+				w.Header().Set("Content-Type", "application/x-ndjson")
+				w.Header().Set("X-Total-Count", fmt.Sprint(total))
+			} else {
+				fmt.Fprintf(w, `{"total":%d,"limit":%d,"offset":%d,"packets":[`, total, limit, offset)
+			}
+			err = db.QueryPackets(limit, offset, filter, query, country, iface, excludeIPs, startTime, endTime, newPacketJSONStream(w, ndjson).Write)
+			if !ndjson {
+				fmt.Fprint(w, "]}\n")
+			}
+			if err != nil {
+				log.Printf("Error querying history: %v", err)
+			}
+		}))
+
+		// Export every packet matching the /api/history filters, streamed as it is read
+		http.HandleFunc("/api/history/export", limiter.Query(func(w http.ResponseWriter, r *http.Request) {
+			noWriteTimeout(w)
+
+			q := PacketExport{
+				Filter:    r.URL.Query().Get("filter"),
+				Country:   r.URL.Query().Get("country"),
+				Interface: r.URL.Query().Get("interface"),
+			}
+			var err error
+			if q.StartTime, q.EndTime, err = parseHistoryRange(r, db); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if q.Query, err = parseDisplayFilterParam(r.URL.Query(), true); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if exclude := r.URL.Query().Get("exclude"); exclude != "" {
+				q.ExcludeIPs = strings.Split(exclude, ",")
+			}
+
+			switch format := r.URL.Query().Get("format"); format {
+			case "csv", "":
+				err = exportPacketsCSV(w, db, q)
+			case "parquet":
+				err = exportPacketsParquet(w, db, q)
+			case "ndjson":
+				err = exportPacketsNDJSON(w, db, q)
+			default:
+				http.Error(w, fmt.Sprintf("unsupported format %q", format), http.StatusBadRequest)
+				return
+			}
+			if err != nil {
+				log.Printf("Error exporting packets: %v", err)
+			}
+		}))
+
+		// Closed and expired connections, stored as flow records
+		http.HandleFunc("/api/history/connections", limiter.Query(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+
+			q := FlowQuery{
+				IP:        r.URL.Query().Get("ip"),
+				Protocol:  r.URL.Query().Get("protocol"),
+				Interface: r.URL.Query().Get("interface"),
+				Limit:     100,
+			}
+			if l := r.URL.Query().Get("limit"); l != "" {
+				fmt.Sscanf(l, "%d", &q.Limit)
+				if q.Limit > 1000 {
+					q.Limit = 1000
+				}
+			}
+			if o := r.URL.Query().Get("offset"); o != "" {
+				fmt.Sscanf(o, "%d", &q.Offset)
+			}
+			if p := r.URL.Query().Get("port"); p != "" {
+				fmt.Sscanf(p, "%d", &q.Port)
+			}
+			var err error
+			if q.StartTime, q.EndTime, err = parseHistoryRange(r, db); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			flows, total, err := db.QueryFlows(q)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"connections": flows,
+				"total":       total,
+				"limit":       q.Limit,
+				"offset":      q.Offset,
+			})
+		}))
+
+		// Which process on the Pi talked to which remote endpoint, e.g. what reached an
+		// address last Tuesday
+		http.HandleFunc("/api/history/processes", limiter.Query(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+
+			q, err := parseProcessConnectionQuery(r)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if q.StartTime, q.EndTime, err = parseHistoryRange(r, db); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			conns, total, err := db.QueryProcessConnections(q)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"connections": conns,
+				"total":       total,
+				"limit":       q.Limit,
+				"offset":      q.Offset,
+			})
+		}))
+
+		// Past DNS lookups, e.g. what a device resolved last night
+		http.HandleFunc("/api/dns", limiter.Query(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+
+			q, err := parseDNSLogQuery(r)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			entries, total, err := db.QueryDNSLog(q)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"queries": entries,
+				"total":   total,
+				"limit":   q.Limit,
+				"offset":  q.Offset,
+			})
+		}))
+
+		// Top N applications, countries, domains, devices or ports over a time range
+		http.HandleFunc("/api/top", limiter.Query(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+
+			q, err := parseTopQuery(r)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			top, err := db.GetTop(q)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			for i := range top.Entries {
+				e := &top.Entries[i]
+				switch q.Group {
+				case topGroupDevice:
+					e.Label = inventory.Label(e.Key)
+				case topGroupPort:
+					var port uint16
+					fmt.Sscanf(e.Key, "%d", &port)
+					e.Label = detectApplication(port, 0)
+				}
+			}
+
+			json.NewEncoder(w).Encode(top)
+		}))
+
+		// All-time top talkers from the running per-IP totals
+		http.HandleFunc("/api/history/talkers", limiter.Query(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+
+			q, err := parseTalkerQuery(r)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			talkers, err := db.GetIPStats(q)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+
+			json.NewEncoder(w).Encode(talkers)
+		}))
+
+		// Historical statistics
+		http.HandleFunc("/api/history/stats", limiter.Query(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+
+			startTime, endTime, err := parseHistoryRange(r, db)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			stats, err := db.GetStats(startTime, endTime)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+
+			json.NewEncoder(w).Encode(stats)
+		}))
+
+		// Hourly device traffic downsampled from expired packets
+		http.HandleFunc("/api/history/devices", limiter.Query(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+
+			startTime, endTime, err := parseHistoryRange(r, db)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			device := strings.ToLower(r.URL.Query().Get("device"))
+
+			history, err := db.GetDeviceHourly(device, r.URL.Query().Get("protocol"), startTime, endTime)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+
+			json.NewEncoder(w).Encode(history)
+		}))
+
+		// Stored start of a packet's payload, for a hex view
+		http.HandleFunc("/api/history/payload", limiter.Query(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+
+			var id int64
+			if _, err := fmt.Sscanf(r.URL.Query().Get("id"), "%d", &id); err != nil {
+				http.Error(w, "invalid id", http.StatusBadRequest)
+				return
+			}
+			payload, err := db.GetPayload(id)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if payload == nil {
+				http.Error(w, "no payload stored for this packet", http.StatusNotFound)
+				return
+			}
+
+			json.NewEncoder(w).Encode(payload)
+		}))
+
+		// Capture runs, newest first, for scoping history queries with ?session=
+		http.HandleFunc("/api/sessions", limiter.Query(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+
+			limit := 100
+			offset := 0
+			if l := r.URL.Query().Get("limit"); l != "" {
+				fmt.Sscanf(l, "%d", &limit)
+				if limit > 1000 {
+					limit = 1000
+				}
+			}
+			if o := r.URL.Query().Get("offset"); o != "" {
+				fmt.Sscanf(o, "%d", &offset)
+			}
+
+			sessions, total, err := db.ListSessions(limit, offset)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			// The running session's stored totals lag by up to a minute
+			if session != nil {
+				current := session.Current()
+				for i := range sessions {
+					if sessions[i].ID == current.ID {
+						sessions[i] = current
+					}
+				}
+			}
+
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"sessions": sessions,
+				"total":    total,
+				"limit":    limit,
+				"offset":   offset,
+			})
+		}))
+
+		// Busiest hours heatmap
+		http.HandleFunc("/api/heatmap", limiter.Query(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+
+			days := 30
+			if d := r.URL.Query().Get("days"); d != "" {
+				fmt.Sscanf(d, "%d", &days)
+				if days < 1 {
+					days = 1
 				}
-			}
-			if e := r.URL.Query().Get("end"); e != "" {
-				if t, err := time.Parse(time.RFC3339, e); err == nil {
-					endTime = &t
+				if days > 366 {
+					days = 366
 				}
 			}
 
-			// Parse exclude IPs
-			var excludeIPs []string
-			if exclude := r.URL.Query().Get("exclude"); exclude != "" {
-				excludeIPs = strings.Split(exclude, ",")
+			heatmap, err := db.GetHeatmap(days)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
 			}
 
-			// Parse country filter
-			country := r.URL.Query().Get("country")
+			json.NewEncoder(w).Encode(heatmap)
+		}))
+
+		// Traffic by country for map visualizations
+		http.HandleFunc("/api/geo/map", limiter.Query(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+
+			// Default to the last 24 hours unless an explicit range is given
+			startTime, endTime := parseTimeRange(r)
+			if startTime == nil && endTime == nil {
+				hours := 24
+				if h := r.URL.Query().Get("hours"); h != "" {
+					fmt.Sscanf(h, "%d", &hours)
+				}
+				if hours > 0 {
+					t := time.Now().Add(-time.Duration(hours) * time.Hour)
+					startTime = &t
+				}
+			}
 
-			packets, total, err := db.QueryPackets(limit, offset, filter, country, excludeIPs, startTime, endTime)
+			geo, err := db.GetGeoMap(startTime, endTime)
 			if err != nil {
 				http.Error(w, err.Error(), http.StatusInternalServerError)
 				return
 			}
 
-			json.NewEncoder(w).Encode(map[string]interface{}{
-				"packets": packets,
-				"total":   total,
-				"limit":   limit,
-				"offset":  offset,
-			})
+			json.NewEncoder(w).Encode(geo)
+		}))
+
+		// Grafana JSON datasource (SimpleJSON or Infinity) over the hourly rollups; the
+		// datasource URL is http://<pi>:<port>/grafana, which answers its connection test
+		http.HandleFunc("/grafana/", func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/grafana/" {
+				http.NotFound(w, r)
+				return
+			}
+			w.Write([]byte("OK"))
 		})
 
-		// Historical statistics
-		http.HandleFunc("/api/history/stats", func(w http.ResponseWriter, r *http.Request) {
+		http.HandleFunc("/grafana/search", limiter.Query(func(w http.ResponseWriter, r *http.Request) {
 			w.Header().Set("Content-Type", "application/json")
-			w.Header().Set("Access-Control-Allow-Origin", "*")
 
-			var startTime, endTime *time.Time
-			if s := r.URL.Query().Get("start"); s != "" {
-				if t, err := time.Parse(time.RFC3339, s); err == nil {
-					startTime = &t
+			var body struct {
+				Target string `json:"target"`
+			}
+			if r.Method == http.MethodPost {
+				if err := json.NewDecoder(r.Body).Decode(&body); err != nil && err != io.EOF {
+					http.Error(w, "invalid search: "+err.Error(), http.StatusBadRequest)
+					return
 				}
 			}
-			if e := r.URL.Query().Get("end"); e != "" {
-				if t, err := time.Parse(time.RFC3339, e); err == nil {
-					endTime = &t
+
+			// A dimension name lists its values, for template variables
+			target := strings.TrimSpace(body.Target)
+			if grafanaDimensions[target] != "" {
+				values, err := db.GrafanaDimensionValues(target)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
 				}
+				json.NewEncoder(w).Encode(values)
+				return
 			}
+			json.NewEncoder(w).Encode(grafanaMetricNames(target))
+		}))
 
-			stats, err := db.GetStats(startTime, endTime)
+		http.HandleFunc("/grafana/query", limiter.Query(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+
+			if r.Method != http.MethodPost {
+				http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			q, err := parseGrafanaQuery(r)
 			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
+				http.Error(w, err.Error(), http.StatusBadRequest)
 				return
 			}
 
-			json.NewEncoder(w).Encode(stats)
-		})
+			result := []interface{}{}
+			for _, t := range q.Targets {
+				if t.Hide || strings.TrimSpace(t.Target) == "" {
+					continue
+				}
+				data, err := db.GrafanaQuery(q, t)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+				result = append(result, data...)
+			}
+			json.NewEncoder(w).Encode(result)
+		}))
 
 		// Database info
 		http.HandleFunc("/api/database", func(w http.ResponseWriter, r *http.Request) {
 			w.Header().Set("Content-Type", "application/json")
-			w.Header().Set("Access-Control-Allow-Origin", "*")
 
 			info, err := db.GetDatabaseInfo()
 			if err != nil {
@@ -928,14 +3032,58 @@ func main() {
 			}
 			info["enabled"] = true
 			info["path"] = *dbPath
+			info["encrypted"] = db.Encrypted()
+			info["statsOnly"] = db.WritesPaused()
+			info["writeQueue"] = db.QueueStatus()
+			info["disk"] = diskMonitor.Status()
+			info["retention"] = retentionManager.Status()
+			info["apiLimits"] = limiter.Status()
 
 			json.NewEncoder(w).Encode(info)
 		})
 
+		// Download a consistent snapshot of the database, safe to take while capturing
+		http.HandleFunc("/api/database/backup", func(w http.ResponseWriter, r *http.Request) {
+
+			if r.Method != http.MethodGet {
+				http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			noWriteTimeout(w)
+
+			// Snapshot next to the database rather than in /tmp, which is often RAM on a Pi
+			tmp, err := os.CreateTemp(filepath.Dir(*dbPath), ".pitrack-backup-*.db")
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			tmp.Close()
+			defer os.Remove(tmp.Name())
+
+			if err := db.Backup(tmp.Name()); err != nil {
+				log.Printf("Error backing up database: %v", err)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			f, err := os.Open(tmp.Name())
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			defer f.Close()
+
+			filename := fmt.Sprintf("pitrack-%s.db", time.Now().Format("20060102-150405"))
+			w.Header().Set("Content-Type", "application/vnd.sqlite3")
+			w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+			if fi, err := f.Stat(); err == nil {
+				w.Header().Set("Content-Length", fmt.Sprint(fi.Size()))
+			}
+			io.Copy(w, f)
+		})
+
 		// Get distinct countries for dropdown
 		http.HandleFunc("/api/countries", func(w http.ResponseWriter, r *http.Request) {
 			w.Header().Set("Content-Type", "application/json")
-			w.Header().Set("Access-Control-Allow-Origin", "*")
 
 			countries, err := db.GetDistinctCountries()
 			if err != nil {
@@ -954,7 +3102,6 @@ func main() {
 			}
 
 			w.Header().Set("Content-Type", "application/json")
-			w.Header().Set("Access-Control-Allow-Origin", "*")
 
 			// Truncate DB
 			if err := db.Truncate(); err != nil {
@@ -968,29 +3115,316 @@ func main() {
 
 			json.NewEncoder(w).Encode(map[string]string{"status": "ok", "message": "Database and memory cleared"})
 		})
+
+		// Maintenance status, POST to run it now (?tasks=analyze,optimize,vacuum, all if empty)
+		http.HandleFunc("/api/database/maintenance", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+
+			switch r.Method {
+			case http.MethodGet:
+				json.NewEncoder(w).Encode(maintenance.Status())
+			case http.MethodPost:
+				tasks, err := ParseMaintenanceTasks(r.URL.Query().Get("tasks"))
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				if err := maintenance.Run("api", tasks, true); err != nil {
+					http.Error(w, err.Error(), http.StatusConflict)
+					return
+				}
+				w.WriteHeader(http.StatusAccepted)
+				json.NewEncoder(w).Encode(maintenance.Status())
+			default:
+				http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			}
+		})
+
+		// Enrichment backfill status, POST to fill in stored packets now (?start=&end=, all if empty)
+		http.HandleFunc("/api/enrichment/backfill", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+
+			switch r.Method {
+			case http.MethodGet:
+				json.NewEncoder(w).Encode(backfill.Status())
+			case http.MethodPost:
+				startTime, endTime := parseTimeRange(r)
+				if err := backfill.Run("api", startTime, endTime, true); err != nil {
+					http.Error(w, err.Error(), http.StatusConflict)
+					return
+				}
+				w.WriteHeader(http.StatusAccepted)
+				json.NewEncoder(w).Encode(backfill.Status())
+			default:
+				http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			}
+		})
+
+		// Weekly reports: list, fetch one by id (or "current" for the week so far), POST to regenerate last week
+		http.HandleFunc("/api/reports", limiter.Query(func(w http.ResponseWriter, r *http.Request) {
+
+			if r.Method == http.MethodPost {
+				reports.publish(weekStart(time.Now()).AddDate(0, 0, -7))
+			}
+
+			id := r.URL.Query().Get("id")
+			if id == "" && r.Method != http.MethodPost {
+				list, err := db.ListReports()
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(list)
+				return
+			}
+
+			var report *Report
+			var err error
+			switch id {
+			case "current":
+				start := weekStart(time.Now())
+				report, err = reports.Generate(start, start.AddDate(0, 0, 7))
+			case "":
+				report, err = db.GetReport(weekStart(time.Now()).AddDate(0, 0, -7).Format("2006-01-02"))
+			default:
+				report, err = db.GetReport(id)
+			}
+			if err == sql.ErrNoRows {
+				http.Error(w, "report not found", http.StatusNotFound)
+				return
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+
+			if r.URL.Query().Get("format") == "html" {
+				page, err := report.RenderHTML()
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+				w.Header().Set("Content-Type", "text/html; charset=utf-8")
+				w.Write(page)
+				return
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(report)
+		}))
 	} else {
 		// Database disabled placeholder
 		http.HandleFunc("/api/database", func(w http.ResponseWriter, r *http.Request) {
 			w.Header().Set("Content-Type", "application/json")
-			w.Header().Set("Access-Control-Allow-Origin", "*")
 			json.NewEncoder(w).Encode(map[string]interface{}{
 				"enabled": false,
 			})
 		})
 	}
 
+	// Configuration export/import. Subsystems register the sections they own.
+	configRegistry := NewConfigRegistry(*configSecret)
+	configRegistry.Register("alert_rules",
+		func() (interface{}, error) {
+			return alertEngine.Rules(), nil
+		},
+		func(data json.RawMessage) error {
+			var rules []AlertRule
+			if err := json.Unmarshal(data, &rules); err != nil {
+				return err
+			}
+			return alertEngine.ReplaceRules(rules)
+		})
+	configRegistry.Register("capture",
+		func() (interface{}, error) {
+			return captureSettings.Config(), nil
+		},
+		func(data json.RawMessage) error {
+			config := captureSettings.Config()
+			if err := json.Unmarshal(data, &config); err != nil {
+				return err
+			}
+			return captureSettings.Update(config)
+		})
+	configRegistry.Register("device_names",
+		func() (interface{}, error) {
+			return inventory.Names(), nil
+		},
+		func(data json.RawMessage) error {
+			var names map[string]string
+			if err := json.Unmarshal(data, &names); err != nil {
+				return err
+			}
+			return inventory.SetNames(names)
+		})
+	configRegistry.Register("country_watchlist",
+		func() (interface{}, error) {
+			return watchlist.Countries(), nil
+		},
+		func(data json.RawMessage) error {
+			var countries []string
+			if err := json.Unmarshal(data, &countries); err != nil {
+				return err
+			}
+			return watchlist.SetCountries(countries)
+		})
+	configRegistry.Register("ip_labels",
+		func() (interface{}, error) {
+			return ipLabels.Labels(), nil
+		},
+		func(data json.RawMessage) error {
+			var labels map[string]string
+			if err := json.Unmarshal(data, &labels); err != nil {
+				return err
+			}
+			return ipLabels.SetLabels(labels)
+		})
+	if db != nil {
+		// UI preferences are stored as an opaque JSON document
+		configRegistry.Register("preferences",
+			func() (interface{}, error) {
+				value, ok, err := db.GetSetting("preferences")
+				if err != nil || !ok {
+					return map[string]interface{}{}, err
+				}
+				return json.RawMessage(value), nil
+			},
+			func(data json.RawMessage) error {
+				return db.SetSetting("preferences", string(data))
+			})
+
+		http.HandleFunc("/api/preferences", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+
+			if r.Method == http.MethodPut {
+				var prefs map[string]interface{}
+				if err := json.NewDecoder(r.Body).Decode(&prefs); err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				data, _ := json.Marshal(prefs)
+				if err := db.SetSetting("preferences", string(data)); err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+			}
+
+			value, ok, err := db.GetSetting("preferences")
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if !ok {
+				value = "{}"
+			}
+			w.Write([]byte(value))
+		})
+	}
+
+	// Runtime-tunable capture settings; PUT takes any subset of the fields
+	http.HandleFunc("/api/config", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPut:
+			config := captureSettings.Config()
+			if err := json.NewDecoder(r.Body).Decode(&config); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err := captureSettings.Update(config); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			// Tell the caller which settings won't survive a restart
+			json.NewEncoder(w).Encode(struct {
+				CaptureConfig
+				Overridden []string `json:"overridden,omitempty"`
+			}{captureSettings.Config(), overriddenCaptureFields(explicitFlags)})
+			return
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		json.NewEncoder(w).Encode(captureSettings.Config())
+	})
+
+	http.HandleFunc("/api/config/export", func(w http.ResponseWriter, r *http.Request) {
+		bundle, err := configRegistry.Export()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=pitrack-config-%s.json", time.Now().Format("20060102")))
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(bundle)
+	})
+
+	http.HandleFunc("/api/config/import", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var bundle ConfigBundle
+		if err := json.NewDecoder(r.Body).Decode(&bundle); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		imported, skipped, err := configRegistry.Import(bundle)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Printf("Imported configuration sections %v from %s", imported, bundle.Hostname)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status":   "ok",
+			"imported": imported,
+			"skipped":  skipped,
+		})
+	})
+
+	// Fault injection controls (chaos builds only)
+	registerChaosHandlers(db)
+
+	// The first message on a new WebSocket or event stream, with the current state. Resuming
+	// clients are replayed the packets they missed instead of the latest ones.
+	initMessage := func(packets bool) []byte {
+		state := map[string]interface{}{
+			"stats":       store.GetStats(),
+			"connections": store.GetConnections(),
+			"interface":   *iface,
+		}
+		if packets {
+			state["packets"] = store.GetPackets(100)
+		}
+		data, _ := json.Marshal(map[string]interface{}{"type": "init", "data": state})
+		return data
+	}
+
 	// WebSocket endpoint
 	http.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
+		if err := checkClientQuery(r); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 		conn, err := upgrader.Upgrade(w, r, nil)
 		if err != nil {
 			log.Println("WebSocket upgrade error:", err)
 			return
 		}
 
-		client := &wsClient{
-			conn: conn,
-			send: make(chan []byte, 256),
-		}
+		conn.SetCompressionLevel(*wsCompressionLevel)
+		client, _ := newWSClient(store, conn, r)
+		resume := r.URL.Query().Get("resume")
 
 		store.clientsMu.Lock()
 		store.clients[client] = true
@@ -1006,44 +3440,234 @@ func main() {
 		}()
 
 		// Send initial data
-		initData, _ := json.Marshal(map[string]interface{}{
-			"type": "init",
-			"data": map[string]interface{}{
-				"packets":     store.GetPackets(100),
-				"stats":       store.GetStats(),
-				"connections": store.GetConnections(),
-				"interface":   *iface,
-			},
-		})
-		conn.WriteMessage(websocket.TextMessage, initData)
+		conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+		conn.WriteMessage(websocket.TextMessage, initMessage(!store.Resumable(resume)))
+		if resume != "" {
+			store.Resume(client, resume)
+		}
 
-		// Writer goroutine - handles all writes to this connection
+		// Writer goroutine - handles all writes to this connection, and pings it. A failed
+		// write closes the connection so the reader below stops too.
 		go func() {
-			for msg := range client.send {
-				if err := conn.WriteMessage(websocket.TextMessage, msg); err != nil {
+			ping := time.NewTicker(wsPingPeriod)
+			defer ping.Stop()
+			for {
+				select {
+				case <-client.evicted:
+					conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseTryAgainLater, client.reason), time.Now().Add(wsWriteWait))
+					log.Printf("Disconnected slow WebSocket client %s: %s", client.remote, client.reason)
+					conn.Close()
 					return
+				case msg := <-client.notices:
+					conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+					if err := conn.WriteMessage(websocket.TextMessage, msg); err != nil {
+						conn.Close()
+						return
+					}
+				case msg, ok := <-client.send:
+					if !ok {
+						return
+					}
+					chaosSlowClient()
+					conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+					if err := conn.WriteMessage(websocket.TextMessage, msg); err != nil {
+						conn.Close()
+						return
+					}
+				case <-ping.C:
+					if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteWait)); err != nil {
+						conn.Close()
+						return
+					}
 				}
 			}
 		}()
 
-		// Reader loop - keep connection alive and detect disconnects
+		// Reader loop - handle control messages and detect disconnects. Half-open
+		// connections stop answering pings, and are dropped once the read deadline passes.
+		conn.SetReadDeadline(time.Now().Add(wsPongWait))
+		conn.SetPongHandler(func(string) error {
+			return conn.SetReadDeadline(time.Now().Add(wsPongWait))
+		})
 		for {
-			_, _, err := conn.ReadMessage()
+			_, data, err := conn.ReadMessage()
 			if err != nil {
+				if ne, ok := err.(net.Error); ok && ne.Timeout() {
+					log.Printf("Debug: dropping unresponsive WebSocket client %s", r.RemoteAddr)
+				}
 				break
 			}
+			conn.SetReadDeadline(time.Now().Add(wsPongWait))
+			client.handleMessage(data)
+		}
+	})
+
+	// Connected live clients with their send and drop counters (admin only)
+	http.HandleFunc("/api/clients", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"policy":  store.slowClients,
+			"clients": store.Clients(),
+		})
+	})
+
+	// The same messages as Server-Sent Events
+	http.HandleFunc("/events", func(w http.ResponseWriter, r *http.Request) {
+		serveEvents(store, w, r, initMessage(true))
+	})
+
+	// Login for the web UI and API
+	if *authUser != "" && *authPassword == "" {
+		log.Fatalf("Invalid -auth-password: required with -auth-user")
+	}
+	apiKeys := NewAPIKeyStore(db)
+	auth := NewAuth(*authUser, *authPassword, strings.Split(*apiTokens, ","), apiKeys, *authSessionTTL)
+	if auth.Enabled() {
+		log.Printf("Authentication required for the web UI and API")
+	} else {
+		log.Printf("Warning: no -auth-user or -api-tokens set; anyone who can reach port %d can see all traffic", *port)
+	}
+	// Cross-origin access, checked before authentication so preflight requests, which
+	// carry no credentials, get an answer
+	cors, err := NewCORSPolicy(*corsOrigins)
+	if err != nil {
+		log.Fatalf("Invalid -cors-origins: %v", err)
+	}
+	upgrader.CheckOrigin = cors.CheckOrigin
+
+	// Live JSON compresses several times over, which matters over Wi-Fi and remote access
+	if *wsCompressionLevel < 1 || *wsCompressionLevel > 9 {
+		log.Fatalf("Invalid -ws-compression-level: must be between 1 and 9")
+	}
+	upgrader.EnableCompression = *wsCompression
+
+	// Scoped API keys; the key itself is only in the answer to the POST creating it
+	http.HandleFunc("/api/keys", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		id := r.URL.Query().Get("id")
+		switch r.Method {
+		case http.MethodGet:
+			json.NewEncoder(w).Encode(apiKeys.List())
+		case http.MethodPost, http.MethodPut:
+			var key APIKey
+			if err := json.NewDecoder(r.Body).Decode(&key); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if r.Method == http.MethodPut {
+				if id == "" {
+					http.Error(w, "id is required", http.StatusBadRequest)
+					return
+				}
+				saved, err := apiKeys.Update(id, key)
+				if err == errUnknownAPIKey {
+					http.Error(w, err.Error(), http.StatusNotFound)
+					return
+				} else if err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				json.NewEncoder(w).Encode(saved)
+				return
+			}
+			if !auth.CanCreateKeys() {
+				http.Error(w, "API keys need -auth-user or -api-tokens, so the first key doesn't lock everyone else out", http.StatusBadRequest)
+				return
+			}
+			created, secret, err := apiKeys.Create(key)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			log.Printf("API key %q created with scopes %s", created.Name, strings.Join(created.Scopes, ","))
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(struct {
+				APIKey
+				Key string `json:"key"`
+			}{created, secret})
+		case http.MethodDelete:
+			if err := apiKeys.Delete(id); err != nil {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		}
 	})
+	configRegistry.Register("api_keys",
+		func() (interface{}, error) {
+			return apiKeys.Stored(), nil
+		},
+		func(data json.RawMessage) error {
+			var stored []storedAPIKey
+			if err := json.Unmarshal(data, &stored); err != nil {
+				return err
+			}
+			return apiKeys.SetStored(stored)
+		})
+
+	http.HandleFunc("/api/login", auth.HandleLogin)
+	http.HandleFunc("/api/logout", auth.HandleLogout)
+	http.HandleFunc("/api/auth", auth.HandleStatus)
 
 	// Serve static files
 	http.Handle("/", http.FileServer(http.FS(webFS)))
 
+	// HTTPS
+	tlsOpts := TLSOptions{
+		CertFile:   *tlsCert,
+		KeyFile:    *tlsKey,
+		SelfSigned: *tlsSelfSigned,
+		ACMEEmail:  *acmeEmail,
+		ACMECache:  *acmeCache,
+	}
+	for _, d := range strings.Split(*acmeDomains, ",") {
+		if d = strings.TrimSpace(d); d != "" {
+			tlsOpts.ACMEDomains = append(tlsOpts.ACMEDomains, d)
+		}
+	}
+	if err := tlsOpts.Validate(); err != nil {
+		log.Fatalf("Invalid TLS options: %v", err)
+	}
+	server := &http.Server{
+		Addr:              fmt.Sprintf(":%d", *port),
+		Handler:           cors.Wrap(limiter.Wrap(auth.Wrap(http.DefaultServeMux))),
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       *httpReadTimeout,
+		WriteTimeout:      *httpWriteTimeout,
+		IdleTimeout:       2 * time.Minute,
+	}
+	scheme := "http"
+	if tlsOpts.Enabled() {
+		tlsConfig, redirect, err := tlsOpts.ServerConfig(*port)
+		if err != nil {
+			log.Fatalf("Failed to set up TLS: %v", err)
+		}
+		server.TLSConfig = tlsConfig
+		scheme = "https"
+		if *httpRedirectPort > 0 {
+			go func() {
+				log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", *httpRedirectPort), redirect))
+			}()
+		}
+	} else if auth.Enabled() {
+		log.Printf("Warning: passwords and session cookies are sent unencrypted; use -tls-cert, -tls-self-signed or -acme-domains for HTTPS")
+	}
+	if grpcServer != nil {
+		go func() {
+			log.Fatal(grpcServer.Serve(*grpcPort, auth, server.TLSConfig))
+		}()
+		log.Printf("Serving the gRPC API on port %d", *grpcPort)
+	}
+
 	// Print available interfaces
 	fmt.Println("\n╔══════════════════════════════════════════════════════════════╗")
 	fmt.Println("║                    🌐 Pi-Track Network Monitor                ║")
 	fmt.Println("╠══════════════════════════════════════════════════════════════╣")
 	fmt.Printf("║  📡 Capturing on: %-43s ║\n", *iface)
-	fmt.Printf("║  🌍 Web Interface: http://0.0.0.0:%-27d ║\n", *port)
+	fmt.Printf("║  🌍 Web Interface: %-42s ║\n", fmt.Sprintf("%s://0.0.0.0:%d", scheme, *port))
 	fmt.Println("║  💡 Access from any device on your network                   ║")
 	fmt.Println("╚══════════════════════════════════════════════════════════════╝")
 
@@ -1051,10 +3675,35 @@ func main() {
 	addrs, _ := net.InterfaceAddrs()
 	for _, addr := range addrs {
 		if ipnet, ok := addr.(*net.IPNet); ok && !ipnet.IP.IsLoopback() && ipnet.IP.To4() != nil {
-			fmt.Printf("  → http://%s:%d\n", ipnet.IP.String(), *port)
+			fmt.Printf("  → %s://%s:%d\n", scheme, ipnet.IP.String(), *port)
 		}
 	}
 	fmt.Println()
 
-	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", *port), nil))
+	// On Ctrl-C or SIGTERM, write out queued packets and record the end of the session
+	shutdown := make(chan os.Signal, 1)
+	signal.Notify(shutdown, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-shutdown
+		log.Printf("Received %s, shutting down", sig)
+		if session != nil {
+			session.Stop()
+		}
+		// Finished and still open flows go out to the exporters rather than being lost
+		if flows != nil {
+			flows.Flush()
+		}
+		if db != nil {
+			db.Flush()
+		}
+		if ipInfoStore != nil {
+			ipInfoStore.Flush()
+		}
+		os.Exit(0)
+	}()
+
+	if server.TLSConfig != nil {
+		log.Fatal(server.ListenAndServeTLS("", ""))
+	}
+	log.Fatal(server.ListenAndServe())
 }
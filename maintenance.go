@@ -0,0 +1,233 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Database maintenance tasks, in the order they run
+const (
+	maintenanceAnalyze  = "analyze"  // Rebuild the query planner's statistics for every index
+	maintenanceOptimize = "optimize" // PRAGMA optimize, cheap and safe to run often
+	maintenanceVacuum   = "vacuum"   // Incremental vacuum and WAL checkpoint
+)
+
+// maintenanceTasks lists every task in run order
+var maintenanceTasks = []string{maintenanceAnalyze, maintenanceOptimize, maintenanceVacuum}
+
+// MaintenanceStep is the outcome of one task
+type MaintenanceStep struct {
+	Task     string  `json:"task"`
+	Duration float64 `json:"durationSeconds"`
+	Error    string  `json:"error,omitempty"`
+}
+
+// MaintenanceRun is one maintenance pass, in progress or finished
+type MaintenanceRun struct {
+	Trigger        string            `json:"trigger"` // "schedule" or "api"
+	Tasks          []string          `json:"tasks"`
+	Current        string            `json:"current,omitempty"` // Task running now
+	Progress       float64           `json:"progress"`          // 0 to 100
+	Steps          []MaintenanceStep `json:"steps"`
+	SizeBefore     int64             `json:"sizeBefore"`
+	SizeAfter      int64             `json:"sizeAfter,omitempty"`
+	ReclaimedBytes int64             `json:"reclaimedBytes"`
+	StartedAt      time.Time         `json:"startedAt"`
+	FinishedAt     *time.Time        `json:"finishedAt,omitempty"`
+}
+
+// MaintenanceStatus is what GET /api/database/maintenance reports
+type MaintenanceStatus struct {
+	Running  bool            `json:"running"`
+	Interval string          `json:"interval"` // Empty when only run on demand
+	NextRun  *time.Time      `json:"nextRun,omitempty"`
+	Current  *MaintenanceRun `json:"current,omitempty"`
+	LastRun  *MaintenanceRun `json:"lastRun,omitempty"`
+}
+
+// DBMaintenance keeps query times from degrading on long-running instances by refreshing
+// planner statistics and returning free pages to the filesystem, on a schedule or on demand.
+// Progress is broadcast to WebSocket clients as "maintenance" messages.
+type DBMaintenance struct {
+	db       *Database
+	store    *PacketStore
+	interval time.Duration
+
+	mu      sync.Mutex
+	current *MaintenanceRun
+	lastRun *MaintenanceRun
+	nextRun time.Time
+}
+
+// NewDBMaintenance creates a scheduler running every task each interval (0 for on demand only)
+func NewDBMaintenance(db *Database, store *PacketStore, interval time.Duration) *DBMaintenance {
+	return &DBMaintenance{db: db, store: store, interval: interval}
+}
+
+// Start runs maintenance on the schedule in the background
+func (m *DBMaintenance) Start() {
+	if m.interval <= 0 {
+		return
+	}
+	m.mu.Lock()
+	m.nextRun = time.Now().Add(m.interval)
+	m.mu.Unlock()
+
+	go func() {
+		ticker := time.NewTicker(m.interval)
+		for range ticker.C {
+			m.mu.Lock()
+			m.nextRun = time.Now().Add(m.interval)
+			m.mu.Unlock()
+			if err := m.Run("schedule", maintenanceTasks, false); err != nil {
+				log.Printf("Warning: scheduled database maintenance skipped: %v", err)
+			}
+		}
+	}()
+}
+
+// ParseMaintenanceTasks parses a comma-separated task list, returning every task if empty
+func ParseMaintenanceTasks(s string) ([]string, error) {
+	if strings.TrimSpace(s) == "" {
+		return maintenanceTasks, nil
+	}
+	wanted := make(map[string]bool)
+	for _, t := range strings.Split(s, ",") {
+		t = strings.ToLower(strings.TrimSpace(t))
+		known := false
+		for _, task := range maintenanceTasks {
+			known = known || task == t
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown maintenance task %q, expected %s", t, strings.Join(maintenanceTasks, ", "))
+		}
+		wanted[t] = true
+	}
+	// Keep run order regardless of how they were listed
+	tasks := []string{}
+	for _, task := range maintenanceTasks {
+		if wanted[task] {
+			tasks = append(tasks, task)
+		}
+	}
+	return tasks, nil
+}
+
+// Run performs the given tasks, in the background if async is set. Only one run
+// happens at a time.
+func (m *DBMaintenance) Run(trigger string, tasks []string, async bool) error {
+	m.mu.Lock()
+	if m.current != nil {
+		m.mu.Unlock()
+		return fmt.Errorf("maintenance is already running")
+	}
+	run := &MaintenanceRun{
+		Trigger:    trigger,
+		Tasks:      tasks,
+		Steps:      []MaintenanceStep{},
+		SizeBefore: m.db.FileSize(),
+		StartedAt:  time.Now(),
+	}
+	m.current = run
+	m.mu.Unlock()
+
+	if async {
+		go m.run(run)
+	} else {
+		m.run(run)
+	}
+	return nil
+}
+
+func (m *DBMaintenance) run(run *MaintenanceRun) {
+	log.Printf("Database maintenance started (%s): %s", run.Trigger, strings.Join(run.Tasks, ", "))
+
+	for i, task := range run.Tasks {
+		m.mu.Lock()
+		run.Current = task
+		run.Progress = float64(i) * 100 / float64(len(run.Tasks))
+		m.mu.Unlock()
+		m.broadcast()
+
+		start := time.Now()
+		var err error
+		switch task {
+		case maintenanceAnalyze:
+			err = m.db.Analyze()
+		case maintenanceOptimize:
+			err = m.db.Optimize()
+		case maintenanceVacuum:
+			// Older databases are rebuilt once to enable incremental vacuum
+			if _, err = m.db.EnableIncrementalVacuum(); err == nil {
+				err = m.db.IncrementalVacuum()
+			}
+		}
+		step := MaintenanceStep{Task: task, Duration: time.Since(start).Seconds()}
+		if err != nil {
+			step.Error = err.Error()
+			log.Printf("Error during database %s: %v", task, err)
+		}
+
+		m.mu.Lock()
+		run.Steps = append(run.Steps, step)
+		m.mu.Unlock()
+	}
+
+	finished := time.Now()
+	size := m.db.FileSize()
+	m.mu.Lock()
+	run.Current = ""
+	run.Progress = 100
+	run.SizeAfter = size
+	if run.SizeBefore > size {
+		run.ReclaimedBytes = run.SizeBefore - size
+	}
+	run.FinishedAt = &finished
+	m.current = nil
+	m.lastRun = run
+	m.mu.Unlock()
+	m.broadcast()
+
+	log.Printf("Database maintenance finished in %s, reclaimed %s", finished.Sub(run.StartedAt).Round(time.Millisecond), formatBytes(run.ReclaimedBytes))
+}
+
+func (m *DBMaintenance) broadcast() {
+	if m.store != nil {
+		m.store.Broadcast("maintenance", m.Status())
+	}
+}
+
+// Status returns the schedule, the run in progress and the last finished run
+func (m *DBMaintenance) Status() MaintenanceStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	status := MaintenanceStatus{Running: m.current != nil}
+	if m.interval > 0 {
+		status.Interval = m.interval.String()
+		next := m.nextRun
+		status.NextRun = &next
+	}
+	if m.current != nil {
+		c := *m.current
+		c.Steps = append([]MaintenanceStep(nil), c.Steps...)
+		status.Current = &c
+	}
+	status.LastRun = m.lastRun
+	return status
+}
+
+// Analyze refreshes the query planner's statistics
+func (d *Database) Analyze() error {
+	_, err := d.db.Exec("ANALYZE")
+	return err
+}
+
+// Optimize lets SQLite run whatever analysis it thinks the recent queries need
+func (d *Database) Optimize() error {
+	_, err := d.db.Exec("PRAGMA optimize")
+	return err
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// rtpHeader holds the fields of an RTP header needed for quality estimation
+type rtpHeader struct {
+	payloadType uint8
+	sequence    uint16
+	timestamp   uint32
+	ssrc        uint32
+}
+
+// parseRTP returns the RTP header if the UDP payload looks like RTP (RFC 3550)
+func parseRTP(srcPort, dstPort uint16, payload []byte) *rtpHeader {
+	// RTP runs on unprivileged ports and has a 12 byte fixed header
+	if srcPort < 1024 || dstPort < 1024 || len(payload) < 12 {
+		return nil
+	}
+	// Version must be 2
+	if payload[0]>>6 != 2 {
+		return nil
+	}
+	// Payload types 72-76 collide with RTCP packet types when the marker bit is set
+	pt := payload[1] & 0x7f
+	if pt >= 72 && pt <= 76 {
+		return nil
+	}
+	return &rtpHeader{
+		payloadType: pt,
+		sequence:    binary.BigEndian.Uint16(payload[2:4]),
+		timestamp:   binary.BigEndian.Uint32(payload[4:8]),
+		ssrc:        binary.BigEndian.Uint32(payload[8:12]),
+	}
+}
+
+// MediaStream reports quality metrics for a single RTP stream
+type MediaStream struct {
+	SrcIP       string    `json:"srcIp"`
+	DstIP       string    `json:"dstIp"`
+	SrcPort     uint16    `json:"srcPort"`
+	DstPort     uint16    `json:"dstPort"`
+	SSRC        uint32    `json:"ssrc"`
+	PayloadType uint8     `json:"payloadType"`
+	ClockRate   int       `json:"clockRate"`
+	Packets     int64     `json:"packets"`
+	Expected    int64     `json:"expected"`
+	Lost        int64     `json:"lost"`
+	LossPercent float64   `json:"lossPercent"`
+	JitterMs    float64   `json:"jitterMs"`
+	FirstSeen   time.Time `json:"firstSeen"`
+	LastSeen    time.Time `json:"lastSeen"`
+}
+
+// mediaState is the per-stream estimator state
+type mediaState struct {
+	stream MediaStream
+
+	baseSeq     uint16
+	maxSeq      uint16
+	cycles      int64
+	firstTS     uint32
+	lastTime    time.Time
+	transit     float64 // Previous relative transit time, in seconds
+	haveTransit bool
+	jitter      float64 // RFC 3550 interarrival jitter, in seconds
+	sequenced   int     // In-order packets seen, used to weed out false positives
+}
+
+// minMediaPackets is how many in-order packets a stream needs before it is reported,
+// which keeps random UDP payloads that happen to look like RTP out of the results
+const minMediaPackets = 10
+
+// mediaIdleTimeout removes streams that have stopped sending
+const mediaIdleTimeout = 60 * time.Second
+
+// Limits on the streams tracked. Encrypted UDP on high ports passes parseRTP about a
+// quarter of the time with a random SSRC, so an SSRC is only tracked once a few of its
+// packets have come in sequence, and both maps are capped.
+const (
+	mediaProbation        = 4               // Consecutive sequence numbers before an SSRC is tracked
+	mediaProbationTimeout = 5 * time.Second // Candidates idle this long are dropped
+	mediaMaxCandidates    = 4096
+	mediaMaxStreams       = 1024
+	mediaPruneInterval    = time.Second // Idle streams and candidates are swept at most this often
+)
+
+// mediaCandidate is an SSRC on probation, not tracked until its sequence numbers run on
+type mediaCandidate struct {
+	seq      uint16
+	run      int // Consecutive sequence numbers seen
+	lastTime time.Time
+}
+
+// MediaTracker estimates jitter and loss for RTP-like UDP flows
+type MediaTracker struct {
+	mu         sync.Mutex
+	streams    map[string]*mediaState
+	candidates map[string]*mediaCandidate
+	pruned     time.Time
+}
+
+// NewMediaTracker creates a new media tracker
+func NewMediaTracker() *MediaTracker {
+	return &MediaTracker{
+		streams:    make(map[string]*mediaState),
+		candidates: make(map[string]*mediaCandidate),
+	}
+}
+
+// Observe updates stream statistics for packets carrying RTP
+func (mt *MediaTracker) Observe(p Packet) {
+	if p.rtp == nil {
+		return
+	}
+	h := p.rtp
+	key := fmt.Sprintf("%s:%d->%s:%d/%d", p.SrcIP, p.SrcPort, p.DstIP, p.DstPort, h.ssrc)
+
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+
+	if p.Timestamp.Sub(mt.pruned) >= mediaPruneInterval {
+		mt.pruneLocked(p.Timestamp)
+	}
+	s, exists := mt.streams[key]
+	if !exists {
+		if len(mt.streams) >= mediaMaxStreams || !mt.probeLocked(key, h, p.Timestamp) {
+			return
+		}
+		mt.streams[key] = &mediaState{
+			stream: MediaStream{
+				SrcIP:       p.SrcIP,
+				DstIP:       p.DstIP,
+				SrcPort:     p.SrcPort,
+				DstPort:     p.DstPort,
+				SSRC:        h.ssrc,
+				PayloadType: h.payloadType,
+				Packets:     1,
+				FirstSeen:   p.Timestamp,
+				LastSeen:    p.Timestamp,
+			},
+			baseSeq:  h.sequence,
+			maxSeq:   h.sequence,
+			firstTS:  h.timestamp,
+			lastTime: p.Timestamp,
+		}
+		return
+	}
+
+	// Sequence tracking with 16-bit wraparound
+	delta := h.sequence - s.maxSeq
+	switch {
+	case delta == 0:
+		// Duplicate, ignore
+		return
+	case delta < 0x8000:
+		if h.sequence < s.maxSeq {
+			s.cycles++
+		}
+		if delta == 1 {
+			s.sequenced++
+		}
+		s.maxSeq = h.sequence
+	case delta > 0xff00:
+		// Late or reordered packet, counts as received but does not move the window
+	default:
+		// Large jump, likely a restarted stream or not RTP at all; start over
+		s.baseSeq, s.maxSeq, s.cycles, s.sequenced = h.sequence, h.sequence, 0, 0
+		s.stream.Packets = 0
+		s.firstTS = h.timestamp
+		s.stream.FirstSeen = p.Timestamp
+		s.jitter, s.haveTransit = 0, false
+	}
+
+	s.stream.Packets++
+	s.stream.LastSeen = p.Timestamp
+
+	// Interarrival jitter needs the media clock rate to compare arrival and RTP timestamps
+	if rate := s.clockRate(p.Timestamp, h.timestamp); rate > 0 {
+		transit := p.Timestamp.Sub(s.stream.FirstSeen).Seconds() - float64(h.timestamp-s.firstTS)/float64(rate)
+		if s.haveTransit {
+			d := math.Abs(transit - s.transit)
+			s.jitter += (d - s.jitter) / 16
+		}
+		s.transit, s.haveTransit = transit, true
+		s.stream.ClockRate = rate
+	}
+	s.lastTime = p.Timestamp
+}
+
+// clockRate returns the RTP clock rate, inferred from the payload type or from the
+// ratio of RTP timestamp progress to wall-clock time for dynamic payload types
+func (s *mediaState) clockRate(arrival time.Time, ts uint32) int {
+	switch s.stream.PayloadType {
+	case 0, 3, 4, 5, 7, 8, 9, 12, 13, 15, 18:
+		return 8000
+	case 10, 11:
+		return 44100
+	case 26, 31, 32, 33, 34:
+		return 90000
+	}
+
+	elapsed := arrival.Sub(s.stream.FirstSeen).Seconds()
+	if elapsed < 1 {
+		return s.stream.ClockRate
+	}
+	observed := float64(ts-s.firstTS) / elapsed
+
+	// Snap to the nearest common clock rate
+	best, bestDiff := 0, math.MaxFloat64
+	for _, rate := range []int{8000, 16000, 32000, 44100, 48000, 90000} {
+		if diff := math.Abs(observed - float64(rate)); diff < bestDiff {
+			best, bestDiff = rate, diff
+		}
+	}
+	return best
+}
+
+// probeLocked counts a packet of an SSRC that isn't tracked yet, returning true once
+// enough have come in sequence for it to be RTP. Caller must hold mt.mu.
+func (mt *MediaTracker) probeLocked(key string, h *rtpHeader, now time.Time) bool {
+	c := mt.candidates[key]
+	if c == nil {
+		if len(mt.candidates) < mediaMaxCandidates {
+			mt.candidates[key] = &mediaCandidate{seq: h.sequence, run: 1, lastTime: now}
+		}
+		return false
+	}
+	if h.sequence == c.seq+1 {
+		c.run++
+	} else if h.sequence != c.seq {
+		c.run = 1
+	}
+	c.seq, c.lastTime = h.sequence, now
+	if c.run < mediaProbation {
+		return false
+	}
+	delete(mt.candidates, key)
+	return true
+}
+
+// pruneLocked removes streams idle longer than mediaIdleTimeout and candidates idle
+// longer than mediaProbationTimeout. Caller must hold mt.mu.
+func (mt *MediaTracker) pruneLocked(now time.Time) {
+	mt.pruned = now
+	for key, s := range mt.streams {
+		if now.Sub(s.lastTime) > mediaIdleTimeout {
+			delete(mt.streams, key)
+		}
+	}
+	for key, c := range mt.candidates {
+		if now.Sub(c.lastTime) > mediaProbationTimeout {
+			delete(mt.candidates, key)
+		}
+	}
+}
+
+// Streams returns quality metrics for all active RTP streams
+func (mt *MediaTracker) Streams() []MediaStream {
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+
+	mt.pruneLocked(time.Now())
+
+	streams := make([]MediaStream, 0, len(mt.streams))
+	for _, s := range mt.streams {
+		if s.sequenced < minMediaPackets {
+			continue
+		}
+
+		stream := s.stream
+		stream.Expected = s.cycles*0x10000 + int64(s.maxSeq) - int64(s.baseSeq) + 1
+		stream.Lost = stream.Expected - stream.Packets
+		if stream.Lost < 0 {
+			stream.Lost = 0
+		}
+		if stream.Expected > 0 {
+			stream.LossPercent = float64(stream.Lost) * 100 / float64(stream.Expected)
+		}
+		stream.JitterMs = s.jitter * 1000
+		streams = append(streams, stream)
+	}
+
+	// Worst quality first
+	sort.Slice(streams, func(i, j int) bool {
+		if streams[i].LossPercent != streams[j].LossPercent {
+			return streams[i].LossPercent > streams[j].LossPercent
+		}
+		return streams[i].JitterMs > streams[j].JitterMs
+	})
+
+	return streams
+}
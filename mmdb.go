@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"net"
+	"os"
+)
+
+// mmdbMetadataMarker starts the metadata at the end of a MaxMind DB file
+var mmdbMetadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+// mmdbReader looks addresses up in a MaxMind DB file, the format of GeoLite2 and DB-IP's
+// free databases. The whole file is read into memory; a city database is about 60 MB.
+type mmdbReader struct {
+	buf        []byte
+	data       []byte // The data section, which record pointers are offsets into
+	nodeCount  uint
+	recordSize uint
+	ipVersion  uint
+	ipv4Start  uint // Node for ::/96, where IPv4 addresses begin in an IPv6 tree
+	dbType     string
+}
+
+// openMMDB reads a MaxMind DB file
+func openMMDB(path string) (*mmdbReader, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	at := bytes.LastIndex(buf, mmdbMetadataMarker)
+	if at < 0 {
+		return nil, fmt.Errorf("%s is not a MaxMind DB file", path)
+	}
+	meta := buf[at+len(mmdbMetadataMarker):]
+	v, _, err := mmdbDecode(meta, 0)
+	if err != nil {
+		return nil, fmt.Errorf("%s: invalid metadata: %w", path, err)
+	}
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s: invalid metadata", path)
+	}
+
+	r := &mmdbReader{
+		buf:        buf,
+		nodeCount:  mmdbUint(m["node_count"]),
+		recordSize: mmdbUint(m["record_size"]),
+		ipVersion:  mmdbUint(m["ip_version"]),
+	}
+	r.dbType, _ = m["database_type"].(string)
+	if r.recordSize != 24 && r.recordSize != 28 && r.recordSize != 32 {
+		return nil, fmt.Errorf("%s: unsupported record size %d", path, r.recordSize)
+	}
+	treeSize := r.nodeCount * r.recordSize / 4
+	if treeSize+16 > uint(at) {
+		return nil, fmt.Errorf("%s: truncated search tree", path)
+	}
+	r.data = buf[treeSize+16 : at]
+
+	if r.ipVersion == 6 {
+		node := uint(0)
+		for i := 0; i < 96 && node < r.nodeCount; i++ {
+			node = r.record(node, 0)
+		}
+		r.ipv4Start = node
+	}
+	return r, nil
+}
+
+// record reads the left (bit 0) or right (bit 1) record of a search tree node
+func (r *mmdbReader) record(node uint, bit uint) uint {
+	switch r.recordSize {
+	case 24:
+		b := r.buf[node*6+bit*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		b := r.buf[node*7:]
+		if bit == 0 {
+			return uint(b[3]&0xf0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0f)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		return uint(binary.BigEndian.Uint32(r.buf[node*8+bit*4:]))
+	}
+}
+
+// Lookup returns the record for an address, or nil if the database has none
+func (r *mmdbReader) Lookup(ip net.IP) (map[string]interface{}, error) {
+	addr := ip.To4()
+	node := uint(0)
+	if addr == nil {
+		if r.ipVersion != 6 {
+			return nil, nil
+		}
+		addr = ip.To16()
+	} else if r.ipVersion == 6 {
+		node = r.ipv4Start
+	}
+
+	for i := 0; i < len(addr)*8 && node < r.nodeCount; i++ {
+		node = r.record(node, uint(addr[i/8]>>(7-i%8))&1)
+	}
+	if node <= r.nodeCount {
+		return nil, nil
+	}
+	offset := node - r.nodeCount - 16
+	if offset >= uint(len(r.data)) {
+		return nil, errors.New("corrupt search tree")
+	}
+	v, _, err := mmdbDecode(r.data, offset)
+	if err != nil {
+		return nil, err
+	}
+	m, _ := v.(map[string]interface{})
+	return m, nil
+}
+
+// mmdbDecode decodes the value at offset in a data section, returning it and the offset
+// after it
+func mmdbDecode(data []byte, offset uint) (interface{}, uint, error) {
+	if offset >= uint(len(data)) {
+		return nil, 0, errors.New("unexpected end of data")
+	}
+	ctrl := data[offset]
+	offset++
+	typ := uint(ctrl >> 5)
+
+	if typ == 1 { // Pointer to a value elsewhere in the data section
+		size := uint(ctrl>>3) & 3
+		if offset+size+1 > uint(len(data)) {
+			return nil, 0, errors.New("unexpected end of data")
+		}
+		var p uint
+		switch size {
+		case 0:
+			p = uint(ctrl&7)<<8 | uint(data[offset])
+		case 1:
+			p = (uint(ctrl&7)<<16 | uint(data[offset])<<8 | uint(data[offset+1])) + 2048
+		case 2:
+			p = (uint(ctrl&7)<<24 | uint(data[offset])<<16 | uint(data[offset+1])<<8 | uint(data[offset+2])) + 526336
+		case 3:
+			p = uint(binary.BigEndian.Uint32(data[offset:]))
+		}
+		v, _, err := mmdbDecode(data, p)
+		return v, offset + size + 1, err
+	}
+
+	if typ == 0 { // Extended type, in the next byte
+		if offset >= uint(len(data)) {
+			return nil, 0, errors.New("unexpected end of data")
+		}
+		typ = 7 + uint(data[offset])
+		offset++
+	}
+
+	size := uint(ctrl & 0x1f)
+	if size >= 29 {
+		n := size - 28
+		if offset+n > uint(len(data)) {
+			return nil, 0, errors.New("unexpected end of data")
+		}
+		extra := uint(0)
+		for _, b := range data[offset : offset+n] {
+			extra = extra<<8 | uint(b)
+		}
+		offset += n
+		size = [...]uint{29, 285, 65821}[n-1] + extra
+	}
+
+	switch typ {
+	case 7: // Map
+		m := make(map[string]interface{}, size)
+		for i := uint(0); i < size; i++ {
+			k, next, err := mmdbDecode(data, offset)
+			if err != nil {
+				return nil, 0, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, 0, errors.New("map key is not a string")
+			}
+			v, next, err := mmdbDecode(data, next)
+			if err != nil {
+				return nil, 0, err
+			}
+			m[key] = v
+			offset = next
+		}
+		return m, offset, nil
+	case 11: // Array
+		a := make([]interface{}, 0, size)
+		for i := uint(0); i < size; i++ {
+			v, next, err := mmdbDecode(data, offset)
+			if err != nil {
+				return nil, 0, err
+			}
+			a = append(a, v)
+			offset = next
+		}
+		return a, offset, nil
+	case 14: // Boolean, held in the size
+		return size != 0, offset, nil
+	}
+
+	if offset+size > uint(len(data)) {
+		return nil, 0, errors.New("unexpected end of data")
+	}
+	b := data[offset : offset+size]
+	offset += size
+	switch typ {
+	case 2: // UTF-8 string
+		return string(b), offset, nil
+	case 3: // Double
+		if size != 8 {
+			return nil, 0, errors.New("invalid double")
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), offset, nil
+	case 15: // Float
+		if size != 4 {
+			return nil, 0, errors.New("invalid float")
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), offset, nil
+	case 4: // Bytes
+		return append([]byte(nil), b...), offset, nil
+	case 5, 6, 9: // Unsigned integers of up to 2, 4 and 8 bytes
+		n := uint64(0)
+		for _, c := range b {
+			n = n<<8 | uint64(c)
+		}
+		return n, offset, nil
+	case 8: // Signed 32-bit integer
+		n := uint32(0)
+		for _, c := range b {
+			n = n<<8 | uint32(c)
+		}
+		if size == 4 {
+			return int64(int32(n)), offset, nil
+		}
+		return int64(n), offset, nil
+	case 10: // Unsigned 128-bit integer
+		return new(big.Int).SetBytes(b), offset, nil
+	}
+	return nil, 0, fmt.Errorf("unsupported data type %d", typ)
+}
+
+// mmdbUint reads an unsigned integer from decoded metadata
+func mmdbUint(v interface{}) uint {
+	n, _ := v.(uint64)
+	return uint(n)
+}
+
+// mmdbPath follows a path of map keys through a decoded record, e.g.
+// mmdbPath(rec, "city", "names", "en")
+func mmdbPath(v interface{}, keys ...string) interface{} {
+	for _, k := range keys {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		v = m[k]
+	}
+	return v
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// MQTTConfig configures publishing to an MQTT broker
+type MQTTConfig struct {
+	Broker   string // e.g. tcp://homeassistant.local:1883 or ssl://broker:8883
+	Username string
+	Password string
+	Topic    string        // Prefix for every topic, e.g. "pitrack"
+	Interval time.Duration // How often traffic stats and device usage are published
+}
+
+// mqttDeviceUsage is the payload published per device
+type mqttDeviceUsage struct {
+	MAC              string    `json:"mac"`
+	IPs              []string  `json:"ips"`
+	SentBytes        int64     `json:"sentBytes"`
+	RecvBytes        int64     `json:"recvBytes"`
+	SentBps          float64   `json:"sentBps"`
+	RecvBps          float64   `json:"recvBps"`
+	BroadcastPercent float64   `json:"broadcastPercent"`
+	LastSeen         time.Time `json:"lastSeen"`
+}
+
+// MQTTPublisher publishes traffic rates, per-device usage and alert events to an MQTT broker:
+//
+//	<prefix>/status            "online"/"offline" (retained, offline via last will)
+//	<prefix>/stats             packets and bits per second, totals (retained)
+//	<prefix>/devices/<device>  usage of one device (retained)
+//	<prefix>/alerts            alert events as they fire and resolve
+type MQTTPublisher struct {
+	client   mqtt.Client
+	prefix   string
+	interval time.Duration
+	store    *PacketStore
+	devices  *DeviceTracker
+
+	lastDevices map[string]Device
+	busy        map[string]bool // Devices last published with non-zero rates
+	lastPublish time.Time
+}
+
+// NewMQTTPublisher connects to the broker. The client reconnects by itself if the broker goes away.
+func NewMQTTPublisher(cfg MQTTConfig, store *PacketStore, devices *DeviceTracker) (*MQTTPublisher, error) {
+	prefix := strings.Trim(cfg.Topic, "/")
+	if prefix == "" {
+		prefix = "pitrack"
+	}
+	hostname, _ := os.Hostname()
+
+	opts := mqtt.NewClientOptions().
+		AddBroker(cfg.Broker).
+		SetClientID(fmt.Sprintf("pi-track-%s", hostname)).
+		SetUsername(cfg.Username).
+		SetPassword(cfg.Password).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetWill(prefix+"/status", "offline", 1, true)
+	opts.SetOnConnectHandler(func(c mqtt.Client) {
+		log.Printf("Connected to MQTT broker %s", cfg.Broker)
+		c.Publish(prefix+"/status", 1, true, "online")
+	})
+	opts.SetConnectionLostHandler(func(c mqtt.Client, err error) {
+		log.Printf("Warning: MQTT connection lost: %v", err)
+	})
+
+	client := mqtt.NewClient(opts)
+	// With connect retry enabled this only fails on bad options; the client keeps trying in the background
+	if token := client.Connect(); token.WaitTimeout(time.Second) && token.Error() != nil {
+		return nil, fmt.Errorf("connecting to MQTT broker %s: %v", cfg.Broker, token.Error())
+	}
+
+	return &MQTTPublisher{
+		client:      client,
+		prefix:      prefix,
+		interval:    cfg.Interval,
+		store:       store,
+		devices:     devices,
+		lastDevices: make(map[string]Device),
+		busy:        make(map[string]bool),
+		lastPublish: time.Now(),
+	}, nil
+}
+
+// Start begins publishing stats and device usage in the background
+func (mp *MQTTPublisher) Start() {
+	go func() {
+		ticker := time.NewTicker(mp.interval)
+		for range ticker.C {
+			mp.publishStats()
+		}
+	}()
+}
+
+func (mp *MQTTPublisher) publish(topic string, retained bool, v interface{}) {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return
+	}
+	// Messages published while disconnected are dropped rather than queued, stats go stale anyway
+	if !mp.client.IsConnectionOpen() {
+		return
+	}
+	mp.client.Publish(mp.prefix+"/"+topic, 0, retained, payload)
+}
+
+// mqttTopicSegment makes a device key safe to use as a single topic level
+func mqttTopicSegment(s string) string {
+	return strings.NewReplacer("/", "_", "+", "_", "#", "_").Replace(s)
+}
+
+func (mp *MQTTPublisher) publishStats() {
+	stats := mp.store.GetStats()
+	mp.publish("stats", true, map[string]interface{}{
+		"packetsPerSec": stats.PacketsPerSec,
+		"bitsPerSec":    stats.BytesPerSec * 8,
+		"totalPackets":  stats.TotalPackets,
+		"totalBytes":    stats.TotalBytes,
+	})
+
+	now := time.Now()
+	elapsed := now.Sub(mp.lastPublish).Seconds()
+	mp.lastPublish = now
+
+	devices := mp.devices.Devices("bytes")
+	current := make(map[string]bool, len(devices))
+	for _, d := range devices {
+		current[d.MAC] = true
+		last, seen := mp.lastDevices[d.MAC]
+		// Only devices with new traffic are republished, and ones gone idle once more with
+		// zero rates; retained messages hold the rest
+		changed := !seen || last.SentBytes != d.SentBytes || last.RecvBytes != d.RecvBytes
+		if !changed && !mp.busy[d.MAC] {
+			continue
+		}
+		mp.lastDevices[d.MAC] = d
+
+		usage := mqttDeviceUsage{
+			MAC:              d.MAC,
+			IPs:              d.IPs,
+			SentBytes:        d.SentBytes,
+			RecvBytes:        d.RecvBytes,
+			BroadcastPercent: d.BroadcastPercent,
+			LastSeen:         d.LastSeen,
+		}
+		if changed && seen && elapsed > 0 {
+			usage.SentBps = float64(d.SentBytes-last.SentBytes) * 8 / elapsed
+			usage.RecvBps = float64(d.RecvBytes-last.RecvBytes) * 8 / elapsed
+		}
+		mp.busy[d.MAC] = usage.SentBps > 0 || usage.RecvBps > 0
+		mp.publish("devices/"+mqttTopicSegment(d.MAC), true, usage)
+	}
+	// Devices the tracker has forgotten
+	for mac := range mp.lastDevices {
+		if !current[mac] {
+			delete(mp.lastDevices, mac)
+			delete(mp.busy, mac)
+		}
+	}
+}
+
+// Name implements AlertNotifier
+func (mp *MQTTPublisher) Name() string {
+	return "mqtt"
+}
+
+// Notify implements AlertNotifier
+func (mp *MQTTPublisher) Notify(a Alert) error {
+	payload, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	token := mp.client.Publish(mp.prefix+"/alerts", 1, false, payload)
+	if !token.WaitTimeout(10 * time.Second) {
+		return fmt.Errorf("timed out publishing to MQTT")
+	}
+	return token.Error()
+}
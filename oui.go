@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// ouiSearchPaths are where distributions install vendor lists (the ieee-data, arp-scan
+// and wireshark packages), tried in order when no -oui-file is given
+var ouiSearchPaths = []string{
+	"/usr/share/ieee-data/oui.txt",
+	"/var/lib/ieee-data/oui.txt",
+	"/usr/share/arp-scan/ieee-oui.txt",
+	"/usr/share/wireshark/manuf",
+}
+
+// builtinVendors covers the boards this usually runs next to when no vendor list is installed
+var builtinVendors = map[string]string{
+	"B827EB": "Raspberry Pi Foundation",
+	"DCA632": "Raspberry Pi Trading Ltd",
+	"E45F01": "Raspberry Pi Trading Ltd",
+	"28CDC1": "Raspberry Pi Trading Ltd",
+	"D83ADD": "Raspberry Pi Trading Ltd",
+	"2CCF67": "Raspberry Pi Trading Ltd",
+}
+
+// VendorDB maps the first three octets of a MAC address (the OUI) to its manufacturer
+type VendorDB struct {
+	vendors map[string]string // Upper-case hex OUI -> vendor
+}
+
+// LoadVendorDB reads a vendor list: IEEE oui.txt or oui.csv, arp-scan's ieee-oui.txt or
+// Wireshark's manuf. With no path, the usual system locations are tried, falling back to
+// a few built-in entries.
+func LoadVendorDB(path string) (*VendorDB, error) {
+	db := &VendorDB{vendors: make(map[string]string)}
+	for oui, vendor := range builtinVendors {
+		db.vendors[oui] = vendor
+	}
+
+	if path == "" {
+		for _, candidate := range ouiSearchPaths {
+			if _, err := os.Stat(candidate); err == nil {
+				path = candidate
+				break
+			}
+		}
+		if path == "" {
+			return db, nil
+		}
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	n := 0
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if oui, vendor, ok := parseOUILine(scanner.Text()); ok {
+			db.vendors[oui] = vendor
+			n++
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading %s: %v", path, err)
+	}
+	if n == 0 {
+		return nil, fmt.Errorf("no vendors found in %s", path)
+	}
+	return db, nil
+}
+
+// parseOUILine reads one vendor list line in any of the supported formats
+func parseOUILine(line string) (oui, vendor string, ok bool) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return "", "", false
+	}
+
+	switch {
+	case strings.Contains(line, "(hex)"):
+		// oui.txt: "00-00-0C   (hex)		Cisco Systems, Inc"
+		prefix, rest, _ := strings.Cut(line, "(hex)")
+		oui, vendor = prefix, rest
+	case strings.HasPrefix(line, "MA-L,"):
+		// oui.csv: "MA-L,00000C,"Cisco Systems, Inc",address"
+		fields, err := csv.NewReader(strings.NewReader(line)).Read()
+		if err != nil || len(fields) < 3 {
+			return "", "", false
+		}
+		oui, vendor = fields[1], fields[2]
+	default:
+		// ieee-oui.txt: "00000C	Cisco Systems, Inc"; manuf: "00:00:0C	Cisco	Cisco Systems, Inc"
+		fields := strings.Split(line, "\t")
+		if len(fields) < 2 || strings.Contains(fields[0], "/") {
+			// manuf's /28 and /36 ranges are narrower than an OUI
+			return "", "", false
+		}
+		oui, vendor = fields[0], fields[len(fields)-1]
+	}
+
+	oui = strings.ToUpper(strings.NewReplacer("-", "", ":", "", ".", "").Replace(strings.TrimSpace(oui)))
+	vendor = strings.TrimSpace(vendor)
+	if len(oui) != 6 || vendor == "" {
+		return "", "", false
+	}
+	if _, err := hex.DecodeString(oui); err != nil {
+		return "", "", false
+	}
+	return oui, vendor, true
+}
+
+// Lookup returns the manufacturer of a MAC address, or "" if it isn't known
+func (db *VendorDB) Lookup(mac string) string {
+	hw, err := net.ParseMAC(mac)
+	if err != nil || len(hw) < 3 {
+		return ""
+	}
+	return db.vendors[strings.ToUpper(hex.EncodeToString(hw[:3]))]
+}
+
+// randomizedMAC reports whether a MAC address is locally administered, as the private
+// addresses phones and laptops use per network are, so it has no vendor
+func randomizedMAC(mac string) bool {
+	hw, err := net.ParseMAC(mac)
+	return err == nil && len(hw) > 0 && hw[0]&0x02 != 0
+}
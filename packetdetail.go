@@ -0,0 +1,264 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"sort"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// rawHeaderBytes caps how much of each frame's headers the live buffer keeps for
+// /api/packets/{id}: enough for Ethernet, IPv6 and a TCP header with options
+const rawHeaderBytes = 128
+
+// rawFrame returns the start of a frame to keep with a live packet: its headers, plus the
+// stored payload when payload storage selected the packet. Payloads are otherwise left out,
+// as they are from the database.
+func rawFrame(data, payload []byte, stored *storedPayload) []byte {
+	n := len(data)
+	if len(payload) > 0 {
+		// The payload was decoded in place, so its capacity gives its offset in the frame
+		n = cap(data) - cap(payload)
+	}
+	if n > rawHeaderBytes {
+		n = rawHeaderBytes
+	}
+	if stored != nil && len(payload) > 0 {
+		n = cap(data) - cap(payload) + len(stored.data)
+	}
+	if n > len(data) {
+		n = len(data)
+	}
+	// Copied so the buffer doesn't pin the whole frame
+	return append([]byte(nil), data[:n]...)
+}
+
+// PacketDetail is a live packet with its headers decoded layer by layer
+type PacketDetail struct {
+	Packet
+	Layers    []PacketLayer `json:"layers"`
+	Captured  int           `json:"captured"`  // Bytes of the frame kept
+	Truncated bool          `json:"truncated"` // Captured is less than the frame length
+	Hex       string        `json:"hex"`
+	Dump      string        `json:"dump"` // hexdump -C style, for display
+}
+
+// PacketLayer is one decoded protocol layer
+type PacketLayer struct {
+	Name   string                 `json:"name"`
+	Offset int                    `json:"offset"` // Start of the layer in the frame
+	Length int                    `json:"length"` // Header length
+	Fields map[string]interface{} `json:"fields,omitempty"`
+	Error  string                 `json:"error,omitempty"` // Why decoding stopped here
+}
+
+// GetPacket returns a packet still in the live buffer by ID
+func (ps *PacketStore) GetPacket(id int64) (Packet, bool) {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+
+	if len(ps.packets) == 0 {
+		return Packet{}, false
+	}
+	// IDs are consecutive, so the ID gives the position, unless packets were removed from
+	// the middle; they still increase, so fall back to a binary search
+	i := id - ps.packets[0].ID
+	if i >= 0 && i < int64(len(ps.packets)) && ps.packets[i].ID == id {
+		return ps.packets[i], true
+	}
+	j := sort.Search(len(ps.packets), func(j int) bool { return ps.packets[j].ID >= id })
+	if j == len(ps.packets) || ps.packets[j].ID != id {
+		return Packet{}, false
+	}
+	return ps.packets[j], true
+}
+
+// decodePacketDetail decodes the kept start of a packet's frame
+func decodePacketDetail(p Packet) PacketDetail {
+	d := PacketDetail{
+		Packet:    p,
+		Layers:    []PacketLayer{},
+		Captured:  len(p.raw),
+		Truncated: len(p.raw) < p.Length,
+		Hex:       hex.EncodeToString(p.raw),
+		Dump:      hex.Dump(p.raw),
+	}
+	if len(p.raw) == 0 {
+		return d
+	}
+
+	decoded := gopacket.NewPacket(p.raw, p.linkType, gopacket.DecodeOptions{NoCopy: true})
+	offset := 0
+	for _, l := range decoded.Layers() {
+		layer := PacketLayer{
+			Name:   l.LayerType().String(),
+			Offset: offset,
+			Length: len(l.LayerContents()),
+			Fields: layerFields(l),
+		}
+		if failure, ok := l.(*gopacket.DecodeFailure); ok {
+			layer.Name = "Undecoded"
+			layer.Error = failure.Error().Error()
+		}
+		d.Layers = append(d.Layers, layer)
+		offset += len(l.LayerContents())
+	}
+	return d
+}
+
+// layerFields lists the header fields of the layers worth inspecting
+func layerFields(l gopacket.Layer) map[string]interface{} {
+	switch l := l.(type) {
+	case *layers.Ethernet:
+		return map[string]interface{}{
+			"srcMac":    l.SrcMAC.String(),
+			"dstMac":    l.DstMAC.String(),
+			"etherType": l.EthernetType.String(),
+		}
+	case *layers.Dot1Q:
+		return map[string]interface{}{
+			"vlan":     l.VLANIdentifier,
+			"priority": l.Priority,
+			"type":     l.Type.String(),
+		}
+	case *layers.ARP:
+		return map[string]interface{}{
+			"operation": l.Operation,
+			"senderMac": net.HardwareAddr(l.SourceHwAddress).String(),
+			"senderIp":  net.IP(l.SourceProtAddress).String(),
+			"targetMac": net.HardwareAddr(l.DstHwAddress).String(),
+			"targetIp":  net.IP(l.DstProtAddress).String(),
+		}
+	case *layers.IPv4:
+		var flags []string
+		if l.Flags&layers.IPv4DontFragment != 0 {
+			flags = append(flags, "DF")
+		}
+		if l.Flags&layers.IPv4MoreFragments != 0 {
+			flags = append(flags, "MF")
+		}
+		options := []map[string]interface{}{}
+		for _, o := range l.Options {
+			options = append(options, map[string]interface{}{"type": o.OptionType, "length": o.OptionLength, "data": hex.EncodeToString(o.OptionData)})
+		}
+		return map[string]interface{}{
+			"version":        l.Version,
+			"ihl":            l.IHL,
+			"tos":            l.TOS,
+			"length":         l.Length,
+			"id":             l.Id,
+			"flags":          flags,
+			"fragmentOffset": l.FragOffset,
+			"ttl":            l.TTL,
+			"protocol":       l.Protocol.String(),
+			"checksum":       fmt.Sprintf("0x%04x", l.Checksum),
+			"srcIp":          l.SrcIP.String(),
+			"dstIp":          l.DstIP.String(),
+			"options":        options,
+		}
+	case *layers.IPv6:
+		return map[string]interface{}{
+			"version":      l.Version,
+			"trafficClass": l.TrafficClass,
+			"flowLabel":    l.FlowLabel,
+			"length":       l.Length,
+			"nextHeader":   l.NextHeader.String(),
+			"hopLimit":     l.HopLimit,
+			"srcIp":        l.SrcIP.String(),
+			"dstIp":        l.DstIP.String(),
+		}
+	case *layers.TCP:
+		var flags []string
+		for _, f := range []struct {
+			set  bool
+			name string
+		}{{l.SYN, "SYN"}, {l.ACK, "ACK"}, {l.FIN, "FIN"}, {l.RST, "RST"}, {l.PSH, "PSH"}, {l.URG, "URG"}, {l.ECE, "ECE"}, {l.CWR, "CWR"}, {l.NS, "NS"}} {
+			if f.set {
+				flags = append(flags, f.name)
+			}
+		}
+		options := []map[string]interface{}{}
+		for _, o := range l.Options {
+			option := map[string]interface{}{"type": o.OptionType.String()}
+			if v := tcpOptionValue(o); v != nil {
+				option["value"] = v
+			} else if len(o.OptionData) > 0 {
+				option["data"] = hex.EncodeToString(o.OptionData)
+			}
+			options = append(options, option)
+		}
+		return map[string]interface{}{
+			"srcPort":    uint16(l.SrcPort),
+			"dstPort":    uint16(l.DstPort),
+			"seq":        l.Seq,
+			"ack":        l.Ack,
+			"dataOffset": l.DataOffset,
+			"flags":      flags,
+			"window":     l.Window,
+			"checksum":   fmt.Sprintf("0x%04x", l.Checksum),
+			"urgent":     l.Urgent,
+			"options":    options,
+		}
+	case *layers.UDP:
+		return map[string]interface{}{
+			"srcPort":  uint16(l.SrcPort),
+			"dstPort":  uint16(l.DstPort),
+			"length":   l.Length,
+			"checksum": fmt.Sprintf("0x%04x", l.Checksum),
+		}
+	case *layers.ICMPv4:
+		return map[string]interface{}{
+			"type":     l.TypeCode.Type(),
+			"code":     l.TypeCode.Code(),
+			"name":     l.TypeCode.String(),
+			"checksum": fmt.Sprintf("0x%04x", l.Checksum),
+			"id":       l.Id,
+			"seq":      l.Seq,
+		}
+	case *layers.ICMPv6:
+		return map[string]interface{}{
+			"type":     l.TypeCode.Type(),
+			"code":     l.TypeCode.Code(),
+			"name":     l.TypeCode.String(),
+			"checksum": fmt.Sprintf("0x%04x", l.Checksum),
+		}
+	case *layers.DNS:
+		questions := []string{}
+		for _, q := range l.Questions {
+			questions = append(questions, fmt.Sprintf("%s %s", q.Name, q.Type))
+		}
+		answers := []string{}
+		for _, a := range l.Answers {
+			answers = append(answers, fmt.Sprintf("%s %s %d %s", a.Name, a.Type, a.TTL, a.String()))
+		}
+		return map[string]interface{}{
+			"id":           l.ID,
+			"response":     l.QR,
+			"opcode":       l.OpCode.String(),
+			"responseCode": l.ResponseCode.String(),
+			"questions":    questions,
+			"answers":      answers,
+		}
+	}
+	return nil
+}
+
+// tcpOptionValue decodes the common TCP options, or returns nil
+func tcpOptionValue(o layers.TCPOption) interface{} {
+	switch {
+	case o.OptionType == layers.TCPOptionKindMSS && len(o.OptionData) == 2:
+		return binary.BigEndian.Uint16(o.OptionData)
+	case o.OptionType == layers.TCPOptionKindWindowScale && len(o.OptionData) == 1:
+		return o.OptionData[0]
+	case o.OptionType == layers.TCPOptionKindTimestamps && len(o.OptionData) == 8:
+		return map[string]uint32{
+			"value": binary.BigEndian.Uint32(o.OptionData[:4]),
+			"echo":  binary.BigEndian.Uint32(o.OptionData[4:]),
+		}
+	}
+	return nil
+}
@@ -0,0 +1,465 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Partitioning settings
+const (
+	partitionDayFormat     = "2006-01-02"
+	partitionCheckInterval = 10 * time.Minute
+	partitionMaxAttached   = 10 // SQLite's limit on attached databases per connection
+)
+
+// partitionSchema creates the packet tables of a daily file attached as "archive". Rows keep
+// the IDs they had in the main database, so IDs stay unique across files.
+const partitionSchema = `
+	CREATE TABLE IF NOT EXISTS archive.packets (
+		id INTEGER PRIMARY KEY,
+		timestamp DATETIME NOT NULL,
+		src_ip TEXT,
+		dst_ip TEXT,
+		src_port INTEGER,
+		dst_port INTEGER,
+		protocol TEXT,
+		length INTEGER,
+		info TEXT,
+		src_mac TEXT,
+		dst_mac TEXT,
+		application TEXT,
+		src_hostname TEXT,
+		dst_hostname TEXT,
+		src_country TEXT,
+		dst_country TEXT,
+		process_name TEXT,
+		interface TEXT,
+		src_asn TEXT,
+		dst_asn TEXT,
+		process_user TEXT,
+		process_unit TEXT
+	);
+
+	CREATE INDEX IF NOT EXISTS archive.idx_packets_timestamp ON packets(timestamp);
+	CREATE INDEX IF NOT EXISTS archive.idx_packets_src_ip ON packets(src_ip);
+	CREATE INDEX IF NOT EXISTS archive.idx_packets_dst_ip ON packets(dst_ip);
+
+	CREATE TABLE IF NOT EXISTS archive.packet_payloads (
+		packet_id INTEGER PRIMARY KEY,
+		length INTEGER NOT NULL,
+		data BLOB NOT NULL
+	);
+`
+
+// Partitions moves each finished day of packets out of the main database into its own file
+// next to it (pitrack-2024-06-01.db), which is then only read. Dropping a day is deleting a
+// file, and damage to one file costs one day. Queries attach the files their range covers.
+type Partitions struct {
+	db   *Database
+	dir  string
+	base string // Database file name without its extension
+}
+
+// partitionFile is one day's file
+type partitionFile struct {
+	day  time.Time // Local midnight
+	path string
+}
+
+// EnablePartitions turns on daily partition files for the database at dbPath
+func (d *Database) EnablePartitions(dbPath string) *Partitions {
+	d.partitions = newPartitions(d, dbPath)
+	return d.partitions
+}
+
+func newPartitions(d *Database, dbPath string) *Partitions {
+	return &Partitions{
+		db:   d,
+		dir:  filepath.Dir(dbPath),
+		base: strings.TrimSuffix(filepath.Base(dbPath), filepath.Ext(dbPath)),
+	}
+}
+
+// partitionsExist reports whether the database at dbPath has daily files, as left by
+// -db-partition
+func partitionsExist(dbPath string) bool {
+	files, err := newPartitions(nil, dbPath).files()
+	return err == nil && len(files) > 0
+}
+
+// Start archives finished days now and then every partitionCheckInterval
+func (p *Partitions) Start() {
+	go func() {
+		for {
+			if err := p.Archive(time.Now()); err != nil {
+				log.Printf("Error archiving packets to daily files: %v", err)
+			}
+			time.Sleep(partitionCheckInterval)
+		}
+	}()
+}
+
+func (p *Partitions) path(day time.Time) string {
+	return filepath.Join(p.dir, p.base+"-"+day.Format(partitionDayFormat)+".db")
+}
+
+// files lists the daily files, oldest first
+func (p *Partitions) files() ([]partitionFile, error) {
+	matches, err := filepath.Glob(filepath.Join(p.dir, p.base+"-????-??-??.db"))
+	if err != nil {
+		return nil, err
+	}
+	files := []partitionFile{}
+	for _, m := range matches {
+		name := strings.TrimSuffix(filepath.Base(m), ".db")
+		day, err := time.ParseInLocation(partitionDayFormat, name[len(name)-len(partitionDayFormat):], time.Local)
+		if err != nil {
+			continue
+		}
+		files = append(files, partitionFile{day: day, path: m})
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].day.Before(files[j].day) })
+	return files, nil
+}
+
+// filesBetween lists the daily files whose day overlaps the range, oldest first
+func (p *Partitions) filesBetween(startTime, endTime *time.Time) ([]partitionFile, error) {
+	files, err := p.files()
+	if err != nil {
+		return nil, err
+	}
+	var overlapping []partitionFile
+	for _, f := range files {
+		if (endTime == nil || !f.day.After(*endTime)) && (startTime == nil || f.day.AddDate(0, 0, 1).After(*startTime)) {
+			overlapping = append(overlapping, f)
+		}
+	}
+	return overlapping, nil
+}
+
+// deletePackets deletes the packets matching a packetFilter clause, and their payloads,
+// from the daily files overlapping the range, returning how many were deleted
+func (p *Partitions) deletePackets(where string, args []interface{}, startTime, endTime *time.Time) (int64, error) {
+	files, err := p.filesBetween(startTime, endTime)
+	if err != nil {
+		return 0, err
+	}
+	ctx := context.Background()
+	var total int64
+	for _, f := range files {
+		conn, release, err := p.db.attach([]string{f.path}, "archive")
+		if err != nil {
+			return total, fmt.Errorf("%s: %v", filepath.Base(f.path), err)
+		}
+		migratePartition(conn, "archive")
+		_, err = conn.ExecContext(ctx, "DELETE FROM archive.packet_payloads WHERE packet_id IN (SELECT id FROM archive.packets"+where+")", args...)
+		var res sql.Result
+		if err == nil {
+			res, err = conn.ExecContext(ctx, "DELETE FROM archive.packets"+where, args...)
+		}
+		release()
+		if err != nil {
+			return total, fmt.Errorf("%s: %v", filepath.Base(f.path), err)
+		}
+		n, _ := res.RowsAffected()
+		total += n
+	}
+	return total, nil
+}
+
+// midnight returns the start of t's day in local time
+func midnight(t time.Time) time.Time {
+	y, m, d := t.Local().Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, time.Local)
+}
+
+// Archive copies every day before now's into its file, then rolls the copied packets up
+// into device_hourly and removes them from the main database. Safe to repeat after a crash.
+func (p *Partitions) Archive(now time.Time) error {
+	today := midnight(now)
+	// Late packets from before midnight may still be queued
+	p.db.Flush()
+
+	archived := 0
+	for {
+		var oldest time.Time
+		err := p.db.db.QueryRow("SELECT timestamp FROM packets WHERE timestamp < ? ORDER BY timestamp LIMIT 1", today).Scan(&oldest)
+		if err == sql.ErrNoRows {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		day := midnight(oldest)
+		if err := p.archiveDay(day); err != nil {
+			return fmt.Errorf("archiving %s: %v", day.Format(partitionDayFormat), err)
+		}
+		// Copied rows leave the main database as they are rolled up
+		if _, err := p.db.DownsamplePackets(day.AddDate(0, 0, 1)); err != nil {
+			return err
+		}
+		archived++
+	}
+	if archived > 0 {
+		if err := p.db.IncrementalVacuum(); err != nil {
+			log.Printf("Warning: incremental vacuum failed: %v", err)
+		}
+		log.Printf("Archived %d day(s) of packets to daily files", archived)
+	}
+	return nil
+}
+
+// archiveDay copies one day of packets and their payloads into the day's file
+func (p *Partitions) archiveDay(day time.Time) error {
+	conn, release, err := p.db.attach([]string{p.path(day)}, "archive")
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	ctx := context.Background()
+	if _, err := conn.ExecContext(ctx, partitionSchema); err != nil {
+		return err
+	}
+	migratePartition(conn, "archive")
+	start, end := day, day.AddDate(0, 0, 1)
+	if _, err := conn.ExecContext(ctx, `
+		INSERT OR IGNORE INTO archive.packets (`+packetColumns+`)
+		SELECT `+packetColumns+` FROM main.packets WHERE timestamp >= ? AND timestamp < ?`, start, end); err != nil {
+		return err
+	}
+	_, err = conn.ExecContext(ctx, `
+		INSERT OR IGNORE INTO archive.packet_payloads (packet_id, length, data)
+		SELECT pp.packet_id, pp.length, pp.data FROM main.packet_payloads pp
+		JOIN main.packets p ON p.id = pp.packet_id
+		WHERE p.timestamp >= ? AND p.timestamp < ?`, start, end)
+	return err
+}
+
+// attach returns a connection with the given files attached as prefix0, prefix1 and so on (or
+// just prefix for a single file). The connection is discarded on release rather than going back
+// to the pool, so nothing attached to it can leak into other queries.
+func (d *Database) attach(paths []string, prefix string) (*sql.Conn, func(), error) {
+	ctx := context.Background()
+	conn, err := d.db.Conn(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	release := func() {
+		conn.Raw(func(interface{}) error { return driver.ErrBadConn })
+		conn.Close()
+	}
+	for i, path := range paths {
+		name := prefix
+		if len(paths) > 1 {
+			name = fmt.Sprintf("%s%d", prefix, i)
+		}
+		if _, err := conn.ExecContext(ctx, "ATTACH DATABASE ? AS "+name, path); err != nil {
+			release()
+			return nil, nil, err
+		}
+	}
+	return conn, release, nil
+}
+
+// migratePartition brings a daily file written by an older version up to date with
+// packetColumns. Errors are ignored, as for the main database's migrations.
+func migratePartition(conn *sql.Conn, name string) {
+	// Migration: Record which interface each packet was captured on
+	conn.ExecContext(context.Background(), "ALTER TABLE "+name+".packets ADD COLUMN interface TEXT")
+
+	// Migration: Store the ASN of each end alongside its hostname and country
+	conn.ExecContext(context.Background(), "ALTER TABLE "+name+".packets ADD COLUMN src_asn TEXT")
+	conn.ExecContext(context.Background(), "ALTER TABLE "+name+".packets ADD COLUMN dst_asn TEXT")
+
+	// Migration: Store the user running each packet's process
+	conn.ExecContext(context.Background(), "ALTER TABLE "+name+".packets ADD COLUMN process_user TEXT")
+
+	// Migration: Store the systemd unit each packet's process runs in
+	conn.ExecContext(context.Background(), "ALTER TABLE "+name+".packets ADD COLUMN process_unit TEXT")
+}
+
+// packetQuerier runs read queries over the packets and packet_payloads tables
+type packetQuerier interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// partitionConn is a connection whose packet tables are views spanning daily files
+type partitionConn struct {
+	conn *sql.Conn
+}
+
+func (c partitionConn) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return c.conn.QueryContext(context.Background(), query, args...)
+}
+
+func (c partitionConn) QueryRow(query string, args ...interface{}) *sql.Row {
+	return c.conn.QueryRowContext(context.Background(), query, args...)
+}
+
+// packetsBetween returns where to query packets from startTime to endTime (either may be nil).
+// Without partitions, or when the range is all in the main database, that is the database
+// itself. Otherwise the covered daily files are attached and stand-in views named packets
+// and packet_payloads union them with the main tables. At most partitionMaxAttached files can
+// be searched at once; open-ended ranges get the newest of them. Call release when done.
+func (d *Database) packetsBetween(startTime, endTime *time.Time) (q packetQuerier, release func(), err error) {
+	none := func() {}
+	if d.partitions == nil {
+		return d.db, none, nil
+	}
+	files, err := d.partitions.filesBetween(startTime, endTime)
+	if err != nil {
+		return nil, nil, err
+	}
+	var paths []string
+	for _, f := range files {
+		paths = append(paths, f.path)
+	}
+	if len(paths) == 0 {
+		return d.db, none, nil
+	}
+	if len(paths) > partitionMaxAttached {
+		if startTime != nil {
+			return nil, nil, fmt.Errorf("the range covers %d daily files but at most %d can be searched at once; narrow start/end", len(paths), partitionMaxAttached)
+		}
+		paths = paths[len(paths)-partitionMaxAttached:]
+	}
+
+	conn, release, err := d.attach(paths, "day")
+	if err != nil {
+		return nil, nil, err
+	}
+	packets := []string{"SELECT " + packetColumns + " FROM main.packets"}
+	payloads := []string{"SELECT packet_id, length, data FROM main.packet_payloads"}
+	for i := range paths {
+		name := fmt.Sprintf("day%d", i)
+		if len(paths) == 1 {
+			name = "day"
+		}
+		migratePartition(conn, name)
+		packets = append(packets, "SELECT "+packetColumns+" FROM "+name+".packets")
+		payloads = append(payloads, "SELECT packet_id, length, data FROM "+name+".packet_payloads")
+	}
+	ctx := context.Background()
+	for _, view := range []string{
+		"CREATE TEMP VIEW packets AS " + strings.Join(packets, " UNION ALL "),
+		"CREATE TEMP VIEW packet_payloads AS " + strings.Join(payloads, " UNION ALL "),
+	} {
+		if _, err := conn.ExecContext(ctx, view); err != nil {
+			release()
+			return nil, nil, err
+		}
+	}
+	return partitionConn{conn}, release, nil
+}
+
+// DropPartitions deletes the daily files of days ending before cutoff, returning how many
+// packets they held
+func (d *Database) DropPartitions(cutoff time.Time) (int64, error) {
+	if d.partitions == nil {
+		return 0, nil
+	}
+	files, err := d.partitions.files()
+	if err != nil {
+		return 0, err
+	}
+	var total int64
+	for _, f := range files {
+		if f.day.AddDate(0, 0, 1).After(cutoff) {
+			break
+		}
+		n, err := d.dropPartition(f)
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// deleteOldestPartitionPackets deletes up to n of the oldest packets in the oldest daily
+// file and vacuums it, so the space is given back, or deletes the file once it's empty.
+// ok is false if there are no daily files.
+func (d *Database) deleteOldestPartitionPackets(n int) (deleted int64, ok bool, err error) {
+	if d.partitions == nil {
+		return 0, false, nil
+	}
+	files, err := d.partitions.files()
+	if err != nil || len(files) == 0 {
+		return 0, false, err
+	}
+	conn, release, err := d.attach([]string{files[0].path}, "archive")
+	if err != nil {
+		return 0, true, fmt.Errorf("%s: %v", filepath.Base(files[0].path), err)
+	}
+	ctx := context.Background()
+	_, err = conn.ExecContext(ctx, "DELETE FROM archive.packet_payloads WHERE packet_id IN (SELECT id FROM archive.packets ORDER BY id LIMIT ?)", n)
+	var res sql.Result
+	if err == nil {
+		res, err = conn.ExecContext(ctx, "DELETE FROM archive.packets WHERE id IN (SELECT id FROM archive.packets ORDER BY id LIMIT ?)", n)
+	}
+	var left int64
+	if err == nil {
+		deleted, _ = res.RowsAffected()
+		err = conn.QueryRowContext(ctx, "SELECT COUNT(*) FROM archive.packets").Scan(&left)
+	}
+	if err == nil && left > 0 {
+		_, err = conn.ExecContext(ctx, "VACUUM archive")
+	}
+	release()
+	if err != nil {
+		return deleted, true, fmt.Errorf("%s: %v", filepath.Base(files[0].path), err)
+	}
+	if left == 0 {
+		_, err = d.dropPartition(files[0])
+	}
+	return deleted, true, err
+}
+
+func (d *Database) dropPartition(f partitionFile) (int64, error) {
+	var n int64
+	if conn, release, err := d.attach([]string{f.path}, "archive"); err == nil {
+		conn.QueryRowContext(context.Background(), "SELECT COUNT(*) FROM archive.packets").Scan(&n)
+		release()
+	}
+	for _, suffix := range []string{"", "-journal", "-wal", "-shm"} {
+		if err := os.Remove(f.path + suffix); err != nil && !os.IsNotExist(err) {
+			return 0, err
+		}
+	}
+	return n, nil
+}
+
+// PartitionStatus describes the daily files
+type PartitionStatus struct {
+	Files  int        `json:"files"`
+	Bytes  int64      `json:"bytes"`
+	Oldest *time.Time `json:"oldest,omitempty"`
+	Newest *time.Time `json:"newest,omitempty"`
+}
+
+// Status returns the number and total size of the daily files
+func (p *Partitions) Status() PartitionStatus {
+	status := PartitionStatus{}
+	files, err := p.files()
+	if err != nil || len(files) == 0 {
+		return status
+	}
+	for _, f := range files {
+		if fi, err := os.Stat(f.path); err == nil {
+			status.Bytes += fi.Size()
+		}
+	}
+	status.Files = len(files)
+	status.Oldest, status.Newest = &files[0].day, &files[len(files)-1].day
+	return status
+}
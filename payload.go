@@ -0,0 +1,132 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+)
+
+// PayloadCapture decides which stored packets keep the start of their payload. Packets
+// are selected by protocol or application name, or by a BPF expression; with neither
+// given, every packet is.
+type PayloadCapture struct {
+	maxBytes  int
+	protocols map[string]bool // Upper-case protocol or application names
+	filter    string          // BPF expression
+}
+
+// NewPayloadCapture creates a selector keeping up to maxBytes of payload, checking the filter compiles
+func NewPayloadCapture(maxBytes int, protocols, filter string) (*PayloadCapture, error) {
+	pc := &PayloadCapture{maxBytes: maxBytes, protocols: make(map[string]bool), filter: strings.TrimSpace(filter)}
+	for _, p := range strings.Split(protocols, ",") {
+		if p = strings.ToUpper(strings.TrimSpace(p)); p != "" {
+			pc.protocols[p] = true
+		}
+	}
+	if pc.filter != "" {
+		if _, err := pcap.NewBPF(layers.LinkTypeEthernet, 65536, pc.filter); err != nil {
+			return nil, fmt.Errorf("invalid filter %q: %v", pc.filter, err)
+		}
+	}
+	return pc, nil
+}
+
+// compile builds the BPF filter for a capture handle's link type, or nil if there is none
+func (pc *PayloadCapture) compile(handle *pcap.Handle) (*pcap.BPF, error) {
+	if pc == nil || pc.filter == "" {
+		return nil, nil
+	}
+	return handle.NewBPF(pc.filter)
+}
+
+// storedPayload is the part of a packet's payload written to the database with it
+type storedPayload struct {
+	length int // Full payload length
+	data   []byte
+}
+
+// Select returns the payload to store with a packet: a copy of its first maxBytes if the
+// packet is selected, otherwise nil. Safe to call on a nil PayloadCapture.
+func (pc *PayloadCapture) Select(p Packet, bpf *pcap.BPF, packet gopacket.Packet) *storedPayload {
+	if pc == nil || len(p.payload) == 0 {
+		return nil
+	}
+	selected := len(pc.protocols) == 0 && bpf == nil
+	selected = selected || pc.protocols[strings.ToUpper(p.Protocol)] || pc.protocols[strings.ToUpper(p.Application)]
+	selected = selected || (bpf != nil && bpf.Matches(packet.Metadata().CaptureInfo, packet.Data()))
+	if !selected {
+		return nil
+	}
+	n := len(p.payload)
+	if n > pc.maxBytes {
+		n = pc.maxBytes
+	}
+	// Copied so the queued packet doesn't pin the whole capture buffer
+	return &storedPayload{length: len(p.payload), data: append([]byte(nil), p.payload[:n]...)}
+}
+
+// PacketPayload is the stored start of a packet's payload
+type PacketPayload struct {
+	PacketID int64  `json:"packetId"`
+	Length   int    `json:"length"`   // Full payload length
+	Captured int    `json:"captured"` // Bytes stored
+	Hex      string `json:"hex"`
+	Dump     string `json:"dump"` // hexdump -C style, for display
+}
+
+func createPayloadTables(db *sql.DB) error {
+	schema := `
+	CREATE TABLE IF NOT EXISTS packet_payloads (
+		packet_id INTEGER PRIMARY KEY,
+		length INTEGER NOT NULL,
+		data BLOB NOT NULL
+	);
+
+	CREATE TRIGGER IF NOT EXISTS packet_payloads_delete AFTER DELETE ON packets
+	BEGIN
+		DELETE FROM packet_payloads WHERE packet_id = OLD.id;
+	END;
+	`
+
+	if _, err := db.Exec(schema); err != nil {
+		return fmt.Errorf("failed to create payload schema: %v", err)
+	}
+	return nil
+}
+
+// insertPayload stores a packet's selected payload alongside it
+func insertPayload(tx *sql.Tx, packetID int64, length int, data []byte) error {
+	_, err := tx.Exec("INSERT OR REPLACE INTO packet_payloads (packet_id, length, data) VALUES (?, ?, ?)", packetID, length, data)
+	return err
+}
+
+// GetPayload returns the stored payload of a packet, or nil if none was kept
+func (d *Database) GetPayload(packetID int64) (*PacketPayload, error) {
+	db, release, err := d.packetsBetween(nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	var length int
+	var data []byte
+	err = db.QueryRow("SELECT length, data FROM packet_payloads WHERE packet_id = ?", packetID).Scan(&length, &data)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &PacketPayload{
+		PacketID: packetID,
+		Length:   length,
+		Captured: len(data),
+		Hex:      hex.EncodeToString(data),
+		Dump:     hex.Dump(data),
+	}, nil
+}
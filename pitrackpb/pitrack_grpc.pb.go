@@ -0,0 +1,312 @@
+// Live feed of captured packets, flows and statistics, served on -grpc-port.
+
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             (unknown)
+// source: pitrack.proto
+
+package pitrackpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	PiTrack_SubscribePackets_FullMethodName = "/pitrack.v1.PiTrack/SubscribePackets"
+	PiTrack_SubscribeFlows_FullMethodName   = "/pitrack.v1.PiTrack/SubscribeFlows"
+	PiTrack_SubscribeStats_FullMethodName   = "/pitrack.v1.PiTrack/SubscribeStats"
+	PiTrack_GetStats_FullMethodName         = "/pitrack.v1.PiTrack/GetStats"
+)
+
+// PiTrackClient is the client API for PiTrack service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type PiTrackClient interface {
+	// Streams packets as they are captured
+	SubscribePackets(ctx context.Context, in *SubscribeRequest, opts ...grpc.CallOption) (PiTrack_SubscribePacketsClient, error)
+	// Streams flows as they end (TCP FIN or RST) or expire
+	SubscribeFlows(ctx context.Context, in *SubscribeRequest, opts ...grpc.CallOption) (PiTrack_SubscribeFlowsClient, error)
+	// Streams statistics every interval
+	SubscribeStats(ctx context.Context, in *StatsRequest, opts ...grpc.CallOption) (PiTrack_SubscribeStatsClient, error)
+	// Returns the current statistics
+	GetStats(ctx context.Context, in *StatsRequest, opts ...grpc.CallOption) (*Stats, error)
+}
+
+type piTrackClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewPiTrackClient(cc grpc.ClientConnInterface) PiTrackClient {
+	return &piTrackClient{cc}
+}
+
+func (c *piTrackClient) SubscribePackets(ctx context.Context, in *SubscribeRequest, opts ...grpc.CallOption) (PiTrack_SubscribePacketsClient, error) {
+	stream, err := c.cc.NewStream(ctx, &PiTrack_ServiceDesc.Streams[0], PiTrack_SubscribePackets_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &piTrackSubscribePacketsClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type PiTrack_SubscribePacketsClient interface {
+	Recv() (*Packet, error)
+	grpc.ClientStream
+}
+
+type piTrackSubscribePacketsClient struct {
+	grpc.ClientStream
+}
+
+func (x *piTrackSubscribePacketsClient) Recv() (*Packet, error) {
+	m := new(Packet)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *piTrackClient) SubscribeFlows(ctx context.Context, in *SubscribeRequest, opts ...grpc.CallOption) (PiTrack_SubscribeFlowsClient, error) {
+	stream, err := c.cc.NewStream(ctx, &PiTrack_ServiceDesc.Streams[1], PiTrack_SubscribeFlows_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &piTrackSubscribeFlowsClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type PiTrack_SubscribeFlowsClient interface {
+	Recv() (*Flow, error)
+	grpc.ClientStream
+}
+
+type piTrackSubscribeFlowsClient struct {
+	grpc.ClientStream
+}
+
+func (x *piTrackSubscribeFlowsClient) Recv() (*Flow, error) {
+	m := new(Flow)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *piTrackClient) SubscribeStats(ctx context.Context, in *StatsRequest, opts ...grpc.CallOption) (PiTrack_SubscribeStatsClient, error) {
+	stream, err := c.cc.NewStream(ctx, &PiTrack_ServiceDesc.Streams[2], PiTrack_SubscribeStats_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &piTrackSubscribeStatsClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type PiTrack_SubscribeStatsClient interface {
+	Recv() (*Stats, error)
+	grpc.ClientStream
+}
+
+type piTrackSubscribeStatsClient struct {
+	grpc.ClientStream
+}
+
+func (x *piTrackSubscribeStatsClient) Recv() (*Stats, error) {
+	m := new(Stats)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *piTrackClient) GetStats(ctx context.Context, in *StatsRequest, opts ...grpc.CallOption) (*Stats, error) {
+	out := new(Stats)
+	err := c.cc.Invoke(ctx, PiTrack_GetStats_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// PiTrackServer is the server API for PiTrack service.
+// All implementations must embed UnimplementedPiTrackServer
+// for forward compatibility
+type PiTrackServer interface {
+	// Streams packets as they are captured
+	SubscribePackets(*SubscribeRequest, PiTrack_SubscribePacketsServer) error
+	// Streams flows as they end (TCP FIN or RST) or expire
+	SubscribeFlows(*SubscribeRequest, PiTrack_SubscribeFlowsServer) error
+	// Streams statistics every interval
+	SubscribeStats(*StatsRequest, PiTrack_SubscribeStatsServer) error
+	// Returns the current statistics
+	GetStats(context.Context, *StatsRequest) (*Stats, error)
+	mustEmbedUnimplementedPiTrackServer()
+}
+
+// UnimplementedPiTrackServer must be embedded to have forward compatible implementations.
+type UnimplementedPiTrackServer struct {
+}
+
+func (UnimplementedPiTrackServer) SubscribePackets(*SubscribeRequest, PiTrack_SubscribePacketsServer) error {
+	return status.Errorf(codes.Unimplemented, "method SubscribePackets not implemented")
+}
+func (UnimplementedPiTrackServer) SubscribeFlows(*SubscribeRequest, PiTrack_SubscribeFlowsServer) error {
+	return status.Errorf(codes.Unimplemented, "method SubscribeFlows not implemented")
+}
+func (UnimplementedPiTrackServer) SubscribeStats(*StatsRequest, PiTrack_SubscribeStatsServer) error {
+	return status.Errorf(codes.Unimplemented, "method SubscribeStats not implemented")
+}
+func (UnimplementedPiTrackServer) GetStats(context.Context, *StatsRequest) (*Stats, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetStats not implemented")
+}
+func (UnimplementedPiTrackServer) mustEmbedUnimplementedPiTrackServer() {}
+
+// UnsafePiTrackServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to PiTrackServer will
+// result in compilation errors.
+type UnsafePiTrackServer interface {
+	mustEmbedUnimplementedPiTrackServer()
+}
+
+func RegisterPiTrackServer(s grpc.ServiceRegistrar, srv PiTrackServer) {
+	s.RegisterService(&PiTrack_ServiceDesc, srv)
+}
+
+func _PiTrack_SubscribePackets_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(SubscribeRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(PiTrackServer).SubscribePackets(m, &piTrackSubscribePacketsServer{stream})
+}
+
+type PiTrack_SubscribePacketsServer interface {
+	Send(*Packet) error
+	grpc.ServerStream
+}
+
+type piTrackSubscribePacketsServer struct {
+	grpc.ServerStream
+}
+
+func (x *piTrackSubscribePacketsServer) Send(m *Packet) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _PiTrack_SubscribeFlows_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(SubscribeRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(PiTrackServer).SubscribeFlows(m, &piTrackSubscribeFlowsServer{stream})
+}
+
+type PiTrack_SubscribeFlowsServer interface {
+	Send(*Flow) error
+	grpc.ServerStream
+}
+
+type piTrackSubscribeFlowsServer struct {
+	grpc.ServerStream
+}
+
+func (x *piTrackSubscribeFlowsServer) Send(m *Flow) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _PiTrack_SubscribeStats_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(StatsRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(PiTrackServer).SubscribeStats(m, &piTrackSubscribeStatsServer{stream})
+}
+
+type PiTrack_SubscribeStatsServer interface {
+	Send(*Stats) error
+	grpc.ServerStream
+}
+
+type piTrackSubscribeStatsServer struct {
+	grpc.ServerStream
+}
+
+func (x *piTrackSubscribeStatsServer) Send(m *Stats) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _PiTrack_GetStats_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(StatsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(PiTrackServer).GetStats(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: PiTrack_GetStats_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(PiTrackServer).GetStats(ctx, req.(*StatsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// PiTrack_ServiceDesc is the grpc.ServiceDesc for PiTrack service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var PiTrack_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "pitrack.v1.PiTrack",
+	HandlerType: (*PiTrackServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "GetStats",
+			Handler:    _PiTrack_GetStats_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "SubscribePackets",
+			Handler:       _PiTrack_SubscribePackets_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "SubscribeFlows",
+			Handler:       _PiTrack_SubscribeFlows_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "SubscribeStats",
+			Handler:       _PiTrack_SubscribeStats_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "pitrack.proto",
+}
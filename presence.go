@@ -0,0 +1,294 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Presence tracking settings
+const (
+	presenceKnownAfter    = time.Hour        // A device must be around this long before its absence is noticed
+	presenceCheckInterval = 30 * time.Second // How often devices are checked for going offline
+	presenceAlertName     = "Device offline"
+	newDeviceAlertName    = "New device"
+)
+
+// DevicePresence is the online state of one LAN device
+type DevicePresence struct {
+	Device    string    `json:"device"`
+	IP        string    `json:"ip"`
+	FirstSeen time.Time `json:"firstSeen"`
+	LastSeen  time.Time `json:"lastSeen"`
+	Online    bool      `json:"online"`
+	Since     time.Time `json:"since"` // When the device last came online or went offline
+	Known     bool      `json:"known"` // Around long enough for its absence to be reported
+	Watched   bool      `json:"watched"`
+}
+
+// presenceEvent is broadcast to WebSocket clients when a device goes offline or comes back
+type presenceEvent struct {
+	Event  string         `json:"event"` // "online" or "offline"
+	Device DevicePresence `json:"device"`
+}
+
+// PresenceMonitor tracks when each LAN device was last seen and reports devices that
+// are normally present disappearing for longer than the offline period, and coming back.
+// Offline devices are raised as alerts that resolve when the device reappears, so both
+// events reach the configured notifiers. Devices never seen before are reported too.
+type PresenceMonitor struct {
+	db           *Database
+	alerts       *AlertEngine
+	store        *PacketStore
+	offlineAfter time.Duration
+	watch        map[string]bool // Devices to report on; empty for every known device
+	started      time.Time
+	baseline     time.Time // New devices aren't reported before this, while the network is first learned
+
+	mu         sync.Mutex
+	devices    map[string]*DevicePresence
+	dirty      map[string]bool
+	newDevices []DevicePresence
+}
+
+// NewPresenceMonitor creates a monitor, loading previously seen devices from the database
+func NewPresenceMonitor(offlineAfter time.Duration, watch []string, db *Database, alerts *AlertEngine, store *PacketStore) *PresenceMonitor {
+	pm := &PresenceMonitor{
+		db:           db,
+		alerts:       alerts,
+		store:        store,
+		offlineAfter: offlineAfter,
+		watch:        make(map[string]bool),
+		started:      time.Now(),
+		devices:      make(map[string]*DevicePresence),
+		dirty:        make(map[string]bool),
+	}
+	for _, w := range watch {
+		if w = strings.ToLower(strings.TrimSpace(w)); w != "" {
+			pm.watch[w] = true
+		}
+	}
+
+	if db != nil {
+		devices, err := db.GetDevicePresence()
+		if err != nil {
+			log.Printf("Error loading device presence: %v", err)
+		}
+		for i := range devices {
+			d := devices[i]
+			// Everyone gets the offline period from startup to show up again
+			d.Online = true
+			d.Since = pm.started
+			pm.devices[d.Device] = &d
+		}
+	}
+	// With nothing remembered, every device would look new
+	if len(pm.devices) == 0 {
+		pm.baseline = pm.started.Add(presenceKnownAfter)
+	}
+	return pm
+}
+
+// Start checks for devices going offline or coming back in the background
+func (pm *PresenceMonitor) Start() {
+	go func() {
+		ticker := time.NewTicker(presenceCheckInterval)
+		for range ticker.C {
+			pm.check(time.Now())
+		}
+	}()
+}
+
+// Observe implements PacketObserver. Only traffic a device sends from a LAN address
+// counts as it being present.
+func (pm *PresenceMonitor) Observe(p Packet) {
+	ip := net.ParseIP(p.SrcIP)
+	if ip == nil || !(ip.IsPrivate() || ip.IsLinkLocalUnicast()) {
+		return
+	}
+	device := deviceKey(p.SrcMAC, p.SrcIP)
+
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	d := pm.devices[device]
+	if d == nil {
+		d = &DevicePresence{Device: device, IP: p.SrcIP, FirstSeen: p.Timestamp, Online: true, Since: p.Timestamp}
+		pm.devices[device] = d
+		if p.Timestamp.After(pm.baseline) {
+			pm.newDevices = append(pm.newDevices, *d)
+		}
+	}
+	d.IP = p.SrcIP
+	d.LastSeen = p.Timestamp
+	pm.dirty[device] = true
+}
+
+// watched reports whether offline events are wanted for the device. Must be called with pm.mu held.
+func (pm *PresenceMonitor) watched(d *DevicePresence) bool {
+	return len(pm.watch) == 0 || pm.watch[d.Device] || pm.watch[d.IP]
+}
+
+// check moves devices between online and offline and persists what changed
+func (pm *PresenceMonitor) check(now time.Time) {
+	var wentOffline, cameOnline, stillOffline []DevicePresence
+
+	pm.mu.Lock()
+	for _, d := range pm.devices {
+		d.Known = d.LastSeen.Sub(d.FirstSeen) >= presenceKnownAfter
+		d.Watched = pm.watched(d)
+
+		lastSeen := d.LastSeen
+		if lastSeen.Before(pm.started) {
+			lastSeen = pm.started
+		}
+		away := now.Sub(lastSeen) > pm.offlineAfter
+
+		switch {
+		case d.Online && away && d.Known && d.Watched:
+			d.Online = false
+			d.Since = d.LastSeen
+			wentOffline = append(wentOffline, *d)
+		case !d.Online && !away:
+			d.Online = true
+			d.Since = d.LastSeen
+			cameOnline = append(cameOnline, *d)
+		case !d.Online:
+			stillOffline = append(stillOffline, *d)
+		}
+	}
+	dirty := make([]DevicePresence, 0, len(pm.dirty))
+	for device := range pm.dirty {
+		dirty = append(dirty, *pm.devices[device])
+	}
+	pm.dirty = make(map[string]bool)
+	newDevices := pm.newDevices
+	pm.newDevices = nil
+	pm.mu.Unlock()
+
+	if pm.db != nil && len(dirty) > 0 {
+		if err := pm.db.SaveDevicePresence(dirty); err != nil {
+			log.Printf("Error saving device presence: %v", err)
+		}
+	}
+
+	for _, d := range wentOffline {
+		pm.broadcast("offline", d)
+	}
+	for _, d := range cameOnline {
+		log.Printf("Device %s (%s) is back online", d.Device, d.IP)
+		pm.broadcast("online", d)
+		if pm.alerts != nil {
+			pm.alerts.Resolve(presenceAlertName, d.Device)
+		}
+	}
+	if pm.alerts == nil {
+		return
+	}
+	for _, d := range newDevices {
+		pm.alerts.Raise(newDeviceAlertName, d.Device, severityInfo,
+			fmt.Sprintf("New device %s (%s) joined the network", d.Device, d.IP))
+	}
+	// Raising again while offline keeps the alert from resolving on its own
+	for _, d := range append(wentOffline, stillOffline...) {
+		pm.alerts.Raise(presenceAlertName, d.Device, severityInfo,
+			fmt.Sprintf("%s (%s) has not been seen since %s", d.Device, d.IP, d.LastSeen.Format("2006-01-02 15:04:05")))
+	}
+}
+
+func (pm *PresenceMonitor) broadcast(event string, d DevicePresence) {
+	if pm.store != nil {
+		pm.store.Broadcast("presence", presenceEvent{Event: event, Device: d})
+	}
+}
+
+// Devices returns every device's presence, offline devices first, then by last seen
+func (pm *PresenceMonitor) Devices() []DevicePresence {
+	pm.mu.Lock()
+	devices := make([]DevicePresence, 0, len(pm.devices))
+	for _, d := range pm.devices {
+		c := *d
+		c.Known = c.LastSeen.Sub(c.FirstSeen) >= presenceKnownAfter
+		c.Watched = pm.watched(d)
+		devices = append(devices, c)
+	}
+	pm.mu.Unlock()
+
+	sort.Slice(devices, func(i, j int) bool {
+		if devices[i].Online != devices[j].Online {
+			return !devices[i].Online
+		}
+		return devices[i].LastSeen.After(devices[j].LastSeen)
+	})
+	return devices
+}
+
+func createPresenceTables(db *sql.DB) error {
+	schema := `
+	CREATE TABLE IF NOT EXISTS device_presence (
+		device TEXT PRIMARY KEY,
+		ip TEXT,
+		first_seen INTEGER NOT NULL,
+		last_seen INTEGER NOT NULL
+	);
+	`
+
+	if _, err := db.Exec(schema); err != nil {
+		return fmt.Errorf("failed to create presence schema: %v", err)
+	}
+	return nil
+}
+
+// SaveDevicePresence stores when devices were first and last seen
+func (d *Database) SaveDevicePresence(devices []DevicePresence) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(`
+		INSERT INTO device_presence (device, ip, first_seen, last_seen) VALUES (?, ?, ?, ?)
+		ON CONFLICT (device) DO UPDATE SET ip = excluded.ip, last_seen = excluded.last_seen
+	`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, p := range devices {
+		if _, err := stmt.Exec(p.Device, p.IP, p.FirstSeen.Unix(), p.LastSeen.Unix()); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// GetDevicePresence returns every device seen before
+func (d *Database) GetDevicePresence() ([]DevicePresence, error) {
+	rows, err := d.db.Query("SELECT device, ip, first_seen, last_seen FROM device_presence")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	devices := []DevicePresence{}
+	for rows.Next() {
+		var p DevicePresence
+		var ip sql.NullString
+		var firstSeen, lastSeen int64
+		if err := rows.Scan(&p.Device, &ip, &firstSeen, &lastSeen); err != nil {
+			return nil, err
+		}
+		p.IP = ip.String
+		p.FirstSeen = time.Unix(firstSeen, 0)
+		p.LastSeen = time.Unix(lastSeen, 0)
+		devices = append(devices, p)
+	}
+	return devices, rows.Err()
+}
@@ -3,35 +3,158 @@ package main
 import (
 	"fmt"
 	"log"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	psnet "github.com/shirou/gopsutil/v3/net"
 	"github.com/shirou/gopsutil/v3/process"
 )
 
-// ProcessTracker maintains a mapping of network ports to process names
+// Open sockets are polled this often by default, or less often when eBPF catches
+// connections as they're made and polling only has to find listening sockets
+const (
+	processPollInterval     = 2 * time.Second
+	processPollIntervalEBPF = 10 * time.Second
+	processPollSlack        = time.Second      // Allowed for a poll taking longer than usual
+	processMapKeep          = 30 * time.Second // A port whose socket has gone is still named this long, with less confidence
+)
+
+// How sure an attribution is, as Packet.ProcessConfidence
+const (
+	processConfidencePolled    = "polled"    // The port was held by the process in polls on either side of the packet
+	processConfidenceTraced    = "traced"    // eBPF saw the process connect or send to the remote address
+	processConfidenceUncertain = "uncertain" // The packet falls outside the polls that found the port, so it may be another process's
+)
+
+// ProcessTracker maintains a mapping of network ports to process names and the users
+// running them. TCP and UDP ports are kept apart, since e.g. a DNS server and a resolver
+// may hold port 53 of each. On Linux, a socketTracer also names the process behind
+// connections too short-lived to be polled.
 type ProcessTracker struct {
+	interval time.Duration
+
 	mu         sync.RWMutex
-	portPidMap map[uint32]int32 // port -> pid (using uint32 to match gopsutil, though ports are uint16)
-	pidNameMap map[int32]string // pid -> process name
+	portPidMap map[processPort]*portMapping
+	pidNameMap map[int32]string  // pid -> process name
+	pidUIDMap  map[int32]uint32  // pid -> real UID, when known
+	pidExeMap  map[int32]string  // pid -> executable path, looked up when first asked for
+	pidUnitMap map[int32]string  // pid -> systemd unit, looked up when first asked for
+	pidHashMap map[int32]string  // pid -> executable SHA-256, once hashed
+	userNames  map[uint32]string // UID -> username, looked up once
 	lastUpdate time.Time
+	failing    bool // Last scan failed, so the error isn't logged again every scan
+
+	sockets *socketTracer // nil without eBPF
+	hasher  *ExeHasher    // nil without -process-hash
+
+	attributed map[string]*int64 // Packets attributed by confidence, counted atomically
+}
+
+// portMapping is a local port held by a process, and when polling found it: the socket
+// was opened after since, and was still open at lastSeen
+type portMapping struct {
+	pid      int32
+	since    time.Time // The poll before the one that first found it; zero on the first poll
+	lastSeen time.Time
+	gone     time.Time // The first poll that didn't find it, zero while it's open
+}
+
+// ProcessInfo is the process behind a packet
+type ProcessInfo struct {
+	PID  int32
+	Name string // "container: <name>" for a Docker container
+	User string // "" if unknown
+	Exe  string // Executable path, "" if unknown
+	Unit string // systemd unit the process runs in, e.g. "nginx.service"; "" if none
+	// Hex SHA-256 of the executable, with -process-hash; "" until it has been hashed
+	SHA256     string
+	Confidence string // processConfidence*, "" if not found by polling or eBPF
+}
+
+// describeProcess names the process behind a packet for alert messages, e.g.
+// "process curl (/usr/bin/curl, sha256 9f86d0…)", or returns "" if there's none
+func describeProcess(p Packet) string {
+	if p.ProcessName == "" {
+		return ""
+	}
+	details := []string{}
+	if p.processExe != "" {
+		details = append(details, p.processExe)
+	}
+	if p.ProcessUser != "" {
+		details = append(details, "user "+p.ProcessUser)
+	}
+	if p.ProcessUnit != "" {
+		details = append(details, "unit "+p.ProcessUnit)
+	}
+	if p.processHash != "" {
+		details = append(details, "sha256 "+p.processHash)
+	}
+	if len(details) == 0 {
+		return "process " + p.ProcessName
+	}
+	return fmt.Sprintf("process %s (%s)", p.ProcessName, strings.Join(details, ", "))
+}
+
+// processPort is a local port of one protocol
+type processPort struct {
+	udp  bool
+	port uint32 // uint32 to match gopsutil, though ports are uint16
 }
 
 // NewProcessTracker creates a new process tracker
 func NewProcessTracker() *ProcessTracker {
 	return &ProcessTracker{
-		portPidMap: make(map[uint32]int32),
+		interval:   processPollInterval,
+		portPidMap: make(map[processPort]*portMapping),
 		pidNameMap: make(map[int32]string),
+		pidUIDMap:  make(map[int32]uint32),
+		pidExeMap:  make(map[int32]string),
+		pidUnitMap: make(map[int32]string),
+		pidHashMap: make(map[int32]string),
+		userNames:  make(map[uint32]string),
+		attributed: map[string]*int64{
+			processConfidencePolled:    new(int64),
+			processConfidenceTraced:    new(int64),
+			processConfidenceUncertain: new(int64),
+		},
 	}
 }
 
-// Start begins the background update loop
-func (pt *ProcessTracker) Start() {
+// Start begins the background update loop, polling every interval (0 for the default),
+// tracing connections with eBPF if enabled and possible, and hashing executables if asked to
+func (pt *ProcessTracker) Start(ebpf, hash bool, interval time.Duration) {
+	if hash {
+		pt.hasher = NewExeHasher()
+	}
+	auto := interval == 0
+	if auto {
+		interval = processPollInterval
+	}
+	if ebpf {
+		sockets, err := newSocketTracer()
+		if err != nil {
+			log.Printf("Warning: eBPF connection tracing unavailable, short-lived connections may not be attributed to processes: %v", err)
+		} else {
+			log.Printf("Tracing connections to processes with eBPF")
+			pt.sockets = sockets
+			if auto {
+				interval = processPollIntervalEBPF
+			}
+		}
+	}
+	pt.interval = interval
 	go func() {
 		for {
 			pt.update()
-			time.Sleep(2 * time.Second)
+			time.Sleep(pt.interval)
 		}
 	}()
 }
@@ -39,40 +162,98 @@ func (pt *ProcessTracker) Start() {
 // update scans current connections and processes
 func (pt *ProcessTracker) update() {
 	// Get all network connections
+	now := time.Now()
 	conns, err := psnet.Connections("inet")
+
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
 	if err != nil {
-		log.Printf("Error getting connections: %v", err)
+		if !pt.failing {
+			log.Printf("Error getting connections, packets won't be attributed to processes: %v", err)
+		}
+		pt.failing = true
 		return
 	}
+	if pt.failing {
+		log.Printf("Getting connections works again")
+		pt.failing = false
+	}
 
-	newPortPidMap := make(map[uint32]int32)
+	newPortPidMap := make(map[processPort]*portMapping)
 	pidsToResolve := make(map[int32]bool)
+	newPidUIDMap := make(map[int32]uint32)
 
 	for _, conn := range conns {
-		if conn.Laddr.Port > 0 {
-			newPortPidMap[conn.Laddr.Port] = conn.Pid
+		// Pid is 0 for sockets of other users' processes when not running as root
+		if conn.Laddr.Port > 0 && conn.Pid > 0 {
+			port := processPort{conn.Type == syscall.SOCK_DGRAM, conn.Laddr.Port}
+			m := pt.portPidMap[port]
+			if m == nil || m.pid != conn.Pid || !m.gone.IsZero() {
+				m = &portMapping{pid: conn.Pid, since: pt.lastUpdate}
+			}
+			m.lastSeen = now
+			newPortPidMap[port] = m
 			pidsToResolve[conn.Pid] = true
+			if len(conn.Uids) > 0 {
+				newPidUIDMap[conn.Pid] = uint32(conn.Uids[0])
+			}
+		}
+	}
+	// A closed socket's last packets may still be on their way
+	for port, m := range pt.portPidMap {
+		if _, open := newPortPidMap[port]; open || now.Sub(m.lastSeen) > processMapKeep {
+			continue
+		}
+		if m.gone.IsZero() {
+			m.gone = now
+		}
+		newPortPidMap[port] = m
+		pidsToResolve[m.pid] = true
+		if uid, ok := pt.pidUIDMap[m.pid]; ok {
+			if _, found := newPidUIDMap[m.pid]; !found {
+				newPidUIDMap[m.pid] = uid
+			}
 		}
 	}
-
-	pt.mu.Lock()
-	defer pt.mu.Unlock()
 
 	pt.portPidMap = newPortPidMap
+	pt.pidUIDMap = newPidUIDMap
+	pt.lastUpdate = now
 
-	// resolve unknown PIDs or refresh older ones (optional optimization: only resolve new PIDs)
-	// For simplicity, we'll check our cache. PIDs are recycled, but name lookup is fast enough.
+	// Only PIDs still holding sockets are kept, so a recycled PID is looked up afresh
+	// once the process that had it has gone
+	newPidNameMap := make(map[int32]string, len(pidsToResolve))
 	for pid := range pidsToResolve {
-		if _, exists := pt.pidNameMap[pid]; !exists {
-			name, err := getProcessName(pid)
-			if err == nil {
-				pt.pidNameMap[pid] = name
-			}
+		if name, exists := pt.pidNameMap[pid]; exists {
+			newPidNameMap[pid] = name
+		} else if name, err := getProcessName(pid); err == nil {
+			newPidNameMap[pid] = name
 		}
 	}
+	pt.pidNameMap = newPidNameMap
 
-	// Clean up stale PIDs from name map?
-	// Not strictly necessary for a small app, but good practice.
+	// Paths of processes found with eBPF rather than polling are forgotten here too
+	newPidExeMap := make(map[int32]string)
+	for pid, exe := range pt.pidExeMap {
+		if pidsToResolve[pid] {
+			newPidExeMap[pid] = exe
+		}
+	}
+	pt.pidExeMap = newPidExeMap
+	newPidUnitMap := make(map[int32]string)
+	for pid, unit := range pt.pidUnitMap {
+		if pidsToResolve[pid] {
+			newPidUnitMap[pid] = unit
+		}
+	}
+	pt.pidUnitMap = newPidUnitMap
+	newPidHashMap := make(map[int32]string)
+	for pid, sum := range pt.pidHashMap {
+		if pidsToResolve[pid] {
+			newPidHashMap[pid] = sum
+		}
+	}
+	pt.pidHashMap = newPidHashMap
 }
 
 func getProcessName(pid int32) (string, error) {
@@ -86,19 +267,215 @@ func getProcessName(pid int32) (string, error) {
 	return proc.Name()
 }
 
-// GetProcessName returns the process name for a given local port
-func (pt *ProcessTracker) GetProcessName(port uint16) string {
+// GetProcess returns the process holding a local TCP or UDP port when a packet was
+// captured at, or failing that the process that last connected or sent to the remote
+// address and port. A port polled before and after the packet is the surest; when the
+// packet falls outside that window, before the port was found or after its socket has
+// gone or polling stalled, eBPF is asked first, and otherwise the port's process is
+// still returned but marked uncertain. Processes in a Docker container, and ports
+// published for one, are named "container: <name>"; other processes carry the systemd
+// unit they run in. The PID is 0, and Name "", when no process is found.
+func (pt *ProcessTracker) GetProcess(protocol string, port uint16, remoteIP string, remotePort uint16, at time.Time) ProcessInfo {
+	if protocol != "TCP" && protocol != "UDP" {
+		return ProcessInfo{}
+	}
+	var info ProcessInfo
+	pid, name, uid, hasUID, confidence := pt.polledProcess(protocol, port, at)
+	if (pid == 0 || confidence == processConfidenceUncertain) && pt.sockets != nil {
+		if ip := net.ParseIP(remoteIP); ip != nil {
+			if tracedPID, tracedUID, tracedName := pt.sockets.Process(ip, remotePort); tracedPID != 0 {
+				pid, uid, name, hasUID, confidence = tracedPID, tracedUID, tracedName, true, processConfidenceTraced
+			}
+		}
+	}
+	if pid != 0 {
+		info = ProcessInfo{PID: pid, Name: name, Exe: pt.exePath(pid), Confidence: confidence}
+		info.SHA256 = pt.exeHash(pid, info.Exe)
+		if hasUID {
+			info.User = pt.userName(uid)
+		}
+		atomic.AddInt64(pt.attributed[confidence], 1)
+	}
+	if container := docker.ForPID(pid); container != "" {
+		info.Name = dockerNamePrefix + container
+		return info
+	}
+	if pod := kube.ForPID(pid); pod != "" {
+		info.Name = kubeNamePrefix + pod
+		return info
+	}
+	if pid != 0 {
+		info.Unit = pt.unitName(pid)
+	}
+	// Published ports are forwarded by docker-proxy, or by NAT with no process at all
+	if info.Name == "" || info.Name == "docker-proxy" {
+		if container := docker.ForPort(protocol, port); container != "" {
+			return ProcessInfo{Name: dockerNamePrefix + container}
+		}
+	}
+	// So are hostPorts, by the CNI's NAT rules
+	if info.Name == "" {
+		if pod := kube.ForPort(protocol, port); pod != "" {
+			return ProcessInfo{Name: kubeNamePrefix + pod}
+		}
+	}
+	return info
+}
+
+// polledProcess returns the process polling found holding a local port, its UID if
+// known, and how sure that is for a packet captured at, or 0 and ""
+func (pt *ProcessTracker) polledProcess(protocol string, port uint16, at time.Time) (pid int32, name string, uid uint32, hasUID bool, confidence string) {
 	pt.mu.RLock()
 	defer pt.mu.RUnlock()
 
-	pid, ok := pt.portPidMap[uint32(port)]
+	m := pt.portPidMap[processPort{protocol == "UDP", uint32(port)}]
+	if m == nil {
+		return 0, "", 0, false, ""
+	}
+	name, ok := pt.pidNameMap[m.pid]
 	if !ok {
-		return ""
+		return 0, "", 0, false, ""
 	}
+	uid, hasUID = pt.pidUIDMap[m.pid]
 
-	name, ok := pt.pidNameMap[pid]
-	if !ok {
+	// Until the next poll is due, the last one still holds
+	confidence = processConfidencePolled
+	switch {
+	case !m.since.IsZero() && at.Before(m.since):
+		confidence = processConfidenceUncertain
+	case !m.gone.IsZero() && at.After(m.gone):
+		confidence = processConfidenceUncertain
+	case m.gone.IsZero() && at.After(m.lastSeen.Add(pt.interval+processPollSlack)):
+		confidence = processConfidenceUncertain
+	}
+	return m.pid, name, uid, hasUID, confidence
+}
+
+// Status reports how polling is going and how sure attributions have been, for
+// /api/processes/tracker
+func (pt *ProcessTracker) Status() map[string]interface{} {
+	pt.mu.RLock()
+	ports, closing := 0, 0
+	for _, m := range pt.portPidMap {
+		if m.gone.IsZero() {
+			ports++
+		} else {
+			closing++
+		}
+	}
+	status := map[string]interface{}{
+		"pollInterval": pt.interval.String(),
+		"ebpf":         pt.sockets != nil,
+		"lastPoll":     pt.lastUpdate,
+		"failing":      pt.failing,
+		"ports":        ports,
+		"closedPorts":  closing,
+	}
+	pt.mu.RUnlock()
+
+	attributed := make(map[string]int64, len(pt.attributed))
+	for confidence, n := range pt.attributed {
+		attributed[confidence] = atomic.LoadInt64(n)
+	}
+	status["attributed"] = attributed
+	return status
+}
+
+// exePath returns the path of a process's executable, or "" if it can't be read, as for
+// other users' processes when not running as root
+func (pt *ProcessTracker) exePath(pid int32) string {
+	pt.mu.RLock()
+	exe, ok := pt.pidExeMap[pid]
+	pt.mu.RUnlock()
+	if ok {
+		return exe
+	}
+
+	if proc, err := process.NewProcess(pid); err == nil {
+		exe, _ = proc.Exe()
+	}
+	pt.mu.Lock()
+	pt.pidExeMap[pid] = exe
+	pt.mu.Unlock()
+	return exe
+}
+
+// unitName returns the systemd unit a process runs in, or "" if it runs in none, e.g.
+// without systemd
+func (pt *ProcessTracker) unitName(pid int32) string {
+	pt.mu.RLock()
+	unit, ok := pt.pidUnitMap[pid]
+	pt.mu.RUnlock()
+	if ok {
+		return unit
+	}
+
+	cgroup, _ := os.ReadFile(fmt.Sprintf("/proc/%d/cgroup", pid))
+	unit = systemdUnit(string(cgroup))
+	pt.mu.Lock()
+	pt.pidUnitMap[pid] = unit
+	pt.mu.Unlock()
+	return unit
+}
+
+// systemdUnit finds the unit in the contents of /proc/<pid>/cgroup: the innermost service
+// or scope in the systemd hierarchy, e.g. "nginx.service" in "0::/system.slice/nginx.service",
+// or a user's own service below their user@<uid>.service
+func systemdUnit(cgroup string) string {
+	for _, line := range strings.Split(cgroup, "\n") {
+		parts := strings.SplitN(line, ":", 3)
+		// The unified hierarchy on cgroup v2, or systemd's named one on v1
+		if len(parts) != 3 || (parts[1] != "" && parts[1] != "name=systemd") {
+			continue
+		}
+		path := strings.Split(strings.TrimSpace(parts[2]), "/")
+		for i := len(path) - 1; i >= 0; i-- {
+			if strings.HasSuffix(path[i], ".service") || strings.HasSuffix(path[i], ".scope") {
+				return path[i]
+			}
+		}
+	}
+	return ""
+}
+
+// exeHash returns the SHA-256 of a process's executable, or "" without -process-hash or
+// until it has been hashed
+func (pt *ProcessTracker) exeHash(pid int32, exe string) string {
+	if pt.hasher == nil {
 		return ""
 	}
+	pt.mu.RLock()
+	sum, ok := pt.pidHashMap[pid]
+	pt.mu.RUnlock()
+	if ok {
+		return sum
+	}
+
+	if sum = pt.hasher.Hash(pid, exe); sum != "" {
+		pt.mu.Lock()
+		pt.pidHashMap[pid] = sum
+		pt.mu.Unlock()
+	}
+	return sum
+}
+
+// userName returns the username of a UID, or the UID itself for one without an account,
+// like a container's user
+func (pt *ProcessTracker) userName(uid uint32) string {
+	pt.mu.RLock()
+	name, ok := pt.userNames[uid]
+	pt.mu.RUnlock()
+	if ok {
+		return name
+	}
+
+	id := strconv.FormatUint(uint64(uid), 10)
+	name = id
+	if u, err := user.LookupId(id); err == nil {
+		name = u.Username
+	}
+	pt.mu.Lock()
+	pt.userNames[uid] = name
+	pt.mu.Unlock()
 	return name
 }
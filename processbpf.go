@@ -0,0 +1,382 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Socket tracer settings
+const (
+	sockTraceEntries = 16384 // Destinations remembered; the least recently used go first
+
+	// Kernel helper functions the program calls
+	bpfFuncMapUpdateElem     = 2
+	bpfFuncProbeRead         = 4
+	bpfFuncGetCurrentPidTgid = 14
+	bpfFuncGetCurrentUIDGID  = 15
+	bpfFuncGetCurrentComm    = 16
+	bpfFuncProbeReadUser     = 112 // Linux 5.5 and later; probe_read before
+)
+
+// sockTraceSyscalls are the calls that name a destination: the tracepoint argument holding
+// the address, and whether it points at a msghdr whose first field points at the address
+var sockTraceSyscalls = []struct {
+	name     string
+	arg      string
+	indirect bool
+}{
+	{"connect", "uservaddr", false},
+	{"sendto", "addr", false},
+	{"sendmsg", "msg", true},
+}
+
+// socketTracer attributes connections to processes as they're made, rather than waiting
+// for the next poll of open sockets, which misses DNS lookups and short HTTP calls that
+// come and go in between. A small eBPF program on the connect, sendto and sendmsg syscall
+// tracepoints records the process behind each destination address and port in a kernel
+// map, which packets to and from that destination are looked up in. Syscall tracepoints
+// have the same layout on every kernel, so no kernel headers or BTF are needed.
+type socketTracer struct {
+	mapFD  int
+	progs  []int
+	events []int
+}
+
+// newSocketTracer loads and attaches the program. It needs root (or CAP_BPF and
+// CAP_PERFMON) and tracefs.
+func newSocketTracer() (*socketTracer, error) {
+	events, err := tracefsEventsDir()
+	if err != nil {
+		return nil, err
+	}
+	t := &socketTracer{}
+	if t.mapFD, err = bpfMapCreate(unix.BPF_MAP_TYPE_LRU_HASH, 24, 24, sockTraceEntries); err != nil {
+		return nil, fmt.Errorf("creating the eBPF map: %w", err)
+	}
+	for _, sc := range sockTraceSyscalls {
+		if err := t.attach(events, sc.name, sc.arg, sc.indirect); err != nil {
+			t.Close()
+			return nil, fmt.Errorf("tracing %s: %w", sc.name, err)
+		}
+	}
+	return t, nil
+}
+
+// tracefsEventsDir finds the tracepoint definitions, mounted in one place or the other
+func tracefsEventsDir() (string, error) {
+	for _, dir := range []string{"/sys/kernel/tracing/events", "/sys/kernel/debug/tracing/events"} {
+		if _, err := os.Stat(filepath.Join(dir, "syscalls")); err == nil {
+			return dir, nil
+		}
+	}
+	return "", fmt.Errorf("no syscall tracepoints (is tracefs mounted at /sys/kernel/tracing?)")
+}
+
+// attach loads the program for one syscall and attaches it on every CPU
+func (t *socketTracer) attach(events, syscall, arg string, indirect bool) error {
+	dir := filepath.Join(events, "syscalls", "sys_enter_"+syscall)
+	id, err := os.ReadFile(filepath.Join(dir, "id"))
+	if err != nil {
+		return err
+	}
+	config, err := strconv.ParseUint(strings.TrimSpace(string(id)), 10, 64)
+	if err != nil {
+		return err
+	}
+	offset, err := tracepointFieldOffset(filepath.Join(dir, "format"), arg)
+	if err != nil {
+		return err
+	}
+
+	var prog int
+	for _, readHelper := range []int32{bpfFuncProbeReadUser, bpfFuncProbeRead} {
+		if prog, err = bpfProgLoad(sockTraceProgram(t.mapFD, offset, indirect, readHelper)); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("loading the eBPF program: %w", err)
+	}
+	t.progs = append(t.progs, prog)
+
+	for cpu := 0; cpu < runtime.NumCPU(); cpu++ {
+		attr := unix.PerfEventAttr{Type: unix.PERF_TYPE_TRACEPOINT, Config: config, Sample: 1, Wakeup: 1}
+		attr.Size = uint32(unsafe.Sizeof(attr))
+		fd, err := unix.PerfEventOpen(&attr, -1, cpu, -1, unix.PERF_FLAG_FD_CLOEXEC)
+		if err == unix.ENODEV {
+			continue // CPU offline
+		} else if err != nil {
+			return err
+		}
+		t.events = append(t.events, fd)
+		if err := unix.IoctlSetInt(fd, unix.PERF_EVENT_IOC_SET_BPF, prog); err != nil {
+			return err
+		}
+		if err := unix.IoctlSetInt(fd, unix.PERF_EVENT_IOC_ENABLE, 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tracepointFieldOffset reads where a field is in a tracepoint's record
+func tracepointFieldOffset(format, field string) (int16, error) {
+	f, err := os.Open(format)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// e.g. "field:struct sockaddr * uservaddr;	offset:24;	size:8;	signed:0;"
+		parts := strings.Split(strings.TrimSpace(scanner.Text()), ";")
+		if len(parts) < 2 || !strings.HasPrefix(parts[0], "field:") {
+			continue
+		}
+		decl := strings.Fields(parts[0])
+		if decl[len(decl)-1] != field {
+			continue
+		}
+		n, err := strconv.Atoi(strings.TrimPrefix(strings.TrimSpace(parts[1]), "offset:"))
+		if err != nil {
+			return 0, fmt.Errorf("%s: bad offset for %s", format, field)
+		}
+		return int16(n), nil
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	return 0, fmt.Errorf("%s has no field %s", format, field)
+}
+
+// Process returns the PID, real UID and name of the process that last connected or sent
+// to an address and port, or 0 and "" if none did since the tracer started
+func (t *socketTracer) Process(ip net.IP, port uint16) (pid int32, uid uint32, name string) {
+	key := make([]byte, 24)
+	if v4 := ip.To4(); v4 != nil {
+		binary.NativeEndian.PutUint16(key, unix.AF_INET)
+		copy(key[8:], v4)
+	} else if v6 := ip.To16(); v6 != nil {
+		binary.NativeEndian.PutUint16(key, unix.AF_INET6)
+		copy(key[8:], v6)
+	} else {
+		return 0, 0, ""
+	}
+	binary.BigEndian.PutUint16(key[2:], port)
+
+	value := make([]byte, 24)
+	if err := bpfMapLookup(t.mapFD, key, value); err != nil {
+		return 0, 0, ""
+	}
+	comm := value[8:]
+	if i := strings.IndexByte(string(comm), 0); i >= 0 {
+		comm = comm[:i]
+	}
+	return int32(binary.NativeEndian.Uint32(value)), binary.NativeEndian.Uint32(value[4:]), string(comm)
+}
+
+// Close detaches the program and frees the map
+func (t *socketTracer) Close() {
+	for _, fd := range append(append(t.events, t.progs...), t.mapFD) {
+		if fd > 0 {
+			unix.Close(fd)
+		}
+	}
+}
+
+// sockTraceProgram assembles the program. The record at ctx+offset points at the
+// destination sockaddr (or at a msghdr pointing at it, if indirect), which is read into
+// the stack and turned into the map key:
+//
+//	fp-32  sockaddr_in or sockaddr_in6 as read (28 bytes)
+//	fp-56  key: family (2 bytes), port (2, network order), padding (4), address (16)
+//	fp-88  value: pid (4), uid (4), comm (16)
+func sockTraceProgram(mapFD int, offset int16, indirect bool, readHelper int32) []byte {
+	a := &bpfAsm{labels: make(map[string]int)}
+	a.op(0xbf, 6, 1, 0, 0)      // r6 = r1 (ctx)
+	a.op(0x79, 7, 6, offset, 0) // r7 = *(u64 *)(r6 + offset)
+	a.jmp(0x15, 7, 0, "exit")   // if r7 == 0 goto exit
+	if indirect {
+		a.op(0xbf, 1, 10, 0, 0) // r1 = fp
+		a.op(0x07, 1, 0, 0, -8) // r1 += -8
+		a.op(0xb7, 2, 0, 0, 8)  // r2 = 8
+		a.op(0xbf, 3, 7, 0, 0)  // r3 = r7
+		a.op(0x85, 0, 0, 0, readHelper)
+		a.jmp(0x55, 0, 0, "exit") // if r0 != 0 goto exit
+		a.op(0x79, 7, 10, -8, 0)  // r7 = msg_name
+		a.jmp(0x15, 7, 0, "exit")
+	}
+	for off := int16(-32); off < 0; off += 8 {
+		a.op(0x7a, 10, 0, off, 0) // *(u64 *)(fp + off) = 0
+	}
+	a.op(0xbf, 1, 10, 0, 0)
+	a.op(0x07, 1, 0, 0, -32)
+	a.op(0xb7, 2, 0, 0, 28)
+	a.op(0xbf, 3, 7, 0, 0)
+	a.op(0x85, 0, 0, 0, readHelper)
+	a.jmp(0x15, 0, 0, "read") // if r0 == 0 goto read
+	// A sockaddr_in at the end of a page can't be read as 28 bytes
+	a.op(0xbf, 1, 10, 0, 0)
+	a.op(0x07, 1, 0, 0, -32)
+	a.op(0xb7, 2, 0, 0, 16)
+	a.op(0xbf, 3, 7, 0, 0)
+	a.op(0x85, 0, 0, 0, readHelper)
+	a.jmp(0x55, 0, 0, "exit")
+
+	a.label("read")
+	for off := int16(-56); off < -32; off += 8 {
+		a.op(0x7a, 10, 0, off, 0)
+	}
+	a.op(0x69, 1, 10, -32, 0) // r1 = family
+	a.op(0x6b, 10, 1, -56, 0)
+	a.op(0x69, 2, 10, -30, 0) // r2 = port
+	a.op(0x6b, 10, 2, -54, 0)
+	a.jmp(0x15, 1, unix.AF_INET6, "v6")
+	a.jmp(0x55, 1, unix.AF_INET, "exit")
+	a.op(0x61, 3, 10, -28, 0) // IPv4 address
+	a.op(0x63, 10, 3, -48, 0)
+	a.jmp(0x05, 0, 0, "store")
+	a.label("v6")
+	a.op(0x79, 3, 10, -24, 0) // IPv6 address, after the flow info
+	a.op(0x7b, 10, 3, -48, 0)
+	a.op(0x79, 3, 10, -16, 0)
+	a.op(0x7b, 10, 3, -40, 0)
+
+	a.label("store")
+	a.op(0x85, 0, 0, 0, bpfFuncGetCurrentPidTgid)
+	a.op(0x77, 0, 0, 0, 32) // r0 >>= 32: the process, not the thread
+	a.op(0x63, 10, 0, -88, 0)
+	a.op(0x85, 0, 0, 0, bpfFuncGetCurrentUIDGID)
+	a.op(0x63, 10, 0, -84, 0) // The lower half: the real UID
+	a.op(0xbf, 1, 10, 0, 0)
+	a.op(0x07, 1, 0, 0, -80)
+	a.op(0xb7, 2, 0, 0, 16)
+	a.op(0x85, 0, 0, 0, bpfFuncGetCurrentComm)
+	a.op(0x18, 1, unix.BPF_PSEUDO_MAP_FD, 0, int32(mapFD)) // r1 = map (two instructions)
+	a.op(0, 0, 0, 0, 0)
+	a.op(0xbf, 2, 10, 0, 0)
+	a.op(0x07, 2, 0, 0, -56)
+	a.op(0xbf, 3, 10, 0, 0)
+	a.op(0x07, 3, 0, 0, -88)
+	a.op(0xb7, 4, 0, 0, 0) // BPF_ANY
+	a.op(0x85, 0, 0, 0, bpfFuncMapUpdateElem)
+
+	a.label("exit")
+	a.op(0xb7, 0, 0, 0, 0)
+	a.op(0x95, 0, 0, 0, 0)
+	return a.bytes()
+}
+
+// bpfAsm builds eBPF instructions, resolving jumps to labels
+type bpfAsm struct {
+	insns  [][8]byte
+	labels map[string]int
+	jumps  map[int]string
+}
+
+func (a *bpfAsm) op(code uint8, dst, src uint8, off int16, imm int32) {
+	var insn [8]byte
+	insn[0] = code
+	insn[1] = src<<4 | dst
+	binary.LittleEndian.PutUint16(insn[2:], uint16(off))
+	binary.LittleEndian.PutUint32(insn[4:], uint32(imm))
+	a.insns = append(a.insns, insn)
+}
+
+func (a *bpfAsm) jmp(code uint8, dst uint8, imm int32, label string) {
+	if a.jumps == nil {
+		a.jumps = make(map[int]string)
+	}
+	a.jumps[len(a.insns)] = label
+	a.op(code, dst, 0, 0, imm)
+}
+
+func (a *bpfAsm) label(name string) {
+	a.labels[name] = len(a.insns)
+}
+
+func (a *bpfAsm) bytes() []byte {
+	out := make([]byte, 0, len(a.insns)*8)
+	for i, insn := range a.insns {
+		if label, ok := a.jumps[i]; ok {
+			binary.LittleEndian.PutUint16(insn[2:], uint16(int16(a.labels[label]-i-1)))
+		}
+		out = append(out, insn[:]...)
+	}
+	return out
+}
+
+// bpf makes a bpf(2) call with an attribute struct
+func bpf(cmd int, attr unsafe.Pointer, size uintptr) (int, error) {
+	fd, _, errno := unix.Syscall(unix.SYS_BPF, uintptr(cmd), uintptr(attr), size)
+	runtime.KeepAlive(attr)
+	if errno != 0 {
+		return 0, errno
+	}
+	return int(fd), nil
+}
+
+func bpfMapCreate(mapType, keySize, valueSize, maxEntries uint32) (int, error) {
+	attr := struct {
+		mapType, keySize, valueSize, maxEntries, flags uint32
+	}{mapType, keySize, valueSize, maxEntries, 0}
+	return bpf(unix.BPF_MAP_CREATE, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+}
+
+func bpfProgLoad(insns []byte) (int, error) {
+	license := []byte("GPL\x00")    // The helpers used are GPL-only
+	logBuf := make([]byte, 64*1024) // The verifier fails the load if its log overflows
+	attr := struct {
+		progType, insnCnt  uint32
+		insns, license     uint64
+		logLevel, logSize  uint32
+		logBuf             uint64
+		kernVersion, flags uint32
+	}{
+		progType: unix.BPF_PROG_TYPE_TRACEPOINT,
+		insnCnt:  uint32(len(insns) / 8),
+		insns:    uint64(uintptr(unsafe.Pointer(&insns[0]))),
+		license:  uint64(uintptr(unsafe.Pointer(&license[0]))),
+		logLevel: 1,
+		logSize:  uint32(len(logBuf)),
+		logBuf:   uint64(uintptr(unsafe.Pointer(&logBuf[0]))),
+	}
+	fd, err := bpf(unix.BPF_PROG_LOAD, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	runtime.KeepAlive(insns)
+	runtime.KeepAlive(license)
+	if err != nil {
+		if msg := strings.TrimRight(string(logBuf), "\x00\n"); msg != "" {
+			return 0, fmt.Errorf("%w: %s", err, msg)
+		}
+		return 0, err
+	}
+	return fd, nil
+}
+
+func bpfMapLookup(mapFD int, key, value []byte) error {
+	attr := struct {
+		mapFD, _   uint32
+		key, value uint64
+		flags      uint64
+	}{
+		mapFD: uint32(mapFD),
+		key:   uint64(uintptr(unsafe.Pointer(&key[0]))),
+		value: uint64(uintptr(unsafe.Pointer(&value[0]))),
+	}
+	_, err := bpf(unix.BPF_MAP_LOOKUP_ELEM, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	runtime.KeepAlive(key)
+	runtime.KeepAlive(value)
+	return err
+}
@@ -0,0 +1,19 @@
+//go:build !linux
+
+package main
+
+import (
+	"fmt"
+	"net"
+)
+
+// socketTracer attributes connections with eBPF, which only Linux has
+type socketTracer struct{}
+
+func newSocketTracer() (*socketTracer, error) {
+	return nil, fmt.Errorf("eBPF needs Linux")
+}
+
+func (t *socketTracer) Process(ip net.IP, port uint16) (int32, uint32, string) { return 0, 0, "" }
+
+func (t *socketTracer) Close() {}
@@ -0,0 +1,457 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Per-process traffic settings
+const (
+	processRateWindow = 5    // Seconds live rates are averaged over, as the overall stats are
+	processMaxRemotes = 1000 // Remote hosts kept per process; traffic with more goes under ""
+)
+
+// ProcessRemote is a process's traffic with one remote host
+type ProcessRemote struct {
+	IP            string `json:"ip"` // "" for the hosts beyond the ones kept
+	Hostname      string `json:"hostname,omitempty"`
+	ASN           string `json:"asn,omitempty"`
+	Country       string `json:"country,omitempty"`
+	BytesSent     int64  `json:"bytesSent"`
+	BytesReceived int64  `json:"bytesReceived"`
+	Packets       int64  `json:"packets"`
+}
+
+// ProcessTraffic is what one process on the Pi, or all the processes of one user, sent
+// and received, and with whom
+type ProcessTraffic struct {
+	Name            string          `json:"name"` // Process name, or username with ?by=user
+	BytesSent       int64           `json:"bytesSent"`
+	BytesReceived   int64           `json:"bytesReceived"`
+	PacketsSent     int64           `json:"packetsSent"`
+	PacketsReceived int64           `json:"packetsReceived"`
+	BytesPerSec     float64         `json:"bytesPerSec"` // Live only
+	PacketsPerSec   float64         `json:"packetsPerSec"`
+	LastSeen        *time.Time      `json:"lastSeen,omitempty"` // Live only
+	Exe             string          `json:"exe,omitempty"`      // Live only: the latest process's executable path
+	SHA256          string          `json:"sha256,omitempty"`   // and its hash, with -process-hash
+	Remotes         []ProcessRemote `json:"remotes"`            // Busiest first, up to ?remotes=
+}
+
+func (t *ProcessTraffic) add(sent bool, packets, bytes int64) {
+	if sent {
+		t.BytesSent += bytes
+		t.PacketsSent += packets
+	} else {
+		t.BytesReceived += bytes
+		t.PacketsReceived += packets
+	}
+}
+
+func (r *ProcessRemote) add(sent bool, packets, bytes int64) {
+	if sent {
+		r.BytesSent += bytes
+	} else {
+		r.BytesReceived += bytes
+	}
+	r.Packets += packets
+}
+
+// ProcessQuery selects what /api/processes and /api/processes/destinations return
+type ProcessQuery struct {
+	Top          int    // Processes returned
+	Remotes      int    // Remote hosts returned per process
+	Destinations int    // Domains, ASNs and countries returned per process
+	Name         string // Only this process, if set
+	By           string // "user" or "unit" for totals per user or systemd unit instead
+}
+
+// parseProcessQuery reads top, remotes, n, name and by, defaulting to the 25 busiest
+// processes with their 10 busiest remote hosts, or destinations of each kind
+func parseProcessQuery(r *http.Request) (ProcessQuery, error) {
+	q := ProcessQuery{Top: 25, Remotes: 10, Destinations: 10, Name: r.URL.Query().Get("name")}
+	switch by := r.URL.Query().Get("by"); by {
+	case "", "process":
+	case "user", "unit":
+		q.By = by
+	default:
+		return q, fmt.Errorf("invalid by %q (expected process, user or unit)", by)
+	}
+	for name, dst := range map[string]*int{"top": &q.Top, "remotes": &q.Remotes, "n": &q.Destinations} {
+		if v := r.URL.Query().Get(name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				return q, fmt.Errorf("invalid %s %q", name, v)
+			}
+			if n > 1000 {
+				n = 1000
+			}
+			*dst = n
+		}
+	}
+	return q, nil
+}
+
+// rankProcesses sorts processes and their remote hosts busiest first and trims them to
+// the query
+func rankProcesses(processes []ProcessTraffic, q ProcessQuery) []ProcessTraffic {
+	total := func(sent, received int64) int64 { return sent + received }
+	sort.Slice(processes, func(i, j int) bool {
+		a, b := total(processes[i].BytesSent, processes[i].BytesReceived), total(processes[j].BytesSent, processes[j].BytesReceived)
+		if a != b {
+			return a > b
+		}
+		return processes[i].Name < processes[j].Name
+	})
+	if len(processes) > q.Top {
+		processes = processes[:q.Top]
+	}
+	for i := range processes {
+		remotes := processes[i].Remotes
+		sort.Slice(remotes, func(a, b int) bool {
+			return total(remotes[a].BytesSent, remotes[a].BytesReceived) > total(remotes[b].BytesSent, remotes[b].BytesReceived)
+		})
+		if len(remotes) > q.Remotes {
+			remotes = remotes[:q.Remotes]
+		}
+		for j := range remotes {
+			if remotes[j].IP != "" && remotes[j].Hostname == "" {
+				remotes[j].Hostname = getIPInfo(remotes[j].IP).Hostname
+			}
+		}
+		processes[i].Remotes = remotes
+	}
+	return processes
+}
+
+// processCounts is the live traffic of one process
+type processCounts struct {
+	traffic ProcessTraffic
+	remotes map[string]*ProcessRemote
+	rate    [processRateWindow]struct{ sec, packets, bytes int64 } // Per second, by second modulo the window
+}
+
+// ProcessUsage tallies the traffic of each process on the Pi itself, as attributed by the
+// ProcessTracker, of each user running them and of each systemd unit they run in, since
+// startup: bytes and packets each way, current rates and the remote hosts talked to.
+// Stored packets keep the process name, user and unit, so totals over any range come from
+// the database.
+type ProcessUsage struct {
+	mu        sync.Mutex
+	processes map[string]*processCounts
+	users     map[string]*processCounts
+	units     map[string]*processCounts
+}
+
+// NewProcessUsage creates an empty tally
+func NewProcessUsage() *ProcessUsage {
+	return &ProcessUsage{
+		processes: make(map[string]*processCounts),
+		users:     make(map[string]*processCounts),
+		units:     make(map[string]*processCounts),
+	}
+}
+
+// Observe implements PacketObserver
+func (u *ProcessUsage) Observe(p Packet) {
+	if p.ProcessName == "" {
+		return
+	}
+	remote := p.DstIP
+	if !p.processSent {
+		remote = p.SrcIP
+	}
+
+	now := time.Now()
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	c := tallyProcess(u.processes, p.ProcessName, remote, p, now)
+	if p.processExe != "" {
+		c.traffic.Exe, c.traffic.SHA256 = p.processExe, p.processHash
+	}
+	if p.ProcessUser != "" {
+		tallyProcess(u.users, p.ProcessUser, remote, p, now)
+	}
+	if p.ProcessUnit != "" {
+		tallyProcess(u.units, p.ProcessUnit, remote, p, now)
+	}
+}
+
+// tallyProcess counts a packet under a process, user or unit. Callers hold mu.
+func tallyProcess(counts map[string]*processCounts, name, remote string, p Packet, now time.Time) *processCounts {
+	c := counts[name]
+	if c == nil {
+		c = &processCounts{traffic: ProcessTraffic{Name: name}, remotes: make(map[string]*ProcessRemote)}
+		counts[name] = c
+	}
+	c.traffic.add(p.processSent, 1, int64(p.Length))
+	c.traffic.LastSeen = &now
+
+	r := c.remotes[remote]
+	if r == nil {
+		if len(c.remotes) >= processMaxRemotes {
+			remote = ""
+		}
+		if r = c.remotes[remote]; r == nil {
+			r = &ProcessRemote{IP: remote}
+			c.remotes[remote] = r
+		}
+	}
+	r.add(p.processSent, 1, int64(p.Length))
+	if r.IP != "" {
+		hostname, asn, country := p.DstHostname, p.DstASN, p.DstCountry
+		if !p.processSent {
+			hostname, asn, country = p.SrcHostname, p.SrcASN, p.SrcCountry
+		}
+		// The name the process asked the server for says more than reverse DNS
+		if p.sni != "" {
+			hostname = p.sni
+		}
+		if hostname != "" && hostname != r.IP {
+			r.Hostname = hostname
+		}
+		if asn != "" {
+			r.ASN = asn
+		}
+		if country != "" {
+			r.Country = country
+		}
+	}
+
+	sec := now.Unix()
+	b := &c.rate[sec%processRateWindow]
+	if b.sec != sec {
+		b.sec, b.packets, b.bytes = sec, 0, 0
+	}
+	b.packets++
+	b.bytes += int64(p.Length)
+	return c
+}
+
+// Processes returns the live traffic of each process, user or unit
+func (u *ProcessUsage) Processes(q ProcessQuery) []ProcessTraffic {
+	since := time.Now().Unix() - processRateWindow
+	u.mu.Lock()
+	counts := u.processes
+	switch q.By {
+	case "user":
+		counts = u.users
+	case "unit":
+		counts = u.units
+	}
+	processes := []ProcessTraffic{}
+	for name, c := range counts {
+		if q.Name != "" && name != q.Name {
+			continue
+		}
+		t := c.traffic
+		for _, b := range c.rate {
+			if b.sec > since {
+				t.PacketsPerSec += float64(b.packets) / processRateWindow
+				t.BytesPerSec += float64(b.bytes) / processRateWindow
+			}
+		}
+		t.Remotes = make([]ProcessRemote, 0, len(c.remotes))
+		for _, r := range c.remotes {
+			t.Remotes = append(t.Remotes, *r)
+		}
+		processes = append(processes, t)
+	}
+	u.mu.Unlock()
+	return rankProcesses(processes, q)
+}
+
+// GetProcesses returns the traffic of each process, user or unit stored between
+// startTime and endTime. Packets whose source is one of the Pi's current addresses count
+// as sent.
+func (d *Database) GetProcesses(q ProcessQuery, startTime, endTime *time.Time) ([]ProcessTraffic, error) {
+	column := "process_name"
+	switch q.By {
+	case "user":
+		column = "process_user"
+	case "unit":
+		column = "process_unit"
+	}
+	where, whereArgs := packetRangeClause(startTime, endTime)
+	if q.Name != "" {
+		where += " AND " + column + " = ?"
+		whereArgs = append(whereArgs, q.Name)
+	}
+
+	placeholders := []string{}
+	local := []interface{}{}
+	addrs, _ := net.InterfaceAddrs()
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok {
+			placeholders = append(placeholders, "?")
+			local = append(local, ipnet.IP.String())
+		}
+	}
+	sent := "0"
+	if len(local) > 0 {
+		sent = "src_ip IN (" + strings.Join(placeholders, ", ") + ")"
+	}
+	// The sent expression is used once for the direction and once for each remote column
+	args := []interface{}{}
+	for i := 0; i < 5; i++ {
+		args = append(args, local...)
+	}
+	args = append(args, whereArgs...)
+
+	db, release, err := d.packetsBetween(startTime, endTime)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	rows, err := db.Query(`
+		SELECT name, sent, remote, COALESCE(MAX(hostname), ''), COALESCE(MAX(asn), ''), COALESCE(MAX(country), ''),
+			COUNT(*), SUM(length) FROM (
+			SELECT `+column+` AS name, length, `+sent+` AS sent,
+				COALESCE(CASE WHEN `+sent+` THEN dst_ip ELSE src_ip END, '') AS remote,
+				NULLIF(CASE WHEN `+sent+` THEN dst_hostname ELSE src_hostname END, '') AS hostname,
+				NULLIF(CASE WHEN `+sent+` THEN dst_asn ELSE src_asn END, '') AS asn,
+				NULLIF(CASE WHEN `+sent+` THEN dst_country ELSE src_country END, '') AS country
+			FROM packets WHERE `+column+` IS NOT NULL AND `+column+` != ''`+where+`
+		) GROUP BY name, sent, remote`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	byName := make(map[string]*ProcessTraffic)
+	remotes := make(map[string]map[string]*ProcessRemote)
+	for rows.Next() {
+		var name, remote, hostname, asn, country string
+		var sent bool
+		var packets, bytes int64
+		if err := rows.Scan(&name, &sent, &remote, &hostname, &asn, &country, &packets, &bytes); err != nil {
+			return nil, err
+		}
+		t := byName[name]
+		if t == nil {
+			t = &ProcessTraffic{Name: name}
+			byName[name] = t
+			remotes[name] = make(map[string]*ProcessRemote)
+		}
+		t.add(sent, packets, bytes)
+		r := remotes[name][remote]
+		if r == nil {
+			r = &ProcessRemote{IP: remote}
+			remotes[name][remote] = r
+		}
+		r.add(sent, packets, bytes)
+		if hostname != "" && hostname != remote {
+			r.Hostname = hostname
+		}
+		if asn != "" {
+			r.ASN = asn
+		}
+		if country != "" {
+			r.Country = country
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	processes := make([]ProcessTraffic, 0, len(byName))
+	for name, t := range byName {
+		t.Remotes = make([]ProcessRemote, 0, len(remotes[name]))
+		for _, r := range remotes[name] {
+			t.Remotes = append(t.Remotes, *r)
+		}
+		processes = append(processes, *t)
+	}
+	return rankProcesses(processes, q), nil
+}
+
+// ProcessDestination is a process's traffic with the remote hosts of one domain, ASN or
+// country
+type ProcessDestination struct {
+	Key           string `json:"key"` // "" for hosts without a name, ASN or country
+	BytesSent     int64  `json:"bytesSent"`
+	BytesReceived int64  `json:"bytesReceived"`
+	Packets       int64  `json:"packets"`
+}
+
+// ProcessDestinations is where one process, or one user's processes, sent data, for
+// /api/processes/destinations
+type ProcessDestinations struct {
+	Name          string               `json:"name"`
+	BytesSent     int64                `json:"bytesSent"`
+	BytesReceived int64                `json:"bytesReceived"`
+	Domains       []ProcessDestination `json:"domains"` // Remote hostnames folded into their domain, or the address without one
+	ASNs          []ProcessDestination `json:"asns"`
+	Countries     []ProcessDestination `json:"countries"`
+}
+
+// processDestinations folds each process's remote hosts into domains, ASNs and countries,
+// most bytes sent first, since that's what an audit of where data goes is after. The
+// processes need all their remote hosts, not the query's top few.
+func processDestinations(processes []ProcessTraffic, q ProcessQuery) []ProcessDestinations {
+	result := make([]ProcessDestinations, 0, len(processes))
+	for _, t := range processes {
+		domains := make(map[string]*ProcessDestination)
+		asns := make(map[string]*ProcessDestination)
+		countries := make(map[string]*ProcessDestination)
+		for _, r := range t.Remotes {
+			domain := r.IP
+			if r.Hostname != "" {
+				domain = r.Hostname
+				if net.ParseIP(domain) == nil {
+					_, domain = splitDNSName(domain)
+				}
+			}
+			for _, group := range []struct {
+				counts map[string]*ProcessDestination
+				key    string
+			}{{domains, domain}, {asns, r.ASN}, {countries, r.Country}} {
+				d := group.counts[group.key]
+				if d == nil {
+					d = &ProcessDestination{Key: group.key}
+					group.counts[group.key] = d
+				}
+				d.BytesSent += r.BytesSent
+				d.BytesReceived += r.BytesReceived
+				d.Packets += r.Packets
+			}
+		}
+		result = append(result, ProcessDestinations{
+			Name:          t.Name,
+			BytesSent:     t.BytesSent,
+			BytesReceived: t.BytesReceived,
+			Domains:       rankDestinations(domains, q.Destinations),
+			ASNs:          rankDestinations(asns, q.Destinations),
+			Countries:     rankDestinations(countries, q.Destinations),
+		})
+	}
+	return result
+}
+
+// rankDestinations sorts destinations by bytes sent, then received, and keeps the top n
+func rankDestinations(counts map[string]*ProcessDestination, n int) []ProcessDestination {
+	list := make([]ProcessDestination, 0, len(counts))
+	for _, d := range counts {
+		list = append(list, *d)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].BytesSent != list[j].BytesSent {
+			return list[i].BytesSent > list[j].BytesSent
+		}
+		if list[i].BytesReceived != list[j].BytesReceived {
+			return list[i].BytesReceived > list[j].BytesReceived
+		}
+		return list[i].Key < list[j].Key
+	})
+	if len(list) > n {
+		list = list[:n]
+	}
+	return list
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Process connection log settings
+const (
+	processLogFlushInterval = 30 * time.Second
+	processLogIdle          = 5 * time.Minute // A connection quiet this long is finished; later packets start a new row
+	processLogMaxOpen       = 10000           // Connections tracked at once; new ones beyond this aren't logged
+)
+
+// ProcessConnection is one process's traffic with one remote endpoint, as stored in the
+// process_connections table
+type ProcessConnection struct {
+	ID             int64     `json:"id"`
+	Process        string    `json:"process"`
+	Exe            string    `json:"exe,omitempty"`    // Executable path
+	SHA256         string    `json:"sha256,omitempty"` // Of the executable, with -process-hash
+	PID            int32     `json:"pid,omitempty"`
+	User           string    `json:"user,omitempty"`
+	Protocol       string    `json:"protocol"`
+	LocalPort      uint16    `json:"localPort"`
+	RemoteIP       string    `json:"remoteIp"`
+	RemotePort     uint16    `json:"remotePort"`
+	RemoteHostname string    `json:"remoteHostname,omitempty"`
+	FirstSeen      time.Time `json:"firstSeen"`
+	LastSeen       time.Time `json:"lastSeen"`
+	BytesSent      int64     `json:"bytesSent"`
+	BytesReceived  int64     `json:"bytesReceived"`
+	Packets        int64     `json:"packets"`
+}
+
+// ProcessConnectionQuery selects logged connections for /api/history/processes
+type ProcessConnectionQuery struct {
+	IP        string // Remote address
+	Port      uint16 // Remote or local port; 0 for any
+	Process   string // Process name, executable path or SHA-256
+	User      string
+	StartTime *time.Time // Connections still active at or after this
+	EndTime   *time.Time // Connections that started at or before this
+	Limit     int
+	Offset    int
+}
+
+// parseProcessConnectionQuery reads the /api/history/processes parameters, apart from the
+// time range
+func parseProcessConnectionQuery(r *http.Request) (ProcessConnectionQuery, error) {
+	v := r.URL.Query()
+	q := ProcessConnectionQuery{IP: v.Get("ip"), Process: v.Get("process"), User: v.Get("user"), Limit: 100}
+	if s := v.Get("port"); s != "" {
+		n, err := strconv.ParseUint(s, 10, 16)
+		if err != nil {
+			return q, fmt.Errorf("invalid port %q", s)
+		}
+		q.Port = uint16(n)
+	}
+	if s := v.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			return q, fmt.Errorf("invalid limit %q", s)
+		}
+		if n > 1000 {
+			n = 1000
+		}
+		q.Limit = n
+	}
+	if s := v.Get("offset"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			return q, fmt.Errorf("invalid offset %q", s)
+		}
+		q.Offset = n
+	}
+	return q, nil
+}
+
+// processConnKey identifies a connection while it's open
+type processConnKey struct {
+	pid        int32
+	process    string
+	protocol   string
+	localPort  uint16
+	remoteIP   string
+	remotePort uint16
+}
+
+// openProcessConn is a connection being logged
+type openProcessConn struct {
+	conn  ProcessConnection
+	dirty bool // Changed since it was last written
+}
+
+// ProcessConnectionLog keeps a history of which process on the Pi talked to which remote
+// endpoint, with its executable path, PID and user, when and how much, in the
+// process_connections table. A connection is a row from its first packet until it has
+// been quiet for five minutes; open connections are written every 30 seconds, so past
+// traffic with an address can be traced to the binary responsible long after it exited.
+type ProcessConnectionLog struct {
+	db *Database
+
+	mu   sync.Mutex
+	open map[processConnKey]*openProcessConn
+}
+
+// NewProcessConnectionLog creates a log writing to db
+func NewProcessConnectionLog(db *Database) *ProcessConnectionLog {
+	return &ProcessConnectionLog{db: db, open: make(map[processConnKey]*openProcessConn)}
+}
+
+// Start writes open connections to the database in the background
+func (pl *ProcessConnectionLog) Start() {
+	go func() {
+		ticker := time.NewTicker(processLogFlushInterval)
+		for range ticker.C {
+			pl.Flush(time.Now())
+		}
+	}()
+}
+
+// Observe implements PacketObserver
+func (pl *ProcessConnectionLog) Observe(p Packet) {
+	if p.ProcessName == "" {
+		return
+	}
+	key := processConnKey{pid: p.processPID, process: p.ProcessName, protocol: p.Protocol}
+	hostname := p.DstHostname
+	if p.processSent {
+		key.localPort, key.remoteIP, key.remotePort = p.SrcPort, p.DstIP, p.DstPort
+	} else {
+		key.localPort, key.remoteIP, key.remotePort = p.DstPort, p.SrcIP, p.SrcPort
+		hostname = p.SrcHostname
+	}
+
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+	c := pl.open[key]
+	if c == nil {
+		if len(pl.open) >= processLogMaxOpen {
+			return
+		}
+		c = &openProcessConn{conn: ProcessConnection{
+			Process:    p.ProcessName,
+			Exe:        p.processExe,
+			SHA256:     p.processHash,
+			PID:        p.processPID,
+			User:       p.ProcessUser,
+			Protocol:   p.Protocol,
+			LocalPort:  key.localPort,
+			RemoteIP:   key.remoteIP,
+			RemotePort: key.remotePort,
+			FirstSeen:  p.Timestamp,
+		}}
+		pl.open[key] = c
+	}
+	if hostname != "" {
+		c.conn.RemoteHostname = hostname
+	}
+	if p.processHash != "" {
+		c.conn.SHA256 = p.processHash // Hashed after the first packets
+	}
+	c.conn.LastSeen = p.Timestamp
+	if p.processSent {
+		c.conn.BytesSent += int64(p.Length)
+	} else {
+		c.conn.BytesReceived += int64(p.Length)
+	}
+	c.conn.Packets++
+	c.dirty = true
+}
+
+// Flush writes connections that changed to the database and stops tracking the ones
+// that have gone quiet
+func (pl *ProcessConnectionLog) Flush(now time.Time) {
+	pl.mu.Lock()
+	var dirty []*openProcessConn
+	var changes []ProcessConnection
+	for key, c := range pl.open {
+		if c.dirty {
+			dirty = append(dirty, c)
+			changes = append(changes, c.conn)
+			c.dirty = false
+		} else if now.Sub(c.conn.LastSeen) > processLogIdle {
+			delete(pl.open, key)
+		}
+	}
+	pl.mu.Unlock()
+
+	if len(changes) == 0 {
+		return
+	}
+	err := pl.db.SaveProcessConnections(changes)
+
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+	for i, c := range dirty {
+		if err != nil {
+			c.dirty = true // Retried on the next flush
+		} else {
+			c.conn.ID = changes[i].ID
+		}
+	}
+	if err != nil {
+		log.Printf("Error saving process connections: %v", err)
+	}
+}
+
+func createProcessConnectionTables(db *sql.DB) error {
+	schema := `
+	CREATE TABLE IF NOT EXISTS process_connections (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		process_name TEXT NOT NULL,
+		exe TEXT,
+		pid INTEGER,
+		username TEXT,
+		protocol TEXT,
+		local_port INTEGER,
+		remote_ip TEXT NOT NULL,
+		remote_port INTEGER,
+		remote_hostname TEXT,
+		first_seen DATETIME NOT NULL,
+		last_seen DATETIME NOT NULL,
+		bytes_sent INTEGER DEFAULT 0,
+		bytes_received INTEGER DEFAULT 0,
+		packets INTEGER DEFAULT 0
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_process_connections_remote_ip ON process_connections(remote_ip, last_seen);
+	CREATE INDEX IF NOT EXISTS idx_process_connections_last_seen ON process_connections(last_seen);
+	CREATE INDEX IF NOT EXISTS idx_process_connections_process ON process_connections(process_name);
+	`
+
+	if _, err := db.Exec(schema); err != nil {
+		return fmt.Errorf("failed to create process connection schema: %v", err)
+	}
+
+	// Migration: Store the hash of each connection's executable
+	db.Exec("ALTER TABLE process_connections ADD COLUMN exe_sha256 TEXT")
+	return nil
+}
+
+// SaveProcessConnections inserts new connections, setting their IDs, and updates the
+// ones already stored, in one transaction. IDs are only set once it commits.
+func (d *Database) SaveProcessConnections(conns []ProcessConnection) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	insert, err := tx.Prepare(`
+		INSERT INTO process_connections (process_name, exe, pid, username, protocol, local_port, remote_ip, remote_port,
+			remote_hostname, first_seen, last_seen, bytes_sent, bytes_received, packets, exe_sha256)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`)
+	if err != nil {
+		return err
+	}
+	defer insert.Close()
+	update, err := tx.Prepare(`
+		UPDATE process_connections SET remote_hostname = ?, last_seen = ?, bytes_sent = ?, bytes_received = ?, packets = ?,
+			exe_sha256 = ?
+		WHERE id = ?
+	`)
+	if err != nil {
+		return err
+	}
+	defer update.Close()
+
+	ids := make([]int64, len(conns))
+	for i, c := range conns {
+		if c.ID != 0 {
+			if _, err := update.Exec(c.RemoteHostname, c.LastSeen, c.BytesSent, c.BytesReceived, c.Packets, c.SHA256, c.ID); err != nil {
+				return err
+			}
+			ids[i] = c.ID
+			continue
+		}
+		result, err := insert.Exec(c.Process, c.Exe, c.PID, c.User, c.Protocol, c.LocalPort, c.RemoteIP, c.RemotePort,
+			c.RemoteHostname, c.FirstSeen, c.LastSeen, c.BytesSent, c.BytesReceived, c.Packets, c.SHA256)
+		if err != nil {
+			return err
+		}
+		if ids[i], err = result.LastInsertId(); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	for i := range conns {
+		conns[i].ID = ids[i]
+	}
+	return nil
+}
+
+// QueryProcessConnections returns logged connections matching q, most recent first, and
+// how many match in total
+func (d *Database) QueryProcessConnections(q ProcessConnectionQuery) ([]ProcessConnection, int, error) {
+	where := " WHERE 1=1"
+	args := []interface{}{}
+	if q.IP != "" {
+		where += " AND remote_ip = ?"
+		args = append(args, q.IP)
+	}
+	if q.Port != 0 {
+		where += " AND (remote_port = ? OR local_port = ?)"
+		args = append(args, q.Port, q.Port)
+	}
+	if q.Process != "" {
+		where += " AND (process_name = ? OR exe = ? OR exe_sha256 = ?)"
+		args = append(args, q.Process, q.Process, strings.ToLower(q.Process))
+	}
+	if q.User != "" {
+		where += " AND username = ?"
+		args = append(args, q.User)
+	}
+	if q.StartTime != nil {
+		where += " AND last_seen >= ?"
+		args = append(args, q.StartTime)
+	}
+	if q.EndTime != nil {
+		where += " AND first_seen <= ?"
+		args = append(args, q.EndTime)
+	}
+
+	var total int
+	if err := d.db.QueryRow("SELECT COUNT(*) FROM process_connections"+where, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	query := `
+		SELECT id, process_name, exe, pid, username, protocol, local_port, remote_ip, remote_port,
+			remote_hostname, first_seen, last_seen, bytes_sent, bytes_received, packets, exe_sha256
+		FROM process_connections` + where + " ORDER BY last_seen DESC, id DESC LIMIT ? OFFSET ?"
+	args = append(args, q.Limit, q.Offset)
+
+	rows, err := d.db.Query(query, args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	conns := []ProcessConnection{}
+	for rows.Next() {
+		var c ProcessConnection
+		var exe, user, protocol, hostname, sha sql.NullString
+		var pid sql.NullInt64
+		err := rows.Scan(&c.ID, &c.Process, &exe, &pid, &user, &protocol, &c.LocalPort, &c.RemoteIP, &c.RemotePort,
+			&hostname, &c.FirstSeen, &c.LastSeen, &c.BytesSent, &c.BytesReceived, &c.Packets, &sha)
+		if err != nil {
+			return nil, 0, err
+		}
+		c.Exe = exe.String
+		c.PID = int32(pid.Int64)
+		c.User = user.String
+		c.Protocol = protocol.String
+		c.RemoteHostname = hostname.String
+		c.SHA256 = sha.String
+		conns = append(conns, c)
+	}
+	return conns, total, rows.Err()
+}
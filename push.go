@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// pushTitle is the notification title for an alert
+func pushTitle(a Alert) string {
+	if a.State == alertStateResolved {
+		return "Resolved: " + a.Rule
+	}
+	return a.Rule
+}
+
+// pushMessage is the notification body for an alert
+func pushMessage(a Alert) string {
+	if a.State == alertStateResolved {
+		return fmt.Sprintf("%s (%s) is no longer firing", a.Rule, a.Subject)
+	}
+	return a.Message
+}
+
+// NtfyNotifier publishes alerts to an ntfy topic, on ntfy.sh or a self-hosted server
+type NtfyNotifier struct {
+	server string
+	topic  string
+	token  string
+}
+
+// NewNtfyNotifier creates a notifier for a topic URL such as https://ntfy.sh/my-topic.
+// The access token is only needed for protected topics.
+func NewNtfyNotifier(topicURL, token string) (*NtfyNotifier, error) {
+	u, err := url.Parse(topicURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid ntfy topic URL %q", topicURL)
+	}
+	topic := strings.Trim(u.Path, "/")
+	if topic == "" || strings.Contains(topic, "/") {
+		return nil, fmt.Errorf("ntfy URL %q must name a topic, e.g. https://ntfy.sh/my-topic", topicURL)
+	}
+	return &NtfyNotifier{server: u.Scheme + "://" + u.Host, topic: topic, token: token}, nil
+}
+
+// Name implements AlertNotifier
+func (nn *NtfyNotifier) Name() string {
+	return "ntfy"
+}
+
+// Notify implements AlertNotifier
+func (nn *NtfyNotifier) Notify(a Alert) error {
+	// ntfy priorities run from 1 (min) to 5 (urgent)
+	priority := map[string]int{severityInfo: 3, severityWarning: 4, severityCritical: 5}[a.Severity]
+	tag := map[string]string{severityInfo: "information_source", severityWarning: "warning", severityCritical: "rotating_light"}[a.Severity]
+	if a.State == alertStateResolved {
+		priority, tag = 3, "white_check_mark"
+	}
+
+	var header http.Header
+	if nn.token != "" {
+		header = http.Header{"Authorization": {"Bearer " + nn.token}}
+	}
+	return postJSONWithHeaders(chatClient, nn.server, header, map[string]interface{}{
+		"topic":    nn.topic,
+		"title":    pushTitle(a),
+		"message":  pushMessage(a),
+		"priority": priority,
+		"tags":     []string{tag},
+	})
+}
+
+// PushoverNotifier sends alerts through the Pushover API
+type PushoverNotifier struct {
+	token string
+	user  string
+}
+
+// NewPushoverNotifier creates a notifier for an application token and a user (or group) key
+func NewPushoverNotifier(token, user string) (*PushoverNotifier, error) {
+	if token == "" || user == "" {
+		return nil, fmt.Errorf("pushover needs both an application token and a user key")
+	}
+	return &PushoverNotifier{token: token, user: user}, nil
+}
+
+// Name implements AlertNotifier
+func (pn *PushoverNotifier) Name() string {
+	return "pushover"
+}
+
+// Notify implements AlertNotifier
+func (pn *PushoverNotifier) Notify(a Alert) error {
+	// Pushover priority -1 is quiet, 0 normal and 1 bypasses quiet hours
+	priority := map[string]int{severityInfo: -1, severityWarning: 0, severityCritical: 1}[a.Severity]
+	if a.State == alertStateResolved {
+		priority = -1
+	}
+	return postJSONWithRetry(chatClient, "https://api.pushover.net/1/messages.json", map[string]interface{}{
+		"token":    pn.token,
+		"user":     pn.user,
+		"title":    pushTitle(a),
+		"message":  pushMessage(a),
+		"priority": priority,
+	})
+}
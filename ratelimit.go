@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// API limiter settings
+const (
+	apiQueryWait       = 10 * time.Second // Longest a request waits for a database query slot
+	apiClientIdleAfter = 10 * time.Minute // Clients not seen for this long are forgotten
+)
+
+// APILimiter keeps heavy API use from starving capture and database writes on a small
+// board: it limits the request rate of each client address and how many database-backed
+// requests run at once
+type APILimiter struct {
+	rate  float64 // Requests per second per client; 0 for no limit
+	burst float64
+
+	mu        sync.Mutex
+	clients   map[string]*apiClient
+	lastSweep time.Time
+
+	querySlots chan struct{} // nil for no limit
+}
+
+// apiClient is the token bucket of one client address
+type apiClient struct {
+	tokens float64
+	seen   time.Time
+}
+
+// NewAPILimiter creates a limiter allowing each client rate requests per second with
+// bursts of up to burst, and maxQueries database-backed requests at once (0 for no limit)
+func NewAPILimiter(rate float64, burst int, maxQueries int) *APILimiter {
+	l := &APILimiter{
+		rate:      rate,
+		burst:     float64(burst),
+		clients:   make(map[string]*apiClient),
+		lastSweep: time.Now(),
+	}
+	if l.burst < 1 {
+		l.burst = 1
+	}
+	if maxQueries > 0 {
+		l.querySlots = make(chan struct{}, maxQueries)
+	}
+	return l
+}
+
+// Wrap returns next behind the per-client rate limit. Clients over it get 429 with the
+// seconds until their next request would be allowed in Retry-After.
+func (l *APILimiter) Wrap(next http.Handler) http.Handler {
+	if l.rate <= 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			host = r.RemoteAddr
+		}
+		if wait := l.take(host); wait > 0 {
+			w.Header().Set("Retry-After", fmt.Sprint(int(wait.Seconds())+1))
+			http.Error(w, "too many requests", http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// take spends one of a client's tokens, returning how long until one is available if it
+// has none
+func (l *APILimiter) take(client string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(l.lastSweep) > apiClientIdleAfter {
+		for addr, c := range l.clients {
+			if now.Sub(c.seen) > apiClientIdleAfter {
+				delete(l.clients, addr)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	c := l.clients[client]
+	if c == nil {
+		c = &apiClient{tokens: l.burst}
+		l.clients[client] = c
+	} else {
+		c.tokens += now.Sub(c.seen).Seconds() * l.rate
+		if c.tokens > l.burst {
+			c.tokens = l.burst
+		}
+	}
+	c.seen = now
+	if c.tokens < 1 {
+		return time.Duration((1 - c.tokens) / l.rate * float64(time.Second))
+	}
+	c.tokens--
+	return 0
+}
+
+// Query returns h holding one of the database query slots while it runs
+func (l *APILimiter) Query(h http.HandlerFunc) http.HandlerFunc {
+	if l.querySlots == nil {
+		return h
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		release, ok := l.acquire(w, r)
+		if !ok {
+			return
+		}
+		defer release()
+		h(w, r)
+	}
+}
+
+// acquire takes a database query slot for handlers that only sometimes query the
+// database. It waits up to apiQueryWait, then answers 503 itself and returns false.
+func (l *APILimiter) acquire(w http.ResponseWriter, r *http.Request) (func(), bool) {
+	if l.querySlots == nil {
+		return func() {}, true
+	}
+	timer := time.NewTimer(apiQueryWait)
+	defer timer.Stop()
+	select {
+	case l.querySlots <- struct{}{}:
+		return func() { <-l.querySlots }, true
+	case <-timer.C:
+		w.Header().Set("Retry-After", "5")
+		http.Error(w, "database busy, try again shortly", http.StatusServiceUnavailable)
+		return nil, false
+	case <-r.Context().Done():
+		return nil, false
+	}
+}
+
+// Status returns the limits and how many queries are running, for /api/database
+func (l *APILimiter) Status() map[string]interface{} {
+	l.mu.Lock()
+	clients := len(l.clients)
+	l.mu.Unlock()
+	return map[string]interface{}{
+		"rateLimit":      l.rate,
+		"burst":          l.burst,
+		"clients":        clients,
+		"maxQueries":     cap(l.querySlots),
+		"runningQueries": len(l.querySlots),
+	}
+}
+
+// noWriteTimeout lifts the server's write timeout for a response that streams for as long
+// as it takes, such as an export or event stream
+func noWriteTimeout(w http.ResponseWriter) {
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// Reverse DNS defaults, changed with -rdns-workers, -rdns-timeout and -rdns-negative-ttl
+const (
+	rdnsDefaultWorkers     = 4
+	rdnsDefaultTimeout     = 2 * time.Second
+	rdnsDefaultNegativeTTL = 30 * time.Minute
+	rdnsQueueSize          = 10000 // Addresses waiting beyond this are dropped
+)
+
+// rdnsSweepInterval is how often addresses without a name are forgotten once past negativeTTL
+const rdnsSweepInterval = time.Minute
+
+// rdnsLookups resolves hostnames for addresses as they're first seen
+var rdnsLookups = NewRDNSPool("", rdnsDefaultWorkers, rdnsDefaultTimeout, rdnsDefaultNegativeTTL)
+
+// RDNSPool looks up the hostnames of addresses with a fixed number of workers, so a burst
+// of new addresses queues up rather than starting a lookup each. Addresses without a
+// name are remembered for negativeTTL and not asked about again until it passes, then
+// forgotten. The workers start with the first address queued.
+type RDNSPool struct {
+	resolver    *net.Resolver
+	server      string // DNS server asked, "" for the system's
+	workers     int
+	timeout     time.Duration
+	negativeTTL time.Duration
+
+	start  sync.Once
+	queue  chan string
+	queued sync.Map // Addresses waiting or being looked up
+	failed sync.Map // Addresses without a name -> when to try again
+
+	// Counters, for /api/enrichment
+	mu                           sync.Mutex
+	lookups, resolved, unnamed   int64
+	skipped, dropped, inProgress int64
+}
+
+// NewRDNSPool creates a pool asking server ("host:port"), or the system resolver if empty
+func NewRDNSPool(server string, workers int, timeout, negativeTTL time.Duration) *RDNSPool {
+	p := &RDNSPool{
+		resolver:    net.DefaultResolver,
+		server:      server,
+		workers:     workers,
+		timeout:     timeout,
+		negativeTTL: negativeTTL,
+		queue:       make(chan string, rdnsQueueSize),
+	}
+	if server != "" {
+		p.resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, server)
+			},
+		}
+	}
+	return p
+}
+
+// Enqueue queues an address to be looked up, unless it already is or its last lookup
+// found no name less than negativeTTL ago
+func (p *RDNSPool) Enqueue(ip string) {
+	if retry, ok := p.failed.Load(ip); ok {
+		if time.Now().Before(retry.(time.Time)) {
+			p.mu.Lock()
+			p.skipped++
+			p.mu.Unlock()
+			return
+		}
+		p.failed.Delete(ip)
+	}
+	p.start.Do(func() {
+		for i := 0; i < p.workers; i++ {
+			go p.work()
+		}
+		go p.sweep()
+	})
+	if _, dup := p.queued.LoadOrStore(ip, true); dup {
+		return
+	}
+	select {
+	case p.queue <- ip:
+	default:
+		p.queued.Delete(ip)
+		p.mu.Lock()
+		p.dropped++
+		p.mu.Unlock()
+	}
+}
+
+// work looks queued addresses up one at a time
+func (p *RDNSPool) work() {
+	for ip := range p.queue {
+		p.mu.Lock()
+		p.inProgress++
+		p.mu.Unlock()
+
+		name := p.lookup(ip)
+
+		p.mu.Lock()
+		p.inProgress--
+		p.lookups++
+		if name != "" {
+			p.resolved++
+		} else {
+			p.unnamed++
+		}
+		p.mu.Unlock()
+
+		if name != "" {
+			updateIPInfo(ip, func(info *IPInfo) { info.Hostname = name })
+		} else {
+			p.failed.Store(ip, time.Now().Add(p.negativeTTL))
+		}
+		p.queued.Delete(ip)
+	}
+}
+
+// sweep forgets addresses without a name once negativeTTL has passed, so the ones never
+// queued again don't stay for good
+func (p *RDNSPool) sweep() {
+	ticker := time.NewTicker(rdnsSweepInterval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		p.failed.Range(func(ip, retry interface{}) bool {
+			if !now.Before(retry.(time.Time)) {
+				p.failed.CompareAndDelete(ip, retry)
+			}
+			return true
+		})
+	}
+}
+
+// lookup returns the first name for an address, or "" if it has none or the lookup failed
+func (p *RDNSPool) lookup(ip string) string {
+	if err := chaosEnrichmentFault(); err != nil {
+		return ""
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), p.timeout)
+	defer cancel()
+	names, err := p.resolver.LookupAddr(ctx, ip)
+	if err != nil || len(names) == 0 {
+		return ""
+	}
+	return names[0]
+}
+
+// Status reports the queue and how lookups have gone, for /api/enrichment
+func (p *RDNSPool) Status() map[string]interface{} {
+	negative := 0
+	p.failed.Range(func(_, _ interface{}) bool {
+		negative++
+		return true
+	})
+	server := p.server
+	if server == "" {
+		server = "system"
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return map[string]interface{}{
+		"server":      server,
+		"workers":     p.workers,
+		"queued":      len(p.queue),
+		"inProgress":  p.inProgress,
+		"lookups":     p.lookups,
+		"resolved":    p.resolved,
+		"unnamed":     p.unnamed,
+		"negative":    negative,
+		"skipped":     p.skipped,
+		"dropped":     p.dropped,
+		"negativeTTL": p.negativeTTL.String(),
+	}
+}
@@ -0,0 +1,440 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"sync"
+	"time"
+)
+
+// reportTopN is how many devices and domains are listed in a report
+const reportTopN = 10
+
+// ReportDevice is a LAN device's usage over the report period
+type ReportDevice struct {
+	MAC       string     `json:"mac"`
+	IP        string     `json:"ip"`
+	Hostname  string     `json:"hostname,omitempty"`
+	Bytes     int64      `json:"bytes"`
+	Packets   int64      `json:"packets"`
+	FirstSeen *time.Time `json:"firstSeen,omitempty"`
+}
+
+// ReportDomain is traffic exchanged with one remote hostname
+type ReportDomain struct {
+	Domain  string `json:"domain"`
+	Bytes   int64  `json:"bytes"`
+	Packets int64  `json:"packets"`
+}
+
+// ReportAlert is an alert raised during the report period
+type ReportAlert struct {
+	Time     time.Time `json:"time"`
+	Severity string    `json:"severity"`
+	Title    string    `json:"title"`
+}
+
+// ReportDay is total traffic for one day of the period
+type ReportDay struct {
+	Date  string `json:"date"`
+	Bytes int64  `json:"bytes"`
+}
+
+// Report summarizes network usage over one week
+type Report struct {
+	ID            string         `json:"id"` // Date of the Monday the week starts on
+	PeriodStart   time.Time      `json:"periodStart"`
+	PeriodEnd     time.Time      `json:"periodEnd"`
+	GeneratedAt   time.Time      `json:"generatedAt"`
+	TotalBytes    int64          `json:"totalBytes"`
+	TotalPackets  int64          `json:"totalPackets"`
+	PreviousBytes int64          `json:"previousBytes"` // Total of the week before, for comparison
+	Days          []ReportDay    `json:"days"`
+	TopDevices    []ReportDevice `json:"topDevices"`
+	TopDomains    []ReportDomain `json:"topDomains"`
+	NewDevices    []ReportDevice `json:"newDevices"`
+	Alerts        []ReportAlert  `json:"alerts"`
+}
+
+// ReportSummary is the listing entry for a stored report
+type ReportSummary struct {
+	ID          string    `json:"id"`
+	PeriodStart time.Time `json:"periodStart"`
+	PeriodEnd   time.Time `json:"periodEnd"`
+	GeneratedAt time.Time `json:"generatedAt"`
+}
+
+// weekStart returns midnight on the Monday of the week containing t, in t's location
+func weekStart(t time.Time) time.Time {
+	daysSinceMonday := (int(t.Weekday()) + 6) % 7
+	y, m, d := t.AddDate(0, 0, -daysSinceMonday).Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, t.Location())
+}
+
+// ReportGenerator builds weekly reports from the packet history and stores them
+type ReportGenerator struct {
+	db *Database
+
+	mu          sync.RWMutex
+	alertSource func(start, end time.Time) []ReportAlert
+	onReport    []func(*Report)
+}
+
+// NewReportGenerator creates a generator reading from db
+func NewReportGenerator(db *Database) *ReportGenerator {
+	return &ReportGenerator{db: db}
+}
+
+// SetAlertSource sets where alerts for the report period come from
+func (rg *ReportGenerator) SetAlertSource(fn func(start, end time.Time) []ReportAlert) {
+	rg.mu.Lock()
+	defer rg.mu.Unlock()
+	rg.alertSource = fn
+}
+
+// OnReport registers a callback invoked with every scheduled report, e.g. to email it
+func (rg *ReportGenerator) OnReport(fn func(*Report)) {
+	rg.mu.Lock()
+	defer rg.mu.Unlock()
+	rg.onReport = append(rg.onReport, fn)
+}
+
+// Start generates last week's report if it is missing, then a new one every Monday at midnight
+func (rg *ReportGenerator) Start() {
+	go func() {
+		for {
+			lastWeek := weekStart(time.Now()).AddDate(0, 0, -7)
+			if _, err := rg.db.GetReport(lastWeek.Format("2006-01-02")); err == sql.ErrNoRows {
+				rg.publish(lastWeek)
+			} else if err != nil {
+				log.Printf("Error loading report: %v", err)
+			}
+
+			next := weekStart(time.Now()).AddDate(0, 0, 7)
+			time.Sleep(time.Until(next))
+		}
+	}()
+}
+
+// publish generates, stores and hands out the report for the week starting at start
+func (rg *ReportGenerator) publish(start time.Time) {
+	report, err := rg.Generate(start, start.AddDate(0, 0, 7))
+	if err != nil {
+		log.Printf("Error generating weekly report: %v", err)
+		return
+	}
+	if err := rg.db.SaveReport(report); err != nil {
+		log.Printf("Error saving weekly report: %v", err)
+		return
+	}
+	log.Printf("Generated weekly report %s (%d MB)", report.ID, report.TotalBytes>>20)
+
+	rg.mu.RLock()
+	callbacks := rg.onReport
+	rg.mu.RUnlock()
+	for _, fn := range callbacks {
+		fn(report)
+	}
+}
+
+// Generate builds a report for the given period
+func (rg *ReportGenerator) Generate(start, end time.Time) (*Report, error) {
+	report := &Report{
+		ID:          start.Format("2006-01-02"),
+		PeriodStart: start,
+		PeriodEnd:   end,
+		GeneratedAt: time.Now(),
+		Alerts:      []ReportAlert{},
+	}
+
+	var err error
+	if report.TotalBytes, report.TotalPackets, err = rg.db.trafficTotal(start, end); err != nil {
+		return nil, err
+	}
+	if report.PreviousBytes, _, err = rg.db.trafficTotal(start.AddDate(0, 0, -7), start); err != nil {
+		return nil, err
+	}
+
+	for day := start; day.Before(end); day = day.AddDate(0, 0, 1) {
+		bytes, _, err := rg.db.trafficTotal(day, day.AddDate(0, 0, 1))
+		if err != nil {
+			return nil, err
+		}
+		report.Days = append(report.Days, ReportDay{Date: day.Format("Mon 02 Jan"), Bytes: bytes})
+	}
+
+	if report.TopDevices, err = rg.db.reportTopDevices(start, end); err != nil {
+		return nil, err
+	}
+	if report.TopDomains, err = rg.db.reportTopDomains(start, end); err != nil {
+		return nil, err
+	}
+	if report.NewDevices, err = rg.db.reportNewDevices(start, end); err != nil {
+		return nil, err
+	}
+
+	rg.mu.RLock()
+	alertSource := rg.alertSource
+	rg.mu.RUnlock()
+	if alertSource != nil {
+		report.Alerts = alertSource(start, end)
+	}
+
+	return report, nil
+}
+
+func createReportTables(db *sql.DB) error {
+	schema := `
+	CREATE TABLE IF NOT EXISTS reports (
+		id TEXT PRIMARY KEY,
+		period_start INTEGER NOT NULL,
+		period_end INTEGER NOT NULL,
+		generated_at INTEGER NOT NULL,
+		data TEXT NOT NULL
+	);
+	`
+
+	if _, err := db.Exec(schema); err != nil {
+		return fmt.Errorf("failed to create report schema: %v", err)
+	}
+	return nil
+}
+
+// SaveReport stores a report, replacing any earlier one for the same week
+func (d *Database) SaveReport(r *Report) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	_, err = d.db.Exec(`
+		INSERT OR REPLACE INTO reports (id, period_start, period_end, generated_at, data)
+		VALUES (?, ?, ?, ?, ?)
+	`, r.ID, r.PeriodStart.Unix(), r.PeriodEnd.Unix(), r.GeneratedAt.Unix(), string(data))
+	return err
+}
+
+// GetReport loads a stored report, returning sql.ErrNoRows if there is none
+func (d *Database) GetReport(id string) (*Report, error) {
+	var data string
+	if err := d.db.QueryRow("SELECT data FROM reports WHERE id = ?", id).Scan(&data); err != nil {
+		return nil, err
+	}
+	var r Report
+	if err := json.Unmarshal([]byte(data), &r); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// ListReports returns stored reports, newest first
+func (d *Database) ListReports() ([]ReportSummary, error) {
+	rows, err := d.db.Query("SELECT id, period_start, period_end, generated_at FROM reports ORDER BY period_start DESC")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	reports := []ReportSummary{}
+	for rows.Next() {
+		var r ReportSummary
+		var start, end, generated int64
+		if err := rows.Scan(&r.ID, &start, &end, &generated); err != nil {
+			return nil, err
+		}
+		r.PeriodStart, r.PeriodEnd, r.GeneratedAt = time.Unix(start, 0), time.Unix(end, 0), time.Unix(generated, 0)
+		reports = append(reports, r)
+	}
+	return reports, rows.Err()
+}
+
+func (d *Database) trafficTotal(start, end time.Time) (bytes, packets int64, err error) {
+	db, release, err := d.packetsBetween(&start, &end)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer release()
+	err = db.QueryRow("SELECT COALESCE(SUM(length), 0), COUNT(*) FROM packets WHERE timestamp >= ? AND timestamp < ?",
+		start, end).Scan(&bytes, &packets)
+	return bytes, packets, err
+}
+
+// reportTopDevices ranks local devices by traffic in either direction
+func (d *Database) reportTopDevices(start, end time.Time) ([]ReportDevice, error) {
+	db, release, err := d.packetsBetween(&start, &end)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	rows, err := db.Query(`
+		SELECT mac, MAX(ip), MAX(hostname), SUM(length) AS bytes, COUNT(*) FROM (
+			SELECT src_mac AS mac, src_ip AS ip, src_hostname AS hostname, length FROM packets
+			WHERE src_country = 'Local' AND src_mac != '' AND timestamp >= ? AND timestamp < ?
+			UNION ALL
+			SELECT dst_mac, dst_ip, dst_hostname, length FROM packets
+			WHERE dst_country = 'Local' AND dst_mac != '' AND timestamp >= ? AND timestamp < ?
+		) GROUP BY mac ORDER BY bytes DESC LIMIT ?`, start, end, start, end, reportTopN)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	devices := []ReportDevice{}
+	for rows.Next() {
+		var dev ReportDevice
+		var hostname sql.NullString
+		if err := rows.Scan(&dev.MAC, &dev.IP, &hostname, &dev.Bytes, &dev.Packets); err != nil {
+			return nil, err
+		}
+		if hostname.String != dev.IP {
+			dev.Hostname = hostname.String
+		}
+		devices = append(devices, dev)
+	}
+	return devices, rows.Err()
+}
+
+// reportTopDomains ranks remote hostnames by traffic in either direction
+func (d *Database) reportTopDomains(start, end time.Time) ([]ReportDomain, error) {
+	db, release, err := d.packetsBetween(&start, &end)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	rows, err := db.Query(`
+		SELECT hostname, SUM(length) AS bytes, COUNT(*) FROM (
+			SELECT src_hostname AS hostname, length FROM packets
+			WHERE src_country NOT IN ('', 'Local') AND src_hostname NOT IN ('', src_ip) AND timestamp >= ? AND timestamp < ?
+			UNION ALL
+			SELECT dst_hostname, length FROM packets
+			WHERE dst_country NOT IN ('', 'Local') AND dst_hostname NOT IN ('', dst_ip) AND timestamp >= ? AND timestamp < ?
+		) GROUP BY hostname ORDER BY bytes DESC LIMIT ?`, start, end, start, end, reportTopN)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	domains := []ReportDomain{}
+	for rows.Next() {
+		var dom ReportDomain
+		if err := rows.Scan(&dom.Domain, &dom.Bytes, &dom.Packets); err != nil {
+			return nil, err
+		}
+		domains = append(domains, dom)
+	}
+	return domains, rows.Err()
+}
+
+// reportNewDevices lists local MAC addresses whose first packet in the history falls in the period
+func (d *Database) reportNewDevices(start, end time.Time) ([]ReportDevice, error) {
+	// Earlier history counts too, as far back as can be attached
+	db, release, err := d.packetsBetween(nil, &end)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	rows, err := db.Query(`
+		SELECT src_mac, MAX(src_ip), MIN(timestamp) AS first FROM packets
+		WHERE src_country = 'Local' AND src_mac != ''
+		GROUP BY src_mac HAVING first >= ? AND first < ? ORDER BY first`, start, end)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	devices := []ReportDevice{}
+	for rows.Next() {
+		var dev ReportDevice
+		var first sql.NullString
+		if err := rows.Scan(&dev.MAC, &dev.IP, &first); err != nil {
+			return nil, err
+		}
+		if t, err := time.Parse("2006-01-02 15:04:05.999999999 -0700 MST", first.String); err == nil {
+			dev.FirstSeen = &t
+		}
+		devices = append(devices, dev)
+	}
+	return devices, rows.Err()
+}
+
+// formatBytes renders a byte count with a binary unit
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for v := n / unit; v >= unit; v /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+var reportTemplate = template.Must(template.New("report").Funcs(template.FuncMap{
+	"bytes": formatBytes,
+	"change": func(cur, prev int64) string {
+		if prev == 0 {
+			return ""
+		}
+		return fmt.Sprintf("(%+.0f%% on the previous week)", float64(cur-prev)*100/float64(prev))
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>pi-track weekly report {{.ID}}</title>
+<style>
+body { font-family: -apple-system, sans-serif; background: #0a0e17; color: #e0e6ed; max-width: 720px; margin: 2em auto; }
+h1, h2 { color: #00d4ff; }
+table { border-collapse: collapse; width: 100%; margin-bottom: 1.5em; }
+th, td { text-align: left; padding: 4px 8px; border-bottom: 1px solid #1e2a3a; }
+td.num { text-align: right; }
+.muted { color: #7a8ba0; }
+</style>
+</head>
+<body>
+<h1>Weekly network report</h1>
+<p class="muted">{{.PeriodStart.Format "Mon 02 Jan 2006"}} &ndash; {{(.PeriodEnd.AddDate 0 0 -1).Format "Mon 02 Jan 2006"}}</p>
+<p>Total traffic: <strong>{{bytes .TotalBytes}}</strong> in {{.TotalPackets}} packets {{change .TotalBytes .PreviousBytes}}</p>
+
+<h2>Daily usage</h2>
+<table>{{range .Days}}<tr><td>{{.Date}}</td><td class="num">{{bytes .Bytes}}</td></tr>{{end}}</table>
+
+<h2>Top devices</h2>
+<table><tr><th>Device</th><th>MAC</th><th>Traffic</th></tr>
+{{range .TopDevices}}<tr><td>{{if .Hostname}}{{.Hostname}}{{else}}{{.IP}}{{end}}</td><td>{{.MAC}}</td><td class="num">{{bytes .Bytes}}</td></tr>
+{{else}}<tr><td colspan="3" class="muted">No traffic recorded</td></tr>{{end}}</table>
+
+<h2>Top domains</h2>
+<table><tr><th>Domain</th><th>Traffic</th></tr>
+{{range .TopDomains}}<tr><td>{{.Domain}}</td><td class="num">{{bytes .Bytes}}</td></tr>
+{{else}}<tr><td colspan="2" class="muted">No resolved hostnames</td></tr>{{end}}</table>
+
+<h2>New devices</h2>
+<table>{{range .NewDevices}}<tr><td>{{.MAC}}</td><td>{{.IP}}</td><td>{{with .FirstSeen}}{{.Format "Mon 02 Jan 15:04"}}{{end}}</td></tr>
+{{else}}<tr><td class="muted">None</td></tr>{{end}}</table>
+
+<h2>Alerts</h2>
+<table>{{range .Alerts}}<tr><td>{{.Time.Format "Mon 02 Jan 15:04"}}</td><td>{{.Severity}}</td><td>{{.Title}}</td></tr>
+{{else}}<tr><td class="muted">None</td></tr>{{end}}</table>
+
+<p class="muted">Generated by pi-track at {{.GeneratedAt.Format "2006-01-02 15:04"}}</p>
+</body>
+</html>
+`))
+
+// RenderHTML renders the report as a standalone HTML page
+func (r *Report) RenderHTML() ([]byte, error) {
+	var buf bytes.Buffer
+	if err := reportTemplate.Execute(&buf, r); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Replay limits for resuming clients: packets further back than maxReplayPackets count as
+// missed, and the rest are sent replayChunk to a message
+const (
+	maxReplayPackets = 5000
+	replayChunk      = 500
+)
+
+// instanceID tells this run's packet IDs apart from a previous run's, which started over
+var instanceID = strconv.FormatInt(time.Now().UnixNano(), 36)
+
+// resumeToken is what a client reconnects with to be sent the packets after seq
+func resumeToken(seq int64) string {
+	return instanceID + ":" + strconv.FormatInt(seq, 10)
+}
+
+// parseResumeToken returns the packet ID in a resume token, and whether it's from this run
+func parseResumeToken(token string) (int64, bool, error) {
+	instance, seq, ok := strings.Cut(token, ":")
+	n, err := strconv.ParseInt(seq, 10, 64)
+	if !ok || err != nil || n < 0 {
+		return 0, false, fmt.Errorf("invalid resume token %q", token)
+	}
+	return n, instance == instanceID, nil
+}
+
+// Resumable reports whether a resume token is from this run, so the packets after it can
+// be replayed, at least those still in the live buffer
+func (ps *PacketStore) Resumable(token string) bool {
+	since, sameRun, err := parseResumeToken(token)
+	if err != nil || !sameRun {
+		return false
+	}
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+	return since <= ps.packetID
+}
+
+// Resume sends a reconnecting client the live packets it missed, those after the packet
+// its token names, as packets messages marked "replay", then a resume message saying how
+// many were replayed and how many had already left the live buffer. Broadcasts wait
+// while this runs, and packets it replays are kept out of later ones, so the client sees
+// each packet once and in order.
+func (ps *PacketStore) Resume(c *wsClient, token string) {
+	replayed := 0
+	reply := map[string]interface{}{"replayed": 0, "missed": 0}
+	defer func() {
+		reply["replayed"] = replayed
+		c.reply("resume", reply)
+	}()
+
+	since, sameRun, err := parseResumeToken(token)
+	if err != nil {
+		reply["error"] = err.Error()
+		return
+	}
+
+	ps.clientsMu.Lock()
+	defer ps.clientsMu.Unlock()
+
+	ps.mu.RLock()
+	if !sameRun || since > ps.packetID {
+		// Restarted since the token was issued; only a fresh start makes sense
+		ps.mu.RUnlock()
+		reply["reset"] = true
+		return
+	}
+	start := sort.Search(len(ps.packets), func(i int) bool { return ps.packets[i].ID > since })
+	missed := int64(0)
+	if start < len(ps.packets) {
+		missed = ps.packets[start].ID - since - 1
+	} else {
+		missed = ps.packetID - since
+	}
+	if n := len(ps.packets) - start; n > maxReplayPackets {
+		missed += int64(n - maxReplayPackets)
+		start = len(ps.packets) - maxReplayPackets
+	}
+	replay := make([]Packet, len(ps.packets)-start)
+	copy(replay, ps.packets[start:])
+	latest := ps.packetID
+	ps.mu.RUnlock()
+
+	if c.channels.Load()&channelPackets == 0 {
+		return
+	}
+	if f, follow := c.filter.Load(), c.follow.Load(); f != nil || follow != nil {
+		matched := replay[:0]
+		for i := range replay {
+			if (f == nil || f.Match(&replay[i])) && (follow == nil || follow.Match(&replay[i])) {
+				matched = append(matched, replay[i])
+			}
+		}
+		replay = matched
+	}
+
+	// Packets captured up to now are either replayed or were left out by the filter
+	c.replayedTo.Store(latest)
+	for len(replay) > 0 {
+		n := min(len(replay), replayChunk)
+		data := marshalPacketsMessage(replay[:n], true)
+		select {
+		case c.send <- data:
+		default:
+			reply["error"] = "send buffer full, replay cut short"
+			return
+		}
+		replayed += n
+		replay = replay[n:]
+	}
+	reply["missed"] = missed
+}
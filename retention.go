@@ -0,0 +1,336 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// retentionInterval is how often old rows are pruned
+const retentionInterval = time.Hour
+
+// retentionChunk is how many rows are deleted per statement, so the capture
+// writer isn't locked out for long
+const retentionChunk = 10000
+
+// retentionTable describes how the age of a table's rows is found
+type retentionTable struct {
+	column string
+	unix   bool   // Column holds Unix seconds rather than a timestamp
+	day    bool   // Column holds a YYYY-MM-DD day
+	where  string // Extra condition rows must meet to be pruned
+}
+
+// retentionTables are the tables a retention policy can be set for
+var retentionTables = map[string]retentionTable{
+	"packets":             {column: "timestamp"},
+	"traffic_hourly":      {column: "hour", unix: true},
+	"device_hourly":       {column: "hour", unix: true},
+	"latency_samples":     {column: "timestamp", unix: true},
+	"speedtests":          {column: "timestamp", unix: true},
+	"reports":             {column: "generated_at", unix: true},
+	"alerts":              {column: "started_at", unix: true, where: "state = 'resolved'"},
+	"device_usage":        {column: "day", day: true},
+	"device_presence":     {column: "last_seen", unix: true},
+	"flows":               {column: "last_seen"},
+	"dns_log":             {column: "timestamp"},
+	"process_connections": {column: "last_seen"},
+}
+
+// parseRetentionAge parses an age such as "30d", "2w" or "12h"
+func parseRetentionAge(s string) (time.Duration, error) {
+	s = strings.TrimSpace(strings.ToLower(s))
+	for suffix, unit := range map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour} {
+		if strings.HasSuffix(s, suffix) {
+			n, err := strconv.ParseFloat(strings.TrimSuffix(s, suffix), 64)
+			if err != nil || n < 0 {
+				return 0, fmt.Errorf("invalid age %q", s)
+			}
+			return time.Duration(n * float64(unit)), nil
+		}
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid age %q", s)
+	}
+	return d, nil
+}
+
+// ParseRetentionPolicies builds the per-table maximum ages from the packet retention and a
+// list such as "traffic_hourly=365d,latency_samples=90d". Zero or missing ages keep rows forever.
+func ParseRetentionPolicies(packets, tables string) (map[string]time.Duration, error) {
+	policies := make(map[string]time.Duration)
+	if strings.TrimSpace(packets) != "" {
+		age, err := parseRetentionAge(packets)
+		if err != nil {
+			return nil, err
+		}
+		policies["packets"] = age
+	}
+	for _, policy := range strings.Split(tables, ",") {
+		if strings.TrimSpace(policy) == "" {
+			continue
+		}
+		table, age, ok := strings.Cut(policy, "=")
+		table = strings.TrimSpace(table)
+		if !ok {
+			return nil, fmt.Errorf("invalid policy %q, expected table=age", policy)
+		}
+		if _, known := retentionTables[table]; !known {
+			return nil, fmt.Errorf("unknown table %q", table)
+		}
+		d, err := parseRetentionAge(age)
+		if err != nil {
+			return nil, err
+		}
+		policies[table] = d
+	}
+	for table, age := range policies {
+		if age == 0 {
+			delete(policies, table)
+		}
+	}
+	return policies, nil
+}
+
+// RetentionRun is the outcome of one pruning pass
+type RetentionRun struct {
+	StartedAt      time.Time        `json:"startedAt"`
+	Duration       float64          `json:"durationSeconds"`
+	Deleted        map[string]int64 `json:"deleted"`            // Rows deleted per table
+	Archived       int64            `json:"archived,omitempty"` // Packets written to the archive first
+	ReclaimedBytes int64            `json:"reclaimedBytes"`
+	Error          string           `json:"error,omitempty"`
+}
+
+// RetentionStatus describes the retention policies and the last pruning pass
+type RetentionStatus struct {
+	Policies map[string]string `json:"policies"` // Table -> maximum age
+	LastRun  *RetentionRun     `json:"lastRun,omitempty"`
+}
+
+// RetentionManager deletes rows older than each table's policy in the background and
+// gives the freed pages back to the filesystem with an incremental vacuum, so the
+// database stops growing once it holds the retention period's worth of data. Expired
+// packets are downsampled into hourly per-device totals rather than just deleted.
+type RetentionManager struct {
+	db      *Database
+	archive *Archiver // Keeps expired packets before they are pruned; nil to just prune
+	vacuum  sync.Once
+
+	mu       sync.Mutex
+	policies map[string]time.Duration
+	lastRun  *RetentionRun
+}
+
+// NewRetentionManager creates a manager for the given per-table maximum ages, archiving
+// expired packets first if archive is set
+func NewRetentionManager(db *Database, policies map[string]time.Duration, archive *Archiver) *RetentionManager {
+	return &RetentionManager{db: db, policies: policies, archive: archive}
+}
+
+// SetPolicies replaces the per-table maximum ages, taking effect on the next run
+func (rm *RetentionManager) SetPolicies(policies map[string]time.Duration) {
+	rm.mu.Lock()
+	rm.policies = policies
+	rm.mu.Unlock()
+}
+
+// Start prunes at startup and then every retentionInterval. Passes are skipped while
+// there are no policies, as they can be set at runtime.
+func (rm *RetentionManager) Start() {
+	go func() {
+		rm.Run()
+		ticker := time.NewTicker(retentionInterval)
+		for range ticker.C {
+			rm.Run()
+		}
+	}()
+}
+
+// Run deletes expired rows from every table with a policy and reclaims the space
+func (rm *RetentionManager) Run() RetentionRun {
+	run := RetentionRun{StartedAt: time.Now(), Deleted: make(map[string]int64)}
+
+	rm.mu.Lock()
+	policies := rm.policies
+	rm.mu.Unlock()
+	if len(policies) == 0 {
+		return run
+	}
+
+	rm.vacuum.Do(func() {
+		// Databases created before incremental vacuum was enabled need one full VACUUM to switch
+		if converted, err := rm.db.EnableIncrementalVacuum(); err != nil {
+			log.Printf("Warning: could not enable incremental vacuum: %v", err)
+		} else if converted {
+			log.Printf("Enabled incremental vacuum on the database")
+		}
+	})
+	before := rm.db.FileSize()
+
+	tables := make([]string, 0, len(policies))
+	for table := range policies {
+		tables = append(tables, table)
+	}
+	sort.Strings(tables)
+
+	var total int64
+	for _, table := range tables {
+		cutoff := run.StartedAt.Add(-policies[table])
+		var deleted int64
+		var err error
+		if table == "packets" && rm.archive != nil {
+			// Nothing is pruned unless it is safely archived
+			run.Archived, err = rm.archive.ArchiveBefore(rm.db, cutoff)
+			if err != nil {
+				run.Error = fmt.Sprintf("archive: %v", err)
+				log.Printf("Error archiving packets, not pruning them: %v", err)
+				continue
+			}
+		}
+		if table == "packets" {
+			// Raw packets are rolled up into device_hourly before they go; days already
+			// moved to their own files were rolled up then and are simply deleted
+			deleted, err = rm.db.DownsamplePackets(cutoff)
+			if err == nil {
+				var dropped int64
+				dropped, err = rm.db.DropPartitions(cutoff)
+				deleted += dropped
+			}
+		} else {
+			deleted, err = rm.db.DeleteExpired(table, cutoff)
+		}
+		run.Deleted[table] = deleted
+		total += deleted
+		if err != nil {
+			run.Error = fmt.Sprintf("%s: %v", table, err)
+			log.Printf("Error pruning %s: %v", table, err)
+		}
+	}
+
+	if total > 0 {
+		if err := rm.db.IncrementalVacuum(); err != nil {
+			log.Printf("Warning: incremental vacuum failed: %v", err)
+		}
+		run.ReclaimedBytes = before - rm.db.FileSize()
+		if run.ReclaimedBytes < 0 {
+			run.ReclaimedBytes = 0
+		}
+		log.Printf("Retention pruned %d rows, reclaimed %s", total, formatBytes(run.ReclaimedBytes))
+	}
+	run.Duration = time.Since(run.StartedAt).Seconds()
+
+	rm.mu.Lock()
+	rm.lastRun = &run
+	rm.mu.Unlock()
+	return run
+}
+
+// Status returns the policies and the outcome of the last run
+func (rm *RetentionManager) Status() RetentionStatus {
+	rm.mu.Lock()
+	status := RetentionStatus{Policies: make(map[string]string, len(rm.policies))}
+	for table, age := range rm.policies {
+		status.Policies[table] = age.String()
+	}
+	status.LastRun = rm.lastRun
+	rm.mu.Unlock()
+	return status
+}
+
+// DeleteExpired removes a table's rows older than cutoff, in chunks
+func (d *Database) DeleteExpired(table string, cutoff time.Time) (int64, error) {
+	t, ok := retentionTables[table]
+	if !ok {
+		return 0, fmt.Errorf("unknown table %q", table)
+	}
+	var arg interface{} = cutoff
+	switch {
+	case t.unix:
+		arg = cutoff.Unix()
+	case t.day:
+		arg = cutoff.Format("2006-01-02")
+	}
+	where := t.column + " < ?"
+	if t.where != "" {
+		where += " AND " + t.where
+	}
+
+	var total int64
+	for {
+		result, err := d.db.Exec("DELETE FROM "+table+" WHERE rowid IN (SELECT rowid FROM "+table+" WHERE "+where+" LIMIT ?)", arg, retentionChunk)
+		if err != nil {
+			return total, err
+		}
+		n, _ := result.RowsAffected()
+		total += n
+		if n < retentionChunk {
+			return total, nil
+		}
+	}
+}
+
+// EnableIncrementalVacuum switches the database to incremental auto-vacuum, rebuilding it
+// if it was created without. Reports whether a rebuild was needed.
+func (d *Database) EnableIncrementalVacuum() (bool, error) {
+	var mode int
+	if err := d.db.QueryRow("PRAGMA auto_vacuum").Scan(&mode); err != nil {
+		return false, err
+	}
+	if mode == 2 { // INCREMENTAL
+		return false, nil
+	}
+	if _, err := d.db.Exec("PRAGMA auto_vacuum=INCREMENTAL"); err != nil {
+		return false, err
+	}
+	if _, err := d.db.Exec("VACUUM"); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// IncrementalVacuum returns free pages to the filesystem and truncates the WAL
+func (d *Database) IncrementalVacuum() error {
+	// The pragma frees one page per step, so every row has to be read
+	rows, err := d.db.Query("PRAGMA incremental_vacuum")
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if _, err := d.db.Exec("PRAGMA wal_checkpoint(TRUNCATE)"); err != nil {
+		log.Printf("Warning: WAL checkpoint failed: %v", err)
+	}
+	return nil
+}
+
+// UsedSize returns the bytes of the database holding data, leaving out free pages
+// that are waiting to be reused or vacuumed
+func (d *Database) UsedSize() int64 {
+	var pageCount, freePages, pageSize int64
+	d.db.QueryRow("PRAGMA page_count").Scan(&pageCount)
+	d.db.QueryRow("PRAGMA freelist_count").Scan(&freePages)
+	d.db.QueryRow("PRAGMA page_size").Scan(&pageSize)
+	used := (pageCount - freePages) * pageSize
+	if d.partitions != nil {
+		used += d.partitions.Status().Bytes
+	}
+	return used
+}
+
+// FileSize returns the size of the database in bytes, from its page count
+func (d *Database) FileSize() int64 {
+	var pageCount, pageSize int64
+	d.db.QueryRow("PRAGMA page_count").Scan(&pageCount)
+	d.db.QueryRow("PRAGMA page_size").Scan(&pageSize)
+	return pageCount * pageSize
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net"
+	"time"
+)
+
+// rollupKey identifies one row of the hourly rollup table
+type rollupKey struct {
+	hour        int64 // Unix seconds at the start of the hour
+	ip          string
+	protocol    string
+	application string
+}
+
+// rollupCounts holds the counters aggregated under a rollupKey
+type rollupCounts struct {
+	packets int64
+	bytes   int64
+}
+
+func createRollupTables(db *sql.DB) error {
+	schema := `
+	CREATE TABLE IF NOT EXISTS traffic_hourly (
+		hour INTEGER NOT NULL,
+		ip TEXT NOT NULL,
+		protocol TEXT NOT NULL,
+		application TEXT NOT NULL,
+		packets INTEGER DEFAULT 0,
+		bytes INTEGER DEFAULT 0,
+		PRIMARY KEY (hour, ip, protocol, application)
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_traffic_hourly_ip ON traffic_hourly(ip);
+
+	CREATE TABLE IF NOT EXISTS device_hourly (
+		hour INTEGER NOT NULL,
+		device TEXT NOT NULL,
+		protocol TEXT NOT NULL,
+		packets_sent INTEGER DEFAULT 0,
+		bytes_sent INTEGER DEFAULT 0,
+		packets_received INTEGER DEFAULT 0,
+		bytes_received INTEGER DEFAULT 0,
+		PRIMARY KEY (hour, device, protocol)
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_device_hourly_device ON device_hourly(device);
+	`
+
+	if _, err := db.Exec(schema); err != nil {
+		return fmt.Errorf("failed to create rollup schema: %v", err)
+	}
+	return nil
+}
+
+// aggregateHourly groups packets into hourly rollup rows keyed by source IP
+func aggregateHourly(packets []Packet) map[rollupKey]*rollupCounts {
+	rollups := make(map[rollupKey]*rollupCounts)
+	for _, p := range packets {
+		key := rollupKey{
+			hour:        p.Timestamp.Truncate(time.Hour).Unix(),
+			ip:          p.SrcIP,
+			protocol:    p.Protocol,
+			application: p.Application,
+		}
+		c := rollups[key]
+		if c == nil {
+			c = &rollupCounts{}
+			rollups[key] = c
+		}
+		c.packets++
+		c.bytes += int64(p.Length)
+	}
+	return rollups
+}
+
+// updateRollups adds the given packets to the hourly rollup table within tx
+func updateRollups(tx *sql.Tx, packets []Packet) error {
+	stmt, err := tx.Prepare(`
+		INSERT INTO traffic_hourly (hour, ip, protocol, application, packets, bytes)
+		VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT (hour, ip, protocol, application) DO UPDATE SET
+			packets = packets + excluded.packets,
+			bytes = bytes + excluded.bytes
+	`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for key, c := range aggregateHourly(packets) {
+		if _, err := stmt.Exec(key.hour, key.ip, key.protocol, key.application, c.packets, c.bytes); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deviceHourlyKey identifies one row of the per-device hourly rollup table
+type deviceHourlyKey struct {
+	hour     int64
+	device   string
+	protocol string
+}
+
+// deviceHourlyCounts holds the counters aggregated under a deviceHourlyKey
+type deviceHourlyCounts struct {
+	sent     rollupCounts
+	received rollupCounts
+}
+
+// downsampleChunk is how many raw packets are rolled up and deleted per transaction
+const downsampleChunk = 10000
+
+// DownsamplePackets rolls packets older than cutoff up into per-device, per-protocol
+// hourly totals and then deletes them, so long-term trends outlive the raw rows. Only
+// LAN devices are kept: senders are credited with what they send, receivers with unicast.
+func (d *Database) DownsamplePackets(cutoff time.Time) (int64, error) {
+	var total int64
+	for {
+		n, err := d.downsampleChunk(cutoff)
+		total += n
+		if err != nil || n < downsampleChunk {
+			return total, err
+		}
+	}
+}
+
+func (d *Database) downsampleChunk(cutoff time.Time) (int64, error) {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`
+		SELECT id, timestamp, src_ip, dst_ip, src_mac, dst_mac, protocol, length FROM packets
+		WHERE timestamp < ? ORDER BY id LIMIT ?
+	`, cutoff, downsampleChunk)
+	if err != nil {
+		return 0, err
+	}
+	var n, lastID int64
+	rollups := make(map[deviceHourlyKey]*deviceHourlyCounts)
+	add := func(hour int64, device, protocol string, length int64, sent bool) {
+		key := deviceHourlyKey{hour, device, protocol}
+		c := rollups[key]
+		if c == nil {
+			c = &deviceHourlyCounts{}
+			rollups[key] = c
+		}
+		if sent {
+			c.sent.packets++
+			c.sent.bytes += length
+		} else {
+			c.received.packets++
+			c.received.bytes += length
+		}
+	}
+	for rows.Next() {
+		var p Packet
+		var srcMAC, dstMAC, protocol sql.NullString
+		if err := rows.Scan(&p.ID, &p.Timestamp, &p.SrcIP, &p.DstIP, &srcMAC, &dstMAC, &protocol, &p.Length); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		p.SrcMAC, p.DstMAC, p.Protocol = srcMAC.String, dstMAC.String, protocol.String
+		n++
+		lastID = p.ID
+
+		hour := p.Timestamp.Truncate(time.Hour).Unix()
+		if ip := net.ParseIP(p.SrcIP); ip != nil && ip.IsPrivate() {
+			add(hour, deviceKey(p.SrcMAC, p.SrcIP), p.Protocol, int64(p.Length), true)
+		}
+		if ip := net.ParseIP(p.DstIP); ip != nil && ip.IsPrivate() && classifyCast(p) == castUnicast {
+			add(hour, deviceKey(p.DstMAC, p.DstIP), p.Protocol, int64(p.Length), false)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	if n == 0 {
+		return 0, nil
+	}
+
+	stmt, err := tx.Prepare(`
+		INSERT INTO device_hourly (hour, device, protocol, packets_sent, bytes_sent, packets_received, bytes_received)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (hour, device, protocol) DO UPDATE SET
+			packets_sent = packets_sent + excluded.packets_sent,
+			bytes_sent = bytes_sent + excluded.bytes_sent,
+			packets_received = packets_received + excluded.packets_received,
+			bytes_received = bytes_received + excluded.bytes_received
+	`)
+	if err != nil {
+		return 0, err
+	}
+	defer stmt.Close()
+	for key, c := range rollups {
+		if _, err := stmt.Exec(key.hour, key.device, key.protocol, c.sent.packets, c.sent.bytes, c.received.packets, c.received.bytes); err != nil {
+			return 0, err
+		}
+	}
+
+	// The rows read are exactly the expired ones up to the last ID
+	if _, err := tx.Exec("DELETE FROM packets WHERE id <= ? AND timestamp < ?", lastID, cutoff); err != nil {
+		return 0, err
+	}
+	return n, tx.Commit()
+}
+
+// DeviceHourly is one hour of downsampled traffic
+type DeviceHourly struct {
+	Hour            time.Time `json:"hour"`
+	PacketsSent     int64     `json:"packetsSent"`
+	BytesSent       int64     `json:"bytesSent"`
+	PacketsReceived int64     `json:"packetsReceived"`
+	BytesReceived   int64     `json:"bytesReceived"`
+}
+
+// GetDeviceHourly returns downsampled hourly traffic for a device, or for all LAN devices
+// combined if device is empty, optionally narrowed to one protocol
+func (d *Database) GetDeviceHourly(device, protocol string, startTime, endTime *time.Time) ([]DeviceHourly, error) {
+	query := `
+		SELECT hour, SUM(packets_sent), SUM(bytes_sent), SUM(packets_received), SUM(bytes_received)
+		FROM device_hourly WHERE 1=1`
+	args := []interface{}{}
+	if device != "" {
+		query += " AND device = ?"
+		args = append(args, device)
+	}
+	if protocol != "" {
+		query += " AND protocol = ?"
+		args = append(args, protocol)
+	}
+	if startTime != nil {
+		query += " AND hour >= ?"
+		args = append(args, startTime.Truncate(time.Hour).Unix())
+	}
+	if endTime != nil {
+		query += " AND hour <= ?"
+		args = append(args, endTime.Unix())
+	}
+	query += " GROUP BY hour ORDER BY hour"
+
+	rows, err := d.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	history := []DeviceHourly{}
+	for rows.Next() {
+		var h DeviceHourly
+		var hour int64
+		if err := rows.Scan(&hour, &h.PacketsSent, &h.BytesSent, &h.PacketsReceived, &h.BytesReceived); err != nil {
+			return nil, err
+		}
+		h.Hour = time.Unix(hour, 0)
+		history = append(history, h)
+	}
+	return history, rows.Err()
+}
+
+// Heatmap is a day-of-week × hour-of-day matrix of traffic
+type Heatmap struct {
+	Days   int           `json:"days"`
+	Start  time.Time     `json:"start"`
+	End    time.Time     `json:"end"`
+	Bytes  [7][24]int64  `json:"bytes"`  // Indexed by weekday (0 = Sunday) then local hour
+	Counts [7][24]int    `json:"counts"` // Number of hours contributing to each cell
+	Avg    [7][24]int64  `json:"avg"`    // Bytes per contributing hour
+	Max    int64         `json:"max"`
+	Labels heatmapLabels `json:"labels"`
+}
+
+type heatmapLabels struct {
+	Days  []string `json:"days"`
+	Hours []int    `json:"hours"`
+}
+
+// GetHeatmap returns bytes per weekday and hour over the last n days, in server local time
+func (d *Database) GetHeatmap(days int) (*Heatmap, error) {
+	end := time.Now()
+	start := end.AddDate(0, 0, -days).Truncate(time.Hour)
+
+	rows, err := d.db.Query(`
+		SELECT hour, SUM(bytes) FROM traffic_hourly
+		WHERE hour >= ? AND hour <= ?
+		GROUP BY hour
+	`, start.Unix(), end.Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	h := &Heatmap{Days: days, Start: start, End: end}
+	for i := 0; i < 7; i++ {
+		h.Labels.Days = append(h.Labels.Days, time.Weekday(i).String())
+	}
+	for i := 0; i < 24; i++ {
+		h.Labels.Hours = append(h.Labels.Hours, i)
+	}
+
+	for rows.Next() {
+		var hour, bytes int64
+		if err := rows.Scan(&hour, &bytes); err != nil {
+			return nil, err
+		}
+		t := time.Unix(hour, 0).In(time.Local)
+		h.Bytes[t.Weekday()][t.Hour()] += bytes
+		h.Counts[t.Weekday()][t.Hour()]++
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for day := range h.Bytes {
+		for hour, bytes := range h.Bytes[day] {
+			if bytes > h.Max {
+				h.Max = bytes
+			}
+			if n := h.Counts[day][hour]; n > 0 {
+				h.Avg[day][hour] = bytes / int64(n)
+			}
+		}
+	}
+
+	return h, nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// Packet sources /api/search can read
+const (
+	searchSourceLive    = "live"    // The in-memory buffer
+	searchSourceHistory = "history" // The database
+)
+
+// SearchQuery is a display filter search for /api/search
+type SearchQuery struct {
+	Filter *DisplayFilter
+	Source string // searchSourceLive or searchSourceHistory
+	Limit  int
+	Offset int
+}
+
+// parseSearchQuery reads the /api/search parameters. The filter is required; history
+// searches also take the /api/history time range, read by the handler.
+func parseSearchQuery(r *http.Request) (SearchQuery, error) {
+	v := r.URL.Query()
+	q := SearchQuery{Source: searchSourceLive, Limit: 100}
+
+	if s := v.Get("source"); s != "" {
+		if s != searchSourceLive && s != searchSourceHistory {
+			return q, fmt.Errorf("invalid source %q (expected live or history)", s)
+		}
+		q.Source = s
+	}
+	var err error
+	if q.Filter, err = parseDisplayFilterParam(v, q.Source == searchSourceHistory); err != nil {
+		return q, err
+	}
+	if q.Filter == nil {
+		return q, fmt.Errorf("missing q (a filter such as ip == 192.168.1.5 && bytes > 1000)")
+	}
+	if s := v.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			return q, fmt.Errorf("invalid limit %q", s)
+		}
+		if n > 1000 {
+			n = 1000
+		}
+		q.Limit = n
+	}
+	if s := v.Get("offset"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			return q, fmt.Errorf("invalid offset %q", s)
+		}
+		q.Offset = n
+	}
+	return q, nil
+}
+
+// SearchPackets returns one page of the buffered packets matching f, newest first, and how
+// many match in total
+func (ps *PacketStore) SearchPackets(f *DisplayFilter, limit, offset int) ([]Packet, int) {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+
+	page := make([]Packet, 0)
+	total := 0
+	for i := len(ps.packets) - 1; i >= 0; i-- {
+		p := &ps.packets[i]
+		if !f.Match(p) {
+			continue
+		}
+		if total >= offset && len(page) < limit {
+			page = append(page, *p)
+		}
+		total++
+	}
+	return page, total
+}
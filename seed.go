@@ -0,0 +1,356 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"strings"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+// seedDevice is a synthetic LAN device used by the demo data generator
+type seedDevice struct {
+	name   string
+	ip     string
+	mac    string
+	weight int      // Relative share of traffic
+	apps   []string // Applications the device uses
+}
+
+// seedRemote is a synthetic internet endpoint
+type seedRemote struct {
+	ip       string
+	hostname string
+	country  string
+}
+
+var seedDevices = []seedDevice{
+	{"laptop", "192.168.1.20", "a4:83:e7:12:34:56", 30, []string{"HTTPS", "HTTPS", "HTTPS", "HTTP", "SSH", "DNS"}},
+	{"desktop", "192.168.1.21", "00:1b:21:aa:bb:cc", 20, []string{"HTTPS", "HTTPS", "HTTP", "DNS", "NTP"}},
+	{"phone", "192.168.1.30", "f0:18:98:01:02:03", 15, []string{"HTTPS", "HTTPS", "DNS", "MQTT-TLS"}},
+	{"tablet", "192.168.1.31", "f0:18:98:04:05:06", 10, []string{"HTTPS", "DNS"}},
+	{"tv", "192.168.1.40", "cc:6e:a4:10:20:30", 18, []string{"HTTPS", "HTTPS", "HTTPS", "DNS"}},
+	{"nas", "192.168.1.10", "00:11:32:de:ad:01", 5, []string{"HTTPS", "NTP", "DNS", "SSH"}},
+	{"thermostat", "192.168.1.50", "18:b4:30:77:88:99", 1, []string{"MQTT", "DNS", "NTP"}},
+	{"camera", "192.168.1.51", "2c:aa:8e:11:22:33", 1, []string{"HTTPS", "DNS"}},
+}
+
+var seedRemotes = map[string][]seedRemote{
+	"HTTPS": {
+		{"142.250.185.78", "fra16s52-in-f14.1e100.net.", "DE"},
+		{"151.101.1.140", "reddit.map.fastly.net.", "US"},
+		{"104.16.132.229", "cloudflare.com.", "US"},
+		{"52.94.236.248", "ec2-52-94-236-248.compute-1.amazonaws.com.", "US"},
+		{"198.38.120.130", "ipv4-c001-ams001-ix.1.oca.nflxvideo.net.", "NL"},
+		{"13.107.42.14", "outlook.office365.com.", "US"},
+		{"185.199.108.153", "cdn-185-199-108-153.github.com.", "US"},
+		{"95.101.75.32", "a95-101-75-32.deploy.static.akamaitechnologies.com.", "GB"},
+	},
+	"HTTP": {
+		{"91.189.91.38", "ubuntu-mirror.canonical.com.", "GB"},
+		{"151.101.130.132", "deb.debian.org.", "US"},
+	},
+	"SSH":      {{"203.0.113.45", "vps.example.net.", "FR"}},
+	"NTP":      {{"162.159.200.1", "time.cloudflare.com.", "US"}},
+	"MQTT":     {{"35.158.43.69", "mqtt.thermostat-cloud.example.", "DE"}},
+	"MQTT-TLS": {{"3.120.16.210", "iot.push.example.", "DE"}},
+}
+
+var seedDomains = []string{
+	"www.google.com", "youtube.com", "api.github.com", "www.reddit.com", "netflix.com",
+	"outlook.office365.com", "time.cloudflare.com", "deb.debian.org", "updates.example.com",
+	"weather.example.org", "cdn.jsdelivr.net", "connectivitycheck.gstatic.com",
+}
+
+var seedPorts = map[string]uint16{
+	"HTTPS": 443, "HTTP": 80, "SSH": 22, "NTP": 123, "MQTT": 1883, "MQTT-TLS": 8883, "DNS": 53,
+}
+
+const (
+	seedGateway    = "192.168.1.1"
+	seedGatewayMAC = "b8:27:eb:00:00:01"
+)
+
+// runSeed implements the "seed" subcommand, filling the database with synthetic history
+func runSeed(args []string) {
+	fs := flag.NewFlagSet("seed", flag.ExitOnError)
+	days := fs.Int("days", 30, "Number of days of history to generate, ending now")
+	dbFlags := addCLIDatabaseFlags(fs)
+	perHour := fs.Int("packets-per-hour", 500, "Average packets generated per hour at peak")
+	randSeed := fs.Int64("seed", 1, "Random seed, for reproducible datasets")
+	fs.Parse(args)
+
+	db := dbFlags.open()
+	defer db.Close()
+
+	rng := rand.New(rand.NewSource(*randSeed))
+	end := time.Now().Truncate(time.Hour)
+	start := end.AddDate(0, 0, -*days)
+
+	var total, flowCount, lookupCount, alertCount int
+	for hour := start; hour.Before(end); hour = hour.Add(time.Hour) {
+		packets := generateSeedHour(rng, hour, *perHour)
+		if err := db.writeBatch(packets); err != nil {
+			log.Fatalf("Failed to write seed data: %v", err)
+		}
+		total += len(packets)
+
+		flows, lookups := seedFlowsAndLookups(packets)
+		if err := db.InsertFlows(flows); err != nil {
+			log.Fatalf("Failed to write seed flows: %v", err)
+		}
+		if err := db.InsertDNSLog(lookups); err != nil {
+			log.Fatalf("Failed to write seed DNS lookups: %v", err)
+		}
+		flowCount += len(flows)
+		lookupCount += len(lookups)
+
+		for _, a := range generateSeedAlerts(rng, hour, end) {
+			var err error
+			if a.ID, err = db.InsertAlert(a); err == nil {
+				err = db.UpdateAlert(a)
+			}
+			if err != nil {
+				log.Fatalf("Failed to write seed alerts: %v", err)
+			}
+			alertCount++
+		}
+
+		if hour.Hour() == 23 {
+			log.Printf("Seeded %s (%d packets so far)", hour.Format("2006-01-02"), total)
+		}
+	}
+
+	fmt.Printf("Seeded %d packets, %d flows, %d DNS lookups and %d alerts over %d days into %s\n",
+		total, flowCount, lookupCount, alertCount, *days, *dbFlags.path)
+}
+
+// seedActivity returns a relative activity level for a local time, peaking in the evening
+func seedActivity(t time.Time) float64 {
+	h := float64(t.Hour()) + float64(t.Minute())/60
+	// Quiet overnight, a morning bump, and a larger evening peak
+	level := 0.08 +
+		0.35*math.Exp(-math.Pow(h-8, 2)/4) +
+		0.45*math.Exp(-math.Pow(h-13, 2)/8) +
+		1.0*math.Exp(-math.Pow(h-20.5, 2)/5)
+	if wd := t.Weekday(); wd == time.Saturday || wd == time.Sunday {
+		level *= 1.25
+	}
+	return level
+}
+
+// generateSeedHour produces one hour of plausible traffic starting at hour
+func generateSeedHour(rng *rand.Rand, hour time.Time, perHour int) []Packet {
+	count := int(float64(perHour) * seedActivity(hour) * (0.7 + 0.6*rng.Float64()))
+
+	totalWeight := 0
+	for _, d := range seedDevices {
+		totalWeight += d.weight
+	}
+
+	packets := make([]Packet, 0, count)
+	for i := 0; i < count; i++ {
+		// Pick a device by weight
+		n := rng.Intn(totalWeight)
+		dev := seedDevices[0]
+		for _, d := range seedDevices {
+			if n < d.weight {
+				dev = d
+				break
+			}
+			n -= d.weight
+		}
+
+		app := dev.apps[rng.Intn(len(dev.apps))]
+		ts := hour.Add(time.Duration(rng.Int63n(int64(time.Hour))))
+		packets = append(packets, generateSeedPacket(rng, ts, dev, app))
+	}
+
+	return packets
+}
+
+func generateSeedPacket(rng *rand.Rand, ts time.Time, dev seedDevice, app string) Packet {
+	localPort := uint16(32768 + rng.Intn(28000))
+	p := Packet{
+		Timestamp:   ts,
+		Application: app,
+		SrcCountry:  "Local",
+		DstCountry:  "Local",
+	}
+
+	if app == "DNS" {
+		domain := seedDomains[rng.Intn(len(seedDomains))]
+		p.Protocol = "UDP"
+		p.SrcIP, p.DstIP = dev.ip, seedGateway
+		p.SrcMAC, p.DstMAC = dev.mac, seedGatewayMAC
+		p.SrcPort, p.DstPort = localPort, 53
+		p.Length = 60 + len(domain)
+		p.Info = fmt.Sprintf("DNS Query: %s", domain)
+		return p
+	}
+
+	remotes := seedRemotes[app]
+	remote := remotes[rng.Intn(len(remotes))]
+	port := seedPorts[app]
+
+	p.Protocol = "TCP"
+	if app == "NTP" {
+		p.Protocol = "UDP"
+	}
+
+	// Downloads dominate: most bytes flow from the remote side in large packets
+	if rng.Float64() < 0.6 {
+		p.SrcIP, p.DstIP = remote.ip, dev.ip
+		p.SrcMAC, p.DstMAC = seedGatewayMAC, dev.mac
+		p.SrcPort, p.DstPort = port, localPort
+		p.SrcHostname, p.SrcCountry = remote.hostname, remote.country
+		p.Length = 600 + rng.Intn(915)
+	} else {
+		p.SrcIP, p.DstIP = dev.ip, remote.ip
+		p.SrcMAC, p.DstMAC = dev.mac, seedGatewayMAC
+		p.SrcPort, p.DstPort = localPort, port
+		p.DstHostname, p.DstCountry = remote.hostname, remote.country
+		p.Length = 54 + rng.Intn(300)
+	}
+
+	if p.Protocol == "TCP" {
+		p.Info = fmt.Sprintf("%d → %d [ACK ] Seq=%d Ack=%d Win=%d",
+			p.SrcPort, p.DstPort, rng.Uint32(), rng.Uint32(), 502+rng.Intn(64000))
+	} else {
+		p.Info = fmt.Sprintf("%d → %d Len=%d", p.SrcPort, p.DstPort, p.Length-28)
+	}
+
+	return p
+}
+
+// seedFlowKey groups an hour's packets between a device and a remote service into a flow
+type seedFlowKey struct {
+	device, remote string
+	protocol       string
+	port           uint16
+}
+
+// seedFlowsAndLookups derives the flows and DNS log entries that capturing packets would
+// have recorded: one flow per device and service an hour, and a lookup per DNS query
+func seedFlowsAndLookups(packets []Packet) ([]FlowRecord, []DNSLogEntry) {
+	flows := make(map[seedFlowKey]*FlowRecord)
+	order := []seedFlowKey{}
+	lookups := []DNSLogEntry{}
+	for _, p := range packets {
+		outbound := p.SrcMAC != seedGatewayMAC
+		key := seedFlowKey{p.SrcIP, p.DstIP, p.Protocol, p.DstPort}
+		localPort, hostname, country := p.SrcPort, p.DstHostname, p.DstCountry
+		if !outbound {
+			key = seedFlowKey{p.DstIP, p.SrcIP, p.Protocol, p.SrcPort}
+			localPort, hostname, country = p.DstPort, p.SrcHostname, p.SrcCountry
+		}
+		f := flows[key]
+		if f == nil {
+			f = &FlowRecord{
+				Flow: Flow{
+					SrcIP:     key.device,
+					DstIP:     key.remote,
+					SrcPort:   localPort,
+					DstPort:   key.port,
+					Protocol:  key.protocol,
+					FirstSeen: p.Timestamp,
+					LastSeen:  p.Timestamp,
+					EndReason: "idle",
+				},
+				Application: p.Application,
+				SrcCountry:  "Local",
+				DstHostname: hostname,
+				DstCountry:  country,
+			}
+			if key.protocol == "TCP" {
+				// SYN, ACK, PSH and FIN over the flow's life
+				f.TCPFlags = 0x1b
+				f.EndReason = "end"
+			}
+			flows[key] = f
+			order = append(order, key)
+		}
+		f.Packets++
+		f.Bytes += int64(p.Length)
+		if p.Timestamp.Before(f.FirstSeen) {
+			f.FirstSeen = p.Timestamp
+		}
+		if p.Timestamp.After(f.LastSeen) {
+			f.LastSeen = p.Timestamp
+		}
+
+		if domain, ok := strings.CutPrefix(p.Info, "DNS Query: "); ok {
+			lookups = append(lookups, DNSLogEntry{
+				Timestamp:    p.Timestamp.Add(time.Duration(5+len(domain)) * time.Millisecond),
+				Client:       p.SrcIP,
+				ClientMAC:    p.SrcMAC,
+				Server:       p.DstIP,
+				Domain:       domain,
+				Type:         layers.DNSTypeA.String(),
+				ResponseCode: layers.DNSResponseCodeNoErr.String(),
+				Answers:      []string{seedDomainAddress(domain)},
+			})
+		}
+	}
+
+	records := make([]FlowRecord, 0, len(order))
+	for _, key := range order {
+		records = append(records, *flows[key])
+	}
+	return records, lookups
+}
+
+// seedDomainAddress returns the address a seeded domain resolves to, the same every time
+func seedDomainAddress(domain string) string {
+	remotes := seedRemotes["HTTPS"]
+	for i, d := range seedDomains {
+		if d == domain {
+			return remotes[i%len(remotes)].ip
+		}
+	}
+	return remotes[0].ip
+}
+
+// generateSeedAlerts produces the detection alerts an hour might have raised, already
+// resolved: the odd device dropping off the network and an IoT device's regular check-ins
+// being flagged as beaconing. Alerts that wouldn't have resolved by end are left out.
+func generateSeedAlerts(rng *rand.Rand, hour, end time.Time) []Alert {
+	alerts := []Alert{}
+	add := func(name, subject, severity, message string, started time.Time, duration time.Duration) {
+		resolved := started.Add(duration)
+		if resolved.After(end) {
+			return
+		}
+		alerts = append(alerts, Alert{
+			Rule:       name,
+			Subject:    subject,
+			Severity:   severity,
+			State:      alertStateResolved,
+			Message:    message,
+			StartedAt:  started,
+			ResolvedAt: &resolved,
+		})
+	}
+
+	// About one outage every few days, from the devices most likely to drop off
+	if rng.Float64() < 0.01 {
+		dev := seedDevices[len(seedDevices)-1-rng.Intn(2)]
+		started := hour.Add(time.Duration(rng.Int63n(int64(time.Hour))))
+		add(presenceAlertName, dev.mac, severityInfo,
+			fmt.Sprintf("%s (%s) has not been seen since %s", dev.mac, dev.ip, started.Add(-5*time.Minute).Format("2006-01-02 15:04:05")),
+			started, time.Duration(20+rng.Intn(70))*time.Minute)
+	}
+	// And now and then the thermostat's cloud check-ins look like beaconing
+	if rng.Float64() < 0.005 {
+		thermostat, remote := seedDevices[6], seedRemotes["MQTT"][0]
+		add("Beaconing", fmt.Sprintf("%s → %s:%d", thermostat.ip, remote.ip, seedPorts["MQTT"]), severityWarning,
+			fmt.Sprintf("%s connects to %s (%s) port %d/TCP every 60s (±0.4s, %d connections, %s each)",
+				thermostat.ip, remote.hostname, remote.ip, seedPorts["MQTT"], 20+rng.Intn(40), formatBytes(int64(200+rng.Intn(400)))),
+			hour.Add(time.Duration(rng.Int63n(int64(time.Hour)))), detectionQuietPeriod+time.Duration(rng.Intn(30))*time.Minute)
+	}
+	return alerts
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// sessionSaveInterval is how often the running session's totals are written, bounding
+// what is lost if the process is killed without a chance to record its end
+const sessionSaveInterval = time.Minute
+
+// CaptureSession is one run of the capture, from startup to shutdown
+type CaptureSession struct {
+	ID           int64      `json:"id"`
+	Interface    string     `json:"interface"`
+	StartTime    time.Time  `json:"startTime"`
+	EndTime      *time.Time `json:"endTime,omitempty"` // Unset while running
+	TotalPackets int64      `json:"totalPackets"`
+	TotalBytes   int64      `json:"totalBytes"`
+	Active       bool       `json:"active"`
+}
+
+// SessionRecorder keeps the sessions table row for the current capture run up to date.
+// Sessions left open by a crash are closed at their last save when the next run starts.
+type SessionRecorder struct {
+	db *Database
+
+	mu      sync.Mutex
+	session CaptureSession
+}
+
+// NewSessionRecorder closes sessions left open by earlier runs and records a new one
+func NewSessionRecorder(db *Database, iface string) (*SessionRecorder, error) {
+	if err := db.CloseOpenSessions(); err != nil {
+		return nil, err
+	}
+	sr := &SessionRecorder{
+		db:      db,
+		session: CaptureSession{Interface: iface, StartTime: time.Now(), Active: true},
+	}
+	id, err := db.InsertSession(sr.session)
+	if err != nil {
+		return nil, err
+	}
+	sr.session.ID = id
+	return sr, nil
+}
+
+// Start saves the session's totals in the background
+func (sr *SessionRecorder) Start() {
+	go func() {
+		ticker := time.NewTicker(sessionSaveInterval)
+		for range ticker.C {
+			sr.save()
+		}
+	}()
+}
+
+// Observe implements PacketObserver
+func (sr *SessionRecorder) Observe(p Packet) {
+	sr.mu.Lock()
+	sr.session.TotalPackets++
+	sr.session.TotalBytes += int64(p.Length)
+	sr.mu.Unlock()
+}
+
+// Stop records the end of the session
+func (sr *SessionRecorder) Stop() {
+	now := time.Now()
+	sr.mu.Lock()
+	sr.session.EndTime = &now
+	sr.session.Active = false
+	sr.mu.Unlock()
+	sr.save()
+}
+
+// Current returns the running session
+func (sr *SessionRecorder) Current() CaptureSession {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	return sr.session
+}
+
+func (sr *SessionRecorder) save() {
+	if err := sr.db.SaveSession(sr.Current()); err != nil {
+		log.Printf("Error saving capture session: %v", err)
+	}
+}
+
+// parseHistoryRange reads the time range of a history query: start and end, narrowed
+// to the span of a capture session when session gives its ID
+func parseHistoryRange(r *http.Request, db *Database) (startTime, endTime *time.Time, err error) {
+	startTime, endTime = parseTimeRange(r)
+	s := r.URL.Query().Get("session")
+	if s == "" {
+		return startTime, endTime, nil
+	}
+	id, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid session %q", s)
+	}
+	session, err := db.GetSession(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	if session == nil {
+		return nil, nil, fmt.Errorf("unknown session %d", id)
+	}
+	if startTime == nil || startTime.Before(session.StartTime) {
+		startTime = &session.StartTime
+	}
+	if session.EndTime != nil && (endTime == nil || endTime.After(*session.EndTime)) {
+		endTime = session.EndTime
+	}
+	return startTime, endTime, nil
+}
+
+func createSessionTables(db *sql.DB) error {
+	// Migration: the sessions table predates periodic saves
+	db.Exec("ALTER TABLE sessions ADD COLUMN updated_at DATETIME")
+
+	if _, err := db.Exec("CREATE INDEX IF NOT EXISTS idx_sessions_start_time ON sessions(start_time)"); err != nil {
+		return fmt.Errorf("failed to create session schema: %v", err)
+	}
+	return nil
+}
+
+// CloseOpenSessions ends sessions that never recorded an end at the time they were last saved
+func (d *Database) CloseOpenSessions() error {
+	_, err := d.db.Exec("UPDATE sessions SET end_time = COALESCE(updated_at, start_time) WHERE end_time IS NULL")
+	return err
+}
+
+// InsertSession records a new session, returning its ID
+func (d *Database) InsertSession(s CaptureSession) (int64, error) {
+	result, err := d.db.Exec(
+		"INSERT INTO sessions (start_time, interface, total_packets, total_bytes, updated_at) VALUES (?, ?, 0, 0, ?)",
+		s.StartTime, s.Interface, s.StartTime)
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+// SaveSession writes a session's totals and end time. The row is recreated if the
+// database was cleared while the session was running.
+func (d *Database) SaveSession(s CaptureSession) error {
+	_, err := d.db.Exec(`
+		INSERT INTO sessions (id, start_time, end_time, interface, total_packets, total_bytes, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET
+			end_time = excluded.end_time,
+			total_packets = excluded.total_packets,
+			total_bytes = excluded.total_bytes,
+			updated_at = excluded.updated_at
+	`, s.ID, s.StartTime, s.EndTime, s.Interface, s.TotalPackets, s.TotalBytes, time.Now())
+	return err
+}
+
+const sessionColumns = "id, start_time, end_time, interface, total_packets, total_bytes"
+
+func scanSession(row interface{ Scan(...interface{}) error }) (CaptureSession, error) {
+	var s CaptureSession
+	var endTime sql.NullTime
+	var iface sql.NullString
+	if err := row.Scan(&s.ID, &s.StartTime, &endTime, &iface, &s.TotalPackets, &s.TotalBytes); err != nil {
+		return s, err
+	}
+	if endTime.Valid {
+		s.EndTime = &endTime.Time
+	}
+	s.Interface = iface.String
+	return s, nil
+}
+
+// ListSessions returns past and current sessions, newest first, and how many there are
+func (d *Database) ListSessions(limit, offset int) ([]CaptureSession, int, error) {
+	var total int
+	if err := d.db.QueryRow("SELECT COUNT(*) FROM sessions").Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := d.db.Query("SELECT "+sessionColumns+" FROM sessions ORDER BY start_time DESC LIMIT ? OFFSET ?", limit, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	sessions := []CaptureSession{}
+	for rows.Next() {
+		s, err := scanSession(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+		sessions = append(sessions, s)
+	}
+	return sessions, total, rows.Err()
+}
+
+// GetSession returns a session by ID, or nil if there is none
+func (d *Database) GetSession(id int64) (*CaptureSession, error) {
+	s, err := scanSession(d.db.QueryRow("SELECT "+sessionColumns+" FROM sessions WHERE id = ?", id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
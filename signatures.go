@@ -0,0 +1,876 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// signatureVars are the address and port variables community rules expect. HOME_NET
+// can be overridden; the server groups all default to it.
+var signatureVars = map[string]string{
+	"HOME_NET":        "[10.0.0.0/8,172.16.0.0/12,192.168.0.0/16,fc00::/7,fe80::/10]",
+	"EXTERNAL_NET":    "!$HOME_NET",
+	"HTTP_SERVERS":    "$HOME_NET",
+	"SMTP_SERVERS":    "$HOME_NET",
+	"SQL_SERVERS":     "$HOME_NET",
+	"DNS_SERVERS":     "$HOME_NET",
+	"TELNET_SERVERS":  "$HOME_NET",
+	"AIM_SERVERS":     "$EXTERNAL_NET",
+	"DC_SERVERS":      "$HOME_NET",
+	"HTTP_PORTS":      "[80,81,591,593,3128,8000,8008,8080,8088,8118,8888,9000,9080]",
+	"SHELLCODE_PORTS": "!80",
+	"ORACLE_PORTS":    "1521",
+	"SSH_PORTS":       "22",
+	"FTP_PORTS":       "21",
+	"DNP3_PORTS":      "20000",
+	"MODBUS_PORTS":    "502",
+	"FILE_DATA_PORTS": "[$HTTP_PORTS,110,143]",
+	"GENEVE_PORTS":    "6081",
+	"VXLAN_PORTS":     "4789",
+	"TEREDO_PORTS":    "3544",
+}
+
+// signatureProtocols maps rule protocols to the transport they run over. Application
+// protocols are matched by transport only; there is no protocol detection.
+var signatureProtocols = map[string]string{
+	"ip": "", "pkthdr": "",
+	"tcp": "TCP", "tcp-pkt": "TCP", "tcp-stream": "TCP",
+	"http": "TCP", "http1": "TCP", "http2": "TCP", "tls": "TCP", "ssh": "TCP", "ftp": "TCP",
+	"ftp-data": "TCP", "smtp": "TCP", "imap": "TCP", "smb": "TCP", "dcerpc": "TCP", "rdp": "TCP",
+	"udp": "UDP", "ntp": "UDP", "dhcp": "UDP", "snmp": "UDP", "tftp": "UDP", "krb5": "",
+	"dns": "", "sip": "",
+	"icmp": "ICMP",
+}
+
+// classtypePriority is the default priority of common Suricata/ET classtypes
+var classtypePriority = map[string]int{
+	"attempted-admin": 1, "attempted-user": 1, "shellcode-detect": 1, "successful-admin": 1,
+	"successful-user": 1, "trojan-activity": 1, "web-application-attack": 1, "command-and-control": 1,
+	"exploit-kit": 1, "targeted-activity": 1, "domain-c2": 1, "credential-theft": 1,
+	"inappropriate-content": 1, "policy-violation": 1,
+	"bad-unknown": 2, "attempted-recon": 2, "attempted-dos": 2, "misc-attack": 2,
+	"suspicious-login": 2, "suspicious-filename-detect": 2, "system-call-detect": 2,
+	"social-engineering": 2, "coin-mining": 2, "default-login-attempt": 2,
+	"successful-recon-limited": 2, "successful-recon-largescale": 2, "denial-of-service": 2,
+	"web-application-activity": 2, "unusual-client-port-connection": 2, "non-standard-protocol": 2,
+	"external-ip-check": 2, "pup-activity": 2,
+}
+
+// Options that don't affect matching, or only narrow it in ways that are safe to drop
+var signatureIgnoredOptions = map[string]bool{
+	"reference": true, "metadata": true, "gid": true, "target": true, "threshold": true,
+	"detection_filter": true, "flow": true, "fast_pattern": true, "rawbytes": true,
+	"http_uri": true, "http_raw_uri": true, "http_header": true, "http_raw_header": true,
+	"http_method": true, "http_cookie": true, "http_client_body": true, "http_server_body": true,
+	"http_stat_code": true, "http_stat_msg": true, "http_user_agent": true, "http_host": true,
+	"http_raw_host": true, "http.uri": true, "http.uri.raw": true, "http.header": true,
+	"http.header.raw": true, "http.method": true, "http.cookie": true, "http.request_body": true,
+	"http.response_body": true, "http.stat_code": true, "http.stat_msg": true,
+	"http.user_agent": true, "http.host": true, "http.host.raw": true, "http.request_line": true,
+	"http.response_line": true, "http.start": true, "http.protocol": true, "file.data": true,
+	"file_data": true,
+}
+
+// Buffers a content match can look at
+const (
+	sigBufferPayload = "payload"
+	sigBufferDNS     = "dns.query"
+	sigBufferSNI     = "tls.sni"
+)
+
+type ipMatcher func(ip net.IP) bool
+type portMatcher func(port uint16) bool
+
+// contentMatch is one content keyword with its modifiers
+type contentMatch struct {
+	pattern  []byte
+	negate   bool
+	nocase   bool
+	buffer   string
+	offset   int
+	depth    int // 0 for unbounded
+	distance int
+	within   int // 0 for unbounded
+	relative bool
+}
+
+// intMatch is a numeric comparison as used by dsize, itype and icode: N, <N, >N or N<>M
+type intMatch struct {
+	op       string
+	min, max int
+}
+
+func (m *intMatch) matches(v int) bool {
+	switch m.op {
+	case "<":
+		return v < m.min
+	case ">":
+		return v > m.min
+	case "<>":
+		return v > m.min && v < m.max
+	}
+	return v == m.min
+}
+
+// flagsMatch is a TCP flags keyword
+type flagsMatch struct {
+	want   uint8
+	ignore uint8
+	mod    byte // 0 for exact, '+' for all of these and maybe others, '*' for any of these, '!' for none of these
+}
+
+func (m *flagsMatch) matches(flags uint8) bool {
+	flags &^= m.ignore
+	switch m.mod {
+	case '+':
+		return flags&m.want == m.want
+	case '*':
+		return flags&m.want != 0
+	case '!':
+		return flags&m.want == 0
+	}
+	return flags == m.want
+}
+
+// Signature is a parsed rule
+type Signature struct {
+	SID       int    `json:"sid"`
+	Rev       int    `json:"rev"`
+	Msg       string `json:"msg"`
+	Classtype string `json:"classtype,omitempty"`
+	Priority  int    `json:"priority"`
+
+	protocol      string
+	src, dst      ipMatcher
+	srcPort       portMatcher
+	dstPort       portMatcher
+	bidirectional bool
+	contents      []contentMatch
+	flags         *flagsMatch
+	itype, icode  *intMatch
+	dsize         *intMatch
+}
+
+// SignatureHits counts how often a signature matched
+type SignatureHits struct {
+	Signature
+	Hits    int64     `json:"hits"`
+	LastHit time.Time `json:"lastHit"`
+	LastSrc string    `json:"lastSrc"`
+	LastDst string    `json:"lastDst"`
+}
+
+// splitSignatureList splits a [a,b,[c,d]] list body on top-level commas
+func splitSignatureList(s string) []string {
+	var parts []string
+	depth, start := 0, 0
+	for i, c := range s {
+		switch c {
+		case '[':
+			depth++
+		case ']':
+			depth--
+		case ',':
+			if depth == 0 {
+				parts = append(parts, strings.TrimSpace(s[start:i]))
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, strings.TrimSpace(s[start:]))
+}
+
+// parseSignatureAddress parses an address spec: any, an IP or CIDR, a $VARIABLE,
+// a [list], or any of those negated with !
+func parseSignatureAddress(s string, vars map[string]string, depth int) (ipMatcher, error) {
+	s = strings.TrimSpace(s)
+	if depth > 10 {
+		return nil, fmt.Errorf("address variables nested too deep")
+	}
+	switch {
+	case s == "any":
+		return func(net.IP) bool { return true }, nil
+	case strings.HasPrefix(s, "!"):
+		inner, err := parseSignatureAddress(s[1:], vars, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		return func(ip net.IP) bool { return !inner(ip) }, nil
+	case strings.HasPrefix(s, "$"):
+		value, ok := vars[s[1:]]
+		if !ok {
+			return nil, fmt.Errorf("unknown variable %s", s)
+		}
+		return parseSignatureAddress(value, vars, depth+1)
+	case strings.HasPrefix(s, "[") && strings.HasSuffix(s, "]"):
+		var include, exclude []ipMatcher
+		for _, part := range splitSignatureList(s[1 : len(s)-1]) {
+			negate := strings.HasPrefix(part, "!")
+			m, err := parseSignatureAddress(strings.TrimPrefix(part, "!"), vars, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			if negate {
+				exclude = append(exclude, m)
+			} else {
+				include = append(include, m)
+			}
+		}
+		return func(ip net.IP) bool {
+			for _, m := range exclude {
+				if m(ip) {
+					return false
+				}
+			}
+			if len(include) == 0 {
+				return true
+			}
+			for _, m := range include {
+				if m(ip) {
+					return true
+				}
+			}
+			return false
+		}, nil
+	}
+
+	if !strings.Contains(s, "/") {
+		if strings.Contains(s, ":") {
+			s += "/128"
+		} else {
+			s += "/32"
+		}
+	}
+	_, network, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid address %q", s)
+	}
+	return network.Contains, nil
+}
+
+// parseSignaturePort parses a port spec: any, N, N:M, N:, :M, a $VARIABLE, a [list],
+// or any of those negated with !
+func parseSignaturePort(s string, vars map[string]string, depth int) (portMatcher, error) {
+	s = strings.TrimSpace(s)
+	if depth > 10 {
+		return nil, fmt.Errorf("port variables nested too deep")
+	}
+	switch {
+	case s == "any":
+		return func(uint16) bool { return true }, nil
+	case strings.HasPrefix(s, "!"):
+		inner, err := parseSignaturePort(s[1:], vars, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		return func(p uint16) bool { return !inner(p) }, nil
+	case strings.HasPrefix(s, "$"):
+		value, ok := vars[s[1:]]
+		if !ok {
+			return nil, fmt.Errorf("unknown variable %s", s)
+		}
+		return parseSignaturePort(value, vars, depth+1)
+	case strings.HasPrefix(s, "[") && strings.HasSuffix(s, "]"):
+		var include, exclude []portMatcher
+		for _, part := range splitSignatureList(s[1 : len(s)-1]) {
+			negate := strings.HasPrefix(part, "!")
+			m, err := parseSignaturePort(strings.TrimPrefix(part, "!"), vars, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			if negate {
+				exclude = append(exclude, m)
+			} else {
+				include = append(include, m)
+			}
+		}
+		return func(p uint16) bool {
+			for _, m := range exclude {
+				if m(p) {
+					return false
+				}
+			}
+			if len(include) == 0 {
+				return true
+			}
+			for _, m := range include {
+				if m(p) {
+					return true
+				}
+			}
+			return false
+		}, nil
+	}
+
+	low, high := s, s
+	if i := strings.Index(s, ":"); i >= 0 {
+		low, high = s[:i], s[i+1:]
+		if low == "" {
+			low = "0"
+		}
+		if high == "" {
+			high = "65535"
+		}
+	}
+	lo, err1 := strconv.Atoi(low)
+	hi, err2 := strconv.Atoi(high)
+	if err1 != nil || err2 != nil || lo < 0 || hi > 65535 || lo > hi {
+		return nil, fmt.Errorf("invalid port %q", s)
+	}
+	return func(p uint16) bool { return int(p) >= lo && int(p) <= hi }, nil
+}
+
+// parseSignatureContent decodes a content string: quoted text with |hex bytes| sections
+func parseSignatureContent(s string) ([]byte, bool, error) {
+	negate := strings.HasPrefix(s, "!")
+	s = strings.TrimPrefix(s, "!")
+	if len(s) < 2 || s[0] != '"' || s[len(s)-1] != '"' {
+		return nil, false, fmt.Errorf("content must be quoted: %s", s)
+	}
+	s = s[1 : len(s)-1]
+
+	var out []byte
+	inHex := false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '|':
+			inHex = !inHex
+		case inHex:
+			if c == ' ' {
+				continue
+			}
+			if i+1 >= len(s) {
+				return nil, false, fmt.Errorf("bad hex in content")
+			}
+			b, err := hex.DecodeString(s[i : i+2])
+			if err != nil {
+				return nil, false, fmt.Errorf("bad hex in content: %v", err)
+			}
+			out = append(out, b[0])
+			i++
+		case c == '\\' && i+1 < len(s):
+			i++
+			out = append(out, s[i])
+		default:
+			out = append(out, c)
+		}
+	}
+	if inHex {
+		return nil, false, fmt.Errorf("unterminated hex in content")
+	}
+	return out, negate, nil
+}
+
+// parseIntMatch parses N, <N, >N or N<>M
+func parseIntMatch(s string) (*intMatch, error) {
+	s = strings.TrimSpace(s)
+	m := &intMatch{}
+	var err error
+	switch {
+	case strings.Contains(s, "<>"):
+		parts := strings.SplitN(s, "<>", 2)
+		m.op = "<>"
+		if m.min, err = strconv.Atoi(strings.TrimSpace(parts[0])); err == nil {
+			m.max, err = strconv.Atoi(strings.TrimSpace(parts[1]))
+		}
+	case strings.HasPrefix(s, "<"), strings.HasPrefix(s, ">"):
+		m.op = s[:1]
+		m.min, err = strconv.Atoi(strings.TrimSpace(s[1:]))
+	default:
+		m.min, err = strconv.Atoi(strings.TrimPrefix(s, "="))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid number %q", s)
+	}
+	return m, nil
+}
+
+// parseFlagsMatch parses a TCP flags keyword such as S, SA, +S, *SF or S,12
+func parseFlagsMatch(s string) (*flagsMatch, error) {
+	bits := map[byte]uint8{
+		'F': tcpFlagFIN, 'S': tcpFlagSYN, 'R': tcpFlagRST, 'P': tcpFlagPSH, 'A': tcpFlagACK,
+		'U': 0, 'C': 0, 'E': 0, '1': 0, '2': 0, '0': 0, // Not tracked
+	}
+	m := &flagsMatch{}
+	spec, mask, _ := strings.Cut(strings.TrimSpace(s), ",")
+	if spec != "" && strings.ContainsRune("+*!", rune(spec[0])) {
+		m.mod = spec[0]
+		spec = spec[1:]
+	}
+	for i := 0; i < len(spec); i++ {
+		b, ok := bits[spec[i]]
+		if !ok {
+			return nil, fmt.Errorf("unknown TCP flag %q", spec[i])
+		}
+		m.want |= b
+	}
+	for i := 0; i < len(mask); i++ {
+		m.ignore |= bits[mask[i]]
+	}
+	return m, nil
+}
+
+// splitSignatureOptions splits the option section on semicolons outside quotes
+func splitSignatureOptions(s string) []string {
+	var opts []string
+	var cur strings.Builder
+	inQuote, escaped := false, false
+	for _, c := range s {
+		switch {
+		case escaped:
+			escaped = false
+		case c == '\\':
+			escaped = true
+		case c == '"':
+			inQuote = !inQuote
+		case c == ';' && !inQuote:
+			if opt := strings.TrimSpace(cur.String()); opt != "" {
+				opts = append(opts, opt)
+			}
+			cur.Reset()
+			continue
+		}
+		cur.WriteRune(c)
+	}
+	if opt := strings.TrimSpace(cur.String()); opt != "" {
+		opts = append(opts, opt)
+	}
+	return opts
+}
+
+// errUnsupported marks rules using keywords that can't be evaluated here. Such rules
+// are skipped rather than run with the keyword ignored, which could make them misfire.
+type errUnsupported struct{ keyword string }
+
+func (e errUnsupported) Error() string {
+	return fmt.Sprintf("unsupported keyword %q", e.keyword)
+}
+
+// ParseSignature parses one rule in Suricata/Snort syntax
+func ParseSignature(line string, vars map[string]string) (*Signature, error) {
+	open := strings.Index(line, "(")
+	if open < 0 || !strings.HasSuffix(line, ")") {
+		return nil, fmt.Errorf("missing option section")
+	}
+	header := strings.Fields(line[:open])
+	if len(header) != 7 {
+		return nil, fmt.Errorf("header needs action, protocol, source, port, direction, destination and port")
+	}
+
+	switch header[0] {
+	case "alert", "drop", "reject", "rejectsrc", "rejectdst", "rejectboth":
+	default:
+		return nil, errUnsupported{header[0]}
+	}
+	protocol, ok := signatureProtocols[strings.ToLower(header[1])]
+	if !ok {
+		return nil, errUnsupported{header[1]}
+	}
+	sig := &Signature{protocol: protocol, Priority: 3}
+
+	var err error
+	if sig.src, err = parseSignatureAddress(header[2], vars, 0); err != nil {
+		return nil, err
+	}
+	if sig.srcPort, err = parseSignaturePort(header[3], vars, 0); err != nil {
+		return nil, err
+	}
+	switch header[4] {
+	case "->":
+	case "<>":
+		sig.bidirectional = true
+	default:
+		return nil, fmt.Errorf("invalid direction %q", header[4])
+	}
+	if sig.dst, err = parseSignatureAddress(header[5], vars, 0); err != nil {
+		return nil, err
+	}
+	if sig.dstPort, err = parseSignaturePort(header[6], vars, 0); err != nil {
+		return nil, err
+	}
+
+	buffer := sigBufferPayload
+	priority := 0
+	for _, opt := range splitSignatureOptions(line[open+1 : len(line)-1]) {
+		key, value, _ := strings.Cut(opt, ":")
+		key = strings.ToLower(strings.TrimSpace(key))
+		value = strings.TrimSpace(value)
+
+		var last *contentMatch
+		if len(sig.contents) > 0 {
+			last = &sig.contents[len(sig.contents)-1]
+		}
+		intValue := func() (int, error) {
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return 0, fmt.Errorf("%s needs a number: %q", key, value)
+			}
+			return n, nil
+		}
+
+		switch key {
+		case "msg":
+			sig.Msg = strings.ReplaceAll(strings.Trim(value, `"`), `\`, "")
+		case "sid":
+			if sig.SID, err = intValue(); err != nil {
+				return nil, err
+			}
+		case "rev":
+			sig.Rev, _ = intValue()
+		case "classtype":
+			sig.Classtype = value
+		case "priority":
+			if priority, err = intValue(); err != nil {
+				return nil, err
+			}
+		case "content":
+			pattern, negate, err := parseSignatureContent(value)
+			if err != nil {
+				return nil, err
+			}
+			sig.contents = append(sig.contents, contentMatch{pattern: pattern, negate: negate, buffer: buffer})
+		case "nocase", "offset", "depth", "distance", "within":
+			if last == nil {
+				return nil, fmt.Errorf("%s without a content", key)
+			}
+			if key == "nocase" {
+				last.nocase = true
+				last.pattern = bytes.ToLower(last.pattern)
+				continue
+			}
+			n, err := intValue()
+			if err != nil {
+				return nil, err
+			}
+			switch key {
+			case "offset":
+				last.offset = n
+			case "depth":
+				last.depth = n
+			case "distance":
+				last.distance, last.relative = n, true
+			case "within":
+				last.within, last.relative = n, true
+			}
+		case "dns.query", "dns_query":
+			buffer = sigBufferDNS
+		case "tls.sni", "tls_sni":
+			buffer = sigBufferSNI
+		case "pkt_data":
+			buffer = sigBufferPayload
+		case "flags":
+			if sig.flags, err = parseFlagsMatch(value); err != nil {
+				return nil, err
+			}
+		case "itype":
+			if sig.itype, err = parseIntMatch(value); err != nil {
+				return nil, err
+			}
+		case "icode":
+			if sig.icode, err = parseIntMatch(value); err != nil {
+				return nil, err
+			}
+		case "dsize":
+			if sig.dsize, err = parseIntMatch(value); err != nil {
+				return nil, err
+			}
+		default:
+			if !signatureIgnoredOptions[key] {
+				return nil, errUnsupported{key}
+			}
+		}
+	}
+
+	if sig.SID == 0 {
+		return nil, fmt.Errorf("missing sid")
+	}
+	if priority == 0 {
+		if p, ok := classtypePriority[sig.Classtype]; ok {
+			priority = p
+		}
+	}
+	if priority != 0 {
+		sig.Priority = priority
+	}
+	return sig, nil
+}
+
+// matchContents runs the content matches in order, each relative one searching after
+// the previous match in the same buffer
+func (s *Signature) matchContents(p Packet) bool {
+	var dnsQuery []byte
+	if p.dns != nil && len(p.dns.Questions) > 0 {
+		dnsQuery = p.dns.Questions[0].Name
+	}
+	buffers := map[string][]byte{
+		sigBufferPayload: p.payload,
+		sigBufferDNS:     dnsQuery,
+		sigBufferSNI:     []byte(p.sni),
+	}
+	lowered := map[string][]byte{}
+	prevEnd := map[string]int{}
+
+	for _, c := range s.contents {
+		buf := buffers[c.buffer]
+		if c.nocase {
+			if lowered[c.buffer] == nil {
+				lowered[c.buffer] = bytes.ToLower(buf)
+			}
+			buf = lowered[c.buffer]
+		}
+
+		start, end := c.offset, len(buf)
+		if c.relative {
+			start = prevEnd[c.buffer] + c.distance
+			if c.within > 0 {
+				end = prevEnd[c.buffer] + c.distance + c.within
+			}
+		} else if c.depth > 0 {
+			end = c.offset + c.depth
+		}
+		if start < 0 {
+			start = 0
+		}
+		if end > len(buf) {
+			end = len(buf)
+		}
+
+		found := -1
+		if start <= end {
+			found = bytes.Index(buf[start:end], c.pattern)
+		}
+		if c.negate {
+			if found >= 0 {
+				return false
+			}
+			continue
+		}
+		if found < 0 {
+			return false
+		}
+		prevEnd[c.buffer] = start + found + len(c.pattern)
+	}
+	return true
+}
+
+// matches evaluates the signature against a packet whose addresses are already parsed
+func (s *Signature) matches(p Packet, src, dst net.IP) bool {
+	if s.protocol != "" && s.protocol != p.Protocol {
+		return false
+	}
+	forward := s.src(src) && s.srcPort(p.SrcPort) && s.dst(dst) && s.dstPort(p.DstPort)
+	if !forward && !(s.bidirectional && s.src(dst) && s.srcPort(p.DstPort) && s.dst(src) && s.dstPort(p.SrcPort)) {
+		return false
+	}
+	if s.flags != nil && (p.Protocol != "TCP" || !s.flags.matches(p.tcpFlags)) {
+		return false
+	}
+	if s.itype != nil && (p.Protocol != "ICMP" || !s.itype.matches(int(p.icmpType))) {
+		return false
+	}
+	if s.icode != nil && (p.Protocol != "ICMP" || !s.icode.matches(int(p.icmpCode))) {
+		return false
+	}
+	if s.dsize != nil && !s.dsize.matches(len(p.payload)) {
+		return false
+	}
+	return len(s.contents) == 0 || s.matchContents(p)
+}
+
+// SignatureEngine evaluates Suricata/Snort-style rules against every captured packet
+// and raises an alert per rule and host pair when one matches. Only a subset of the
+// syntax is supported: header addresses and ports, content with nocase/offset/depth/
+// distance/within, the dns.query and tls.sni buffers, flags, itype, icode and dsize.
+// Matching is per packet; streams are not reassembled.
+type SignatureEngine struct {
+	alerts *AlertEngine
+
+	mu         sync.Mutex
+	signatures []*Signature
+	skipped    int
+	hits       map[int]*SignatureHits
+}
+
+// NewSignatureEngine creates an engine with no rules loaded
+func NewSignatureEngine(alerts *AlertEngine) *SignatureEngine {
+	return &SignatureEngine{alerts: alerts, hits: make(map[int]*SignatureHits)}
+}
+
+// signatureFiles expands paths into rule files; directories contribute their *.rules files
+func signatureFiles(paths []string) ([]string, error) {
+	var files []string
+	for _, path := range paths {
+		if path = strings.TrimSpace(path); path == "" {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			files = append(files, path)
+			continue
+		}
+		matches, err := filepath.Glob(filepath.Join(path, "*.rules"))
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, matches...)
+	}
+	return files, nil
+}
+
+// Load parses rule files (or directories of *.rules files), replacing the loaded rules.
+// Rules that fail to parse or use unsupported keywords are skipped and counted.
+func (se *SignatureEngine) Load(paths []string, homeNet string) error {
+	vars := make(map[string]string, len(signatureVars))
+	for k, v := range signatureVars {
+		vars[k] = v
+	}
+	if homeNet != "" {
+		vars["HOME_NET"] = homeNet
+	}
+
+	files, err := signatureFiles(paths)
+	if err != nil {
+		return err
+	}
+
+	var signatures []*Signature
+	skipped := 0
+	unsupported := map[string]int{}
+	for _, file := range files {
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		var rule strings.Builder
+		lineNo := 0
+		for scanner.Scan() {
+			lineNo++
+			line := strings.TrimSpace(scanner.Text())
+			if rule.Len() == 0 && (line == "" || strings.HasPrefix(line, "#")) {
+				continue
+			}
+			// A trailing backslash continues the rule on the next line
+			if strings.HasSuffix(line, `\`) {
+				rule.WriteString(strings.TrimSuffix(line, `\`))
+				continue
+			}
+			rule.WriteString(line)
+			text := rule.String()
+			rule.Reset()
+
+			sig, err := ParseSignature(text, vars)
+			if err != nil {
+				skipped++
+				if u, ok := err.(errUnsupported); ok {
+					unsupported[u.keyword]++
+				} else {
+					log.Printf("Warning: skipping rule at %s:%d: %v", file, lineNo, err)
+				}
+				continue
+			}
+			signatures = append(signatures, sig)
+		}
+		f.Close()
+		if err := scanner.Err(); err != nil {
+			return fmt.Errorf("reading %s: %v", file, err)
+		}
+	}
+
+	if len(unsupported) > 0 {
+		keywords := make([]string, 0, len(unsupported))
+		for k, n := range unsupported {
+			keywords = append(keywords, fmt.Sprintf("%s (%d)", k, n))
+		}
+		sort.Strings(keywords)
+		log.Printf("Skipped rules using unsupported keywords: %s", strings.Join(keywords, ", "))
+	}
+	log.Printf("Loaded %d signatures from %d files (%d skipped)", len(signatures), len(files), skipped)
+
+	se.mu.Lock()
+	defer se.mu.Unlock()
+	se.signatures = signatures
+	se.skipped = skipped
+	return nil
+}
+
+// Observe implements PacketObserver
+func (se *SignatureEngine) Observe(p Packet) {
+	se.mu.Lock()
+	signatures := se.signatures
+	se.mu.Unlock()
+	if len(signatures) == 0 {
+		return
+	}
+
+	src, dst := net.ParseIP(p.SrcIP), net.ParseIP(p.DstIP)
+	if src == nil || dst == nil {
+		return
+	}
+
+	for _, s := range signatures {
+		if !s.matches(p, src, dst) {
+			continue
+		}
+
+		se.mu.Lock()
+		h := se.hits[s.SID]
+		if h == nil {
+			h = &SignatureHits{Signature: *s}
+			se.hits[s.SID] = h
+		}
+		h.Hits++
+		h.LastHit = p.Timestamp
+		h.LastSrc = fmt.Sprintf("%s:%d", p.SrcIP, p.SrcPort)
+		h.LastDst = fmt.Sprintf("%s:%d", p.DstIP, p.DstPort)
+		se.mu.Unlock()
+
+		if se.alerts == nil {
+			continue
+		}
+		severity := severityInfo
+		switch s.Priority {
+		case 1:
+			severity = severityCritical
+		case 2:
+			severity = severityWarning
+		}
+		message := fmt.Sprintf("[%d:%d] %s (%s) %s %s:%d → %s:%d",
+			s.SID, s.Rev, s.Msg, s.Classtype, p.Protocol, p.SrcIP, p.SrcPort, p.DstIP, p.DstPort)
+		if process := describeProcess(p); process != "" {
+			message += ", " + process
+		}
+		se.alerts.Raise(s.Msg, fmt.Sprintf("%s → %s", p.SrcIP, p.DstIP), severity, message)
+	}
+}
+
+// Stats returns how many rules are loaded and skipped, and the rules that matched, most hits first
+func (se *SignatureEngine) Stats() (loaded, skipped int, hits []SignatureHits) {
+	se.mu.Lock()
+	defer se.mu.Unlock()
+
+	hits = make([]SignatureHits, 0, len(se.hits))
+	for _, h := range se.hits {
+		hits = append(hits, *h)
+	}
+	sort.Slice(hits, func(i, j int) bool {
+		return hits[i].Hits > hits[j].Hits
+	})
+	return len(se.signatures), se.skipped, hits
+}
@@ -0,0 +1,76 @@
+package main
+
+import "encoding/binary"
+
+// parseSNI returns the server name from a TLS ClientHello, or "" if the TCP payload
+// isn't one. Only a ClientHello that fits in the first segment is recognised, which
+// is nearly always the case.
+func parseSNI(payload []byte) string {
+	// TLS record header: handshake (22), version, length
+	if len(payload) < 5 || payload[0] != 0x16 {
+		return ""
+	}
+	b := payload[5:]
+
+	// Handshake header: ClientHello (1), 3-byte length, then client version and random
+	if len(b) < 38 || b[0] != 0x01 {
+		return ""
+	}
+	b = b[38:]
+
+	// Session ID, cipher suites, compression methods
+	skip := func(lenBytes int) bool {
+		if len(b) < lenBytes {
+			return false
+		}
+		n := 0
+		for _, c := range b[:lenBytes] {
+			n = n<<8 | int(c)
+		}
+		if len(b) < lenBytes+n {
+			return false
+		}
+		b = b[lenBytes+n:]
+		return true
+	}
+	if !skip(1) || !skip(2) || !skip(1) {
+		return ""
+	}
+
+	// Extensions
+	if len(b) < 2 {
+		return ""
+	}
+	b = b[2:]
+	for len(b) >= 4 {
+		extType := binary.BigEndian.Uint16(b)
+		extLen := int(binary.BigEndian.Uint16(b[2:]))
+		if len(b) < 4+extLen {
+			return ""
+		}
+		ext := b[4 : 4+extLen]
+		b = b[4+extLen:]
+		if extType != 0 {
+			continue
+		}
+
+		// server_name: list length, then entries of name type and length-prefixed name
+		if len(ext) < 2 {
+			return ""
+		}
+		ext = ext[2:]
+		for len(ext) >= 3 {
+			nameType := ext[0]
+			nameLen := int(binary.BigEndian.Uint16(ext[1:]))
+			if len(ext) < 3+nameLen {
+				return ""
+			}
+			if nameType == 0 {
+				return string(ext[3 : 3+nameLen])
+			}
+			ext = ext[3+nameLen:]
+		}
+		return ""
+	}
+	return ""
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// Supported speed test clients
+const (
+	speedtestOokla      = "ookla"      // Ookla's official "speedtest" CLI
+	speedtestLibrespeed = "librespeed" // librespeed-cli
+)
+
+// SpeedTestResult is one measurement of line capacity
+type SpeedTestResult struct {
+	Time         time.Time `json:"time"`
+	Tool         string    `json:"tool"`
+	DownloadMbps float64   `json:"downloadMbps"`
+	UploadMbps   float64   `json:"uploadMbps"`
+	PingMs       float64   `json:"pingMs"`
+	JitterMs     float64   `json:"jitterMs"`
+	Server       string    `json:"server"`
+	ISP          string    `json:"isp"`
+}
+
+// SpeedTester periodically runs an external speed test client and records the results
+type SpeedTester struct {
+	tool string
+	db   *Database
+
+	mu      sync.Mutex
+	running bool
+	last    *SpeedTestResult
+}
+
+// NewSpeedTester creates a speed tester using the given client
+func NewSpeedTester(tool string, db *Database) (*SpeedTester, error) {
+	binary := map[string]string{speedtestOokla: "speedtest", speedtestLibrespeed: "librespeed-cli"}[tool]
+	if binary == "" {
+		return nil, fmt.Errorf("unknown speed test client %q (expected %s or %s)", tool, speedtestOokla, speedtestLibrespeed)
+	}
+	if _, err := exec.LookPath(binary); err != nil {
+		return nil, fmt.Errorf("%s not found in PATH: %v", binary, err)
+	}
+	return &SpeedTester{tool: tool, db: db}, nil
+}
+
+// Start runs a speed test every interval
+func (st *SpeedTester) Start(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		for range ticker.C {
+			if _, err := st.Run(); err != nil {
+				log.Printf("Speed test error: %v", err)
+			}
+		}
+	}()
+}
+
+// Last returns the most recent result, if any
+func (st *SpeedTester) Last() *SpeedTestResult {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.last
+}
+
+// Run performs a speed test now. Only one test runs at a time.
+func (st *SpeedTester) Run() (*SpeedTestResult, error) {
+	st.mu.Lock()
+	if st.running {
+		st.mu.Unlock()
+		return nil, fmt.Errorf("speed test already running")
+	}
+	st.running = true
+	st.mu.Unlock()
+
+	defer func() {
+		st.mu.Lock()
+		st.running = false
+		st.mu.Unlock()
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Minute)
+	defer cancel()
+
+	var cmd *exec.Cmd
+	if st.tool == speedtestOokla {
+		cmd = exec.CommandContext(ctx, "speedtest", "--format=json", "--accept-license", "--accept-gdpr")
+	} else {
+		cmd = exec.CommandContext(ctx, "librespeed-cli", "--json")
+	}
+
+	log.Printf("Running %s speed test", st.tool)
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%s failed: %v", st.tool, err)
+	}
+
+	var result *SpeedTestResult
+	if st.tool == speedtestOokla {
+		result, err = parseOoklaResult(out)
+	} else {
+		result, err = parseLibrespeedResult(out)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("Speed test: %.1f Mbps down, %.1f Mbps up, %.1f ms ping (%s)",
+		result.DownloadMbps, result.UploadMbps, result.PingMs, result.Server)
+
+	st.mu.Lock()
+	st.last = result
+	st.mu.Unlock()
+
+	if st.db != nil {
+		if err := st.db.InsertSpeedTest(result); err != nil {
+			log.Printf("Database speed test insert error: %v", err)
+		}
+	}
+
+	return result, nil
+}
+
+// parseOoklaResult parses `speedtest --format=json`, which reports bandwidth in bytes/sec
+func parseOoklaResult(out []byte) (*SpeedTestResult, error) {
+	var r struct {
+		Timestamp time.Time `json:"timestamp"`
+		Ping      struct {
+			Jitter  float64 `json:"jitter"`
+			Latency float64 `json:"latency"`
+		} `json:"ping"`
+		Download struct {
+			Bandwidth float64 `json:"bandwidth"`
+		} `json:"download"`
+		Upload struct {
+			Bandwidth float64 `json:"bandwidth"`
+		} `json:"upload"`
+		ISP    string `json:"isp"`
+		Server struct {
+			Name     string `json:"name"`
+			Location string `json:"location"`
+		} `json:"server"`
+	}
+	if err := json.Unmarshal(out, &r); err != nil {
+		return nil, fmt.Errorf("parsing speedtest output: %v", err)
+	}
+
+	return &SpeedTestResult{
+		Time:         time.Now(),
+		Tool:         speedtestOokla,
+		DownloadMbps: r.Download.Bandwidth * 8 / 1e6,
+		UploadMbps:   r.Upload.Bandwidth * 8 / 1e6,
+		PingMs:       r.Ping.Latency,
+		JitterMs:     r.Ping.Jitter,
+		Server:       fmt.Sprintf("%s (%s)", r.Server.Name, r.Server.Location),
+		ISP:          r.ISP,
+	}, nil
+}
+
+// parseLibrespeedResult parses `librespeed-cli --json`, which reports Mbps
+func parseLibrespeedResult(out []byte) (*SpeedTestResult, error) {
+	var results []struct {
+		Server struct {
+			Name string `json:"name"`
+		} `json:"server"`
+		Client struct {
+			ISP string `json:"isp"`
+		} `json:"client"`
+		Ping     float64 `json:"ping"`
+		Jitter   float64 `json:"jitter"`
+		Download float64 `json:"download"`
+		Upload   float64 `json:"upload"`
+	}
+	if err := json.Unmarshal(out, &results); err != nil {
+		return nil, fmt.Errorf("parsing librespeed-cli output: %v", err)
+	}
+	if len(results) == 0 {
+		return nil, fmt.Errorf("librespeed-cli returned no results")
+	}
+
+	r := results[0]
+	return &SpeedTestResult{
+		Time:         time.Now(),
+		Tool:         speedtestLibrespeed,
+		DownloadMbps: r.Download,
+		UploadMbps:   r.Upload,
+		PingMs:       r.Ping,
+		JitterMs:     r.Jitter,
+		Server:       r.Server.Name,
+		ISP:          r.Client.ISP,
+	}, nil
+}
+
+func createSpeedTestTables(db *sql.DB) error {
+	schema := `
+	CREATE TABLE IF NOT EXISTS speedtests (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		timestamp INTEGER NOT NULL,
+		tool TEXT,
+		download_mbps REAL,
+		upload_mbps REAL,
+		ping_ms REAL,
+		jitter_ms REAL,
+		server TEXT,
+		isp TEXT
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_speedtests_timestamp ON speedtests(timestamp);
+	`
+
+	if _, err := db.Exec(schema); err != nil {
+		return fmt.Errorf("failed to create speed test schema: %v", err)
+	}
+	return nil
+}
+
+// InsertSpeedTest stores a speed test result
+func (d *Database) InsertSpeedTest(r *SpeedTestResult) error {
+	_, err := d.db.Exec(`
+		INSERT INTO speedtests (timestamp, tool, download_mbps, upload_mbps, ping_ms, jitter_ms, server, isp)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	`, r.Time.Unix(), r.Tool, r.DownloadMbps, r.UploadMbps, r.PingMs, r.JitterMs, r.Server, r.ISP)
+	return err
+}
+
+// GetSpeedTests returns stored results in the given time range, oldest first
+func (d *Database) GetSpeedTests(startTime, endTime *time.Time) ([]SpeedTestResult, error) {
+	query := "SELECT timestamp, tool, download_mbps, upload_mbps, ping_ms, jitter_ms, server, isp FROM speedtests WHERE 1=1"
+	args := []interface{}{}
+	if startTime != nil {
+		query += " AND timestamp >= ?"
+		args = append(args, startTime.Unix())
+	}
+	if endTime != nil {
+		query += " AND timestamp <= ?"
+		args = append(args, endTime.Unix())
+	}
+	query += " ORDER BY timestamp"
+
+	rows, err := d.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := []SpeedTestResult{}
+	for rows.Next() {
+		var r SpeedTestResult
+		var ts int64
+		var server, isp sql.NullString
+		if err := rows.Scan(&ts, &r.Tool, &r.DownloadMbps, &r.UploadMbps, &r.PingMs, &r.JitterMs, &server, &isp); err != nil {
+			return nil, err
+		}
+		r.Time = time.Unix(ts, 0)
+		r.Server = server.String
+		r.ISP = isp.String
+		results = append(results, r)
+	}
+	return results, rows.Err()
+}
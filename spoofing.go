@@ -0,0 +1,270 @@
+package main
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Why a source address is reported
+const (
+	spoofReasonBogon    = "bogon"             // Reserved or unallocated, so it shouldn't be on any network
+	spoofReasonInternal = "internal-from-wan" // An internal address arriving from the internet side
+)
+
+// Spoofed source settings
+const (
+	spoofMaxSources   = 1000 // Sources beyond this are counted but not listed
+	fullBogonsV4URL   = "https://www.team-cymru.org/Services/Bogons/fullbogons-ipv4.txt"
+	fullBogonsV6URL   = "https://www.team-cymru.org/Services/Bogons/fullbogons-ipv6.txt"
+	fullBogonsRefresh = 24 * time.Hour
+	fullBogonsRetry   = 15 * time.Minute
+)
+
+// martianRanges are reserved for documentation, benchmarking, multicast or the future,
+// and never a valid source. Internal, link-local and shared (CGNAT, Tailscale) ranges are
+// judged separately.
+var martianRanges = []string{
+	"0.0.0.0/8", "127.0.0.0/8", "192.0.0.0/24", "192.0.2.0/24", "198.18.0.0/15",
+	"198.51.100.0/24", "203.0.113.0/24", "224.0.0.0/4", "240.0.0.0/4",
+	"::1/128", "100::/64", "2001:db8::/32", "ff00::/8",
+}
+
+// internalRanges are the prefixes LAN addresses come from, which the internet side
+// should never send
+var internalRanges = []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "fc00::/7"}
+
+// spoofIgnoredRanges are neither: link-local addresses, and the shared space carrier-grade
+// NAT and Tailscale use on both sides
+var spoofIgnoredRanges = []string{"169.254.0.0/16", "100.64.0.0/10", "fe80::/10"}
+
+// SpoofedSource is traffic from one suspicious source address
+type SpoofedSource struct {
+	Reason    string    `json:"reason"`
+	SrcIP     string    `json:"srcIp"`
+	SrcMAC    string    `json:"srcMac"`
+	Interface string    `json:"interface,omitempty"`
+	DstIP     string    `json:"dstIp"` // Last destination seen
+	Protocol  string    `json:"protocol"`
+	Packets   int64     `json:"packets"`
+	Bytes     int64     `json:"bytes"`
+	FirstSeen time.Time `json:"firstSeen"`
+	LastSeen  time.Time `json:"lastSeen"`
+}
+
+// spoofTable classifies source addresses, remembering each since packets keep coming
+// from the same ones
+type spoofTable struct {
+	bogons *cloudTable
+	kinds  sync.Map // Address -> reason it could be reported for, "" for none
+}
+
+// SpoofDetector reports packets whose source is a bogon, or an internal address that
+// arrived from the WAN side, pointing at spoofing or misrouting. The WAN side is the
+// -wan-interfaces, or the gateway's MAC address: given with -gateway-macs, or without
+// either learned from the packets the default gateway sends from its own address, which
+// are never reported.
+// With full bogons on, Team Cymru's list of unallocated ranges is downloaded daily on top
+// of the reserved ones.
+type SpoofDetector struct {
+	wanInterfaces map[string]bool
+	gatewayIP     string
+	learnGateway  bool // Without -wan-interfaces or -gateway-macs
+	fullBogons    bool
+	client        *http.Client
+
+	table atomic.Pointer[spoofTable]
+
+	mu          sync.Mutex
+	gatewayMACs map[string]bool
+	sources     map[string]*SpoofedSource // Keyed by reason and address
+	dropped     int64
+	bogonStatus *RangeListStatus
+}
+
+// NewSpoofDetector creates a detector. wanInterfaces and gatewayMACs are comma-separated.
+func NewSpoofDetector(wanInterfaces, gatewayMACs string, fullBogons bool) *SpoofDetector {
+	d := &SpoofDetector{
+		wanInterfaces: make(map[string]bool),
+		fullBogons:    fullBogons,
+		client:        &http.Client{Timeout: 60 * time.Second},
+		gatewayMACs:   make(map[string]bool),
+		sources:       make(map[string]*SpoofedSource),
+	}
+	for _, iface := range strings.Split(wanInterfaces, ",") {
+		if iface = strings.TrimSpace(iface); iface != "" {
+			d.wanInterfaces[iface] = true
+		}
+	}
+	for _, mac := range strings.Split(gatewayMACs, ",") {
+		if mac = strings.ToLower(strings.TrimSpace(mac)); mac != "" {
+			d.gatewayMACs[mac] = true
+		}
+	}
+	if gw := defaultGateway(); gw != nil {
+		d.gatewayIP = gw.String()
+	}
+	d.learnGateway = len(d.wanInterfaces) == 0 && len(d.gatewayMACs) == 0
+	d.setBogons(nil)
+	return d
+}
+
+// Start downloads the full bogon list in the background, when enabled
+func (d *SpoofDetector) Start() {
+	if !d.fullBogons {
+		return
+	}
+	d.bogonStatus = &RangeListStatus{}
+	go func() {
+		for {
+			wait := fullBogonsRefresh
+			var prefixes []cloudPrefix
+			var err error
+			for _, url := range []string{fullBogonsV4URL, fullBogonsV6URL} {
+				var list []cloudPrefix
+				if list, err = downloadRangeList(d.client, url, parseAddressList); err != nil {
+					break
+				}
+				prefixes = append(prefixes, list...)
+			}
+
+			d.mu.Lock()
+			if err != nil {
+				d.bogonStatus.Error = err.Error()
+				wait = fullBogonsRetry
+			} else {
+				now := time.Now()
+				d.bogonStatus.Prefixes, d.bogonStatus.UpdatedAt, d.bogonStatus.Error = len(prefixes), &now, ""
+			}
+			d.mu.Unlock()
+			if err != nil {
+				log.Printf("Warning: failed to download the full bogon list: %v", err)
+			} else {
+				d.setBogons(prefixes)
+			}
+			time.Sleep(wait)
+		}
+	}()
+}
+
+// setBogons rebuilds the table from the reserved ranges and a downloaded list
+func (d *SpoofDetector) setBogons(downloaded []cloudPrefix) {
+	t := &spoofTable{bogons: &cloudTable{}}
+	for _, cidr := range martianRanges {
+		t.bogons.add(spoofReasonBogon, cloudPrefix{cidr: cidr})
+	}
+	for _, p := range downloaded {
+		t.bogons.add(spoofReasonBogon, p)
+	}
+	t.bogons.finish()
+	d.table.Store(t)
+}
+
+// classify returns what a source address could be reported for
+func (d *SpoofDetector) classify(ip string) string {
+	t := d.table.Load()
+	if kind, ok := t.kinds.Load(ip); ok {
+		return kind.(string)
+	}
+	kind := ""
+	parsed := net.ParseIP(ip)
+	switch {
+	case parsed == nil || parsed.IsUnspecified():
+		// DHCP discovers and duplicate address detection send from 0.0.0.0 and ::
+	case ipInRanges(parsed, spoofIgnoredRanges):
+	case ipInRanges(parsed, internalRanges):
+		kind = spoofReasonInternal
+	case t.bogons.lookup(parsed) != nil:
+		kind = spoofReasonBogon
+	}
+	t.kinds.Store(ip, kind)
+	return kind
+}
+
+// ipInRanges reports whether an address is within any of the CIDRs
+func ipInRanges(ip net.IP, ranges []string) bool {
+	for _, cidr := range ranges {
+		if _, network, err := net.ParseCIDR(cidr); err == nil && network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Observe implements PacketObserver
+func (d *SpoofDetector) Observe(p Packet) {
+	if p.SrcIP == "" {
+		return
+	}
+	reason := d.classify(p.SrcIP)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.learnGateway && p.SrcIP == d.gatewayIP && p.SrcMAC != "" && !d.gatewayMACs[p.SrcMAC] {
+		d.gatewayMACs[p.SrcMAC] = true
+	}
+	switch reason {
+	case "":
+		return
+	case spoofReasonInternal:
+		wan := d.wanInterfaces[p.Interface] || (d.gatewayMACs[p.SrcMAC] && p.SrcIP != d.gatewayIP)
+		if !wan {
+			return
+		}
+	}
+
+	key := reason + "|" + p.SrcIP
+	s := d.sources[key]
+	if s == nil {
+		if len(d.sources) >= spoofMaxSources {
+			d.dropped++
+			return
+		}
+		s = &SpoofedSource{Reason: reason, SrcIP: p.SrcIP, FirstSeen: p.Timestamp}
+		d.sources[key] = s
+	}
+	s.SrcMAC, s.Interface = p.SrcMAC, p.Interface
+	s.DstIP, s.Protocol = p.DstIP, p.Protocol
+	s.Packets++
+	s.Bytes += int64(p.Length)
+	s.LastSeen = p.Timestamp
+}
+
+// SpoofReport is what GET /api/spoofing returns
+type SpoofReport struct {
+	Sources     []SpoofedSource  `json:"sources"`
+	Dropped     int64            `json:"dropped"` // Packets from sources beyond the listed ones
+	GatewayMACs []string         `json:"gatewayMacs"`
+	FullBogons  *RangeListStatus `json:"fullBogons,omitempty"`
+}
+
+// Report returns the suspicious sources since startup, most packets first, optionally
+// only those reported for one reason
+func (d *SpoofDetector) Report(reason string) SpoofReport {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	r := SpoofReport{Sources: []SpoofedSource{}, Dropped: d.dropped, GatewayMACs: []string{}}
+	for _, s := range d.sources {
+		if reason == "" || s.Reason == reason {
+			r.Sources = append(r.Sources, *s)
+		}
+	}
+	sort.Slice(r.Sources, func(i, j int) bool {
+		return r.Sources[i].Packets > r.Sources[j].Packets
+	})
+	for mac := range d.gatewayMACs {
+		r.GatewayMACs = append(r.GatewayMACs, mac)
+	}
+	sort.Strings(r.GatewayMACs)
+	if d.bogonStatus != nil {
+		status := *d.bogonStatus
+		r.FullBogons = &status
+	}
+	return r
+}
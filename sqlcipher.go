@@ -0,0 +1,73 @@
+//go:build sqlcipher
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// Encrypted databases are opened through SQLCipher, linked in by building with -tags sqlcipher
+
+// errNoSQLCipher is returned when the binary was linked against plain SQLite
+var errNoSQLCipher = errors.New("SQLCipher is not linked in; see the README for building with encryption")
+
+// sqlcipherConnector opens connections to one database through a keyed driver
+type sqlcipherConnector struct {
+	path   string
+	driver *sqlite3.SQLiteDriver
+}
+
+func (c sqlcipherConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	return c.driver.Open(c.path)
+}
+
+func (c sqlcipherConnector) Driver() driver.Driver {
+	return c.driver
+}
+
+// openEncrypted opens a SQLCipher database, unlocking every new connection with key and
+// then running the given pragmas on it
+func openEncrypted(path, key string, pragmas []string) (*sql.DB, error) {
+	drv := &sqlite3.SQLiteDriver{
+		ConnectHook: func(c *sqlite3.SQLiteConn) error {
+			if _, err := c.Exec("PRAGMA key = '"+strings.ReplaceAll(key, "'", "''")+"'", nil); err != nil {
+				return err
+			}
+			// Plain SQLite ignores the key, which would leave the file unencrypted
+			rows, err := c.Query("PRAGMA cipher_version", nil)
+			if err != nil {
+				return err
+			}
+			hasCipher := rows.Next(make([]driver.Value, 1)) == nil
+			rows.Close()
+			if !hasCipher {
+				return errNoSQLCipher
+			}
+			for _, p := range pragmas {
+				if _, err := c.Exec("PRAGMA "+p, nil); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	}
+	db := sql.OpenDB(sqlcipherConnector{path: path, driver: drv})
+
+	// A wrong key only shows when the file is first read
+	var tables int
+	if err := db.QueryRow("SELECT COUNT(*) FROM sqlite_master").Scan(&tables); err != nil {
+		db.Close()
+		if errors.Is(err, errNoSQLCipher) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("cannot read %s with this key (wrong key, or not an encrypted database): %v", path, err)
+	}
+	return db, nil
+}
@@ -0,0 +1,14 @@
+//go:build !sqlcipher
+
+package main
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// Encrypted databases need SQLCipher, which normal builds leave out
+
+func openEncrypted(path, key string, pragmas []string) (*sql.DB, error) {
+	return nil, fmt.Errorf("this build cannot open encrypted databases; rebuild with make build-sqlcipher")
+}
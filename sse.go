@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// sseKeepalive is how often an idle event stream gets a comment line, so proxies that
+// time out quiet connections leave it open
+const sseKeepalive = 30 * time.Second
+
+// serveEvents streams the WebSocket messages as Server-Sent Events, for clients behind
+// proxies that break WebSockets and for curl. Each event's data is the same JSON
+// message a WebSocket client gets, starting with init. ?channels=stats,alerts subscribes
+// to those channels only, ?types=packet,alert limits the stream to those message types,
+// ?logs=warn subscribes to log lines at that level, ?rate=20 sends at most 20 packets a
+// second, ?follow= only the packets of one connection and ?q= only those matching a
+// display filter.
+func serveEvents(store *PacketStore, w http.ResponseWriter, r *http.Request, init []byte) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	// Each write gets its own deadline instead of the server's, so a client that stops
+	// reading is dropped rather than blocking the stream forever
+	rc := http.NewResponseController(w)
+	rc.SetWriteDeadline(time.Now().Add(wsWriteWait))
+
+	client, err := newWSClient(store, nil, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	filter, err := parseDisplayFilterParam(r.URL.Query(), false)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	client.filter.Store(filter)
+	if types := r.URL.Query().Get("types"); types != "" {
+		client.types = make(map[string]bool)
+		for _, t := range strings.Split(types, ",") {
+			client.types[strings.TrimSpace(t)] = true
+		}
+	}
+	if level := r.URL.Query().Get("logs"); level != "" {
+		if !client.logsOK {
+			http.Error(w, errLogsScope.Error(), http.StatusForbidden)
+			return
+		}
+		client.logLevel.Store(parseLogLevel(level))
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no") // Stop nginx buffering the stream
+
+	store.clientsMu.Lock()
+	store.clients[client] = true
+	store.clientsMu.Unlock()
+	defer func() {
+		store.clientsMu.Lock()
+		delete(store.clients, client)
+		store.clientsMu.Unlock()
+	}()
+
+	// EventSource reconnects after the retry delay if the stream drops
+	fmt.Fprint(w, "retry: 3000\n\n")
+	if client.types == nil || client.types["init"] {
+		fmt.Fprintf(w, "data: %s\n\n", init)
+	}
+	flusher.Flush()
+
+	keepalive := time.NewTicker(sseKeepalive)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-client.evicted:
+			rc.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			msg, _ := json.Marshal(map[string]interface{}{"type": "evicted", "data": map[string]string{"reason": client.reason}})
+			fmt.Fprintf(w, "data: %s\n\n", msg)
+			flusher.Flush()
+			log.Printf("Disconnected slow event stream client %s: %s", client.remote, client.reason)
+			return
+		case msg := <-client.notices:
+			rc.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if _, err := fmt.Fprintf(w, "data: %s\n\n", msg); err != nil {
+				return
+			}
+			flusher.Flush()
+		case msg := <-client.send:
+			chaosSlowClient()
+			rc.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			// Messages are single-line JSON, so each fits in one data field
+			if _, err := fmt.Fprintf(w, "data: %s\n\n", msg); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-keepalive.C:
+			rc.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import "reflect"
+
+// statsTalkersEvery is how many stats intervals pass between recalculations of the top
+// talkers and country stats when only delta clients need them
+const statsTalkersEvery = 5
+
+// statsBroadcaster sends stats to live clients each interval: the full Stats object to
+// clients that want it, and to those that connected with ?stats=delta a statsDelta
+// message holding only what changed since the previous one
+type statsBroadcaster struct {
+	store *PacketStore
+	last  Stats // What the previous delta was taken against
+	ticks int
+}
+
+// tick sends one interval's stats
+func (b *statsBroadcaster) tick() {
+	full, deltas := b.store.statsListeners()
+	if !full && !deltas {
+		return
+	}
+
+	withTalkers := full || b.ticks%statsTalkersEvery == 0 || b.last.TopTalkers == nil
+	b.ticks++
+	stats := b.store.statsSnapshot(withTalkers)
+	if !withTalkers {
+		stats.TopTalkers, stats.CountryStats = b.last.TopTalkers, b.last.CountryStats
+	}
+
+	if full {
+		b.store.Broadcast("stats", stats)
+	}
+	if deltas {
+		if delta := statsDelta(b.last, stats); len(delta) > 0 {
+			b.store.Broadcast("statsDelta", delta)
+		}
+	}
+	b.last = stats
+}
+
+// statsListeners reports whether any client wants full stats, and any wants deltas
+func (ps *PacketStore) statsListeners() (full, deltas bool) {
+	ps.clientsMu.RLock()
+	defer ps.clientsMu.RUnlock()
+	for c := range ps.clients {
+		if c.channels.Load()&channelStats == 0 {
+			continue
+		}
+		if c.statsDeltas {
+			deltas = true
+		} else {
+			full = true
+		}
+	}
+	return full, deltas
+}
+
+// statsDelta returns the fields of next that differ from prev, under their JSON names.
+// Counters carry their new value rather than the change, and maps only the keys whose
+// value changed; topTalkers is sent whole when any of it changed. After the stats are
+// cleared it is the full object with "full": true, since keys have gone.
+func statsDelta(prev, next Stats) map[string]interface{} {
+	delta := make(map[string]interface{})
+	if !prev.StartTime.Equal(next.StartTime) {
+		delta["full"] = true
+		delta["totalPackets"] = next.TotalPackets
+		delta["totalBytes"] = next.TotalBytes
+		delta["packetsPerSec"] = next.PacketsPerSec
+		delta["bytesPerSec"] = next.BytesPerSec
+		delta["protocolStats"] = next.ProtocolStats
+		delta["countryStats"] = next.CountryStats
+		delta["topTalkers"] = next.TopTalkers
+		delta["applicationStats"] = next.ApplicationStats
+		delta["processStats"] = next.ProcessStats
+		delta["userStats"] = next.UserStats
+		delta["unitStats"] = next.UnitStats
+		delta["startTime"] = next.StartTime
+		return delta
+	}
+
+	if next.TotalPackets != prev.TotalPackets {
+		delta["totalPackets"] = next.TotalPackets
+	}
+	if next.TotalBytes != prev.TotalBytes {
+		delta["totalBytes"] = next.TotalBytes
+	}
+	if next.PacketsPerSec != prev.PacketsPerSec {
+		delta["packetsPerSec"] = next.PacketsPerSec
+	}
+	if next.BytesPerSec != prev.BytesPerSec {
+		delta["bytesPerSec"] = next.BytesPerSec
+	}
+	for name, maps := range map[string][2]map[string]int64{
+		"protocolStats":    {prev.ProtocolStats, next.ProtocolStats},
+		"countryStats":     {prev.CountryStats, next.CountryStats},
+		"applicationStats": {prev.ApplicationStats, next.ApplicationStats},
+		"processStats":     {prev.ProcessStats, next.ProcessStats},
+		"userStats":        {prev.UserStats, next.UserStats},
+		"unitStats":        {prev.UnitStats, next.UnitStats},
+	} {
+		changed := make(map[string]int64)
+		for k, v := range maps[1] {
+			if old, ok := maps[0][k]; !ok || old != v {
+				changed[k] = v
+			}
+		}
+		if len(changed) > 0 {
+			delta[name] = changed
+		}
+	}
+	if !reflect.DeepEqual(prev.TopTalkers, next.TopTalkers) {
+		delta["topTalkers"] = next.TopTalkers
+	}
+	return delta
+}
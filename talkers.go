@@ -0,0 +1,304 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// TalkerQuery selects how top talkers are ranked
+type TalkerQuery struct {
+	Top       int    // Number of talkers to return
+	By        string // "bytes" or "packets"
+	Direction string // "out" (sent), "in" (received) or "both"
+}
+
+// parseTalkerQuery reads top, by and direction from the request, applying defaults
+func parseTalkerQuery(r *http.Request) (TalkerQuery, error) {
+	q := TalkerQuery{Top: 10, By: "bytes", Direction: "out"}
+
+	if v := r.URL.Query().Get("top"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return q, fmt.Errorf("invalid top %q", v)
+		}
+		if n > 1000 {
+			n = 1000
+		}
+		q.Top = n
+	}
+
+	if v := r.URL.Query().Get("by"); v != "" {
+		if v != "bytes" && v != "packets" {
+			return q, fmt.Errorf("invalid by %q (expected bytes or packets)", v)
+		}
+		q.By = v
+	}
+
+	if v := r.URL.Query().Get("direction"); v != "" {
+		if v != "in" && v != "out" && v != "both" {
+			return q, fmt.Errorf("invalid direction %q (expected in, out or both)", v)
+		}
+		q.Direction = v
+	}
+
+	return q, nil
+}
+
+// sortTalkers orders talkers by the query's sort key and truncates to the requested size
+func sortTalkers(talkers []Talker, q TalkerQuery) []Talker {
+	sort.Slice(talkers, func(i, j int) bool {
+		if q.By == "packets" {
+			return talkers[i].Packets > talkers[j].Packets
+		}
+		return talkers[i].Bytes > talkers[j].Bytes
+	})
+
+	if len(talkers) > q.Top {
+		talkers = talkers[:q.Top]
+	}
+	return talkers
+}
+
+// GetTalkers returns the live top talkers for the given query
+func (ps *PacketStore) GetTalkers(q TalkerQuery) []Talker {
+	ps.mu.RLock()
+	talkers := make([]Talker, 0, len(ps.ipStats))
+	for ip, stats := range ps.ipStats {
+		t := Talker{IP: ip}
+		switch q.Direction {
+		case "out":
+			t.Packets, t.Bytes = stats.packets, stats.bytes
+		case "in":
+			t.Packets, t.Bytes = stats.inPackets, stats.inBytes
+		default:
+			t.Packets, t.Bytes = stats.packets+stats.inPackets, stats.bytes+stats.inBytes
+		}
+		if t.Packets > 0 {
+			talkers = append(talkers, t)
+		}
+	}
+	ps.mu.RUnlock()
+
+	talkers = sortTalkers(talkers, q)
+
+	// Enrich only the talkers actually returned
+	for i := range talkers {
+		info := getIPInfo(talkers[i].IP)
+		if info.Hostname == "" && info.Country == "" {
+			go resolveIPInfo(talkers[i].IP)
+		}
+		talkers[i].setIPInfo(info)
+	}
+
+	return talkers
+}
+
+// GetTalkers returns historical top talkers for the given query and time range
+func (d *Database) GetTalkers(q TalkerQuery, startTime, endTime *time.Time) ([]Talker, error) {
+	where := ""
+	args := []interface{}{}
+	if startTime != nil {
+		where += " AND timestamp >= ?"
+		args = append(args, startTime)
+	}
+	if endTime != nil {
+		where += " AND timestamp <= ?"
+		args = append(args, endTime)
+	}
+
+	outSide := "SELECT src_ip AS ip, length FROM packets WHERE src_ip != ''" + where
+	inSide := "SELECT dst_ip AS ip, length FROM packets WHERE dst_ip != ''" + where
+
+	var source string
+	switch q.Direction {
+	case "out":
+		source = outSide
+	case "in":
+		source = inSide
+	default:
+		source = outSide + " UNION ALL " + inSide
+		args = append(args, args...)
+	}
+
+	orderBy := "bytes"
+	if q.By == "packets" {
+		orderBy = "pkts"
+	}
+
+	query := "SELECT ip, SUM(length) AS bytes, COUNT(*) AS pkts FROM (" + source + ") GROUP BY ip ORDER BY " + orderBy + " DESC LIMIT ?"
+	args = append(args, q.Top)
+
+	db, release, err := d.packetsBetween(startTime, endTime)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	talkers := []Talker{}
+	for rows.Next() {
+		var t Talker
+		if err := rows.Scan(&t.IP, &t.Bytes, &t.Packets); err != nil {
+			return nil, err
+		}
+		t.setIPInfo(getIPInfo(t.IP))
+		talkers = append(talkers, t)
+	}
+
+	return talkers, rows.Err()
+}
+
+// IPStats is the all-time traffic of one IP from the ip_stats table
+type IPStats struct {
+	Talker
+	PacketsSent     int64     `json:"packetsSent"`
+	BytesSent       int64     `json:"bytesSent"`
+	PacketsReceived int64     `json:"packetsReceived"`
+	BytesReceived   int64     `json:"bytesReceived"`
+	FirstSeen       time.Time `json:"firstSeen"`
+	LastSeen        time.Time `json:"lastSeen"`
+}
+
+// ipStatsCounts accumulates one IP's traffic within a batch
+type ipStatsCounts struct {
+	hostname, country              string
+	sentPackets, sentBytes         int64
+	receivedPackets, receivedBytes int64
+	firstSeen, lastSeen            time.Time
+}
+
+// updateIPStats adds a batch of packets to the per-IP running totals
+func updateIPStats(tx *sql.Tx, packets []Packet) error {
+	stmt, err := tx.Prepare(`
+		INSERT INTO ip_stats (ip, hostname, country, total_packets, total_bytes, packets_sent, bytes_sent, first_seen, last_seen)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (ip) DO UPDATE SET
+			hostname = COALESCE(NULLIF(excluded.hostname, ''), hostname),
+			country = COALESCE(NULLIF(excluded.country, ''), country),
+			total_packets = total_packets + excluded.total_packets,
+			total_bytes = total_bytes + excluded.total_bytes,
+			packets_sent = packets_sent + excluded.packets_sent,
+			bytes_sent = bytes_sent + excluded.bytes_sent,
+			first_seen = COALESCE(first_seen, excluded.first_seen),
+			last_seen = excluded.last_seen
+	`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	counts := make(map[string]*ipStatsCounts)
+	add := func(ip, hostname, country string, t time.Time, length int64, sent bool) {
+		if ip == "" {
+			return
+		}
+		c := counts[ip]
+		if c == nil {
+			c = &ipStatsCounts{firstSeen: t}
+			counts[ip] = c
+		}
+		if hostname != "" {
+			c.hostname = hostname
+		}
+		if country != "" {
+			c.country = country
+		}
+		if sent {
+			c.sentPackets++
+			c.sentBytes += length
+		} else {
+			c.receivedPackets++
+			c.receivedBytes += length
+		}
+		if t.Before(c.firstSeen) {
+			c.firstSeen = t
+		}
+		if t.After(c.lastSeen) {
+			c.lastSeen = t
+		}
+	}
+	for _, p := range packets {
+		add(p.SrcIP, p.SrcHostname, p.SrcCountry, p.Timestamp, int64(p.Length), true)
+		add(p.DstIP, p.DstHostname, p.DstCountry, p.Timestamp, int64(p.Length), false)
+	}
+
+	for ip, c := range counts {
+		// Packets are stored before their lookups finish, so fall back to what's known now
+		info := getIPInfo(ip)
+		if c.hostname == "" {
+			c.hostname = info.Hostname
+		}
+		if c.country == "" {
+			c.country = info.Country
+		}
+		_, err := stmt.Exec(ip, c.hostname, c.country,
+			c.sentPackets+c.receivedPackets, c.sentBytes+c.receivedBytes, c.sentPackets, c.sentBytes,
+			c.firstSeen, c.lastSeen)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetIPStats returns the all-time top talkers from the ip_stats table, which is kept up
+// to date as packets are stored so nothing has to be aggregated at query time
+func (d *Database) GetIPStats(q TalkerQuery) ([]IPStats, error) {
+	packets, bytes := "total_packets", "total_bytes"
+	switch q.Direction {
+	case "out":
+		packets, bytes = "packets_sent", "bytes_sent"
+	case "in":
+		packets, bytes = "(total_packets - packets_sent)", "(total_bytes - bytes_sent)"
+	}
+	orderBy := bytes
+	if q.By == "packets" {
+		orderBy = packets
+	}
+
+	rows, err := d.db.Query(`
+		SELECT ip, hostname, country, total_packets, total_bytes, packets_sent, bytes_sent, first_seen, last_seen
+		FROM ip_stats WHERE `+packets+` > 0 ORDER BY `+orderBy+` DESC LIMIT ?`, q.Top)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	stats := []IPStats{}
+	for rows.Next() {
+		var s IPStats
+		var hostname, country sql.NullString
+		var totalPackets, totalBytes int64
+		var firstSeen, lastSeen sql.NullTime
+		err := rows.Scan(&s.IP, &hostname, &country, &totalPackets, &totalBytes, &s.PacketsSent, &s.BytesSent, &firstSeen, &lastSeen)
+		if err != nil {
+			return nil, err
+		}
+		s.setIPInfo(getIPInfo(s.IP))
+		s.Hostname = hostname.String
+		s.Country = country.String
+		s.PacketsReceived = totalPackets - s.PacketsSent
+		s.BytesReceived = totalBytes - s.BytesSent
+		s.FirstSeen = firstSeen.Time
+		s.LastSeen = lastSeen.Time
+		switch q.Direction {
+		case "out":
+			s.Packets, s.Bytes = s.PacketsSent, s.BytesSent
+		case "in":
+			s.Packets, s.Bytes = s.PacketsReceived, s.BytesReceived
+		default:
+			s.Packets, s.Bytes = totalPackets, totalBytes
+		}
+		stats = append(stats, s)
+	}
+	return stats, rows.Err()
+}
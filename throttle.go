@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxClientRate caps the packets per second a client may ask to be limited to
+const maxClientRate = 10000
+
+// parseClientRate reads a ?rate= or rate message value: the most packets per second to
+// send a client, 0 for no limit
+func parseClientRate(s string) (int, error) {
+	if s == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 || n > maxClientRate {
+		return 0, fmt.Errorf("invalid rate %q (expected 0 to %d packets per second)", s, maxClientRate)
+	}
+	return n, nil
+}
+
+// packetSampler holds a client to at most rate packets a second. Each second's allowance
+// builds up as it passes, and a batch with more packets than there is allowance left is
+// sampled evenly across it rather than cut short, so the client sees the whole period.
+type packetSampler struct {
+	mu      sync.Mutex
+	rate    int // Packets per second, 0 for no limit
+	credit  float64
+	last    time.Time
+	skipped atomic.Int64 // Packets left out by the limit, for /api/clients
+}
+
+// setRate changes the limit, starting with a full second's allowance
+func (s *packetSampler) setRate(rate int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rate = rate
+	s.credit = float64(rate)
+	s.last = time.Now()
+}
+
+// Rate returns the limit in packets per second, 0 for none
+func (s *packetSampler) Rate() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.rate
+}
+
+// take returns how many of n packets may be sent now
+func (s *packetSampler) take(n int) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.rate == 0 {
+		return n
+	}
+	now := time.Now()
+	s.credit = min(s.credit+now.Sub(s.last).Seconds()*float64(s.rate), float64(s.rate))
+	s.last = now
+	k := min(n, int(s.credit))
+	s.credit -= float64(k)
+	s.skipped.Add(int64(n - k))
+	return k
+}
+
+// sample keeps the packets of a batch the client's limit allows, spread evenly across it
+func (s *packetSampler) sample(batch []Packet) []Packet {
+	k := s.take(len(batch))
+	if k == len(batch) {
+		return batch
+	}
+	sampled := make([]Packet, k)
+	for i := range sampled {
+		sampled[i] = batch[i*len(batch)/k]
+	}
+	return sampled
+}
+
+// setPaused stops or restarts the client's packets, answering with a throttle message.
+// Unlike unsubscribing, it leaves the client's channels as they are.
+func (c *wsClient) setPaused(paused bool) {
+	c.paused.Store(paused)
+	c.replyThrottle(nil)
+}
+
+// setRate changes the client's packet limit, answering with a throttle message
+func (c *wsClient) setRate(rate string) {
+	n, err := parseClientRate(rate)
+	if err == nil {
+		c.sampler.setRate(n)
+	}
+	c.replyThrottle(err)
+}
+
+// replyThrottle answers a pause, unpause or rate message with the settings in effect
+func (c *wsClient) replyThrottle(err error) {
+	reply := map[string]interface{}{
+		"paused": c.paused.Load(),
+		"rate":   c.sampler.Rate(),
+	}
+	if err != nil {
+		reply["error"] = err.Error()
+	}
+	c.reply("throttle", reply)
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// Default locations for the generated certificate, next to the default database
+const (
+	selfSignedCertFile = "pitrack-cert.pem"
+	selfSignedKeyFile  = "pitrack-key.pem"
+)
+
+// TLSOptions selects where the web server's certificate comes from: PEM files (e.g. from
+// certbot), a self-signed certificate generated on first run, or Let's Encrypt via ACME.
+// With none set the server speaks plain HTTP.
+type TLSOptions struct {
+	CertFile   string
+	KeyFile    string
+	SelfSigned bool
+
+	ACMEDomains []string
+	ACMEEmail   string
+	ACMECache   string // Directory keeping the ACME account key and issued certificates
+}
+
+// Enabled reports whether the web server should use HTTPS
+func (o TLSOptions) Enabled() bool {
+	return o.CertFile != "" || o.SelfSigned || len(o.ACMEDomains) > 0
+}
+
+// Validate checks the options don't contradict each other, filling in the default
+// self-signed certificate paths
+func (o *TLSOptions) Validate() error {
+	if len(o.ACMEDomains) > 0 && (o.CertFile != "" || o.SelfSigned) {
+		return errors.New("-acme-domains can't be combined with -tls-cert or -tls-self-signed")
+	}
+	if o.SelfSigned {
+		if o.CertFile == "" {
+			o.CertFile = selfSignedCertFile
+		}
+		if o.KeyFile == "" {
+			o.KeyFile = selfSignedKeyFile
+		}
+	}
+	if (o.CertFile == "") != (o.KeyFile == "") {
+		return errors.New("-tls-cert and -tls-key must be set together")
+	}
+	return nil
+}
+
+// ServerConfig builds the TLS configuration for the web server. The returned handler
+// answers ACME HTTP-01 challenges and redirects everything else to HTTPS; it is meant for
+// the plain-HTTP listener on -http-redirect-port.
+func (o TLSOptions) ServerConfig(httpsPort int) (*tls.Config, http.Handler, error) {
+	redirect := httpsRedirect(httpsPort)
+
+	if len(o.ACMEDomains) > 0 {
+		m := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(o.ACMEDomains...),
+			Cache:      autocert.DirCache(o.ACMECache),
+			Email:      o.ACMEEmail,
+		}
+		// The manager's config also answers TLS-ALPN-01 challenges, so certificates can be
+		// issued over port 443 alone
+		return m.TLSConfig(), m.HTTPHandler(redirect), nil
+	}
+
+	if o.SelfSigned {
+		if err := ensureSelfSigned(o.CertFile, o.KeyFile); err != nil {
+			return nil, nil, err
+		}
+	}
+	certs := &certReloader{certFile: o.CertFile, keyFile: o.KeyFile}
+	cert, err := certs.load()
+	if err != nil {
+		return nil, nil, err
+	}
+	if leaf, err := x509.ParseCertificate(cert.Certificate[0]); err == nil {
+		sum := sha256.Sum256(leaf.Raw)
+		log.Printf("TLS certificate %s expires %s (SHA-256 fingerprint %s)",
+			o.CertFile, leaf.NotAfter.Format("2006-01-02"), strings.ToUpper(hex.EncodeToString(sum[:])))
+	}
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: certs.GetCertificate,
+	}, redirect, nil
+}
+
+// httpsRedirect sends plain-HTTP requests to the same path on the HTTPS port
+func httpsRedirect(httpsPort int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if httpsPort != 443 {
+			host = net.JoinHostPort(host, fmt.Sprint(httpsPort))
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
+
+// certReloader serves a certificate from PEM files, reloading them when the certificate
+// file changes so renewals (certbot, or a regenerated self-signed certificate) take effect
+// without a restart
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+func (c *certReloader) load() (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	info, err := os.Stat(c.certFile)
+	if err != nil {
+		if c.cert != nil {
+			return c.cert, nil
+		}
+		return nil, err
+	}
+	if c.cert != nil && info.ModTime().Equal(c.modTime) {
+		return c.cert, nil
+	}
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		if c.cert != nil {
+			// Probably caught halfway through a renewal; keep serving the old one
+			log.Printf("Failed to reload TLS certificate: %v", err)
+			return c.cert, nil
+		}
+		return nil, err
+	}
+	c.cert, c.modTime = &cert, info.ModTime()
+	return c.cert, nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return c.load()
+}
+
+// ensureSelfSigned generates a self-signed certificate and key unless usable ones are
+// already there. An expired certificate is replaced.
+func ensureSelfSigned(certFile, keyFile string) error {
+	if cert, err := tls.LoadX509KeyPair(certFile, keyFile); err == nil {
+		if leaf, err := x509.ParseCertificate(cert.Certificate[0]); err == nil && time.Now().Before(leaf.NotAfter) {
+			return nil
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+	hostname, _ := os.Hostname()
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"Pi-Track"}, CommonName: hostname},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              []string{"localhost"},
+	}
+	// Cover the names and addresses the banner tells users to browse to
+	if hostname != "" {
+		tmpl.DNSNames = append(tmpl.DNSNames, hostname, hostname+".local")
+	}
+	addrs, _ := net.InterfaceAddrs()
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ipnet.IP)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		return err
+	}
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644); err != nil {
+		return err
+	}
+	log.Printf("Generated self-signed TLS certificate %s", certFile)
+	return nil
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Groupings for /api/top
+const (
+	topGroupApplication = "application"
+	topGroupCountry     = "country"
+	topGroupDomain      = "domain"
+	topGroupDevice      = "device"
+	topGroupPort        = "port"
+)
+
+// TopQuery ranks stored traffic for /api/top
+type TopQuery struct {
+	Group     string // One of the topGroup constants
+	By        string // "bytes" or "packets"
+	StartTime *time.Time
+	EndTime   *time.Time
+	N         int
+}
+
+// TopEntry is the traffic of one group member
+type TopEntry struct {
+	Key     string  `json:"key,omitempty"`
+	Label   string  `json:"label,omitempty"` // Friendly name of a device or service of a port, when known
+	Packets int64   `json:"packets"`
+	Bytes   int64   `json:"bytes"`
+	Share   float64 `json:"share"` // Percentage of the total, by the ranking measure
+}
+
+// TopResult is the top N of a grouping, with what the rest add up to
+type TopResult struct {
+	Group   string     `json:"group"`
+	By      string     `json:"by"`
+	From    *time.Time `json:"from,omitempty"`
+	To      *time.Time `json:"to,omitempty"`
+	Entries []TopEntry `json:"entries"`
+	Other   TopEntry   `json:"other"` // Everything outside the top N
+	Total   TopEntry   `json:"total"`
+}
+
+// parseTopQuery reads the /api/top parameters, defaulting to the top 25 applications by
+// bytes over the last 24 hours
+func parseTopQuery(r *http.Request) (TopQuery, error) {
+	v := r.URL.Query()
+	q := TopQuery{Group: topGroupApplication, By: "bytes", N: 25}
+
+	if s := v.Get("group"); s != "" {
+		switch s {
+		case topGroupApplication, topGroupCountry, topGroupDomain, topGroupDevice, topGroupPort:
+			q.Group = s
+		default:
+			return q, fmt.Errorf("invalid group %q (expected application, country, domain, device or port)", s)
+		}
+	}
+	if s := v.Get("by"); s != "" {
+		if s != "bytes" && s != "packets" {
+			return q, fmt.Errorf("invalid by %q (expected bytes or packets)", s)
+		}
+		q.By = s
+	}
+	if s := v.Get("n"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			return q, fmt.Errorf("invalid n %q", s)
+		}
+		if n > 1000 {
+			n = 1000
+		}
+		q.N = n
+	}
+
+	var err error
+	if q.StartTime, q.EndTime, err = parseFromTo(v); err != nil {
+		return q, err
+	}
+	if q.StartTime == nil && q.EndTime == nil {
+		t := time.Now().Add(-24 * time.Hour)
+		q.StartTime = &t
+	}
+	return q, nil
+}
+
+// topCounts accumulates traffic per group member
+type topCounts map[string]*TopEntry
+
+func (c topCounts) add(key string, packets, bytes int64) {
+	if key == "" {
+		return
+	}
+	e := c[key]
+	if e == nil {
+		e = &TopEntry{Key: key}
+		c[key] = e
+	}
+	e.Packets += packets
+	e.Bytes += bytes
+}
+
+// scan adds the (key, packets, bytes) rows of a query
+func (c topCounts) scan(db packetQuerier, query string, args []interface{}, key func(string) string) error {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var k string
+		var packets, bytes int64
+		if err := rows.Scan(&k, &packets, &bytes); err != nil {
+			return err
+		}
+		if key != nil {
+			k = key(k)
+		}
+		c.add(k, packets, bytes)
+	}
+	return rows.Err()
+}
+
+// GetTop ranks traffic in the range by the query's grouping. Applications come from the
+// hourly rollups; devices from the raw packets plus the per-device rollups of packets that
+// have since been downsampled; countries, domains and ports from the raw packets, so they
+// only reach as far back as packet retention.
+func (d *Database) GetTop(q TopQuery) (*TopResult, error) {
+	counts := make(topCounts)
+
+	packetRange, packetArgs := "", []interface{}{}
+	hourRange, hourArgs := "", []interface{}{}
+	if q.StartTime != nil {
+		packetRange += " AND timestamp >= ?"
+		packetArgs = append(packetArgs, q.StartTime)
+		hourRange += " AND hour >= ?"
+		hourArgs = append(hourArgs, q.StartTime.Truncate(time.Hour).Unix())
+	}
+	if q.EndTime != nil {
+		packetRange += " AND timestamp <= ?"
+		packetArgs = append(packetArgs, q.EndTime)
+		hourRange += " AND hour <= ?"
+		hourArgs = append(hourArgs, q.EndTime.Unix())
+	}
+	// For queries reading each packet from both ends
+	bothArgs := append(append([]interface{}{}, packetArgs...), packetArgs...)
+
+	var err error
+	switch q.Group {
+	case topGroupApplication:
+		err = counts.scan(d.db, `
+			SELECT application, SUM(packets), SUM(bytes) FROM traffic_hourly
+			WHERE application != ''`+hourRange+` GROUP BY application`, hourArgs, nil)
+
+	case topGroupDevice:
+		err = d.topDevices(counts, packetRange, packetArgs, hourRange, hourArgs)
+
+	default:
+		var query string
+		var args []interface{}
+		var key func(string) string
+		switch q.Group {
+		case topGroupCountry:
+			// Count each packet against its remote side, as the geo map does
+			query = `
+				SELECT country, COUNT(*), SUM(length) FROM (
+					SELECT src_country AS country, length FROM packets
+					WHERE src_country IS NOT NULL AND src_country NOT IN ('', 'Local')` + packetRange + `
+					UNION ALL
+					SELECT dst_country, length FROM packets
+					WHERE dst_country IS NOT NULL AND dst_country NOT IN ('', 'Local')` + packetRange + `
+				) GROUP BY country`
+			args = bothArgs
+		case topGroupDomain:
+			// Remote hostnames, folded into their domain
+			query = `
+				SELECT hostname, COUNT(*), SUM(length) FROM (
+					SELECT src_hostname AS hostname, length FROM packets
+					WHERE src_hostname IS NOT NULL AND src_hostname != '' AND src_country != 'Local'` + packetRange + `
+					UNION ALL
+					SELECT dst_hostname, length FROM packets
+					WHERE dst_hostname IS NOT NULL AND dst_hostname != '' AND dst_country != 'Local'` + packetRange + `
+				) GROUP BY hostname`
+			args = bothArgs
+			key = func(hostname string) string {
+				if net.ParseIP(hostname) != nil {
+					return hostname
+				}
+				_, base := splitDNSName(hostname)
+				return base
+			}
+		case topGroupPort:
+			// The lower port of a conversation is taken to be the service
+			query = `
+				SELECT (CASE WHEN src_port < dst_port THEN src_port ELSE dst_port END) || '/' || COALESCE(protocol, ''), COUNT(*), SUM(length)
+				FROM packets WHERE src_port > 0 AND dst_port > 0` + packetRange + `
+				GROUP BY 1`
+			args = packetArgs
+		}
+
+		db, release, perr := d.packetsBetween(q.StartTime, q.EndTime)
+		if perr != nil {
+			return nil, perr
+		}
+		err = counts.scan(db, query, args, key)
+		release()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return rankTop(q, counts), nil
+}
+
+// topDevices adds what each LAN device sent and received, counted as downsampling does:
+// senders with everything they send, receivers only with unicast
+func (d *Database) topDevices(counts topCounts, packetRange string, packetArgs []interface{}, hourRange string, hourArgs []interface{}) error {
+	// Days moved to daily files were rolled up when they moved, so only the main table is read
+	rows, err := d.db.Query(`
+		SELECT src_mac, src_ip, dst_mac, dst_ip, COUNT(*), SUM(length) FROM packets
+		WHERE 1=1`+packetRange+` GROUP BY src_mac, src_ip, dst_mac, dst_ip`, packetArgs...)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var srcMAC, srcIP, dstMAC, dstIP sql.NullString
+		var packets, bytes int64
+		if err := rows.Scan(&srcMAC, &srcIP, &dstMAC, &dstIP, &packets, &bytes); err != nil {
+			rows.Close()
+			return err
+		}
+		p := Packet{SrcMAC: srcMAC.String, SrcIP: srcIP.String, DstMAC: dstMAC.String, DstIP: dstIP.String}
+		if ip := net.ParseIP(p.SrcIP); ip != nil && ip.IsPrivate() {
+			counts.add(deviceKey(p.SrcMAC, p.SrcIP), packets, bytes)
+		}
+		if ip := net.ParseIP(p.DstIP); ip != nil && ip.IsPrivate() && classifyCast(p) == castUnicast {
+			counts.add(deviceKey(p.DstMAC, p.DstIP), packets, bytes)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	return counts.scan(d.db, `
+		SELECT device, SUM(packets_sent + packets_received), SUM(bytes_sent + bytes_received)
+		FROM device_hourly WHERE 1=1`+hourRange+` GROUP BY device`, hourArgs, nil)
+}
+
+// rankTop sorts the counts by the query's measure and keeps the top N
+func rankTop(q TopQuery, counts topCounts) *TopResult {
+	result := &TopResult{Group: q.Group, By: q.By, From: q.StartTime, To: q.EndTime, Entries: []TopEntry{}}
+	value := func(e *TopEntry) int64 {
+		if q.By == "packets" {
+			return e.Packets
+		}
+		return e.Bytes
+	}
+
+	entries := make([]*TopEntry, 0, len(counts))
+	for _, e := range counts {
+		entries = append(entries, e)
+		result.Total.Packets += e.Packets
+		result.Total.Bytes += e.Bytes
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if vi, vj := value(entries[i]), value(entries[j]); vi != vj {
+			return vi > vj
+		}
+		return entries[i].Key < entries[j].Key
+	})
+
+	total := value(&result.Total)
+	for i, e := range entries {
+		if total > 0 {
+			e.Share = float64(value(e)) * 100 / float64(total)
+		}
+		if i < q.N {
+			result.Entries = append(result.Entries, *e)
+		} else {
+			result.Other.Packets += e.Packets
+			result.Other.Bytes += e.Bytes
+			result.Other.Share += e.Share
+		}
+	}
+	result.Total.Share = 100
+	if total == 0 {
+		result.Total.Share = 0
+	}
+	return result
+}
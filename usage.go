@@ -0,0 +1,260 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Usage periods, as used by data cap rules and the usage API
+const (
+	usagePeriodDay   = "day"
+	usagePeriodMonth = "month"
+)
+
+// usageFlushInterval is how often accumulated usage is written to the database
+const usageFlushInterval = time.Minute
+
+// usageKey identifies one row of the daily usage table
+type usageKey struct {
+	day    string // YYYY-MM-DD in local time
+	device string
+}
+
+// DeviceUsage is how much one device transferred in a period
+type DeviceUsage struct {
+	Device string `json:"device"`
+	IP     string `json:"ip,omitempty"` // Last LAN address seen
+	Bytes  int64  `json:"bytes"`
+}
+
+// UsageTracker accounts bytes sent and received per device per calendar day, so
+// data caps hold across restarts. Daily totals are kept in the device_usage table.
+type UsageTracker struct {
+	db *Database
+
+	mu      sync.Mutex
+	day     string
+	today   map[string]int64
+	month   map[string]int64
+	pending map[usageKey]int64
+	byIP    map[string]string // LAN IP -> device
+}
+
+// NewUsageTracker creates a tracker, loading this day's and month's usage from the database
+func NewUsageTracker(db *Database) *UsageTracker {
+	ut := &UsageTracker{
+		db:      db,
+		pending: make(map[usageKey]int64),
+		byIP:    make(map[string]string),
+	}
+	ut.rollover(time.Now().Format("2006-01-02"))
+	return ut
+}
+
+// rollover switches to a new day, resetting the month too when it changes. On startup,
+// whatever was stored earlier today and this month is loaded. Must be called with ut.mu held.
+func (ut *UsageTracker) rollover(day string) {
+	starting := ut.day == ""
+	if starting || ut.day[:7] != day[:7] {
+		ut.month = make(map[string]int64)
+	}
+	ut.day = day
+	ut.today = make(map[string]int64)
+	if !starting || ut.db == nil {
+		return
+	}
+
+	if usage, err := ut.db.GetDeviceUsage(day[:7]+"-01", day[:7]+"-31"); err == nil {
+		ut.month = usage
+	} else {
+		log.Printf("Error loading device usage: %v", err)
+	}
+	if usage, err := ut.db.GetDeviceUsage(day, day); err == nil {
+		ut.today = usage
+	} else {
+		log.Printf("Error loading device usage: %v", err)
+	}
+}
+
+// Start flushes usage to the database in the background
+func (ut *UsageTracker) Start() {
+	if ut.db == nil {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(usageFlushInterval)
+		for range ticker.C {
+			ut.Flush()
+		}
+	}()
+}
+
+// Flush writes pending usage to the database
+func (ut *UsageTracker) Flush() {
+	if ut.db == nil {
+		return
+	}
+	ut.mu.Lock()
+	pending := ut.pending
+	ut.pending = make(map[usageKey]int64)
+	ut.mu.Unlock()
+
+	if len(pending) == 0 {
+		return
+	}
+	if err := ut.db.AddDeviceUsage(pending); err != nil {
+		log.Printf("Error saving device usage: %v", err)
+		// Put it back so it is retried on the next flush
+		ut.mu.Lock()
+		for k, v := range pending {
+			ut.pending[k] += v
+		}
+		ut.mu.Unlock()
+	}
+}
+
+// add credits bytes to a device. Must be called with ut.mu held.
+func (ut *UsageTracker) add(device, ip string, length int64) {
+	if device == "" {
+		return
+	}
+	ut.today[device] += length
+	ut.month[device] += length
+	ut.pending[usageKey{ut.day, device}] += length
+	if parsed := net.ParseIP(ip); parsed != nil && parsed.IsPrivate() {
+		ut.byIP[ip] = device
+	}
+}
+
+// Observe implements PacketObserver. Accounting matches the device tracker: senders are
+// credited with everything they send, receivers only with unicast.
+func (ut *UsageTracker) Observe(p Packet) {
+	length := int64(p.Length)
+	day := p.Timestamp.Local().Format("2006-01-02")
+
+	ut.mu.Lock()
+	defer ut.mu.Unlock()
+
+	if day > ut.day {
+		ut.rollover(day)
+	}
+	ut.add(deviceKey(p.SrcMAC, p.SrcIP), p.SrcIP, length)
+	if classifyCast(p) == castUnicast {
+		ut.add(deviceKey(p.DstMAC, p.DstIP), p.DstIP, length)
+	}
+}
+
+// Usage returns every device's usage in the current day or month, highest first
+func (ut *UsageTracker) Usage(period string) ([]DeviceUsage, error) {
+	ut.mu.Lock()
+	defer ut.mu.Unlock()
+
+	var totals map[string]int64
+	switch period {
+	case usagePeriodDay, "":
+		totals = ut.today
+	case usagePeriodMonth:
+		totals = ut.month
+	default:
+		return nil, fmt.Errorf("unknown period %q, expected day or month", period)
+	}
+
+	ips := make(map[string]string, len(ut.byIP))
+	for ip, device := range ut.byIP {
+		ips[device] = ip
+	}
+	usage := make([]DeviceUsage, 0, len(totals))
+	for device, bytes := range totals {
+		usage = append(usage, DeviceUsage{Device: device, IP: ips[device], Bytes: bytes})
+	}
+	sort.Slice(usage, func(i, j int) bool {
+		return usage[i].Bytes > usage[j].Bytes
+	})
+	return usage, nil
+}
+
+// Bytes returns the usage of one device (by MAC or LAN IP) in the current day or month
+func (ut *UsageTracker) Bytes(period, device string) int64 {
+	ut.mu.Lock()
+	defer ut.mu.Unlock()
+
+	device = strings.ToLower(device)
+	if mapped, ok := ut.byIP[device]; ok {
+		device = mapped
+	}
+	if period == usagePeriodMonth {
+		return ut.month[device]
+	}
+	return ut.today[device]
+}
+
+func createUsageTables(db *sql.DB) error {
+	schema := `
+	CREATE TABLE IF NOT EXISTS device_usage (
+		day TEXT NOT NULL,
+		device TEXT NOT NULL,
+		bytes INTEGER DEFAULT 0,
+		PRIMARY KEY (day, device)
+	);
+	`
+
+	if _, err := db.Exec(schema); err != nil {
+		return fmt.Errorf("failed to create usage schema: %v", err)
+	}
+	return nil
+}
+
+// AddDeviceUsage adds bytes to the daily usage rows
+func (d *Database) AddDeviceUsage(usage map[usageKey]int64) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(`
+		INSERT INTO device_usage (day, device, bytes) VALUES (?, ?, ?)
+		ON CONFLICT (day, device) DO UPDATE SET bytes = bytes + excluded.bytes
+	`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for k, bytes := range usage {
+		if _, err := stmt.Exec(k.day, k.device, bytes); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// GetDeviceUsage returns bytes per device summed over the given days (YYYY-MM-DD, inclusive)
+func (d *Database) GetDeviceUsage(firstDay, lastDay string) (map[string]int64, error) {
+	rows, err := d.db.Query(`
+		SELECT device, SUM(bytes) FROM device_usage
+		WHERE day >= ? AND day <= ?
+		GROUP BY device
+	`, firstDay, lastDay)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	usage := make(map[string]int64)
+	for rows.Next() {
+		var device string
+		var bytes int64
+		if err := rows.Scan(&device, &bytes); err != nil {
+			return nil, err
+		}
+		usage[device] = bytes
+	}
+	return usage, rows.Err()
+}
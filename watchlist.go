@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// countryWatchlistSetting is where the watched countries are persisted
+const countryWatchlistSetting = "country_watchlist"
+
+// WatchlistHit is traffic between one device and one watched country
+type WatchlistHit struct {
+	Country   string    `json:"country"`
+	Device    string    `json:"device"`   // MAC address, or IP when there is no Ethernet header
+	DeviceIP  string    `json:"deviceIp"` // Last LAN address seen
+	RemoteIP  string    `json:"remoteIp"` // Last remote address seen
+	Domain    string    `json:"domain"`   // TLS SNI when seen, otherwise the remote hostname
+	Bytes     int64     `json:"bytes"`
+	Packets   int64     `json:"packets"`
+	FirstSeen time.Time `json:"firstSeen"`
+	LastSeen  time.Time `json:"lastSeen"`
+
+	reported int64 // Bytes when the alert was last raised
+}
+
+// CountryWatchlist raises an alert when a device exchanges traffic with a country
+// that should never show up, naming the device, domain and bytes involved
+type CountryWatchlist struct {
+	alerts *AlertEngine
+	db     *Database
+
+	mu        sync.Mutex
+	countries map[string]bool
+	hits      map[string]*WatchlistHit // Keyed by device and country
+}
+
+// NewCountryWatchlist creates a watchlist. Countries passed in replace the saved list;
+// when none are, the list saved through the API is used.
+func NewCountryWatchlist(countries []string, alerts *AlertEngine, db *Database) *CountryWatchlist {
+	cw := &CountryWatchlist{
+		alerts:    alerts,
+		db:        db,
+		countries: make(map[string]bool),
+		hits:      make(map[string]*WatchlistHit),
+	}
+
+	codes := normalizeCountries(countries)
+	if len(codes) == 0 && db != nil {
+		if value, ok, err := db.GetSetting(countryWatchlistSetting); err == nil && ok {
+			json.Unmarshal([]byte(value), &codes)
+		}
+	}
+	for _, c := range codes {
+		cw.countries[c] = true
+	}
+	if len(codes) > 0 {
+		log.Printf("Watching for traffic to: %s", strings.Join(codes, ", "))
+	}
+	return cw
+}
+
+// normalizeCountries upper-cases country codes and drops blanks and duplicates
+func normalizeCountries(countries []string) []string {
+	seen := make(map[string]bool)
+	codes := []string{}
+	for _, c := range countries {
+		c = strings.ToUpper(strings.TrimSpace(c))
+		if c == "" || seen[c] {
+			continue
+		}
+		seen[c] = true
+		codes = append(codes, c)
+	}
+	sort.Strings(codes)
+	return codes
+}
+
+// Start raises alerts for new watchlist traffic in the background. Hits are batched
+// per evaluation so the alert carries a meaningful byte count, not a single packet.
+func (cw *CountryWatchlist) Start() {
+	go func() {
+		ticker := time.NewTicker(alertEvalInterval)
+		for range ticker.C {
+			cw.check()
+		}
+	}()
+}
+
+// Observe implements PacketObserver
+func (cw *CountryWatchlist) Observe(p Packet) {
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+	if len(cw.countries) == 0 {
+		return
+	}
+
+	// The remote side is the watched one, the local side is the device
+	var country, remoteIP, remoteHost, deviceMAC, deviceIP string
+	switch {
+	case cw.countries[p.DstCountry]:
+		country, remoteIP, remoteHost = p.DstCountry, p.DstIP, p.DstHostname
+		deviceMAC, deviceIP = p.SrcMAC, p.SrcIP
+	case cw.countries[p.SrcCountry]:
+		country, remoteIP, remoteHost = p.SrcCountry, p.SrcIP, p.SrcHostname
+		deviceMAC, deviceIP = p.DstMAC, p.DstIP
+	default:
+		return
+	}
+
+	device := deviceKey(deviceMAC, deviceIP)
+	key := device + "|" + country
+	h := cw.hits[key]
+	if h == nil {
+		h = &WatchlistHit{Country: country, Device: device, FirstSeen: p.Timestamp}
+		cw.hits[key] = h
+	}
+	h.DeviceIP = deviceIP
+	h.RemoteIP = remoteIP
+	if p.sni != "" {
+		h.Domain = p.sni
+	} else if h.Domain == "" {
+		h.Domain = remoteHost
+	}
+	h.Bytes += int64(p.Length)
+	h.Packets++
+	h.LastSeen = p.Timestamp
+}
+
+// check raises an alert for every hit with traffic since the last check
+func (cw *CountryWatchlist) check() {
+	if cw.alerts == nil {
+		return
+	}
+
+	cw.mu.Lock()
+	var pending []WatchlistHit
+	for _, h := range cw.hits {
+		if h.Bytes > h.reported && cw.countries[h.Country] {
+			h.reported = h.Bytes
+			pending = append(pending, *h)
+		}
+	}
+	cw.mu.Unlock()
+
+	for _, h := range pending {
+		remote := h.RemoteIP
+		if h.Domain != "" {
+			remote = fmt.Sprintf("%s, %s", h.Domain, h.RemoteIP)
+		}
+		cw.alerts.Raise("Watched country", fmt.Sprintf("%s → %s", h.Device, h.Country), severityCritical,
+			fmt.Sprintf("%s (%s) exchanged %s with %s (%s)", h.Device, h.DeviceIP, formatBytes(h.Bytes), h.Country, remote))
+	}
+}
+
+// Countries returns the watched country codes
+func (cw *CountryWatchlist) Countries() []string {
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+
+	codes := make([]string, 0, len(cw.countries))
+	for c := range cw.countries {
+		codes = append(codes, c)
+	}
+	sort.Strings(codes)
+	return codes
+}
+
+// SetCountries replaces the watched countries and persists them
+func (cw *CountryWatchlist) SetCountries(countries []string) error {
+	codes := normalizeCountries(countries)
+	for _, c := range codes {
+		if len(c) != 2 {
+			return fmt.Errorf("invalid country code %q, expected two letters like KP", c)
+		}
+	}
+
+	if cw.db != nil {
+		data, _ := json.Marshal(codes)
+		if err := cw.db.SetSetting(countryWatchlistSetting, string(data)); err != nil {
+			return err
+		}
+	}
+
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+	cw.countries = make(map[string]bool, len(codes))
+	for _, c := range codes {
+		cw.countries[c] = true
+	}
+	return nil
+}
+
+// Hits returns watchlist traffic since startup, most bytes first
+func (cw *CountryWatchlist) Hits() []WatchlistHit {
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+
+	hits := make([]WatchlistHit, 0, len(cw.hits))
+	for _, h := range cw.hits {
+		hits = append(hits, *h)
+	}
+	sort.Slice(hits, func(i, j int) bool {
+		return hits[i].Bytes > hits[j].Bytes
+	})
+	return hits
+}
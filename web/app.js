@@ -3,6 +3,7 @@
 class PiTrack {
     constructor() {
         this.ws = null;
+        this.wsFailures = 0; // Attempts in a row that never opened
         this.packets = [];
         this.stats = null;
         this.connections = [];
@@ -52,6 +53,7 @@ class PiTrack {
     init() {
         this.bindElements();
         this.bindEvents();
+        this.checkAuth();
         this.connect();
         this.startUptimeTimer();
         this.checkDatabase();
@@ -85,6 +87,7 @@ class PiTrack {
             dbModal: document.getElementById('db-modal'),
             dbModalClose: document.getElementById('db-modal-close'),
             dbDetails: document.getElementById('db-details'),
+            logoutBtn: document.getElementById('logout-btn'),
             // History elements
             historyTableBody: document.getElementById('history-table-body'),
             historyFilter: document.getElementById('history-filter'),
@@ -133,6 +136,7 @@ class PiTrack {
                 this.paused = !this.paused;
                 this.elements.pauseBtn.innerHTML = this.paused ? '<i class="bi bi-play-fill"></i> Resume' : '<i class="bi bi-pause-fill"></i> Pause';
                 this.elements.pauseBtn.classList.toggle('active', this.paused);
+                this.sendPaused();
             });
         }
 
@@ -371,20 +375,56 @@ class PiTrack {
         if (this.elements.nukeDbBtn) {
             this.elements.nukeDbBtn.addEventListener('click', () => this.truncateDatabase());
         }
+
+        if (this.elements.logoutBtn) {
+            this.elements.logoutBtn.addEventListener('click', () => this.logout());
+        }
+    }
+
+    // Show the logout button when logged in, or go to the login page when the session has expired
+    checkAuth() {
+        fetch('/api/auth')
+            .then(res => res.json())
+            .then(auth => {
+                if (auth.enabled && !auth.authenticated) {
+                    window.location.href = '/login.html';
+                } else if (auth.enabled && auth.passwordLogin && this.elements.logoutBtn) {
+                    this.elements.logoutBtn.style.display = '';
+                }
+            })
+            .catch(() => {});
+    }
+
+    logout() {
+        fetch('/api/logout', { method: 'POST' })
+            .finally(() => { window.location.href = '/login.html'; });
     }
 
     connect() {
         const protocol = window.location.protocol === 'https:' ? 'wss:' : 'ws:';
-        const wsUrl = `${protocol}//${window.location.host}/ws`;
+        // After a drop, pick up from the last packet seen rather than starting over
+        const resume = this.resumeToken ? `&resume=${encodeURIComponent(this.resumeToken)}` : '';
+        const wsUrl = `${protocol}//${window.location.host}/ws?channels=packets,stats&stats=delta${resume}`;
 
         this.ws = new WebSocket(wsUrl);
+        let opened = false;
 
         this.ws.onopen = () => {
+            opened = true;
+            this.wsFailures = 0;
             this.setConnectionStatus('connected', 'Connected');
+            if (this.paused) this.sendPaused();
         };
 
         this.ws.onclose = () => {
             this.setConnectionStatus('disconnected', 'Disconnected');
+            // The connection is refused once the login expires
+            this.checkAuth();
+            // A proxy that breaks WebSockets fails every attempt; use Server-Sent Events instead
+            if (!opened && ++this.wsFailures >= 3) {
+                this.connectEvents();
+                return;
+            }
             // Reconnect after 3 seconds
             setTimeout(() => this.connect(), 3000);
         };
@@ -399,7 +439,35 @@ class PiTrack {
         };
     }
 
+    // While paused the server holds packets back rather than sending them to be dropped
+    sendPaused() {
+        if (this.ws && this.ws.readyState === WebSocket.OPEN) {
+            this.ws.send(JSON.stringify({ type: this.paused ? 'pause' : 'unpause' }));
+        }
+    }
+
+    connectEvents() {
+        const events = new EventSource('/events?channels=packets,stats&stats=delta');
+
+        events.onopen = () => {
+            this.setConnectionStatus('connected', 'Connected');
+        };
+
+        // EventSource reconnects by itself
+        events.onerror = () => {
+            this.setConnectionStatus('disconnected', 'Disconnected');
+            this.checkAuth();
+        };
+
+        events.onmessage = (event) => {
+            this.handleMessage(JSON.parse(event.data));
+        };
+    }
+
     handleMessage(message) {
+        if (message.resume) {
+            this.resumeToken = message.resume;
+        }
         switch (message.type) {
             case 'init':
                 this.handleInit(message.data);
@@ -407,14 +475,27 @@ class PiTrack {
             case 'packet':
                 this.handlePacket(message.data);
                 break;
+            case 'packets':
+                message.data.forEach(packet => this.handlePacket(packet));
+                break;
             case 'stats':
                 this.handleStats(message.data);
                 break;
+            case 'statsDelta':
+                this.handleStatsDelta(message.data);
+                break;
+            case 'slow':
+                // The server stopped sending packets because this browser couldn't keep up
+                this.setConnectionStatus('connected', 'Connected (live packets paused: ' + message.data.reason + ')');
+                break;
         }
     }
 
     handleInit(data) {
-        this.packets = data.packets || [];
+        // A resumed connection sends the missed packets next instead
+        if (data.packets) {
+            this.packets = data.packets;
+        }
         this.stats = data.stats;
         this.connections = data.connections || [];
         this.startTime = new Date(data.stats.startTime);
@@ -445,6 +526,23 @@ class PiTrack {
         this.renderStats();
     }
 
+    // Deltas hold only the counters that changed, with their new values
+    handleStatsDelta(delta) {
+        if (delta.full || !this.stats) {
+            delete delta.full;
+            this.handleStats(delta);
+            return;
+        }
+        for (const [key, value] of Object.entries(delta)) {
+            if (value && typeof value === 'object' && !Array.isArray(value)) {
+                this.stats[key] = Object.assign(this.stats[key] || {}, value);
+            } else {
+                this.stats[key] = value;
+            }
+        }
+        this.handleStats(this.stats);
+    }
+
     setConnectionStatus(status, text) {
         if (!this.elements.connectionStatus) return;
         this.elements.connectionStatus.className = `nav-icon-btn ${status}`;
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+// Webhook delivery retries with exponential backoff: 1s, 2s, 4s, 8s
+const (
+	webhookAttempts       = 5
+	webhookInitialBackoff = time.Second
+)
+
+// WebhookPayload is the JSON body POSTed for each alert state change
+type WebhookPayload struct {
+	Event  string    `json:"event"` // "alert.firing" or "alert.resolved"
+	Host   string    `json:"host"`
+	SentAt time.Time `json:"sentAt"`
+	Alert  Alert     `json:"alert"`
+}
+
+// WebhookNotifier POSTs alerts as JSON to a URL
+type WebhookNotifier struct {
+	url    string
+	client *http.Client
+}
+
+// NewWebhookNotifier creates a notifier for the given http(s) URL
+func NewWebhookNotifier(rawURL string) (*WebhookNotifier, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid webhook URL %q", rawURL)
+	}
+	return &WebhookNotifier{
+		url:    rawURL,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+// Name implements AlertNotifier
+func (wn *WebhookNotifier) Name() string {
+	return "webhook"
+}
+
+// Notify implements AlertNotifier, retrying failed deliveries with backoff
+func (wn *WebhookNotifier) Notify(a Alert) error {
+	hostname, _ := os.Hostname()
+	return postJSONWithRetry(wn.client, wn.url, WebhookPayload{
+		Event:  "alert." + a.State,
+		Host:   hostname,
+		SentAt: time.Now().UTC(),
+		Alert:  a,
+	})
+}
+
+// postJSONWithRetry POSTs v as JSON, retrying transient failures with exponential backoff.
+// Shared by the webhook, chat and push notifiers.
+func postJSONWithRetry(client *http.Client, target string, v interface{}) error {
+	return postJSONWithHeaders(client, target, nil, v)
+}
+
+// postJSONWithHeaders is postJSONWithRetry with extra request headers, e.g. for authorization
+func postJSONWithHeaders(client *http.Client, target string, header http.Header, v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	backoff := webhookInitialBackoff
+	for attempt := 1; ; attempt++ {
+		retry, err := postJSON(client, target, header, body)
+		if err == nil {
+			return nil
+		}
+		if !retry || attempt == webhookAttempts {
+			return fmt.Errorf("giving up after %d attempts: %v", attempt, err)
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// postJSON sends one delivery, reporting whether a failure is worth retrying
+func postJSON(client *http.Client, target string, header http.Header, body []byte) (retry bool, err error) {
+	req, err := http.NewRequest(http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "pi-track")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return true, fmt.Errorf("server returned %s", resp.Status)
+	default:
+		// Other client errors won't go away by sending the same request again
+		return false, fmt.Errorf("server returned %s", resp.Status)
+	}
+}
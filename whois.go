@@ -0,0 +1,359 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RDAP settings. IANA's bootstrap files say which registry answers for each range.
+const (
+	rdapBootstrapV4URL   = "https://data.iana.org/rdap/ipv4.json"
+	rdapBootstrapV6URL   = "https://data.iana.org/rdap/ipv6.json"
+	rdapBootstrapRefresh = 7 * 24 * time.Hour
+	rdapCacheTTL         = 24 * time.Hour
+	rdapCacheSize        = 1000            // Netblocks kept; the oldest goes beyond this
+	rdapFailureTTL       = 5 * time.Minute // Before a failed address is asked about again
+)
+
+var (
+	errNoRDAPRecord  = errors.New("no RDAP record for this address")
+	errNotPublicAddr = errors.New("not a public address")
+)
+
+// WhoisContact is an entity named in a netblock's record
+type WhoisContact struct {
+	Handle string `json:"handle,omitempty"`
+	Name   string `json:"name,omitempty"`
+	Email  string `json:"email,omitempty"`
+	Phone  string `json:"phone,omitempty"`
+}
+
+// WhoisResult is what the registry knows about the netblock an address is in
+type WhoisResult struct {
+	IP           string        `json:"ip"` // Address asked about
+	Handle       string        `json:"handle"`
+	Name         string        `json:"name"`           // e.g. "GOGL"
+	Type         string        `json:"type,omitempty"` // e.g. "DIRECT ALLOCATION"
+	StartAddress string        `json:"startAddress"`
+	EndAddress   string        `json:"endAddress"`
+	CIDRs        []string      `json:"cidrs,omitempty"`
+	Country      string        `json:"country,omitempty"`
+	Owner        *WhoisContact `json:"owner,omitempty"`
+	Abuse        *WhoisContact `json:"abuse,omitempty"`
+	Registered   *time.Time    `json:"registered,omitempty"`
+	LastChanged  *time.Time    `json:"lastChanged,omitempty"`
+	Source       string        `json:"source"` // URL the registry answered at
+	FetchedAt    time.Time     `json:"fetchedAt"`
+	Cached       bool          `json:"cached"`
+}
+
+// whoisEntry is a cached netblock, found again for any address within it
+type whoisEntry struct {
+	start, end net.IP // 16-byte form
+	result     WhoisResult
+	expires    time.Time
+}
+
+// WhoisClient looks up the owner and abuse contact of an address's netblock over RDAP,
+// asking the registry IANA's bootstrap files point at. Answers are cached by netblock
+// for a day, so investigating neighbouring addresses asks once, and failures for a few
+// minutes.
+type WhoisClient struct {
+	client *http.Client
+
+	mu          sync.Mutex
+	servers     *cloudTable // Registry base URL by range, in each tag's Service
+	bootstrapAt time.Time
+	entries     []*whoisEntry // Oldest first
+	failures    map[string]whoisFailure
+}
+
+type whoisFailure struct {
+	err   error
+	until time.Time
+}
+
+// NewWhoisClient creates a client with an empty cache
+func NewWhoisClient() *WhoisClient {
+	return &WhoisClient{
+		client:   &http.Client{Timeout: 15 * time.Second},
+		failures: make(map[string]whoisFailure),
+	}
+}
+
+// Lookup returns the netblock record for a public address
+func (c *WhoisClient) Lookup(parsed net.IP) (WhoisResult, error) {
+	if isPrivateIP(parsed) || !parsed.IsGlobalUnicast() {
+		return WhoisResult{}, errNotPublicAddr
+	}
+	ip, ip16 := parsed.String(), parsed.To16()
+
+	c.mu.Lock()
+	if result, ok := c.cached(ip16); ok {
+		c.mu.Unlock()
+		result.IP = ip
+		return result, nil
+	}
+	if f, ok := c.failures[ip]; ok && time.Now().Before(f.until) {
+		c.mu.Unlock()
+		return WhoisResult{}, f.err
+	}
+	c.mu.Unlock()
+
+	result, err := c.fetch(parsed)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err != nil {
+		c.failures[ip] = whoisFailure{err, time.Now().Add(rdapFailureTTL)}
+		return WhoisResult{}, err
+	}
+	delete(c.failures, ip)
+	entry := &whoisEntry{result: result, expires: result.FetchedAt.Add(rdapCacheTTL)}
+	entry.start, entry.end = net.ParseIP(result.StartAddress).To16(), net.ParseIP(result.EndAddress).To16()
+	if entry.start != nil && entry.end != nil {
+		c.entries = append(c.entries, entry)
+		if len(c.entries) > rdapCacheSize {
+			c.entries = c.entries[len(c.entries)-rdapCacheSize:]
+		}
+	}
+	result.IP = ip
+	return result, nil
+}
+
+// cached returns the smallest unexpired netblock containing an address. Callers hold mu.
+func (c *WhoisClient) cached(ip16 net.IP) (WhoisResult, bool) {
+	now := time.Now()
+	var best *whoisEntry
+	kept := c.entries[:0]
+	for _, e := range c.entries {
+		if now.After(e.expires) {
+			continue
+		}
+		kept = append(kept, e)
+		if bytes.Compare(ip16, e.start) < 0 || bytes.Compare(ip16, e.end) > 0 {
+			continue
+		}
+		if best == nil || bytes.Compare(e.start, best.start) >= 0 && bytes.Compare(e.end, best.end) <= 0 {
+			best = e
+		}
+	}
+	c.entries = kept
+	if best == nil {
+		return WhoisResult{}, false
+	}
+	result := best.result
+	result.Cached = true
+	return result, true
+}
+
+// server returns the base URL of the registry answering for an address, downloading the
+// bootstrap files first if they're missing or old
+func (c *WhoisClient) server(ip net.IP) (string, error) {
+	c.mu.Lock()
+	servers := c.servers
+	if servers == nil || time.Since(c.bootstrapAt) > rdapBootstrapRefresh {
+		c.mu.Unlock()
+		table := &cloudTable{}
+		for _, url := range []string{rdapBootstrapV4URL, rdapBootstrapV6URL} {
+			prefixes, err := downloadRangeList(c.client, url, parseRDAPBootstrap)
+			if err != nil {
+				if servers == nil {
+					return "", fmt.Errorf("downloading the RDAP bootstrap: %w", err)
+				}
+				table = nil // Keep using the old one
+				break
+			}
+			for _, p := range prefixes {
+				table.add("rdap", p)
+			}
+		}
+		c.mu.Lock()
+		if table != nil {
+			table.finish()
+			c.servers, c.bootstrapAt = table, time.Now()
+			servers = table
+		}
+	}
+	c.mu.Unlock()
+
+	tag := servers.lookup(ip)
+	if tag == nil {
+		return "", errNoRDAPRecord
+	}
+	return tag.Service, nil
+}
+
+// parseRDAPBootstrap reads an IANA bootstrap file, keeping each range's first HTTPS server
+func parseRDAPBootstrap(body []byte) ([]cloudPrefix, error) {
+	var doc struct {
+		Services [][][]string `json:"services"`
+	}
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return nil, err
+	}
+	prefixes := []cloudPrefix{}
+	for _, service := range doc.Services {
+		if len(service) < 2 || len(service[1]) == 0 {
+			continue
+		}
+		url := service[1][0]
+		for _, u := range service[1] {
+			if strings.HasPrefix(u, "https://") {
+				url = u
+				break
+			}
+		}
+		if !strings.HasSuffix(url, "/") {
+			url += "/"
+		}
+		for _, cidr := range service[0] {
+			prefixes = append(prefixes, cloudPrefix{cidr: cidr, service: url})
+		}
+	}
+	return prefixes, nil
+}
+
+// fetch asks the registry about an address
+func (c *WhoisClient) fetch(ip net.IP) (WhoisResult, error) {
+	base, err := c.server(ip)
+	if err != nil {
+		return WhoisResult{}, err
+	}
+	url := base + "ip/" + ip.String()
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return WhoisResult{}, err
+	}
+	req.Header.Set("Accept", "application/rdap+json")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return WhoisResult{}, err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return WhoisResult{}, errNoRDAPRecord
+	case resp.StatusCode == http.StatusTooManyRequests:
+		return WhoisResult{}, fmt.Errorf("rate limited by %s", base)
+	case resp.StatusCode != http.StatusOK:
+		return WhoisResult{}, fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+
+	var network rdapObject
+	if err := json.NewDecoder(resp.Body).Decode(&network); err != nil {
+		return WhoisResult{}, fmt.Errorf("reading %s: %w", url, err)
+	}
+	result := WhoisResult{
+		Handle:       network.Handle,
+		Name:         network.Name,
+		Type:         network.Type,
+		StartAddress: network.StartAddress,
+		EndAddress:   network.EndAddress,
+		Country:      network.Country,
+		Source:       resp.Request.URL.String(), // After any redirect to the registry holding it
+		FetchedAt:    time.Now(),
+	}
+	for _, cidr := range network.CIDRs {
+		prefix := cidr.V4Prefix
+		if prefix == "" {
+			prefix = cidr.V6Prefix
+		}
+		result.CIDRs = append(result.CIDRs, fmt.Sprintf("%s/%d", prefix, cidr.Length))
+	}
+	for _, event := range network.Events {
+		date := event.Date
+		switch event.Action {
+		case "registration":
+			result.Registered = &date
+		case "last changed":
+			result.LastChanged = &date
+		}
+	}
+	if owner := network.findEntity("registrant"); owner != nil {
+		result.Owner = owner.contact()
+	}
+	if abuse := network.findEntity("abuse"); abuse != nil {
+		result.Abuse = abuse.contact()
+	}
+	return result, nil
+}
+
+// rdapObject is the part of an RDAP IP network or entity object that's used
+type rdapObject struct {
+	Handle       string `json:"handle"`
+	Name         string `json:"name"`
+	Type         string `json:"type"`
+	StartAddress string `json:"startAddress"`
+	EndAddress   string `json:"endAddress"`
+	Country      string `json:"country"`
+	CIDRs        []struct {
+		V4Prefix string `json:"v4prefix"`
+		V6Prefix string `json:"v6prefix"`
+		Length   int    `json:"length"`
+	} `json:"cidr0_cidrs"`
+	Events []struct {
+		Action string    `json:"eventAction"`
+		Date   time.Time `json:"eventDate"`
+	} `json:"events"`
+	Roles      []string          `json:"roles"`
+	VCardArray []json.RawMessage `json:"vcardArray"`
+	Entities   []rdapObject      `json:"entities"`
+}
+
+// findEntity returns the first entity with a role, searching nested entities too: ARIN
+// puts the abuse contact under the registrant, RIPE next to it
+func (o *rdapObject) findEntity(role string) *rdapObject {
+	for i := range o.Entities {
+		for _, r := range o.Entities[i].Roles {
+			if r == role {
+				return &o.Entities[i]
+			}
+		}
+	}
+	for i := range o.Entities {
+		if e := o.Entities[i].findEntity(role); e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+// contact reads an entity's name, email and phone from its vCard
+func (o *rdapObject) contact() *WhoisContact {
+	c := &WhoisContact{Handle: o.Handle}
+	if len(o.VCardArray) == 2 {
+		var properties [][]json.RawMessage
+		json.Unmarshal(o.VCardArray[1], &properties)
+		for _, p := range properties {
+			if len(p) < 4 {
+				continue
+			}
+			var name, value string
+			json.Unmarshal(p[0], &name)
+			if json.Unmarshal(p[3], &value) != nil {
+				continue // Structured values, like addresses
+			}
+			switch name {
+			case "fn":
+				c.Name = value
+			case "email":
+				if c.Email == "" {
+					c.Email = value
+				}
+			case "tel":
+				if c.Phone == "" {
+					c.Phone = strings.TrimPrefix(value, "tel:")
+				}
+			}
+		}
+	}
+	return c
+}